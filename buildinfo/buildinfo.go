@@ -0,0 +1,132 @@
+// Package buildinfo lets a service report the version it is running at
+// Path, so the updater's post-update check and fleet tooling can confirm a
+// new version is actually serving rather than only installed
+package buildinfo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Path is where services mount Handler
+const Path = "/__version"
+
+// maxInfoSize caps how much of a version response Fetch reads
+const maxInfoSize = 64 << 10
+
+// Info is what a service reports about its build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version,omitempty"`
+}
+
+// Read returns what the Go toolchain recorded in the running binary: the
+// main module's version and the VCS revision, commit time, and dirty flag
+func Read() Info {
+	info := Info{GoVersion: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	if bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		info.Version = strings.TrimPrefix(bi.Main.Version, "v")
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Commit = setting.Value
+		case "vcs.time":
+			info.Date = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// Merge fills the empty fields of info from Read. Services that stamp their
+// version with -ldflags pass it here, since buildinfo doesn't see it;
+// placeholders like "dev", "none", and "unknown" count as empty.
+func Merge(info Info) Info {
+	read := Read()
+	if placeholder(info.Version) {
+		info.Version = read.Version
+	}
+	if placeholder(info.Commit) {
+		info.Commit = read.Commit
+	}
+	if placeholder(info.Date) {
+		info.Date = read.Date
+	}
+	if info.GoVersion == "" {
+		info.GoVersion = read.GoVersion
+	}
+	info.Modified = info.Modified || read.Modified
+	return info
+}
+
+func placeholder(s string) bool {
+	switch s {
+	case "", "dev", "none", "unknown":
+		return true
+	}
+	return false
+}
+
+// Handler serves info, merged with Read, as JSON
+func Handler(info Info) http.Handler {
+	info = Merge(info)
+	body, _ := json.Marshal(info)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body)
+	})
+}
+
+// Mount registers Handler at Path on mux
+func Mount(mux *http.ServeMux, info Info) {
+	mux.Handle(Path, Handler(info))
+}
+
+// Fetch asks the service at url, the full URL of its version endpoint, which
+// version it is serving
+func Fetch(ctx context.Context, httpClient *http.Client, url string) (Info, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Info{}, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return Info{}, fmt.Errorf("fetch version: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Info{}, fmt.Errorf("fetch version: unexpected status %d", resp.StatusCode)
+	}
+
+	var info Info
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxInfoSize)).Decode(&info); err != nil {
+		return Info{}, fmt.Errorf("decode version: %w", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,30 @@
+// nametag-launcher stands in for nametag in the launcher slot layout. It
+// execs whichever slot the pointer file next to it names, so updates only
+// ever write the inactive slot and never a running executable.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/platform"
+)
+
+func main() {
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nametag-launcher: %v\n", err)
+		os.Exit(1)
+	}
+
+	slot, err := platform.ActiveSlot(self)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nametag-launcher: no active slot for %s (is %s missing?)\n", self, platform.SlotPointerPath(self))
+		os.Exit(1)
+	}
+
+	if err := platform.Reexec(slot, os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "nametag-launcher: %v\n", err)
+		os.Exit(1)
+	}
+}
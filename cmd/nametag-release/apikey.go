@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// apiKeyEntry is an entry of the server's -api-keys file
+type apiKeyEntry struct {
+	Name       string    `json:"name"`
+	KeySHA256  string    `json:"key_sha256"`
+	SigningKey string    `json:"signing_key"`
+	Components []string  `json:"components,omitempty"`
+	Expires    time.Time `json:"expires,omitzero"`
+}
+
+// cmdAPIKey issues an API key and prints the entry to add to the server's
+// key file for it. The entry holds the key's SHA-256 and the signing key
+// derived from it, never the key itself.
+func cmdAPIKey(logger *slog.Logger) {
+	name := flag.String("name", "", "Name of the key holder, shown in the server's logs (required)")
+	components := flag.String("components", "", "Comma-separated components the key may fetch (default: all)")
+	expires := flag.Duration("expires", 0, "How long the key stays valid (0 never expires)")
+	stdin := flag.Bool("stdin", false, "Read an already issued key from standard input instead of generating one")
+	flag.Parse()
+
+	if *name == "" {
+		logger.Error("-name is required")
+		os.Exit(1)
+	}
+
+	var key string
+	if *stdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		key = strings.TrimSpace(line)
+		if key == "" {
+			logger.Error("no key on standard input", "error", err)
+			os.Exit(1)
+		}
+	} else {
+		key = rand.Text()
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	entry := apiKeyEntry{
+		Name:       *name,
+		KeySHA256:  hex.EncodeToString(sum[:]),
+		SigningKey: hex.EncodeToString(update.RequestSigningKey(key)),
+	}
+	if *components != "" {
+		entry.Components = strings.Split(*components, ",")
+	}
+	if *expires > 0 {
+		entry.Expires = time.Now().Add(*expires).UTC().Truncate(time.Second)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("failed to encode key entry", "error", err)
+		os.Exit(1)
+	}
+	if !*stdin {
+		fmt.Fprintf(os.Stderr, "API key (shown once, give it to the key holder): %s\n", key)
+	}
+	fmt.Println(string(data))
+}
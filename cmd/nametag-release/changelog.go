@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// changelogHeading matches version headings such as "## [1.2.0] - 2024-01-01",
+// "## v1.2.0" or "## 1.2.0"
+var changelogHeading = regexp.MustCompile(`^##\s+\[?v?([0-9]+\.[0-9]+\.[0-9]+[^\]\s]*)\]?`)
+
+// conventionalCommit matches "type(scope)!: description" commit subjects
+var conventionalCommit = regexp.MustCompile(`^(\w+)(\([^)]*\))?(!)?:\s*(.+)$`)
+
+// changelogSections orders the conventional commit types included in release
+// notes; other types (chore, ci, docs, ...) are left out
+var changelogSections = []struct {
+	Type  string
+	Title string
+}{
+	{"feat", "Features"},
+	{"fix", "Bug Fixes"},
+	{"perf", "Performance"},
+}
+
+// changelogFromFile returns the body of the CHANGELOG.md section for version
+func changelogFromFile(path, version string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("open changelog: %w", err)
+	}
+	defer f.Close()
+
+	version = strings.TrimPrefix(version, "v")
+
+	var lines []string
+	inSection := false
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if m := changelogHeading.FindStringSubmatch(line); m != nil {
+			if inSection {
+				break
+			}
+			inSection = m[1] == version
+			continue
+		}
+		if inSection && strings.HasPrefix(line, "# ") {
+			break
+		}
+		if inSection {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("read changelog: %w", err)
+	}
+
+	if !inSection {
+		return "", fmt.Errorf("no changelog section for version %s", version)
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+// changelogFromGit builds release notes from conventional commits between
+// two refs. An empty from covers the whole history up to to.
+func changelogFromGit(from, to string) (string, error) {
+	revRange := to
+	if from != "" {
+		revRange = from + ".." + to
+	}
+
+	out, err := exec.Command("git", "log", "--no-merges", "--format=%s", revRange).Output()
+	if err != nil {
+		return "", fmt.Errorf("git log: %w", err)
+	}
+
+	entries := make(map[string][]string)
+	var breaking []string
+
+	for _, subject := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		m := conventionalCommit.FindStringSubmatch(subject)
+		if m == nil {
+			continue
+		}
+
+		commitType, scope, bang, description := m[1], strings.Trim(m[2], "()"), m[3], m[4]
+		if scope != "" {
+			description = "**" + scope + ":** " + description
+		}
+
+		if bang != "" {
+			breaking = append(breaking, description)
+		}
+		entries[commitType] = append(entries[commitType], description)
+	}
+
+	var b strings.Builder
+	writeSection := func(title string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "### %s\n\n", title)
+		for _, item := range items {
+			fmt.Fprintf(&b, "- %s\n", item)
+		}
+	}
+
+	writeSection("Breaking Changes", breaking)
+	for _, section := range changelogSections {
+		writeSection(section.Title, entries[section.Type])
+	}
+
+	return strings.TrimSpace(b.String()), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+func cmdCompanions(logger *slog.Logger) {
+	out := flag.String("out", update.CompanionsFile, "Path to write the index; the files listed are relative to its directory")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: nametag-release companions [-out companions.json] kind=file...")
+		fmt.Fprintf(os.Stderr, "Kinds: %s\n", strings.Join([]string{
+			update.CompanionBash, update.CompanionZsh, update.CompanionFish,
+			update.CompanionPowerShell, update.CompanionMan, update.CompanionConfig,
+		}, ", "))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	dir := filepath.Dir(*out)
+	var files []update.CompanionFile
+	for _, arg := range flag.Args() {
+		kind, file, ok := strings.Cut(arg, "=")
+		if !ok {
+			logger.Error("companion must be given as kind=file", "arg", arg)
+			os.Exit(1)
+		}
+		hash, err := update.FileSHA256(filepath.Join(dir, file))
+		if err != nil {
+			logger.Error("failed to hash companion file", "file", file, "error", err)
+			os.Exit(1)
+		}
+		files = append(files, update.CompanionFile{Path: filepath.ToSlash(file), Kind: kind, SHA256: hash})
+	}
+
+	if err := update.WriteCompanionIndex(*out, files); err != nil {
+		logger.Error("failed to write companions index", "error", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Companions index with %d file(s) written to %s\n", len(files), *out)
+}
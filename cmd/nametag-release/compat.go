@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/compat"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+func cmdCompatRecord(logger *slog.Logger) {
+	serverURL := flag.String("server", "http://localhost:8080", "Server to record, started with -manifest-ttl 876000h")
+	assetsDir := flag.String("assets", "", "The server's assets directory, stored in the fixture (required)")
+	component := flag.String("component", "nametag", "Component to check for")
+	platform := flag.String("platform", "linux-amd64", "Platform whose asset to download")
+	publicKeys := flag.String("public-key", "", "Comma-separated public keys verifying the server's manifest signatures")
+	releaseVersion := flag.String("version", version, "Release the fixture is recorded for")
+	out := flag.String("out", "", "Fixture file to write (required)")
+	timeout := flag.Duration("timeout", time.Minute, "Timeout of the recording")
+	flag.Parse()
+
+	if *assetsDir == "" || *out == "" {
+		logger.Error("-assets and -out are required")
+		os.Exit(1)
+	}
+	var keys []ed25519.PublicKey
+	if *publicKeys != "" {
+		for _, encoded := range strings.Split(*publicKeys, ",") {
+			key, err := update.ParsePublicKey(strings.TrimSpace(encoded))
+			if err != nil {
+				logger.Error("invalid public key", "error", err)
+				os.Exit(1)
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	fixture, err := compat.Record(ctx, *releaseVersion, *serverURL, *assetsDir, *component, *platform, keys)
+	if err != nil {
+		logger.Error("failed to record fixture", "error", err)
+		os.Exit(1)
+	}
+	if err := fixture.Save(*out); err != nil {
+		logger.Error("failed to write fixture", "error", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Recorded %d exchanges with %s into %s\n", len(fixture.Exchanges), *serverURL, *out)
+}
+
+func cmdCompatCheck(logger *slog.Logger) {
+	fixtures := flag.String("fixtures", "compat/fixtures", "Directory of recorded fixtures")
+	serverBinary := flag.String("server-binary", "./bin/server", "Server binary to check against the recorded clients")
+	timeout := flag.Duration("timeout", 5*time.Minute, "Timeout of all checks")
+	flag.Parse()
+
+	loaded, err := compat.LoadDir(*fixtures)
+	if err != nil {
+		logger.Error("failed to load fixtures", "error", err)
+		os.Exit(1)
+	}
+	if len(loaded) == 0 {
+		logger.Error("no fixtures found", "dir", *fixtures)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	failed := 0
+	for _, fixture := range loaded {
+		if err := compat.Run(ctx, fixture, *serverBinary); err != nil {
+			failed++
+			fmt.Printf("FAIL %s\n", fixture.Version)
+			for line := range strings.SplitSeq(err.Error(), "\n") {
+				fmt.Printf("  %s\n", line)
+			}
+			continue
+		}
+		fmt.Printf("ok   %s\n", fixture.Version)
+	}
+
+	if failed > 0 {
+		fmt.Printf("\n%d of %d release(s) incompatible\n", failed, len(loaded))
+		os.Exit(1)
+	}
+}
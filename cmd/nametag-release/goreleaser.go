@@ -0,0 +1,659 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/catalog"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// goreleaserArtifact is an entry of GoReleaser's dist/artifacts.json
+type goreleaserArtifact struct {
+	Name   string         `json:"name"`
+	Path   string         `json:"path"`
+	GOOS   string         `json:"goos"`
+	GOARCH string         `json:"goarch"`
+	Type   string         `json:"type"`
+	Extra  map[string]any `json:"extra"`
+}
+
+// goreleaserMetadata is GoReleaser's dist/metadata.json
+type goreleaserMetadata struct {
+	ProjectName string    `json:"project_name"`
+	Tag         string    `json:"tag"`
+	PreviousTag string    `json:"previous_tag"`
+	Version     string    `json:"version"`
+	Date        time.Time `json:"date"`
+}
+
+// releaseAsset is a binary mapped to its component and platform
+type releaseAsset struct {
+	Component string
+	Platform  string
+	Path      string
+	SHA256    string
+	Size      int64
+	// Hashes are the other supported digests, for the manifest
+	Hashes map[string]string
+	// KeyID names the content key a private asset is encrypted with
+	KeyID string
+	// Provenance is the SLSA provenance attestation published with the asset
+	Provenance string
+}
+
+func cmdGoReleaser(logger *slog.Logger) {
+	dist := flag.String("dist", "./dist", "GoReleaser dist directory")
+	checksums := flag.String("checksums", "", "Checksums file (default: detected from artifacts.json)")
+	releaseVersion := flag.String("version", "", "Release version (default: from metadata.json)")
+	assetsDir := flag.String("assets", "", "Publish binaries into this server assets directory")
+	assetTemplate := flag.String("asset-template", update.DefaultAssetTemplate, "Template for published asset filenames")
+	manifestPath := flag.String("manifest", "", "Write a static manifest to this path")
+	changelogFile := flag.String("changelog-file", "", "Take release notes from this version's section of a CHANGELOG.md")
+	changelogGit := flag.Bool("changelog-git", false, "Generate release notes from conventional commits since the previous tag")
+	force := flag.Bool("force", false, "Replace assets already published with different content (recorded in the audit log)")
+	critical := flag.Bool("critical", false, "Mark the release critical so bandwidth pacing never defers it")
+	manifestTTL := flag.Duration("manifest-ttl", 0, "Expire the static manifest this long after generation (0 never expires)")
+	privateKey := flag.String("private-key", "", "Encrypt assets end to end under this content key (256-bit, raw or base64), for licensed clients only")
+	encryptionKey := flag.String("encryption-key", "", "Encrypt published assets at rest under this key: file:PATH or vault-transit:[MOUNT/]NAME")
+	provenance := flag.String("provenance", "", "Publish this SLSA provenance attestation (.intoto.jsonl) with every asset")
+	flag.Parse()
+
+	if *assetsDir == "" && *manifestPath == "" {
+		logger.Error("at least one of -assets or -manifest is required")
+		os.Exit(1)
+	}
+
+	namer, err := update.NewAssetNamer(*assetTemplate)
+	if err != nil {
+		logger.Error("invalid asset template", "error", err)
+		os.Exit(1)
+	}
+
+	var wrapper update.KeyWrapper
+	if *encryptionKey != "" && *privateKey != "" {
+		logger.Error("-private-key assets are stored encrypted already; drop -encryption-key")
+		os.Exit(1)
+	}
+	if *encryptionKey != "" {
+		if *assetsDir == "" {
+			logger.Error("-encryption-key requires -assets")
+			os.Exit(1)
+		}
+		wrapper, err = update.LoadKeyWrapper(*encryptionKey)
+		if err != nil {
+			logger.Error("failed to load encryption key", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	meta, err := readGoReleaserMetadata(*dist)
+	if err != nil {
+		logger.Error("failed to read metadata", "error", err)
+		os.Exit(1)
+	}
+	if *releaseVersion != "" {
+		meta.Version = *releaseVersion
+	}
+	if _, err := update.ParseVersion(meta.Version); err != nil {
+		logger.Error("invalid release version", "version", meta.Version, "error", err)
+		os.Exit(1)
+	}
+
+	artifacts, err := readGoReleaserArtifacts(*dist)
+	if err != nil {
+		logger.Error("failed to read artifacts", "error", err)
+		os.Exit(1)
+	}
+
+	if *checksums == "" {
+		*checksums = findChecksumsFile(*dist, artifacts)
+	}
+
+	var sums map[string]string
+	if *checksums != "" {
+		sums, err = update.ReadChecksums(*checksums)
+		if err != nil {
+			logger.Error("failed to read checksums", "error", err)
+			os.Exit(1)
+		}
+	} else {
+		logger.Warn("no checksums file found, publishing binaries unverified", "dist", *dist)
+	}
+
+	assets, err := mapGoReleaserArtifacts(*dist, artifacts, sums)
+	if err != nil {
+		logger.Error("failed to map artifacts", "error", err)
+		os.Exit(1)
+	}
+	if len(assets) == 0 {
+		logger.Error("no binary artifacts found", "dist", *dist)
+		os.Exit(1)
+	}
+
+	if *provenance != "" {
+		if _, err := os.Stat(*provenance); err != nil {
+			logger.Error("failed to read provenance", "error", err)
+			os.Exit(1)
+		}
+		for i := range assets {
+			assets[i].Provenance = *provenance
+		}
+	}
+
+	if *privateKey != "" {
+		keyID, key, err := update.LoadContentKey(*privateKey)
+		if err != nil {
+			logger.Error("failed to load content key", "error", err)
+			os.Exit(1)
+		}
+
+		dir, err := os.MkdirTemp("", "nametag-private-*")
+		if err != nil {
+			logger.Error("failed to create temp directory", "error", err)
+			os.Exit(1)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := encryptPrivateAssets(assets, keyID, key, dir, *assetsDir, namer, meta.Version); err != nil {
+			os.RemoveAll(dir)
+			logger.Error("failed to encrypt private assets", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("encrypted private assets", "key_id", keyID)
+	}
+
+	var changelog string
+	switch {
+	case *changelogFile != "":
+		changelog, err = changelogFromFile(*changelogFile, meta.Version)
+	case *changelogGit:
+		changelog, err = changelogFromGit(meta.PreviousTag, meta.Tag)
+	}
+	if err != nil {
+		logger.Error("failed to extract changelog", "error", err)
+		os.Exit(1)
+	}
+
+	if *assetsDir != "" {
+		// Published versions are immutable: check every asset before copying
+		// any, so a refused republish leaves nothing half-replaced
+		previous := make([]string, len(assets))
+		conflict := false
+		for i, asset := range assets {
+			previous[i], err = publishedHash(*assetsDir, namer, meta.Version, asset, wrapper)
+			if err != nil {
+				logger.Error("failed to check published asset", "path", asset.Path, "error", err)
+				os.Exit(1)
+			}
+			if previous[i] != "" && previous[i] != asset.SHA256 {
+				conflict = true
+				logger.Error("asset already published with different content",
+					"component", asset.Component,
+					"platform", asset.Platform,
+					"version", meta.Version,
+					"published_sha256", previous[i],
+					"sha256", asset.SHA256,
+				)
+			}
+		}
+		if conflict && !*force {
+			logger.Error("refusing to overwrite published assets; bump the version or pass -force")
+			os.Exit(1)
+		}
+
+		releases, err := catalog.Open(filepath.Join(*assetsDir, catalog.File))
+		if err != nil {
+			logger.Error("failed to open release catalog", "error", err)
+			os.Exit(1)
+		}
+		defer releases.Close()
+
+		for i, asset := range assets {
+			if previous[i] == asset.SHA256 {
+				logger.Info("asset already published", "component", asset.Component, "platform", asset.Platform)
+				continue
+			}
+
+			dest, err := publishAsset(releases, *assetsDir, namer, meta.Version, asset, wrapper)
+			if err != nil {
+				logger.Error("failed to publish asset", "path", asset.Path, "error", err)
+				os.Exit(1)
+			}
+
+			entry := update.AuditEntry{
+				Action:         update.AuditPublish,
+				Actor:          currentActor(),
+				Component:      asset.Component,
+				Version:        meta.Version,
+				File:           filepath.Base(dest),
+				SHA256:         asset.SHA256,
+				PreviousSHA256: previous[i],
+			}
+			if previous[i] != "" {
+				entry.Action = update.AuditRepublish
+				logger.Warn("republished asset", "dest", dest, "previous_sha256", previous[i])
+			}
+			if err := update.AppendAuditLog(*assetsDir, entry); err != nil {
+				logger.Error("failed to record publish", "error", err)
+				os.Exit(1)
+			}
+
+			logger.Info("published asset",
+				"component", asset.Component,
+				"platform", asset.Platform,
+				"dest", dest,
+			)
+		}
+
+		if *provenance != "" {
+			if err := publishProvenance(*assetsDir, namer, meta.Version, assets); err != nil {
+				logger.Error("failed to publish provenance", "error", err)
+				os.Exit(1)
+			}
+		}
+		if changelog != "" {
+			if err := publishChangelog(*assetsDir, meta.Version, changelog, assets); err != nil {
+				logger.Error("failed to publish changelog", "error", err)
+				os.Exit(1)
+			}
+		}
+		if *critical {
+			if err := publishCritical(*assetsDir, meta.Version, assets); err != nil {
+				logger.Error("failed to mark release critical", "error", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if *manifestPath != "" {
+		manifest := buildManifest(meta.Version, meta.Date, changelog, *critical, assets)
+		if *manifestTTL > 0 {
+			manifest.Expires = manifest.Generated.Add(*manifestTTL)
+		}
+		if err := writeManifest(*manifestPath, manifest); err != nil {
+			logger.Error("failed to write manifest", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("wrote manifest", "path", *manifestPath, "components", len(manifest.Components))
+	}
+}
+
+func readGoReleaserMetadata(dist string) (*goreleaserMetadata, error) {
+	data, err := os.ReadFile(filepath.Join(dist, "metadata.json"))
+	if err != nil {
+		return nil, fmt.Errorf("read metadata: %w", err)
+	}
+
+	var meta goreleaserMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("decode metadata: %w", err)
+	}
+
+	return &meta, nil
+}
+
+func readGoReleaserArtifacts(dist string) ([]goreleaserArtifact, error) {
+	data, err := os.ReadFile(filepath.Join(dist, "artifacts.json"))
+	if err != nil {
+		return nil, fmt.Errorf("read artifacts: %w", err)
+	}
+
+	var artifacts []goreleaserArtifact
+	if err := json.Unmarshal(data, &artifacts); err != nil {
+		return nil, fmt.Errorf("decode artifacts: %w", err)
+	}
+
+	return artifacts, nil
+}
+
+// resolveArtifactPath resolves an artifact path, which GoReleaser records
+// relative to the project root (the parent of dist/)
+func resolveArtifactPath(dist, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(dist)), path)
+}
+
+func findChecksumsFile(dist string, artifacts []goreleaserArtifact) string {
+	for _, a := range artifacts {
+		if a.Type == "Checksum" {
+			return resolveArtifactPath(dist, a.Path)
+		}
+	}
+	return ""
+}
+
+// mapGoReleaserArtifacts maps raw binary artifacts to components and
+// platforms, verifying each against the checksums file unless sums is nil
+func mapGoReleaserArtifacts(dist string, artifacts []goreleaserArtifact, sums map[string]string) ([]releaseAsset, error) {
+	var assets []releaseAsset
+	seen := make(map[string]bool)
+
+	for _, a := range artifacts {
+		if a.Type != "Binary" || a.GOOS == "" || a.GOARCH == "" {
+			continue
+		}
+
+		component, _ := a.Extra["Binary"].(string)
+		if component == "" {
+			component = strings.TrimSuffix(filepath.Base(a.Path), ".exe")
+		}
+		platform := a.GOOS + "-" + a.GOARCH
+
+		key := component + "/" + platform
+		if seen[key] {
+			continue // e.g. multiple GOAMD64 variants; keep the first
+		}
+		seen[key] = true
+
+		path := resolveArtifactPath(dist, a.Path)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("stat artifact: %w", err)
+		}
+
+		digests, err := update.FileDigests(path, update.HashAlgorithms()...)
+		if err != nil {
+			return nil, err
+		}
+		hash, hashes := update.SplitDigests(digests)
+
+		if sums != nil {
+			if err := verifyGoReleaserBinary(dist, a, hash, artifacts, sums); err != nil {
+				return nil, err
+			}
+		}
+
+		assets = append(assets, releaseAsset{
+			Component: component,
+			Platform:  platform,
+			Path:      path,
+			SHA256:    hash,
+			Hashes:    hashes,
+			Size:      info.Size(),
+		})
+	}
+
+	return assets, nil
+}
+
+// verifyGoReleaserBinary checks a binary of the given hash against the
+// checksums file. GoReleaser's checksums list the archives rather than the
+// binaries unless they're published raw, so a binary that isn't listed is
+// verified through the listed archives of its platform: an archive must
+// match its checksum and carry the same binary. A binary covered by neither
+// is an error, as it would be published unverified.
+func verifyGoReleaserBinary(dist string, binary goreleaserArtifact, hash string, artifacts []goreleaserArtifact, sums map[string]string) error {
+	if expected, ok := sums[binary.Name]; ok {
+		if expected != hash {
+			return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", binary.Name, expected, hash)
+		}
+		return nil
+	}
+
+	name := filepath.Base(binary.Path)
+	for _, a := range artifacts {
+		expected, ok := sums[a.Name]
+		if a.Type != "Archive" || a.GOOS != binary.GOOS || a.GOARCH != binary.GOARCH || !ok {
+			continue
+		}
+		format := update.ArchiveFormat(a.Name)
+		if format == "" {
+			continue
+		}
+
+		path := resolveArtifactPath(dist, a.Path)
+		digests, err := update.FileDigests(path, update.HashSHA256)
+		if err != nil {
+			return err
+		}
+		if digests[update.HashSHA256] != expected {
+			return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", a.Name, expected, digests[update.HashSHA256])
+		}
+
+		// Another archive of the platform may be the one carrying it, as
+		// with GOAMD64 variants or archives of other binaries
+		inner, err := update.ArchiveFileSHA256(path, format, name)
+		if err != nil || inner != hash {
+			continue
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%s (%s/%s) is not in the checksums file nor in an archive listed there", binary.Name, binary.GOOS, binary.GOARCH)
+}
+
+// publishedHash returns the hash an asset was already published with, taken
+// from the version's checksums file or else the file on disk, or "" when it
+// has not been published. The checksums file wins so a quarantined asset
+// still counts as published. Assets encrypted at rest are decrypted with
+// wrapper.
+func publishedHash(assetsDir string, namer *update.AssetNamer, version string, asset releaseAsset, wrapper update.KeyWrapper) (string, error) {
+	filename, err := namer.Name(asset.Component, version, asset.Platform)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(assetsDir, asset.Component, version)
+
+	sums, err := update.ReadChecksums(filepath.Join(dir, update.ChecksumsFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if hash, ok := sums[filename]; ok {
+		return hash, nil
+	}
+
+	file, err := update.OpenAsset(context.Background(), filepath.Join(dir, filename), wrapper)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	digests, err := update.ReaderDigests(file, update.HashSHA256)
+	if err != nil {
+		return "", err
+	}
+	return digests[update.HashSHA256], nil
+}
+
+// currentActor names who is publishing, for the audit log
+func currentActor() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// publishAsset copies an asset into the server's assets tree, encrypting it
+// at rest when wrapper is set, and publishes it in the server's catalog on
+// the stable channel
+func publishAsset(releases *catalog.Catalog, assetsDir string, namer *update.AssetNamer, version string, asset releaseAsset, wrapper update.KeyWrapper) (string, error) {
+	filename, err := namer.Name(asset.Component, version, asset.Platform)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(assetsDir, asset.Component, version)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("create directory: %w", err)
+	}
+
+	dest := filepath.Join(dir, filename)
+	if err := copyFile(asset.Path, dest, wrapper); err != nil {
+		return "", err
+	}
+
+	// Recorded for the server's integrity audit
+	if err := update.RecordChecksum(dir, filename, asset.SHA256); err != nil {
+		return "", err
+	}
+
+	release := catalog.Release{Version: version, Channel: update.ChannelStable}
+	published := catalog.Asset{Platform: asset.Platform, File: filename, Size: asset.Size, SHA256: asset.SHA256}
+	if err := releases.Publish(context.Background(), asset.Component, release, published); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// publishProvenance stores each asset's attestation next to it, where the
+// server picks it up when generating the manifest
+func publishProvenance(assetsDir string, namer *update.AssetNamer, version string, assets []releaseAsset) error {
+	for _, asset := range assets {
+		filename, err := namer.Name(asset.Component, version, asset.Platform)
+		if err != nil {
+			return err
+		}
+
+		dest := filepath.Join(assetsDir, asset.Component, version, filename+update.ProvenanceExtension)
+		if err := copyFile(asset.Provenance, dest, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishChangelog stores the release notes next to each component's assets,
+// where the server picks them up when generating the manifest
+func publishChangelog(assetsDir, version, changelog string, assets []releaseAsset) error {
+	written := make(map[string]bool)
+	for _, asset := range assets {
+		if written[asset.Component] {
+			continue
+		}
+		written[asset.Component] = true
+
+		path := filepath.Join(assetsDir, asset.Component, version, update.ChangelogFile)
+		if err := os.WriteFile(path, []byte(changelog+"\n"), 0644); err != nil {
+			return fmt.Errorf("write changelog: %w", err)
+		}
+	}
+	return nil
+}
+
+// publishCritical marks the version of each component critical
+func publishCritical(assetsDir, version string, assets []releaseAsset) error {
+	for _, asset := range assets {
+		path := filepath.Join(assetsDir, asset.Component, version, update.CriticalFile)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			return fmt.Errorf("write critical marker: %w", err)
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to dest via a temporary file so readers never observe
+// a partially written asset, encrypting it when wrapper is set
+func copyFile(src, dest string, wrapper update.KeyWrapper) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open source: %w", err)
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if wrapper != nil {
+		err = encryptFile(tmp, in, wrapper)
+	} else {
+		_, err = io.Copy(tmp, in)
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("copy: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return fmt.Errorf("chmod: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	return nil
+}
+
+func encryptFile(dst io.Writer, src *os.File, wrapper update.KeyWrapper) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	return update.EncryptAsset(context.Background(), dst, src, info.Size(), wrapper)
+}
+
+func buildManifest(version string, released time.Time, changelog string, critical bool, assets []releaseAsset) *update.Manifest {
+	if released.IsZero() {
+		released = time.Now()
+	}
+
+	manifest := &update.Manifest{
+		SchemaVersion: update.SchemaVersion,
+		Generated:     time.Now().UTC(),
+		Components:    make(map[string]update.Component),
+	}
+
+	for _, asset := range assets {
+		comp, ok := manifest.Components[asset.Component]
+		if !ok {
+			comp = update.Component{
+				Name:        asset.Component,
+				Version:     version,
+				ReleaseDate: released.UTC(),
+				Changelog:   changelog,
+				Assets:      make(map[string]update.Asset),
+				Critical:    critical,
+			}
+		}
+
+		entry := update.Asset{
+			URL:    update.AssetURL(asset.Component, asset.Platform, version),
+			Size:   asset.Size,
+			SHA256: asset.SHA256,
+			Hashes: asset.Hashes,
+			KeyID:  asset.KeyID,
+		}
+		if asset.Provenance != "" {
+			entry.ProvenanceURL = update.ProvenanceURL(asset.Component, asset.Platform, version)
+		}
+		comp.Assets[asset.Platform] = entry
+		manifest.Components[asset.Component] = comp
+	}
+
+	return manifest
+}
+
+func writeManifest(path string, manifest *update.Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/catalog"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// writeTarGz writes a tar.gz archive at path holding files, by name
+func writeTarGz(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sha256File(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestMapGoReleaserArtifactsChecksums(t *testing.T) {
+	root := t.TempDir()
+	dist := filepath.Join(root, "dist")
+	if err := os.MkdirAll(filepath.Join(dist, "nametag_linux_amd64_v1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	binaryPath := filepath.Join(dist, "nametag_linux_amd64_v1", "nametag")
+	if err := os.WriteFile(binaryPath, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTarGz(t, filepath.Join(dist, "nametag_linux_amd64.tar.gz"), map[string]string{"nametag_linux_amd64/nametag": "binary", "README.md": "readme"})
+	writeTarGz(t, filepath.Join(dist, "other_linux_amd64.tar.gz"), map[string]string{"nametag": "another build"})
+
+	binary := goreleaserArtifact{Name: "nametag", Path: "dist/nametag_linux_amd64_v1/nametag", GOOS: "linux", GOARCH: "amd64", Type: "Binary"}
+	archive := goreleaserArtifact{Name: "nametag_linux_amd64.tar.gz", Path: "dist/nametag_linux_amd64.tar.gz", GOOS: "linux", GOARCH: "amd64", Type: "Archive"}
+	other := goreleaserArtifact{Name: "other_linux_amd64.tar.gz", Path: "dist/other_linux_amd64.tar.gz", GOOS: "linux", GOARCH: "amd64", Type: "Archive"}
+	binaryHash := sha256File(t, binaryPath)
+	archiveHash := sha256File(t, filepath.Join(dist, archive.Name))
+	otherHash := sha256File(t, filepath.Join(dist, other.Name))
+	wrong := strings.Repeat("0", 64)
+
+	for _, tt := range []struct {
+		name      string
+		artifacts []goreleaserArtifact
+		sums      map[string]string
+		wantErr   string
+	}{
+		{name: "no checksums file", artifacts: []goreleaserArtifact{binary}},
+		{name: "binary listed", artifacts: []goreleaserArtifact{binary}, sums: map[string]string{"nametag": binaryHash}},
+		{name: "binary mismatch", artifacts: []goreleaserArtifact{binary}, sums: map[string]string{"nametag": wrong}, wantErr: "checksum mismatch for nametag"},
+		{name: "archive listed", artifacts: []goreleaserArtifact{binary, archive}, sums: map[string]string{archive.Name: archiveHash}},
+		{name: "archive mismatch", artifacts: []goreleaserArtifact{binary, archive}, sums: map[string]string{archive.Name: wrong}, wantErr: "checksum mismatch for " + archive.Name},
+		{name: "archive of another build", artifacts: []goreleaserArtifact{binary, other, archive}, sums: map[string]string{other.Name: otherHash, archive.Name: archiveHash}},
+		{name: "only another build", artifacts: []goreleaserArtifact{binary, other}, sums: map[string]string{other.Name: otherHash}, wantErr: "not in the checksums file"},
+		{name: "archive not listed", artifacts: []goreleaserArtifact{binary, archive}, sums: map[string]string{"unrelated.tar.gz": wrong}, wantErr: "not in the checksums file"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assets, err := mapGoReleaserArtifacts(dist, tt.artifacts, tt.sums)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(assets) != 1 || assets[0].SHA256 != binaryHash || assets[0].Platform != "linux-amd64" {
+				t.Errorf("assets = %+v", assets)
+			}
+		})
+	}
+}
+
+func TestPublishAssetCatalogs(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "nametag")
+	if err := os.WriteFile(src, []byte("nametag 1.2.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	asset := releaseAsset{Component: "nametag", Platform: "linux-amd64", Path: src, SHA256: sha256File(t, src), Size: 13}
+	namer, err := update.NewAssetNamer(update.DefaultAssetTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assetsDir := t.TempDir()
+	releases, err := catalog.Open(filepath.Join(assetsDir, catalog.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releases.Close()
+	if _, err := publishAsset(releases, assetsDir, namer, "1.2.0", asset, nil); err != nil {
+		t.Fatalf("publishAsset() = %v", err)
+	}
+
+	// The server offers what the catalog lists, not what the directory holds
+	ctx := context.Background()
+	release, err := releases.Release(ctx, "nametag", "1.2.0")
+	if err != nil || release.Channel != update.ChannelStable {
+		t.Fatalf("Release() = %+v, %v, want published on stable", release, err)
+	}
+	assets, err := releases.Assets(ctx, "nametag", "1.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := assets["linux-amd64"]; got.SHA256 != asset.SHA256 || got.Size != asset.Size || got.File != "nametag-linux-amd64" {
+		t.Errorf("cataloged asset = %+v", got)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+func cmdKeygen(logger *slog.Logger) {
+	out := flag.String("out", "signing-key.pem", "Path to write the private key")
+	flag.Parse()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		logger.Error("failed to generate key", "error", err)
+		os.Exit(1)
+	}
+
+	data, err := update.EncodePrivateKey(priv)
+	if err != nil {
+		logger.Error("failed to encode key", "error", err)
+		os.Exit(1)
+	}
+
+	// O_EXCL so an existing signing key is never overwritten by accident
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		logger.Error("failed to create key file", "error", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		logger.Error("failed to write key file", "error", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Private key written to %s\n", *out)
+	fmt.Printf("Public key: %s\n", update.EncodePublicKey(pub))
+	fmt.Printf("Minisign public key: %s\n", update.MinisignPublicKey(pub))
+}
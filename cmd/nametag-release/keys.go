@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+func cmdRotateKeys(logger *slog.Logger) {
+	dir := flag.String("dir", "./keys", "Directory of key rotation documents served with the server's -keys-dir")
+	keys := flag.String("keys", "", "Comma-separated private keys of the new key set: PEM files or piv:SLOT on a hardware token")
+	threshold := flag.Int("threshold", 1, "Signatures required from the new key set")
+	sign := flag.String("sign", "", "Comma-separated private keys of the current key set that approve the rotation: PEM files or piv:SLOT")
+	flag.Parse()
+
+	if *keys == "" || *sign == "" {
+		fmt.Fprintln(os.Stderr, "Usage: nametag-release rotate-keys -keys new1.pem,... -threshold N -sign old1.pem,... [-dir ./keys]")
+		os.Exit(1)
+	}
+
+	newKeys, err := loadSigners(*keys)
+	if err != nil {
+		logger.Error("failed to load new keys", "error", err)
+		os.Exit(1)
+	}
+	approvers, err := loadSigners(*sign)
+	if err != nil {
+		logger.Error("failed to load current keys", "error", err)
+		os.Exit(1)
+	}
+
+	latest, err := latestKeyRotation(*dir)
+	if err != nil {
+		logger.Error("failed to read key rotations", "error", err)
+		os.Exit(1)
+	}
+
+	rotation := update.KeyRotation{
+		Version:   latest + 1,
+		Threshold: *threshold,
+	}
+	for _, key := range newKeys {
+		rotation.Keys = append(rotation.Keys, update.EncodePublicKey(key.Public().(ed25519.PublicKey)))
+	}
+
+	// The new keys sign as well, proving they are usable
+	data, err := update.SignKeyRotation(rotation, append(approvers, newKeys...)...)
+	if err != nil {
+		logger.Error("failed to sign key rotation", "error", err)
+		os.Exit(1)
+	}
+
+	// Check against the previous rotation when there is one; the first
+	// rotation is checked against the keys built into clients
+	if latest > 0 {
+		prevData, err := os.ReadFile(rotationPath(*dir, latest))
+		if err != nil {
+			logger.Error("failed to read previous key rotation", "error", err)
+			os.Exit(1)
+		}
+		prev, err := update.ParseKeyRotation(prevData)
+		if err != nil {
+			logger.Error("failed to parse previous key rotation", "error", err)
+			os.Exit(1)
+		}
+		if _, err := prev.Rotate(data); err != nil {
+			logger.Error("key rotation would be rejected by clients", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		logger.Error("failed to create keys directory", "error", err)
+		os.Exit(1)
+	}
+
+	// O_EXCL so a published rotation is never rewritten
+	path := rotationPath(*dir, rotation.Version)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		logger.Error("failed to create key rotation", "error", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		logger.Error("failed to write key rotation", "error", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Key rotation %d written to %s\n", rotation.Version, path)
+	fmt.Printf("New key set: %d key(s), threshold %d\n", len(rotation.Keys), rotation.Threshold)
+}
+
+// loadSigners loads a comma-separated list of signing keys, PEM files or
+// keys on hardware tokens
+func loadSigners(specs string) ([]crypto.Signer, error) {
+	var keys []crypto.Signer
+	for _, spec := range strings.Split(specs, ",") {
+		key, err := update.LoadSigner(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// latestKeyRotation returns the highest rotation version in dir, or 0
+func latestKeyRotation(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var latest int64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if v, err := strconv.ParseInt(name, 10, 64); err == nil && v > latest {
+			latest = v
+		}
+	}
+	return latest, nil
+}
+
+func rotationPath(dir string, version int64) string {
+	return filepath.Join(dir, strconv.FormatInt(version, 10)+".json")
+}
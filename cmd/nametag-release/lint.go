@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+func cmdLint(logger *slog.Logger) {
+	server := flag.String("server", "", "Check that asset URLs are reachable on this server")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: nametag-release lint [-server URL] manifest.json")
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		logger.Error("failed to read manifest", "error", err)
+		os.Exit(1)
+	}
+
+	manifest, err := update.ParseManifest(data)
+	if err != nil {
+		logger.Error("failed to decode manifest", "error", err)
+		os.Exit(1)
+	}
+
+	issues := update.LintManifest(manifest)
+	if *server != "" {
+		issues = append(issues, checkReachability(*server, manifest)...)
+	}
+
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+
+	if len(issues) > 0 {
+		fmt.Printf("\n%d problem(s) found\n", len(issues))
+		os.Exit(1)
+	}
+
+	fmt.Println("Manifest OK")
+}
+
+// checkReachability issues a HEAD request for every asset and verifies the
+// advertised size matches
+func checkReachability(server string, manifest *update.Manifest) []error {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	names := make([]string, 0, len(manifest.Components))
+	for name := range manifest.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var issues []error
+	for _, name := range names {
+		for platform, asset := range manifest.Components[name].Assets {
+			where := fmt.Sprintf("component %q platform %q", name, platform)
+
+			url := asset.URL
+			if strings.HasPrefix(url, "/") {
+				url = strings.TrimSuffix(server, "/") + url
+			}
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodHead, url, nil)
+			if err != nil {
+				issues = append(issues, fmt.Errorf("%s: %w", where, err))
+				continue
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				issues = append(issues, fmt.Errorf("%s: unreachable: %w", where, err))
+				continue
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				issues = append(issues, fmt.Errorf("%s: %s returned status %d", where, url, resp.StatusCode))
+				continue
+			}
+			if resp.ContentLength >= 0 && resp.ContentLength != asset.Size {
+				issues = append(issues, fmt.Errorf("%s: size is %d, manifest says %d", where, resp.ContentLength, asset.Size))
+			}
+		}
+	}
+
+	return issues
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+func main() {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(1)
+	}
+
+	cmd := os.Args[1]
+	os.Args = os.Args[1:] // Shift args for subcommand flags
+	flag.CommandLine = flag.NewFlagSet(cmd, flag.ExitOnError)
+
+	switch cmd {
+	case "api-key":
+		cmdAPIKey(logger)
+	case "companions":
+		cmdCompanions(logger)
+	case "compat-check":
+		cmdCompatCheck(logger)
+	case "compat-record":
+		cmdCompatRecord(logger)
+	case "goreleaser":
+		cmdGoReleaser(logger)
+	case "keygen":
+		cmdKeygen(logger)
+	case "lint":
+		cmdLint(logger)
+	case "publish":
+		cmdPublish(logger)
+	case "rotate-keys":
+		cmdRotateKeys(logger)
+	case "tuf-init":
+		cmdTUFInit(logger)
+	case "version":
+		cmdVersion()
+	case "help":
+		printUsage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", cmd)
+		printUsage()
+		os.Exit(1)
+	}
+}
+
+func printUsage() {
+	fmt.Println("nametag-release - Release publishing tool for the update server")
+	fmt.Println()
+	fmt.Println("Usage:")
+	fmt.Println("  nametag-release <command> [flags]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  api-key       Issue an API key and print its entry for the server's key file")
+	fmt.Println("  companions    Write the index of the companion files to pack into an update archive")
+	fmt.Println("  compat-check  Check the current server and client against recorded releases")
+	fmt.Println("  compat-record Record a release's client and server exchanges as a fixture")
+	fmt.Println("  goreleaser    Import a GoReleaser dist/ directory")
+	fmt.Println("  keygen        Generate an Ed25519 manifest signing key")
+	fmt.Println("  lint          Validate a manifest file")
+	fmt.Println("  publish       Publish built binaries, by upload or into an assets directory")
+	fmt.Println("  rotate-keys   Publish a signed rotation to a new manifest key set")
+	fmt.Println("  tuf-init      Create TUF root metadata and role keys")
+	fmt.Println("  version       Show version information")
+	fmt.Println("  help          Show this help message")
+}
+
+func cmdVersion() {
+	fmt.Printf("nametag-release version %s\n", version)
+	fmt.Printf("  commit:   %s\n", commit)
+	fmt.Printf("  built:    %s\n", date)
+}
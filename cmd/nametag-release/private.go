@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// encryptPrivateAssets encrypts every asset end to end under the content key
+// into dir, pointing the asset at its ciphertext, which is what gets
+// published and described by the manifest. Encryption is randomized, so an
+// asset already published from the same plaintext keeps its published
+// ciphertext rather than looking like a conflicting republish.
+func encryptPrivateAssets(assets []releaseAsset, keyID string, key []byte, dir, assetsDir string, namer *update.AssetNamer, version string) error {
+	for i := range assets {
+		asset := &assets[i]
+
+		path, err := publishedPrivateAsset(assetsDir, namer, version, *asset, key)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			path = filepath.Join(dir, asset.Component+"-"+asset.Platform)
+			if err := encryptPrivateFile(asset.Path, path, key); err != nil {
+				return fmt.Errorf("encrypt %s: %w", asset.Path, err)
+			}
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("stat encrypted asset: %w", err)
+		}
+		digests, err := update.FileDigests(path, update.HashAlgorithms()...)
+		if err != nil {
+			return err
+		}
+
+		asset.Path = path
+		asset.Size = info.Size()
+		asset.SHA256, asset.Hashes = update.SplitDigests(digests)
+		asset.KeyID = keyID
+	}
+	return nil
+}
+
+// publishedPrivateAsset returns the path of the asset's published ciphertext
+// if it decrypts under key to the same plaintext, or ""
+func publishedPrivateAsset(assetsDir string, namer *update.AssetNamer, version string, asset releaseAsset, key []byte) (string, error) {
+	if assetsDir == "" {
+		return "", nil
+	}
+	filename, err := namer.Name(asset.Component, version, asset.Platform)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(assetsDir, asset.Component, version, filename)
+
+	file, err := update.OpenPrivateAsset(path, map[string][]byte{update.ContentKeyID(key): key})
+	if err != nil {
+		// Missing, public, or under another key: a new ciphertext it is
+		return "", nil
+	}
+	defer file.Close()
+
+	digests, err := update.ReaderDigests(file, update.HashSHA256)
+	if err != nil || digests[update.HashSHA256] != asset.SHA256 {
+		return "", nil
+	}
+	return path, nil
+}
+
+func encryptPrivateFile(src, dest string, key []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open source: %w", err)
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("stat source: %w", err)
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	if err := update.EncryptPrivateAsset(out, in, info.Size(), key); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/catalog"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// publishPlatforms are the platforms the update server distributes, the
+// suffixes of the binaries `just build-all` writes
+var publishPlatforms = []string{
+	"darwin-amd64", "darwin-arm64",
+	"linux-amd64", "linux-arm64",
+	"windows-amd64",
+}
+
+// uploadResponse is the server's reply to an upload
+type uploadResponse struct {
+	SHA256    string `json:"sha256"`
+	Unchanged bool   `json:"unchanged"`
+	Signed    bool   `json:"signed"`
+}
+
+func cmdPublish(logger *slog.Logger) {
+	dir := flag.String("dir", "./bin", "Directory of built binaries named {component}-{os}-{arch}[.exe]")
+	releaseVersion := flag.String("version", "", "Release version (required)")
+	componentList := flag.String("components", "nametag,nametag-up", "Comma-separated components to publish; other binaries in -dir are skipped")
+	serverURL := flag.String("server", "", "Upload through this update server's API")
+	token := flag.String("token", "", "Bearer token with the publisher role for -server (default: $NAMETAG_RELEASE_TOKEN)")
+	product := flag.String("product", "", "Publish into this product's namespace on -server")
+	assetsDir := flag.String("assets", "", "Copy binaries into this server assets directory instead of uploading")
+	assetTemplate := flag.String("asset-template", update.DefaultAssetTemplate, "Template for published asset filenames, with -assets")
+	signingKey := flag.String("signing-key", "", "Sign every binary with this Ed25519 key, a PEM private key or piv:SLOT on a hardware token")
+	manifestPath := flag.String("manifest", "", "Write a static manifest to this path")
+	force := flag.Bool("force", false, "Replace assets already published with different content (recorded in the audit log)")
+	timeout := flag.Duration("timeout", 5*time.Minute, "Timeout of each upload")
+	flag.Parse()
+
+	if *serverURL == "" && *assetsDir == "" && *manifestPath == "" {
+		logger.Error("at least one of -server, -assets, or -manifest is required")
+		os.Exit(1)
+	}
+	if *serverURL != "" && *assetsDir != "" {
+		logger.Error("-server and -assets are exclusive: the server publishes into its own assets directory")
+		os.Exit(1)
+	}
+	if _, err := update.ParseVersion(*releaseVersion); err != nil {
+		logger.Error("invalid release version", "version", *releaseVersion, "error", err)
+		os.Exit(1)
+	}
+	if *product != "" {
+		if err := update.ValidateProduct(*product); err != nil {
+			logger.Error("invalid product", "error", err)
+			os.Exit(1)
+		}
+	}
+	if *token == "" {
+		*token = os.Getenv("NAMETAG_RELEASE_TOKEN")
+	}
+	if *serverURL != "" && *token == "" {
+		logger.Error("-server requires -token or NAMETAG_RELEASE_TOKEN")
+		os.Exit(1)
+	}
+
+	namer, err := update.NewAssetNamer(*assetTemplate)
+	if err != nil {
+		logger.Error("invalid asset template", "error", err)
+		os.Exit(1)
+	}
+
+	var signer crypto.Signer
+	if *signingKey != "" {
+		signer, err = update.LoadSigner(*signingKey)
+		if err != nil {
+			logger.Error("failed to load signing key", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	assets, err := findBuiltAssets(*dir, strings.Split(*componentList, ","))
+	if err != nil {
+		logger.Error("failed to read binaries", "error", err)
+		os.Exit(1)
+	}
+	if len(assets) == 0 {
+		logger.Error("no binaries found", "dir", *dir, "components", *componentList)
+		os.Exit(1)
+	}
+
+	// Signatures cover the asset as published, so they're made before any
+	// is, and a bad key publishes nothing
+	signatures := make([][]byte, len(assets))
+	if signer != nil {
+		for i, asset := range assets {
+			filename, err := namer.Name(asset.Component, *releaseVersion, asset.Platform)
+			if err != nil {
+				logger.Error("invalid asset name", "error", err)
+				os.Exit(1)
+			}
+			signatures[i], err = signAsset(signer, asset.Path, filename)
+			if err != nil {
+				logger.Error("failed to sign asset", "path", asset.Path, "error", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	switch {
+	case *serverURL != "":
+		client := &http.Client{Timeout: *timeout}
+		for i, asset := range assets {
+			result, err := uploadAsset(client, *serverURL, *token, *product, *releaseVersion, asset, signatures[i], *force)
+			if err != nil {
+				logger.Error("failed to upload asset", "component", asset.Component, "platform", asset.Platform, "error", err)
+				os.Exit(1)
+			}
+			if result.Unchanged {
+				logger.Info("asset already published", "component", asset.Component, "platform", asset.Platform)
+				continue
+			}
+			logger.Info("uploaded asset",
+				"component", asset.Component,
+				"platform", asset.Platform,
+				"sha256", result.SHA256,
+				"signed", result.Signed,
+			)
+		}
+	case *assetsDir != "":
+		if err := copyAssets(logger, *assetsDir, namer, *releaseVersion, assets, signatures, *force); err != nil {
+			logger.Error("failed to publish assets", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *manifestPath != "" {
+		manifest := buildManifest(*releaseVersion, time.Time{}, "", false, assets)
+		for name, comp := range manifest.Components {
+			for platform, entry := range comp.Assets {
+				if signer != nil {
+					entry.SignatureURL = update.SignatureURL(name, platform, *releaseVersion)
+				}
+				entry.URL = update.ProductPath(*product, entry.URL)
+				entry.SignatureURL = update.ProductPath(*product, entry.SignatureURL)
+				comp.Assets[platform] = entry
+			}
+		}
+		if err := writeManifest(*manifestPath, manifest); err != nil {
+			logger.Error("failed to write manifest", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("wrote manifest", "path", *manifestPath, "components", len(manifest.Components))
+	}
+}
+
+// findBuiltAssets maps the binaries of components in dir to their platforms
+// and hashes them. Anything else in dir, such as checksums or other tools'
+// binaries, is skipped.
+func findBuiltAssets(dir string, components []string) ([]releaseAsset, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read directory: %w", err)
+	}
+
+	var assets []releaseAsset
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		component, platform, ok := parseBuiltName(entry.Name())
+		if !ok || !slices.Contains(components, component) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("stat %s: %w", entry.Name(), err)
+		}
+		digests, err := update.FileDigests(path, update.HashAlgorithms()...)
+		if err != nil {
+			return nil, err
+		}
+		hash, hashes := update.SplitDigests(digests)
+
+		assets = append(assets, releaseAsset{
+			Component: component,
+			Platform:  platform,
+			Path:      path,
+			SHA256:    hash,
+			Hashes:    hashes,
+			Size:      info.Size(),
+		})
+	}
+
+	sort.Slice(assets, func(i, j int) bool {
+		if assets[i].Component != assets[j].Component {
+			return assets[i].Component < assets[j].Component
+		}
+		return assets[i].Platform < assets[j].Platform
+	})
+	return assets, nil
+}
+
+// parseBuiltName splits a binary's name, e.g. nametag-up-windows-amd64.exe,
+// into its component and platform
+func parseBuiltName(name string) (string, string, bool) {
+	base, exe := strings.CutSuffix(name, ".exe")
+	for _, platform := range publishPlatforms {
+		component, ok := strings.CutSuffix(base, "-"+platform)
+		if !ok || component == "" {
+			continue
+		}
+		// Only Windows binaries carry .exe
+		if exe != strings.HasPrefix(platform, "windows-") {
+			return "", "", false
+		}
+		return component, platform, true
+	}
+	return "", "", false
+}
+
+// signAsset makes the minisign signature of the binary at path, published
+// as filename
+func signAsset(signer crypto.Signer, path, filename string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read asset: %w", err)
+	}
+	trustedComment := fmt.Sprintf("timestamp:%d\tfile:%s", time.Now().Unix(), filename)
+	signature, err := update.MinisignSignWith(signer, data, trustedComment)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(signature), nil
+}
+
+// uploadAsset publishes asset through the server's upload API, streaming it
+// as a multipart form with its checksum and signature
+func uploadAsset(client *http.Client, serverURL, token, product, version string, asset releaseAsset, signature []byte, force bool) (*uploadResponse, error) {
+	file, err := os.Open(asset.Path)
+	if err != nil {
+		return nil, fmt.Errorf("open asset: %w", err)
+	}
+	defer file.Close()
+
+	path := update.ProductPath(product, fmt.Sprintf("/v1/upload/%s/%s/%s", asset.Component, asset.Platform, version))
+	endpoint := strings.TrimSuffix(serverURL, "/") + path
+	if force {
+		endpoint += "?" + url.Values{"force": {"true"}}.Encode()
+	}
+
+	body, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUploadForm(form, file, asset.SHA256, signature))
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("upload: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result uploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode upload response: %w", err)
+	}
+	if result.SHA256 != asset.SHA256 {
+		return nil, fmt.Errorf("server stored sha256 %s, expected %s", result.SHA256, asset.SHA256)
+	}
+	return &result, nil
+}
+
+// writeUploadForm writes the upload form: the checksum and signature first,
+// so the server has them before the file
+func writeUploadForm(form *multipart.Writer, file io.Reader, sha256 string, signature []byte) error {
+	if err := form.WriteField("sha256", sha256); err != nil {
+		return err
+	}
+	if signature != nil {
+		if err := form.WriteField("signature", string(signature)); err != nil {
+			return err
+		}
+	}
+	part, err := form.CreateFormFile("file", "asset")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return fmt.Errorf("read asset: %w", err)
+	}
+	return form.Close()
+}
+
+// copyAssets publishes assets straight into an assets directory, as the
+// server's upload API would: refusing different content for a published
+// version unless forced, and recording every change in the audit log
+func copyAssets(logger *slog.Logger, assetsDir string, namer *update.AssetNamer, version string, assets []releaseAsset, signatures [][]byte, force bool) error {
+	// Check every asset before copying any, so a refused republish leaves
+	// nothing half-replaced
+	previous := make([]string, len(assets))
+	conflict := false
+	for i, asset := range assets {
+		var err error
+		previous[i], err = publishedHash(assetsDir, namer, version, asset, nil)
+		if err != nil {
+			return fmt.Errorf("check published %s: %w", asset.Path, err)
+		}
+		if previous[i] != "" && previous[i] != asset.SHA256 {
+			conflict = true
+			logger.Error("asset already published with different content",
+				"component", asset.Component,
+				"platform", asset.Platform,
+				"version", version,
+				"published_sha256", previous[i],
+				"sha256", asset.SHA256,
+			)
+		}
+	}
+	if conflict && !force {
+		return errors.New("refusing to overwrite published assets; bump the version or pass -force")
+	}
+
+	releases, err := catalog.Open(filepath.Join(assetsDir, catalog.File))
+	if err != nil {
+		return err
+	}
+	defer releases.Close()
+
+	for i, asset := range assets {
+		filename, err := namer.Name(asset.Component, version, asset.Platform)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(assetsDir, asset.Component, version, filename)
+
+		if previous[i] != asset.SHA256 {
+			// A republished asset's old signature must not outlive it
+			if err := os.Remove(dest + update.MinisignExtension); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("remove stale signature: %w", err)
+			}
+			if _, err := publishAsset(releases, assetsDir, namer, version, asset, nil); err != nil {
+				return fmt.Errorf("publish %s: %w", asset.Path, err)
+			}
+
+			entry := update.AuditEntry{
+				Action:         update.AuditPublish,
+				Actor:          currentActor(),
+				Component:      asset.Component,
+				Version:        version,
+				File:           filename,
+				SHA256:         asset.SHA256,
+				PreviousSHA256: previous[i],
+			}
+			if previous[i] != "" {
+				entry.Action = update.AuditRepublish
+				logger.Warn("republished asset", "dest", dest, "previous_sha256", previous[i])
+			}
+			if err := update.AppendAuditLog(assetsDir, entry); err != nil {
+				return fmt.Errorf("record publish: %w", err)
+			}
+		}
+
+		if signatures[i] != nil {
+			if err := os.WriteFile(dest+update.MinisignExtension, signatures[i], 0644); err != nil {
+				return fmt.Errorf("write signature: %w", err)
+			}
+		}
+
+		if previous[i] == asset.SHA256 {
+			logger.Info("asset already published", "component", asset.Component, "platform", asset.Platform)
+			continue
+		}
+		logger.Info("published asset", "component", asset.Component, "platform", asset.Platform, "dest", dest)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+func cmdTUFInit(logger *slog.Logger) {
+	dir := flag.String("dir", "./tuf", "Directory to write the TUF repository to")
+	expires := flag.Duration("expires", 365*24*time.Hour, "Lifetime of the root metadata")
+	flag.Parse()
+
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		logger.Error("failed to create directory", "error", err)
+		os.Exit(1)
+	}
+
+	root := update.TUFRoot{
+		TUFHeader: update.NewTUFHeader(update.TUFRoleRoot, 1, time.Now().Add(*expires)),
+		Keys:      make(map[string]update.TUFKey),
+		Roles:     make(map[string]update.TUFRole),
+	}
+
+	var rootKey ed25519.PrivateKey
+	for _, role := range []string{update.TUFRoleRoot, update.TUFRoleTargets, update.TUFRoleSnapshot, update.TUFRoleTimestamp} {
+		key, err := generateTUFKey(filepath.Join(*dir, role+".pem"))
+		if err != nil {
+			logger.Error("failed to generate key", "role", role, "error", err)
+			os.Exit(1)
+		}
+
+		tufKey := update.NewTUFKey(key.Public().(ed25519.PublicKey))
+		keyID, err := update.TUFKeyID(tufKey)
+		if err != nil {
+			logger.Error("failed to compute key id", "error", err)
+			os.Exit(1)
+		}
+
+		root.Keys[keyID] = tufKey
+		root.Roles[role] = update.TUFRole{KeyIDs: []string{keyID}, Threshold: 1}
+
+		if role == update.TUFRoleRoot {
+			rootKey = key
+		}
+	}
+
+	data, err := update.SignTUF(root, rootKey)
+	if err != nil {
+		logger.Error("failed to sign root", "error", err)
+		os.Exit(1)
+	}
+
+	// Versioned copies let clients walk the chain of root rotations
+	for _, name := range []string{"root.json", "1.root.json"} {
+		if err := os.WriteFile(filepath.Join(*dir, name), data, 0644); err != nil {
+			logger.Error("failed to write root", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("TUF repository initialized in %s\n", *dir)
+	fmt.Printf("Move %s offline; the server only needs the other keys.\n", filepath.Join(*dir, "root.pem"))
+	fmt.Printf("Distribute %s to clients as their trusted root.\n", filepath.Join(*dir, "root.json"))
+}
+
+func generateTUFKey(path string) (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := update.EncodePrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	// O_EXCL so an existing repository is never overwritten by accident
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return nil, err
+	}
+
+	return priv, nil
+}
@@ -0,0 +1,259 @@
+// nametag-sign signs a release directory offline: every asset the manifest
+// lists gets a minisign signature next to it, and the manifest gets its
+// signatures in manifest.json.sig. The update server then serves both as
+// they are and never holds a private key.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+func main() {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+
+	keyPaths := flag.String("key", "", "Ed25519 key to sign with, a PEM private key or piv:SLOT on a hardware token, or a comma-separated list of them; the first also signs assets")
+	dir := flag.String("dir", "./releases", "Release directory: the server's assets directory")
+	manifestPath := flag.String("manifest", "", "Manifest to sign, e.g. from nametag-release goreleaser -manifest (default: manifest.json in -dir)")
+	assetTemplate := flag.String("asset-template", update.DefaultAssetTemplate, "Template for asset filenames within a version directory")
+	ttl := flag.Duration("ttl", 0, "Regenerate the manifest's timestamp and expire it this long after signing (0 keeps both, and needs a manifest that expires)")
+	encryptionKey := flag.String("encryption-key", "", "Key encryption key of assets encrypted at rest: file:PATH or vault-transit:[MOUNT/]NAME")
+	showVersion := flag.Bool("version", false, "Show version information")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nametag-sign version %s\n", version)
+		fmt.Printf("  commit:   %s\n", commit)
+		fmt.Printf("  built:    %s\n", date)
+		return
+	}
+
+	if *keyPaths == "" {
+		logger.Error("-key is required")
+		os.Exit(1)
+	}
+	if *manifestPath == "" {
+		*manifestPath = filepath.Join(*dir, "manifest.json")
+	}
+
+	var keys []crypto.Signer
+	for _, path := range strings.Split(*keyPaths, ",") {
+		key, err := update.LoadSigner(path)
+		if err != nil {
+			logger.Error("failed to load signing key", "error", err)
+			os.Exit(1)
+		}
+		keys = append(keys, key)
+	}
+
+	namer, err := update.NewAssetNamer(*assetTemplate)
+	if err != nil {
+		logger.Error("invalid asset template", "error", err)
+		os.Exit(1)
+	}
+
+	var wrapper update.KeyWrapper
+	if *encryptionKey != "" {
+		wrapper, err = update.LoadKeyWrapper(*encryptionKey)
+		if err != nil {
+			logger.Error("failed to load encryption key", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	manifest, err := readManifest(*manifestPath)
+	if err != nil {
+		logger.Error("failed to read manifest", "error", err)
+		os.Exit(1)
+	}
+
+	signer := &assetSigner{dir: *dir, namer: namer, key: keys[0], wrapper: wrapper}
+	for _, name := range sortedKeys(manifest.Components) {
+		comp := manifest.Components[name]
+		for _, platform := range sortedKeys(comp.Assets) {
+			asset := comp.Assets[platform]
+			path, err := signer.sign(comp, platform, asset)
+			if err != nil {
+				logger.Error("failed to sign asset", "component", name, "platform", platform, "error", err)
+				os.Exit(1)
+			}
+			asset.SignatureURL = update.SignatureURL(name, platform, comp.Version)
+			comp.Assets[platform] = asset
+
+			logger.Info("signed asset", "component", name, "platform", platform, "path", path)
+		}
+	}
+
+	if *ttl > 0 {
+		manifest.Generated = time.Now().UTC()
+		manifest.Expires = manifest.Generated.Add(*ttl)
+	}
+	// Clients refuse signed manifests that never expire
+	if manifest.Expires.IsZero() {
+		logger.Error("manifest has no expiry; pass -ttl")
+		os.Exit(1)
+	}
+
+	if issues := update.LintManifest(manifest); len(issues) > 0 {
+		for _, issue := range issues {
+			logger.Error("manifest problem", "issue", issue)
+		}
+		os.Exit(1)
+	}
+
+	if err := writeSignedManifest(*manifestPath, manifest, keys); err != nil {
+		logger.Error("failed to write signed manifest", "error", err)
+		os.Exit(1)
+	}
+
+	for _, key := range keys {
+		logger.Info("signed manifest",
+			"path", *manifestPath,
+			"public_key", update.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+		)
+	}
+	logger.Info("manifest expires; sign it again before then", "expires", manifest.Expires)
+}
+
+func readManifest(path string) (*update.Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := update.ParseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode manifest %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// assetSigner writes minisign signatures next to the assets of a release
+// directory, after checking them against the manifest
+type assetSigner struct {
+	dir     string
+	namer   *update.AssetNamer
+	key     crypto.Signer
+	wrapper update.KeyWrapper
+}
+
+// sign signs the asset for platform and returns its path. The signature
+// covers what the server serves: the plaintext of assets encrypted at rest.
+func (s *assetSigner) sign(comp update.Component, platform string, asset update.Asset) (string, error) {
+	filename, err := s.namer.Name(comp.Name, comp.Version, platform)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.dir, comp.Name, comp.Version, filename)
+
+	file, err := update.OpenAsset(context.Background(), path, s.wrapper)
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return "", fmt.Errorf("read asset: %w", err)
+	}
+
+	digests, err := update.ReaderDigests(bytes.NewReader(data), update.HashAlgorithms()...)
+	if err != nil {
+		return "", err
+	}
+	if err := update.MatchDigests(asset.Digests(), digests); err != nil {
+		return "", fmt.Errorf("%s does not match the manifest: %w", path, err)
+	}
+
+	trustedComment := fmt.Sprintf("timestamp:%d\tfile:%s", time.Now().Unix(), filename)
+	signature, err := update.MinisignSignWith(s.key, data, trustedComment)
+	if err != nil {
+		return "", err
+	}
+	if err := writeFile(path+update.MinisignExtension, []byte(signature)); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// writeSignedManifest writes the manifest and, next to it, one signature of
+// the exact bytes per key
+func writeSignedManifest(path string, manifest *update.Manifest, keys []crypto.Signer) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode manifest: %w", err)
+	}
+
+	var signatures strings.Builder
+	for _, key := range keys {
+		signature, err := update.SignWith(key, data)
+		if err != nil {
+			return err
+		}
+		signatures.WriteString(signature + "\n")
+	}
+
+	// The signatures go first: until the manifest is replaced, the server
+	// pairs the old manifest with signatures that don't verify, which
+	// clients refuse, rather than a new manifest with none
+	if err := writeFile(path+update.ManifestSignatureExtension, []byte(signatures.String())); err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile replaces path through a temporary file so the server never
+// serves a partial write
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sign-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %w", filepath.Base(path), err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("chmod %s: %w", filepath.Base(path), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", filepath.Base(path), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,17 +1,47 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 
+	"github.com/1995parham-learning/auto-update-binary/buildinfo"
+	"github.com/1995parham-learning/auto-update-binary/internal/config"
 	"github.com/1995parham-learning/auto-update-binary/internal/ipc"
 	"github.com/1995parham-learning/auto-update-binary/internal/platform"
 	"github.com/1995parham-learning/auto-update-binary/internal/update"
+	"github.com/1995parham-learning/auto-update-binary/quiesce"
 )
 
+// hookTimeout bounds how long a preinstall or postinstall hook may run
+const hookTimeout = 5 * time.Minute
+
+// defaultVersionTimeout is how long a restarted component has to report its
+// new version when its restart policy doesn't say
+const defaultVersionTimeout = time.Minute
+
+// defaultQuiesceTimeout is how long a service has to acknowledge quiescing
+// when its restart policy doesn't say; resume and restart get adminTimeout
+const (
+	defaultQuiesceTimeout = 2 * time.Minute
+	adminTimeout          = 30 * time.Second
+)
+
+// sharedLockTimeout is how long the updater of a shared install waits for
+// the update ahead of it, such as the nametag that started it, to finish
+const sharedLockTimeout = 5 * time.Minute
+
+// errNotServing is returned when a restarted component doesn't report the
+// version just installed
+var errNotServing = errors.New("restarted component is not serving the new version")
+
 var (
 	version = "dev"
 	commit  = "none"
@@ -25,8 +55,15 @@ func main() {
 
 	cmdFile := flag.String("command-file", "", "Path to command JSON file")
 	showVersion := flag.Bool("version", false, "Show version information")
+	simulateOnly := flag.Bool("simulate", false, "Run the update against a sandbox copy of the target, reporting what each phase would do, and change nothing")
+	flag.String(config.FlagName, "", "Config file (default: nametag/config.json in the user config directory)")
 	flag.Parse()
 
+	if err := config.Load(flag.CommandLine, config.ClientEnvPrefix, config.DefaultClientPath()); err != nil {
+		logger.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+
 	if *showVersion {
 		logger.Info("nametag-up",
 			"version", version,
@@ -41,7 +78,25 @@ func main() {
 		os.Exit(1)
 	}
 
-	cmd, err := ipc.ReadFromFile(*cmdFile)
+	if *simulateOnly {
+		if err := simulate(os.Stdout, *cmdFile); err != nil {
+			if !errors.Is(err, errSimulationFailed) {
+				logger.Error("simulation failed", "error", err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The key arrives from the spawning app; a command file without it may
+	// have been planted by another process
+	key, err := ipc.KeyFromEnv()
+	if err != nil {
+		logger.Error("missing command key", "error", err)
+		os.Exit(1)
+	}
+
+	cmd, err := ipc.ReadFromFile(*cmdFile, key)
 	if err != nil {
 		logger.Error("failed to read command file", "error", err)
 		os.Exit(1)
@@ -50,56 +105,442 @@ func main() {
 	// Clean up command file when done
 	defer ipc.Cleanup(*cmdFile)
 
+	// Updates of an install shared by the machine's users take turns; the
+	// lock is held until the updater is done, rollback included
+	unlock := func() {}
+	if platform.SharedInstall(cmd.TargetBinary) {
+		release, err := platform.LockSharedInstall(sharedLockTimeout)
+		if err != nil {
+			logger.Error("failed to lock the shared install", "error", err)
+			os.Exit(1)
+		}
+		unlock = release
+	}
+	defer unlock()
+
 	if err := executeUpdate(logger, cmd); err != nil {
 		logger.Error("update failed", "error", err)
+		recordAction(logger, cmd, update.ActionFailure, err.Error())
 
-		// Attempt rollback on failure
-		if cmd.Action == ipc.ActionUpdate {
+		// Attempt rollback on failure, unless the binary was left alone
+		// because someone else's update replaced it or could tamper with it
+		if cmd.Action == ipc.ActionUpdate && !errors.Is(err, update.ErrTargetChanged) && !errors.Is(err, platform.ErrInsecureDir) {
 			replacer := update.NewReplacer(logger)
-			if rollbackErr := replacer.Rollback(cmd.TargetBinary, cmd.BackupPath); rollbackErr != nil {
+			rollback := func() error { return replacer.Rollback(cmd.TargetBinary, cmd.BackupPath) }
+			if cmd.InstallPath != "" {
+				rollback = func() error { return replacer.RollbackMigration(cmd.TargetBinary, cmd.BackupPath, cmd.InstallPath) }
+			}
+			if rollbackErr := rollback(); rollbackErr != nil {
 				logger.Error("rollback also failed", "error", rollbackErr)
+			} else {
+				recordAction(logger, cmd, update.ActionRollback, cmd.TargetBinary)
+
+				// The new version was already restarted; bring the old one back
+				if errors.Is(err, errNotServing) {
+					if restartErr := restart(logger, cmd); restartErr != nil {
+						logger.Error("failed to restart the previous version", "error", restartErr)
+					}
+				}
 			}
 		}
+		unlock()
 		os.Exit(1)
 	}
 
 	logger.Info("update completed successfully")
 }
 
-func executeUpdate(logger *slog.Logger, cmd *ipc.UpdateCommand) error {
+func executeUpdate(logger *slog.Logger, cmd *ipc.UpdateCommand) (err error) {
 	logger.Info("executing update",
 		"action", cmd.Action,
 		"target", cmd.TargetBinary,
 		"parent_pid", cmd.ParentPID,
 	)
 
+	if err := validateRestart(cmd); err != nil {
+		return err
+	}
+
+	newVersion, installedPath, err := checkDowngrade(cmd)
+	if err != nil {
+		return err
+	}
+
+	if err := platform.CheckWritable(cmd.TargetBinary); err != nil {
+		return err
+	}
+	if err := checkSharedInstall(cmd); err != nil {
+		return err
+	}
+
 	// Step 1: Wait for parent process to exit
 	logger.Info("waiting for parent process to exit", "pid", cmd.ParentPID)
-	if err := platform.WaitForProcessExit(cmd.ParentPID, 30*time.Second); err != nil {
+	if err := platform.WaitForProcessExit(cmd.ParentPID, cmd.ParentStartTime, 30*time.Second); err != nil {
 		return err
 	}
 	logger.Info("parent process has exited")
 
 	// Step 2: Verify the new binary checksum
 	logger.Info("verifying new binary checksum")
-	if err := update.VerifyChecksum(cmd.NewBinaryPath, cmd.ExpectedSHA256); err != nil {
+	if err := update.VerifyChecksum(cmd.NewBinaryPath, update.MergeDigests(cmd.ExpectedSHA256, cmd.ExpectedHashes)); err != nil {
 		return err
 	}
 	logger.Info("checksum verified")
 
-	// Step 3: Perform atomic replacement
+	// Let the operator's scanner look at the download, archive and all,
+	// before anything is unpacked or replaced
+	if cmd.ScanCommand != "" {
+		logger.Info("scanning new binary", "command", cmd.ScanCommand)
+		if err := update.Scan(context.Background(), cmd.ScanCommand, cmd.NewBinaryPath); err != nil {
+			return err
+		}
+		logger.Info("scan passed")
+	}
+
+	// Step 3: Unpack archives; the checksum above covers the hooks as well
+	newBinary := cmd.NewBinaryPath
+	hooks := map[string]string{}
+	var companions []update.ExtractedCompanion
+	if cmd.ArchiveFormat != "" {
+		extracted, err := extractArchive(logger, cmd)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(filepath.Dir(extracted.Binary))
+
+		newBinary = extracted.Binary
+		hooks = extracted.Hooks
+		companions = extracted.Companions
+	}
+
+	if len(hooks) > 0 && cmd.HookPolicy != ipc.HookAllow {
+		return errors.New("archive contains hook scripts but hooks are not allowed")
+	}
+
+	if cmd.Publisher != "" {
+		if err := platform.VerifyPublisher(newBinary, cmd.Publisher); err != nil {
+			return fmt.Errorf("verify publisher: %w", err)
+		}
+		logger.Info("publisher verified", "publisher", cmd.Publisher)
+	}
+
+	if err := runHook(logger, cmd, hooks[update.HookPreinstall]); err != nil {
+		return err
+	}
+
+	// A service that can't be restarted blindly drains first, and carries
+	// on as it was if anything below fails before it is handed over
+	handedOver := false
+	if cmd.AdminSocket != "" {
+		if err := adminSend(logger, cmd, quiesce.OpQuiesce); err != nil {
+			_ = adminSend(logger, cmd, quiesce.OpResume)
+			return err
+		}
+		defer func() {
+			if err != nil && !handedOver {
+				_ = adminSend(logger, cmd, quiesce.OpResume)
+			}
+		}()
+	}
+
+	// Step 4: Perform atomic replacement, or move to the release's install
+	// path
 	replacer := update.NewReplacer(logger)
-	if err := replacer.Replace(cmd.TargetBinary, cmd.NewBinaryPath, cmd.BackupPath); err != nil {
+	installed := cmd.TargetBinary
+	if cmd.InstallPath != "" {
+		forwarder, err := replacer.Migrate(cmd.TargetBinary, newBinary, cmd.BackupPath, cmd.InstallPath)
+		if err != nil {
+			return err
+		}
+		installed = cmd.InstallPath
+		recordMigration(logger, cmd, forwarder)
+		// The next update looks for the updater next to the binary
+		if err := copyUpdater(cmd.InstallPath); err != nil {
+			logger.Warn("failed to copy the updater to the install path", "error", err)
+		}
+	} else {
+		if err := replacer.Replace(cmd.TargetBinary, newBinary, cmd.BackupPath); err != nil {
+			return err
+		}
+		recordAction(logger, cmd, update.ActionReplace, cmd.TargetBinary)
+	}
+
+	// Step 5: Validate the new binary, and put the companion files shipped
+	// with it in place
+	if err := replacer.ValidateAfterUpdate(installed); err != nil {
+		return err
+	}
+	if len(companions) > 0 {
+		placed, companionErr := installCompanions(logger, cmd, companions)
+		if companionErr != nil {
+			return companionErr
+		}
+		// Undone with the binary if anything below fails
+		defer func() {
+			if err != nil {
+				if rollbackErr := placed.Rollback(); rollbackErr != nil {
+					logger.Error("failed to roll back companion files", "error", rollbackErr)
+				}
+				return
+			}
+			commitCompanions(logger, cmd, placed)
+		}()
+	}
+
+	if installedPath != "" {
+		if err := update.RecordInstalled(installedPath, cmd.Component, newVersion); err != nil {
+			logger.Warn("failed to record installed version", "error", err)
+		}
+	}
+	pruneStaged(logger, cmd)
+
+	if err := runHook(logger, cmd, hooks[update.HookPostinstall]); err != nil {
 		return err
 	}
 
-	// Step 4: Validate the new binary
-	if err := replacer.ValidateAfterUpdate(cmd.TargetBinary); err != nil {
+	// Step 6: Restart the updated component
+	if err := restart(logger, cmd); err != nil {
 		return err
 	}
+	handedOver = true
+	if err := confirmVersion(logger, cmd); err != nil {
+		return err
+	}
+	if cmd.UninstallKey != "" {
+		if err := platform.RegisterUninstall(cmd.UninstallKey, cmd.Component, cmd.NewVersion, installed); err != nil {
+			logger.Warn("failed to record the version in the uninstall entry", "key", cmd.UninstallKey, "error", err)
+		}
+	}
+
+	// Step 7: Schedule cleanup of old binary and the downloaded archive
+	platform.ScheduleCleanup(cmd.BackupPath)
+	if cmd.ArchiveFormat != "" {
+		platform.Shred(cmd.NewBinaryPath)
+	}
+
+	return nil
+}
+
+// checkDowngrade refuses a new version lower than the highest one installed
+// before, returning the version and the installed state path to record it
+// in. Commands that don't name a component and version are not tracked.
+func checkDowngrade(cmd *ipc.UpdateCommand) (update.Version, string, error) {
+	if cmd.Component == "" || cmd.NewVersion == "" {
+		return update.Version{}, "", nil
+	}
+
+	newVersion, err := update.ParseVersion(cmd.NewVersion)
+	if err != nil {
+		return update.Version{}, "", fmt.Errorf("parse new version: %w", err)
+	}
+
+	stateDir, err := platform.StateDir()
+	if err != nil {
+		return update.Version{}, "", fmt.Errorf("get state directory: %w", err)
+	}
+	installedPath := filepath.Join(stateDir, update.InstalledFile)
+
+	if !cmd.AllowDowngrade {
+		if err := update.CheckDowngrade(installedPath, cmd.Component, newVersion); err != nil {
+			return update.Version{}, "", err
+		}
+	}
+
+	return newVersion, installedPath, nil
+}
+
+// checkSharedInstall checks, for a shared install, that neither the
+// install directory, where the backup and extracted archive go, nor the
+// directory of the download can be written by other users, who could swap
+// the files after they were verified, and that the binary is still the one
+// the update was prepared for
+func checkSharedInstall(cmd *ipc.UpdateCommand) error {
+	if !platform.SharedInstall(cmd.TargetBinary) {
+		return nil
+	}
+	if err := platform.CheckSystemDir(filepath.Dir(cmd.TargetBinary)); err != nil {
+		return fmt.Errorf("install directory: %w", err)
+	}
+	if err := platform.CheckSystemDir(filepath.Dir(cmd.NewBinaryPath)); err != nil {
+		return fmt.Errorf("new binary: %w", err)
+	}
+	return update.CheckTarget(cmd.TargetBinary, cmd.TargetSHA256)
+}
+
+// pruneStaged drops updates staged for the target that the version just
+// installed already covers, so the next start doesn't apply an older one
+func pruneStaged(logger *slog.Logger, cmd *ipc.UpdateCommand) {
+	if cmd.NewVersion == "" {
+		return
+	}
+	dir, err := platform.StagedDir()
+	if err != nil {
+		return
+	}
+	queue, err := ipc.NewQueue(dir)
+	if err != nil {
+		return
+	}
+
+	err = queue.Prune(cmd.TargetBinary, cmd.NewVersion, func(a, b string) bool {
+		va, errA := update.ParseVersion(a)
+		vb, errB := update.ParseVersion(b)
+		return errA == nil && errB == nil && va.LessThan(vb)
+	})
+	if err != nil {
+		logger.Warn("failed to prune staged updates", "error", err)
+	}
+}
+
+// validateRestart rejects restart settings up front, before anything on disk
+// has been touched
+func validateRestart(cmd *ipc.UpdateCommand) error {
+	if cmd.RunAsUser != "" {
+		if cmd.RestartMode != "" && cmd.RestartMode != ipc.RestartExec {
+			return fmt.Errorf("restart mode %q starts no process to run as %s", cmd.RestartMode, cmd.RunAsUser)
+		}
+		if err := platform.CheckRunAs(cmd.RunAsUser, cmd.RunAsGroup); err != nil {
+			return fmt.Errorf("run restart as %s: %w", cmd.RunAsUser, err)
+		}
+	}
+
+	switch cmd.RestartMode {
+	case "", ipc.RestartExec, ipc.RestartNone:
+		return nil
+	case ipc.RestartSystemd:
+		if cmd.RestartUnit == "" {
+			return fmt.Errorf("restart mode %q requires a unit", cmd.RestartMode)
+		}
+		return nil
+	case ipc.RestartAdmin:
+		if cmd.AdminSocket == "" {
+			return fmt.Errorf("restart mode %q requires an admin socket", cmd.RestartMode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown restart mode %q", cmd.RestartMode)
+	}
+}
+
+// extractArchive unpacks the downloaded archive into a directory next to the
+// target so the binary can be renamed into place on the same filesystem
+func extractArchive(logger *slog.Logger, cmd *ipc.UpdateCommand) (*update.ExtractedArchive, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(cmd.TargetBinary), ".nametag-update-")
+	if err != nil {
+		return nil, fmt.Errorf("create extract dir: %w", err)
+	}
+
+	extracted, err := update.ExtractArchive(cmd.NewBinaryPath, cmd.ArchiveFormat, dir, cmd.ArchiveBinary, platform.HookExtension())
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("extract archive: %w", err)
+	}
+
+	logger.Info("archive extracted", "binary", extracted.Binary, "hooks", len(extracted.Hooks), "companions", len(extracted.Companions))
+	return extracted, nil
+}
+
+// installCompanions puts the companion files extracted from the archive in
+// place, replacing the ones the last update installed
+func installCompanions(logger *slog.Logger, cmd *ipc.UpdateCommand, companions []update.ExtractedCompanion) (*update.CompanionInstall, error) {
+	stateDir, err := platform.StateDir()
+	if err != nil {
+		return nil, fmt.Errorf("get state directory: %w", err)
+	}
+	previous, err := update.ReadCompanionState(filepath.Join(stateDir, update.CompanionStateFile), cmd.Component)
+	if err != nil {
+		return nil, err
+	}
+
+	installed, err := update.InstallCompanions(companions, previous)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range installed.Kept {
+		logger.Warn("keeping locally changed config", "path", path)
+	}
+	for _, path := range installed.Unsupported {
+		logger.Info("skipping companion file with no place on this platform", "file", path)
+	}
+	logger.Info("companion files installed", "count", len(installed.Installed))
+	return installed, nil
+}
+
+// commitCompanions removes the files the companion files replaced, and
+// records the ones installed for the next update
+func commitCompanions(logger *slog.Logger, cmd *ipc.UpdateCommand, installed *update.CompanionInstall) {
+	if err := installed.Commit(); err != nil {
+		logger.Warn("failed to clean up replaced companion files", "error", err)
+	}
+	stateDir, err := platform.StateDir()
+	if err != nil {
+		return
+	}
+	if err := update.RecordCompanionState(filepath.Join(stateDir, update.CompanionStateFile), cmd.Component, installed.Installed); err != nil {
+		logger.Warn("failed to record companion files", "error", err)
+	}
+}
+
+// runHook runs a hook script from the update archive. An empty path means
+// the archive did not ship that hook.
+func runHook(logger *slog.Logger, cmd *ipc.UpdateCommand, path string) error {
+	if path == "" {
+		return nil
+	}
+
+	name := filepath.Base(path)
+	logger.Info("running hook", "hook", name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	proc := exec.CommandContext(ctx, path)
+	proc.Dir = filepath.Dir(cmd.TargetBinary)
+	proc.Env = append(os.Environ(),
+		"NAMETAG_TARGET_BINARY="+cmd.TargetBinary,
+		"NAMETAG_BACKUP_PATH="+cmd.BackupPath,
+		"NAMETAG_NEW_VERSION="+cmd.NewVersion,
+	)
+	proc.Stdout = os.Stderr
+	proc.Stderr = os.Stderr
+
+	if err := proc.Run(); err != nil {
+		return fmt.Errorf("hook %s: %w", name, err)
+	}
+
+	logger.Info("hook completed", "hook", name)
+	return nil
+}
+
+func restart(logger *slog.Logger, cmd *ipc.UpdateCommand) error {
+	switch cmd.RestartMode {
+	case ipc.RestartNone:
+		logger.Info("restart disabled, leaving it to the operator")
+		// A quiesced service keeps running the old version meanwhile
+		if cmd.AdminSocket != "" {
+			return adminSend(logger, cmd, quiesce.OpResume)
+		}
+		return nil
+
+	case ipc.RestartAdmin:
+		return adminSend(logger, cmd, quiesce.OpRestart)
+
+	case ipc.RestartSystemd:
+		logger.Info("restarting systemd unit", "unit", cmd.RestartUnit)
+
+		out, err := exec.Command("systemctl", "restart", cmd.RestartUnit).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("systemctl restart %s: %w: %s", cmd.RestartUnit, err, out)
+		}
+
+		logger.Info("systemd unit restarted", "unit", cmd.RestartUnit)
+		return nil
+
+	default:
+		if cmd.RestartBinary == "" {
+			return nil
+		}
 
-	// Step 5: Start the new binary
-	if cmd.RestartBinary != "" {
 		logger.Info("starting new binary", "path", cmd.RestartBinary)
 
 		proc := exec.Command(cmd.RestartBinary, cmd.RestartArgs...)
@@ -107,15 +548,139 @@ func executeUpdate(logger *slog.Logger, cmd *ipc.UpdateCommand) error {
 		proc.Stderr = os.Stderr
 		platform.ConfigureDetached(proc)
 
+		// The updater may run as root to replace the binary; the component
+		// it relaunches shouldn't
+		if cmd.RunAsUser != "" {
+			if err := platform.RunAs(proc, cmd.RunAsUser, cmd.RunAsGroup); err != nil {
+				return fmt.Errorf("run restart as %s: %w", cmd.RunAsUser, err)
+			}
+		}
+
 		if err := proc.Start(); err != nil {
 			return err
 		}
 
-		logger.Info("new binary started", "pid", proc.Process.Pid)
+		logger.Info("new binary started", "pid", proc.Process.Pid, "user", cmd.RunAsUser)
+		return nil
 	}
+}
 
-	// Step 6: Schedule cleanup of old binary
-	platform.ScheduleCleanup(cmd.BackupPath)
+// confirmVersion polls the component's version endpoint until it reports the
+// version just installed, so an update that installs but doesn't come up, or
+// leaves the old process serving, is rolled back
+func confirmVersion(logger *slog.Logger, cmd *ipc.UpdateCommand) error {
+	if cmd.VersionURL == "" || cmd.NewVersion == "" || cmd.RestartMode == ipc.RestartNone {
+		return nil
+	}
+
+	want, err := update.ParseVersion(cmd.NewVersion)
+	if err != nil {
+		return fmt.Errorf("parse new version: %w", err)
+	}
+	timeout := cmd.VersionTimeout
+	if timeout <= 0 {
+		timeout = defaultVersionTimeout
+	}
+
+	logger.Info("waiting for the new version to serve", "url", cmd.VersionURL, "timeout", timeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+
+	var last string
+	for {
+		info, err := buildinfo.Fetch(ctx, httpClient, cmd.VersionURL)
+		if err == nil {
+			if got, err := update.ParseVersion(info.Version); err == nil && got.Compare(want) == 0 {
+				logger.Info("new version is serving", "version", info.Version, "commit", info.Commit)
+				return nil
+			}
+			last = "reports version " + info.Version
+		} else {
+			last = err.Error()
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s after %s", errNotServing, last, timeout)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// adminSend sends op to the service's admin socket and waits for its
+// acknowledgment
+func adminSend(logger *slog.Logger, cmd *ipc.UpdateCommand, op string) error {
+	timeout := adminTimeout
+	if op == quiesce.OpQuiesce {
+		timeout = cmd.QuiesceTimeout
+		if timeout <= 0 {
+			timeout = defaultQuiesceTimeout
+		}
+	}
 
+	logger.Info("asking service over its admin socket", "op", op, "socket", cmd.AdminSocket, "timeout", timeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := quiesce.Send(ctx, cmd.AdminSocket, quiesce.Request{Op: op, Version: cmd.NewVersion}); err != nil {
+		logger.Error("service did not acknowledge", "op", op, "error", err)
+		return err
+	}
+
+	logger.Info("service acknowledged", "op", op)
 	return nil
 }
+
+// recordMigration records the move to cmd's install path in the action log
+// and the install path state, for operators looking for the binary
+func recordMigration(logger *slog.Logger, cmd *ipc.UpdateCommand, forwarder string) {
+	recordAction(logger, cmd, update.ActionMigrate, cmd.TargetBinary+" -> "+cmd.InstallPath)
+	stateDir, err := platform.StateDir()
+	if err != nil {
+		return
+	}
+	migration := update.InstallMigration{
+		From:      cmd.TargetBinary,
+		To:        cmd.InstallPath,
+		Forwarder: forwarder,
+		Version:   cmd.NewVersion,
+		Migrated:  time.Now().UTC(),
+	}
+	if err := update.RecordInstallMigration(filepath.Join(stateDir, update.InstallPathFile), cmd.Component, migration); err != nil {
+		logger.Warn("failed to record install path", "error", err)
+	}
+}
+
+// copyUpdater copies the running updater next to installPath, unless one is
+// there already
+func copyUpdater(installPath string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(filepath.Dir(installPath), filepath.Base(self))
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	return copyFile(self, dst)
+}
+
+// recordAction appends an action on cmd's component to the action log in
+// the state directory; a log that can't be written doesn't stop the update
+func recordAction(logger *slog.Logger, cmd *ipc.UpdateCommand, action, detail string) {
+	stateDir, err := platform.StateDir()
+	if err != nil {
+		return
+	}
+	entry := update.ActionEntry{
+		Action:    action,
+		Component: cmd.Component,
+		Version:   cmd.NewVersion,
+		Detail:    detail,
+	}
+	if err := update.NewActionLog(filepath.Join(stateDir, update.ActionLogFile)).Append(entry); err != nil {
+		logger.Warn("failed to record action", "action", action, "error", err)
+	}
+}
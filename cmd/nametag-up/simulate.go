@@ -0,0 +1,309 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/buildinfo"
+	"github.com/1995parham-learning/auto-update-binary/internal/ipc"
+	"github.com/1995parham-learning/auto-update-binary/internal/platform"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// errSimulationFailed ends a simulation at the phase the update would fail
+var errSimulationFailed = errors.New("update would fail")
+
+// simulation prints what each phase of an update does, or would do
+type simulation struct {
+	w io.Writer
+	// replaced is set once the update would have replaced the target
+	replaced bool
+}
+
+func (s *simulation) ok(phase, format string, args ...any) {
+	s.print("ok", phase, fmt.Sprintf(format, args...))
+}
+
+// would reports what a phase acting on the running system would do
+func (s *simulation) would(phase, format string, args ...any) {
+	s.print("would", phase, fmt.Sprintf(format, args...))
+}
+
+func (s *simulation) skip(phase, format string, args ...any) {
+	s.print("skip", phase, fmt.Sprintf(format, args...))
+}
+
+// fail reports the phase the update would fail at, and what the updater
+// would do about it
+func (s *simulation) fail(cmd *ipc.UpdateCommand, phase string, err error) error {
+	s.print("FAIL", phase, err.Error())
+	if cmd.Action == ipc.ActionUpdate && s.replaced {
+		s.would("rollback", "restore %s from %s", cmd.TargetBinary, cmd.BackupPath)
+	}
+	return errSimulationFailed
+}
+
+func (s *simulation) print(status, phase, detail string) {
+	fmt.Fprintf(s.w, "%-6s %-10s %s\n", status, phase, detail)
+}
+
+// simulate runs the update of the command file at path against a sandbox: a
+// copy of the target in a temporary directory is replaced and rolled back,
+// while the phases that act on the running system (waiting for the parent,
+// hooks, quiescing, restarting) are only reported. The command file is left
+// in place. Without the key in NAMETAG_IPC_KEY the file is read unverified,
+// and the commands it names are not run.
+func simulate(w io.Writer, path string) error {
+	sim := &simulation{w: w}
+
+	trusted := true
+	var cmd *ipc.UpdateCommand
+	key, err := ipc.KeyFromEnv()
+	if err == nil {
+		cmd, err = ipc.ReadFromFile(path, key)
+	} else {
+		trusted = false
+		cmd, err = ipc.ReadUnverifiedFromFile(path)
+	}
+	if err != nil {
+		sim.print("FAIL", "command", err.Error())
+		return errSimulationFailed
+	}
+	if trusted {
+		sim.ok("command", "%s of %s, signed with the key", cmd.Action, cmd.TargetBinary)
+	} else {
+		sim.skip("command", "%s of %s, not verified without %s; its scan command and hooks won't be run", cmd.Action, cmd.TargetBinary, ipc.KeyEnv)
+	}
+
+	sandbox, err := os.MkdirTemp("", "nametag-simulate-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(sandbox)
+
+	// Preflight
+	if err := validateRestart(cmd); err != nil {
+		return sim.fail(cmd, "restart", err)
+	}
+	sim.ok("restart", "restart mode %s is valid", cmp.Or(cmd.RestartMode, ipc.RestartExec))
+	newVersion, installedPath, err := checkDowngrade(cmd)
+	if err != nil {
+		return sim.fail(cmd, "downgrade", err)
+	}
+	if installedPath == "" {
+		sim.skip("downgrade", "the command names no component and version")
+	} else {
+		sim.ok("downgrade", "%s %s may be installed", cmd.Component, newVersion)
+	}
+	if err := platform.CheckWritable(cmd.TargetBinary); err != nil {
+		return sim.fail(cmd, "writable", err)
+	}
+	sim.ok("writable", "%s can be replaced", cmd.TargetBinary)
+
+	// Step 1
+	if err := platform.WaitForProcessExit(cmd.ParentPID, cmd.ParentStartTime, 100*time.Millisecond); err != nil {
+		sim.would("parent", "wait up to 30s for process %d, which is still running, to exit", cmd.ParentPID)
+	} else {
+		sim.ok("parent", "process %d has exited", cmd.ParentPID)
+	}
+
+	// Step 2
+	if err := update.VerifyChecksum(cmd.NewBinaryPath, update.MergeDigests(cmd.ExpectedSHA256, cmd.ExpectedHashes)); err != nil {
+		return sim.fail(cmd, "checksum", err)
+	}
+	sim.ok("checksum", "%s matches", cmd.NewBinaryPath)
+	switch {
+	case cmd.ScanCommand == "":
+		sim.skip("scan", "no scan command")
+	case !trusted:
+		sim.skip("scan", "would run %q", cmd.ScanCommand)
+	default:
+		if err := update.Scan(context.Background(), cmd.ScanCommand, cmd.NewBinaryPath); err != nil {
+			return sim.fail(cmd, "scan", err)
+		}
+		sim.ok("scan", "%q passed", cmd.ScanCommand)
+	}
+
+	// Step 3, into the sandbox; the download itself is only read, as the
+	// replacement below moves whatever it installs
+	newBinary := filepath.Join(sandbox, "new", filepath.Base(cmd.TargetBinary))
+	hooks := map[string]string{}
+	var companions []update.ExtractedCompanion
+	if cmd.ArchiveFormat != "" {
+		extracted, err := update.ExtractArchive(cmd.NewBinaryPath, cmd.ArchiveFormat, filepath.Join(sandbox, "new"), cmd.ArchiveBinary, platform.HookExtension())
+		if err != nil {
+			return sim.fail(cmd, "extract", err)
+		}
+		newBinary, hooks, companions = extracted.Binary, extracted.Hooks, extracted.Companions
+		sim.ok("extract", "%s archive holds %s, %d hook(s), and %d companion file(s)", cmd.ArchiveFormat, filepath.Base(newBinary), len(hooks), len(companions))
+	} else if err := copyFile(cmd.NewBinaryPath, newBinary); err != nil {
+		return err
+	}
+	if len(hooks) > 0 && cmd.HookPolicy != ipc.HookAllow {
+		return sim.fail(cmd, "hooks", errors.New("archive contains hook scripts but hooks are not allowed"))
+	}
+	if cmd.Publisher != "" {
+		if err := platform.VerifyPublisher(newBinary, cmd.Publisher); err != nil {
+			return sim.fail(cmd, "publisher", fmt.Errorf("verify publisher: %w", err))
+		}
+		sim.ok("publisher", "signed by %s", cmd.Publisher)
+	}
+	if hook := hooks[update.HookPreinstall]; hook != "" {
+		sim.would("preinstall", "run %s in %s", filepath.Base(hook), filepath.Dir(cmd.TargetBinary))
+	}
+	if cmd.AdminSocket != "" {
+		if _, err := os.Stat(cmd.AdminSocket); err != nil {
+			return sim.fail(cmd, "quiesce", fmt.Errorf("admin socket: %w", err))
+		}
+		sim.would("quiesce", "ask the service on %s to quiesce", cmd.AdminSocket)
+	}
+
+	// Steps 4 and 5 on a copy of the target, rolled back right after
+	if err := simulateReplace(sim, cmd, sandbox, newBinary); err != nil {
+		return err
+	}
+	if cmd.InstallPath != "" {
+		if _, err := os.Lstat(cmd.InstallPath); err == nil {
+			return sim.fail(cmd, "migrate", fmt.Errorf("install path %s already exists", cmd.InstallPath))
+		}
+		sim.would("migrate", "install at %s instead, forwarding %s to it", cmd.InstallPath, cmd.TargetBinary)
+	}
+	for _, c := range companions {
+		dest, err := update.CompanionPath(c.Kind, c.Name())
+		if err != nil {
+			sim.skip("companion", "%s: %v", c.Path, err)
+			continue
+		}
+		sim.would("companion", "install %s (%s) at %s", c.Path, c.Kind, dest)
+	}
+	if installedPath != "" {
+		sim.would("record", "record %s %s as installed in %s", cmd.Component, newVersion, installedPath)
+	}
+	if hook := hooks[update.HookPostinstall]; hook != "" {
+		sim.would("postinstall", "run %s in %s", filepath.Base(hook), filepath.Dir(cmd.TargetBinary))
+	}
+
+	// Step 6
+	describeRestart(sim, cmd)
+	if err := simulateConfirm(sim, cmd); err != nil {
+		return err
+	}
+
+	if cmd.UninstallKey != "" {
+		sim.would("register", "record %s %s in the Uninstall registry entry %s (Windows only)", cmd.Component, cmd.NewVersion, cmd.UninstallKey)
+	}
+
+	// Step 7
+	sim.would("cleanup", "remove %s", cmd.BackupPath)
+	return nil
+}
+
+// simulateReplace replaces a copy of the target in sandbox with newBinary,
+// validates it, and rolls it back as a failed update would
+func simulateReplace(sim *simulation, cmd *ipc.UpdateCommand, sandbox, newBinary string) error {
+	target := filepath.Join(sandbox, "target", filepath.Base(cmd.TargetBinary))
+	if err := copyFile(cmd.TargetBinary, target); err != nil {
+		return sim.fail(cmd, "replace", fmt.Errorf("copy target: %w", err))
+	}
+	backup := target + ".old"
+
+	replacer := update.NewReplacer(slog.New(slog.DiscardHandler))
+	if err := replacer.Replace(target, newBinary, backup); err != nil {
+		return sim.fail(cmd, "replace", err)
+	}
+	sim.replaced = true
+	if err := replacer.ValidateAfterUpdate(target); err != nil {
+		return sim.fail(cmd, "validate", err)
+	}
+	if link, ok := platform.SlotLink(cmd.TargetBinary); ok {
+		sim.ok("replace", "new binary installs; %s would be pointed at the inactive slot", link)
+	} else {
+		sim.ok("replace", "new binary installs; %s would be kept as %s", cmd.TargetBinary, cmd.BackupPath)
+	}
+	if err := replacer.Rollback(target, backup); err != nil {
+		return sim.fail(cmd, "rollback", err)
+	}
+	sim.ok("rollback", "the sandbox copy was restored from its backup")
+	return nil
+}
+
+// describeRestart reports how the updated component would be restarted
+func describeRestart(sim *simulation, cmd *ipc.UpdateCommand) {
+	switch cmd.RestartMode {
+	case ipc.RestartNone:
+		sim.skip("restart", "restart disabled")
+		if cmd.AdminSocket != "" {
+			sim.would("resume", "ask the service on %s to resume", cmd.AdminSocket)
+		}
+	case ipc.RestartAdmin:
+		sim.would("restart", "ask the service on %s to restart", cmd.AdminSocket)
+	case ipc.RestartSystemd:
+		sim.would("restart", "run systemctl restart %s", cmd.RestartUnit)
+	default:
+		if cmd.RestartBinary == "" {
+			sim.skip("restart", "no restart binary")
+			return
+		}
+		as := ""
+		if cmd.RunAsUser != "" {
+			as = " as " + cmd.RunAsUser
+		}
+		sim.would("restart", "start %s%s", strings.Join(append([]string{cmd.RestartBinary}, cmd.RestartArgs...), " "), as)
+	}
+}
+
+// simulateConfirm reports the version endpoint the update would wait on,
+// and what it serves now
+func simulateConfirm(sim *simulation, cmd *ipc.UpdateCommand) error {
+	if cmd.VersionURL == "" || cmd.NewVersion == "" || cmd.RestartMode == ipc.RestartNone {
+		return nil
+	}
+	if _, err := update.ParseVersion(cmd.NewVersion); err != nil {
+		return sim.fail(cmd, "confirm", fmt.Errorf("parse new version: %w", err))
+	}
+	timeout := cmp.Or(cmd.VersionTimeout, defaultVersionTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	now := "is unreachable"
+	if info, err := buildinfo.Fetch(ctx, &http.Client{Timeout: 5 * time.Second}, cmd.VersionURL); err == nil {
+		now = "reports " + info.Version
+	}
+	sim.would("confirm", "wait up to %s for %s to report %s; it %s now", timeout, cmd.VersionURL, cmd.NewVersion, now)
+	return nil
+}
+
+// copyFile copies src to dst with its permissions, creating dst's directory
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/platform"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// actionLog returns the action log in the state directory, or nil
+func actionLog() *update.ActionLog {
+	stateDir, err := platform.StateDir()
+	if err != nil {
+		return nil
+	}
+	return update.NewActionLog(filepath.Join(stateDir, update.ActionLogFile))
+}
+
+// recordAction appends entry to the action log; a log that can't be
+// written is reported but doesn't stop the update
+func recordAction(logger *slog.Logger, entry update.ActionEntry) {
+	log := actionLog()
+	if log == nil {
+		return
+	}
+	if entry.Component == "" {
+		entry.Component = "nametag"
+	}
+	if err := log.Append(entry); err != nil {
+		logger.Warn("failed to record action", "action", entry.Action, "error", err)
+	}
+}
+
+// recordFailure records that stage of an update to newVersion failed
+func recordFailure(logger *slog.Logger, stage, newVersion string, err error) {
+	recordAction(logger, update.ActionEntry{
+		Action:  update.ActionFailure,
+		From:    version,
+		Version: newVersion,
+		Detail:  stage + ": " + err.Error(),
+	})
+}
+
+// recordCheck records the outcome of an update check
+func recordCheck(logger *slog.Logger, result *update.CheckResult) {
+	detail := "update available"
+	if !result.UpdateAvailable {
+		detail = string(result.Reason) + ": " + result.Explanation
+	}
+	recordAction(logger, update.ActionEntry{
+		Action:  update.ActionCheck,
+		From:    result.CurrentVersion.String(),
+		Version: result.LatestVersion.String(),
+		Detail:  detail,
+	})
+}
+
+// cmdAudit prints the action log and verifies its hash chain
+func cmdAudit(logger *slog.Logger) {
+	asJSON := flag.Bool("json", false, "Print entries as JSON lines")
+	parseFlags(logger)
+
+	log := actionLog()
+	if log == nil {
+		logger.Error("failed to get state directory")
+		os.Exit(1)
+	}
+
+	var count int64
+	var head string
+	err := log.Entries(func(e update.ActionEntry) {
+		count, head = e.Seq, e.Hash
+		if *asJSON {
+			line, _ := json.Marshal(e)
+			fmt.Println(string(line))
+			return
+		}
+
+		change := e.Version
+		if e.From != "" {
+			change = e.From + " -> " + e.Version
+		}
+		fmt.Printf("%5d  %s  %-8s  %-10s %s", e.Seq, e.Time.Local().Format(time.RFC3339), e.Action, e.Component, change)
+		if e.Detail != "" {
+			fmt.Printf("  %s", e.Detail)
+		}
+		fmt.Println()
+	})
+	if err != nil {
+		logger.Error("action log failed verification", "error", err, "verified_entries", count)
+		os.Exit(1)
+	}
+
+	if !*asJSON {
+		fmt.Fprintf(os.Stderr, "Chain intact: %d entries, head %s\n", count, head)
+	}
+}
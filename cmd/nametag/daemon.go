@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/config"
+	"github.com/1995parham-learning/auto-update-binary/internal/platform"
+)
+
+// daemonLabel is the launchd label the update daemon is installed under
+const daemonLabel = "com.nametag.updater"
+
+const (
+	// networkSettle is how long after a network change a failed update is
+	// retried, for addresses, routes, and DNS to come up
+	networkSettle = 10 * time.Second
+	// networkRetryGap is the least time between two runs, so a flapping
+	// network doesn't have the daemon hammer the server
+	networkRetryGap = time.Minute
+)
+
+// cmdDaemon runs nametag update on a schedule in the background, and on
+// macOS installs itself as a LaunchAgent that keeps it running
+func cmdDaemon(logger *slog.Logger) {
+	if len(os.Args) < 2 {
+		printDaemonUsage()
+		os.Exit(1)
+	}
+
+	action := os.Args[1]
+	os.Args = os.Args[1:]
+	flag.CommandLine = flag.NewFlagSet("daemon "+action, flag.ExitOnError)
+
+	switch action {
+	case "run":
+		cmdDaemonRun(logger)
+	case "install":
+		cmdDaemonInstall(logger)
+	case "uninstall":
+		cmdDaemonUninstall(logger)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown daemon command: %s\n", action)
+		printDaemonUsage()
+		os.Exit(1)
+	}
+}
+
+func printDaemonUsage() {
+	fmt.Println("Usage:")
+	fmt.Println("  nametag daemon run [-interval 6h] [-- update flags]       Run nametag update every interval")
+	fmt.Println("  nametag daemon install [-interval 6h] [-- update flags]   macOS: run the daemon as a LaunchAgent")
+	fmt.Println("  nametag daemon uninstall                                  macOS: stop and remove the LaunchAgent")
+}
+
+// cmdDaemonRun runs nametag update every interval until stopped, passing
+// it the arguments after --, while -updates is auto. A failed update is
+// retried as soon as the network changes, such as when connectivity
+// returns, rather than an interval later. Once an update replaced the binary
+// the daemon exits, so the service manager keeping it alive restarts the
+// new version.
+func cmdDaemonRun(logger *slog.Logger) {
+	interval := flag.Duration("interval", 6*time.Hour, "How often to run nametag update")
+	networkRetry := flag.Bool("network-retry", true, "Retry a failed update as soon as the network changes instead of an interval later")
+	updates := addUpdatesFlag()
+	parseFlags(logger)
+	if *interval <= 0 {
+		logger.Error("invalid interval flag", "value", *interval)
+		os.Exit(1)
+	}
+	if err := checkUpdatesAllowed(*updates); err != nil && *updates != updatesDisabled {
+		logger.Error("invalid updates flag", "error", err)
+		os.Exit(1)
+	}
+	updateArgs := flag.Args()
+
+	execPath, err := platform.GetExecutablePath()
+	if err != nil {
+		logger.Error("failed to get executable path", "error", err)
+		os.Exit(1)
+	}
+	started, err := os.Stat(execPath)
+	if err != nil {
+		logger.Error("failed to stat executable", "error", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var changes <-chan struct{}
+	if *networkRetry {
+		if changes, err = platform.WatchNetwork(ctx); err != nil {
+			logger.Warn("not watching network changes; failed updates are retried at the next interval", "error", err)
+		}
+	}
+
+	logger.Info("update daemon started", "version", version, "interval", *interval)
+	for {
+		// Policy is read again each time, so an administrator turning
+		// automatic updates off or on needn't restart the daemon
+		if _, err := config.ApplyPolicy(flag.CommandLine); err != nil {
+			logger.Warn("failed to load policy", "error", err)
+		}
+		failed := false
+		if *updates == updatesAuto {
+			cmd := exec.Command(execPath, slices.Concat([]string{"update"}, updateArgs)...)
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				logger.Warn("update failed", "error", err)
+				failed = true
+			}
+		} else {
+			logger.Info("skipping update, automatic updates are off", "updates", *updates)
+		}
+
+		if current, err := os.Stat(execPath); err == nil && (!os.SameFile(started, current) || !current.ModTime().Equal(started.ModTime())) {
+			logger.Info("nametag was updated, exiting to be restarted with the new binary")
+			return
+		}
+
+		if !waitForNextRun(ctx, logger, *interval, failed, &changes) {
+			logger.Info("update daemon stopped")
+			return
+		}
+	}
+}
+
+// waitForNextRun waits out interval or, after a failed run, until the
+// network changes and has had time to settle. It reports false once ctx is
+// done. If the network watch stops early, it logs so and sets *changes to
+// nil, leaving failed updates to the interval.
+func waitForNextRun(ctx context.Context, logger *slog.Logger, interval time.Duration, failed bool, changes *<-chan struct{}) bool {
+	next := time.NewTimer(interval)
+	defer next.Stop()
+	earliest := time.Now().Add(networkRetryGap)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-next.C:
+			return true
+		case _, ok := <-*changes:
+			if !ok {
+				if ctx.Err() != nil {
+					return false
+				}
+				logger.Warn("stopped watching network changes; failed updates are retried at the next interval")
+				*changes = nil
+				continue
+			}
+			if !failed {
+				continue
+			}
+		}
+
+		settle := max(networkSettle, time.Until(earliest))
+		logger.Info("network changed, retrying the failed update", "in", settle)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(settle):
+		}
+		// The changes while settling are what the retry is for
+		select {
+		case <-*changes:
+		default:
+		}
+		return true
+	}
+}
+
+// cmdDaemonInstall writes and loads a LaunchAgent running daemon run with
+// the same flags; installing again replaces it
+func cmdDaemonInstall(logger *slog.Logger) {
+	interval := flag.Duration("interval", 6*time.Hour, "How often to run nametag update")
+	throttle := flag.Duration("throttle", time.Minute, "Least time between two starts of the daemon, e.g. after an update")
+	networkRetry := flag.Bool("network-retry", true, "Retry a failed update as soon as the network changes instead of an interval later")
+	parseFlags(logger)
+	if *interval <= 0 {
+		logger.Error("invalid interval flag", "value", *interval)
+		os.Exit(1)
+	}
+
+	execPath, err := platform.GetExecutablePath()
+	if err != nil {
+		logger.Error("failed to get executable path", "error", err)
+		os.Exit(1)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		logger.Error("failed to get home directory", "error", err)
+		os.Exit(1)
+	}
+
+	args := []string{execPath, "daemon", "run", "-interval", interval.String(), "-network-retry=" + strconv.FormatBool(*networkRetry)}
+	if len(flag.Args()) > 0 {
+		args = slices.Concat(args, []string{"--"}, flag.Args())
+	}
+	agent := platform.LaunchAgent{
+		Label:    daemonLabel,
+		Args:     args,
+		Throttle: *throttle,
+		LogPath:  filepath.Join(home, "Library", "Logs", "nametag", "daemon.log"),
+	}
+	path, err := platform.InstallLaunchAgent(agent)
+	if errors.Is(err, platform.ErrLaunchdUnsupported) {
+		logger.Error("daemon install is only supported on macOS; have systemd or Task Scheduler run nametag daemon run instead")
+		os.Exit(1)
+	}
+	if err != nil {
+		logger.Error("failed to install launch agent", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("update daemon installed", "plist", path, "log", agent.LogPath, "interval", *interval)
+}
+
+// cmdDaemonUninstall stops the LaunchAgent and removes its plist
+func cmdDaemonUninstall(logger *slog.Logger) {
+	parseFlags(logger)
+
+	path, err := platform.UninstallLaunchAgent(daemonLabel)
+	if errors.Is(err, platform.ErrLaunchdUnsupported) {
+		logger.Error("daemon uninstall is only supported on macOS")
+		os.Exit(1)
+	}
+	if err != nil {
+		logger.Error("failed to uninstall launch agent", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("update daemon uninstalled", "plist", path)
+}
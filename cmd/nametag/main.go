@@ -1,14 +1,22 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/1995parham-learning/auto-update-binary/internal/config"
 	"github.com/1995parham-learning/auto-update-binary/internal/ipc"
 	"github.com/1995parham-learning/auto-update-binary/internal/platform"
 	"github.com/1995parham-learning/auto-update-binary/internal/update"
@@ -19,6 +27,35 @@ var (
 	commit    = "none"
 	date      = "unknown"
 	serverURL = "http://localhost:8080"
+
+	// publicKey is the base64 Ed25519 key trusted to sign manifests, or a
+	// comma-separated list of them. When set (via -ldflags), manifests not
+	// signed by keyThreshold of the keys are rejected.
+	publicKey    = ""
+	keyThreshold = "1"
+
+	// channelKeys are the keys trusted to sign release channels other than
+	// stable, as comma-separated CHANNEL=KEY pairs; list a channel again for
+	// more keys, any one of which suffices. Only used with publicKey, which
+	// never signs for those channels.
+	channelKeys = ""
+
+	// pinServer, when "true" (via -ldflags), forbids updating from any server
+	// other than serverURL
+	pinServer = "false"
+
+	// publisher, when set (via -ldflags), is the code signing identity an
+	// update must be signed by before it replaces the binary
+	publisher = ""
+
+	// product, when set (via -ldflags), is the namespace nametag is
+	// distributed under on a server serving several products
+	product = ""
+
+	// formerNames, when set (via -ldflags), are the comma-separated names
+	// earlier releases of nametag were installed as; a binary started under
+	// one of them moves itself to nametag
+	formerNames = ""
 )
 
 func main() {
@@ -29,6 +66,26 @@ func main() {
 	// Clean up any old binaries from previous updates
 	_ = platform.CleanupOldBinaries()
 
+	// A release installed over a binary of a former name, by a client from
+	// before the rename, takes its own name
+	if formerNames != "" {
+		if execPath, err := platform.GetExecutablePath(); err == nil {
+			migrated, err := update.MigrateRename(execPath, "nametag", strings.Split(formerNames, ","))
+			if err != nil {
+				logger.Warn("failed to migrate to the new binary name", "error", err)
+			} else if migrated != execPath {
+				logger.Info("migrated to the new binary name", "from", execPath, "to", migrated)
+			}
+		}
+	}
+
+	// Apply an update staged by update -stage before anything else runs; the
+	// updated binary takes over with the same arguments. Staging runs wait
+	// until their flags say whether they stage again.
+	if (len(os.Args) < 2 || os.Args[1] != "update") && applyStaged(logger, os.Args[1:]) {
+		exit(0)
+	}
+
 	if len(os.Args) < 2 {
 		printUsage()
 		os.Exit(1)
@@ -45,6 +102,16 @@ func main() {
 		cmdCheck(logger)
 	case "update":
 		cmdUpdate(logger)
+	case "sbom":
+		cmdSBOM(logger)
+	case "trust":
+		cmdTrust(logger)
+	case "slots":
+		cmdSlots(logger)
+	case "audit":
+		cmdAudit(logger)
+	case "daemon":
+		cmdDaemon(logger)
 	case "help":
 		printUsage()
 	default:
@@ -64,6 +131,11 @@ func printUsage() {
 	fmt.Println("  version   Show version information")
 	fmt.Println("  check     Check for updates")
 	fmt.Println("  update    Download and apply updates")
+	fmt.Println("  sbom      Download a release's software bill of materials")
+	fmt.Println("  trust     Manage signing keys trusted locally")
+	fmt.Println("  slots     Manage blue/green binary slots and switch back instantly")
+	fmt.Println("  audit     Print the local log of update actions and verify its hash chain")
+	fmt.Println("  daemon    Update in the background on a schedule, as a LaunchAgent on macOS")
 	fmt.Println("  help      Show this help message")
 }
 
@@ -76,7 +148,14 @@ func cmdVersion() {
 
 func cmdCheck(logger *slog.Logger) {
 	server := flag.String("server", serverURL, "Update server URL")
-	flag.Parse()
+	tufRoot := flag.String("tuf-root", "", "Trusted TUF root.json to bootstrap TUF metadata verification")
+	channel := flag.String("channel", update.ChannelStable, "Release channel to follow, e.g. beta or nightly")
+	conn := addConnFlags()
+	maxAge := flag.Duration("max-manifest-age", 0, "Reject manifests generated longer ago than this (0 relies on the manifest's expiry)")
+	ignoreBackoff := flag.Bool("ignore-backoff", false, "Contact the server even if it asked clients to back off")
+	hooks := flag.String("hooks", hooksSigned, "Hook policy update will run with, for the preview: always, signed, or never")
+	gpgKeyring := flag.String("gpg-keyring", "", "GPG keyring update will verify assets with, for the preview")
+	parseFlags(logger)
 
 	currentVersion, err := update.ParseVersion(version)
 	if err != nil {
@@ -84,28 +163,545 @@ func cmdCheck(logger *slog.Logger) {
 		os.Exit(1)
 	}
 
-	checker := update.NewChecker(*server, logger)
+	hookPolicy, err := resolveHookPolicy(*hooks, *gpgKeyring != "")
+	if err != nil {
+		logger.Error("invalid hooks flag", "error", err)
+		os.Exit(1)
+	}
+
+	opts, _ := clientOptions(logger, *server, *tufRoot, *channel, conn)
+	opts = append(opts, update.WithMaxManifestAge(*maxAge))
+	if *ignoreBackoff {
+		opts = append(opts, update.WithIgnoreBackoff())
+	}
+	checker := update.NewChecker(*server, logger, opts...)
 	ctx := context.Background()
 
 	result, err := checker.Check(ctx, "nametag", currentVersion)
+	if reportBackoff(err) {
+		return
+	}
 	if err != nil {
 		logger.Error("failed to check for updates", "error", err)
+		recordFailure(logger, "check", "", err)
 		os.Exit(1)
 	}
+	recordCheck(logger, result)
 
 	if result.UpdateAvailable {
 		fmt.Printf("Update available!\n")
-		fmt.Printf("  Current: %s\n", result.CurrentVersion.String())
-		fmt.Printf("  Latest:  %s\n", result.LatestVersion.String())
-		fmt.Printf("\nRun 'nametag update' to install the update.\n")
+		fmt.Printf("  Current:  %s\n", result.CurrentVersion.String())
+		fmt.Printf("  Latest:   %s\n", result.LatestVersion.String())
+		if execPath, err := platform.GetExecutablePath(); err == nil {
+			if installPath := migrationPath(execPath, result.InstallDir); installPath != "" {
+				fmt.Printf("  Moves to: %s, forwarded from %s\n", installPath, execPath)
+			}
+		}
+		if result.RenamedTo != "" {
+			fmt.Printf("  Renamed:  nametag is now published as %s\n", result.RenamedTo)
+		}
+		printPreview(result, hookPolicy)
+		if hint := cmp.Or(storeHint(), containerHint()); hint != "" {
+			fmt.Printf("\nNote: %s.\n", hint)
+		} else {
+			fmt.Printf("\nRun 'nametag update' to install the update.\n")
+		}
 	} else {
+		printNoUpdate(result)
+	}
+}
+
+// printPreview tells the operator what applying the update involves
+func printPreview(result *update.CheckResult, hookPolicy ipc.HookPolicy) {
+	preview := result.Preview
+
+	download := formatSize(preview.DownloadSize) + ", full download"
+	if execPath, err := platform.GetExecutablePath(); err == nil {
+		if info, err := os.Stat(execPath); err == nil {
+			download += fmt.Sprintf("; installed binary is %s", formatSize(info.Size()))
+		}
+	}
+	if result.Asset.Format != "" {
+		download += fmt.Sprintf("; %s archive", result.Asset.Format)
+	}
+	fmt.Printf("  Download: %s\n", download)
+
+	switch {
+	case !preview.RestartRequired:
+		fmt.Printf("  Restart:  no, left to the operator\n")
+	case preview.RestartMode == update.RestartSystemd:
+		fmt.Printf("  Restart:  yes, systemd unit %s\n", result.Restart.Unit)
+	default:
+		fmt.Printf("  Restart:  yes, %s\n", preview.RestartMode)
+	}
+
+	switch {
+	case len(preview.Hooks) == 0:
+		fmt.Printf("  Hooks:    none\n")
+	case hookPolicy == ipc.HookAllow:
+		fmt.Printf("  Hooks:    %s (will run)\n", strings.Join(preview.Hooks, ", "))
+	default:
+		fmt.Printf("  Hooks:    %s (not allowed by the -hooks policy; update refuses the archive)\n", strings.Join(preview.Hooks, ", "))
+	}
+
+	switch {
+	case !preview.RestartRequired:
+		fmt.Printf("  Downtime: none until restarted\n")
+	case preview.Downtime > 0:
+		fmt.Printf("  Downtime: about %s\n", preview.Downtime)
+	default:
+		fmt.Printf("  Downtime: not estimated by the publisher\n")
+	}
+}
+
+// formatSize renders a byte count in binary units
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// reportBackoff tells the user when the server asked clients to back off.
+// That isn't a failure: the next scheduled run picks the update up.
+func reportBackoff(err error) bool {
+	var backoff *update.BackoffError
+	if !errors.As(err, &backoff) {
+		return false
+	}
+	fmt.Printf("The update server asked clients to wait until %s; skipping this check (use -ignore-backoff to override)\n",
+		backoff.Until.Local().Format(time.RFC1123))
+	return true
+}
+
+// printNoUpdate tells the user why no update is offered, so a client held
+// back by a rollout or a missing asset isn't mistaken for an up-to-date one
+func printNoUpdate(result *update.CheckResult) {
+	switch result.Reason {
+	case update.NoUpdateUpToDate:
 		fmt.Printf("You are running the latest version (%s)\n", version)
+	case update.NoUpdateDeferred:
+		fmt.Printf("Update to %s is available, but the server deferred it for %s to spread out downloads (use -ignore-backoff to override)\n",
+			result.LatestVersion.String(), result.Deferred)
+	default:
+		fmt.Printf("No update for %s (%s): %s\n", version, result.Reason, result.Explanation)
+	}
+}
+
+// parseFlags parses the subcommand's flags and fills in the rest from
+// NAMETAG_* environment variables and the config file
+func parseFlags(logger *slog.Logger) {
+	flag.String(config.FlagName, "", "Config file (default: nametag/config.json in the user config directory)")
+	flag.Parse()
+
+	if err := config.Load(flag.CommandLine, config.ClientEnvPrefix, config.DefaultClientPath()); err != nil {
+		logger.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+	enforced, err := config.ApplyPolicy(flag.CommandLine)
+	if err != nil {
+		logger.Error("failed to load policy", "error", err)
+		os.Exit(1)
+	}
+	if len(enforced) > 0 {
+		logger.Info("settings enforced by policy", "flags", strings.Join(enforced, ","))
+	}
+}
+
+// checkServerTrust refuses to update from a server other than the built-in
+// one unless its manifests are verified, since whoever controls the server
+// otherwise controls the binary
+func checkServerTrust(server string, verified, insecure bool) error {
+	if server == serverURL {
+		return nil
+	}
+	if pinServer == "true" {
+		return fmt.Errorf("server is pinned to %s at build time", serverURL)
+	}
+	if !verified && !insecure {
+		return fmt.Errorf("%s is not the built-in server and there is no public key or TUF root to verify it (use -insecure to override)", server)
+	}
+	return nil
+}
+
+// storeHint explains that a binary in a package store is upgraded through
+// its package manager, or returns "" for one that isn't
+func storeHint() string {
+	execPath, err := platform.GetExecutablePath()
+	if err != nil {
+		return ""
+	}
+	reason, ok := platform.ImmutableStore(execPath)
+	if !ok {
+		return ""
+	}
+	return reason
+}
+
+// Values of the update -container-policy flag
+const (
+	containerNotify = "notify"
+	containerUpdate = "update"
+)
+
+// containerHint explains why updating in place inside a container is the
+// wrong move, or returns "" outside one
+func containerHint() string {
+	reason, ok := platform.InContainer()
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("nametag is running in a container (%s); rebuild the image with the new version instead of updating it in place, "+
+		"since the change is lost when the container is recreated", reason)
+}
+
+// Values of the -updates flag, usually enforced by an administrator
+// through policy
+const (
+	updatesAuto     = "auto"
+	updatesManual   = "manual"
+	updatesDisabled = "disabled"
+)
+
+// addUpdatesFlag registers the flag deciding who may install updates
+func addUpdatesFlag() *string {
+	return flag.String("updates", updatesAuto, "Who installs updates: auto (nametag update and the update daemon), manual (only nametag update run by hand), or disabled (nothing)")
+}
+
+// checkUpdatesAllowed refuses nametag update when -updates disables updates
+func checkUpdatesAllowed(updates string) error {
+	switch updates {
+	case updatesAuto, updatesManual:
+		return nil
+	case updatesDisabled:
+		return errors.New("updates are disabled (updates=disabled); they are managed by your administrator or config")
+	}
+	return fmt.Errorf("invalid updates flag %q", updates)
+}
+
+// Values of the update -hooks flag
+const (
+	hooksAlways = "always"
+	hooksSigned = "signed"
+	hooksNever  = "never"
+)
+
+// resolveHookPolicy maps the -hooks flag to the policy the updater enforces.
+// "signed" only allows hooks when a public key is embedded or a GPG keyring
+// is given, since the asset signature is then verified before the updater
+// runs.
+func resolveHookPolicy(hooks string, gpgVerified bool) (ipc.HookPolicy, error) {
+	switch hooks {
+	case hooksAlways:
+		return ipc.HookAllow, nil
+	case hooksSigned:
+		if publicKey != "" || gpgVerified {
+			return ipc.HookAllow, nil
+		}
+		return ipc.HookDeny, nil
+	case hooksNever:
+		return ipc.HookDeny, nil
+	default:
+		return "", fmt.Errorf("unknown value %q", hooks)
+	}
+}
+
+// connFlags configure the connection to the update server
+type connFlags struct {
+	pins   *string
+	cert   *string
+	key    *string
+	caFile *string
+
+	product      *string
+	group        *string
+	authToken    *string
+	signRequests *bool
+	tokenSource  *string
+	clientID     *string
+	clientSecret *string
+	oauthScope   *string
+
+	maxManifestSize *int
+	maxComponents   *int
+	maxAssets       *int
+}
+
+func addConnFlags() *connFlags {
+	return &connFlags{
+		pins:   flag.String("pin", "", "Comma-separated TLS pins the server's certificate chain must match: sha256//<base64 public key hash> or a certificate's hex SHA-256 fingerprint"),
+		cert:   flag.String("tls-cert", "", "PEM client certificate for servers that require mutual TLS (requires -tls-key)"),
+		key:    flag.String("tls-key", "", "PEM private key for -tls-cert"),
+		caFile: flag.String("ca-file", "", "PEM bundle of extra CAs to trust for the server, e.g. an internal CA or a TLS-inspecting proxy"),
+
+		product:      flag.String("product", product, "Product namespace on a server distributing several products (/v1/{product}/)"),
+		group:        flag.String("group", "", "Group label the server's targeting rules may offer releases by, e.g. pilot"),
+		authToken:    flag.String("auth-token", "", "API key for servers that require one for manifests and downloads"),
+		signRequests: flag.Bool("sign-requests", false, "Sign requests with the -auth-token API key instead of sending it, so captured requests can't be replayed"),
+		tokenSource:  flag.String("token-source", "", "Where to get bearer tokens for servers behind an identity provider: file:PATH, exec:COMMAND, or oauth2:TOKEN_URL"),
+		clientID:     flag.String("oauth-client-id", "", "OAuth 2.0 client ID for -token-source oauth2:"),
+		clientSecret: flag.String("oauth-client-secret", "", "OAuth 2.0 client secret for -token-source oauth2: (better set through NAMETAG_OAUTH_CLIENT_SECRET)"),
+		oauthScope:   flag.String("oauth-scope", "", "Scope to request with -token-source oauth2:"),
+
+		maxManifestSize: flag.Int("max-manifest-size", 0, "Refuse manifests larger than this many bytes (0 is 4 MiB)"),
+		maxComponents:   flag.Int("max-manifest-components", 0, "Refuse manifests listing more components than this (0 is unlimited)"),
+		maxAssets:       flag.Int("max-component-assets", 0, "Refuse components with assets for more platforms than this (0 is unlimited)"),
+	}
+}
+
+// options returns the update options the connection flags ask for
+func (f *connFlags) options(logger *slog.Logger, server string) []update.Option {
+	var opts []update.Option
+	if *f.product != "" {
+		if err := update.ValidateProduct(*f.product); err != nil {
+			logger.Error("invalid product", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, update.WithProduct(*f.product))
+	}
+	if *f.group != "" {
+		if err := update.ValidateGroup(*f.group); err != nil {
+			logger.Error("invalid group", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, update.WithGroup(*f.group))
+	}
+	if *f.authToken != "" {
+		opts = append(opts, update.WithAuthToken(*f.authToken))
+	}
+	if *f.signRequests {
+		if *f.authToken == "" {
+			logger.Error("-sign-requests requires -auth-token")
+			os.Exit(1)
+		}
+		opts = append(opts, update.WithSignedRequests())
+	}
+	if *f.tokenSource != "" {
+		source, err := update.ParseTokenSource(*f.tokenSource, *f.clientID, *f.clientSecret, *f.oauthScope)
+		if err != nil {
+			logger.Error("invalid token source", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, update.WithTokenSource(source))
+	}
+	if *f.maxManifestSize < 0 || *f.maxComponents < 0 || *f.maxAssets < 0 {
+		logger.Error("manifest limits must not be negative")
+		os.Exit(1)
+	}
+	opts = append(opts, update.WithManifestLimits(update.ManifestLimits{
+		MaxSize:       *f.maxManifestSize,
+		MaxComponents: *f.maxComponents,
+		MaxAssets:     *f.maxAssets,
+	}))
+
+	if (*f.pins != "" || *f.cert != "" || *f.caFile != "") && !strings.HasPrefix(server, "https://") {
+		logger.Error("TLS options need an https:// server", "server", server)
+		os.Exit(1)
+	}
+
+	if *f.caFile != "" {
+		pool, err := update.LoadCABundle(*f.caFile)
+		if err != nil {
+			logger.Error("failed to load ca bundle", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, update.WithRootCAs(pool))
+	}
+
+	if *f.pins != "" {
+		pinSet, err := update.ParsePins(*f.pins)
+		if err != nil {
+			logger.Error("invalid TLS pins", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, update.WithTLSPins(pinSet))
+	}
+
+	if *f.cert != "" || *f.key != "" {
+		cert, err := tls.LoadX509KeyPair(*f.cert, *f.key)
+		if err != nil {
+			logger.Error("failed to load client certificate", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, update.WithClientCertificate(cert))
+	}
+
+	return opts
+}
+
+// clientOptions returns the options derived from build-time configuration
+// and client state, and whether they verify the manifest
+func clientOptions(logger *slog.Logger, server, tufRoot, channel string, conn *connFlags) ([]update.Option, bool) {
+	// Connection options go first so the TUF client below uses them too
+	opts := conn.options(logger, server)
+
+	stateDir, err := platform.StateDir()
+	if err != nil {
+		logger.Error("failed to get state directory", "error", err)
+		os.Exit(1)
+	}
+	channel = update.NormalizeChannel(channel)
+	if err := update.ValidateChannel(channel); err != nil {
+		logger.Error("invalid channel", "error", err)
+		os.Exit(1)
+	}
+	if channel != update.ChannelStable {
+		opts = append(opts, update.WithChannel(channel))
+	}
+
+	opts = append(opts,
+		update.WithInstalledState(filepath.Join(stateDir, update.InstalledFile)),
+		update.WithBackoff(filepath.Join(stateDir, update.BackoffFile)),
+		update.WithVerifyCache(filepath.Join(stateDir, update.VerifyCacheFile)),
+		update.WithManifestDictionary(filepath.Join(stateDir, update.ManifestDictionaryFile)),
+		update.WithMachineID(filepath.Join(stateDir, update.MachineIDFile)),
+	)
+
+	// Keys added with nametag trust are trusted on top of the built-in ones,
+	// or on their own by a client built without any
+	local, err := update.NewTrustStore(update.TrustStorePath(stateDir, channel)).Keys(time.Now())
+	if err != nil {
+		logger.Error("failed to load trust store", "error", err)
+		os.Exit(1)
+	}
+
+	var keys *update.TrustedKeys
+	if publicKey != "" {
+		threshold, err := strconv.Atoi(keyThreshold)
+		if err != nil {
+			logger.Error("invalid embedded key threshold", "error", err)
+			os.Exit(1)
+		}
+		builtin, err := update.ParseKeySet(publicKey, threshold)
+		if err != nil {
+			logger.Error("invalid embedded public key", "error", err)
+			os.Exit(1)
+		}
+
+		storePath := filepath.Join(stateDir, "keys.json")
+		if channel != update.ChannelStable {
+			// Other channels are verified with their own keys only, so a
+			// key leaked from one can't sign for stable
+			builtin, err = builtinChannelKeys(channel)
+			if err != nil && len(local) == 0 {
+				logger.Error("no trusted keys for channel", "channel", channel, "error", err)
+				os.Exit(1)
+			}
+			storePath = filepath.Join(stateDir, "keys-"+channel+".json")
+		}
+
+		if builtin != nil {
+			keys, err = update.NewChannelKeys(channel, builtin, storePath)
+			if err != nil {
+				logger.Error("failed to load trusted keys", "error", err)
+				os.Exit(1)
+			}
+			keys.AddLocal(local...)
+		}
+	}
+	if keys == nil && len(local) > 0 {
+		keys, err = update.NewLocalKeys(local)
+		if err != nil {
+			logger.Error("failed to load trusted keys", "error", err)
+			os.Exit(1)
+		}
+	}
+	verified := keys != nil
+	if keys != nil {
+		opts = append(opts, update.WithTrustedKeys(keys))
+	}
+
+	tufDir := filepath.Join(stateDir, "tuf")
+
+	if usesTUF(tufRoot) {
+		verified = true
+
+		var bootstrap []byte
+		if tufRoot != "" {
+			bootstrap, err = os.ReadFile(tufRoot)
+			if err != nil {
+				logger.Error("failed to read tuf root", "error", err)
+				os.Exit(1)
+			}
+		}
+
+		client, err := update.NewTUFClient(server, tufDir, bootstrap, logger, opts...)
+		if err != nil {
+			logger.Error("failed to initialize tuf client", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, update.WithTUF(client))
 	}
+
+	return opts, verified
+}
+
+// builtinChannelKeys returns the key set built in for channel
+func builtinChannelKeys(channel string) (*update.KeySet, error) {
+	var keys []string
+	for _, pair := range strings.Split(channelKeys, ",") {
+		// Keys are base64 and may end in "=", so cut at the first one
+		name, key, ok := strings.Cut(pair, "=")
+		if ok && name == channel {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("none built in")
+	}
+	return update.ParseKeySet(strings.Join(keys, ","), 1)
+}
+
+// usesTUF reports whether the client verifies updates with TUF. Once a TUF
+// root is trusted, TUF stays in use so clients can't be downgraded to the
+// unauthenticated manifest.
+func usesTUF(tufRoot string) bool {
+	if tufRoot != "" {
+		return true
+	}
+	stateDir, err := platform.StateDir()
+	return err == nil && update.HasTrustedRoot(filepath.Join(stateDir, "tuf"))
 }
 
 func cmdUpdate(logger *slog.Logger) {
 	server := flag.String("server", serverURL, "Update server URL")
-	flag.Parse()
+	tufRoot := flag.String("tuf-root", "", "Trusted TUF root.json to bootstrap TUF metadata verification")
+	channel := flag.String("channel", update.ChannelStable, "Release channel to follow, e.g. beta or nightly")
+	conn := addConnFlags()
+	maxAge := flag.Duration("max-manifest-age", 0, "Reject manifests generated longer ago than this (0 relies on the manifest's expiry)")
+	ignoreBackoff := flag.Bool("ignore-backoff", false, "Contact the server even if it asked clients to back off")
+	hooks := flag.String("hooks", hooksSigned, "When to run hook scripts shipped in update archives: always, signed, or never")
+	gpgKeyring := flag.String("gpg-keyring", "", "Require assets to carry a GPG signature from a key in this keyring (exported with gpg --export)")
+	insecure := flag.Bool("insecure", false, "Allow updating from a non-default server without manifest verification")
+	allowDowngrade := flag.Bool("allow-downgrade", false, "Install the server's version even if it is lower than one installed before")
+	licenseToken := flag.String("license-token", "", "License token exchanged for the keys of end-to-end encrypted private releases")
+	provenanceKeys := flag.String("provenance-keys", "", "Require SLSA provenance signed by one of the PEM public keys in this file")
+	provenanceBuilder := flag.String("provenance-builder", "", "Require SLSA provenance naming this builder ID (needs -provenance-keys)")
+	provenanceSource := flag.String("provenance-source", "", "Require SLSA provenance naming this source repository (needs -provenance-keys)")
+	requireSBOM := flag.Bool("require-sbom", false, "Refuse updates whose release has no SBOM published")
+	containerPolicy := flag.String("container-policy", containerNotify, "What to do when running inside a container: notify (report the update only) or update (install it anyway)")
+	transparency := flag.Bool("transparency", false, "Refuse updates the server's transparency log doesn't prove to contain")
+	stage := flag.Bool("stage", false, "Download and verify the update, then apply it the next time nametag starts instead of now")
+	scanCommand := flag.String("scan-command", "", "Command run against the downloaded file before it is installed, e.g. clamscan; a non-zero exit aborts the update")
+	uninstallKey := flag.String("uninstall-key", "", "Windows: Uninstall registry entry to record the new version and install location in after the update, e.g. Nametag")
+	updates := addUpdatesFlag()
+	parseFlags(logger)
+	if err := checkUpdatesAllowed(*updates); err != nil {
+		logger.Error("not updating", "error", err)
+		os.Exit(1)
+	}
+
+	// Staging again queues behind what is staged rather than applying it,
+	// so a scheduled update -stage never restarts nametag
+	if !*stage && applyStaged(logger, os.Args) {
+		exit(0)
+	}
 
 	currentVersion, err := update.ParseVersion(version)
 	if err != nil {
@@ -113,28 +709,157 @@ func cmdUpdate(logger *slog.Logger) {
 		os.Exit(1)
 	}
 
+	// The running version counts as installed, so the floor covers the
+	// initial install too
+	if stateDir, err := platform.StateDir(); err == nil {
+		if err := update.RecordInstalled(filepath.Join(stateDir, update.InstalledFile), "nametag", currentVersion); err != nil {
+			logger.Warn("failed to record installed version", "error", err)
+		}
+	}
+
+	hookPolicy, err := resolveHookPolicy(*hooks, *gpgKeyring != "")
+	if err != nil {
+		logger.Error("invalid hooks flag", "error", err)
+		os.Exit(1)
+	}
+	if *containerPolicy != containerNotify && *containerPolicy != containerUpdate {
+		logger.Error("invalid container-policy flag", "value", *containerPolicy)
+		os.Exit(1)
+	}
+
 	ctx := context.Background()
 
 	// Step 1: Check for updates
 	logger.Info("checking for updates")
-	checker := update.NewChecker(*server, logger)
+	opts, verified := clientOptions(logger, *server, *tufRoot, *channel, conn)
+	if err := checkServerTrust(*server, verified, *insecure); err != nil {
+		logger.Error("untrusted update server", "error", err)
+		os.Exit(1)
+	}
+	if *gpgKeyring != "" {
+		opts = append(opts, update.WithGPGKeyring(*gpgKeyring))
+	}
+	if *allowDowngrade {
+		opts = append(opts, update.WithAllowDowngrade())
+	}
+	opts = append(opts, update.WithMaxManifestAge(*maxAge))
+	if *ignoreBackoff {
+		opts = append(opts, update.WithIgnoreBackoff())
+	}
+	if *licenseToken != "" {
+		opts = append(opts, update.WithLicenseToken(*licenseToken))
+	}
+	if *transparency {
+		stateDir, err := platform.StateDir()
+		if err != nil {
+			logger.Error("failed to get state directory", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, update.WithTransparencyLog(filepath.Join(stateDir, update.TransparencyFile)))
+	}
+	if *provenanceKeys != "" {
+		keys, err := update.LoadProvenanceKeys(*provenanceKeys)
+		if err != nil {
+			logger.Error("failed to load provenance keys", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, update.WithProvenancePolicy(&update.ProvenancePolicy{
+			Builder: *provenanceBuilder,
+			Source:  *provenanceSource,
+			Keys:    keys,
+		}))
+	} else if *provenanceBuilder != "" || *provenanceSource != "" {
+		logger.Error("-provenance-builder and -provenance-source need -provenance-keys to verify attestations with")
+		os.Exit(1)
+	}
+	checker := update.NewChecker(*server, logger, opts...)
 
 	result, err := checker.Check(ctx, "nametag", currentVersion)
+	if reportBackoff(err) {
+		return
+	}
 	if err != nil {
 		logger.Error("failed to check for updates", "error", err)
+		recordFailure(logger, "check", "", err)
 		os.Exit(1)
 	}
+	recordCheck(logger, result)
 
 	if !result.UpdateAvailable {
-		fmt.Printf("You are running the latest version (%s)\n", version)
+		printNoUpdate(result)
+		return
+	}
+
+	// The checker already enforces this; refuse outright should a manifest
+	// slip through without a signature from the pinned keys
+	if publicKey != "" && !usesTUF(*tufRoot) {
+		if len(result.Signers) == 0 {
+			logger.Error("manifest is not signed by the pinned keys")
+			os.Exit(1)
+		}
+		signers := make([]string, 0, len(result.Signers))
+		for _, key := range result.Signers {
+			signers = append(signers, update.EncodePublicKey(key))
+		}
+		logger.Info("manifest signed by pinned keys", "signers", signers)
+	}
+
+	if *requireSBOM && result.Asset.SBOMURL == "" {
+		logger.Error("release has no sbom; refusing to update (drop -require-sbom to override)", "version", result.LatestVersion.String())
+		os.Exit(1)
+	}
+
+	// A store's binaries are replaced by its package manager, whatever the
+	// policy; an attempt is bound to fail
+	if hint := storeHint(); hint != "" {
+		fmt.Printf("Update %s -> %s available, not installed: %s.\n", result.CurrentVersion.String(), result.LatestVersion.String(), hint)
 		return
 	}
 
+	// An image's binaries are replaced by rebuilding it, not by the container
+	if hint := containerHint(); hint != "" {
+		if *containerPolicy == containerNotify {
+			fmt.Printf("Update %s -> %s available, not installed: %s.\n", result.CurrentVersion.String(), result.LatestVersion.String(), hint)
+			return
+		}
+		logger.Warn("updating inside a container as -container-policy allows", "hint", hint)
+	}
+
+	// A binary that can't be replaced is better found out before the download
+	if execPath, err := platform.GetExecutablePath(); err == nil {
+		if err := platform.CheckWritable(execPath); err != nil {
+			logger.Error("cannot install the update here", "error", err)
+			recordFailure(logger, "preflight", result.LatestVersion.String(), err)
+			os.Exit(1)
+		}
+		if err := lockSharedInstall(execPath); err != nil {
+			logger.Error("cannot update the shared install", "error", err)
+			recordFailure(logger, "preflight", result.LatestVersion.String(), err)
+			os.Exit(1)
+		}
+		defer unlockShared()
+	}
+
 	fmt.Printf("Downloading update %s -> %s\n", result.CurrentVersion.String(), result.LatestVersion.String())
 
-	// Step 2: Download the new binary
-	downloader := update.NewDownloader(logger)
-	tempPath := platform.TempDownloadPath(result.LatestVersion.String())
+	// Step 2: Download the new binary; staged updates wait in the state
+	// directory, which survives reboots
+	downloader := update.NewDownloader(logger, opts...)
+	var tempPath string
+	if *stage {
+		dir, err := newStagedEntry()
+		if err != nil {
+			logger.Error("failed to prepare staging", "error", err)
+			exit(1)
+		}
+		tempPath = filepath.Join(dir, "nametag-update-"+result.LatestVersion.String()+platform.BinaryExtension())
+	} else {
+		tempPath, err = platform.TempDownloadPath(result.LatestVersion.String())
+		if err != nil {
+			logger.Error("failed to create download file", "error", err)
+			exit(1)
+		}
+	}
 
 	// Build full download URL
 	downloadURL := *server + result.Asset.URL
@@ -147,80 +872,259 @@ func cmdUpdate(logger *slog.Logger) {
 	})
 	if err != nil {
 		logger.Error("download failed", "error", err)
-		os.Remove(tempPath)
-		os.Exit(1)
+		recordFailure(logger, "download", result.LatestVersion.String(), err)
+		platform.Shred(tempPath)
+		exit(1)
 	}
 	fmt.Println() // Newline after progress
+	recordAction(logger, update.ActionEntry{
+		Action:  update.ActionDownload,
+		From:    version,
+		Version: result.LatestVersion.String(),
+		Detail:  "sha256 " + downloadResult.SHA256,
+	})
 
 	// Step 3: Verify checksum
 	logger.Info("verifying checksum")
-	if downloadResult.SHA256 != result.Asset.SHA256 {
-		logger.Error("checksum mismatch",
-			"expected", result.Asset.SHA256,
-			"got", downloadResult.SHA256,
-		)
-		os.Remove(tempPath)
-		os.Exit(1)
+	if err := update.MatchDigests(result.Asset.Digests(), downloadResult.Hashes); err != nil {
+		logger.Error("checksum mismatch", "error", err)
+		recordFailure(logger, "checksum", result.LatestVersion.String(), err)
+		platform.Shred(tempPath)
+		exit(1)
+	}
+
+	// Step 4: Verify signature so the updater only ever sees trusted binaries
+	signatureURL := ""
+	if result.Asset.SignatureURL != "" {
+		signatureURL = *server + result.Asset.SignatureURL
+	}
+	if err := downloader.VerifySignature(ctx, signatureURL, tempPath); err != nil {
+		logger.Error("signature verification failed", "error", err)
+		recordFailure(logger, "signature", result.LatestVersion.String(), err)
+		platform.Shred(tempPath)
+		exit(1)
 	}
 
-	// Step 4: Prepare update command
+	gpgSignatureURL := ""
+	if result.Asset.GPGSignatureURL != "" {
+		gpgSignatureURL = *server + result.Asset.GPGSignatureURL
+	}
+	if err := downloader.VerifyGPGSignature(ctx, gpgSignatureURL, tempPath); err != nil {
+		logger.Error("gpg signature verification failed", "error", err)
+		recordFailure(logger, "gpg signature", result.LatestVersion.String(), err)
+		platform.Shred(tempPath)
+		exit(1)
+	}
+
+	// Step 4b: Decrypt a private asset, now that its ciphertext is verified;
+	// the updater checks the plaintext
+	expectedSHA256, expectedHashes := result.Asset.SHA256, result.Asset.Hashes
+	if result.Asset.KeyID != "" {
+		logger.Info("decrypting private asset", "key_id", result.Asset.KeyID)
+		keys, err := downloader.FetchContentKeys(ctx, *server+update.LicenseKeysPath)
+		if err == nil {
+			err = update.DecryptPrivateAsset(tempPath, keys)
+		}
+		if err != nil {
+			logger.Error("failed to decrypt private asset", "error", err)
+			recordFailure(logger, "decrypt", result.LatestVersion.String(), err)
+			platform.Shred(tempPath)
+			exit(1)
+		}
+
+		digests, err := update.FileDigests(tempPath, update.HashAlgorithms()...)
+		if err != nil {
+			logger.Error("failed to hash decrypted asset", "error", err)
+			platform.Shred(tempPath)
+			exit(1)
+		}
+		expectedSHA256, expectedHashes = update.SplitDigests(digests)
+	}
+
+	// Step 4c: Verify the binary was built by the trusted builder from the
+	// trusted source; attestations cover the plaintext of private assets
+	provenanceURL := ""
+	if result.Asset.ProvenanceURL != "" {
+		provenanceURL = *server + result.Asset.ProvenanceURL
+	}
+	if err := downloader.VerifyProvenance(ctx, provenanceURL, update.MergeDigests(expectedSHA256, expectedHashes)); err != nil {
+		logger.Error("provenance verification failed", "error", err)
+		recordFailure(logger, "provenance", result.LatestVersion.String(), err)
+		platform.Shred(tempPath)
+		exit(1)
+	}
+
+	// Step 5: Prepare update command
 	execPath, err := platform.GetExecutablePath()
 	if err != nil {
 		logger.Error("failed to get executable path", "error", err)
-		os.Remove(tempPath)
-		os.Exit(1)
+		platform.Shred(tempPath)
+		exit(1)
 	}
 
-	updaterPath, err := platform.GetUpdaterPath()
-	if err != nil {
-		logger.Error("failed to get updater path", "error", err)
-		os.Remove(tempPath)
-		os.Exit(1)
+	parentStartTime, err := platform.ProcessStartTime(os.Getpid())
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		logger.Warn("failed to get process start time", "error", err)
 	}
 
-	// Check if updater exists
-	if _, err := os.Stat(updaterPath); err != nil {
-		logger.Error("updater not found", "path", updaterPath)
-		os.Remove(tempPath)
-		os.Exit(1)
+	// The updater refuses to replace a binary changed in the meantime
+	targetSHA256, err := update.FileSHA256(execPath)
+	if err != nil {
+		logger.Warn("failed to hash executable", "error", err)
 	}
 
 	cmd := &ipc.UpdateCommand{
-		Action:         ipc.ActionUpdate,
-		TargetBinary:   execPath,
-		NewBinaryPath:  tempPath,
-		BackupPath:     platform.GetBackupPath(execPath),
-		ExpectedSHA256: result.Asset.SHA256,
-		RestartBinary:  execPath,
-		RestartArgs:    []string{"version"},
-		ParentPID:      os.Getpid(),
+		Action:          ipc.ActionUpdate,
+		TargetBinary:    execPath,
+		TargetSHA256:    targetSHA256,
+		NewBinaryPath:   tempPath,
+		BackupPath:      platform.GetBackupPath(execPath),
+		ExpectedSHA256:  expectedSHA256,
+		ExpectedHashes:  expectedHashes,
+		RestartBinary:   execPath,
+		RestartArgs:     []string{"version"},
+		ParentPID:       os.Getpid(),
+		ParentStartTime: parentStartTime,
+		Publisher:       publisher,
+		ScanCommand:     *scanCommand,
+		UninstallKey:    *uninstallKey,
+		Component:       "nametag",
+		NewVersion:      result.LatestVersion.String(),
+		AllowDowngrade:  *allowDowngrade,
 	}
-
-	// Step 5: Write command file
-	cmdFile := platform.TempCommandPath()
-	if err := cmd.WriteToFile(cmdFile); err != nil {
-		logger.Error("failed to write command file", "error", err)
-		os.Remove(tempPath)
-		os.Exit(1)
+	if result.Asset.Format != "" {
+		cmd.ArchiveFormat = result.Asset.Format
+		// A renamed release's archive holds the binary under its new name
+		cmd.ArchiveBinary = cmp.Or(result.RenamedTo, "nametag") + platform.BinaryExtension()
+		cmd.HookPolicy = hookPolicy
+	}
+	applyRestart(cmd, execPath, result.Restart)
+	if installPath := migrationPath(execPath, result.InstallDir); installPath != "" {
+		cmd.InstallPath = installPath
+		if cmd.RestartBinary == execPath {
+			cmd.RestartBinary = installPath
+		}
+		logger.Info("release moves to a new install path", "from", execPath, "to", installPath)
 	}
 
-	// Step 6: Spawn updater
-	fmt.Println("Launching updater...")
-	proc := exec.Command(updaterPath, "--command-file", cmdFile)
-	proc.Stdout = os.Stdout
-	proc.Stderr = os.Stderr
-	platform.ConfigureDetached(proc)
+	// Only staged updates that are swapped in at start do without the updater
+	if !*stage || !swappable(cmd) {
+		updaterPath, err := platform.GetUpdaterPath()
+		if err != nil {
+			logger.Error("failed to get updater path", "error", err)
+			platform.Shred(tempPath)
+			exit(1)
+		}
+		if _, err := os.Stat(updaterPath); err != nil {
+			logger.Error("updater not found", "path", updaterPath)
+			platform.Shred(tempPath)
+			exit(1)
+		}
+	}
 
-	if err := proc.Start(); err != nil {
-		logger.Error("failed to start updater", "error", err)
-		os.Remove(tempPath)
-		os.Remove(cmdFile)
-		os.Exit(1)
+	if *stage {
+		dir := filepath.Dir(tempPath)
+		if err := stageUpdate(dir, cmd); err != nil {
+			logger.Error("failed to stage update", "error", err)
+			os.RemoveAll(dir)
+			exit(1)
+		}
+		fmt.Printf("Update to %s staged; it is applied the next time nametag starts\n", result.LatestVersion.String())
+		return
 	}
 
-	logger.Info("updater started, exiting for update", "updater_pid", proc.Process.Pid)
+	// Step 6: Write the command file, signed with a key only the updater
+	// gets, and spawn the updater
+	if err := launchUpdater(logger, cmd); err != nil {
+		logger.Error("failed to launch updater", "error", err)
+		platform.Shred(tempPath)
+		exit(1)
+	}
 	fmt.Println("Update in progress, please wait...")
 
 	// Step 7: Exit to allow updater to replace us
-	os.Exit(0)
+	exit(0)
+}
+
+// unlockShared releases the shared install lock once lockSharedInstall has
+// taken it. Holding the release here keeps the lock file open, and so the
+// lock held, for the rest of the run.
+var unlockShared = func() {}
+
+// lockSharedInstall takes the lock updates of a shared install take turns
+// with, held until unlockShared or exit, and checks no other user can write
+// to its directory; other installs need neither
+func lockSharedInstall(execPath string) error {
+	if !platform.SharedInstall(execPath) {
+		return nil
+	}
+	if err := platform.CheckSystemDir(filepath.Dir(execPath)); err != nil {
+		return err
+	}
+	release, err := platform.LockSharedInstall(0)
+	if err != nil {
+		return err
+	}
+	var once sync.Once
+	unlockShared = func() { once.Do(release) }
+	return nil
+}
+
+// exit releases the shared install lock, if held, and exits with code
+func exit(code int) {
+	unlockShared()
+	os.Exit(code)
+}
+
+// migrationPath returns where the binary at execPath moves to for a release
+// installed in installDir, or "" when it stays. Slots are left where they
+// are, the layout being the operator's.
+func migrationPath(execPath, installDir string) string {
+	if installDir == "" || installDir == filepath.Dir(execPath) {
+		return ""
+	}
+	// Started through the forwarder of an earlier move
+	if resolved, err := filepath.EvalSymlinks(execPath); err == nil && filepath.Dir(resolved) == installDir {
+		return ""
+	}
+	if _, ok := platform.SlotLink(execPath); ok {
+		return ""
+	}
+	return filepath.Join(installDir, filepath.Base(execPath))
+}
+
+// applyRestart translates the manifest's restart policy for the component into
+// the updater's restart settings
+func applyRestart(cmd *ipc.UpdateCommand, execPath string, restart *update.Restart) {
+	if restart == nil {
+		cmd.RestartMode = ipc.RestartExec
+		cmd.RestartBinary = execPath
+		cmd.RestartArgs = []string{"version"}
+		return
+	}
+
+	cmd.VersionURL = restart.VersionURL
+	cmd.VersionTimeout = time.Duration(restart.VersionTimeoutSeconds) * time.Second
+	cmd.AdminSocket = restart.AdminSocket
+	cmd.QuiesceTimeout = time.Duration(restart.QuiesceTimeoutSeconds) * time.Second
+	cmd.RunAsUser = restart.User
+	cmd.RunAsGroup = restart.Group
+
+	switch restart.Mode {
+	case update.RestartCommand:
+		cmd.RestartMode = ipc.RestartExec
+		cmd.RestartBinary = restart.Command[0]
+		cmd.RestartArgs = restart.Command[1:]
+	case update.RestartSystemd:
+		cmd.RestartMode = ipc.RestartSystemd
+		cmd.RestartUnit = restart.Unit
+	case update.RestartNone:
+		cmd.RestartMode = ipc.RestartNone
+	case update.RestartAdmin:
+		cmd.RestartMode = ipc.RestartAdmin
+	default:
+		cmd.RestartMode = ipc.RestartExec
+		cmd.RestartBinary = execPath
+		cmd.RestartArgs = restart.Args
+	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// cmdSBOM downloads the software bill of materials of a release, by default
+// the running one, for the current platform
+func cmdSBOM(logger *slog.Logger) {
+	server := flag.String("server", serverURL, "Update server URL")
+	output := flag.String("o", "", "Write the SBOM to this file instead of stdout")
+	conn := addConnFlags()
+	parseFlags(logger)
+
+	sbomVersion := version
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		sbomVersion = flag.Arg(0)
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: nametag sbom [flags] [version]")
+		os.Exit(1)
+	}
+
+	parsed, err := update.ParseVersion(sbomVersion)
+	if err != nil {
+		logger.Error("invalid version", "version", sbomVersion, "error", err)
+		os.Exit(1)
+	}
+
+	downloader := update.NewDownloader(logger, conn.options(logger, *server)...)
+	url := *server + update.SBOMURL("nametag", update.CurrentPlatform(), parsed.String())
+	ctx := context.Background()
+
+	if *output == "" {
+		if err := downloader.FetchSBOM(ctx, url, os.Stdout); err != nil {
+			reportSBOMError(logger, parsed, err)
+		}
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(*output), ".sbom-*")
+	if err != nil {
+		logger.Error("failed to create temp file", "error", err)
+		os.Exit(1)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := downloader.FetchSBOM(ctx, url, tmp); err != nil {
+		tmp.Close()
+		reportSBOMError(logger, parsed, err)
+	}
+	if err := tmp.Close(); err != nil {
+		logger.Error("failed to write sbom", "error", err)
+		os.Exit(1)
+	}
+	if err := os.Rename(tmp.Name(), *output); err != nil {
+		logger.Error("failed to write sbom", "error", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Wrote SBOM for nametag %s (%s) to %s\n", parsed.String(), update.CurrentPlatform(), *output)
+}
+
+func reportSBOMError(logger *slog.Logger, v update.Version, err error) {
+	if errors.Is(err, update.ErrNoSBOM) {
+		logger.Error("no sbom published for this release", "version", v.String(), "platform", update.CurrentPlatform())
+	} else {
+		logger.Error("failed to download sbom", "error", err)
+	}
+	os.Exit(1)
+}
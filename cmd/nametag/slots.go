@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/platform"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// cmdSlots manages the blue/green slot layout, where updates install into
+// the inactive slot and switching versions is a symlink flip
+func cmdSlots(logger *slog.Logger) {
+	if len(os.Args) < 2 {
+		printSlotsUsage()
+		os.Exit(1)
+	}
+
+	action := os.Args[1]
+	os.Args = os.Args[1:]
+	flag.CommandLine = flag.NewFlagSet("slots "+action, flag.ExitOnError)
+	var useLauncher *bool
+	if action == "enable" {
+		useLauncher = flag.Bool("launcher", runtime.GOOS == "windows", "Install nametag-launcher in the binary's place instead of a symlink")
+	}
+	parseFlags(logger)
+
+	execPath, err := platform.GetExecutablePath()
+	if err != nil {
+		logger.Error("failed to get executable path", "error", err)
+		os.Exit(1)
+	}
+
+	switch action {
+	case "enable":
+		cmdSlotsEnable(logger, execPath, *useLauncher)
+	case "status":
+		cmdSlotsStatus(logger, execPath)
+	case "switch":
+		cmdSlotsSwitch(logger, execPath)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown slots command: %s\n", action)
+		printSlotsUsage()
+		os.Exit(1)
+	}
+}
+
+func printSlotsUsage() {
+	fmt.Println("Usage:")
+	fmt.Println("  nametag slots enable [-launcher]   Move the binary into slot A behind a symlink or launcher")
+	fmt.Println("  nametag slots status               Show the slots and which one is active")
+	fmt.Println("  nametag slots switch               Switch back to the other slot's version")
+}
+
+func cmdSlotsEnable(logger *slog.Logger, execPath string, useLauncher bool) {
+	if err := platform.CheckWritable(execPath); err != nil {
+		logger.Error("cannot enable slots here", "error", err)
+		os.Exit(1)
+	}
+
+	launcher := ""
+	if useLauncher {
+		var err error
+		launcher, err = platform.GetLauncherPath()
+		if err != nil {
+			logger.Error("failed to get launcher path", "error", err)
+			os.Exit(1)
+		}
+		if err := update.CheckExecutable(launcher); err != nil {
+			logger.Error("launcher not found next to nametag", "path", launcher, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := platform.EnableSlots(execPath, launcher); err != nil {
+		logger.Error("failed to enable slots", "error", err)
+		os.Exit(1)
+	}
+
+	how := "links to"
+	if launcher != "" {
+		how = "is a launcher for"
+	}
+	fmt.Printf("%s now %s slot %s; updates install into the other slot\n", execPath, how, filepath.Base(platform.SlotPath(execPath, platform.SlotA)))
+}
+
+func cmdSlotsStatus(logger *slog.Logger, execPath string) {
+	active, err := platform.ActiveSlot(execPath)
+	if err != nil {
+		logger.Error("slots are not enabled; run nametag slots enable", "path", execPath)
+		os.Exit(1)
+	}
+
+	for _, slot := range []string{platform.SlotPath(execPath, platform.SlotA), platform.SlotPath(execPath, platform.SlotB)} {
+		marker := " "
+		if slot == active {
+			marker = "*"
+		}
+		fmt.Printf("%s %s  %s\n", marker, filepath.Base(slot), slotVersion(slot))
+	}
+}
+
+func cmdSlotsSwitch(logger *slog.Logger, execPath string) {
+	active, err := platform.ActiveSlot(execPath)
+	if err != nil {
+		logger.Error("slots are not enabled; run nametag slots enable", "path", execPath)
+		os.Exit(1)
+	}
+
+	// An empty or foreign slot would leave nothing that runs
+	other := platform.OtherSlot(active)
+	if err := update.CheckExecutable(other); err != nil {
+		logger.Error("the other slot holds no usable binary", "slot", other, "error", err)
+		os.Exit(1)
+	}
+	if err := platform.PointSlot(execPath, other); err != nil {
+		logger.Error("failed to switch slots", "error", err)
+		os.Exit(1)
+	}
+	otherVersion := slotVersion(other)
+	recordAction(logger, update.ActionEntry{
+		Action:  update.ActionSwitch,
+		From:    filepath.Base(active),
+		Version: filepath.Base(other),
+		Detail:  otherVersion,
+	})
+	fmt.Printf("Switched %s to slot %s (%s)\n", execPath, filepath.Base(other), otherVersion)
+}
+
+// slotVersion asks the binary in slot for its version
+func slotVersion(slot string) string {
+	if _, err := os.Stat(slot); err != nil {
+		return "empty"
+	}
+	out, err := exec.Command(slot, "version").Output()
+	if err != nil {
+		return "unknown version"
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimPrefix(strings.TrimSpace(line), "nametag ")
+}
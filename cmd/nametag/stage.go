@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/ipc"
+	"github.com/1995parham-learning/auto-update-binary/internal/platform"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// stagedQueue returns the queue updates staged with update -stage wait in,
+// each with its verified binary and the command for the updater. The next
+// start of nametag collapses the queue to the newest update and applies it.
+func stagedQueue() (*ipc.Queue, error) {
+	dir, err := platform.StagedDir()
+	if err != nil {
+		return nil, fmt.Errorf("get state directory: %w", err)
+	}
+	return ipc.NewQueue(dir)
+}
+
+// newStagedEntry returns a new directory in the staging queue to download
+// an update into
+func newStagedEntry() (string, error) {
+	queue, err := stagedQueue()
+	if err != nil {
+		return "", err
+	}
+	return queue.NewEntry()
+}
+
+// stageUpdate queues cmd, whose binary is already in dir, for the next start
+func stageUpdate(dir string, cmd *ipc.UpdateCommand) error {
+	queue, err := stagedQueue()
+	if err != nil {
+		return err
+	}
+	return queue.Add(dir, cmd)
+}
+
+// applyStaged applies the newest of the updates staged by update -stage for
+// this binary; older ones, and ones already applied, are dropped with their
+// files. A plain binary is swapped in and re-executed with args in place of
+// this process; anything else is handed to the updater, and applyStaged
+// reports whether the process must exit so the updater can replace it and
+// restart nametag with args. Until then the shared install lock, if taken,
+// stays held.
+func applyStaged(logger *slog.Logger, args []string) bool {
+	queue, err := stagedQueue()
+	if err != nil {
+		return false
+	}
+	pending, err := queue.Pending()
+	if err != nil {
+		logger.Warn("discarded unreadable staged updates", "error", err)
+	}
+	if len(pending) == 0 {
+		return false
+	}
+
+	execPath, err := platform.GetExecutablePath()
+	if err != nil {
+		return false
+	}
+
+	apply, superseded := ipc.Collapse(pending, olderVersion)
+	for _, entry := range superseded {
+		if entry.Command.TargetBinary == execPath {
+			logger.Info("dropping superseded staged update", "version", entry.Command.NewVersion)
+		}
+		queue.Remove(entry)
+	}
+
+	for _, entry := range apply {
+		if entry.Command.TargetBinary != execPath {
+			// Another install sharing the state directory applies its own
+			// updates, unless it is gone
+			if _, err := os.Stat(entry.Command.TargetBinary); err != nil {
+				queue.Remove(entry)
+			}
+			continue
+		}
+		if err := checkStaged(entry.Command); err != nil {
+			logger.Info("discarding staged update", "version", entry.Command.NewVersion, "reason", err)
+			queue.Remove(entry)
+			continue
+		}
+
+		// Another update of a shared install goes first; this one waits for
+		// a later start
+		if err := lockSharedInstall(execPath); err != nil {
+			logger.Info("not applying staged update yet", "version", entry.Command.NewVersion, "reason", err)
+			return false
+		}
+
+		// Once claimed the update is used up: a failing one must not be
+		// retried on every start
+		cmd, dir, err := queue.Claim(entry)
+		if err != nil {
+			// Another nametag starting at the same time is applying it
+			logger.Info("staged update is being applied elsewhere", "version", entry.Command.NewVersion)
+			unlockShared()
+			return false
+		}
+		if !applyClaimed(logger, cmd, dir, args) {
+			unlockShared()
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// applyClaimed applies a staged update taken out of the queue, whose files
+// are in dir
+func applyClaimed(logger *slog.Logger, cmd *ipc.UpdateCommand, dir string, args []string) bool {
+	// A plain binary that restarts as itself is swapped in right here, before
+	// any command runs, the way browsers apply updates at launch
+	if swappable(cmd) {
+		err := swapStaged(logger, cmd)
+		os.RemoveAll(dir)
+		if err != nil {
+			logger.Error("failed to apply staged update", "error", err)
+			recordFailure(logger, "apply staged", cmd.NewVersion, err)
+			return false
+		}
+
+		fmt.Printf("Updated to %s\n", cmd.NewVersion)
+		unlockShared()
+		if err := platform.Reexec(cmd.TargetBinary, args); err != nil {
+			logger.Error("failed to start updated binary; run nametag again", "error", err)
+			exit(1)
+		}
+	}
+
+	var err error
+	cmd.ParentPID = os.Getpid()
+	cmd.ParentStartTime, err = platform.ProcessStartTime(cmd.ParentPID)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		logger.Warn("failed to get process start time", "error", err)
+	}
+	if (cmd.RestartMode == "" || cmd.RestartMode == ipc.RestartExec) && cmd.RestartBinary == cmd.TargetBinary {
+		cmd.RestartArgs = args
+	}
+
+	// The updater consumes the files; the empty entry goes on a later start
+	fmt.Printf("Applying staged update to %s...\n", cmd.NewVersion)
+	if err := launchUpdater(logger, cmd); err != nil {
+		logger.Error("failed to apply staged update", "error", err)
+		os.RemoveAll(dir)
+		return false
+	}
+	return true
+}
+
+// olderVersion orders staged versions; unparsable ones sort first and are
+// then refused by checkStaged
+func olderVersion(a, b string) bool {
+	va, errA := update.ParseVersion(a)
+	vb, errB := update.ParseVersion(b)
+	if errA != nil || errB != nil {
+		return errA != nil && errB == nil
+	}
+	return va.LessThan(vb)
+}
+
+// checkStaged refuses a staged update that no longer applies to this binary
+func checkStaged(cmd *ipc.UpdateCommand) error {
+	execPath, err := platform.GetExecutablePath()
+	if err != nil {
+		return fmt.Errorf("get executable path: %w", err)
+	}
+	if cmd.TargetBinary != execPath {
+		return fmt.Errorf("staged for %s", cmd.TargetBinary)
+	}
+
+	staged, err := update.ParseVersion(cmd.NewVersion)
+	if err != nil {
+		return err
+	}
+	current, err := update.ParseVersion(version)
+	if err != nil {
+		return err
+	}
+	if !cmd.AllowDowngrade && !current.LessThan(staged) {
+		return fmt.Errorf("already running %s", version)
+	}
+
+	if _, err := os.Stat(cmd.NewBinaryPath); err != nil {
+		return fmt.Errorf("staged binary: %w", err)
+	}
+	return nil
+}
+
+// launchUpdater writes cmd to a command file signed with a fresh key, only
+// handed to the updater, and starts the updater detached
+func launchUpdater(logger *slog.Logger, cmd *ipc.UpdateCommand) error {
+	updaterPath, err := platform.GetUpdaterPath()
+	if err != nil {
+		return fmt.Errorf("get updater path: %w", err)
+	}
+	if _, err := os.Stat(updaterPath); err != nil {
+		return fmt.Errorf("updater not found: %s", updaterPath)
+	}
+
+	key, err := ipc.NewKey()
+	if err != nil {
+		return err
+	}
+	cmdFile, err := platform.TempCommandPath()
+	if err != nil {
+		return fmt.Errorf("create command file: %w", err)
+	}
+	if err := cmd.WriteToFile(cmdFile, key); err != nil {
+		platform.Shred(cmdFile)
+		return err
+	}
+
+	fmt.Println("Launching updater...")
+	proc := exec.Command(updaterPath, "--command-file", cmdFile)
+	proc.Env = append(os.Environ(), ipc.KeyEnv+"="+hex.EncodeToString(key))
+	proc.Stdout = os.Stdout
+	proc.Stderr = os.Stderr
+	platform.ConfigureDetached(proc)
+
+	if err := proc.Start(); err != nil {
+		platform.Shred(cmdFile)
+		return fmt.Errorf("start updater: %w", err)
+	}
+
+	logger.Info("updater started, exiting for update", "updater_pid", proc.Process.Pid)
+	return nil
+}
+
+// swappable reports whether the staged update can be applied without the
+// updater: a bare binary, no hooks to run, restarting as nametag itself
+func swappable(cmd *ipc.UpdateCommand) bool {
+	if cmd.ArchiveFormat != "" {
+		return false
+	}
+	if cmd.RestartMode != "" && cmd.RestartMode != ipc.RestartExec {
+		return false
+	}
+	return cmd.RestartBinary == cmd.TargetBinary
+}
+
+// swapStaged verifies the staged binary again and replaces the running one
+// with it, doing in-process what the updater does after the parent exits
+func swapStaged(logger *slog.Logger, cmd *ipc.UpdateCommand) error {
+	if err := platform.CheckWritable(cmd.TargetBinary); err != nil {
+		return err
+	}
+	if platform.SharedInstall(cmd.TargetBinary) {
+		if err := platform.CheckSystemDir(filepath.Dir(cmd.NewBinaryPath)); err != nil {
+			return fmt.Errorf("staged binary: %w", err)
+		}
+		if err := update.CheckTarget(cmd.TargetBinary, cmd.TargetSHA256); err != nil {
+			return err
+		}
+	}
+	if err := update.VerifyChecksum(cmd.NewBinaryPath, update.MergeDigests(cmd.ExpectedSHA256, cmd.ExpectedHashes)); err != nil {
+		return err
+	}
+	if cmd.ScanCommand != "" {
+		if err := update.Scan(context.Background(), cmd.ScanCommand, cmd.NewBinaryPath); err != nil {
+			return err
+		}
+	}
+	if cmd.Publisher != "" {
+		if err := platform.VerifyPublisher(cmd.NewBinaryPath, cmd.Publisher); err != nil {
+			return fmt.Errorf("verify publisher: %w", err)
+		}
+	}
+
+	var installedPath string
+	newVersion, err := update.ParseVersion(cmd.NewVersion)
+	if err != nil {
+		return fmt.Errorf("parse new version: %w", err)
+	}
+	if cmd.Component != "" {
+		stateDir, err := platform.StateDir()
+		if err != nil {
+			return fmt.Errorf("get state directory: %w", err)
+		}
+		installedPath = filepath.Join(stateDir, update.InstalledFile)
+
+		if !cmd.AllowDowngrade {
+			if err := update.CheckDowngrade(installedPath, cmd.Component, newVersion); err != nil {
+				return err
+			}
+		}
+	}
+
+	replacer := update.NewReplacer(logger)
+	if err := replacer.Replace(cmd.TargetBinary, cmd.NewBinaryPath, cmd.BackupPath); err != nil {
+		return err
+	}
+	recordAction(logger, update.ActionEntry{Action: update.ActionReplace, From: version, Version: cmd.NewVersion, Detail: "staged"})
+	if err := replacer.ValidateAfterUpdate(cmd.TargetBinary); err != nil {
+		if rollbackErr := replacer.Rollback(cmd.TargetBinary, cmd.BackupPath); rollbackErr != nil {
+			logger.Error("rollback also failed", "error", rollbackErr)
+		} else {
+			recordAction(logger, update.ActionEntry{Action: update.ActionRollback, Version: version, Detail: "staged"})
+		}
+		return err
+	}
+
+	if installedPath != "" {
+		if err := update.RecordInstalled(installedPath, cmd.Component, newVersion); err != nil {
+			logger.Warn("failed to record installed version", "error", err)
+		}
+	}
+	if cmd.UninstallKey != "" {
+		if err := platform.RegisterUninstall(cmd.UninstallKey, cmd.Component, cmd.NewVersion, cmd.TargetBinary); err != nil {
+			logger.Warn("failed to record the version in the uninstall entry", "error", err)
+		}
+	}
+
+	// The running binary is still mapped on Windows; the backup is removed
+	// on a later start by CleanupOldBinaries
+	platform.ScheduleCleanup(cmd.BackupPath)
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/platform"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// cmdTrust manages the local trust store: signing keys trusted on top of the
+// ones built in, e.g. the key of an internal mirror that re-signs releases
+func cmdTrust(logger *slog.Logger) {
+	if len(os.Args) < 2 {
+		printTrustUsage()
+		os.Exit(1)
+	}
+
+	action := os.Args[1]
+	os.Args = os.Args[1:]
+	flag.CommandLine = flag.NewFlagSet("trust "+action, flag.ExitOnError)
+	channel := flag.String("channel", update.ChannelStable, "Release channel whose trusted keys to manage")
+
+	switch action {
+	case "add":
+		cmdTrustAdd(logger, channel)
+	case "remove":
+		cmdTrustRemove(logger, channel)
+	case "list":
+		cmdTrustList(logger, channel)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown trust command: %s\n", action)
+		printTrustUsage()
+		os.Exit(1)
+	}
+}
+
+func printTrustUsage() {
+	fmt.Println("Usage:")
+	fmt.Println("  nametag trust add [-channel C] [-expires D] [-comment TEXT] <base64 public key>")
+	fmt.Println("  nametag trust remove [-channel C] <base64 public key>")
+	fmt.Println("  nametag trust list [-channel C]")
+}
+
+// trustStore returns the trust store of channel
+func trustStore(logger *slog.Logger, channel string) *update.TrustStore {
+	channel = update.NormalizeChannel(channel)
+	if err := update.ValidateChannel(channel); err != nil {
+		logger.Error("invalid channel", "error", err)
+		os.Exit(1)
+	}
+	stateDir, err := platform.StateDir()
+	if err != nil {
+		logger.Error("failed to get state directory", "error", err)
+		os.Exit(1)
+	}
+	return update.NewTrustStore(update.TrustStorePath(stateDir, channel))
+}
+
+func cmdTrustAdd(logger *slog.Logger, channel *string) {
+	expires := flag.Duration("expires", 0, "Stop trusting the key this long from now (0 never expires)")
+	comment := flag.String("comment", "", "Note on whose key this is, shown by trust list")
+	parseFlags(logger)
+
+	if flag.NArg() != 1 {
+		printTrustUsage()
+		os.Exit(1)
+	}
+
+	key := update.LocalKey{Key: flag.Arg(0), Comment: *comment, Added: time.Now().UTC()}
+	if *expires > 0 {
+		key.Expires = key.Added.Add(*expires)
+	}
+	if err := trustStore(logger, *channel).Add(key); err != nil {
+		logger.Error("failed to trust key", "error", err)
+		os.Exit(1)
+	}
+
+	if key.Expires.IsZero() {
+		fmt.Printf("Trusting %s for the %s channel\n", key.Key, update.NormalizeChannel(*channel))
+	} else {
+		fmt.Printf("Trusting %s for the %s channel until %s\n", key.Key, update.NormalizeChannel(*channel), key.Expires.Format(time.RFC3339))
+	}
+}
+
+func cmdTrustRemove(logger *slog.Logger, channel *string) {
+	parseFlags(logger)
+
+	if flag.NArg() != 1 {
+		printTrustUsage()
+		os.Exit(1)
+	}
+
+	removed, err := trustStore(logger, *channel).Remove(flag.Arg(0))
+	if err != nil {
+		logger.Error("failed to remove key", "error", err)
+		os.Exit(1)
+	}
+	if !removed {
+		logger.Error("key is not in the trust store; built-in keys can't be removed", "key", flag.Arg(0))
+		os.Exit(1)
+	}
+	fmt.Printf("No longer trusting %s\n", flag.Arg(0))
+}
+
+func cmdTrustList(logger *slog.Logger, channel *string) {
+	parseFlags(logger)
+
+	store := trustStore(logger, *channel)
+	name := update.NormalizeChannel(*channel)
+
+	if set := builtinKeySet(name); set != nil {
+		source := "built-in"
+		if stateDir, err := platform.StateDir(); err == nil {
+			storePath := filepath.Join(stateDir, "keys.json")
+			if name != update.ChannelStable {
+				storePath = filepath.Join(stateDir, "keys-"+name+".json")
+			}
+			if keys, err := update.NewChannelKeys(name, set, storePath); err == nil && keys.Current().Version > 0 {
+				set = keys.Current()
+				source = "rotated (key set " + strconv.FormatInt(set.Version, 10) + ")"
+			}
+		}
+		for _, key := range set.Keys {
+			fmt.Printf("%s  %s, threshold %d\n", update.EncodePublicKey(key), source, set.Threshold)
+		}
+	}
+
+	local, err := store.List()
+	if err != nil {
+		logger.Error("failed to read trust store", "error", err)
+		os.Exit(1)
+	}
+	now := time.Now()
+	for _, key := range local {
+		status := "local"
+		switch {
+		case key.Expired(now):
+			status += ", expired " + key.Expires.Format(time.RFC3339)
+		case !key.Expires.IsZero():
+			status += ", expires " + key.Expires.Format(time.RFC3339)
+		}
+		if key.Comment != "" {
+			status += ": " + key.Comment
+		}
+		fmt.Printf("%s  %s\n", key.Key, status)
+	}
+}
+
+// builtinKeySet returns the key set built in for channel, or nil
+func builtinKeySet(channel string) *update.KeySet {
+	if publicKey == "" {
+		return nil
+	}
+	if channel != update.ChannelStable {
+		set, _ := builtinChannelKeys(channel)
+		return set
+	}
+	threshold, err := strconv.Atoi(keyThreshold)
+	if err != nil {
+		return nil
+	}
+	set, _ := update.ParseKeySet(publicKey, threshold)
+	return set
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// requestIDHeader carries a request's ID: taken from the request when a
+// proxy in front of the server already assigned one, and sent back in the
+// response so a client's report can be matched to the server's logs
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the IDs accepted from requests
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// withAccessLog wraps next so every request gets an ID and a log line with
+// its outcome once handled. Logging done with the request's context carries
+// the ID too.
+func withAccessLog(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = rand.Text()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		cw := &countingWriter{ResponseWriter: w}
+		// Deferred so requests whose handler aborts the connection are
+		// logged too
+		defer func() {
+			status := cw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", status),
+				slog.Duration("duration", time.Since(start)),
+				slog.Int64("bytes", cw.bytes),
+				slog.String("remote", r.RemoteAddr),
+			)
+		}()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// validRequestID reports whether id is fit to log and send back: printable
+// ASCII without spaces, of a sane length
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := range len(id) {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newLogger returns the server's logger writing to w at level (debug, info,
+// warn, or error) in format: text, or json for log shippers
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q (must be text or json)", format)
+	}
+	return slog.New(requestIDHandler{handler}), nil
+}
+
+// requestIDHandler adds the request ID of the context a record is logged
+// with to the record
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
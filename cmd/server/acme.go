@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// letsEncryptURL is the directory of Let's Encrypt's production CA
+	letsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+	// acmeALPNProto is the ALPN protocol CAs validate tls-alpn-01
+	// challenges with (RFC 8737)
+	acmeALPNProto = "acme-tls/1"
+	// acmeRenewBefore is how long before it expires a certificate is
+	// renewed, and acmeRenewInterval how often that is checked
+	acmeRenewBefore   = 30 * 24 * time.Hour
+	acmeRenewInterval = 12 * time.Hour
+	// acmeIssueTimeout bounds getting one certificate, validation included
+	acmeIssueTimeout = 2 * time.Minute
+	// acmeRetryDelay keeps a host whose certificate couldn't be had from
+	// being asked for again on every handshake, which the CA rate-limits
+	acmeRetryDelay = 5 * time.Minute
+	// maxACMEResponseSize caps the CA's responses, certificate chains
+	// included
+	maxACMEResponseSize = 1 << 20
+)
+
+// idPeACMEIdentifier is the critical extension of a tls-alpn-01 challenge
+// certificate, holding the SHA-256 of the key authorization
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// acmeManager gets and renews the server's certificates from an ACME CA
+// such as Let's Encrypt, for the allowed hosts only, so a client naming any
+// other host in its handshake can't make the server ask for certificates.
+// Ownership of a host is proven with tls-alpn-01 challenges answered on the
+// HTTPS listener itself, which must therefore be reachable on port 443.
+// The account key and certificates are kept in cacheDir, so restarts don't
+// count against the CA's rate limits.
+type acmeManager struct {
+	directoryURL string
+	email        string
+	hosts        []string
+	cacheDir     string
+	accountKey   *ecdsa.PrivateKey
+	client       *http.Client
+	logger       *slog.Logger
+
+	mu         sync.Mutex
+	certs      map[string]*tls.Certificate
+	challenges map[string]*tls.Certificate
+	failed     map[string]acmeFailure
+
+	// issue allows one conversation with the CA at a time, which the
+	// fields below belong to
+	issue     sync.Mutex
+	directory acmeDirectory
+	accountID string
+	nonce     string
+}
+
+type acmeFailure struct {
+	at  time.Time
+	err error
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	Status         string           `json:"status"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate"`
+	Error          *acmeProblem     `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+// acmeProblem is an error document of the CA (RFC 7807)
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", strings.TrimPrefix(p.Type, "urn:ietf:params:acme:error:"), p.Detail)
+}
+
+// newACMEManager loads or creates the account key in cacheDir and the
+// certificates already there for hosts
+func newACMEManager(directoryURL, email string, hosts []string, cacheDir string, logger *slog.Logger) (*acmeManager, error) {
+	for _, host := range hosts {
+		if host == "" || strings.ContainsAny(host, "*/: ") {
+			return nil, fmt.Errorf("invalid acme host %q", host)
+		}
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("create acme cache: %w", err)
+	}
+	accountKey, err := loadACMEAccountKey(filepath.Join(cacheDir, "account.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &acmeManager{
+		directoryURL: directoryURL,
+		email:        email,
+		hosts:        hosts,
+		cacheDir:     cacheDir,
+		accountKey:   accountKey,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		logger:       logger,
+		certs:        make(map[string]*tls.Certificate),
+		challenges:   make(map[string]*tls.Certificate),
+		failed:       make(map[string]acmeFailure),
+	}
+	for _, host := range hosts {
+		cert, err := tls.LoadX509KeyPair(m.certPath(host), m.certPath(host))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			logger.Warn("ignoring unreadable acme certificate", "host", host, "error", err)
+			continue
+		}
+		m.certs[host] = &cert
+	}
+	return m, nil
+}
+
+// loadACMEAccountKey reads the account's P-256 key from path, creating it
+// the first time
+func loadACMEAccountKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate acme account key: %w", err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("encode acme account key: %w", err)
+		}
+		if err := writeACMEFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read acme account key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("acme account key %s: no PEM data", path)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("acme account key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+func (m *acmeManager) certPath(host string) string {
+	return filepath.Join(m.cacheDir, host+".pem")
+}
+
+// tlsConfig serves the manager's certificates and answers tls-alpn-01
+// challenges, which get a config of their own so mutual TLS doesn't turn
+// the CA away
+func (m *acmeManager) tlsConfig() *tls.Config {
+	challengeConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{acmeALPNProto},
+		GetCertificate: m.challengeCertificate,
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.getCertificate,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if slices.Contains(hello.SupportedProtos, acmeALPNProto) {
+				return challengeConfig, nil
+			}
+			return nil, nil
+		},
+	}
+}
+
+// getCertificate returns the certificate of the host the client asks for,
+// getting one from the CA when there is none yet
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if host == "" && len(m.hosts) == 1 {
+		// Clients connecting by IP address send no server name
+		host = m.hosts[0]
+	}
+	if !slices.Contains(m.hosts, host) {
+		return nil, fmt.Errorf("acme: host %q is not allowed", hello.ServerName)
+	}
+
+	m.mu.Lock()
+	cert := m.certs[host]
+	m.mu.Unlock()
+	if cert != nil && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+	return m.obtain(hello.Context(), host)
+}
+
+// challengeCertificate returns the tls-alpn-01 certificate of a challenge
+// in progress
+func (m *acmeManager) challengeCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cert := m.challenges[host]; cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("acme: no challenge for %q", hello.ServerName)
+}
+
+// obtain gets a new certificate for host, unless another handshake or the
+// renewal loop got one meanwhile or the last attempt failed too recently
+func (m *acmeManager) obtain(ctx context.Context, host string) (*tls.Certificate, error) {
+	m.issue.Lock()
+	defer m.issue.Unlock()
+
+	m.mu.Lock()
+	cert, failure := m.certs[host], m.failed[host]
+	m.mu.Unlock()
+	if cert != nil && time.Until(cert.Leaf.NotAfter) > acmeRenewBefore {
+		return cert, nil
+	}
+	if time.Since(failure.at) < acmeRetryDelay {
+		return nil, failure.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), acmeIssueTimeout)
+	defer cancel()
+	cert, err := m.issueCertificate(ctx, host)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.logger.Error("failed to get acme certificate", "host", host, "error", err)
+		m.failed[host] = acmeFailure{at: time.Now(), err: err}
+		return nil, err
+	}
+	delete(m.failed, host)
+	m.certs[host] = cert
+	m.logger.Info("acme certificate issued", "host", host, "expires", cert.Leaf.NotAfter)
+	return cert, nil
+}
+
+// runRenewLoop gets the missing certificates at once, then renews the ones
+// close to expiry every interval
+func (m *acmeManager) runRenewLoop(interval time.Duration) {
+	for {
+		for _, host := range m.hosts {
+			m.mu.Lock()
+			cert := m.certs[host]
+			m.mu.Unlock()
+			if cert == nil || time.Until(cert.Leaf.NotAfter) <= acmeRenewBefore {
+				_, _ = m.obtain(context.Background(), host)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// issueCertificate orders a certificate for host, proves the account
+// controls it, and stores the issued chain with its new key in the cache
+func (m *acmeManager) issueCertificate(ctx context.Context, host string) (*tls.Certificate, error) {
+	if err := m.register(ctx); err != nil {
+		return nil, err
+	}
+
+	var order acmeOrder
+	resp, err := m.post(ctx, m.directory.NewOrder, map[string]any{
+		"identifiers": []acmeIdentifier{{Type: "dns", Value: host}},
+	}, &order)
+	if err != nil {
+		return nil, fmt.Errorf("new order: %w", err)
+	}
+	orderURL := resp.Header.Get("Location")
+	for _, authzURL := range order.Authorizations {
+		if err := m.authorize(ctx, authzURL); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate certificate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: host},
+		DNSNames: []string{host},
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("create csr: %w", err)
+	}
+	resp, err = m.post(ctx, order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, &order)
+	if err != nil {
+		return nil, fmt.Errorf("finalize order: %w", err)
+	}
+	for order.Status != "valid" {
+		if order.Status == "invalid" {
+			if order.Error != nil {
+				return nil, fmt.Errorf("order for %s: %w", host, order.Error)
+			}
+			return nil, fmt.Errorf("order for %s is invalid", host)
+		}
+		if err := m.wait(ctx, resp); err != nil {
+			return nil, err
+		}
+		if resp, err = m.post(ctx, orderURL, nil, &order); err != nil {
+			return nil, fmt.Errorf("poll order: %w", err)
+		}
+	}
+
+	resp, err = m.post(ctx, order.Certificate, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("download certificate: %w", err)
+	}
+	chain, err := io.ReadAll(io.LimitReader(resp.Body, maxACMEResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("download certificate: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("encode certificate key: %w", err)
+	}
+	data := append(chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...)
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, fmt.Errorf("issued certificate: %w", err)
+	}
+	if err := cert.Leaf.VerifyHostname(host); err != nil {
+		return nil, fmt.Errorf("issued certificate: %w", err)
+	}
+	if err := writeACMEFile(m.certPath(host), data); err != nil {
+		m.logger.Warn("failed to cache acme certificate", "host", host, "error", err)
+	}
+	return &cert, nil
+}
+
+// authorize answers the tls-alpn-01 challenge of an authorization and
+// waits for the CA to validate it
+func (m *acmeManager) authorize(ctx context.Context, authzURL string) error {
+	var authz acmeAuthorization
+	resp, err := m.post(ctx, authzURL, nil, &authz)
+	if err != nil {
+		return fmt.Errorf("get authorization: %w", err)
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	host := authz.Identifier.Value
+	i := slices.IndexFunc(authz.Challenges, func(c acmeChallenge) bool { return c.Type == "tls-alpn-01" })
+	if i < 0 {
+		return fmt.Errorf("acme: the CA offers no tls-alpn-01 challenge for %s", host)
+	}
+	challenge := authz.Challenges[i]
+
+	cert, err := tlsALPNCertificate(host, challenge.Token+"."+m.thumbprint())
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.challenges[host] = cert
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.challenges, host)
+		m.mu.Unlock()
+	}()
+
+	if _, err := m.post(ctx, challenge.URL, struct{}{}, nil); err != nil {
+		return fmt.Errorf("answer challenge for %s: %w", host, err)
+	}
+	for {
+		if err := m.wait(ctx, resp); err != nil {
+			return err
+		}
+		if resp, err = m.post(ctx, authzURL, nil, &authz); err != nil {
+			return fmt.Errorf("poll authorization: %w", err)
+		}
+		switch authz.Status {
+		case "pending", "processing":
+			continue
+		case "valid":
+			return nil
+		}
+		for _, c := range authz.Challenges {
+			if c.Type == challenge.Type && c.Error != nil {
+				return fmt.Errorf("validate %s: %w", host, c.Error)
+			}
+		}
+		return fmt.Errorf("validate %s: authorization is %s", host, authz.Status)
+	}
+}
+
+// tlsALPNCertificate returns the self-signed certificate answering a
+// tls-alpn-01 challenge for host with keyAuth
+func tlsALPNCertificate(host, keyAuth string) (*tls.Certificate, error) {
+	sum := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: host},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		DNSNames:        []string{host},
+		ExtraExtensions: []pkix.Extension{{Id: idPeACMEIdentifier, Critical: true, Value: value}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("create challenge certificate: %w", err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// register fetches the CA's directory and finds or creates the account of
+// the key, once per process
+func (m *acmeManager) register(ctx context.Context) error {
+	if m.accountID != "" {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch acme directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch acme directory: %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxACMEResponseSize)).Decode(&m.directory); err != nil {
+		return fmt.Errorf("decode acme directory: %w", err)
+	}
+
+	account := map[string]any{"termsOfServiceAgreed": true}
+	if m.email != "" {
+		account["contact"] = []string{"mailto:" + m.email}
+	}
+	resp, err = m.post(ctx, m.directory.NewAccount, account, nil)
+	if err != nil {
+		return fmt.Errorf("register acme account: %w", err)
+	}
+	m.accountID = resp.Header.Get("Location")
+	if m.accountID == "" {
+		return errors.New("register acme account: no account URL")
+	}
+	return nil
+}
+
+// post sends payload to url signed with the account key, or a POST-as-GET
+// for a nil payload, decoding the JSON response into out when set; a nonce
+// the CA rejected is retried once with the fresh one it sent
+func (m *acmeManager) post(ctx context.Context, url string, payload, out any) (*http.Response, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		signed, err := m.sign(ctx, url, body)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(signed))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err := m.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		m.nonce = resp.Header.Get("Replay-Nonce")
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxACMEResponseSize))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{Status: resp.StatusCode}
+			if json.Unmarshal(data, problem) != nil || problem.Type == "" {
+				return nil, fmt.Errorf("acme: %s", resp.Status)
+			}
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+				continue
+			}
+			return nil, problem
+		}
+		if out != nil {
+			if err := json.Unmarshal(data, out); err != nil {
+				return nil, fmt.Errorf("decode acme response: %w", err)
+			}
+		}
+		return resp, nil
+	}
+}
+
+// sign returns the JWS of payload for url, naming the account by its key
+// until it is registered and by its URL after
+func (m *acmeManager) sign(ctx context.Context, url string, payload []byte) ([]byte, error) {
+	if m.nonce == "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, m.directory.NewNonce, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := m.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("get acme nonce: %w", err)
+		}
+		resp.Body.Close()
+		if m.nonce = resp.Header.Get("Replay-Nonce"); m.nonce == "" {
+			return nil, errors.New("get acme nonce: none sent")
+		}
+	}
+
+	protected := map[string]any{"alg": "ES256", "nonce": m.nonce, "url": url}
+	if m.accountID != "" {
+		protected["kid"] = m.accountID
+	} else {
+		protected["jwk"] = m.jwk()
+	}
+	m.nonce = ""
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(encodedHeader + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, m.accountKey, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("sign acme request: %w", err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": encodedHeader,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// jwk returns the account's public key as a JWK, members in the order its
+// thumbprint needs (RFC 7638)
+func (m *acmeManager) jwk() map[string]string {
+	pub := m.accountKey.PublicKey
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(x),
+		"y":   base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+// thumbprint returns the account key's JWK thumbprint, which key
+// authorizations end with
+func (m *acmeManager) thumbprint() string {
+	// encoding/json sorts map keys, which is the order RFC 7638 asks for
+	data, _ := json.Marshal(m.jwk())
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// wait sleeps for as long as the CA's Retry-After asks before polling
+// again, a second when it doesn't say, up to 10
+func (m *acmeManager) wait(ctx context.Context, resp *http.Response) error {
+	delay := time.Second
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		delay = min(time.Duration(seconds)*time.Second, 10*time.Second)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// writeACMEFile writes data to path, readable by the server's user only
+func writeACMEFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".acme-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %w", filepath.Base(path), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", filepath.Base(path), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACMECA is an ACME CA (RFC 8555) issuing for one order at a time. It
+// checks every request's signature and nonce, and validates tls-alpn-01
+// challenges by asking the manager's TLS config for the challenge
+// certificate, as a real CA's handshake would.
+type fakeACMECA struct {
+	t   *testing.T
+	srv *httptest.Server
+	key *ecdsa.PrivateKey
+
+	// validate gets the challenge certificate a CA connecting to host
+	// would be served
+	validate func(host string) (*tls.Certificate, error)
+	// rejectNonces is how many requests to turn away with badNonce
+	rejectNonces int
+	// failChallenge fails validation with this detail
+	failChallenge string
+	// processing is how many polls a finalized order stays processing
+	processing int
+
+	mu        sync.Mutex
+	nonces    map[string]bool
+	nextNonce int
+	account   *ecdsa.PublicKey
+	thumb     string
+	orders    int
+	host      string
+	authz     string
+	challenge string
+	order     string
+	cert      []byte
+}
+
+const acmeTestToken = "challenge-token"
+
+func newFakeACMECA(t *testing.T) *fakeACMECA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &fakeACMECA{t: t, key: key, nonces: make(map[string]bool)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(acmeDirectory{
+			NewNonce:   ca.srv.URL + "/nonce",
+			NewAccount: ca.srv.URL + "/account",
+			NewOrder:   ca.srv.URL + "/order",
+		})
+	})
+	mux.HandleFunc("HEAD /nonce", func(w http.ResponseWriter, r *http.Request) {
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		w.Header().Set("Replay-Nonce", ca.newNonce())
+	})
+	mux.HandleFunc("POST /", ca.handle)
+	ca.srv = httptest.NewServer(mux)
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+// newNonce issues a nonce; ca.mu must be held
+func (ca *fakeACMECA) newNonce() string {
+	ca.nextNonce++
+	nonce := fmt.Sprintf("nonce-%d", ca.nextNonce)
+	ca.nonces[nonce] = true
+	return nonce
+}
+
+func (ca *fakeACMECA) problem(w http.ResponseWriter, status int, kind, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(acmeProblem{Type: "urn:ietf:params:acme:error:" + kind, Detail: detail, Status: status})
+}
+
+func (ca *fakeACMECA) handle(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	w.Header().Set("Replay-Nonce", ca.newNonce())
+
+	payload, err := ca.verify(r)
+	if err != nil {
+		ca.t.Errorf("%s: %v", r.URL.Path, err)
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	if ca.rejectNonces > 0 {
+		ca.rejectNonces--
+		ca.problem(w, http.StatusBadRequest, "badNonce", "try again")
+		return
+	}
+
+	switch path := r.URL.Path; {
+	case path == "/account":
+		w.Header().Set("Location", ca.srv.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"valid"}`))
+	case path == "/order":
+		var req struct {
+			Identifiers []acmeIdentifier `json:"identifiers"`
+		}
+		if err := json.Unmarshal(payload, &req); err != nil || len(req.Identifiers) != 1 {
+			ca.problem(w, http.StatusBadRequest, "malformed", "one identifier expected")
+			return
+		}
+		ca.orders++
+		ca.host, ca.authz, ca.challenge, ca.order, ca.cert = req.Identifiers[0].Value, "pending", "pending", "pending", nil
+		w.Header().Set("Location", ca.srv.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		ca.writeOrder(w)
+	case path == "/authz/1":
+		ca.writeAuthz(w)
+	case path == "/challenge/1":
+		ca.validateChallenge()
+		json.NewEncoder(w).Encode(acmeChallenge{Type: "tls-alpn-01", Status: ca.challenge})
+	case path == "/order/1/finalize":
+		if ca.authz != "valid" {
+			ca.problem(w, http.StatusForbidden, "orderNotReady", "authorization is "+ca.authz)
+			return
+		}
+		if err := ca.issue(payload); err != nil {
+			ca.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+			return
+		}
+		ca.writeOrder(w)
+	case path == "/order/1":
+		if ca.order == "processing" && ca.processing == 0 {
+			ca.order = "valid"
+		}
+		ca.processing--
+		ca.writeOrder(w)
+	case path == "/cert/1" && ca.cert != nil:
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.cert)
+	default:
+		ca.problem(w, http.StatusNotFound, "malformed", "no such resource")
+	}
+}
+
+// verify checks a request's JWS: its URL, that its nonce was issued and
+// not used before, and its signature by the account key. It returns the
+// payload.
+func (ca *fakeACMECA) verify(r *http.Request) ([]byte, error) {
+	var jws struct {
+		Protected, Payload, Signature string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, err
+	}
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	if err := decodeSegment(jws.Protected, &protected); err != nil {
+		return nil, err
+	}
+	if protected.URL != ca.srv.URL+r.URL.Path {
+		return nil, fmt.Errorf("signed for %s", protected.URL)
+	}
+	if !ca.nonces[protected.Nonce] {
+		return nil, fmt.Errorf("nonce %q not issued or used", protected.Nonce)
+	}
+	delete(ca.nonces, protected.Nonce)
+
+	key := ca.account
+	switch {
+	case r.URL.Path == "/account" && protected.JWK != nil:
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK["x"])
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK["y"])
+		pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return nil, err
+		}
+		key = pub
+		ca.account = pub
+		thumb := sha256.Sum256(fmt.Appendf(nil, `{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, protected.JWK["x"], protected.JWK["y"]))
+		ca.thumb = base64.RawURLEncoding.EncodeToString(thumb[:])
+	case protected.Kid != ca.srv.URL+"/account/1" || key == nil:
+		return nil, fmt.Errorf("unknown account %q", protected.Kid)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil || len(sig) != 64 || protected.Alg != "ES256" {
+		return nil, fmt.Errorf("bad %s signature", protected.Alg)
+	}
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, fmt.Errorf("signature does not verify")
+	}
+	return base64.RawURLEncoding.DecodeString(jws.Payload)
+}
+
+// validateChallenge checks the challenge certificate as RFC 8737 asks: for
+// the host, with the critical acmeIdentifier extension holding the SHA-256
+// of the key authorization
+func (ca *fakeACMECA) validateChallenge() {
+	ca.authz, ca.challenge = "invalid", "invalid"
+	if ca.failChallenge != "" {
+		return
+	}
+	cert, err := ca.validate(ca.host)
+	if err != nil {
+		ca.failChallenge = err.Error()
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		ca.failChallenge = err.Error()
+		return
+	}
+	want := sha256.Sum256([]byte(acmeTestToken + "." + ca.thumb))
+	for _, ext := range leaf.Extensions {
+		var got []byte
+		if ext.Id.Equal(idPeACMEIdentifier) && ext.Critical && slices.Equal(leaf.DNSNames, []string{ca.host}) {
+			if _, err := asn1.Unmarshal(ext.Value, &got); err == nil && string(got) == string(want[:]) {
+				ca.authz, ca.challenge = "valid", "valid"
+				return
+			}
+		}
+	}
+	ca.failChallenge = "the challenge certificate doesn't hold the key authorization"
+}
+
+func (ca *fakeACMECA) writeAuthz(w http.ResponseWriter) {
+	challenge := acmeChallenge{Type: "tls-alpn-01", URL: ca.srv.URL + "/challenge/1", Token: acmeTestToken, Status: ca.challenge}
+	if ca.challenge == "invalid" {
+		challenge.Error = &acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: ca.failChallenge}
+	}
+	json.NewEncoder(w).Encode(acmeAuthorization{
+		Status:     ca.authz,
+		Identifier: acmeIdentifier{Type: "dns", Value: ca.host},
+		Challenges: []acmeChallenge{
+			{Type: "http-01", URL: ca.srv.URL + "/unused", Token: "unused", Status: "pending"},
+			challenge,
+		},
+	})
+}
+
+func (ca *fakeACMECA) writeOrder(w http.ResponseWriter) {
+	order := acmeOrder{
+		Status:         ca.order,
+		Identifiers:    []acmeIdentifier{{Type: "dns", Value: ca.host}},
+		Authorizations: []string{ca.srv.URL + "/authz/1"},
+		Finalize:       ca.srv.URL + "/order/1/finalize",
+	}
+	if ca.order == "valid" {
+		order.Certificate = ca.srv.URL + "/cert/1"
+	}
+	json.NewEncoder(w).Encode(order)
+}
+
+// issue signs the certificate the CSR in a finalize payload asks for
+func (ca *fakeACMECA) issue(payload []byte) error {
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return err
+	}
+	if !slices.Equal(csr.DNSNames, []string{ca.host}) {
+		return fmt.Errorf("csr names %v, order %s", csr.DNSNames, ca.host)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(ca.orders)),
+		Subject:      pkix.Name{CommonName: ca.host},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	issuer := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "fake acme ca"}}
+	cert, err := x509.CreateCertificate(rand.Reader, template, issuer, csr.PublicKey, ca.key)
+	if err != nil {
+		return err
+	}
+	ca.cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	ca.order = "valid"
+	if ca.processing > 0 {
+		ca.order = "processing"
+	}
+	return nil
+}
+
+// newTestACMEManager returns a manager for host using ca, with the CA's
+// validation served by the manager's own challenge config
+func newTestACMEManager(t *testing.T, ca *fakeACMECA, cacheDir, host string) *acmeManager {
+	t.Helper()
+	m, err := newACMEManager(ca.srv.URL+"/directory", "ops@example.com", []string{host}, cacheDir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.validate = func(host string) (*tls.Certificate, error) {
+		hello := &tls.ClientHelloInfo{ServerName: host, SupportedProtos: []string{acmeALPNProto}}
+		config, err := m.tlsConfig().GetConfigForClient(hello)
+		if err != nil || config == nil {
+			return nil, fmt.Errorf("no challenge config: %v", err)
+		}
+		return config.GetCertificate(hello)
+	}
+	return m
+}
+
+func TestACMEIssue(t *testing.T) {
+	t.Parallel()
+	ca := newFakeACMECA(t)
+	cacheDir := t.TempDir()
+	m := newTestACMEManager(t, ca, cacheDir, "updates.example.com")
+
+	cert, err := m.obtain(context.Background(), "updates.example.com")
+	if err != nil {
+		t.Fatalf("obtain() = %v", err)
+	}
+	if err := cert.Leaf.VerifyHostname("updates.example.com"); err != nil {
+		t.Error(err)
+	}
+	if len(m.challenges) != 0 {
+		t.Error("challenge certificate left behind")
+	}
+
+	// Handshakes are served the certificate without another order
+	served, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: "Updates.Example.com."})
+	if err != nil || served != cert {
+		t.Errorf("getCertificate() = %v, %v, want the issued certificate", served, err)
+	}
+	if ca.orders != 1 {
+		t.Errorf("%d orders, want 1", ca.orders)
+	}
+
+	// A restart reuses the cached certificate and account key
+	again := newTestACMEManager(t, ca, cacheDir, "updates.example.com")
+	if got := again.certs["updates.example.com"]; got == nil || !got.Leaf.Equal(cert.Leaf) {
+		t.Error("the cached certificate was not loaded")
+	}
+	if !again.accountKey.Equal(m.accountKey) {
+		t.Error("the account key was not reused")
+	}
+}
+
+func TestACMERetriesBadNonce(t *testing.T) {
+	t.Parallel()
+	ca := newFakeACMECA(t)
+	ca.rejectNonces = 1
+	m := newTestACMEManager(t, ca, t.TempDir(), "updates.example.com")
+
+	if _, err := m.obtain(context.Background(), "updates.example.com"); err != nil {
+		t.Fatalf("obtain() = %v", err)
+	}
+}
+
+func TestACMEPollsProcessingOrder(t *testing.T) {
+	t.Parallel()
+	ca := newFakeACMECA(t)
+	ca.processing = 1
+	m := newTestACMEManager(t, ca, t.TempDir(), "updates.example.com")
+
+	if _, err := m.obtain(context.Background(), "updates.example.com"); err != nil {
+		t.Fatalf("obtain() = %v", err)
+	}
+}
+
+func TestACMEFailedChallenge(t *testing.T) {
+	t.Parallel()
+	ca := newFakeACMECA(t)
+	ca.failChallenge = "connection refused"
+	cacheDir := t.TempDir()
+	m := newTestACMEManager(t, ca, cacheDir, "updates.example.com")
+
+	_, err := m.obtain(context.Background(), "updates.example.com")
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("obtain() = %v, want the CA's validation error", err)
+	}
+	if _, err := os.Stat(m.certPath("updates.example.com")); !os.IsNotExist(err) {
+		t.Errorf("certificate cached after a failure: %v", err)
+	}
+
+	// The next handshakes don't go back to the CA until acmeRetryDelay
+	if _, err := m.obtain(context.Background(), "updates.example.com"); err == nil {
+		t.Fatal("obtain() succeeded after a failure")
+	}
+	if ca.orders != 1 {
+		t.Errorf("%d orders, want 1", ca.orders)
+	}
+}
+
+func TestACMEDisallowedHost(t *testing.T) {
+	t.Parallel()
+	ca := newFakeACMECA(t)
+	m := newTestACMEManager(t, ca, t.TempDir(), "updates.example.com")
+
+	for _, name := range []string{"other.example.com", "updates.example.com.evil.example", "*.example.com"} {
+		if _, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: name}); err == nil {
+			t.Errorf("getCertificate(%q) succeeded", name)
+		}
+	}
+	if _, err := m.challengeCertificate(&tls.ClientHelloInfo{ServerName: "updates.example.com"}); err == nil {
+		t.Error("challengeCertificate() succeeded with no challenge in progress")
+	}
+	if ca.orders != 0 {
+		t.Errorf("%d orders, want 0", ca.orders)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// readAliases returns the former names a component's releases are also
+// offered under, from the AliasesFile in its directory
+func (s *Server) readAliases(comp, compDir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(compDir, update.AliasesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read aliases: %w", err)
+	}
+
+	var aliases []string
+	for line := range strings.Lines(string(data)) {
+		alias := strings.TrimSpace(line)
+		if alias == "" || strings.HasPrefix(alias, "#") {
+			continue
+		}
+		if alias == comp || strings.ContainsAny(alias, "/\\ \t") {
+			return nil, fmt.Errorf("%s: invalid alias %q", compDir, alias)
+		}
+		// A name still served can't stand for another component
+		if s.isValidComponent(alias) {
+			return nil, fmt.Errorf("%s: alias %q is a component of its own", compDir, alias)
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, nil
+}
+
+// applyAliases lists each renamed component's release under its former
+// names too, as clients installed before the rename look it up by those; a
+// former name of a component not offered is dropped with it
+func applyAliases(manifest *update.Manifest, aliases map[string]string) {
+	for alias, comp := range aliases {
+		if component, ok := manifest.Components[comp]; ok {
+			manifest.Components[alias] = component
+		} else {
+			delete(manifest.Components, alias)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// apiKeyFile lists the API keys that may fetch manifests and downloads. Keys
+// are stored as SHA-256 hashes so the file can't be used to send a key if it
+// leaks. Signing keys, which signed requests are checked with, are secrets,
+// though: anyone who reads them can sign requests, so a file holding them
+// must be kept private.
+type apiKeyFile struct {
+	Keys []apiKey `json:"keys"`
+}
+
+type apiKey struct {
+	// Name identifies the key holder in logs
+	Name      string `json:"name"`
+	KeySHA256 string `json:"key_sha256"`
+	// SigningKey is the hex of update.RequestSigningKey for the key;
+	// without it requests signed with the key are refused
+	SigningKey string `json:"signing_key,omitempty"`
+	// Components are the components the key may fetch; empty allows all
+	Components []string  `json:"components,omitempty"`
+	Expires    time.Time `json:"expires,omitzero"`
+}
+
+// apiKeyAuth accepts manifest and download requests carrying a listed API
+// key, in the APIKeyHeader header or the APIKeyParam query parameter. The
+// key file is re-read on every request so keys can be issued and revoked
+// without a restart.
+//
+// Requests may instead be signed with the key (update.RequestSignatureHeader);
+// those are only accepted once, within update.RequestSignatureSkew of their
+// timestamp. With requireSigned, requests carrying the key itself are refused.
+type apiKeyAuth struct {
+	path          string
+	requireSigned bool
+	nonces        *nonceCache
+}
+
+// newAPIKeyAuth checks the key file at path
+func newAPIKeyAuth(path string, requireSigned bool) (*apiKeyAuth, error) {
+	a := &apiKeyAuth{path: path, requireSigned: requireSigned, nonces: newNonceCache()}
+	if _, err := a.read(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *apiKeyAuth) read() (*apiKeyFile, error) {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("read api keys: %w", err)
+	}
+
+	var file apiKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("decode api keys %s: %w", a.path, err)
+	}
+	return &file, nil
+}
+
+func (a *apiKeyAuth) Scopes() []authScope {
+	return []authScope{scopeManifest, scopeDownload}
+}
+
+func (a *apiKeyAuth) Authenticate(r *http.Request, scope authScope) (*identity, error) {
+	if header := r.Header.Get(update.RequestSignatureHeader); header != "" {
+		return a.authenticateSigned(r, scope, header)
+	}
+
+	token := r.Header.Get(update.APIKeyHeader)
+	if token == "" {
+		token = r.URL.Query().Get(update.APIKeyParam)
+	}
+	if token == "" || a.requireSigned {
+		return nil, errUnauthenticated
+	}
+
+	file, err := a.read()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	for _, key := range file.Keys {
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(key.KeySHA256)), []byte(hash)) == 1 {
+			return key.accept(r, scope)
+		}
+	}
+	return nil, errUnauthenticated
+}
+
+// authenticateSigned accepts a request signed with a listed key, unless it
+// is stale or a replay
+func (a *apiKeyAuth) authenticateSigned(r *http.Request, scope authScope, header string) (*identity, error) {
+	sig, err := update.ParseRequestSignature(header)
+	if err != nil {
+		return nil, errUnauthenticated
+	}
+	now := time.Now()
+	if sig.Timestamp.Before(now.Add(-update.RequestSignatureSkew)) || sig.Timestamp.After(now.Add(update.RequestSignatureSkew)) {
+		return nil, errUnauthenticated
+	}
+
+	file, err := a.read()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range file.Keys {
+		signingKey, err := hex.DecodeString(key.SigningKey)
+		if err != nil || len(signingKey) == 0 || update.RequestKeyID(signingKey) != sig.KeyID {
+			continue
+		}
+		if !sig.Verify(r, signingKey) {
+			return nil, errUnauthenticated
+		}
+		// Only spend the nonce once the signature holds, so forged requests
+		// can't burn a client's nonces
+		if !a.nonces.use(sig.KeyID+":"+sig.Nonce, sig.Timestamp.Add(update.RequestSignatureSkew)) {
+			return nil, errUnauthenticated
+		}
+		return key.accept(r, scope)
+	}
+	return nil, errUnauthenticated
+}
+
+// accept returns the identity of a request authenticated with the key
+func (key *apiKey) accept(r *http.Request, scope authScope) (*identity, error) {
+	if !key.Expires.IsZero() && time.Now().After(key.Expires) {
+		return nil, errUnauthenticated
+	}
+
+	// Manifests are narrowed to the key's components when served; anything
+	// else must be for one of them
+	id := &identity{Subject: "api-key:" + key.Name, Components: key.Components}
+	if scope == scopeDownload && !id.allows(pathComponent(r.URL.Path)) {
+		return nil, errForbidden
+	}
+	return id, nil
+}
+
+// pathComponent returns the component of an asset path, /v1/{kind}/{component}/...
+func pathComponent(path string) string {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[2]
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// writeAPIKeys writes a key file listing keys, with the signing keys of
+// those in signed
+func writeAPIKeys(t *testing.T, keys map[string]bool) string {
+	t.Helper()
+	var file apiKeyFile
+	for key, signed := range keys {
+		entry := testAPIKey(key)
+		if signed {
+			entry.SigningKey = hex.EncodeToString(update.RequestSigningKey(key))
+		}
+		file.Keys = append(file.Keys, entry)
+	}
+	return writeAPIKeyFile(t, &file)
+}
+
+// testAPIKey is the entry of key, limited to nametag
+func testAPIKey(key string) apiKey {
+	sum := sha256.Sum256([]byte(key))
+	return apiKey{Name: key, KeySHA256: hex.EncodeToString(sum[:]), Components: []string{"nametag"}}
+}
+
+func writeAPIKeyFile(t *testing.T, file *apiKeyFile) string {
+	t.Helper()
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "api-keys.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func signedRequest(t *testing.T, path string, signingKey []byte, at time.Time) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if err := update.SignRequest(req, signingKey, at); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	auth, err := newAPIKeyAuth(writeAPIKeys(t, map[string]bool{"signed-key": true, "plain-key": false}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha := sha256.Sum256([]byte("signed-key"))
+
+	tests := []struct {
+		name    string
+		req     func() *http.Request
+		scope   authScope
+		wantErr error
+	}{
+		{"key in header", func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/v1/manifest.json", nil)
+			r.Header.Set(update.APIKeyHeader, "plain-key")
+			return r
+		}, scopeManifest, nil},
+		{"key in query", func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/v1/manifest.json?"+update.APIKeyParam+"=plain-key", nil)
+		}, scopeManifest, nil},
+		{"unknown key", func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/v1/manifest.json", nil)
+			r.Header.Set(update.APIKeyHeader, "other")
+			return r
+		}, scopeManifest, errUnauthenticated},
+		{"no key", func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/v1/manifest.json", nil)
+		}, scopeManifest, errUnauthenticated},
+		{"other component", func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/v1/download/nametag-up/linux-amd64/1.0.0", nil)
+			r.Header.Set(update.APIKeyHeader, "plain-key")
+			return r
+		}, scopeDownload, errForbidden},
+		{"signed", func() *http.Request {
+			return signedRequest(t, "/v1/manifest.json", update.RequestSigningKey("signed-key"), time.Now())
+		}, scopeManifest, nil},
+		{"signed without a signing key on file", func() *http.Request {
+			return signedRequest(t, "/v1/manifest.json", update.RequestSigningKey("plain-key"), time.Now())
+		}, scopeManifest, errUnauthenticated},
+		// The stored SHA-256 must not be enough to sign requests
+		{"signed with the stored hash", func() *http.Request {
+			return signedRequest(t, "/v1/manifest.json", sha[:], time.Now())
+		}, scopeManifest, errUnauthenticated},
+		{"signed too long ago", func() *http.Request {
+			return signedRequest(t, "/v1/manifest.json", update.RequestSigningKey("signed-key"),
+				time.Now().Add(-2*update.RequestSignatureSkew))
+		}, scopeManifest, errUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := auth.Authenticate(tt.req(), tt.scope)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAPIKeyAuthReplay(t *testing.T) {
+	auth, err := newAPIKeyAuth(writeAPIKeys(t, map[string]bool{"signed-key": true}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := signedRequest(t, "/v1/manifest.json", update.RequestSigningKey("signed-key"), time.Now())
+	if _, err := auth.Authenticate(req, scopeManifest); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if _, err := auth.Authenticate(req.Clone(req.Context()), scopeManifest); !errors.Is(err, errUnauthenticated) {
+		t.Fatalf("replay: error = %v, want %v", err, errUnauthenticated)
+	}
+}
+
+func TestAPIKeyAuthRequireSigned(t *testing.T) {
+	auth, err := newAPIKeyAuth(writeAPIKeys(t, map[string]bool{"signed-key": true}), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/manifest.json", nil)
+	req.Header.Set(update.APIKeyHeader, "signed-key")
+	if _, err := auth.Authenticate(req, scopeManifest); !errors.Is(err, errUnauthenticated) {
+		t.Fatalf("unsigned request: error = %v, want %v", err, errUnauthenticated)
+	}
+
+	req = signedRequest(t, "/v1/manifest.json", update.RequestSigningKey("signed-key"), time.Now())
+	if _, err := auth.Authenticate(req, scopeManifest); err != nil {
+		t.Fatalf("signed request: %v", err)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	expired := testAPIKey("expired-key")
+	expired.Expires = time.Now().Add(-time.Hour)
+	keys := writeAPIKeyFile(t, &apiKeyFile{Keys: []apiKey{testAPIKey("plain-key"), expired}})
+	_, h := newTestServer(t, func(s *Server) {
+		auth, err := newAPIKeyAuth(keys, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.authenticators = append(s.authenticators, auth)
+	})
+
+	tests := []struct {
+		name  string
+		path  string
+		key   string
+		admin bool
+		want  int
+	}{
+		{"key on the manifest", "/v1/manifest.json", "plain-key", false, http.StatusOK},
+		{"key on admin state", "/v1/admin/components/nametag", "plain-key", false, http.StatusForbidden},
+		{"key on the release listing", "/v1/admin/releases", "plain-key", false, http.StatusForbidden},
+		{"key on the lint report", "/v1/manifest/lint", "plain-key", false, http.StatusForbidden},
+		{"unknown key on admin state", "/v1/admin/components/nametag", "other-key", false, http.StatusUnauthorized},
+		{"admin token on admin state", "/v1/admin/components/nametag", "", true, http.StatusOK},
+		{"admin token on the manifest", "/v1/manifest.json", "", true, http.StatusForbidden},
+		{"expired key on the manifest", "/v1/manifest.json", "expired-key", false, http.StatusUnauthorized},
+		{"expired key on a download", "/v1/download/nametag/linux-amd64/1.0.0", "expired-key", false, http.StatusUnauthorized},
+		{"expired key on admin state", "/v1/admin/components/nametag", "expired-key", false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.key != "" {
+				req.Header.Set(update.APIKeyHeader, tt.key)
+			}
+			if rec := serve(h, req, tt.admin); rec.Code != tt.want {
+				t.Fatalf("GET %s = %d, want %d: %s", tt.path, rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// quarantineDir is where corrupted assets are moved, relative to the assets
+// directory, hidden by the leading dot
+const quarantineDir = ".quarantine"
+
+// auditReport summarizes one integrity audit of the assets directory
+type auditReport struct {
+	Started     time.Time      `json:"started"`
+	Duration    string         `json:"duration"`
+	Checked     int            `json:"checked"`
+	Recorded    int            `json:"recorded"`
+	Missing     []string       `json:"missing"`
+	Corrupted   []auditFinding `json:"corrupted"`
+	Quarantined int            `json:"quarantined"`
+}
+
+// auditFinding describes an asset whose content no longer matches its
+// recorded hash
+type auditFinding struct {
+	Path        string `json:"path"`
+	Expected    string `json:"expected"`
+	Actual      string `json:"actual"`
+	Quarantined string `json:"quarantined,omitempty"`
+}
+
+// runAuditLoop audits the assets at startup and then every interval until
+// the process exits
+func (s *Server) runAuditLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// Audits record checksums and quarantine files, so they wait for
+		// the server to accept changes again
+		if mode := s.currentMode().Mode; mode != modeNormal {
+			s.logger.Info("skipping integrity audit", "mode", mode)
+		} else if _, err := s.audit(scheduledAuditActor); err != nil {
+			s.logger.Error("integrity audit failed", "error", err)
+		}
+		<-ticker.C
+	}
+}
+
+// scheduledAuditActor is recorded in the audit log for quarantines made by
+// the periodic audit
+const scheduledAuditActor = "scheduled-audit"
+
+// audit re-hashes every published asset of every version and compares it with
+// the version's checksums file. Assets not listed yet are recorded (trust on
+// first audit); assets that no longer match are quarantined so the manifest
+// stops offering them, and the quarantine is logged as done by actor.
+func (s *Server) audit(actor string) (*auditReport, error) {
+	if !s.auditMu.TryLock() {
+		return nil, errAuditRunning
+	}
+	defer s.auditMu.Unlock()
+
+	report := &auditReport{
+		Started:   time.Now().UTC(),
+		Missing:   []string{},
+		Corrupted: []auditFinding{},
+	}
+
+	for _, comp := range s.components {
+		versions, err := os.ReadDir(filepath.Join(s.assetsDir, comp))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read component %s: %w", comp, err)
+		}
+
+		for _, v := range versions {
+			if !v.IsDir() {
+				continue
+			}
+			if err := s.auditVersion(comp, v.Name(), actor, report); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	report.Duration = time.Since(report.Started).Round(time.Millisecond).String()
+
+	s.logger.Info("integrity audit complete",
+		"checked", report.Checked,
+		"recorded", report.Recorded,
+		"missing", len(report.Missing),
+		"corrupted", len(report.Corrupted),
+		"quarantined", report.Quarantined,
+	)
+
+	return report, nil
+}
+
+func (s *Server) auditVersion(comp, version, actor string, report *auditReport) error {
+	dir := filepath.Join(s.assetsDir, comp, version)
+	sumsPath := filepath.Join(dir, update.ChecksumsFile)
+
+	sums, err := update.ReadChecksums(sumsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		sums = make(map[string]string)
+	} else if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, plat := range platforms {
+		filename, err := s.namer.Name(comp, version, plat)
+		if err != nil {
+			return fmt.Errorf("render asset name: %w", err)
+		}
+		path := filepath.Join(dir, filename)
+		expected, recorded := sums[filename]
+
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if recorded {
+				report.Missing = append(report.Missing, path)
+				s.logger.Warn("recorded asset is missing", "path", path)
+			}
+			continue
+		}
+
+		actual, err := s.assetSHA256(path)
+		if errors.Is(err, update.ErrDecrypt) {
+			// Authentication failed: the stored ciphertext was altered
+			actual = "undecryptable"
+		} else if err != nil {
+			return err
+		}
+		report.Checked++
+
+		if !recorded && actual != "undecryptable" {
+			sums[filename] = actual
+			changed = true
+			report.Recorded++
+			s.logger.Info("recorded asset checksum", "path", path, "sha256", actual)
+			continue
+		}
+
+		if strings.EqualFold(actual, expected) {
+			continue
+		}
+
+		finding := auditFinding{Path: path, Expected: expected, Actual: actual}
+		s.logger.Error("asset failed integrity audit",
+			"path", path,
+			"expected", expected,
+			"actual", actual,
+		)
+
+		dest, err := s.quarantine(comp, version, filename)
+		if err != nil {
+			s.logger.Error("failed to quarantine asset", "path", path, "error", err)
+		} else {
+			finding.Quarantined = dest
+			report.Quarantined++
+			s.holdAsset(path)
+			if err := s.catalog.RemoveAsset(context.Background(), comp, version, plat); err != nil {
+				s.logger.Error("failed to remove quarantined asset from the catalog", "path", path, "error", err)
+			}
+			s.assetsChanged()
+			s.logger.Warn("quarantined corrupted asset", "path", path, "dest", dest)
+
+			if err := update.AppendAuditLog(s.assetsDir, update.AuditEntry{
+				Action:         update.AuditQuarantine,
+				Actor:          actor,
+				Component:      comp,
+				Version:        version,
+				File:           filename,
+				SHA256:         actual,
+				PreviousSHA256: expected,
+			}); err != nil {
+				s.logger.Error("failed to write audit log", "error", err)
+			}
+		}
+		report.Corrupted = append(report.Corrupted, finding)
+	}
+
+	if changed {
+		if err := update.WriteChecksums(sumsPath, sums); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// quarantine moves a corrupted asset out of the served tree, keeping it for
+// inspection. The recorded checksum stays so a re-published copy is verified.
+func (s *Server) quarantine(comp, version, filename string) (string, error) {
+	dir := filepath.Join(s.assetsDir, quarantineDir, comp, version)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("create quarantine directory: %w", err)
+	}
+
+	dest := filepath.Join(dir, fmt.Sprintf("%s.%d", filename, time.Now().Unix()))
+	if err := os.Rename(filepath.Join(s.assetsDir, comp, version, filename), dest); err != nil {
+		return "", fmt.Errorf("move to quarantine: %w", err)
+	}
+
+	return dest, nil
+}
+
+// assetSHA256 hashes a stored asset's content, decrypting it if needed
+func (s *Server) assetSHA256(path string) (string, error) {
+	_, digests, err := s.assetDigests(path, update.HashSHA256)
+	if err != nil {
+		return "", err
+	}
+	return digests[update.HashSHA256], nil
+}
+
+var errAuditRunning = errors.New("an audit is already running")
+
+// handleAudit serves POST /v1/admin/audit, running an audit immediately. It
+// may quarantine assets, so it takes the promoter role.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if !s.requireRole(w, r, rolePromoter) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.rejectReadOnly(w) {
+		return
+	}
+
+	report, err := s.audit(requestIdentity(r).Subject)
+	if errors.Is(err, errAuditRunning) {
+		http.Error(w, "Audit already running", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "integrity audit failed", "error", err)
+		http.Error(w, "Audit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
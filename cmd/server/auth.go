@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// authScope is the group of endpoints a request is authenticated for
+type authScope string
+
+const (
+	// scopeAdmin covers /v1/admin/; these endpoints don't exist unless an
+	// authenticator is configured for them
+	scopeAdmin authScope = "admin"
+	// scopeDownload covers assets and their signatures; it is open unless an
+	// authenticator is configured for it
+	scopeDownload authScope = "download"
+	// scopeManifest covers the manifest; it is open unless an authenticator
+	// is configured for it
+	scopeManifest authScope = "manifest"
+)
+
+// role grants access to a class of admin actions
+type role string
+
+const (
+	// roleReader may read admin state
+	roleReader role = "reader"
+	// rolePromoter may change which versions are offered (promote, yank,
+	// audit and quarantine)
+	rolePromoter role = "promoter"
+	// rolePublisher may publish new releases
+	rolePublisher role = "publisher"
+)
+
+// allRoles is granted to credentials that aren't role-aware, like the static
+// admin token
+var allRoles = []role{roleReader, rolePromoter, rolePublisher}
+
+// identity is who an authenticator accepted a request from
+type identity struct {
+	// Subject names the caller in logs and the audit log
+	Subject string
+	Roles   []role
+	// Components limits the caller to these components; empty allows all
+	Components []string
+}
+
+// allows reports whether the identity may fetch component
+func (id *identity) allows(component string) bool {
+	return len(id.Components) == 0 || slices.Contains(id.Components, component)
+}
+
+// has reports whether the identity holds role; promoters and publishers can
+// also read
+func (id *identity) has(r role) bool {
+	if r == roleReader && len(id.Roles) > 0 {
+		return true
+	}
+	return slices.Contains(id.Roles, r)
+}
+
+// Authenticator decides whether a request may use the endpoints of a scope.
+// It returns the caller's identity, errUnauthenticated when the request
+// carries no acceptable credentials, or errForbidden when they aren't good
+// enough. Custom schemes (OIDC, HMAC request signing, SSO) plug in by
+// implementing it and being added to Server.authenticators.
+type Authenticator interface {
+	// Scopes lists the scopes the authenticator protects
+	Scopes() []authScope
+	Authenticate(r *http.Request, scope authScope) (*identity, error)
+}
+
+var (
+	errUnauthenticated = errors.New("unauthenticated")
+	errForbidden       = errors.New("forbidden")
+)
+
+type identityKey struct{}
+
+// requireAuth wraps a handler so it only runs for requests accepted by one of
+// the authenticators protecting scope. The caller's identity is available to
+// the handler through requestIdentity.
+func (s *Server) requireAuth(scope authScope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := s.authorize(w, r, scope)
+		if !ok {
+			return
+		}
+		if id != nil {
+			r = r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+		}
+		next(w, r)
+	}
+}
+
+// requestIdentity returns the identity requireAuth accepted the request
+// from, or nil for an unprotected scope
+func requestIdentity(r *http.Request) *identity {
+	id, _ := r.Context().Value(identityKey{}).(*identity)
+	return id
+}
+
+// manifestCacheControl returns the Cache-Control of a manifest response;
+// one served to an authenticated caller is kept out of shared caches
+func manifestCacheControl(r *http.Request) string {
+	if requestIdentity(r) != nil {
+		return "private, max-age=60"
+	}
+	return "max-age=60"
+}
+
+// requireRole writes a 403 response unless the request's identity holds
+// role
+func (s *Server) requireRole(w http.ResponseWriter, r *http.Request, need role) bool {
+	id := requestIdentity(r)
+	if id != nil && id.has(need) {
+		return true
+	}
+
+	subject := ""
+	if id != nil {
+		subject = id.Subject
+	}
+	s.logger.WarnContext(r.Context(), "request forbidden", "subject", subject, "role", need, "path", r.URL.Path)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// authorize checks a request against the authenticators of scope, writing
+// the error response when it is refused. Any one authenticator accepting the
+// request is enough.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, scope authScope) (*identity, bool) {
+	var (
+		protected bool
+		denied    error
+	)
+	for _, a := range s.authenticators {
+		if !slices.Contains(a.Scopes(), scope) {
+			continue
+		}
+		protected = true
+
+		id, err := a.Authenticate(r, scope)
+		if err == nil {
+			return id, true
+		}
+		// A refusal from one authenticator is more telling than another's
+		// missing credentials
+		if denied == nil || errors.Is(err, errForbidden) {
+			denied = err
+		}
+	}
+
+	switch {
+	case !protected && scope == scopeAdmin:
+		http.NotFound(w, r)
+		return nil, false
+	case !protected:
+		return nil, true
+	case errors.Is(denied, errForbidden), errors.Is(denied, errUnauthenticated) && s.authenticatedElsewhere(r, scope):
+		s.logger.WarnContext(r.Context(), "request forbidden", "scope", scope, "path", r.URL.Path)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	case errors.Is(denied, errUnauthenticated):
+		w.Header().Set("WWW-Authenticate", `Bearer realm="nametag-`+string(scope)+`"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	default:
+		s.logger.ErrorContext(r.Context(), "authentication failed", "scope", scope, "error", denied)
+		http.Error(w, "Authentication unavailable", http.StatusBadGateway)
+		return nil, false
+	}
+}
+
+// authenticatedElsewhere reports whether the request carries credentials
+// good for a scope other than scope, such as an API key sent to an admin
+// endpoint: the caller is known, just not allowed here
+func (s *Server) authenticatedElsewhere(r *http.Request, scope authScope) bool {
+	for _, a := range s.authenticators {
+		if slices.Contains(a.Scopes(), scope) {
+			continue
+		}
+		for _, other := range a.Scopes() {
+			if _, err := a.Authenticate(r, other); err == nil || errors.Is(err, errForbidden) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tokenAuth accepts requests carrying a static bearer token
+type tokenAuth struct {
+	token  string
+	scopes []authScope
+}
+
+func (a *tokenAuth) Scopes() []authScope {
+	return a.scopes
+}
+
+func (a *tokenAuth) Authenticate(r *http.Request, scope authScope) (*identity, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		return nil, errUnauthenticated
+	}
+	return &identity{Subject: "admin-token", Roles: allRoles}, nil
+}
+
+// forwardAuthTimeout bounds each call to the external authorization service
+const forwardAuthTimeout = 5 * time.Second
+
+// forwardAuth delegates the decision to an external service, in the style of
+// reverse proxy "auth request" hooks. The service gets a GET with the
+// original request's headers plus X-Forwarded-Method, X-Forwarded-Uri,
+// X-Forwarded-For, and X-Nametag-Scope, and answers 2xx to allow, 401 or 403
+// to refuse. Request bodies are not forwarded. An allowing response may name
+// the caller in X-Nametag-Subject and its roles, comma-separated, in
+// X-Nametag-Roles; without the latter every role is granted.
+type forwardAuth struct {
+	url        string
+	scopes     []authScope
+	httpClient *http.Client
+}
+
+func newForwardAuth(url string, scopes []authScope) *forwardAuth {
+	return &forwardAuth{
+		url:        url,
+		scopes:     scopes,
+		httpClient: &http.Client{Timeout: forwardAuthTimeout},
+	}
+}
+
+func (a *forwardAuth) Scopes() []authScope {
+	return a.scopes
+}
+
+func (a *forwardAuth) Authenticate(r *http.Request, scope authScope) (*identity, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), forwardAuthTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create auth request: %w", err)
+	}
+
+	req.Header = r.Header.Clone()
+	req.Header.Del("Content-Length")
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", host)
+	}
+	req.Header.Set("X-Nametag-Scope", string(scope))
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("call auth service: %w", err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, errUnauthenticated
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, errForbidden
+	default:
+		return nil, fmt.Errorf("auth service returned status %d", resp.StatusCode)
+	}
+
+	id := &identity{Subject: resp.Header.Get("X-Nametag-Subject"), Roles: allRoles}
+	if id.Subject == "" {
+		id.Subject = "forward-auth"
+	}
+	if roles := resp.Header.Get("X-Nametag-Roles"); roles != "" {
+		id.Roles = parseRoles(strings.Split(roles, ","))
+	}
+	return id, nil
+}
+
+// parseRoles keeps the known role names of names
+func parseRoles(names []string) []role {
+	var roles []role
+	for _, name := range names {
+		r := role(strings.TrimSpace(name))
+		if slices.Contains(allRoles, r) && !slices.Contains(roles, r) {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+// parseAuthScopes decodes a comma-separated list of scopes
+func parseAuthScopes(s string) ([]authScope, error) {
+	var scopes []authScope
+	for _, name := range strings.Split(s, ",") {
+		switch scope := authScope(strings.TrimSpace(name)); scope {
+		case scopeAdmin, scopeDownload, scopeManifest:
+			scopes = append(scopes, scope)
+		default:
+			return nil, fmt.Errorf("unknown auth scope %q", name)
+		}
+	}
+	return scopes, nil
+}
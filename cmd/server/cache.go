@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/strictjson"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// pullCache makes the server a regional cache of an upstream update server.
+// Manifests and metadata are relayed unchanged, so clients still verify the
+// upstream's signatures. Assets listed in the manifest are fetched once,
+// verified against the manifest's digests, and kept on disk by SHA-256,
+// evicting the least recently used beyond the size limit.
+type pullCache struct {
+	upstream    string
+	dir         string
+	maxBytes    int64
+	manifestTTL time.Duration
+	httpClient  *http.Client
+	proxy       *httputil.ReverseProxy
+	logger      *slog.Logger
+
+	manifestMu sync.Mutex
+	manifest   *cachedManifest
+
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	size     int64
+	inflight map[string]*cacheFill
+}
+
+// cachedManifest is the upstream manifest as received, signatures included
+type cachedManifest struct {
+	body       []byte
+	signatures []string
+	parsed     *update.Manifest
+	fetched    time.Time
+}
+
+type cacheEntry struct {
+	size int64
+	used time.Time
+}
+
+// cacheFill is an upstream fetch other requests for the same asset wait on
+type cacheFill struct {
+	done chan struct{}
+	err  error
+}
+
+const (
+	// cacheFetchTimeout bounds a single upstream asset fetch
+	cacheFetchTimeout = 30 * time.Minute
+	// manifestFetchTimeout bounds a manifest fetch, which requests wait on
+	manifestFetchTimeout = 30 * time.Second
+)
+
+func newPullCache(upstream, dir string, maxBytes int64, manifestTTL time.Duration, logger *slog.Logger) (*pullCache, error) {
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream %q", upstream)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+
+	c := &pullCache{
+		upstream:    strings.TrimSuffix(upstream, "/"),
+		dir:         dir,
+		maxBytes:    maxBytes,
+		manifestTTL: manifestTTL,
+		httpClient:  &http.Client{Timeout: cacheFetchTimeout},
+		proxy: &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(u)
+				r.SetXForwarded()
+			},
+		},
+		logger:   logger,
+		entries:  make(map[string]*cacheEntry),
+		inflight: make(map[string]*cacheFill),
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load indexes the assets already on disk, using their modification time as
+// the last use, and removes fetches a previous run didn't finish
+func (c *pullCache) load() error {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("read cache dir: %w", err)
+	}
+
+	for _, file := range files {
+		path := filepath.Join(c.dir, file.Name())
+		if strings.HasPrefix(file.Name(), ".fill-") {
+			os.Remove(path)
+			continue
+		}
+		if !isCacheKey(file.Name()) || !file.Type().IsRegular() {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		c.entries[file.Name()] = &cacheEntry{size: info.Size(), used: info.ModTime()}
+		c.size += info.Size()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict("")
+
+	c.logger.Info("asset cache loaded", "dir", c.dir, "assets", len(c.entries), "bytes", c.size)
+	return nil
+}
+
+// isCacheKey reports whether name is a hex SHA-256, the only names used
+func isCacheKey(name string) bool {
+	decoded, err := hex.DecodeString(name)
+	return err == nil && len(decoded) == 32 && strings.ToLower(name) == name
+}
+
+// getManifest returns the upstream manifest, refetching it once it is older
+// than manifestTTL. When the upstream fails, the last copy is served; its
+// own expiry still protects clients from a cache that has been cut off.
+func (c *pullCache) getManifest(ctx context.Context) (*cachedManifest, error) {
+	c.manifestMu.Lock()
+	defer c.manifestMu.Unlock()
+
+	if c.manifest != nil && time.Since(c.manifest.fetched) < c.manifestTTL {
+		return c.manifest, nil
+	}
+
+	m, err := c.fetchManifest(ctx)
+	if err != nil {
+		if c.manifest != nil {
+			c.logger.Warn("upstream manifest unavailable, serving cached copy", "error", err, "fetched", c.manifest.fetched)
+			return c.manifest, nil
+		}
+		return nil, err
+	}
+	c.manifest = m
+	return m, nil
+}
+
+func (c *pullCache) fetchManifest(ctx context.Context) (*cachedManifest, error) {
+	ctx, cancel := context.WithTimeout(ctx, manifestFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.upstream+"/v1/manifest.json", nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch upstream manifest: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream manifest: status %d", resp.StatusCode)
+	}
+
+	body, err := strictjson.ReadAll(resp.Body, update.MaxManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("read upstream manifest: %w", err)
+	}
+
+	parsed, err := update.ParseManifest(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode upstream manifest: %w", err)
+	}
+
+	return &cachedManifest{
+		body:       body,
+		signatures: resp.Header.Values(update.SignatureHeader),
+		parsed:     parsed,
+		fetched:    time.Now(),
+	}, nil
+}
+
+// findAsset returns the asset the manifest serves at path
+func (m *cachedManifest) findAsset(path string) (update.Asset, bool) {
+	for _, comp := range m.parsed.Components {
+		for _, asset := range comp.Assets {
+			if asset.URL == path {
+				return asset, true
+			}
+		}
+	}
+	return update.Asset{}, false
+}
+
+// fill returns the path of the cached asset, fetching it from the upstream
+// unless it is already on disk. Concurrent requests for the same asset
+// share one fetch.
+func (c *pullCache) fill(path string, asset update.Asset) (string, error) {
+	key := strings.ToLower(asset.SHA256)
+	if !isCacheKey(key) {
+		return "", fmt.Errorf("invalid sha256 %q", asset.SHA256)
+	}
+	dest := filepath.Join(c.dir, key)
+
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok {
+		if _, err := os.Stat(dest); err == nil {
+			now := time.Now()
+			entry.used = now
+			c.mu.Unlock()
+			os.Chtimes(dest, now, now)
+			return dest, nil
+		}
+		// Removed behind our back; fetch it again
+		c.size -= entry.size
+		delete(c.entries, key)
+	}
+	if f, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-f.done
+		return dest, f.err
+	}
+	f := &cacheFill{done: make(chan struct{})}
+	c.inflight[key] = f
+	c.mu.Unlock()
+
+	// Not tied to the request: others may be waiting on this fetch
+	size, err := c.fetchAsset(path, asset, dest)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if err == nil {
+		c.entries[key] = &cacheEntry{size: size, used: time.Now()}
+		c.size += size
+		c.evict(key)
+	}
+	c.mu.Unlock()
+
+	f.err = err
+	close(f.done)
+	return dest, err
+}
+
+// fetchAsset downloads an asset from the upstream into dest, keeping it only
+// if it matches the manifest
+func (c *pullCache) fetchAsset(path string, asset update.Asset, dest string) (int64, error) {
+	c.logger.Info("fetching asset from upstream", "path", path, "sha256", asset.SHA256)
+
+	resp, err := c.httpClient.Get(c.upstream + path)
+	if err != nil {
+		return 0, fmt.Errorf("fetch upstream asset: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("upstream asset: status %d", resp.StatusCode)
+	}
+
+	tmp, err := os.CreateTemp(c.dir, ".fill-*")
+	if err != nil {
+		return 0, fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("write cached asset: %w", err)
+	}
+
+	if size != asset.Size {
+		return 0, fmt.Errorf("upstream asset is %d bytes, manifest says %d", size, asset.Size)
+	}
+	if err := update.VerifyChecksum(tmp.Name(), asset.Digests()); err != nil {
+		return 0, fmt.Errorf("upstream asset: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return 0, fmt.Errorf("store cached asset: %w", err)
+	}
+	return size, nil
+}
+
+// evict removes the least recently used assets until the cache fits its
+// limit, never removing keep. c.mu must be held.
+func (c *pullCache) evict(keep string) {
+	for c.size > c.maxBytes {
+		var (
+			oldest string
+			entry  *cacheEntry
+		)
+		for key, e := range c.entries {
+			if key != keep && (entry == nil || e.used.Before(entry.used)) {
+				oldest, entry = key, e
+			}
+		}
+		if entry == nil {
+			return
+		}
+
+		if err := os.Remove(filepath.Join(c.dir, oldest)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			c.logger.Warn("failed to evict cached asset", "key", oldest, "error", err)
+		}
+		delete(c.entries, oldest)
+		c.size -= entry.size
+		c.logger.Info("evicted cached asset", "key", oldest, "bytes", entry.size)
+	}
+}
+
+// handleCachedManifest relays the upstream manifest and its signatures.
+// Manifests of channels other than stable are relayed without caching.
+func (s *Server) handleCachedManifest(w http.ResponseWriter, r *http.Request) {
+	if update.NormalizeChannel(r.URL.Query().Get("channel")) != update.ChannelStable {
+		s.cache.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	m, err := s.cache.getManifest(r.Context())
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to get upstream manifest", "error", err)
+		http.Error(w, "Upstream unavailable", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", manifestCacheControl(r))
+	for _, sig := range m.signatures {
+		w.Header().Add(update.SignatureHeader, sig)
+	}
+	w.Write(m.body)
+}
+
+// handleCachedDownload serves assets of the current manifest from the cache
+// and relays anything else, such as older versions, without caching it
+func (s *Server) handleCachedDownload(w http.ResponseWriter, r *http.Request) {
+	m, err := s.cache.getManifest(r.Context())
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to get upstream manifest", "error", err)
+		http.Error(w, "Upstream unavailable", http.StatusBadGateway)
+		return
+	}
+
+	asset, ok := m.findAsset(r.URL.Path)
+	if !ok {
+		s.cache.proxy.ServeHTTP(s.meterEgress(w), r)
+		return
+	}
+
+	path, err := s.cache.fill(r.URL.Path, asset)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to cache asset", "path", r.URL.Path, "error", err)
+		http.Error(w, "Upstream asset unavailable", http.StatusBadGateway)
+		return
+	}
+
+	setAssetHeaders(w, strings.ToLower(asset.SHA256))
+	s.issueResumeToken(w, r)
+	http.ServeFile(s.meterEgress(w), r, path)
+}
+
+// handleUpstream relays a request to the upstream unchanged
+func (s *Server) handleUpstream(w http.ResponseWriter, r *http.Request) {
+	s.cache.proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/catalog"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// legacyCatalogFile is where the server listed releases before it kept a
+// catalog database; only the publication times are still read from it
+const legacyCatalogFile = ".catalog.json"
+
+// catalogSnapshot is where a server that stores to a storage keeps a copy of
+// its catalog, for the servers following it. Unlike the catalog itself it is
+// synced.
+const catalogSnapshot = "catalog.db"
+
+// legacyRelease is a release as legacyCatalogFile lists it
+type legacyRelease struct {
+	Version   string    `json:"version"`
+	Published time.Time `json:"published"`
+}
+
+// openCatalog opens the release catalog of the assets directory, which the
+// server's upload and release APIs write and its manifests are generated
+// from. The directory's releases from before there was one are imported
+// into it the first time.
+func (s *Server) openCatalog(ctx context.Context) error {
+	c, err := catalog.Open(filepath.Join(s.assetsDir, catalog.File))
+	if err != nil {
+		return err
+	}
+	imported, err := c.Imported(ctx)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	s.catalog = c
+	if imported {
+		return nil
+	}
+
+	n, err := s.importReleases(ctx)
+	if err != nil {
+		return fmt.Errorf("import releases: %w", err)
+	}
+	if err := s.importReleaseStates(ctx); err != nil {
+		return fmt.Errorf("import release state: %w", err)
+	}
+	if err := c.SetImported(ctx); err != nil {
+		return err
+	}
+	if n > 0 {
+		s.logger.Info("imported releases into the catalog", "releases", n)
+	}
+	return nil
+}
+
+// importReleases adds the releases in the assets directory the catalog
+// doesn't have: those published before it existed, and those fetched from a
+// storage other servers publish to. A release is put on the channel its
+// directory's CHANNEL file names, stable without one. Returns how many
+// releases it added to or completed.
+func (s *Server) importReleases(ctx context.Context) (int, error) {
+	var published map[string][]legacyRelease
+	if data, err := os.ReadFile(filepath.Join(s.assetsDir, legacyCatalogFile)); err == nil {
+		if err := json.Unmarshal(data, &published); err != nil {
+			s.logger.Warn("ignoring corrupt legacy release catalog", "error", err)
+		}
+	}
+
+	imported := 0
+	for _, comp := range s.components {
+		entries, err := os.ReadDir(filepath.Join(s.assetsDir, comp))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return imported, err
+		}
+		for _, e := range entries {
+			if _, err := update.ParseVersion(e.Name()); err != nil || !e.IsDir() {
+				continue
+			}
+			versionDir := filepath.Join(s.assetsDir, comp, e.Name())
+			channel, err := update.ReadChannel(versionDir)
+			if err != nil {
+				return imported, err
+			}
+			release := catalog.Release{Version: e.Name(), Channel: channel, Published: time.Now().UTC()}
+			if i := slices.IndexFunc(published[comp], func(r legacyRelease) bool { return r.Version == e.Name() }); i >= 0 {
+				release.Published = published[comp][i].Published
+			} else if info, err := e.Info(); err == nil {
+				release.Published = info.ModTime().UTC()
+			}
+
+			assets, err := s.scanAssets(comp, e.Name())
+			if err != nil {
+				return imported, err
+			}
+			// A directory without assets is an upload in progress or what
+			// the quarantine left, not a release
+			if len(assets) == 0 {
+				continue
+			}
+			added, err := s.catalog.Import(ctx, comp, release, assets)
+			if err != nil {
+				return imported, err
+			}
+			if added {
+				imported++
+			}
+		}
+	}
+	return imported, nil
+}
+
+// scanAssets lists the assets of a version directory, by the names the
+// server gives them
+func (s *Server) scanAssets(comp, version string) ([]catalog.Asset, error) {
+	var assets []catalog.Asset
+	for _, plat := range platforms {
+		filename, err := s.namer.Name(comp, version, plat)
+		if err != nil {
+			return nil, fmt.Errorf("render asset name: %w", err)
+		}
+		path := filepath.Join(s.assetsDir, comp, version, filename)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		size, digests, err := s.cachedDigests(path, update.HashSHA256)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		assets = append(assets, catalog.Asset{Platform: plat, File: filename, Size: size, SHA256: digests[update.HashSHA256]})
+	}
+	return assets, nil
+}
+
+// importReleaseStates moves the release state kept in each component's
+// directory before the catalog into it
+func (s *Server) importReleaseStates(ctx context.Context) error {
+	for _, comp := range s.components {
+		data, err := os.ReadFile(filepath.Join(s.assetsDir, comp, releaseFile))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if current, err := s.catalog.State(ctx, comp); err != nil {
+			return err
+		} else if current != nil {
+			continue
+		}
+		var state releaseState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("decode release state of %s: %w", comp, err)
+		}
+		if err := s.writeReleaseState(comp, &state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishAsset records an asset just placed in the assets directory in the
+// catalog, publishing its version on channel if it is the version's first
+func (s *Server) publishAsset(ctx context.Context, comp, plat, version, channel string, published time.Time, size int64, sha256 string) error {
+	filename, err := s.namer.Name(comp, version, plat)
+	if err != nil {
+		return fmt.Errorf("render asset name: %w", err)
+	}
+	release := catalog.Release{Version: version, Channel: channel, Published: published}
+	asset := catalog.Asset{Platform: plat, File: filename, Size: size, SHA256: sha256}
+	if err := s.catalog.Publish(ctx, comp, release, asset); err != nil {
+		return fmt.Errorf("catalog asset: %w", err)
+	}
+	return nil
+}
+
+// restoreCatalog replaces the catalog with the snapshot in the assets
+// directory if pull fetched a new one, reporting whether it did; info is the
+// snapshot's file as it was before the pull, nil for none
+func (s *Server) restoreCatalog(ctx context.Context, info os.FileInfo) (bool, error) {
+	path := filepath.Join(s.assetsDir, catalogSnapshot)
+	fetched, err := os.Stat(path)
+	if err != nil || (info != nil && fetched.ModTime().Equal(info.ModTime()) && fetched.Size() == info.Size()) {
+		return false, nil
+	}
+	if err := s.catalog.Restore(ctx, path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// exportCatalog writes the catalog's snapshot for the storage if it changed
+// since the last one
+func (s *Server) exportCatalog(ctx context.Context) error {
+	path := filepath.Join(s.assetsDir, catalogSnapshot)
+	_, changed, err := s.catalog.Changed(ctx)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && !changed.After(info.ModTime()) {
+		return nil
+	}
+	return s.catalog.Export(ctx, path)
+}
+
+// releases returns a component's published versions, newest first by
+// version precedence, so 1.10.0 sorts above 1.9.0
+func (s *Server) releases(comp string) ([]catalog.Release, error) {
+	return s.catalog.Releases(context.Background(), comp)
+}
+
+// findRelease returns the release of version among releases
+func findRelease(releases []catalog.Release, version string) (catalog.Release, bool) {
+	i := slices.IndexFunc(releases, func(r catalog.Release) bool { return r.Version == version })
+	if i < 0 {
+		return catalog.Release{}, false
+	}
+	return releases[i], true
+}
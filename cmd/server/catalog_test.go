@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/catalog"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// offered returns the version of nametag the manifest of channel offers, ""
+// for none
+func offered(t *testing.T, h http.Handler, channel string) string {
+	t.Helper()
+	rec := serve(h, httptest.NewRequest(http.MethodGet, "/v1/manifest.json?channel="+channel, nil), false)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("manifest = %d: %s", rec.Code, rec.Body)
+	}
+	manifest, err := update.ParseManifest(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest.Components["nametag"].Version
+}
+
+// placeAsset puts nametag's linux-amd64 asset of version in assetsDir by
+// hand, the way releases were published before the catalog
+func placeAsset(t *testing.T, assetsDir, version string) {
+	t.Helper()
+	dir := filepath.Join(assetsDir, "nametag", version)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "nametag-linux-amd64"), []byte("nametag "+version), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCatalogPublish(t *testing.T) {
+	s, h := newTestServer(t)
+	for _, version := range []string{"1.9.0", "1.10.0"} {
+		if rec := upload(t, h, version, []byte("nametag "+version), ""); rec.Code != http.StatusCreated {
+			t.Fatalf("upload %s = %d: %s", version, rec.Code, rec.Body)
+		}
+	}
+	if got := offered(t, h, update.ChannelStable); got != "1.10.0" {
+		t.Fatalf("offered %q, want 1.10.0 over 1.9.0", got)
+	}
+
+	// The assets directory only holds files: one put there by hand isn't
+	// published until uploaded
+	placeAsset(t, s.assetsDir, "2.0.0")
+	if got := offered(t, h, update.ChannelStable); got != "1.10.0" {
+		t.Errorf("offered %q with 2.0.0 only on disk, want 1.10.0", got)
+	}
+	if rec := upload(t, h, "2.0.0", []byte("nametag 2.0.0"), ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"unchanged":true`) {
+		t.Fatalf("upload of the file on disk = %d: %s", rec.Code, rec.Body)
+	}
+	if got := offered(t, h, update.ChannelStable); got != "2.0.0" {
+		t.Errorf("offered %q after uploading 2.0.0, want it", got)
+	}
+
+	// Moving a release to another channel moves it in the catalog
+	req := httptest.NewRequest(http.MethodPost, "/v1/admin/components/nametag/channel", strings.NewReader(`{"version":"2.0.0","channel":"beta"}`))
+	req.Header.Set("If-Match", releaseETag(0))
+	if rec := serve(h, req, true); rec.Code != http.StatusOK {
+		t.Fatalf("channel = %d: %s", rec.Code, rec.Body)
+	}
+	if got := offered(t, h, update.ChannelStable); got != "1.10.0" {
+		t.Errorf("stable offered %q after moving 2.0.0 to beta, want 1.10.0", got)
+	}
+	if got := offered(t, h, "beta"); got != "2.0.0" {
+		t.Errorf("beta offered %q, want 2.0.0", got)
+	}
+	if _, err := os.Stat(filepath.Join(s.assetsDir, "nametag", "2.0.0", update.ChannelFile)); err == nil {
+		t.Error("channel move wrote a CHANNEL file")
+	}
+	req = httptest.NewRequest(http.MethodPost, "/v1/admin/components/nametag/channel", strings.NewReader(`{"version":"3.0.0","channel":"beta"}`))
+	req.Header.Set("If-Match", releaseETag(1))
+	if rec := serve(h, req, true); rec.Code != http.StatusNotFound {
+		t.Errorf("channel of an unpublished version = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestCatalogImport(t *testing.T) {
+	published := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	var assetsDir string
+	s, h := newTestServer(t, func(s *Server) {
+		assetsDir = s.assetsDir
+		for _, version := range []string{"1.8.0", "1.9.0", "1.10.0"} {
+			placeAsset(t, s.assetsDir, version)
+		}
+		// An upload in progress, not a release
+		if err := os.MkdirAll(filepath.Join(s.assetsDir, "nametag", "1.11.0"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		files := map[string]string{
+			filepath.Join("nametag", "1.10.0", update.ChannelFile): "beta\n",
+			filepath.Join("nametag", releaseFile):                  `{"revision":3,"yanked":["1.9.0"]}`,
+			legacyCatalogFile:                                      `{"nametag":[{"version":"1.8.0","channel":"stable","published":"` + published.Format(time.RFC3339) + `"}]}`,
+		}
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(s.assetsDir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	if got := offered(t, h, update.ChannelStable); got != "1.8.0" {
+		t.Errorf("stable offered %q, want 1.8.0 with 1.9.0 yanked", got)
+	}
+	if got := offered(t, h, "beta"); got != "1.10.0" {
+		t.Errorf("beta offered %q, want 1.10.0", got)
+	}
+	releases, err := s.releases("nametag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(releases); strings.Join(got, " ") != "1.10.0 1.9.0 1.8.0" {
+		t.Errorf("imported releases %v", got)
+	}
+	if r, _ := findRelease(releases, "1.8.0"); !r.Published.Equal(published) {
+		t.Errorf("1.8.0 published %s, want %s from the legacy catalog", r.Published, published)
+	}
+	state, err := s.releaseState("nametag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Revision != 3 {
+		t.Errorf("imported release state at revision %d, want 3", state.Revision)
+	}
+
+	// Importing happens once; later changes to the directory aren't
+	// releases, nor is the release state file
+	placeAsset(t, assetsDir, "1.12.0")
+	if err := os.WriteFile(filepath.Join(assetsDir, "nametag", releaseFile), []byte(`{"revision":9}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, h = newTestServer(t, func(s *Server) { s.assetsDir = assetsDir })
+	if got := offered(t, h, update.ChannelStable); got != "1.8.0" {
+		t.Errorf("stable offered %q after reopening, want 1.8.0", got)
+	}
+	if state, _ := s.releaseState("nametag"); state.Revision != 3 {
+		t.Errorf("release state at revision %d after reopening, want 3", state.Revision)
+	}
+}
+
+func TestCatalogStoragePull(t *testing.T) {
+	storage := &memStorage{objects: map[string][]byte{}}
+	s, h := newTestServer(t, func(s *Server) {
+		mirror, err := newStorageMirror(storage, s.assetsDir, s.logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.storage = mirror
+	})
+	if got := offered(t, h, update.ChannelStable); got != "" {
+		t.Fatalf("offered %q of an empty storage", got)
+	}
+
+	// Published by another server sharing the storage
+	storage.objects["nametag/1.0.0/nametag-linux-amd64"] = []byte("nametag 1.0.0")
+	storage.objects["nametag/1.1.0/nametag-linux-amd64"] = []byte("nametag 1.1.0")
+	storage.objects["nametag/1.1.0/"+update.ChannelFile] = []byte("beta\n")
+	if err := s.syncStorage(t.Context()); err != nil {
+		t.Fatalf("syncStorage() = %v", err)
+	}
+	if got := offered(t, h, update.ChannelStable); got != "1.0.0" {
+		t.Errorf("stable offered %q after the pull, want 1.0.0", got)
+	}
+	if got := offered(t, h, "beta"); got != "1.1.0" {
+		t.Errorf("beta offered %q after the pull, want 1.1.0", got)
+	}
+}
+
+// versions lists the versions of releases in order
+func versions(releases []catalog.Release) []string {
+	var vs []string
+	for _, r := range releases {
+		vs = append(vs, r.Version)
+	}
+	return vs
+}
+
+func TestCatalogStorageReplica(t *testing.T) {
+	storage := &memStorage{objects: map[string][]byte{}}
+	withStorage := func(s *Server) {
+		mirror, err := newStorageMirror(storage, s.assetsDir, s.logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.storage = mirror
+	}
+	writer, wh := newTestServer(t, withStorage)
+	replica, rh := newTestServer(t, withStorage, func(s *Server) { s.setMode(modeReadOnly, time.Minute) })
+
+	for _, version := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+		if rec := upload(t, wh, version, []byte("nametag "+version), ""); rec.Code != http.StatusCreated {
+			t.Fatalf("upload %s = %d: %s", version, rec.Code, rec.Body)
+		}
+	}
+	for i, change := range []struct{ action, body string }{
+		{"channel", `{"version":"1.2.0","channel":"beta"}`},
+		{"yank", `{"version":"1.1.0"}`},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/admin/components/nametag/"+change.action, strings.NewReader(change.body))
+		req.Header.Set("If-Match", releaseETag(int64(i)))
+		if rec := serve(wh, req, true); rec.Code != http.StatusOK {
+			t.Fatalf("%s = %d: %s", change.action, rec.Code, rec.Body)
+		}
+	}
+	if err := writer.syncStorage(t.Context()); err != nil {
+		t.Fatalf("writer syncStorage() = %v", err)
+	}
+	if _, ok := storage.objects[catalogSnapshot]; !ok {
+		t.Fatal("writer stored no catalog")
+	}
+
+	// The replica follows the writer's channels and yanks, which aren't
+	// in the files it fetched
+	if err := replica.syncStorage(t.Context()); err != nil {
+		t.Fatalf("replica syncStorage() = %v", err)
+	}
+	if got := offered(t, rh, update.ChannelStable); got != "1.0.0" {
+		t.Errorf("replica stable offered %q, want 1.0.0 with 1.1.0 yanked", got)
+	}
+	if got := offered(t, rh, "beta"); got != "1.2.0" {
+		t.Errorf("replica beta offered %q, want 1.2.0", got)
+	}
+
+	// A sync without changes keeps the stored copy
+	stored := storage.objects[catalogSnapshot]
+	if err := writer.syncStorage(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storage.objects[catalogSnapshot], stored) {
+		t.Error("writer stored its catalog again without changes")
+	}
+}
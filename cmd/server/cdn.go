@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cdnRedirect sends downloads to a CDN mirroring the assets directory, so
+// the server only answers with a redirect and the CDN carries the bytes.
+// With a key, the redirect's URL is signed and expires, for CDNs that only
+// serve URLs the server handed out.
+type cdnRedirect struct {
+	base *url.URL
+	key  []byte
+	ttl  time.Duration
+}
+
+// cdnKeySize is the minimum length of a CDN signing key
+const cdnKeySize = 32
+
+func newCDNRedirect(base, keyFile string, ttl time.Duration) (*cdnRedirect, error) {
+	u, err := parseCDNURL(base)
+	if err != nil {
+		return nil, err
+	}
+	c := &cdnRedirect{base: u, ttl: ttl}
+	if keyFile == "" {
+		return c, nil
+	}
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CDN signing key: %w", err)
+	}
+	c.key = bytes.TrimSpace(key)
+	if len(c.key) < cdnKeySize {
+		return nil, fmt.Errorf("CDN signing key must be at least %d bytes", cdnKeySize)
+	}
+	if ttl <= 0 {
+		return nil, errors.New("signed CDN URLs need a positive lifetime")
+	}
+	return c, nil
+}
+
+// withBase returns a redirect to another CDN URL, signed alike
+func (c *cdnRedirect) withBase(base string) (*cdnRedirect, error) {
+	u, err := parseCDNURL(base)
+	if err != nil {
+		return nil, err
+	}
+	return &cdnRedirect{base: u, key: c.key, ttl: c.ttl}, nil
+}
+
+// parseCDNURL checks a CDN base URL, which asset paths are appended to
+func parseCDNURL(base string) (*url.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid CDN URL %q", base)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("CDN URL %q has a query or fragment", base)
+	}
+	return u, nil
+}
+
+// location returns the CDN URL of the asset at rel, a slash-separated path
+// within the assets directory. A signed URL ends in
+// ?expires={unix}&signature={sig}, sig being the unpadded base64url
+// HMAC-SHA256 of the URL's path and "?expires={unix}".
+func (c *cdnRedirect) location(rel string, now time.Time) string {
+	u := c.base.JoinPath(strings.Split(rel, "/")...)
+	if c.key == nil {
+		return u.String()
+	}
+
+	u.RawQuery = "expires=" + strconv.FormatInt(now.Add(c.ttl).Unix(), 10)
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(u.EscapedPath() + "?" + u.RawQuery))
+	u.RawQuery += "&signature=" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	return u.String()
+}
+
+// redirect answers a download of the asset at rel with the CDN's URL of it.
+// The redirect isn't cached: a signed URL expires, and a client coming back
+// should be sent to whatever the server offers then.
+func (c *cdnRedirect) redirect(w http.ResponseWriter, r *http.Request, rel string) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, c.location(rel, time.Now()), http.StatusFound)
+}
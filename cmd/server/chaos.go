@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chaosPath is where chaos rules are set, with query parameters
+const chaosPath = "/v1/chaos"
+
+// errChaosTruncated ends a response cut short by a chaos rule
+var errChaosTruncated = errors.New("response truncated by chaos rule")
+
+// chaosRule injects failures into the responses of the paths under Endpoint,
+// so clients' resilience can be tested against the real server
+type chaosRule struct {
+	Endpoint string `json:"endpoint"`
+	// Delay holds back the response
+	Delay time.Duration `json:"-"`
+	// Rate, when set, paces the body to this many bytes per second
+	Rate int64 `json:"rate,omitempty"`
+	// Truncate, when set, drops the connection after this many body bytes
+	Truncate *int64 `json:"truncate,omitempty"`
+	// Corrupt flips the first byte of the body, so its hash is wrong
+	Corrupt bool `json:"corrupt,omitempty"`
+	// Status, when set, answers with this error status instead
+	Status int `json:"status,omitempty"`
+	// Times is how many more requests the rule applies to; 0 is until it's
+	// removed
+	Times int `json:"times,omitempty"`
+}
+
+// MarshalJSON renders Delay as a duration string
+func (c chaosRule) MarshalJSON() ([]byte, error) {
+	type plain chaosRule
+	return json.Marshal(struct {
+		plain
+		Delay string `json:"delay,omitempty"`
+	}{plain(c), durationText(c.Delay)})
+}
+
+func durationText(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// chaos is the server's failure injection, a developer mode enabled with
+// -chaos. Rules are keyed by endpoint; a request gets the rule of the
+// longest endpoint its path starts with.
+type chaos struct {
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	rules map[string]*chaosRule
+}
+
+func newChaos(logger *slog.Logger) *chaos {
+	return &chaos{logger: logger, rules: make(map[string]*chaosRule)}
+}
+
+// take returns the rule applying to a request for path, counting the use
+func (c *chaos) take(path string) (chaosRule, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var match *chaosRule
+	for endpoint, rule := range c.rules {
+		if strings.HasPrefix(path, endpoint) && (match == nil || len(endpoint) > len(match.Endpoint)) {
+			match = rule
+		}
+	}
+	if match == nil {
+		return chaosRule{}, false
+	}
+	rule := *match
+	if match.Times > 0 {
+		if match.Times--; match.Times == 0 {
+			delete(c.rules, match.Endpoint)
+		}
+	}
+	return rule, true
+}
+
+// wrap applies the chaos rules to the responses of next
+func (c *chaos) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == chaosPath {
+			c.handle(w, r)
+			return
+		}
+		rule, ok := c.take(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c.logger.WarnContext(r.Context(), "injecting failure", "path", r.URL.Path, "endpoint", rule.Endpoint)
+
+		if rule.Delay > 0 {
+			select {
+			case <-time.After(rule.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if rule.Status != 0 {
+			http.Error(w, "Injected failure", rule.Status)
+			return
+		}
+
+		cw := &chaosWriter{ResponseWriter: w, rule: rule}
+		next.ServeHTTP(cw, r)
+		if cw.truncated {
+			// Drop the connection, as a failing network would, rather than
+			// end a response short of its Content-Length cleanly
+			http.NewResponseController(w).Flush()
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// chaosWriter applies a rule's body faults to a response
+type chaosWriter struct {
+	http.ResponseWriter
+	rule      chaosRule
+	written   int64
+	corrupted bool
+	truncated bool
+}
+
+func (w *chaosWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *chaosWriter) Write(p []byte) (int, error) {
+	var err error
+	if w.rule.Truncate != nil {
+		if left := *w.rule.Truncate - w.written; int64(len(p)) > left {
+			p, err = p[:max(left, 0)], errChaosTruncated
+			w.truncated = true
+		}
+	}
+	if w.rule.Corrupt && !w.corrupted && len(p) > 0 {
+		p = append([]byte{p[0] ^ 0xff}, p[1:]...)
+		w.corrupted = true
+	}
+
+	n, werr := w.pace(p)
+	w.written += int64(n)
+	if werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// pace writes p at the rule's rate, in tenth-of-a-second chunks flushed to
+// the client as they go
+func (w *chaosWriter) pace(p []byte) (int, error) {
+	if w.rule.Rate <= 0 {
+		return w.ResponseWriter.Write(p)
+	}
+	chunk := max(int(w.rule.Rate/10), 1)
+	written := 0
+	for len(p) > 0 {
+		part := p[:min(chunk, len(p))]
+		n, err := w.ResponseWriter.Write(part)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		http.NewResponseController(w.ResponseWriter).Flush()
+		p = p[n:]
+		time.Sleep(100 * time.Millisecond)
+	}
+	return written, nil
+}
+
+// handle serves /v1/chaos:
+//
+//	GET                                 - the rules, as a JSON list
+//	POST ?endpoint=/v1/download/&...    - set the rule of an endpoint
+//	DELETE [?endpoint=...]              - remove one rule, or all of them
+//
+// A rule takes delay (a duration), rate (bytes per second), truncate (bytes),
+// corrupt, status (400-599), and times.
+func (c *chaos) handle(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		c.mu.Lock()
+		rules := []*chaosRule{}
+		for _, endpoint := range slices.Sorted(maps.Keys(c.rules)) {
+			rules = append(rules, c.rules[endpoint])
+		}
+		writeJSON(w, rules)
+		c.mu.Unlock()
+
+	case http.MethodPost:
+		rule, err := parseChaosRule(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		c.rules[rule.Endpoint] = rule
+		c.mu.Unlock()
+		c.logger.WarnContext(r.Context(), "chaos rule set", "endpoint", rule.Endpoint)
+		writeJSON(w, rule)
+
+	case http.MethodDelete:
+		endpoint := r.URL.Query().Get("endpoint")
+		c.mu.Lock()
+		if endpoint == "" {
+			clear(c.rules)
+		} else {
+			delete(c.rules, endpoint)
+		}
+		c.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func parseChaosRule(r *http.Request) (*chaosRule, error) {
+	q := r.URL.Query()
+	rule := &chaosRule{Endpoint: q.Get("endpoint")}
+	if !strings.HasPrefix(rule.Endpoint, "/") || rule.Endpoint == chaosPath {
+		return nil, fmt.Errorf("endpoint must be a path such as /v1/download/")
+	}
+
+	var err error
+	if v := q.Get("delay"); v != "" {
+		if rule.Delay, err = time.ParseDuration(v); err != nil || rule.Delay < 0 {
+			return nil, fmt.Errorf("invalid delay %q", v)
+		}
+	}
+	if v := q.Get("rate"); v != "" {
+		if rule.Rate, err = strconv.ParseInt(v, 10, 64); err != nil || rule.Rate <= 0 {
+			return nil, fmt.Errorf("invalid rate %q", v)
+		}
+	}
+	if v := q.Get("truncate"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid truncate %q", v)
+		}
+		rule.Truncate = &n
+	}
+	if v := q.Get("corrupt"); v != "" {
+		if rule.Corrupt, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid corrupt %q", v)
+		}
+	}
+	if v := q.Get("status"); v != "" {
+		if rule.Status, err = strconv.Atoi(v); err != nil || rule.Status < 400 || rule.Status > 599 {
+			return nil, fmt.Errorf("invalid status %q", v)
+		}
+	}
+	if v := q.Get("times"); v != "" {
+		if rule.Times, err = strconv.Atoi(v); err != nil || rule.Times < 0 {
+			return nil, fmt.Errorf("invalid times %q", v)
+		}
+	}
+
+	if rule.Delay == 0 && rule.Rate == 0 && rule.Truncate == nil && !rule.Corrupt && rule.Status == 0 {
+		return nil, fmt.Errorf("rule injects nothing; set delay, rate, truncate, corrupt, or status")
+	}
+	return rule, nil
+}
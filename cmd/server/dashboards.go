@@ -0,0 +1,214 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Grafana dashboards are generated from the metric names rather than kept as
+// JSON files, so a renamed metric can't leave a panel querying nothing. They
+// pick the Prometheus data source and product when imported.
+
+type grafanaDashboard struct {
+	UID           string          `json:"uid"`
+	Title         string          `json:"title"`
+	Tags          []string        `json:"tags"`
+	SchemaVersion int             `json:"schemaVersion"`
+	Refresh       string          `json:"refresh"`
+	Time          grafanaRange    `json:"time"`
+	Templating    grafanaTemplate `json:"templating"`
+	Panels        []grafanaPanel  `json:"panels"`
+}
+
+type grafanaRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaTemplate struct {
+	List []grafanaVariable `json:"list"`
+}
+
+type grafanaVariable struct {
+	Name       string             `json:"name"`
+	Label      string             `json:"label"`
+	Type       string             `json:"type"`
+	Query      string             `json:"query"`
+	Datasource *grafanaDatasource `json:"datasource,omitempty"`
+	IncludeAll bool               `json:"includeAll,omitempty"`
+	AllValue   string             `json:"allValue,omitempty"`
+	Refresh    int                `json:"refresh,omitempty"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaPanel struct {
+	ID          int                `json:"id"`
+	Type        string             `json:"type"`
+	Title       string             `json:"title"`
+	Description string             `json:"description,omitempty"`
+	GridPos     grafanaGridPos     `json:"gridPos"`
+	Datasource  grafanaDatasource  `json:"datasource"`
+	Targets     []grafanaTarget    `json:"targets"`
+	FieldConfig grafanaFieldConfig `json:"fieldConfig"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	Instant      bool   `json:"instant,omitempty"`
+	Format       string `json:"format,omitempty"`
+}
+
+type grafanaFieldConfig struct {
+	Defaults struct {
+		Unit string `json:"unit,omitempty"`
+	} `json:"defaults"`
+}
+
+var prometheusDatasource = grafanaDatasource{Type: "prometheus", UID: "${datasource}"}
+
+// dashboardBuilder lays panels out two to a row
+type dashboardBuilder struct {
+	dashboard grafanaDashboard
+}
+
+func newDashboard(uid, title string) *dashboardBuilder {
+	return &dashboardBuilder{dashboard: grafanaDashboard{
+		UID:           uid,
+		Title:         title,
+		Tags:          []string{"nametag"},
+		SchemaVersion: 39,
+		Refresh:       "1m",
+		Time:          grafanaRange{From: "now-7d", To: "now"},
+		Templating: grafanaTemplate{List: []grafanaVariable{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+			{
+				Name: "product", Label: "Product", Type: "query",
+				Query:      "label_values(" + metricManifestRequests + ", product)",
+				Datasource: &prometheusDatasource, IncludeAll: true, AllValue: ".*", Refresh: 2,
+			},
+		}},
+	}}
+}
+
+func (b *dashboardBuilder) panel(kind, title, unit, description string, targets ...grafanaTarget) {
+	n := len(b.dashboard.Panels)
+	panel := grafanaPanel{
+		ID:          n + 1,
+		Type:        kind,
+		Title:       title,
+		Description: description,
+		GridPos:     grafanaGridPos{H: 8, W: 12, X: 12 * (n % 2), Y: 8 * (n / 2)},
+		Datasource:  prometheusDatasource,
+		Targets:     targets,
+	}
+	for i := range panel.Targets {
+		panel.Targets[i].RefID = string(rune('A' + i))
+	}
+	panel.FieldConfig.Defaults.Unit = unit
+	b.dashboard.Panels = append(b.dashboard.Panels, panel)
+}
+
+// productFilter selects the dashboard's product, plus any further matchers
+func productFilter(matchers ...string) string {
+	return "{" + strings.Join(append([]string{`product=~"$product"`}, matchers...), ",") + "}"
+}
+
+// dashboards generates the server's dashboards, by name
+func dashboards() map[string]grafanaDashboard {
+	rollout := newDashboard("nametag-rollout", "Nametag rollout")
+	rollout.panel("table", "Offered versions", "", "The version each channel's manifest offers",
+		grafanaTarget{Expr: metricOfferedVersion + productFilter(), Instant: true, Format: "table"})
+	rollout.panel("timeseries", "Downloads by version", "reqps", "Successful downloads, by component and version",
+		grafanaTarget{
+			Expr:         "sum by (component, version) (rate(" + metricDownloads + productFilter(`status=~"2.."`) + "[5m]))",
+			LegendFormat: "{{component}} {{version}}",
+		})
+	rollout.panel("timeseries", "Adoption by version", "percentunit",
+		"Each version's share of a component's successful downloads over the last day",
+		grafanaTarget{
+			Expr: "sum by (component, version) (increase(" + metricDownloads + productFilter(`status=~"2.."`) + "[1d]))" +
+				" / ignoring(version) group_left sum by (component) (increase(" + metricDownloads + productFilter(`status=~"2.."`) + "[1d]))",
+			LegendFormat: "{{component}} {{version}}",
+		})
+	rollout.panel("timeseries", "Downloads by platform", "reqps", "Successful downloads, by component and platform",
+		grafanaTarget{
+			Expr:         "sum by (component, platform) (rate(" + metricDownloads + productFilter(`status=~"2.."`) + "[5m]))",
+			LegendFormat: "{{component}} {{platform}}",
+		})
+
+	traffic := newDashboard("nametag-traffic", "Nametag traffic")
+	traffic.panel("timeseries", "Manifest requests", "reqps", "Manifest responses by channel and status; 304s are clients already up to date",
+		grafanaTarget{
+			Expr:         "sum by (channel, status) (rate(" + metricManifestRequests + productFilter() + "[5m]))",
+			LegendFormat: "{{channel}} {{status}}",
+		})
+	traffic.panel("timeseries", "Download egress", "Bps", "Bytes of assets sent",
+		grafanaTarget{
+			Expr:         "sum by (component) (rate(" + metricDownloadBytes + productFilter() + "[5m]))",
+			LegendFormat: "{{component}}",
+		})
+	traffic.panel("timeseries", "Failed downloads", "percentunit", "Share of download responses with an error status",
+		grafanaTarget{
+			Expr: "sum(rate(" + metricDownloads + productFilter(`status=~"[45].."`) + "[5m]))" +
+				" / sum(rate(" + metricDownloads + productFilter() + "[5m]))",
+			LegendFormat: "failed",
+		})
+	traffic.panel("timeseries", "Resumed downloads", "reqps", "Partial content responses, from clients resuming interrupted downloads",
+		grafanaTarget{
+			Expr:         "sum by (component) (rate(" + metricDownloads + productFilter(`status="206"`) + "[5m]))",
+			LegendFormat: "{{component}}",
+		})
+
+	return map[string]grafanaDashboard{
+		"rollout": rollout.dashboard,
+		"traffic": traffic.dashboard,
+	}
+}
+
+// handleDashboards serves the generated Grafana dashboards:
+//
+//	GET /v1/admin/dashboards                - their names, as a JSON list
+//	GET /v1/admin/dashboards/{name}.json    - one dashboard, for Grafana to import
+func (s *Server) handleDashboards(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireRole(w, r, roleReader) {
+		return
+	}
+
+	all := dashboards()
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/admin/dashboards"), "/")
+	if name == "" {
+		var names []string
+		for _, name := range slices.Sorted(maps.Keys(all)) {
+			names = append(names, name+".json")
+		}
+		writeJSON(w, names)
+		return
+	}
+
+	dashboard, ok := all[strings.TrimSuffix(name, ".json")]
+	if !ok || !strings.HasSuffix(name, ".json") {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, dashboard)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// dictionaryCache keeps the manifest dictionaries recently offered, so a
+// client polling with one gets the manifest compressed against it. A
+// dictionary is the manifest minus its timestamps, narrowed to what the
+// caller may see; callers seeing different components hold different ones.
+// The least recently used go first once there are more than capacity.
+type dictionaryCache struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*dictionaryEntry
+}
+
+type dictionaryEntry struct {
+	data []byte
+	used time.Time
+}
+
+func newDictionaryCache(capacity int) *dictionaryCache {
+	return &dictionaryCache{capacity: capacity, entries: make(map[[sha256.Size]byte]*dictionaryEntry)}
+}
+
+// add keeps dict and returns its ID
+func (c *dictionaryCache) add(dict []byte) string {
+	sum := sha256.Sum256(dict)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := c.entries[sum]; ok {
+		entry.used = now
+		return hex.EncodeToString(sum[:])
+	}
+	c.entries[sum] = &dictionaryEntry{data: dict, used: now}
+	for len(c.entries) > c.capacity {
+		var oldest [sha256.Size]byte
+		var oldestUsed time.Time
+		for key, entry := range c.entries {
+			if oldestUsed.IsZero() || entry.used.Before(oldestUsed) {
+				oldest, oldestUsed = key, entry.used
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the dictionary with SHA-256 sum, or nil
+func (c *dictionaryCache) get(sum [sha256.Size]byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[sum]
+	if !ok {
+		return nil
+	}
+	entry.used = time.Now()
+	return entry.data
+}
+
+// encode returns data compressed against the dictionary the client says it
+// holds, when the server still has it, and sets the response's headers to
+// match. The ETag becomes weak, as it names the content, not these bytes.
+func (c *dictionaryCache) encode(w http.ResponseWriter, r *http.Request, data []byte) []byte {
+	if !acceptsEncoding(r, update.EncodingDCZ) {
+		return data
+	}
+	sum, ok := update.ParseDictionaryHash(r.Header.Get(update.AvailableDictionaryHeader))
+	if !ok {
+		return data
+	}
+	dict := c.get(sum)
+	if dict == nil {
+		return data
+	}
+
+	compressed, err := update.CompressDCZ(data, dict)
+	if err != nil || len(compressed) >= len(data) {
+		return data
+	}
+	w.Header().Set("Content-Encoding", update.EncodingDCZ)
+	if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		w.Header().Set("ETag", "W/"+etag)
+	}
+	return compressed
+}
+
+// acceptsEncoding reports whether the request's Accept-Encoding lists
+// encoding with a non-zero weight
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for item := range strings.SplitSeq(value, ",") {
+			name, params, _ := strings.Cut(item, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+				continue
+			}
+			for param := range strings.SplitSeq(params, ";") {
+				key, value, _ := strings.Cut(param, "=")
+				if strings.TrimSpace(key) == "q" {
+					q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+					return err == nil && q > 0
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// handleManifestDictionary serves a manifest dictionary recently offered,
+// by its ID
+func (s *Server) handleManifestDictionary(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/manifest-dictionary/")
+	sum, err := hex.DecodeString(id)
+	if err != nil || len(sum) != sha256.Size {
+		http.Error(w, "Invalid dictionary ID", http.StatusBadRequest)
+		return
+	}
+	dict := s.dictionaries.get([sha256.Size]byte(sum))
+	if dict == nil {
+		http.Error(w, "Dictionary not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", manifestCacheControl(r))
+	w.Header().Set("Vary", "Accept-Encoding, Available-Dictionary")
+	w.Write(s.dictionaries.encode(w, r, dict))
+}
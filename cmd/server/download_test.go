@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// memStorage is a Storage kept in memory
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *memStorage) List(_ context.Context, prefix string) ([]storageObject, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var objects []storageObject
+	for name := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, m.object(name))
+		}
+	}
+	return objects, nil
+}
+
+func (m *memStorage) Stat(_ context.Context, name string) (storageObject, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[name]; !ok {
+		return storageObject{}, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return m.object(name), nil
+}
+
+func (m *memStorage) Open(_ context.Context, name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memStorage) Put(_ context.Context, name string, body io.Reader, _ int64) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[name] = data
+	return nil
+}
+
+func (m *memStorage) Delete(_ context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, name)
+	return nil
+}
+
+// object returns the metadata of a stored file. m.mu must be held.
+func (m *memStorage) object(name string) storageObject {
+	data := m.objects[name]
+	return storageObject{Name: name, Size: int64(len(data)), ModTime: time.Unix(0, 0), ETag: sha256Hex(data)}
+}
+
+func TestDownload(t *testing.T) {
+	// Three segments of an asset encrypted at rest, the last one short
+	data := bytes.Repeat([]byte("nametag 1.0.0\n"), 150<<10/14)
+	sum := sha256Hex(data)
+	etag := `"` + sum + `"`
+
+	backends := []struct {
+		name string
+		// setup publishes data as nametag 1.0.0 for linux-amd64
+		setup func(t *testing.T) http.Handler
+	}{
+		{"local", func(t *testing.T) http.Handler {
+			_, h := newTestServer(t)
+			if rec := upload(t, h, "1.0.0", data, ""); rec.Code != http.StatusCreated {
+				t.Fatalf("upload = %d: %s", rec.Code, rec.Body)
+			}
+			return h
+		}},
+		{"storage mirror", func(t *testing.T) http.Handler {
+			storage := &memStorage{objects: map[string][]byte{"nametag/1.0.0/nametag-linux-amd64": data}}
+			_, h := newTestServer(t, func(s *Server) {
+				mirror, err := newStorageMirror(storage, s.assetsDir, s.logger)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := mirror.pull(context.Background()); err != nil {
+					t.Fatalf("pull() = %v", err)
+				}
+				s.storage = mirror
+			})
+			return h
+		}},
+		{"encrypted at rest", func(t *testing.T) http.Handler {
+			keyPath := filepath.Join(t.TempDir(), "kek")
+			if err := os.WriteFile(keyPath, bytes.Repeat([]byte{7}, 32), 0600); err != nil {
+				t.Fatal(err)
+			}
+			wrapper, err := update.LoadKeyWrapper("file:" + keyPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, h := newTestServer(t, func(s *Server) { s.encryption = wrapper })
+			if rec := upload(t, h, "1.0.0", data, ""); rec.Code != http.StatusCreated {
+				t.Fatalf("upload = %d: %s", rec.Code, rec.Body)
+			}
+			stored, err := os.ReadFile(filepath.Join(s.assetsDir, "nametag", "1.0.0", "nametag-linux-amd64"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(stored, data[:64]) {
+				t.Fatal("asset stored in the clear")
+			}
+			return h
+		}},
+	}
+
+	// Across the boundary of the first two segments
+	first, last := int64(64<<10-10), int64(64<<10+9)
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		want   int
+		// body is the content served, nil for none
+		body []byte
+		// contentRange is the Content-Range header expected, if any
+		contentRange string
+	}{
+		{"GET", http.MethodGet, nil, http.StatusOK, data, ""},
+		{"HEAD", http.MethodHead, nil, http.StatusOK, nil, ""},
+		{"range", http.MethodGet, map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", first, last)}, http.StatusPartialContent, data[first : last+1], fmt.Sprintf("bytes %d-%d/%d", first, last, len(data))},
+		{"suffix range", http.MethodGet, map[string]string{"Range": "bytes=-5"}, http.StatusPartialContent, data[len(data)-5:], fmt.Sprintf("bytes %d-%d/%d", len(data)-5, len(data)-1, len(data))},
+		{"If-Range of the asset", http.MethodGet, map[string]string{"Range": "bytes=10-19", "If-Range": etag}, http.StatusPartialContent, data[10:20], fmt.Sprintf("bytes 10-19/%d", len(data))},
+		{"If-Range of another asset", http.MethodGet, map[string]string{"Range": "bytes=10-19", "If-Range": `"` + strings.Repeat("0", 64) + `"`}, http.StatusOK, data, ""},
+		{"range past the end", http.MethodGet, map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(data))}, http.StatusRequestedRangeNotSatisfiable, nil, fmt.Sprintf("bytes */%d", len(data))},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			h := backend.setup(t)
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					req := httptest.NewRequest(tt.method, "/v1/download/nametag/linux-amd64/1.0.0", nil)
+					for k, v := range tt.header {
+						req.Header.Set(k, v)
+					}
+					rec := serve(h, req, false)
+					if rec.Code != tt.want {
+						t.Fatalf("download = %d, want %d: %.100s", rec.Code, tt.want, rec.Body)
+					}
+					if got := rec.Header().Get(update.AssetSHA256Header); got != sum {
+						t.Errorf("%s = %q, want %s", update.AssetSHA256Header, got, sum)
+					}
+					if got := rec.Header().Get("Content-Range"); got != tt.contentRange {
+						t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+					}
+					// ServeContent drops the ETag from its error responses
+					if tt.want == http.StatusRequestedRangeNotSatisfiable {
+						return
+					}
+					if got := rec.Header().Get("ETag"); got != etag {
+						t.Errorf("ETag = %s, want %s", got, etag)
+					}
+					wantLength := len(data)
+					if tt.body != nil {
+						wantLength = len(tt.body)
+					}
+					if got := rec.Header().Get("Content-Length"); got != fmt.Sprint(wantLength) {
+						t.Errorf("Content-Length = %s, want %d", got, wantLength)
+					}
+					if tt.body == nil {
+						if rec.Body.Len() > 0 {
+							t.Errorf("%s response has a %d byte body", tt.method, rec.Body.Len())
+						}
+					} else if !bytes.Equal(rec.Body.Bytes(), tt.body) {
+						t.Errorf("served %d bytes, not the %d expected", rec.Body.Len(), len(tt.body))
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// egressWindow is how far back the egress rate is averaged, in seconds
+const egressWindow = 60
+
+// egressBudget paces rollouts: while downloads use more bandwidth than the
+// budget, manifests ask clients to defer non-critical updates, so the spike
+// after a release is spread out instead of saturating the link
+type egressBudget struct {
+	// limit is in bytes per second
+	limit float64
+	// deferFor is the average deferral; each manifest jitters it by half
+	// either way so deferred clients don't all return together
+	deferFor time.Duration
+	meter    egressMeter
+	over     atomic.Bool
+}
+
+// egressMeter counts bytes sent in one-second buckets over egressWindow
+type egressMeter struct {
+	mu      sync.Mutex
+	bytes   [egressWindow]int64
+	seconds [egressWindow]int64
+}
+
+func (m *egressMeter) add(n int64) {
+	now := time.Now().Unix()
+	i := now % egressWindow
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seconds[i] != now {
+		m.seconds[i] = now
+		m.bytes[i] = 0
+	}
+	m.bytes[i] += n
+}
+
+// rate returns the average bytes per second over egressWindow
+func (m *egressMeter) rate() float64 {
+	now := time.Now().Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int64
+	for i := range m.bytes {
+		if now-m.seconds[i] < egressWindow {
+			total += m.bytes[i]
+		}
+	}
+	return float64(total) / egressWindow
+}
+
+// meteredWriter counts the bytes written through it
+type meteredWriter struct {
+	http.ResponseWriter
+	meter *egressMeter
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.meter.add(int64(n))
+	return n, err
+}
+
+// meterEgress counts what is written to w against the egress budget
+func (s *Server) meterEgress(w http.ResponseWriter) http.ResponseWriter {
+	if s.egress == nil {
+		return w
+	}
+	return &meteredWriter{ResponseWriter: w, meter: &s.egress.meter}
+}
+
+// deferUpdates asks clients to hold off non-critical updates while egress is
+// over budget
+func (s *Server) deferUpdates(manifest *update.Manifest) {
+	if s.egress == nil {
+		return
+	}
+
+	rate := s.egress.meter.rate()
+	over := rate > s.egress.limit
+	if s.egress.over.Swap(over) != over {
+		s.logger.Warn("egress budget", "exceeded", over, "bytes_per_second", int64(rate))
+	}
+	if !over {
+		return
+	}
+
+	half := int64(s.egress.deferFor.Seconds() / 2)
+	deferSeconds := half + rand.Int64N(2*half+1)
+	for name, comp := range manifest.Components {
+		if comp.Critical {
+			continue
+		}
+		comp.DeferSeconds = deferSeconds
+		manifest.Components[name] = comp
+	}
+}
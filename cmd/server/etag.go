@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// manifestValidators returns the ETag and Last-Modified of a manifest about
+// to be served. Both ignore its generated and expires times, which change
+// with every response, so they stay put while its content does, but only
+// for half the manifest TTL: a copy revalidated with them then always has
+// half its lifetime left. Last-Modified is zero while updates are deferred,
+// which changes the content but no file.
+func (s *Server) manifestValidators(manifest *update.Manifest, modified time.Time) (string, time.Time, error) {
+	var window time.Time
+	if s.manifestTTL > 0 {
+		window = time.Now().Truncate(s.manifestTTL / 2)
+	}
+
+	content := *manifest
+	content.Generated, content.Expires = time.Time{}, time.Time{}
+	data, err := json.Marshal(&content)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	h := sha256.New()
+	h.Write(data)
+	h.Write([]byte(window.UTC().Format(time.RFC3339)))
+	etag := `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+
+	for _, comp := range manifest.Components {
+		if comp.DeferSeconds > 0 {
+			return etag, time.Time{}, nil
+		}
+	}
+	if window.After(modified) {
+		modified = window
+	}
+	return etag, modified.UTC().Truncate(time.Second), nil
+}
+
+// notModified reports whether the request's conditions show the client
+// already has the response with etag and lastModified. If-None-Match, when
+// sent, decides alone.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for tag := range strings.SplitSeq(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !lastModified.IsZero() && !lastModified.After(ims)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestManifestETag(t *testing.T) {
+	_, h := newTestServer(t)
+	if rec := upload(t, h, "1.0.0", []byte("nametag 1.0.0"), ""); rec.Code != http.StatusCreated {
+		t.Fatalf("upload = %d: %s", rec.Code, rec.Body)
+	}
+
+	get := func(header map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/v1/manifest.json", nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		return serve(h, req, false)
+	}
+
+	rec := get(nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("manifest = %d: %s", rec.Code, rec.Body)
+	}
+	etag, lastModified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("manifest served with ETag %q, Last-Modified %q", etag, lastModified)
+	}
+	if again := get(nil).Header().Get("ETag"); again != etag {
+		t.Errorf("ETag of the unchanged manifest = %s, then %s", etag, again)
+	}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"matching If-None-Match", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"weak match", map[string]string{"If-None-Match": "W/" + etag}, http.StatusNotModified},
+		{"match in a list", map[string]string{"If-None-Match": `"stale", ` + etag}, http.StatusNotModified},
+		{"wildcard", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"other ETag", map[string]string{"If-None-Match": `"stale"`}, http.StatusOK},
+		{"If-Modified-Since", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{"If-None-Match decides alone", map[string]string{"If-None-Match": `"stale"`, "If-Modified-Since": lastModified}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(tt.header)
+			if rec.Code != tt.want {
+				t.Fatalf("manifest = %d, want %d", rec.Code, tt.want)
+			}
+			if rec.Code == http.StatusNotModified && rec.Body.Len() > 0 {
+				t.Errorf("304 with a body: %s", rec.Body)
+			}
+			if got := rec.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag = %s, want %s", got, etag)
+			}
+		})
+	}
+
+	// A new release changes the manifest, so the old ETag no longer matches
+	if rec := upload(t, h, "1.1.0", []byte("nametag 1.1.0"), ""); rec.Code != http.StatusCreated {
+		t.Fatalf("upload = %d: %s", rec.Code, rec.Body)
+	}
+	rec = get(map[string]string{"If-None-Match": etag})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("changed manifest = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if changed := rec.Header().Get("ETag"); changed == "" || changed == etag {
+		t.Errorf("ETag of the changed manifest = %q, want other than %s", changed, etag)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// Files of the export directory. Downloads go to one file per UTC day;
+// releases.csv gains a row whenever a manifest first offers an asset, so
+// adoption can be measured from when each version went out.
+const (
+	exportReleasesFile   = "releases.csv"
+	exportDownloadPrefix = "downloads-"
+)
+
+var (
+	exportDownloadHeader = []string{"time", "product", "component", "platform", "version", "status", "bytes"}
+	exportReleaseHeader  = []string{"first_seen", "product", "channel", "component", "version", "platform", "size", "sha256", "critical"}
+)
+
+// exporter writes download records and release history as CSV files for
+// analysis elsewhere, e.g. loaded into BigQuery with bq load. It's shared by
+// the servers of all products.
+type exporter struct {
+	dir string
+
+	mu sync.Mutex
+	// day and downloads are the open downloads file
+	day       string
+	downloads *os.File
+	// released are the keys of the assets already in releases.csv
+	released map[string]bool
+}
+
+// newExporter opens the export directory, picking up the release history
+// already written there
+func newExporter(dir string) (*exporter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create export directory: %w", err)
+	}
+
+	e := &exporter{dir: dir, released: make(map[string]bool)}
+	file, err := os.Open(filepath.Join(dir, exportReleasesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read release history: %w", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("read release history: %w", err)
+	}
+	for _, record := range records[min(1, len(records)):] {
+		if len(record) == len(exportReleaseHeader) {
+			e.released[strings.Join(record[1:6], "/")] = true
+		}
+	}
+	return e, nil
+}
+
+// recordDownload appends a served download to the day's file
+func (e *exporter) recordDownload(product, comp, plat, version string, status int, bytes int64) error {
+	now := time.Now().UTC()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	day := now.Format(time.DateOnly)
+	if day != e.day {
+		if e.downloads != nil {
+			e.downloads.Close()
+			e.downloads = nil
+		}
+		file, err := openCSV(filepath.Join(e.dir, exportDownloadPrefix+day+".csv"), exportDownloadHeader)
+		if err != nil {
+			return err
+		}
+		e.day, e.downloads = day, file
+	}
+
+	return writeCSV(e.downloads, []string{
+		now.Format(time.RFC3339), product, comp, plat, version,
+		strconv.Itoa(status), strconv.FormatInt(bytes, 10),
+	})
+}
+
+// recordReleases appends the assets of manifest not in the release history
+// yet
+func (e *exporter) recordReleases(product, channel string, manifest *update.Manifest) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var rows [][]string
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, name := range slices.Sorted(maps.Keys(manifest.Components)) {
+		comp := manifest.Components[name]
+		if comp.Name != name {
+			// A former name of a renamed component, released under its own
+			continue
+		}
+		for _, plat := range slices.Sorted(maps.Keys(comp.Assets)) {
+			asset := comp.Assets[plat]
+			row := []string{now, product, channel, name, comp.Version, plat,
+				strconv.FormatInt(asset.Size, 10), asset.SHA256, strconv.FormatBool(comp.Critical)}
+			key := strings.Join(row[1:6], "/")
+			if e.released[key] {
+				continue
+			}
+			e.released[key] = true
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	file, err := openCSV(filepath.Join(e.dir, exportReleasesFile), exportReleaseHeader)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return writeCSV(file, rows...)
+}
+
+// openCSV opens a CSV file for appending, writing header if it's new
+func openCSV(path string, header []string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", filepath.Base(path), err)
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() == 0 {
+		err = writeCSV(file, header)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write %s: %w", filepath.Base(path), err)
+	}
+	return file, nil
+}
+
+// writeCSV writes rows with a single write, so concurrent readers never see
+// half a row
+func writeCSV(w io.Writer, rows ...[]string) error {
+	var b strings.Builder
+	cw := csv.NewWriter(&b)
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// runExportLoop records the releases the server's manifests offer every
+// interval
+func (s *Server) runExportLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		channels := append([]string{update.ChannelStable}, slices.Sorted(maps.Keys(s.channelKeys))...)
+		for _, channel := range channels {
+			generated, err := s.manifest(channel)
+			if err != nil {
+				s.logger.Error("failed to generate manifest for export", "channel", channel, "error", err)
+				continue
+			}
+			if err := s.export.recordReleases(s.product, channel, generated.manifest); err != nil {
+				s.logger.Error("failed to export releases", "channel", channel, "error", err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// countingWriter records the status and size of a response
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// handleExport serves the export directory:
+//
+//	GET /v1/admin/export/          - the files, as a JSON list
+//	GET /v1/admin/export/{file}    - one CSV file
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireRole(w, r, roleReader) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/admin/export/")
+	if name == "" {
+		entries, err := os.ReadDir(s.export.dir)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "failed to list export directory", "error", err)
+			http.Error(w, "Failed to list exports", http.StatusInternalServerError)
+			return
+		}
+		files := []string{}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".csv") {
+				files = append(files, entry.Name())
+			}
+		}
+		writeJSON(w, files)
+		return
+	}
+
+	if strings.ContainsAny(name, `/\`) || !strings.HasSuffix(name, ".csv") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, filepath.Join(s.export.dir, name))
+}
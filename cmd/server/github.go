@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/config"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// githubRelease is a release of the GitHub REST API
+type githubRelease struct {
+	TagName     string        `json:"tag_name"`
+	Body        string        `json:"body"`
+	Draft       bool          `json:"draft"`
+	Prerelease  bool          `json:"prerelease"`
+	PublishedAt time.Time     `json:"published_at"`
+	Assets      []githubAsset `json:"assets"`
+}
+
+// githubAsset is a file attached to a GitHub release
+type githubAsset struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// URL is the API URL, which serves the file to Accept:
+	// application/octet-stream, also of private repositories
+	URL string `json:"url"`
+	// DownloadURL is the public download link, only usable without
+	// credentials for public repositories
+	DownloadURL string `json:"browser_download_url"`
+	Size        int64  `json:"size"`
+	// Digest is "sha256:<hex>", on assets uploaded since GitHub started
+	// recording it
+	Digest string `json:"digest"`
+}
+
+// githubImporter backfills an assets directory from a repository's releases
+type githubImporter struct {
+	server *Server
+	client *http.Client
+	apiURL string
+	repo   string
+	token  string
+	// source names the release assets on GitHub
+	source *update.AssetNamer
+	// prereleaseChannel is the channel prereleases are published on; they
+	// are skipped when it's empty
+	prereleaseChannel string
+	force             bool
+	dryRun            bool
+	logger            *slog.Logger
+}
+
+// cmdImportGitHub imports the releases of a GitHub repository:
+//
+//	server import-github -repo org/app [-assets ./releases]
+func cmdImportGitHub(logger *slog.Logger) {
+	repo := flag.String("repo", "", "GitHub repository to import the releases of, as owner/name (required)")
+	assetsDir := flag.String("assets", "./releases", "Directory containing release binaries")
+	storageURL := flag.String("storage", "", "Object store the server keeps releases in, like its -storage; -assets is synced with it before and after the import")
+	assetTemplate := flag.String("asset-template", update.DefaultAssetTemplate, "Template for asset filenames within a version directory")
+	githubTemplate := flag.String("github-template", update.DefaultAssetTemplate, "Template the release assets on GitHub are named by, e.g. {{.Component}}_{{.Version}}_{{.OS}}_{{.Arch}}{{.Ext}}")
+	componentList := flag.String("components", strings.Join(components, ","), "Comma-separated components to import")
+	apiURL := flag.String("github-api", "https://api.github.com", "GitHub API URL, for GitHub Enterprise Server")
+	token := flag.String("github-token", "", "GitHub token, needed for private repositories (default: $GITHUB_TOKEN)")
+	prereleaseChannel := flag.String("prerelease-channel", "beta", "Channel to publish prereleases on (empty skips them)")
+	encryptionKey := flag.String("encryption-key", "", "Key encryption key for assets encrypted at rest: file:PATH or vault-transit:[MOUNT/]NAME")
+	force := flag.Bool("force", false, "Replace assets already published with different content (recorded in the audit log)")
+	dryRun := flag.Bool("dry-run", false, "List what would be imported without importing it")
+	timeout := flag.Duration("timeout", 10*time.Minute, "Timeout of each GitHub request, downloads included")
+	flag.Parse()
+
+	if err := config.Load(flag.CommandLine, config.ServerEnvPrefix, ""); err != nil {
+		logger.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+
+	if owner, name, ok := strings.Cut(*repo, "/"); !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		logger.Error("-repo must be owner/name", "repo", *repo)
+		os.Exit(1)
+	}
+	if *prereleaseChannel != "" {
+		if err := update.ValidateChannel(*prereleaseChannel); err != nil {
+			logger.Error("invalid prerelease channel", "error", err)
+			os.Exit(1)
+		}
+	}
+	if *token == "" {
+		*token = os.Getenv("GITHUB_TOKEN")
+	}
+
+	namer, err := update.NewAssetNamer(*assetTemplate)
+	if err != nil {
+		logger.Error("invalid asset template", "error", err)
+		os.Exit(1)
+	}
+	source, err := update.NewAssetNamer(*githubTemplate)
+	if err != nil {
+		logger.Error("invalid GitHub asset template", "error", err)
+		os.Exit(1)
+	}
+
+	server := &Server{
+		assetsDir:  *assetsDir,
+		namer:      namer,
+		components: strings.Split(*componentList, ","),
+		logger:     logger,
+	}
+	if *encryptionKey != "" {
+		server.encryption, err = update.LoadKeyWrapper(*encryptionKey)
+		if err != nil {
+			logger.Error("failed to load encryption key", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	var snapshot os.FileInfo
+	if *storageURL != "" {
+		server.storage, err = openStorageMirror(*storageURL, *assetsDir, logger)
+		if err != nil {
+			logger.Error("failed to open storage", "error", err)
+			os.Exit(1)
+		}
+		snapshot, _ = os.Stat(filepath.Join(*assetsDir, catalogSnapshot))
+		if _, err := server.storage.pull(context.Background()); err != nil {
+			logger.Error("failed to pull from storage", "error", err)
+			os.Exit(1)
+		}
+	}
+	if !*dryRun {
+		if err := server.openCatalog(context.Background()); err != nil {
+			logger.Error("failed to open release catalog", "error", err)
+			os.Exit(1)
+		}
+		defer server.catalog.Close()
+		// Imported releases are added to the catalog of the server storing
+		if server.storage != nil {
+			if _, err := server.restoreCatalog(context.Background(), snapshot); err != nil {
+				logger.Error("failed to restore release catalog from storage", "error", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	importer := &githubImporter{
+		server:            server,
+		client:            &http.Client{Timeout: *timeout},
+		apiURL:            strings.TrimSuffix(*apiURL, "/"),
+		repo:              *repo,
+		token:             *token,
+		source:            source,
+		prereleaseChannel: *prereleaseChannel,
+		force:             *force,
+		dryRun:            *dryRun,
+		logger:            logger,
+	}
+
+	releases, err := importer.releases(context.Background())
+	if err != nil {
+		logger.Error("failed to list releases", "repo", *repo, "error", err)
+		os.Exit(1)
+	}
+
+	// Oldest first, so the audit log reads in release order
+	slices.Reverse(releases)
+	imported, failed := 0, 0
+	for _, release := range releases {
+		n, err := importer.importRelease(context.Background(), release)
+		imported += n
+		if err != nil {
+			failed++
+			logger.Error("failed to import release", "tag", release.TagName, "error", err)
+		}
+	}
+
+	if server.storage != nil && !*dryRun {
+		if err := server.exportCatalog(context.Background()); err != nil {
+			logger.Error("failed to export release catalog", "error", err)
+			os.Exit(1)
+		}
+		if _, err := server.storage.push(context.Background()); err != nil {
+			logger.Error("failed to push to storage", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	logger.Info("import complete", "repo", *repo, "releases", len(releases), "assets", imported, "failed", failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// releases lists the repository's releases, following pagination
+func (g *githubImporter) releases(ctx context.Context) ([]githubRelease, error) {
+	var all []githubRelease
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/repos/%s/releases?per_page=100&page=%d", g.apiURL, g.repo, page)
+		resp, err := g.get(ctx, url, "application/vnd.github+json")
+		if err != nil {
+			return nil, err
+		}
+
+		var releases []githubRelease
+		err = json.NewDecoder(resp.Body).Decode(&releases)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decode releases: %w", err)
+		}
+		if len(releases) == 0 {
+			return all, nil
+		}
+		all = append(all, releases...)
+	}
+}
+
+// importRelease publishes the assets of a release's components and its
+// notes, returning how many assets it published
+func (g *githubImporter) importRelease(ctx context.Context, release githubRelease) (int, error) {
+	if release.Draft {
+		return 0, nil
+	}
+	if release.Prerelease && g.prereleaseChannel == "" {
+		g.logger.Info("skipping prerelease", "tag", release.TagName)
+		return 0, nil
+	}
+	version := strings.TrimPrefix(release.TagName, "v")
+	if _, err := update.ParseVersion(version); err != nil {
+		g.logger.Warn("skipping release without a version tag", "tag", release.TagName)
+		return 0, nil
+	}
+
+	byName := make(map[string]githubAsset, len(release.Assets))
+	for _, asset := range release.Assets {
+		byName[asset.Name] = asset
+	}
+
+	imported := 0
+	var errs []error
+	for _, comp := range g.server.components {
+		dir := filepath.Join(g.server.assetsDir, comp, version)
+		found := false
+		for _, plat := range platforms {
+			name, err := g.source.Name(comp, version, plat)
+			if err != nil {
+				return imported, err
+			}
+			asset, ok := byName[name]
+			if !ok {
+				continue
+			}
+			found = true
+
+			published, err := g.importAsset(ctx, comp, plat, version, release, asset, byName[name+update.MinisignExtension])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			if published {
+				imported++
+			}
+		}
+		if !found || g.dryRun {
+			continue
+		}
+
+		if err := g.writeMetadata(dir, release); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return imported, errors.Join(errs...)
+}
+
+// importAsset downloads a release asset and publishes it, with its minisign
+// signature when the release has one, in the catalog as of when it was
+// released on GitHub. It reports whether it published anything: an asset
+// already published with the same content is skipped.
+func (g *githubImporter) importAsset(ctx context.Context, comp, plat, version string, release githubRelease, asset, signature githubAsset) (bool, error) {
+	s := g.server
+	filename, err := s.namer.Name(comp, version, plat)
+	if err != nil {
+		return false, err
+	}
+	compDir := filepath.Join(s.assetsDir, comp)
+	dir := filepath.Join(compDir, version)
+
+	previous, err := s.publishedHash(dir, filename)
+	if err != nil {
+		return false, fmt.Errorf("check published asset: %w", err)
+	}
+	expected, _ := strings.CutPrefix(asset.Digest, "sha256:")
+	if previous != "" && previous == expected {
+		g.logger.Info("asset already published", "component", comp, "platform", plat, "version", version)
+		return false, nil
+	}
+	if g.dryRun {
+		g.logger.Info("would import asset", "component", comp, "platform", plat, "version", version, "from", asset.Name, "size", asset.Size)
+		return false, nil
+	}
+
+	if err := os.MkdirAll(compDir, 0755); err != nil {
+		return false, fmt.Errorf("create component directory: %w", err)
+	}
+	tmp, hash, err := g.download(ctx, asset, compDir)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+
+	switch {
+	case previous == hash:
+		g.logger.Info("asset already published", "component", comp, "platform", plat, "version", version)
+		return false, nil
+	case previous != "" && !g.force:
+		return false, fmt.Errorf("already published with different content (%s, GitHub has %s); pass -force to replace it", previous, hash)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, fmt.Errorf("create release directory: %w", err)
+	}
+	// A republished asset's old signature must not outlive it
+	dest := filepath.Join(dir, filename)
+	if err := s.removeAsset(ctx, dest+update.MinisignExtension); err != nil {
+		return false, fmt.Errorf("remove stale signature: %w", err)
+	}
+	if err := s.placeUpload(ctx, tmp, asset.Size, dest); err != nil {
+		return false, err
+	}
+	if err := update.RecordChecksum(dir, filename, hash); err != nil {
+		return false, err
+	}
+	if signature.URL != "" {
+		sig, err := g.fetch(ctx, signature)
+		if err != nil {
+			return false, fmt.Errorf("download signature: %w", err)
+		}
+		if err := writeUploadSignature(dest, sig); err != nil {
+			return false, err
+		}
+	}
+	channel := update.ChannelStable
+	if release.Prerelease {
+		channel = g.prereleaseChannel
+	}
+	if err := s.publishAsset(ctx, comp, plat, version, channel, release.PublishedAt, asset.Size, hash); err != nil {
+		return false, err
+	}
+
+	entry := update.AuditEntry{
+		Action:         update.AuditPublish,
+		Actor:          "github:" + g.repo,
+		Component:      comp,
+		Version:        version,
+		File:           filename,
+		SHA256:         hash,
+		PreviousSHA256: previous,
+	}
+	if previous != "" {
+		entry.Action = update.AuditRepublish
+	}
+	if err := update.AppendAuditLog(s.assetsDir, entry); err != nil {
+		return false, fmt.Errorf("write audit log: %w", err)
+	}
+
+	g.logger.Info("imported asset",
+		"component", comp,
+		"platform", plat,
+		"version", version,
+		"sha256", hash,
+		"signed", signature.URL != "",
+		"republished", previous != "",
+	)
+	return true, nil
+}
+
+// download streams a release asset into a temp file in dir, checking it
+// against the size and digest GitHub lists, and returns the file and its
+// SHA-256. On error the file is already gone.
+func (g *githubImporter) download(ctx context.Context, asset githubAsset, dir string) (string, string, error) {
+	resp, err := g.get(ctx, asset.URL, "application/octet-stream")
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return "", "", fmt.Errorf("create temp file: %w", err)
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", fmt.Errorf("download %s: %w", asset.Name, err)
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	expected, _ := strings.CutPrefix(asset.Digest, "sha256:")
+	switch {
+	case size != asset.Size:
+		err = fmt.Errorf("downloaded %d bytes of %s, GitHub lists %d", size, asset.Name, asset.Size)
+	case expected != "" && !strings.EqualFold(hash, expected):
+		err = fmt.Errorf("%w: got %s, GitHub lists %s", errChecksumMismatch, hash, expected)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	return tmp.Name(), hash, nil
+}
+
+// fetch reads a small release asset, such as a signature
+func (g *githubImporter) fetch(ctx context.Context, asset githubAsset) ([]byte, error) {
+	resp, err := g.get(ctx, asset.URL, "application/octet-stream")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
+
+// writeMetadata backfills the release notes the server reads from a version
+// directory besides its assets. Notes already there are kept.
+func (g *githubImporter) writeMetadata(dir string, release githubRelease) error {
+	if _, err := os.Stat(dir); err != nil {
+		// Nothing of the component was published
+		return nil
+	}
+
+	notes := strings.TrimSpace(release.Body)
+	if notes == "" {
+		return nil
+	}
+	path := filepath.Join(dir, update.ChangelogFile)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(notes+"\n"), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", update.ChangelogFile, err)
+	}
+	return nil
+}
+
+// get sends an authenticated GET to the GitHub API. Redirects to other
+// hosts, where downloads are served from, don't carry the token.
+func (g *githubImporter) get(ctx context.Context, url, accept string) (*http.Response, error) {
+	return g.getRange(ctx, url, accept, "")
+}
+
+// getRange is get for part of a file when byteRange, a Range header, is set
+func (g *githubImporter) getRange(ctx context.Context, url, accept, byteRange string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && (byteRange == "" || resp.StatusCode != http.StatusPartialContent) {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
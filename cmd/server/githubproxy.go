@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// githubProxy serves a GitHub repository's releases as the server's own, for
+// projects already publishing there. Release metadata is refetched at most
+// every ttl; downloads are redirected to GitHub or relayed through the server.
+type githubProxy struct {
+	// api lists releases and fetches assets, as import-github does
+	api *githubImporter
+	ttl time.Duration
+	// redirect sends clients to GitHub's download links instead of relaying
+	redirect bool
+
+	mu       sync.Mutex
+	releases []githubRelease
+	fetched  time.Time
+
+	digestMu sync.Mutex
+	// digests are the SHA-256s of assets GitHub records none for, by ID
+	digests map[int64]string
+}
+
+func newGitHubProxy(repo, apiURL, token, template, prereleaseChannel, downloads string, ttl time.Duration, server *Server, logger *slog.Logger) (*githubProxy, error) {
+	if owner, name, ok := strings.Cut(repo, "/"); !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("repository must be owner/name, not %q", repo)
+	}
+	if prereleaseChannel != "" {
+		if err := update.ValidateChannel(prereleaseChannel); err != nil {
+			return nil, err
+		}
+	}
+	if downloads != "proxy" && downloads != "redirect" {
+		return nil, fmt.Errorf("invalid downloads %q (want proxy or redirect)", downloads)
+	}
+	source, err := update.NewAssetNamer(template)
+	if err != nil {
+		return nil, err
+	}
+
+	return &githubProxy{
+		api: &githubImporter{
+			server:            server,
+			client:            &http.Client{Timeout: cacheFetchTimeout},
+			apiURL:            strings.TrimSuffix(apiURL, "/"),
+			repo:              repo,
+			token:             token,
+			source:            source,
+			prereleaseChannel: prereleaseChannel,
+			logger:            logger,
+		},
+		ttl:      ttl,
+		redirect: downloads == "redirect",
+		digests:  make(map[int64]string),
+	}, nil
+}
+
+// githubFetchTimeout bounds listing the releases, which requests wait on
+const githubFetchTimeout = 30 * time.Second
+
+// current returns the repository's releases, refetching them once they're
+// older than ttl. When GitHub fails, the last list is served.
+func (g *githubProxy) current(ctx context.Context) ([]githubRelease, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.fetched.IsZero() || time.Since(g.fetched) >= g.ttl {
+		ctx, cancel := context.WithTimeout(ctx, githubFetchTimeout)
+		defer cancel()
+
+		releases, err := g.api.releases(ctx)
+		switch {
+		case err == nil:
+			g.releases, g.fetched = releases, time.Now()
+		case g.fetched.IsZero():
+			return nil, err
+		default:
+			g.api.logger.Warn("GitHub releases unavailable, serving cached list", "error", err, "fetched", g.fetched)
+		}
+	}
+	return g.releases, nil
+}
+
+// offered returns the newest release on channel with assets of comp, and
+// its version. Prereleases are published on the prerelease channel.
+func (g *githubProxy) offered(releases []githubRelease, comp, channel string) (*githubRelease, string, error) {
+	var (
+		latest    *githubRelease
+		latestVer update.Version
+		version   string
+	)
+	for i := range releases {
+		release := &releases[i]
+		if release.Draft {
+			continue
+		}
+		published := update.ChannelStable
+		if release.Prerelease {
+			published = g.api.prereleaseChannel
+		}
+		if published != channel {
+			continue
+		}
+		tagVersion := strings.TrimPrefix(release.TagName, "v")
+		v, err := update.ParseVersion(tagVersion)
+		if err != nil || (latest != nil && !latestVer.LessThan(v)) {
+			continue
+		}
+
+		has, err := g.hasComponent(release, comp, tagVersion)
+		if err != nil {
+			return nil, "", err
+		}
+		if has {
+			latest, latestVer, version = release, v, tagVersion
+		}
+	}
+	return latest, version, nil
+}
+
+func (g *githubProxy) hasComponent(release *githubRelease, comp, version string) (bool, error) {
+	for _, plat := range platforms {
+		name, err := g.api.source.Name(comp, version, plat)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := findGitHubAsset(release, name); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// find returns the asset of a component version for a platform, with the
+// release it belongs to
+func (g *githubProxy) find(ctx context.Context, comp, plat, version string) (githubAsset, *githubRelease, bool, error) {
+	releases, err := g.current(ctx)
+	if err != nil {
+		return githubAsset{}, nil, false, err
+	}
+	name, err := g.api.source.Name(comp, version, plat)
+	if err != nil {
+		return githubAsset{}, nil, false, err
+	}
+	for i := range releases {
+		release := &releases[i]
+		if release.Draft || strings.TrimPrefix(release.TagName, "v") != version {
+			continue
+		}
+		if asset, ok := findGitHubAsset(release, name); ok {
+			return asset, release, true, nil
+		}
+	}
+	return githubAsset{}, nil, false, nil
+}
+
+func findGitHubAsset(release *githubRelease, name string) (githubAsset, bool) {
+	for _, asset := range release.Assets {
+		if asset.Name == name {
+			return asset, true
+		}
+	}
+	return githubAsset{}, false
+}
+
+// sha256 returns an asset's SHA-256: GitHub's record of it, or else hashed
+// from a download once and remembered
+func (g *githubProxy) sha256(ctx context.Context, asset githubAsset) (string, error) {
+	if digest, ok := strings.CutPrefix(asset.Digest, "sha256:"); ok {
+		return strings.ToLower(digest), nil
+	}
+
+	g.digestMu.Lock()
+	defer g.digestMu.Unlock()
+	if digest, ok := g.digests[asset.ID]; ok {
+		return digest, nil
+	}
+
+	g.api.logger.Info("hashing GitHub asset without a recorded digest", "asset", asset.Name, "size", asset.Size)
+	resp, err := g.api.get(ctx, asset.URL, "application/octet-stream")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("download %s: %w", asset.Name, err)
+	}
+	if size != asset.Size {
+		return "", fmt.Errorf("downloaded %d bytes of %s, GitHub lists %d", size, asset.Name, asset.Size)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	g.digests[asset.ID] = digest
+	return digest, nil
+}
+
+// githubManifest builds channel's manifest from the repository's releases,
+// and returns when the newest offered release was published
+func (s *Server) githubManifest(ctx context.Context, channel string) (*update.Manifest, time.Time, error) {
+	releases, err := s.github.current(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	manifest := &update.Manifest{
+		SchemaVersion: update.SchemaVersion,
+		Generated:     time.Now().UTC(),
+		Components:    make(map[string]update.Component),
+	}
+	if channel != update.ChannelStable {
+		manifest.Channel = channel
+	}
+	if s.manifestTTL > 0 {
+		manifest.Expires = manifest.Generated.Add(s.manifestTTL)
+	}
+	if s.nextCheck > 0 {
+		manifest.NextCheckAfter = int64(s.nextCheck.Seconds())
+	}
+
+	var modified time.Time
+	for _, comp := range s.components {
+		release, version, err := s.github.offered(releases, comp, channel)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if release == nil {
+			continue
+		}
+
+		component := update.Component{
+			Name:        comp,
+			Version:     version,
+			ReleaseDate: release.PublishedAt,
+			Changelog:   strings.TrimSpace(release.Body),
+			Assets:      make(map[string]update.Asset),
+		}
+		for _, plat := range platforms {
+			name, err := s.github.api.source.Name(comp, version, plat)
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			ghAsset, ok := findGitHubAsset(release, name)
+			if !ok {
+				continue
+			}
+			hash, err := s.github.sha256(ctx, ghAsset)
+			if err != nil {
+				s.logger.Warn("failed to hash GitHub asset", "asset", name, "error", err)
+				continue
+			}
+
+			asset := update.Asset{
+				URL:    s.path(update.AssetURL(comp, plat, version)),
+				Size:   ghAsset.Size,
+				SHA256: hash,
+				Format: update.ArchiveFormat(name),
+			}
+			if _, ok := findGitHubAsset(release, name+update.MinisignExtension); ok {
+				asset.SignatureURL = s.path(update.SignatureURL(comp, plat, version))
+			}
+			component.Assets[plat] = asset
+		}
+
+		if len(component.Assets) > 0 {
+			manifest.Components[comp] = component
+			if release.PublishedAt.After(modified) {
+				modified = release.PublishedAt
+			}
+		}
+	}
+	return manifest, modified, nil
+}
+
+// handleGitHubManifest serves the manifest built from GitHub releases,
+// signed like a generated one
+func (s *Server) handleGitHubManifest(w http.ResponseWriter, r *http.Request) {
+	channel := update.NormalizeChannel(r.URL.Query().Get("channel"))
+	s.logger.InfoContext(r.Context(), "manifest requested", "channel", channel)
+
+	keys, ok := s.manifestKeys(channel)
+	if err := update.ValidateChannel(channel); err != nil || !ok {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	}
+
+	manifest, modified, err := s.githubManifest(r.Context(), channel)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to build manifest from GitHub releases", "error", err)
+		http.Error(w, "GitHub unavailable", http.StatusBadGateway)
+		return
+	}
+	s.writeManifest(w, r, channel, keys, manifest, modified)
+}
+
+// resolveGitHubAsset looks up the GitHub asset a request path names, with
+// the release it belongs to
+func (s *Server) resolveGitHubAsset(w http.ResponseWriter, r *http.Request, prefix, msg string) (githubAsset, *githubRelease, bool) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if len(parts) != 3 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return githubAsset{}, nil, false
+	}
+	component, platform, version := parts[0], parts[1], parts[2]
+	s.logger.InfoContext(r.Context(), msg,
+		"component", component,
+		"platform", platform,
+		"version", version,
+	)
+
+	if !s.isValidComponent(component) || !isValidPlatform(platform) {
+		http.Error(w, "Invalid component or platform", http.StatusBadRequest)
+		return githubAsset{}, nil, false
+	}
+	if _, err := update.ParseVersion(version); err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return githubAsset{}, nil, false
+	}
+
+	asset, release, ok, err := s.github.find(r.Context(), component, platform, version)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to look up GitHub asset", "error", err)
+		http.Error(w, "GitHub unavailable", http.StatusBadGateway)
+		return githubAsset{}, nil, false
+	}
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return githubAsset{}, nil, false
+	}
+	return asset, release, true
+}
+
+// handleGitHubDownload redirects a download to GitHub, or relays it,
+// passing Range through so interrupted downloads resume
+func (s *Server) handleGitHubDownload(w http.ResponseWriter, r *http.Request) {
+	asset, _, ok := s.resolveGitHubAsset(w, r, "/v1/download/", "download requested")
+	if !ok {
+		return
+	}
+
+	cw := &countingWriter{ResponseWriter: s.meterEgress(w)}
+	defer func() {
+		if r.Method == http.MethodHead {
+			return
+		}
+		s.downloadFinished(r, cw.status, cw.bytes)
+	}()
+
+	if s.github.redirect {
+		// Counted without the redirect's body, which is no asset egress
+		http.Redirect(w, r, asset.DownloadURL, http.StatusFound)
+		cw.status = http.StatusFound
+		return
+	}
+
+	hash, err := s.github.sha256(r.Context(), asset)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to hash GitHub asset", "asset", asset.Name, "error", err)
+		http.Error(cw, "GitHub unavailable", http.StatusBadGateway)
+		return
+	}
+	setAssetHeaders(cw, hash)
+	s.issueResumeToken(cw, r)
+	cw.Header().Set("Accept-Ranges", "bytes")
+	cw.Header().Set("Content-Type", "application/octet-stream")
+	if r.Method == http.MethodHead {
+		cw.Header().Set("Content-Length", strconv.FormatInt(asset.Size, 10))
+		return
+	}
+
+	// A range of another asset than the client started on would corrupt
+	// its download; the whole asset is sent instead
+	byteRange := r.Header.Get("Range")
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != `"`+hash+`"` {
+		byteRange = ""
+	}
+	resp, err := s.github.api.getRange(r.Context(), asset.URL, "application/octet-stream", byteRange)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to fetch GitHub asset", "asset", asset.Name, "error", err)
+		http.Error(cw, "GitHub unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, header := range []string{"Content-Length", "Content-Range"} {
+		if v := resp.Header.Get(header); v != "" {
+			cw.Header().Set(header, v)
+		}
+	}
+	cw.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(cw, resp.Body); err != nil {
+		s.logger.WarnContext(r.Context(), "GitHub download interrupted", "asset", asset.Name, "error", err)
+	}
+}
+
+// handleGitHubSignature relays the .minisig published next to an asset on
+// GitHub
+func (s *Server) handleGitHubSignature(w http.ResponseWriter, r *http.Request) {
+	asset, release, ok := s.resolveGitHubAsset(w, r, "/v1/signature/", "signature requested")
+	if !ok {
+		return
+	}
+	sig, ok := findGitHubAsset(release, asset.Name+update.MinisignExtension)
+	if !ok {
+		http.Error(w, "Signature not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := s.github.api.fetch(r.Context(), sig)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to fetch GitHub signature", "asset", sig.Name, "error", err)
+		http.Error(w, "GitHub unavailable", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
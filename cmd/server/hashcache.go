@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// hashCacheFile keeps the digests of stored assets at the root of the
+// assets directory
+const hashCacheFile = ".hashes.json"
+
+// hashEntry is an asset's digests, valid while the stored file keeps the
+// size and modification time it had when hashed
+type hashEntry struct {
+	StoredSize int64     `json:"stored_size"`
+	ModTime    time.Time `json:"mod_time"`
+	// Size is the plaintext's, which differs for assets encrypted at rest
+	Size    int64             `json:"size"`
+	Digests map[string]string `json:"digests"`
+}
+
+// hashCache spares re-reading multi-hundred-MB assets after a restart or a
+// manifest cache miss: an asset is only hashed again once its size or
+// modification time changes. Corruption that changes neither goes unseen
+// here, which is what the integrity audit, never served from the cache, is
+// for.
+type hashCache struct {
+	assetsDir string
+	logger    *slog.Logger
+
+	mu      sync.Mutex
+	entries map[string]hashEntry
+}
+
+// loadHashCache reads the cache of assetsDir, dropping entries of assets
+// that are gone. A missing or unreadable cache starts empty.
+func loadHashCache(assetsDir string, logger *slog.Logger) *hashCache {
+	c := &hashCache{assetsDir: assetsDir, logger: logger, entries: make(map[string]hashEntry)}
+
+	data, err := os.ReadFile(filepath.Join(assetsDir, hashCacheFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("failed to read hash cache", "error", err)
+		}
+		return c
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		logger.Warn("ignoring corrupt hash cache", "error", err)
+		c.entries = make(map[string]hashEntry)
+		return c
+	}
+
+	pruned := false
+	for name := range c.entries {
+		if _, err := os.Stat(filepath.Join(assetsDir, name)); errors.Is(err, os.ErrNotExist) {
+			delete(c.entries, name)
+			pruned = true
+		}
+	}
+	if pruned {
+		c.save()
+	}
+	return c
+}
+
+// digests returns the asset's size and digests from the cache, computing
+// and recording them with hash when they're missing or stale
+func (c *hashCache) digests(path string, algorithms []string, hash func() (int64, map[string]string, error)) (int64, map[string]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	name, err := filepath.Rel(c.assetsDir, path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	c.mu.Unlock()
+	if ok && entry.StoredSize == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		if digests, ok := pickDigests(entry.Digests, algorithms); ok {
+			return entry.Size, digests, nil
+		}
+	}
+
+	size, digests, err := hash()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[name] = hashEntry{StoredSize: info.Size(), ModTime: info.ModTime(), Size: size, Digests: digests}
+	c.save()
+	return size, digests, nil
+}
+
+// pickDigests returns the digests of algorithms, if all were recorded
+func pickDigests(digests map[string]string, algorithms []string) (map[string]string, bool) {
+	picked := make(map[string]string, len(algorithms))
+	for _, algorithm := range algorithms {
+		if digests[algorithm] == "" {
+			return nil, false
+		}
+		picked[algorithm] = digests[algorithm]
+	}
+	return picked, true
+}
+
+// save writes the cache; it is only an optimization, so failing to is
+// logged and the cache carries on in memory. Called with mu held.
+func (c *hashCache) save() {
+	if err := c.write(); err != nil {
+		c.logger.Warn("failed to write hash cache", "error", err)
+	}
+}
+
+func (c *hashCache) write() error {
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return fmt.Errorf("encode hash cache: %w", err)
+	}
+
+	path := filepath.Join(c.assetsDir, hashCacheFile)
+	tmp, err := os.CreateTemp(c.assetsDir, ".hashes-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write hash cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close hash cache: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename hash cache: %w", err)
+	}
+	return nil
+}
+
+// cachedDigests is assetDigests, served from the hash cache when the server
+// keeps one
+func (s *Server) cachedDigests(path string, algorithms ...string) (int64, map[string]string, error) {
+	if s.hashes == nil {
+		return s.assetDigests(path, algorithms...)
+	}
+	return s.hashes.digests(path, algorithms, func() (int64, map[string]string, error) {
+		return s.assetDigests(path, algorithms...)
+	})
+}
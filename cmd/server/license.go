@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// licenseFile lists the licenses whose tokens clients exchange for the
+// content keys of private assets. Tokens are stored as SHA-256 hashes so the
+// file grants nothing if it leaks.
+type licenseFile struct {
+	Licenses []license `json:"licenses"`
+}
+
+type license struct {
+	// Name identifies the licensee in logs
+	Name        string `json:"name"`
+	TokenSHA256 string `json:"token_sha256"`
+	// Keys are the IDs of the content keys the license entitles to
+	Keys    []string  `json:"keys"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// licenseStore hands out content keys to licensed clients. The license file
+// is re-read on every exchange so licenses can be granted and revoked
+// without a restart.
+type licenseStore struct {
+	path string
+	keys map[string][]byte
+}
+
+// newLicenseStore loads the content keys (*.key) from keysDir and checks the
+// license file at path
+func newLicenseStore(keysDir, path string) (*licenseStore, error) {
+	files, err := filepath.Glob(filepath.Join(keysDir, "*.key"))
+	if err != nil {
+		return nil, fmt.Errorf("list content keys: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no content keys (*.key) in %s", keysDir)
+	}
+
+	store := &licenseStore{path: path, keys: make(map[string][]byte)}
+	for _, file := range files {
+		id, key, err := update.LoadContentKey(file)
+		if err != nil {
+			return nil, err
+		}
+		store.keys[id] = key
+	}
+
+	if _, err := store.read(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (l *licenseStore) read() (*licenseFile, error) {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return nil, fmt.Errorf("read licenses: %w", err)
+	}
+
+	var file licenseFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("decode licenses %s: %w", l.path, err)
+	}
+	return &file, nil
+}
+
+// lookup returns the license with token, or nil if there is none
+func (l *licenseStore) lookup(token string) (*license, error) {
+	file, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	for i, lic := range file.Licenses {
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(lic.TokenSHA256)), []byte(hash)) == 1 {
+			return &file.Licenses[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// handleLicenseKeys serves GET /v1/license/keys, exchanging the bearer
+// license token for the content keys it entitles to
+func (s *Server) handleLicenseKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="nametag-license"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	lic, err := s.licenses.lookup(token)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to look up license", "error", err)
+		http.Error(w, "Failed to read licenses", http.StatusInternalServerError)
+		return
+	}
+	if lic == nil {
+		s.logger.WarnContext(r.Context(), "unknown license token")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="nametag-license"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !lic.Expires.IsZero() && time.Now().After(lic.Expires) {
+		s.logger.WarnContext(r.Context(), "expired license", "license", lic.Name, "expired", lic.Expires)
+		http.Error(w, "License expired", http.StatusForbidden)
+		return
+	}
+
+	resp := update.LicenseKeys{Keys: make(map[string]string)}
+	for _, id := range lic.Keys {
+		if key, ok := s.licenses.keys[id]; ok {
+			resp.Keys[id] = base64.StdEncoding.EncodeToString(key)
+		}
+	}
+
+	s.logger.InfoContext(r.Context(), "content keys issued", "license", lic.Name, "keys", len(resp.Keys))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
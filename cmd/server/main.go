@@ -1,19 +1,30 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/1995parham-learning/auto-update-binary/buildinfo"
+	"github.com/1995parham-learning/auto-update-binary/internal/catalog"
+	"github.com/1995parham-learning/auto-update-binary/internal/config"
 	"github.com/1995parham-learning/auto-update-binary/internal/update"
 )
 
@@ -22,45 +33,718 @@ var (
 )
 
 func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	}))
+	logger, _ := newLogger(os.Stderr, "info", "text")
+
+	if len(os.Args) > 1 && os.Args[1] == "import-github" {
+		os.Args = os.Args[1:] // Shift args for subcommand flags
+		flag.CommandLine = flag.NewFlagSet("import-github", flag.ExitOnError)
+		cmdImportGitHub(logger)
+		return
+	}
 
 	addr := flag.String("addr", ":8080", "Server address")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 10*time.Second, "How long a client may take to send a request's headers")
+	readTimeout := flag.Duration("read-timeout", 15*time.Minute, "How long a client may take to send a whole request, uploads included (0 means no limit)")
+	writeTimeout := flag.Duration("write-timeout", time.Hour, "How long a response may take to send, downloads included; cut-off downloads resume where they stopped (0 means no limit)")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "How long to keep an idle keep-alive connection open")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Minute, "How long to let in-flight requests finish after SIGINT or SIGTERM before cutting them off")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate to serve HTTPS with (requires -tls-key)")
+	tlsKey := flag.String("tls-key", "", "PEM private key for -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "Require client certificates issued by a CA in this PEM bundle (mutual TLS)")
+	acmeHosts := flag.String("acme-hosts", "", "Comma-separated host names to serve HTTPS for with certificates from an ACME CA such as Let's Encrypt; handshakes for other names are refused (-addr must be reachable on port 443)")
+	acmeCacheDir := flag.String("acme-cache-dir", "", "Directory keeping the ACME account key and certificates across restarts (required with -acme-hosts)")
+	acmeEmail := flag.String("acme-email", "", "Contact address registered with the ACME CA for expiry and problem notices")
+	acmeDirectory := flag.String("acme-directory", letsEncryptURL, "ACME directory URL of the CA, e.g. Let's Encrypt's staging directory for testing")
+	logLevel := flag.String("log-level", "info", "Least severe level logged: debug, info, warn, or error")
+	logFormat := flag.String("log-format", "text", "Log format: text, or json for log shippers")
 	assetsDir := flag.String("assets", "./releases", "Directory containing release binaries")
+	componentList := flag.String("components", strings.Join(components, ","), "Comma-separated components served from -assets")
+	platformList := flag.String("platforms", strings.Join(platforms, ","), "Comma-separated platforms (os-arch) releases are published for")
+	storageURL := flag.String("storage", "", "Object store to keep releases in, as s3://bucket/prefix or gs://bucket/prefix (options: ?endpoint=URL&region=&path-style=); -assets becomes its local copy")
+	storageSync := flag.Duration("storage-sync", time.Minute, "How often to fetch changes from -storage")
+	cdnURL := flag.String("cdn-url", "", "Redirect downloads to this CDN base URL, which mirrors the assets directory, instead of serving them")
+	cdnSigningKey := flag.String("cdn-signing-key", "", "File with the HMAC key signing -cdn-url redirects, for CDNs that only serve signed URLs")
+	cdnURLTTL := flag.Duration("cdn-url-ttl", 15*time.Minute, "How long a signed -cdn-url redirect stays valid")
+	assetTemplate := flag.String("asset-template", update.DefaultAssetTemplate, "Template for asset filenames within a version directory")
+	tufDir := flag.String("tuf-dir", "", "Directory with TUF root.json and online role keys; enables /v1/tuf/")
+	signingKey := flag.String("signing-key", "", "PEM-encoded Ed25519 private key used to sign the manifest, or a comma-separated list of them")
+	channelSigningKey := flag.String("channel-signing-key", "", "Comma-separated CHANNEL=PATH pairs of PEM Ed25519 keys that sign the manifests and assets of release channels other than stable; list a channel again for more keys")
+	manifestFile := flag.String("manifest-file", "", "Serve this manifest, signed offline by nametag-sign, as is instead of generating one; its signatures are read from the .sig file next to it")
+	transparencyLog := flag.String("transparency-log", "", "File of the append-only log of published assets; enables /v1/log/ checkpoints and proofs")
+	keysDir := flag.String("keys-dir", "", "Directory of signed key rotation documents ({version}.json, and {channel}/{version}.json for other channels); enables /v1/keys/")
+	hashes := flag.String("hashes", "sha512,blake3", "Comma-separated digests (sha512, blake3) published for each asset besides sha256")
+	manifestTTL := flag.Duration("manifest-ttl", 24*time.Hour, "How long clients accept a served manifest (0 never expires, only for unsigned manifests)")
+	hashCache := flag.Bool("hash-cache", true, "Keep computed asset digests in .hashes.json in the assets directory, recomputing them only when an asset's size or modification time changes")
+	manifestCache := flag.Duration("manifest-cache", 5*time.Second, "Cache generated manifests, checking the assets directory for changes at most this often (0 generates one per request)")
+	manifestDictionaries := flag.Int("manifest-dictionaries", 32, "How many manifest dictionaries to keep, to serve manifests compressed against the one a client holds (0 disables)")
+	nextCheckAfter := flag.Duration("next-check-after", 0, "Ask clients to wait this long before checking again, to shed load (0 disables)")
+	egressMbps := flag.Float64("egress-budget", 0, "Download bandwidth budget in Mbit/s; above it, manifests defer non-critical updates (0 disables)")
+	egressDefer := flag.Duration("egress-defer", 15*time.Minute, "Average deferral asked of clients while over -egress-budget")
+	encryptionKey := flag.String("encryption-key", "", "Key encryption key for assets encrypted at rest: file:PATH or vault-transit:[MOUNT/]NAME")
+	contentKeys := flag.String("content-keys", "", "Directory of content keys (*.key) of private assets, handed out in exchange for licenses")
+	licenses := flag.String("licenses", "", "JSON file of license tokens (as SHA-256) and the content keys they entitle to; enables /v1/license/keys")
+	uploadMaxSize := flag.Int64("upload-max-size", 512, "Largest asset in MiB accepted by /v1/upload/")
+	exportDir := flag.String("export-dir", "", "Directory to export download records and release history to as CSV files; enables /v1/admin/export/")
+	metricsOn := flag.Bool("metrics", true, "Serve Prometheus metrics of manifests and downloads on /metrics, with Grafana dashboards for them on /v1/admin/dashboards")
+	exportInterval := flag.Duration("export-interval", time.Hour, "How often to record the releases manifests offer in -export-dir")
+	statsFile := flag.String("stats-file", "", "File to keep download counts in across restarts, by component, platform, version, and client version; enables /v1/admin/stats")
+	statsInterval := flag.Duration("stats-interval", time.Minute, "How often to write the download counts to -stats-file")
+	auditInterval := flag.Duration("audit-interval", 24*time.Hour, "How often to re-hash stored assets against their recorded checksums (0 disables)")
+	products := flag.String("products", "", "JSON file of further products to distribute, each under /v1/{product}/ with its own assets, components, signing keys, and credentials")
+	upstream := flag.String("upstream", "", "Upstream update server to act as a pull-through cache for, instead of serving -assets")
+	cacheDir := flag.String("cache-dir", "./cache", "Directory for assets cached from -upstream")
+	cacheSize := flag.Int64("cache-size", 10240, "Disk space for cached assets in MiB; least recently used assets are evicted beyond it")
+	upstreamTTL := flag.Duration("upstream-ttl", time.Minute, "How long a manifest fetched from -upstream is served before refetching it")
+	githubRepo := flag.String("github-repo", "", "GitHub repository (owner/name) whose releases to serve, instead of -assets")
+	githubTemplate := flag.String("github-template", "{{.Component}}-{{.Platform}}-{{.Version}}{{.Ext}}", "Template the release assets of -github-repo are named by")
+	githubAPI := flag.String("github-api", "https://api.github.com", "GitHub API URL, for GitHub Enterprise Server")
+	githubToken := flag.String("github-token", "", "GitHub token, needed for private repositories (default: $GITHUB_TOKEN)")
+	githubTTL := flag.Duration("github-ttl", 5*time.Minute, "How long the release list of -github-repo is served before refetching it")
+	githubDownloads := flag.String("github-downloads", "proxy", "How downloads from -github-repo are served: proxy (relayed through the server) or redirect (to GitHub; public repositories only)")
+	githubPrereleases := flag.String("github-prerelease-channel", "beta", "Channel the prereleases of -github-repo are offered on (empty skips them)")
+	adminToken := flag.String("admin-token", "", "Bearer token for /v1/admin/ endpoints (disabled when empty)")
+	authURL := flag.String("auth-url", "", "External authorization service consulted for requests in -auth-scopes")
+	authScopes := flag.String("auth-scopes", "admin,download", "Comma-separated scopes (admin, download, manifest) that -auth-url protects")
+	apiKeys := flag.String("api-keys", "", "JSON file of API keys (as SHA-256) and the components they may fetch; when set, manifests and downloads require one")
+	requireSigned := flag.Bool("require-signed-requests", false, "Refuse requests carrying an API key itself; clients must sign requests with it (nametag -sign-requests), which protects against replay")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer whose tokens are accepted for the scopes in -oidc-scopes")
+	oidcScopes := flag.String("oidc-scopes", "admin", "Comma-separated scopes (admin, download, manifest) that -oidc-issuer protects")
+	oidcAudience := flag.String("oidc-audience", "", "Audience (client ID) OIDC tokens must be issued for")
+	oidcRolesClaim := flag.String("oidc-roles-claim", "roles", "OIDC token claim listing the caller's roles or groups")
+	oidcRoleMap := flag.String("oidc-role-map", "", "Comma-separated claim-value=role mappings (roles: reader, promoter, publisher)")
+	resumeTTL := flag.Duration("resume-token-ttl", time.Hour, "Lifetime of tokens for resuming authenticated downloads (0 disables)")
+	resumeKey := flag.String("resume-token-key", "", "File with the HMAC key for resumption tokens, shared by all replicas (default: random per process)")
+	mode := flag.String("mode", string(modeNormal), "Initial server mode: normal, read-only, or maintenance (changed at runtime through /v1/admin/mode)")
+	retryAfter := flag.Duration("retry-after", 5*time.Minute, "Retry-After sent with maintenance and read-only refusals")
+	uiOn := flag.Bool("ui", true, "Serve the web dashboard of releases on /ui/, signed into with a token for the admin API (not served with -upstream or -github-repo)")
+	chaosMode := flag.Bool("chaos", false, "Developer mode: inject slow responses, truncated bodies, corrupted assets, and error bursts per endpoint, as set through /v1/chaos (never in production)")
 	showVersion := flag.Bool("version", false, "Show version information")
+	flag.String(config.FlagName, "", "Config file keyed by flag name: TOML when it ends in .toml, JSON otherwise")
 	flag.Parse()
 
+	if err := config.Load(flag.CommandLine, config.ServerEnvPrefix, ""); err != nil {
+		logger.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+
+	configured, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		logger.Error("failed to set up logging", "error", err)
+		os.Exit(1)
+	}
+	logger = configured
+
 	if *showVersion {
 		fmt.Printf("nametag-server version %s\n", version)
 		return
 	}
 
+	namer, err := update.NewAssetNamer(*assetTemplate)
+	if err != nil {
+		logger.Error("invalid asset template", "error", err)
+		os.Exit(1)
+	}
+
+	digests, err := update.ParseHashAlgorithms(*hashes)
+	if err != nil {
+		logger.Error("invalid hashes", "error", err)
+		os.Exit(1)
+	}
+
+	if components, err = parseComponents(*componentList); err != nil {
+		logger.Error("invalid components", "error", err)
+		os.Exit(1)
+	}
+	if platforms, err = parsePlatforms(*platformList); err != nil {
+		logger.Error("invalid platforms", "error", err)
+		os.Exit(1)
+	}
+
 	server := &Server{
-		assetsDir: *assetsDir,
-		logger:    logger,
+		assetsDir:     *assetsDir,
+		keysDir:       *keysDir,
+		namer:         namer,
+		digests:       append([]string{update.HashSHA256}, digests...),
+		manifestTTL:   *manifestTTL,
+		nextCheck:     *nextCheckAfter,
+		components:    components,
+		uploadMaxSize: *uploadMaxSize << 20,
+		mode:          new(atomic.Pointer[modeState]),
+		logger:        logger,
+	}
+	if *manifestCache > 0 {
+		server.manifests = newManifestCache(*manifestCache)
+	}
+	if *manifestDictionaries > 0 {
+		server.dictionaries = newDictionaryCache(*manifestDictionaries)
+	}
+	if *hashCache && *upstream == "" {
+		server.hashes = loadHashCache(*assetsDir, logger)
+	}
+	if *metricsOn && *upstream == "" {
+		server.metrics = newMetrics()
+	}
+	if *exportDir != "" {
+		if *upstream != "" {
+			logger.Error("-export-dir cannot be used with -upstream")
+			os.Exit(1)
+		}
+		server.export, err = newExporter(*exportDir)
+		if err != nil {
+			logger.Error("failed to open export directory", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("exporting downloads and releases", "dir", *exportDir)
+	}
+	if *statsFile != "" {
+		if *upstream != "" {
+			logger.Error("-stats-file cannot be used with -upstream")
+			os.Exit(1)
+		}
+		server.stats, err = openDownloadStats(*statsFile, logger)
+		if err != nil {
+			logger.Error("failed to open download stats", "error", err)
+			os.Exit(1)
+		}
+		go server.stats.runStatsLoop(*statsInterval)
+		logger.Info("keeping download stats", "path", *statsFile)
+	}
+
+	if *encryptionKey != "" {
+		wrapper, err := update.LoadKeyWrapper(*encryptionKey)
+		if err != nil {
+			logger.Error("failed to load encryption key", "error", err)
+			os.Exit(1)
+		}
+		server.encryption = wrapper
+	}
+
+	if *licenses != "" {
+		store, err := newLicenseStore(*contentKeys, *licenses)
+		if err != nil {
+			logger.Error("failed to load licenses", "error", err)
+			os.Exit(1)
+		}
+		server.licenses = store
+		logger.Info("license key exchange enabled", "content_keys", len(store.keys))
+	} else if *contentKeys != "" {
+		logger.Error("-content-keys requires -licenses")
+		os.Exit(1)
+	}
+
+	if *egressMbps > 0 {
+		if *egressDefer < 2*time.Second {
+			logger.Error("-egress-defer must be at least 2s")
+			os.Exit(1)
+		}
+		server.egress = &egressBudget{limit: *egressMbps * 1e6 / 8, deferFor: *egressDefer}
+		logger.Info("egress budget enabled", "mbps", *egressMbps, "defer", *egressDefer)
+	}
+
+	initialMode, err := parseServerMode(*mode)
+	if err != nil {
+		logger.Error("invalid mode", "error", err)
+		os.Exit(1)
+	}
+	server.setMode(initialMode, *retryAfter)
+
+	var tlsConfig *tls.Config
+	switch {
+	case *tlsCert != "" && *acmeHosts != "":
+		logger.Error("-tls-cert and -acme-hosts are mutually exclusive")
+		os.Exit(1)
+	case *tlsCert != "":
+		tlsConfig, err = serverTLSConfig(*tlsCert, *tlsKey, logger)
+		if err != nil {
+			logger.Error("failed to load tls configuration", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("https enabled", "client_ca", *tlsClientCA)
+	case *acmeHosts != "":
+		if *acmeCacheDir == "" {
+			logger.Error("-acme-hosts requires -acme-cache-dir")
+			os.Exit(1)
+		}
+		hosts := strings.Split(strings.ToLower(*acmeHosts), ",")
+		manager, err := newACMEManager(*acmeDirectory, *acmeEmail, hosts, *acmeCacheDir, logger)
+		if err != nil {
+			logger.Error("failed to set up acme", "error", err)
+			os.Exit(1)
+		}
+		tlsConfig = manager.tlsConfig()
+		go manager.runRenewLoop(acmeRenewInterval)
+		logger.Info("https enabled with acme certificates", "hosts", hosts, "directory", *acmeDirectory, "client_ca", *tlsClientCA)
+	case *tlsClientCA != "":
+		logger.Error("-tls-client-ca requires -tls-cert and -tls-key, or -acme-hosts")
+		os.Exit(1)
+	}
+	if tlsConfig != nil && *tlsClientCA != "" {
+		if err := requireClientCerts(tlsConfig, *tlsClientCA); err != nil {
+			logger.Error("failed to load tls configuration", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *adminToken != "" {
+		server.authenticators = append(server.authenticators, &tokenAuth{token: *adminToken, scopes: []authScope{scopeAdmin}})
+	}
+	if *apiKeys != "" {
+		auth, err := newAPIKeyAuth(*apiKeys, *requireSigned)
+		if err != nil {
+			logger.Error("failed to load api keys", "error", err)
+			os.Exit(1)
+		}
+		server.authenticators = append(server.authenticators, auth)
+		logger.Info("api key authentication enabled", "keys", *apiKeys, "require_signed", *requireSigned)
+	} else if *requireSigned {
+		logger.Error("-require-signed-requests requires -api-keys")
+		os.Exit(1)
+	}
+	if *authURL != "" {
+		scopes, err := parseAuthScopes(*authScopes)
+		if err != nil {
+			logger.Error("invalid auth scopes", "error", err)
+			os.Exit(1)
+		}
+		server.authenticators = append(server.authenticators, newForwardAuth(*authURL, scopes))
+		logger.Info("external authorization enabled", "url", *authURL, "scopes", *authScopes)
+	}
+	if *oidcIssuer != "" {
+		if *oidcAudience == "" {
+			logger.Error("-oidc-audience is required with -oidc-issuer")
+			os.Exit(1)
+		}
+		roleMap, err := parseRoleMap(*oidcRoleMap)
+		if err != nil {
+			logger.Error("invalid oidc role map", "error", err)
+			os.Exit(1)
+		}
+		scopes, err := parseAuthScopes(*oidcScopes)
+		if err != nil {
+			logger.Error("invalid oidc scopes", "error", err)
+			os.Exit(1)
+		}
+		server.authenticators = append(server.authenticators,
+			newOIDCAuth(*oidcIssuer, *oidcAudience, *oidcRolesClaim, roleMap, scopes, logger))
+		logger.Info("oidc authentication enabled", "issuer", *oidcIssuer, "audience", *oidcAudience, "scopes", *oidcScopes)
+	}
+
+	// Resumption tokens only make sense for downloads that need credentials;
+	// added unconditionally, resumeAuth would protect open downloads
+	if *resumeTTL > 0 && slices.ContainsFunc(server.authenticators, func(a Authenticator) bool {
+		return slices.Contains(a.Scopes(), scopeDownload)
+	}) {
+		tokens, err := newResumeTokens(*resumeKey, *resumeTTL)
+		if err != nil {
+			logger.Error("failed to set up resumption tokens", "error", err)
+			os.Exit(1)
+		}
+		server.resume = tokens
+		server.authenticators = append(server.authenticators, &resumeAuth{tokens: tokens})
+	}
+
+	if *upstream != "" {
+		// The upstream signs what the cache relays; local release state
+		// has no place here
+		if *signingKey != "" || *channelSigningKey != "" || *manifestFile != "" || *tufDir != "" || *keysDir != "" || *transparencyLog != "" || *products != "" {
+			logger.Error("-signing-key, -channel-signing-key, -manifest-file, -tuf-dir, -keys-dir, -transparency-log and -products cannot be used with -upstream")
+			os.Exit(1)
+		}
+		cache, err := newPullCache(*upstream, *cacheDir, *cacheSize<<20, *upstreamTTL, logger)
+		if err != nil {
+			logger.Error("failed to set up cache", "error", err)
+			os.Exit(1)
+		}
+		server.cache = cache
+		logger.Info("caching proxy enabled", "upstream", *upstream, "cache_dir", *cacheDir)
+	}
+
+	if *githubRepo != "" {
+		// Releases live on GitHub; nothing local describes them
+		if *upstream != "" || *storageURL != "" || *manifestFile != "" || *products != "" || *tufDir != "" || *exportDir != "" {
+			logger.Error("-upstream, -storage, -manifest-file, -products, -tuf-dir and -export-dir cannot be used with -github-repo")
+			os.Exit(1)
+		}
+		proxy, err := newGitHubProxy(*githubRepo, *githubAPI, cmp.Or(*githubToken, os.Getenv("GITHUB_TOKEN")), *githubTemplate, *githubPrereleases, *githubDownloads, *githubTTL, server, logger)
+		if err != nil {
+			logger.Error("failed to set up GitHub releases", "error", err)
+			os.Exit(1)
+		}
+		server.github = proxy
+		logger.Info("serving GitHub releases", "repo", *githubRepo, "downloads", *githubDownloads)
+	}
+
+	// Releases served from the assets directory are listed in its catalog,
+	// which syncing with a storage keeps up to date
+	if *upstream == "" && server.github == nil {
+		if err := server.openCatalog(context.Background()); err != nil {
+			logger.Error("failed to open release catalog", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *storageURL != "" {
+		if *upstream != "" {
+			logger.Error("-storage cannot be used with -upstream")
+			os.Exit(1)
+		}
+		server.storage, err = openStorageMirror(*storageURL, *assetsDir, logger)
+		if err != nil {
+			logger.Error("failed to open storage", "error", err)
+			os.Exit(1)
+		}
+		// The manifest is checked against what the storage holds
+		if err := server.syncStorage(context.Background()); err != nil {
+			logger.Error("failed to sync with storage", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("keeping releases in object storage", "storage", *storageURL, "local_copy", *assetsDir)
+	}
+
+	if *cdnURL != "" {
+		if *upstream != "" || *githubRepo != "" {
+			logger.Error("-cdn-url cannot be used with -upstream or -github-repo")
+			os.Exit(1)
+		}
+		server.cdn, err = newCDNRedirect(*cdnURL, *cdnSigningKey, *cdnURLTTL)
+		if err != nil {
+			logger.Error("failed to set up CDN redirects", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("redirecting downloads to CDN", "url", *cdnURL, "signed", *cdnSigningKey != "")
+	} else if *cdnSigningKey != "" {
+		logger.Error("-cdn-signing-key requires -cdn-url")
+		os.Exit(1)
+	}
+
+	if *signingKey != "" {
+		for _, path := range strings.Split(*signingKey, ",") {
+			key, err := update.LoadPrivateKey(path)
+			if err != nil {
+				logger.Error("failed to load signing key", "error", err)
+				os.Exit(1)
+			}
+			server.signingKeys = append(server.signingKeys, key)
+			logger.Info("manifest signing enabled",
+				"public_key", update.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+			)
+		}
+	}
+
+	if *channelSigningKey != "" {
+		keys, err := loadChannelKeys(*channelSigningKey)
+		if err != nil {
+			logger.Error("failed to load channel signing keys", "error", err)
+			os.Exit(1)
+		}
+		server.channelKeys = keys
+		for channel, keys := range keys {
+			for _, key := range keys {
+				logger.Info("channel signing enabled",
+					"channel", channel,
+					"public_key", update.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+				)
+			}
+		}
+	}
+
+	// Clients refuse signed manifests that never expire
+	if (len(server.signingKeys) > 0 || len(server.channelKeys) > 0) && *manifestTTL <= 0 {
+		logger.Error("-manifest-ttl must be positive when signing manifests")
+		os.Exit(1)
+	}
+
+	if *manifestFile != "" {
+		// The manifest's bytes are what its signatures cover: nothing may
+		// sign or rewrite it on the way out
+		if *signingKey != "" || *channelSigningKey != "" {
+			logger.Error("-signing-key and -channel-signing-key cannot be used with -manifest-file; sign it with nametag-sign")
+			os.Exit(1)
+		}
+		if server.egress != nil {
+			logger.Error("-egress-budget cannot defer updates in a -manifest-file manifest")
+			os.Exit(1)
+		}
+		if _, err := update.ReadManifestSignatures(*manifestFile); err != nil {
+			logger.Error("failed to read manifest signatures", "error", err)
+			os.Exit(1)
+		}
+		server.manifestFile = *manifestFile
+		logger.Info("serving offline-signed manifest", "path", *manifestFile)
+	}
+
+	if *transparencyLog != "" {
+		// Checkpoints are signed online, which an offline-signed release
+		// process has no key for
+		if *manifestFile != "" {
+			logger.Error("-transparency-log cannot be used with -manifest-file")
+			os.Exit(1)
+		}
+		log, err := openTransparencyLog(*transparencyLog)
+		if err != nil {
+			logger.Error("failed to open transparency log", "error", err)
+			os.Exit(1)
+		}
+		server.transparency = log
+		logger.Info("transparency log enabled", "path", *transparencyLog, "size", len(log.leaves))
+	}
+
+	if *tufDir != "" {
+		repo, err := loadTUFRepo(*tufDir)
+		if err != nil {
+			logger.Error("failed to load tuf repository", "error", err)
+			os.Exit(1)
+		}
+		server.tuf = repo
+		logger.Info("tuf metadata enabled", "dir", *tufDir)
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/manifest.json", server.handleManifest)
-	mux.HandleFunc("/v1/download/", server.handleDownload)
+	if server.cache != nil {
+		mux.HandleFunc("/v1/manifest.json", server.requireAuth(scopeManifest, server.handleCachedManifest))
+		mux.HandleFunc("/v1/download/", server.requireAuth(scopeDownload, server.handleCachedDownload))
+		mux.HandleFunc("/v1/signature/", server.requireAuth(scopeDownload, server.handleUpstream))
+		mux.HandleFunc("/v1/gpg-signature/", server.requireAuth(scopeDownload, server.handleUpstream))
+		mux.HandleFunc("/v1/provenance/", server.requireAuth(scopeDownload, server.handleUpstream))
+		mux.HandleFunc("/v1/sbom/", server.requireAuth(scopeDownload, server.handleUpstream))
+		mux.HandleFunc("/v1/tuf/", server.handleUpstream)
+		mux.HandleFunc("/v1/log/", server.handleUpstream)
+		mux.HandleFunc(update.KeyRotationPath, server.handleUpstream)
+		mux.HandleFunc(update.LicenseKeysPath, server.handleUpstream)
+	} else if server.github != nil {
+		// Fail fast rather than serve a subtly broken manifest
+		manifest, _, err := server.githubManifest(context.Background(), update.ChannelStable)
+		if err != nil {
+			logger.Error("failed to build manifest from GitHub releases", "error", err)
+			os.Exit(1)
+		}
+		if issues := update.LintManifest(manifest); len(issues) > 0 {
+			for _, issue := range issues {
+				logger.Error("manifest problem", "issue", issue)
+			}
+			os.Exit(1)
+		}
+
+		mux.HandleFunc("/v1/manifest.json", server.requireAuth(scopeManifest, server.handleGitHubManifest))
+		if server.dictionaries != nil {
+			mux.HandleFunc("/v1/manifest-dictionary/", server.requireAuth(scopeManifest, server.handleManifestDictionary))
+		}
+		mux.HandleFunc("/v1/download/", server.requireAuth(scopeDownload, server.handleGitHubDownload))
+		mux.HandleFunc("/v1/signature/", server.requireAuth(scopeDownload, server.handleGitHubSignature))
+		mux.HandleFunc(update.KeyRotationPath, server.handleKeyRotation)
+		if server.stats != nil {
+			mux.HandleFunc("/v1/admin/stats", server.requireAuth(scopeAdmin, server.handleStats))
+		}
+		if server.metrics != nil {
+			mux.HandleFunc("/metrics", server.handleMetrics)
+			mux.HandleFunc("/v1/admin/dashboards", server.requireAuth(scopeAdmin, server.handleDashboards))
+			mux.HandleFunc("/v1/admin/dashboards/", server.requireAuth(scopeAdmin, server.handleDashboards))
+		}
+	} else {
+		// Fail fast rather than serve a subtly broken manifest
+		if issues, err := server.cachedLint(); err != nil {
+			logger.Error("failed to generate manifest", "error", err)
+			os.Exit(1)
+		} else if len(issues) > 0 {
+			for _, issue := range issues {
+				logger.Error("manifest problem", "issue", issue)
+			}
+			os.Exit(1)
+		}
+
+		if *auditInterval > 0 {
+			go server.runAuditLoop(*auditInterval)
+		}
+		if server.storage != nil {
+			go server.runStorageLoop(*storageSync)
+		}
+		if server.export != nil {
+			go server.runExportLoop(*exportInterval)
+			mux.HandleFunc("/v1/admin/export/", server.requireAuth(scopeAdmin, server.handleExport))
+		}
+		if server.metrics != nil {
+			mux.HandleFunc("/metrics", server.handleMetrics)
+			mux.HandleFunc("/v1/admin/dashboards", server.requireAuth(scopeAdmin, server.handleDashboards))
+			mux.HandleFunc("/v1/admin/dashboards/", server.requireAuth(scopeAdmin, server.handleDashboards))
+		}
+
+		server.registerReleaseRoutes(mux)
+		if *uiOn && server.protects(scopeAdmin) {
+			mux.Handle(uiPath, uiHandler())
+		}
+
+		if *products != "" {
+			configs, err := readProducts(*products)
+			if err != nil {
+				logger.Error("failed to load products", "error", err)
+				os.Exit(1)
+			}
+			for _, p := range configs {
+				ps, err := server.newProductServer(p, *requireSigned)
+				if err != nil {
+					logger.Error("failed to set up product", "error", err)
+					os.Exit(1)
+				}
+				if *auditInterval > 0 {
+					go ps.runAuditLoop(*auditInterval)
+				}
+				if ps.storage != nil {
+					go ps.runStorageLoop(*storageSync)
+				}
+				if ps.export != nil {
+					go ps.runExportLoop(*exportInterval)
+				}
+				mux.Handle("/v1/"+p.Name+"/", ps.productHandler())
+				logger.Info("serving product", "product", p.Name, "assets_dir", p.Assets, "components", p.Components)
+			}
+		}
+	}
+	mux.HandleFunc("/v1/admin/mode", server.requireAuth(scopeAdmin, server.handleMode))
 	mux.HandleFunc("/health", server.handleHealth)
+	buildinfo.Mount(mux, buildinfo.Info{Version: version})
 	mux.HandleFunc("/", server.handleRoot)
 
 	logger.Info("starting update server",
 		"addr", *addr,
 		"assets_dir", *assetsDir,
+		"upstream", *upstream,
+		"mode", initialMode,
 	)
 
-	if err := http.ListenAndServe(*addr, mux); err != nil {
+	handler := server.withMode(mux)
+	if *chaosMode {
+		handler = newChaos(logger).wrap(handler)
+		logger.Warn("chaos mode enabled: anyone can make the server fail through " + chaosPath)
+	}
+	handler = withAccessLog(logger, handler)
+
+	httpServer := &http.Server{
+		Addr:              *addr,
+		Handler:           handler,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	httpServer.TLSConfig = tlsConfig
+	if err := listenAndServe(httpServer, tlsConfig != nil, *shutdownTimeout, logger); err != nil {
 		logger.Error("server failed", "error", err)
 		os.Exit(1)
 	}
+
+	// Counts since the last periodic write would be lost otherwise
+	if server.stats != nil {
+		if err := server.stats.save(); err != nil {
+			logger.Error("failed to save download stats", "error", err)
+		}
+	}
+	logger.Info("server stopped")
 }
 
 type Server struct {
 	assetsDir string
-	logger    *slog.Logger
+	// components are the components served from assetsDir
+	components []string
+	// product namespaces the server's paths under /v1/{product}/ when it
+	// is one of several; empty for the default product
+	product string
+	namer   *update.AssetNamer
+	// digests are the algorithms each asset is hashed with
+	digests []string
+	// manifestTTL sets the manifest's expiry relative to its generation
+	manifestTTL time.Duration
+	// manifests, when set, caches generated manifests
+	manifests *manifestCache
+	// dictionaries, when set, keeps the dictionaries manifests are served
+	// compressed against
+	dictionaries *dictionaryCache
+	// export, when set, records downloads and releases for analysis
+	export *exporter
+	// stats, when set, counts downloads across restarts
+	stats *downloadStats
+	// catalog records the published releases manifests are generated from,
+	// the assets directory only holding their files
+	catalog *catalog.Catalog
+	// hashes, when set, keeps asset digests across requests and restarts
+	hashes *hashCache
+	// metrics, when set, counts manifests and downloads for Prometheus
+	metrics *metrics
+	// storage, when set, is the object store assetsDir is a copy of
+	storage *storageMirror
+	// github, when set, serves a GitHub repository's releases instead of
+	// assetsDir
+	github *githubProxy
+	// nextCheck is the manifest's next_check_after hint
+	nextCheck time.Duration
+	// cdn, when set, redirects downloads to a CDN mirroring assetsDir
+	cdn *cdnRedirect
+	// egress, when set, defers updates while downloads exceed a budget
+	egress *egressBudget
+	// resume issues download resumption tokens when downloads need auth
+	resume *resumeTokens
+	// uploadMaxSize bounds assets published through /v1/upload/
+	uploadMaxSize int64
+	// encryption unwraps the data keys of assets encrypted at rest
+	encryption update.KeyWrapper
+	// licenses, when set, exchanges license tokens for content keys
+	licenses *licenseStore
+	// cache, when set, serves an upstream server's releases instead of assetsDir
+	cache *pullCache
+	// signingKeys each sign the manifest; the first also signs assets
+	signingKeys []ed25519.PrivateKey
+	// channelKeys do the same for the manifests and releases of other
+	// channels, so a leaked key of one can't sign for stable
+	channelKeys map[string][]ed25519.PrivateKey
+	keysDir     string
+	tuf         *tufRepo
+	// transparency, when set, logs every asset before a manifest offers it
+	transparency *transparencyLog
+
+	// manifestFile, when set, is a manifest signed offline served instead
+	// of the generated one
+	manifestFile string
+	// authenticators guard the admin and download endpoints; see Authenticator
+	authenticators []Authenticator
+	auditMu        sync.Mutex
+	releaseMu      sync.Mutex
+	// lint is the last manifest validation report; see cachedLint
+	lintMu sync.Mutex
+	lint   *lintReport
+	// mode is shared with the servers of other products
+	mode   *atomic.Pointer[modeState]
+	logger *slog.Logger
+}
+
+// registerReleaseRoutes serves the releases in the assets directory on mux
+func (s *Server) registerReleaseRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/manifest.json", s.requireAuth(scopeManifest, s.handleManifest))
+	if s.dictionaries != nil {
+		mux.HandleFunc("/v1/manifest-dictionary/", s.requireAuth(scopeManifest, s.handleManifestDictionary))
+	}
+	mux.HandleFunc("/v1/manifest/lint", s.requireAuth(scopeAdmin, s.handleLint))
+	mux.HandleFunc("/v1/download/", s.requireAuth(scopeDownload, s.handleDownload))
+	mux.HandleFunc("/v1/signature/", s.requireAuth(scopeDownload, s.handleSignature))
+	mux.HandleFunc("/v1/gpg-signature/", s.requireAuth(scopeDownload, s.handleGPGSignature))
+	mux.HandleFunc("/v1/provenance/", s.requireAuth(scopeDownload, s.handleProvenance))
+	mux.HandleFunc("/v1/sbom/", s.requireAuth(scopeDownload, s.handleSBOM))
+	mux.HandleFunc("/v1/tuf/", s.handleTUF)
+	if s.transparency != nil {
+		mux.HandleFunc(update.TransparencyCheckpointPath, s.handleCheckpoint)
+		mux.HandleFunc(update.TransparencyProofPath, s.handleInclusionProof)
+		mux.HandleFunc(update.TransparencyConsistencyPath, s.handleConsistencyProof)
+	}
+	mux.HandleFunc(update.KeyRotationPath, s.handleKeyRotation)
+	if s.licenses != nil {
+		mux.HandleFunc(update.LicenseKeysPath, s.handleLicenseKeys)
+	}
+	mux.HandleFunc("/v1/admin/audit", s.requireAuth(scopeAdmin, s.handleAudit))
+	mux.HandleFunc("/v1/admin/releases", s.requireAuth(scopeAdmin, s.handleReleases))
+	if s.stats != nil {
+		mux.HandleFunc("/v1/admin/stats", s.requireAuth(scopeAdmin, s.handleStats))
+	}
+	mux.HandleFunc("/v1/admin/components/", s.requireAuth(scopeAdmin, s.handleRelease))
+	mux.HandleFunc("/v1/upload/", s.requireAuth(scopeAdmin, s.handleUpload))
 }
 
 func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
@@ -72,183 +756,909 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprintf(w, "Nametag Update Server\n")
 	fmt.Fprintf(w, "\nEndpoints:\n")
-	fmt.Fprintf(w, "  GET /v1/manifest.json - Version manifest\n")
+	fmt.Fprintf(w, "  GET /v1/manifest.json[?channel={channel}] - Version manifest of the stable or another release channel\n")
+	fmt.Fprintf(w, "  GET /v1/manifest/lint - Manifest validation report (admin)\n")
 	fmt.Fprintf(w, "  GET /v1/download/{component}/{platform}/{version} - Download binary\n")
+	fmt.Fprintf(w, "  GET /v1/signature/{component}/{platform}/{version} - Minisign signature of binary\n")
+	fmt.Fprintf(w, "  GET /v1/gpg-signature/{component}/{platform}/{version} - Armored GPG signature of binary\n")
+	fmt.Fprintf(w, "  GET /v1/provenance/{component}/{platform}/{version} - SLSA provenance of binary\n")
+	fmt.Fprintf(w, "  GET /v1/sbom/{component}/{platform}/{version} - SPDX or CycloneDX SBOM of binary\n")
+	fmt.Fprintf(w, "  GET /v1/keys/[{channel}/]{version}.json - Signed key rotation documents\n")
+	fmt.Fprintf(w, "  GET /v1/tuf/{role}.json - TUF metadata (root, timestamp, snapshot, targets)\n")
+	fmt.Fprintf(w, "  GET /v1/log/checkpoint - Signed size and root of the transparency log of published assets\n")
+	fmt.Fprintf(w, "  GET /v1/log/proof?component=&version=&platform=&sha256=[&size=] - Inclusion proof of an asset\n")
+	fmt.Fprintf(w, "  GET /v1/log/consistency?from=[&to=] - Proof that the log of from leaves is a prefix of the one of to\n")
+	fmt.Fprintf(w, "  GET /v1/license/keys - Content keys of private assets for a license token\n")
+	fmt.Fprintf(w, "  POST /v1/admin/audit - Re-hash stored assets and quarantine corrupted ones\n")
+	fmt.Fprintf(w, "  GET /v1/admin/releases[?component={component}] - Every version with its channel, assets, and release state\n")
+	fmt.Fprintf(w, "  GET /v1/admin/components/{component} - Release state (promoted and yanked versions)\n")
+	fmt.Fprintf(w, "  POST /v1/admin/components/{component}/{promote,yank,unyank,rollout,channel} - Change release state (If-Match)\n")
+	fmt.Fprintf(w, "  POST /v1/upload/{component}/{platform}/{version} - Publish a release asset (sha256 required)\n")
+	fmt.Fprintf(w, "  * /v1/{product}/... - The endpoints above (except mode, export, and dashboards) for a product listed in -products\n")
+	fmt.Fprintf(w, "  GET|PUT /v1/admin/mode - Server mode (normal, read-only, maintenance)\n")
+	fmt.Fprintf(w, "  GET /v1/admin/export/[{file}.csv] - Exported download records and release history (-export-dir)\n")
+	fmt.Fprintf(w, "  GET /v1/admin/stats[?component={component}][&version={version}] - Downloads of each version since stats were first kept (-stats-file)\n")
+	fmt.Fprintf(w, "  GET /v1/admin/dashboards[/{name}.json] - Grafana dashboards of the server's metrics\n")
+	fmt.Fprintf(w, "  GET %s - Web dashboard of releases, using the admin API\n", uiPath)
+	fmt.Fprintf(w, "  GET /metrics - Prometheus metrics of manifests and downloads\n")
+	fmt.Fprintf(w, "  GET|POST|DELETE %s - Failure injection rules per endpoint (-chaos)\n", chaosPath)
 	fmt.Fprintf(w, "  GET /health - Health check\n")
+	fmt.Fprintf(w, "  GET %s - Version, commit, and build date of the server\n", buildinfo.Path)
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "mode": string(s.currentMode().Mode)})
 }
 
 func (s *Server) handleManifest(w http.ResponseWriter, r *http.Request) {
-	s.logger.Info("manifest requested", "remote", r.RemoteAddr)
+	channel := update.NormalizeChannel(r.URL.Query().Get("channel"))
+	s.logger.InfoContext(r.Context(), "manifest requested", "channel", channel)
+
+	keys, ok := s.manifestKeys(channel)
+	if err := update.ValidateChannel(channel); err != nil || !ok || (s.manifestFile != "" && channel != update.ChannelStable) {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	}
+
+	// A manifest signed elsewhere is served whole; keys limited to some
+	// components are still refused the others' downloads
+	if s.manifestFile != "" {
+		s.serveSignedManifest(w, r)
+		return
+	}
+
+	generated, err := s.manifest(channel)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to generate manifest", "error", err)
+		http.Error(w, "Failed to generate manifest", http.StatusInternalServerError)
+		return
+	}
+	modified, err := s.manifestModified()
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to generate manifest", "error", err)
+		http.Error(w, "Failed to generate manifest", http.StatusInternalServerError)
+		return
+	}
+	manifest := generated.manifest
+	if len(generated.targets) > 0 {
+		w.Header().Add("Vary", strings.Join([]string{update.PlatformHeader, update.CurrentVersionHeader, update.GroupHeader}, ", "))
+	}
+	if len(generated.targets) > 0 || len(generated.rollouts) > 0 {
+		w.Header().Add("Vary", update.MachineIDHeader)
+	}
+	// A component a targeting rule decided for the client isn't staged too
+	targeted := applyTargeting(w, r, manifest, generated.targets, generated.aliases)
+	stageRollouts(w, r, manifest, generated.rollouts, targeted)
+	applyAliases(manifest, generated.aliases)
+	s.writeManifest(w, r, channel, keys, manifest, modified)
+}
+
+// writeManifest validates, logs, and signs a channel's manifest, narrowed to
+// what the caller may fetch, and serves it unless the client has it already
+func (s *Server) writeManifest(w http.ResponseWriter, r *http.Request, channel string, keys []ed25519.PrivateKey, manifest *update.Manifest, modified time.Time) {
+	if issues := update.LintManifest(manifest); len(issues) > 0 {
+		for _, issue := range issues {
+			s.logger.ErrorContext(r.Context(), "manifest problem", "issue", issue)
+		}
+		http.Error(w, "Manifest failed validation", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.logManifest(manifest); err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to log published assets", "error", err)
+		http.Error(w, "Failed to generate manifest", http.StatusInternalServerError)
+		return
+	}
 
-	manifest, err := s.generateManifest()
+	// Former names of renamed components go with the components'
+	// downloads
+	if id := requestIdentity(r); id != nil {
+		for name, comp := range manifest.Components {
+			if !id.allows(comp.Name) {
+				delete(manifest.Components, name)
+			}
+		}
+	}
+	// The dictionary leaves out deferrals, which come and go with load
+	var dictID string
+	if s.dictionaries != nil {
+		dict, err := update.ManifestDictionary(manifest)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "failed to encode manifest", "error", err)
+			http.Error(w, "Failed to generate manifest", http.StatusInternalServerError)
+			return
+		}
+		dictID = s.dictionaries.add(dict)
+	}
+	s.deferUpdates(manifest)
+
+	etag, lastModified, err := s.manifestValidators(manifest, modified)
 	if err != nil {
-		s.logger.Error("failed to generate manifest", "error", err)
+		s.logger.ErrorContext(r.Context(), "failed to encode manifest", "error", err)
+		http.Error(w, "Failed to generate manifest", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+	w.Header().Set("Cache-Control", manifestCacheControl(r))
+	if dictID != "" {
+		w.Header().Set(update.ManifestDictionaryHeader, dictID)
+		w.Header().Add("Vary", "Accept-Encoding, Available-Dictionary")
+	}
+	// Fleets polling every minute mostly get this: nothing but headers
+	if notModified(r, etag, lastModified) {
+		s.metrics.manifestServed(s.product, channel, http.StatusNotModified, manifest)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to encode manifest", "error", err)
 		http.Error(w, "Failed to generate manifest", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Cache-Control", "max-age=60")
-	json.NewEncoder(w).Encode(manifest)
+	// One header per key; clients that expect a single key read the first
+	for _, key := range keys {
+		w.Header().Add(update.SignatureHeader, update.Sign(key, data))
+	}
+	body := data
+	if s.dictionaries != nil {
+		body = s.dictionaries.encode(w, r, data)
+	}
+	w.Write(body)
+	s.metrics.manifestServed(s.product, channel, http.StatusOK, manifest)
+}
+
+func (s *Server) handleLint(w http.ResponseWriter, r *http.Request) {
+	// The issues name components and versions the caller may not be
+	// offered
+	if !s.requireRole(w, r, roleReader) {
+		return
+	}
+
+	issues, err := s.cachedLint()
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to generate manifest", "error", err)
+		http.Error(w, "Failed to generate manifest", http.StatusInternalServerError)
+		return
+	}
+
+	report := struct {
+		Valid  bool     `json:"valid"`
+		Issues []string `json:"issues"`
+	}{
+		Valid:  len(issues) == 0,
+		Issues: make([]string, 0, len(issues)),
+	}
+	for _, issue := range issues {
+		report.Issues = append(report.Issues, issue.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// lintManifest generates the current manifest, or reads the one signed
+// offline, and validates it
+func (s *Server) lintManifest() ([]error, error) {
+	if s.manifestFile != "" {
+		data, err := os.ReadFile(s.manifestFile)
+		if err != nil {
+			return nil, fmt.Errorf("read manifest: %w", err)
+		}
+		manifest, err := update.ParseManifest(data)
+		if err != nil {
+			return nil, fmt.Errorf("decode manifest: %w", err)
+		}
+		return update.LintManifest(manifest), nil
+	}
+
+	issues, err := s.lintChannel(update.ChannelStable)
+	if err != nil {
+		return nil, err
+	}
+	for _, channel := range slices.Sorted(maps.Keys(s.channelKeys)) {
+		channelIssues, err := s.lintChannel(channel)
+		if err != nil {
+			return nil, err
+		}
+		for _, issue := range channelIssues {
+			issues = append(issues, fmt.Errorf("channel %s: %w", channel, issue))
+		}
+	}
+	return issues, nil
+}
+
+func (s *Server) lintChannel(channel string) ([]error, error) {
+	generated, err := s.generateManifest(channel)
+	if err != nil {
+		return nil, err
+	}
+	// Releases being rolled out, or offered by targeting rules, are checked
+	// before they reach anyone
+	staged := withRollouts(generated.manifest, generated.rollouts)
+	applyAliases(staged, generated.aliases)
+	issues := update.LintManifest(staged)
+	for comp, targets := range generated.targets {
+		for _, t := range targets {
+			if t.component == nil {
+				continue
+			}
+			targeted := withTarget(generated.manifest, comp, t)
+			applyAliases(targeted, generated.aliases)
+			for _, issue := range update.LintManifest(targeted) {
+				issues = append(issues, fmt.Errorf("targeting rule %s: %w", t.rule.Name, issue))
+			}
+		}
+	}
+	return issues, nil
+}
+
+// manifestKeys returns the keys that sign channel's manifest and the
+// releases published on it, and whether the channel is served at all. Once
+// the server signs, channels other than stable need keys of their own.
+func (s *Server) manifestKeys(channel string) ([]ed25519.PrivateKey, bool) {
+	if channel == update.ChannelStable {
+		return s.signingKeys, true
+	}
+	keys := s.channelKeys[channel]
+	return keys, len(keys) > 0 || (len(s.signingKeys) == 0 && len(s.channelKeys) == 0)
+}
+
+// loadChannelKeys parses -channel-signing-key
+func loadChannelKeys(pairs string) (map[string][]ed25519.PrivateKey, error) {
+	keys := make(map[string][]ed25519.PrivateKey)
+	for _, pair := range strings.Split(pairs, ",") {
+		channel, path, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not CHANNEL=PATH", pair)
+		}
+		if err := update.ValidateChannel(channel); err != nil {
+			return nil, err
+		}
+		if channel == update.ChannelStable {
+			return nil, errors.New("stable is signed with -signing-key")
+		}
+
+		key, err := update.LoadPrivateKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("channel %s: %w", channel, err)
+		}
+		keys[channel] = append(keys[channel], key)
+	}
+	return keys, nil
+}
+
+// serveSignedManifest serves the manifest signed offline byte for byte,
+// with its signatures. Both are read on every request so a newly signed
+// release goes out without a restart.
+func (s *Server) serveSignedManifest(w http.ResponseWriter, r *http.Request) {
+	signatures, err := update.ReadManifestSignatures(s.manifestFile)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to read manifest signatures", "error", err)
+		http.Error(w, "Failed to read manifest", http.StatusInternalServerError)
+		return
+	}
+	data, err := os.ReadFile(s.manifestFile)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to read manifest", "error", err)
+		http.Error(w, "Failed to read manifest", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", manifestCacheControl(r))
+	for _, signature := range signatures {
+		w.Header().Add(update.SignatureHeader, signature)
+	}
+	w.Write(data)
 }
 
 func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
-	// Parse path: /v1/download/{component}/{platform}/{version}
-	path := strings.TrimPrefix(r.URL.Path, "/v1/download/")
+	filePath, ok := s.resolveAsset(w, r, "/v1/download/", "download requested")
+	if !ok {
+		return
+	}
+
+	asset, err := s.openAsset(filePath)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to open asset", "path", filePath, "error", err)
+		http.Error(w, "Failed to read asset", http.StatusInternalServerError)
+		return
+	}
+	defer asset.Close()
+
+	// The CDN holds the stored bytes, which only assets not encrypted at
+	// rest can be served as; HEAD stays here, for the asset's SHA-256
+	if s.cdn != nil && r.Method == http.MethodGet && !asset.Encrypted() {
+		rel, err := filepath.Rel(s.assetsDir, filePath)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "failed to locate asset", "path", filePath, "error", err)
+			http.Error(w, "Failed to read asset", http.StatusInternalServerError)
+			return
+		}
+		s.cdn.redirect(w, r, filepath.ToSlash(rel))
+		s.downloadRedirected(r)
+		return
+	}
+
+	_, digests, err := s.cachedDigests(filePath, update.HashSHA256)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to hash asset", "path", filePath, "error", err)
+		http.Error(w, "Failed to read asset", http.StatusInternalServerError)
+		return
+	}
+	setAssetHeaders(w, digests[update.HashSHA256])
+	s.issueResumeToken(w, r)
+
+	// ServeContent honors Range, which is how downloads resume, including
+	// those of assets encrypted at rest, and answers HEAD with the headers
+	if (s.export == nil && s.metrics == nil && s.stats == nil) || r.Method == http.MethodHead {
+		http.ServeContent(s.meterEgress(w), r, filepath.Base(filePath), asset.ModTime(), asset)
+		return
+	}
+	cw := &countingWriter{ResponseWriter: s.meterEgress(w)}
+	http.ServeContent(cw, r, filepath.Base(filePath), asset.ModTime(), asset)
+	s.downloadFinished(r, cw.status, cw.bytes)
+}
+
+// downloadRedirected records a download sent elsewhere, without the bytes
+// the server didn't serve
+func (s *Server) downloadRedirected(r *http.Request) {
+	s.downloadFinished(r, http.StatusFound, 0)
+}
+
+// downloadFinished counts a download response in the metrics and stats,
+// and exports it
+func (s *Server) downloadFinished(r *http.Request, status int, bytes int64) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/download/"), "/")
+	s.metrics.downloadServed(s.product, parts[0], parts[1], parts[2], status, bytes)
+	s.stats.downloadServed(s.product, parts[0], parts[1], parts[2], status, bytes, r.UserAgent())
+	if s.export == nil {
+		return
+	}
+	if err := s.export.recordDownload(s.product, parts[0], parts[1], parts[2], status, bytes); err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to export download", "error", err)
+	}
+}
+
+// setAssetHeaders marks a download with its asset's SHA-256, as a header and
+// as a strong ETag. ServeContent checks If-Range against the ETag, so a
+// resumed download only continues the asset it started with, whichever
+// replica or cache serves it, where modification times differ.
+func setAssetHeaders(w http.ResponseWriter, sha256 string) {
+	w.Header().Set(update.AssetSHA256Header, sha256)
+	w.Header().Set("ETag", `"`+sha256+`"`)
+}
+
+func (s *Server) handleSignature(w http.ResponseWriter, r *http.Request) {
+	filePath, ok := s.resolveAsset(w, r, "/v1/signature/", "signature requested")
+	if !ok {
+		return
+	}
+
+	// Prefer a signature produced offline by the release pipeline
+	sigPath := filePath + update.MinisignExtension
+	if _, err := os.Stat(sigPath); err == nil {
+		http.ServeFile(w, r, sigPath)
+		return
+	}
+
+	// Releases are signed with the keys of the channel they're published on
+	versionDir := filepath.Dir(filePath)
+	release, err := s.catalog.Release(r.Context(), filepath.Base(filepath.Dir(versionDir)), filepath.Base(versionDir))
+	if errors.Is(err, catalog.ErrNotFound) {
+		http.Error(w, "Signature not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to read release channel", "path", filePath, "error", err)
+		http.Error(w, "Failed to sign asset", http.StatusInternalServerError)
+		return
+	}
+	keys, _ := s.manifestKeys(release.Channel)
+	if len(keys) == 0 {
+		http.Error(w, "Signature not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := s.readAsset(filePath)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to read asset", "path", filePath, "error", err)
+		http.Error(w, "Failed to sign asset", http.StatusInternalServerError)
+		return
+	}
+
+	trustedComment := fmt.Sprintf("timestamp:%d\tfile:%s", time.Now().Unix(), filepath.Base(filePath))
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, update.MinisignSign(keys[0], data, trustedComment))
+}
+
+// handleGPGSignature serves the armored GPG signature published next to an
+// asset; the server holds no GPG key, so these are always produced offline
+func (s *Server) handleGPGSignature(w http.ResponseWriter, r *http.Request) {
+	filePath, ok := s.resolveAsset(w, r, "/v1/gpg-signature/", "gpg signature requested")
+	if !ok {
+		return
+	}
+
+	sigPath := filePath + update.GPGExtension
+	if _, err := os.Stat(sigPath); err != nil {
+		http.Error(w, "Signature not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pgp-signature")
+	http.ServeFile(w, r, sigPath)
+}
+
+// handleProvenance serves the SLSA provenance attestation published next to
+// an asset by its builder
+func (s *Server) handleProvenance(w http.ResponseWriter, r *http.Request) {
+	filePath, ok := s.resolveAsset(w, r, "/v1/provenance/", "provenance requested")
+	if !ok {
+		return
+	}
+
+	provenancePath := filePath + update.ProvenanceExtension
+	if _, err := os.Stat(provenancePath); err != nil {
+		http.Error(w, "Provenance not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	http.ServeFile(w, r, provenancePath)
+}
+
+// handleSBOM serves the SPDX or CycloneDX SBOM published next to an asset
+func (s *Server) handleSBOM(w http.ResponseWriter, r *http.Request) {
+	filePath, ok := s.resolveAsset(w, r, "/v1/sbom/", "sbom requested")
+	if !ok {
+		return
+	}
+
+	sbomPath, format, ok := update.FindSBOM(filePath)
+	if !ok {
+		http.Error(w, "SBOM not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", update.SBOMContentType(format))
+	http.ServeFile(w, r, sbomPath)
+}
+
+// handleKeyRotation serves /v1/keys/{version}.json from the keys directory
+func (s *Server) handleKeyRotation(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, update.KeyRotationPath)
+	version, ok := strings.CutSuffix(name, ".json")
+	if s.keysDir == "" || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// Channels other than stable rotate their keys under {channel}/
+	if channel, rest, found := strings.Cut(version, "/"); found {
+		if update.ValidateChannel(channel) != nil || channel == update.ChannelStable {
+			http.NotFound(w, r)
+			return
+		}
+		version = rest
+	}
+	if _, err := strconv.ParseUint(version, 10, 63); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	path := filepath.Join(s.keysDir, name)
+	if _, err := os.Stat(path); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, path)
+}
+
+// resolveAsset parses /{prefix}/{component}/{platform}/{version} and returns
+// the asset's path on disk, writing an error response when it can't
+func (s *Server) resolveAsset(w http.ResponseWriter, r *http.Request, prefix, msg string) (string, bool) {
+	path := strings.TrimPrefix(r.URL.Path, prefix)
 	parts := strings.Split(path, "/")
 
 	if len(parts) != 3 {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
-		return
+		return "", false
 	}
 
 	component := parts[0]
 	platform := parts[1]
 	version := parts[2]
 
-	s.logger.Info("download requested",
+	s.logger.InfoContext(r.Context(), msg,
 		"component", component,
 		"platform", platform,
 		"version", version,
-		"remote", r.RemoteAddr,
 	)
 
 	// Validate inputs
-	if !isValidComponent(component) || !isValidPlatform(platform) {
+	if !s.isValidComponent(component) || !isValidPlatform(platform) {
 		http.Error(w, "Invalid component or platform", http.StatusBadRequest)
-		return
+		return "", false
+	}
+	if _, err := update.ParseVersion(version); err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return "", false
 	}
 
 	// Construct file path
-	filename := fmt.Sprintf("%s-%s", component, platform)
-	if strings.HasPrefix(platform, "windows") {
-		filename += ".exe"
+	filename, err := s.namer.Name(component, version, platform)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to render asset name", "error", err)
+		http.Error(w, "Invalid asset name", http.StatusInternalServerError)
+		return "", false
 	}
 
 	filePath := filepath.Join(s.assetsDir, component, version, filename)
 
 	// Check file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		s.logger.Warn("file not found", "path", filePath)
+		s.logger.WarnContext(r.Context(), "file not found", "path", filePath)
 		http.Error(w, "File not found", http.StatusNotFound)
-		return
+		return "", false
+	}
+
+	return filePath, true
+}
+
+// openAsset opens a stored asset, decrypting it if it is encrypted at rest
+func (s *Server) openAsset(path string) (*update.AssetFile, error) {
+	return update.OpenAsset(context.Background(), path, s.encryption)
+}
+
+// archiveHooks lists the hook scripts an archive asset for platform carries
+func (s *Server) archiveHooks(path, format, platform string) ([]string, error) {
+	asset, err := s.openAsset(path)
+	if err != nil {
+		return nil, err
 	}
+	defer asset.Close()
 
-	// Serve file
-	http.ServeFile(w, r, filePath)
+	suffix := ""
+	if strings.HasPrefix(platform, "windows-") {
+		suffix = ".cmd"
+	}
+	return update.ArchiveHooks(asset, asset.Size(), format, suffix)
 }
 
-func (s *Server) generateManifest() (*update.Manifest, error) {
+func (s *Server) readAsset(path string) ([]byte, error) {
+	asset, err := s.openAsset(path)
+	if err != nil {
+		return nil, err
+	}
+	defer asset.Close()
+
+	return io.ReadAll(asset)
+}
+
+// privateKeyID returns the ID of the content key a stored asset is encrypted
+// end to end with, or "" for a public asset
+func (s *Server) privateKeyID(path string) (string, error) {
+	asset, err := s.openAsset(path)
+	if err != nil {
+		return "", err
+	}
+	defer asset.Close()
+
+	keyID, _, err := update.PrivateKeyID(asset)
+	return keyID, err
+}
+
+// assetDigests returns a stored asset's size and digests, of its plaintext
+// when it is encrypted at rest
+func (s *Server) assetDigests(path string, algorithms ...string) (int64, map[string]string, error) {
+	asset, err := s.openAsset(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer asset.Close()
+
+	digests, err := update.ReaderDigests(asset, algorithms...)
+	if err != nil {
+		return 0, nil, err
+	}
+	return asset.Size(), digests, nil
+}
+
+// generateManifest builds the manifest of a release channel from the assets
+// directory; it offers the releases published on that channel only.
+// Releases being rolled out to some clients are left out, and returned as
+// rollouts to stage per client, along with the releases targeting rules
+// offer the clients they match. Renamed components are listed under their
+// former names too.
+func (s *Server) generateManifest(channel string) (*generatedManifest, error) {
 	manifest := &update.Manifest{
-		SchemaVersion: 1,
+		SchemaVersion: update.SchemaVersion,
 		Generated:     time.Now().UTC(),
 		Components:    make(map[string]update.Component),
 	}
-
-	// Scan assets directory for components
-	components := []string{"nametag", "nametag-up"}
-	platforms := []string{
-		"darwin-amd64", "darwin-arm64",
-		"linux-amd64", "linux-arm64",
-		"windows-amd64",
+	if channel != update.ChannelStable {
+		manifest.Channel = channel
+	}
+	keys, _ := s.manifestKeys(channel)
+	if s.manifestTTL > 0 {
+		manifest.Expires = manifest.Generated.Add(s.manifestTTL)
+	}
+	if s.nextCheck > 0 {
+		manifest.NextCheckAfter = int64(s.nextCheck.Seconds())
 	}
 
-	for _, comp := range components {
+	// Scan assets directory for components
+	rollouts := make(map[string]rollout)
+	targets := make(map[string][]target)
+	aliases := make(map[string]string)
+	for _, comp := range s.components {
 		compDir := filepath.Join(s.assetsDir, comp)
 		if _, err := os.Stat(compDir); os.IsNotExist(err) {
 			continue
 		}
 
-		// Find latest version
-		versions, err := os.ReadDir(compDir)
+		state, err := s.releaseState(comp)
 		if err != nil {
-			continue
+			return nil, err
+		}
+		restart, err := readRestart(filepath.Join(compDir, update.RestartFile))
+		if err != nil {
+			return nil, err
+		}
+
+		// Everyone is offered what would be offered if the versions being
+		// rolled out were yanked
+		held := *state
+		held.Yanked = slices.Concat(state.Yanked, slices.Collect(maps.Keys(state.Rollouts)))
+		releases, err := s.releases(comp)
+		if err != nil {
+			return nil, err
+		}
+		version := offeredVersion(releases, &held, channel)
+		staged := offeredVersion(releases, state, channel)
+
+		if version != "" {
+			component, err := s.generateComponent(comp, compDir, version, releases, restart, keys)
+			if err != nil {
+				return nil, err
+			}
+			if len(component.Assets) > 0 {
+				manifest.Components[comp] = component
+			}
+		}
+		if staged != "" && staged != version {
+			component, err := s.generateComponent(comp, compDir, staged, releases, restart, keys)
+			if err != nil {
+				return nil, err
+			}
+			if len(component.Assets) > 0 {
+				rollouts[comp] = rollout{percent: state.Rollouts[staged], component: component}
+			}
 		}
 
-		var latestVersion string
-		for _, v := range versions {
-			if v.IsDir() {
-				latestVersion = v.Name()
+		var offered *update.Component
+		if component, ok := manifest.Components[comp]; ok {
+			offered = &component
+		}
+		compTargets, err := s.generateTargets(comp, compDir, releases, state, channel, offered, restart, keys)
+		if err != nil {
+			return nil, err
+		}
+		if len(compTargets) > 0 {
+			targets[comp] = compTargets
+		}
+
+		compAliases, err := s.readAliases(comp, compDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, alias := range compAliases {
+			if other, ok := aliases[alias]; ok {
+				return nil, fmt.Errorf("alias %q is claimed by both %s and %s", alias, other, comp)
 			}
+			aliases[alias] = comp
 		}
+	}
+	applyAliases(manifest, aliases)
 
-		if latestVersion == "" {
+	return &generatedManifest{manifest: manifest, rollouts: rollouts, targets: targets, aliases: aliases}, nil
+}
+
+// generateComponent builds the manifest entry of a component's version,
+// with the assets of the platforms it was published for. Its release date
+// is when the version was published, among releases, so that the manifest
+// and its ETag stay put while nothing is published.
+func (s *Server) generateComponent(comp, compDir, version string, releases []catalog.Release, restart *update.Restart, keys []ed25519.PrivateKey) (update.Component, error) {
+	component := update.Component{
+		Name:        comp,
+		Version:     version,
+		ReleaseDate: time.Now().UTC(),
+		Assets:      make(map[string]update.Asset),
+		Restart:     restart,
+	}
+	if release, ok := findRelease(releases, version); ok {
+		component.ReleaseDate = release.Published
+	}
+
+	if notes, err := os.ReadFile(filepath.Join(compDir, version, update.ChangelogFile)); err == nil {
+		component.Changelog = strings.TrimSpace(string(notes))
+	}
+	if _, err := os.Stat(filepath.Join(compDir, version, update.CriticalFile)); err == nil {
+		component.Critical = true
+	}
+	installDirs, err := readInstallDirs(filepath.Join(compDir, version, update.InstallFile))
+	if err != nil {
+		return update.Component{}, err
+	}
+	component.InstallDirs = installDirs
+
+	// Offer the assets the catalog lists, of the platforms still served
+	published, err := s.catalog.Assets(context.Background(), comp, version)
+	if err != nil {
+		return update.Component{}, err
+	}
+	for _, plat := range platforms {
+		if _, ok := published[plat]; !ok {
 			continue
 		}
+		filename, err := s.namer.Name(comp, version, plat)
+		if err != nil {
+			return update.Component{}, fmt.Errorf("render asset name: %w", err)
+		}
 
-		component := update.Component{
-			Name:        comp,
-			Version:     latestVersion,
-			ReleaseDate: time.Now().UTC(),
-			Assets:      make(map[string]update.Asset),
+		filePath := filepath.Join(compDir, version, filename)
+		if _, err := os.Stat(filePath); err != nil {
+			s.logger.Warn("published asset is missing", "file", filePath, "error", err)
+			continue
 		}
 
-		// Find assets for each platform
-		for _, plat := range platforms {
-			filename := fmt.Sprintf("%s-%s", comp, plat)
-			if strings.HasPrefix(plat, "windows") {
-				filename += ".exe"
-			}
+		size, digests, err := s.cachedDigests(filePath, s.digests...)
+		if errors.Is(err, update.ErrAssetEncrypted) || errors.Is(err, update.ErrUnwrapKey) {
+			// Not a damaged file but a misconfigured server or KMS
+			return update.Component{}, fmt.Errorf("%s: %w", filePath, err)
+		}
+		if err != nil {
+			s.logger.Warn("failed to compute hash", "file", filePath, "error", err)
+			continue
+		}
+		hash, hashes := update.SplitDigests(digests)
 
-			filePath := filepath.Join(compDir, latestVersion, filename)
-			info, err := os.Stat(filePath)
+		asset := update.Asset{
+			URL:    s.path(update.AssetURL(comp, plat, version)),
+			Size:   size,
+			SHA256: hash,
+			Hashes: hashes,
+			Format: update.ArchiveFormat(filename),
+		}
+		if len(keys) > 0 {
+			asset.SignatureURL = s.path(update.SignatureURL(comp, plat, version))
+		} else if _, err := os.Stat(filePath + update.MinisignExtension); err == nil {
+			asset.SignatureURL = s.path(update.SignatureURL(comp, plat, version))
+		}
+		if _, err := os.Stat(filePath + update.GPGExtension); err == nil {
+			asset.GPGSignatureURL = s.path(update.GPGSignatureURL(comp, plat, version))
+		}
+		if _, err := os.Stat(filePath + update.ProvenanceExtension); err == nil {
+			asset.ProvenanceURL = s.path(update.ProvenanceURL(comp, plat, version))
+		}
+		if _, format, ok := update.FindSBOM(filePath); ok {
+			asset.SBOMURL = s.path(update.SBOMURL(comp, plat, version))
+			asset.SBOMFormat = format
+		}
+		keyID, err := s.privateKeyID(filePath)
+		if err != nil {
+			s.logger.Warn("failed to read asset header", "file", filePath, "error", err)
+			continue
+		}
+		asset.KeyID = keyID
+		if asset.Format != "" && keyID == "" {
+			hooks, err := s.archiveHooks(filePath, asset.Format, plat)
 			if err != nil {
+				s.logger.Warn("failed to list archive hooks", "file", filePath, "error", err)
 				continue
 			}
+			asset.Hooks = hooks
+		}
 
-			// Compute SHA256
-			hash, err := computeSHA256(filePath)
-			if err != nil {
-				s.logger.Warn("failed to compute hash", "file", filePath, "error", err)
-				continue
-			}
+		component.Assets[plat] = asset
+	}
 
-			component.Assets[plat] = update.Asset{
-				URL:    fmt.Sprintf("/v1/download/%s/%s/%s", comp, plat, latestVersion),
-				Size:   info.Size(),
-				SHA256: hash,
-			}
-		}
+	return component, nil
+}
 
-		if len(component.Assets) > 0 {
-			manifest.Components[comp] = component
-		}
+// readRestart loads a component's optional restart policy
+func readRestart(path string) (*update.Restart, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read restart policy: %w", err)
+	}
+
+	var restart update.Restart
+	if err := json.Unmarshal(data, &restart); err != nil {
+		return nil, fmt.Errorf("decode restart policy %s: %w", path, err)
 	}
 
-	return manifest, nil
+	return &restart, nil
 }
 
-func computeSHA256(path string) (string, error) {
-	f, err := os.Open(path)
+// readInstallDirs loads the install directories a release declares, by OS;
+// a release without them is installed wherever its clients are
+func readInstallDirs(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("read install dirs: %w", err)
 	}
-	defer f.Close()
 
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
+	var dirs map[string]string
+	if err := json.Unmarshal(data, &dirs); err != nil {
+		return nil, fmt.Errorf("decode install dirs %s: %w", path, err)
+	}
+	for goos := range dirs {
+		if !slices.ContainsFunc(platforms, func(p string) bool { return strings.HasPrefix(p, goos+"-") }) {
+			return nil, fmt.Errorf("install dirs %s: unknown OS %q", path, goos)
+		}
 	}
+	return dirs, nil
+}
 
-	return hex.EncodeToString(h.Sum(nil)), nil
+// Components and platforms the server publishes, replaced by -components
+// and -platforms
+var (
+	components = []string{"nametag", "nametag-up"}
+	platforms  = []string{
+		"darwin-amd64", "darwin-arm64",
+		"linux-amd64", "linux-arm64",
+		"windows-amd64",
+	}
+)
+
+// parseComponents parses the comma-separated list of -components. Names
+// end up in paths and asset filenames, so they are restricted to lowercase
+// letters, digits, and dashes.
+func parseComponents(list string) ([]string, error) {
+	names := strings.Split(list, ",")
+	for _, name := range names {
+		if name == "" || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return nil, fmt.Errorf("invalid component name %q", name)
+		}
+	}
+	return names, nil
+}
+
+// parsePlatforms parses the comma-separated os-arch pairs of -platforms
+func parsePlatforms(list string) ([]string, error) {
+	names := strings.Split(list, ",")
+	for _, name := range names {
+		goos, goarch, ok := strings.Cut(name, "-")
+		if !ok || goos == "" || goarch == "" ||
+			strings.Trim(goos+goarch, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+			return nil, fmt.Errorf("invalid platform %q (must be os-arch, e.g. linux-amd64)", name)
+		}
+	}
+	return names, nil
 }
 
-func isValidComponent(c string) bool {
-	return c == "nametag" || c == "nametag-up"
+func (s *Server) isValidComponent(c string) bool {
+	return slices.Contains(s.components, c)
 }
 
 func isValidPlatform(p string) bool {
-	valid := map[string]bool{
-		"darwin-amd64":  true,
-		"darwin-arm64":  true,
-		"linux-amd64":   true,
-		"linux-arm64":   true,
-		"windows-amd64": true,
-	}
-	return valid[p]
+	return slices.Contains(platforms, p)
 }
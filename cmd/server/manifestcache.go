@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// manifestCache keeps the generated manifest of each channel until the
+// catalog or the assets directory changes. Generating one hashes every
+// offered asset, too slow to repeat per request; a change is noticed by the
+// catalog's change serial and by fingerprinting the tree's sizes and
+// modification times, only a walk of stat calls, at most once per interval.
+// The server's own writes invalidate it at once.
+type manifestCache struct {
+	interval time.Duration
+
+	mu          sync.Mutex
+	checked     time.Time
+	fingerprint [sha256.Size]byte
+	// modified is the latest modification time in the fingerprinted tree
+	modified  time.Time
+	manifests map[string]*generatedManifest
+}
+
+// generatedManifest is a channel's manifest with the releases it offers some
+// clients only
+type generatedManifest struct {
+	manifest *update.Manifest
+	rollouts map[string]rollout
+	// targets are each component's targeting rules, in order
+	targets map[string][]target
+	// aliases are the current names of renamed components, by former name
+	aliases map[string]string
+}
+
+func newManifestCache(interval time.Duration) *manifestCache {
+	return &manifestCache{interval: interval, manifests: make(map[string]*generatedManifest)}
+}
+
+// manifest returns channel's manifest with the rollouts and targeting rules
+// to apply per client, from the cache when the server keeps one. The caller
+// may change the returned manifest's components.
+func (s *Server) manifest(channel string) (*generatedManifest, error) {
+	if s.manifests == nil {
+		return s.generateManifest(channel)
+	}
+	return s.manifests.get(s, channel)
+}
+
+func (c *manifestCache) get(s *Server, channel string) (*generatedManifest, error) {
+	// Held while generating, so a burst of requests after a change hashes
+	// the tree once
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.checked) >= c.interval {
+		// Taken before generating: a change made meanwhile shows up in the
+		// next fingerprint rather than being cached as seen
+		fingerprint, modified, err := s.manifestFingerprint()
+		if err != nil {
+			return nil, err
+		}
+		if fingerprint != c.fingerprint {
+			clear(c.manifests)
+			c.fingerprint, c.modified = fingerprint, modified
+		}
+		c.checked = now
+	}
+
+	cached, ok := c.manifests[channel]
+	if !ok {
+		generated, err := s.generateManifest(channel)
+		if err != nil {
+			return nil, err
+		}
+		cached = generated
+		c.manifests[channel] = cached
+	}
+
+	// Timestamps are the serving time's, as a generated manifest's would be
+	manifest := *cached.manifest
+	manifest.Components = maps.Clone(cached.manifest.Components)
+	manifest.Generated = now.UTC()
+	if s.manifestTTL > 0 {
+		manifest.Expires = manifest.Generated.Add(s.manifestTTL)
+	}
+	return &generatedManifest{manifest: &manifest, rollouts: cached.rollouts, targets: cached.targets, aliases: cached.aliases}, nil
+}
+
+// manifestModified returns when the files manifests are generated from last
+// changed, as of the manifest last returned
+func (s *Server) manifestModified() (time.Time, error) {
+	if s.manifests == nil {
+		_, modified, err := s.manifestFingerprint()
+		return modified, err
+	}
+	s.manifests.mu.Lock()
+	defer s.manifests.mu.Unlock()
+	return s.manifests.modified, nil
+}
+
+// invalidate drops the cached manifests after the server changed the
+// assets directory itself
+func (c *manifestCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.manifests)
+	c.checked = time.Time{}
+}
+
+// lintReport is the validation report of the manifests generated from the
+// assets directory as of fingerprint
+type lintReport struct {
+	fingerprint [sha256.Size]byte
+	issues      []error
+}
+
+// cachedLint returns the validation report of the manifests. Linting
+// generates every channel's manifest and every targeting rule's, so the
+// report is kept until the assets directory changes rather than redone for
+// each request.
+func (s *Server) cachedLint() ([]error, error) {
+	if s.manifestFile != "" {
+		return s.lintManifest()
+	}
+	fingerprint, _, err := s.manifestFingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	s.lintMu.Lock()
+	defer s.lintMu.Unlock()
+	if s.lint != nil && s.lint.fingerprint == fingerprint {
+		return s.lint.issues, nil
+	}
+	issues, err := s.lintManifest()
+	if err != nil {
+		return nil, err
+	}
+	s.lint = &lintReport{fingerprint: fingerprint, issues: issues}
+	return issues, nil
+}
+
+// manifestFingerprint fingerprints everything manifests are generated from:
+// the catalog, by its change serial, and the files of the assets directory.
+// It returns the latest change among them too.
+func (s *Server) manifestFingerprint() ([sha256.Size]byte, time.Time, error) {
+	files, modified, err := assetsFingerprint(s.assetsDir, s.components)
+	if err != nil {
+		return [sha256.Size]byte{}, time.Time{}, err
+	}
+	serial, changed, err := s.catalog.Changed(context.Background())
+	if err != nil {
+		return [sha256.Size]byte{}, time.Time{}, err
+	}
+	if changed.After(modified) {
+		modified = changed
+	}
+	h := sha256.New()
+	h.Write(files[:])
+	binary.Write(h, binary.BigEndian, serial)
+	return [sha256.Size]byte(h.Sum(nil)), modified, nil
+}
+
+// assetsFingerprint hashes the name, size, and modification time of every
+// file under the components' directories, the files manifests are read
+// from, and returns the latest modification time among them
+func assetsFingerprint(assetsDir string, components []string) ([sha256.Size]byte, time.Time, error) {
+	h := sha256.New()
+	var modified time.Time
+	var buf [16]byte
+	for _, comp := range components {
+		root := filepath.Join(assetsDir, comp)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if errors.Is(err, os.ErrNotExist) {
+				// A component not published yet, or a file removed mid-walk
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(modified) {
+				modified = info.ModTime()
+			}
+			binary.BigEndian.PutUint64(buf[:8], uint64(info.Size()))
+			binary.BigEndian.PutUint64(buf[8:], uint64(info.ModTime().UnixNano()))
+			h.Write([]byte(path))
+			h.Write([]byte{0})
+			h.Write(buf[:])
+			return nil
+		})
+		if err != nil {
+			return [sha256.Size]byte{}, time.Time{}, err
+		}
+	}
+	return [sha256.Size]byte(h.Sum(nil)), modified, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// Metric names, which the generated dashboards query. The product label is
+// empty for the default product, as in exported records.
+const (
+	metricManifestRequests = "nametag_manifest_requests_total"
+	metricDownloads        = "nametag_downloads_total"
+	metricDownloadBytes    = "nametag_download_bytes_total"
+	metricOfferedVersion   = "nametag_offered_version"
+)
+
+type manifestMetricKey struct {
+	product, channel string
+	status           int
+}
+
+type downloadMetricKey struct {
+	product, component, platform, version string
+	status                                int
+}
+
+type offerMetricKey struct {
+	product, channel, component string
+}
+
+// metrics counts what the server hands out, for Prometheus to scrape from
+// /metrics. It's shared by the servers of all products.
+type metrics struct {
+	mu               sync.Mutex
+	manifestRequests map[manifestMetricKey]uint64
+	downloads        map[downloadMetricKey]uint64
+	downloadBytes    map[downloadMetricKey]uint64
+	// offered is the version each channel's manifest last offered
+	offered map[offerMetricKey]string
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		manifestRequests: make(map[manifestMetricKey]uint64),
+		downloads:        make(map[downloadMetricKey]uint64),
+		downloadBytes:    make(map[downloadMetricKey]uint64),
+		offered:          make(map[offerMetricKey]string),
+	}
+}
+
+// manifestServed counts a manifest response and records the versions it
+// offers
+func (m *metrics) manifestServed(product, channel string, status int, manifest *update.Manifest) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.manifestRequests[manifestMetricKey{product, channel, status}]++
+	for name, comp := range manifest.Components {
+		m.offered[offerMetricKey{product, channel, name}] = comp.Version
+	}
+}
+
+// downloadServed counts a download response and the bytes it sent
+func (m *metrics) downloadServed(product, comp, plat, version string, status int, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := downloadMetricKey{product, comp, plat, version, status}
+	m.downloads[key]++
+	m.downloadBytes[key] += uint64(bytes)
+}
+
+// downloadCounts returns the downloads of a version served since the server
+// started, by platform, resumed ones included
+func (m *metrics) downloadCounts(product, comp, version string) map[string]uint64 {
+	counts := make(map[string]uint64)
+	if m == nil {
+		return counts
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, n := range m.downloads {
+		if k.product == product && k.component == comp && k.version == version &&
+			(k.status == http.StatusOK || k.status == http.StatusPartialContent) {
+			counts[k.platform] += n
+		}
+	}
+	return counts
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats alternating label names and values
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// writeTo writes the metrics in the Prometheus text format, series sorted
+// so consecutive scrapes diff cleanly
+func (m *metrics) writeTo(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series := func(name, kind, help string, lines []string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		slices.Sort(lines)
+		for _, line := range lines {
+			w.WriteString(name + line + "\n")
+		}
+	}
+
+	var lines []string
+	for k, n := range m.manifestRequests {
+		lines = append(lines, labels("product", k.product, "channel", k.channel, "status", strconv.Itoa(k.status))+" "+strconv.FormatUint(n, 10))
+	}
+	series(metricManifestRequests, "counter", "Manifest responses by channel and status.", lines)
+
+	downloads := func(values map[downloadMetricKey]uint64) []string {
+		var lines []string
+		for k, n := range values {
+			lines = append(lines, labels("product", k.product, "component", k.component, "platform", k.platform,
+				"version", k.version, "status", strconv.Itoa(k.status))+" "+strconv.FormatUint(n, 10))
+		}
+		return lines
+	}
+	series(metricDownloads, "counter", "Download responses by asset and status.", downloads(m.downloads))
+	series(metricDownloadBytes, "counter", "Bytes of assets sent by downloads.", downloads(m.downloadBytes))
+
+	lines = nil
+	for k, version := range m.offered {
+		lines = append(lines, labels("product", k.product, "channel", k.channel, "component", k.component, "version", version)+" 1")
+	}
+	series(metricOfferedVersion, "gauge", "Version each channel's manifest last offered, as a series valued 1.", lines)
+}
+
+// handleMetrics serves the metrics for Prometheus to scrape
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	s.metrics.writeTo(bw)
+	bw.Flush()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/buildinfo"
+)
+
+// serverMode controls what the server is willing to do, so the asset store
+// can be migrated safely
+type serverMode string
+
+const (
+	// modeNormal serves and accepts changes
+	modeNormal serverMode = "normal"
+	// modeReadOnly keeps serving but refuses anything that writes to the
+	// assets directory: publishes, promotions, yanks, and audits
+	modeReadOnly serverMode = "read-only"
+	// modeMaintenance answers everything but /health and the mode endpoint
+	// with 503 and Retry-After
+	modeMaintenance serverMode = "maintenance"
+)
+
+// modeState is the server's current mode; it is replaced, never modified
+type modeState struct {
+	Mode serverMode `json:"mode"`
+	// RetryAfter is what maintenance and read-only refusals tell clients
+	RetryAfter time.Duration `json:"-"`
+	Since      time.Time     `json:"since"`
+}
+
+// MarshalJSON renders RetryAfter as a duration string
+func (m modeState) MarshalJSON() ([]byte, error) {
+	type plain modeState
+	return json.Marshal(struct {
+		plain
+		RetryAfter string `json:"retry_after"`
+	}{plain(m), m.RetryAfter.String()})
+}
+
+func parseServerMode(s string) (serverMode, error) {
+	switch mode := serverMode(s); mode {
+	case modeNormal, modeReadOnly, modeMaintenance:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q", s)
+	}
+}
+
+// setMode switches the server's mode
+func (s *Server) setMode(mode serverMode, retryAfter time.Duration) {
+	s.mode.Store(&modeState{Mode: mode, RetryAfter: retryAfter, Since: time.Now().UTC()})
+}
+
+func (s *Server) currentMode() *modeState {
+	return s.mode.Load()
+}
+
+// modeExempt are the paths still served during maintenance
+var modeExempt = map[string]bool{
+	"/health":        true,
+	buildinfo.Path:   true,
+	"/v1/admin/mode": true,
+}
+
+// withMode answers requests with 503 while the server is in maintenance
+func (s *Server) withMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.currentMode().Mode == modeMaintenance && !modeExempt[r.URL.Path] {
+			s.unavailable(w, "Server is under maintenance")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectReadOnly answers a request that would write to the assets directory
+// with 503 when the server isn't accepting changes
+func (s *Server) rejectReadOnly(w http.ResponseWriter) bool {
+	if s.currentMode().Mode == modeNormal {
+		return false
+	}
+	s.unavailable(w, "Server is read-only")
+	return true
+}
+
+func (s *Server) unavailable(w http.ResponseWriter, msg string) {
+	if retryAfter := s.currentMode().RetryAfter; retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	}
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
+
+// handleMode serves /v1/admin/mode: GET reports the mode, and PUT with
+// {"mode": "...", "retry_after": "10m"} changes it
+func (s *Server) handleMode(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, roleReader) {
+			return
+		}
+	case http.MethodPut:
+		if !s.requireRole(w, r, rolePromoter) {
+			return
+		}
+
+		var req struct {
+			Mode       string `json:"mode"`
+			RetryAfter string `json:"retry_after"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		mode, err := parseServerMode(req.Mode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		retryAfter := s.currentMode().RetryAfter
+		if req.RetryAfter != "" {
+			retryAfter, err = time.ParseDuration(req.RetryAfter)
+			if err != nil || retryAfter < 0 {
+				http.Error(w, "Invalid retry_after", http.StatusBadRequest)
+				return
+			}
+		}
+
+		s.setMode(mode, retryAfter)
+		s.logger.WarnContext(r.Context(), "server mode changed",
+			"mode", mode,
+			"retry_after", retryAfter,
+			"actor", requestIdentity(r).Subject,
+		)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.currentMode())
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcClockSkew is how far token times may be off from the server clock
+	oidcClockSkew = time.Minute
+	// oidcKeysMaxAge is how long fetched signing keys are used before the
+	// JWKS is fetched again
+	oidcKeysMaxAge = time.Hour
+	// oidcRefetchInterval rate-limits JWKS fetches for unknown key IDs, so
+	// tokens with made-up key IDs can't hammer the identity provider
+	oidcRefetchInterval = 30 * time.Second
+	// maxOIDCDocumentSize caps discovery documents and key sets
+	maxOIDCDocumentSize = 1 << 20
+)
+
+// oidcAuth accepts bearer JWTs issued by an OpenID Connect provider for the
+// configured audience. For the admin scope, the caller's roles come from a
+// token claim whose values name roles directly or are mapped to them.
+type oidcAuth struct {
+	issuer     string
+	audience   string
+	rolesClaim string
+	roleMap    map[string]role
+	scopes     []authScope
+	httpClient *http.Client
+	logger     *slog.Logger
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	lastFetch time.Time
+	// fetching is closed when the key set fetch in flight is done
+	fetching chan struct{}
+}
+
+func newOIDCAuth(issuer, audience, rolesClaim string, roleMap map[string]role, scopes []authScope, logger *slog.Logger) *oidcAuth {
+	return &oidcAuth{
+		issuer:     strings.TrimSuffix(issuer, "/"),
+		audience:   audience,
+		rolesClaim: rolesClaim,
+		roleMap:    roleMap,
+		scopes:     scopes,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		logger:     logger,
+	}
+}
+
+func (a *oidcAuth) Scopes() []authScope {
+	return a.scopes
+}
+
+func (a *oidcAuth) Authenticate(r *http.Request, scope authScope) (*identity, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, errUnauthenticated
+	}
+
+	claims, err := a.verify(r.Context(), token)
+	if err != nil {
+		a.logger.WarnContext(r.Context(), "rejected oidc token", "error", err)
+		return nil, errUnauthenticated
+	}
+
+	// Any valid token may fetch manifests and downloads; only the admin
+	// API needs roles
+	id := &identity{Subject: claims.subject(), Roles: a.roles(claims)}
+	if scope == scopeAdmin && len(id.Roles) == 0 {
+		return nil, errForbidden
+	}
+	return id, nil
+}
+
+// jwtHeader is the JOSE header of a signed JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims holds a verified token's claims
+type jwtClaims map[string]any
+
+// subject names the caller, preferring a human-readable email
+func (c jwtClaims) subject() string {
+	if email, ok := c["email"].(string); ok && email != "" {
+		return email
+	}
+	sub, _ := c["sub"].(string)
+	return sub
+}
+
+// strings returns a claim that is either a string or an array of strings
+func (c jwtClaims) strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var out []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// time returns a NumericDate claim
+func (c jwtClaims) time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// roles maps the token's roles claim to roles
+func (a *oidcAuth) roles(claims jwtClaims) []role {
+	var names []string
+	for _, value := range claims.strings(a.rolesClaim) {
+		if mapped, ok := a.roleMap[value]; ok {
+			names = append(names, string(mapped))
+		} else {
+			names = append(names, value)
+		}
+	}
+	return parseRoles(names)
+}
+
+// verify checks a compact JWS token's signature against the provider's keys
+// and validates its issuer, audience, and validity period
+func (a *oidcAuth) verify(ctx context.Context, token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("decode header: %w", err)
+	}
+
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("decode signature: %w", err)
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("decode claims: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != a.issuer {
+		return nil, fmt.Errorf("issuer %q is not trusted", iss)
+	}
+	if !slices.Contains(claims.strings("aud"), a.audience) {
+		return nil, fmt.Errorf("token is not for audience %q", a.audience)
+	}
+
+	now := time.Now()
+	exp, ok := claims.time("exp")
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(oidcClockSkew)) {
+		return nil, errors.New("token has expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(oidcClockSkew).Before(nbf) {
+		return nil, errors.New("token is not valid yet")
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyJWS checks a JWS signature. The algorithm must match the key type,
+// which rules out "none" and algorithm confusion.
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	digest := sha256.Sum256(signed)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || k.Curve != elliptic.P256() {
+			break
+		}
+		if len(sig) != 64 {
+			return errors.New("invalid token signature")
+		}
+		rs, ss := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], rs, ss) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(k, signed, sig) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported token algorithm %q for key", alg)
+}
+
+// key returns the provider's signing key kid. A stale key set is refreshed
+// in the background while its keys keep being served; a kid it doesn't know
+// yet waits for a fetch.
+func (a *oidcAuth) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	key, ok := a.keys[kid]
+	if ok {
+		if time.Since(a.fetched) > oidcKeysMaxAge {
+			a.refresh(ctx)
+		}
+		a.mu.Unlock()
+		return key, nil
+	}
+	done := a.refresh(ctx)
+	a.mu.Unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		a.mu.Lock()
+		key, ok = a.keys[kid]
+		a.mu.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the key set unless a fetch started within
+// oidcRefetchInterval, and returns a channel closed once the fetch in
+// flight is done, or nil if there is none. The fetch runs without a.mu, so
+// tokens signed with known keys are verified meanwhile, and outlives the
+// request that started it. a.mu must be held.
+func (a *oidcAuth) refresh(ctx context.Context) <-chan struct{} {
+	if a.fetching != nil {
+		return a.fetching
+	}
+	if time.Since(a.lastFetch) < oidcRefetchInterval {
+		return nil
+	}
+	a.lastFetch = time.Now()
+
+	done := make(chan struct{})
+	a.fetching = done
+	go func() {
+		keys, err := a.fetchKeys(context.WithoutCancel(ctx))
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if err != nil {
+			// Keep using the keys we have while the provider is unreachable
+			a.logger.Error("failed to fetch oidc signing keys", "issuer", a.issuer, "error", err)
+		} else {
+			a.keys = keys
+			a.fetched = time.Now()
+		}
+		a.fetching = nil
+		close(done)
+	}()
+	return done
+}
+
+// fetchKeys discovers the provider's JWKS and decodes its signing keys
+func (a *oidcAuth) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := a.getJSON(ctx, a.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != a.issuer {
+		return nil, fmt.Errorf("discovery names issuer %q", discovery.Issuer)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := a.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			a.logger.Warn("skipping oidc signing key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (a *oidcAuth) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxOIDCDocumentSize)).Decode(v)
+}
+
+// jwk is a JSON Web Key of one of the types verifyJWS supports
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	field := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch {
+	case k.Kty == "RSA":
+		n, err := field(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := field(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.BitLen() < 2048 || !e.IsInt64() {
+			return nil, errors.New("weak or invalid rsa key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != 32 {
+			return nil, errors.New("invalid ec key")
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil || len(y) != 32 {
+			return nil, errors.New("invalid ec key")
+		}
+		// Parsing the uncompressed point also checks it is on the curve
+		point := append(append([]byte{4}, x...), y...)
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+}
+
+// parseRoleMap decodes "claim-value=role,..." pairs
+func parseRoleMap(s string) (map[string]role, error) {
+	m := make(map[string]role)
+	if s == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		value, name, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !slices.Contains(allRoles, role(name)) {
+			return nil, fmt.Errorf("invalid role mapping %q", pair)
+		}
+		m[value] = role(name)
+	}
+	return m, nil
+}
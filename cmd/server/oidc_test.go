@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeOIDCProvider serves discovery and a JWKS of one Ed25519 key, kid
+// "k1". Key set fetches block while gate is open.
+type fakeOIDCProvider struct {
+	srv     *httptest.Server
+	key     ed25519.PrivateKey
+	fetches atomic.Int32
+	// started receives once per key set fetch, before it blocks on gate
+	started chan struct{}
+	gate    chan struct{}
+	opened  sync.Once
+}
+
+func newFakeOIDCProvider(t *testing.T, blocking bool) *fakeOIDCProvider {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeOIDCProvider{key: priv, started: make(chan struct{}, 16), gate: make(chan struct{})}
+	if !blocking {
+		p.release()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": p.srv.URL, "jwks_uri": p.srv.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.fetches.Add(1)
+		p.started <- struct{}{}
+		<-p.gate
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "OKP", "crv": "Ed25519", "kid": "k1", "use": "sig",
+			"x": base64.RawURLEncoding.EncodeToString(pub),
+		}}})
+	})
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	// Runs before Close, so no fetch is left blocked
+	t.Cleanup(p.release)
+	return p
+}
+
+// release lets key set fetches through
+func (p *fakeOIDCProvider) release() {
+	p.opened.Do(func() { close(p.gate) })
+}
+
+// token signs claims, with the standard ones filled in unless given
+func (p *fakeOIDCProvider) token(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+	full := map[string]any{"iss": p.srv.URL, "aud": "nametag", "sub": "user", "exp": time.Now().Add(time.Hour).Unix()}
+	for k, v := range claims {
+		if v == nil {
+			delete(full, k)
+		} else {
+			full[k] = v
+		}
+	}
+	segment := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(jwtHeader{Alg: "EdDSA", Kid: kid}) + "." + segment(full)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(p.key, []byte(signed)))
+}
+
+func newTestOIDCAuth(p *fakeOIDCProvider) *oidcAuth {
+	return newOIDCAuth(p.srv.URL, "nametag", "roles", nil, []authScope{scopeManifest}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestOIDCAuthVerify(t *testing.T) {
+	p := newFakeOIDCProvider(t, false)
+	auth := newTestOIDCAuth(p)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"valid", p.token(t, "k1", nil), ""},
+		{"other audience", p.token(t, "k1", map[string]any{"aud": "other"}), "audience"},
+		{"other issuer", p.token(t, "k1", map[string]any{"iss": "https://evil.example"}), "issuer"},
+		{"expired", p.token(t, "k1", map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}), "expired"},
+		{"no expiry", p.token(t, "k1", map[string]any{"exp": nil}), "no expiry"},
+		{"unknown key", p.token(t, "k2", nil), "unknown signing key"},
+		{"tampered", p.token(t, "k1", nil) + "A", "signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := auth.verify(context.Background(), tt.token)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("verify() = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("verify() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOIDCAuthSharesKeyFetch(t *testing.T) {
+	p := newFakeOIDCProvider(t, true)
+	auth := newTestOIDCAuth(p)
+
+	const callers = 8
+	errs := make(chan error, callers)
+	for range callers {
+		go func() {
+			_, err := auth.key(context.Background(), "k1")
+			errs <- err
+		}()
+	}
+	<-p.started
+	p.release()
+	for range callers {
+		if err := <-errs; err != nil {
+			t.Errorf("key() = %v", err)
+		}
+	}
+	if n := p.fetches.Load(); n != 1 {
+		t.Errorf("fetched the key set %d times, want 1", n)
+	}
+}
+
+func TestOIDCAuthServesStaleKeysWhileFetching(t *testing.T) {
+	p := newFakeOIDCProvider(t, true)
+	auth := newTestOIDCAuth(p)
+	auth.keys = map[string]crypto.PublicKey{"k1": p.key.Public()}
+	auth.fetched = time.Now().Add(-2 * oidcKeysMaxAge)
+
+	// The refresh blocks at the provider; verifying mustn't wait for it
+	for range 3 {
+		if _, err := auth.verify(context.Background(), p.token(t, "k1", nil)); err != nil {
+			t.Fatalf("verify() = %v", err)
+		}
+	}
+	<-p.started
+
+	// A key the cached set lacks waits for the fetch in flight, or gives
+	// up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := auth.key(ctx, "k2"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("key() while fetching = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	p.release()
+	auth.mu.Lock()
+	done := auth.fetching
+	auth.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	if n := p.fetches.Load(); n != 1 {
+		t.Errorf("fetched the key set %d times, want 1", n)
+	}
+	if time.Since(auth.fetched) > time.Minute {
+		t.Error("the refreshed key set was not stored")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// productFile lists the products a server distributes besides its default
+// one, each an independent application with its own releases, keys, and
+// credentials
+type productFile struct {
+	Products []productConfig `json:"products"`
+}
+
+type productConfig struct {
+	// Name is the product's namespace, /v1/{name}/
+	Name string `json:"name"`
+	// Assets is the product's assets directory
+	Assets     string   `json:"assets"`
+	Components []string `json:"components"`
+	// Storage is an object store to keep the product's releases in, like
+	// -storage; Assets is then its local copy
+	Storage string `json:"storage,omitempty"`
+	// CDNURL is the CDN mirroring the product's assets, signed like
+	// -cdn-url's; the product's downloads otherwise go to
+	// -cdn-url/{name}/ when that is set
+	CDNURL string `json:"cdn_url,omitempty"`
+	// SigningKey is a comma-separated list of PEM Ed25519 keys, like
+	// -signing-key
+	SigningKey string `json:"signing_key,omitempty"`
+	// KeysDir holds the product's key rotation documents, like -keys-dir
+	KeysDir string `json:"keys_dir,omitempty"`
+	// APIKeys is a key file like -api-keys'; when set, the product's
+	// manifests and downloads require one of its keys
+	APIKeys string `json:"api_keys,omitempty"`
+	// AdminToken is a bearer token for the product's admin endpoints
+	AdminToken string `json:"admin_token,omitempty"`
+}
+
+// readProducts loads and checks the product file at path
+func readProducts(path string) ([]productConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read products: %w", err)
+	}
+
+	var file productFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("decode products %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range file.Products {
+		if err := update.ValidateProduct(p.Name); err != nil {
+			return nil, err
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("product %s is listed twice", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Assets == "" || len(p.Components) == 0 {
+			return nil, fmt.Errorf("product %s needs assets and components", p.Name)
+		}
+	}
+	return file.Products, nil
+}
+
+// newProductServer returns the server of a product. It shares the default
+// server's asset naming, digests, manifest settings, and mode; everything
+// tied to a release line or its clients is the product's own.
+func (s *Server) newProductServer(p productConfig, requireSigned bool) (*Server, error) {
+	ps := &Server{
+		assetsDir:     p.Assets,
+		components:    p.Components,
+		product:       p.Name,
+		namer:         s.namer,
+		digests:       s.digests,
+		manifestTTL:   s.manifestTTL,
+		nextCheck:     s.nextCheck,
+		uploadMaxSize: s.uploadMaxSize,
+		keysDir:       p.KeysDir,
+		mode:          s.mode,
+		export:        s.export,
+		metrics:       s.metrics,
+		stats:         s.stats,
+		logger:        s.logger.With("product", p.Name),
+	}
+	if s.manifests != nil {
+		ps.manifests = newManifestCache(s.manifests.interval)
+	}
+	if s.dictionaries != nil {
+		ps.dictionaries = newDictionaryCache(s.dictionaries.capacity)
+	}
+	if s.hashes != nil {
+		ps.hashes = loadHashCache(p.Assets, ps.logger)
+	}
+	if err := ps.openCatalog(context.Background()); err != nil {
+		return nil, fmt.Errorf("product %s: %w", p.Name, err)
+	}
+	if p.Storage != "" {
+		storage, err := openStorageMirror(p.Storage, p.Assets, ps.logger)
+		if err != nil {
+			return nil, fmt.Errorf("product %s: %w", p.Name, err)
+		}
+		ps.storage = storage
+		if err := ps.syncStorage(context.Background()); err != nil {
+			return nil, fmt.Errorf("product %s: %w", p.Name, err)
+		}
+	}
+
+	if s.cdn != nil {
+		base := cmp.Or(p.CDNURL, s.cdn.base.JoinPath(p.Name).String())
+		cdn, err := s.cdn.withBase(base)
+		if err != nil {
+			return nil, fmt.Errorf("product %s: %w", p.Name, err)
+		}
+		ps.cdn = cdn
+	} else if p.CDNURL != "" {
+		return nil, fmt.Errorf("product %s: cdn_url requires -cdn-url", p.Name)
+	}
+
+	if p.SigningKey != "" {
+		for _, path := range strings.Split(p.SigningKey, ",") {
+			key, err := update.LoadPrivateKey(path)
+			if err != nil {
+				return nil, fmt.Errorf("product %s: %w", p.Name, err)
+			}
+			ps.signingKeys = append(ps.signingKeys, key)
+			ps.logger.Info("manifest signing enabled",
+				"public_key", update.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+			)
+		}
+		if ps.manifestTTL <= 0 {
+			return nil, fmt.Errorf("product %s: signed manifests need a positive -manifest-ttl", p.Name)
+		}
+	}
+	if p.AdminToken != "" {
+		ps.authenticators = append(ps.authenticators, &tokenAuth{token: p.AdminToken, scopes: []authScope{scopeAdmin}})
+	}
+	if p.APIKeys != "" {
+		auth, err := newAPIKeyAuth(p.APIKeys, requireSigned)
+		if err != nil {
+			return nil, fmt.Errorf("product %s: %w", p.Name, err)
+		}
+		ps.authenticators = append(ps.authenticators, auth)
+	}
+
+	// Fail fast rather than serve a subtly broken manifest
+	issues, err := ps.cachedLint()
+	if err != nil {
+		return nil, fmt.Errorf("product %s: generate manifest: %w", p.Name, err)
+	}
+	if len(issues) > 0 {
+		return nil, fmt.Errorf("product %s: manifest problems: %w", p.Name, errors.Join(issues...))
+	}
+	return ps, nil
+}
+
+// path moves a /v1/ server path into the server's product namespace
+func (s *Server) path(p string) string {
+	return update.ProductPath(s.product, p)
+}
+
+// productHandler serves /v1/{product}/... with the product's server, which
+// routes it as the default server would route /v1/...
+func (s *Server) productHandler() http.Handler {
+	mux := http.NewServeMux()
+	s.registerReleaseRoutes(mux)
+
+	prefix := "/v1/" + s.product
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/v1" + strings.TrimPrefix(r.URL.Path, prefix)
+		r2.URL.RawPath = ""
+		mux.ServeHTTP(w, r2)
+	})
+}
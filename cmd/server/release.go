@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/catalog"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// releaseFile is the name of the file in a component's directory that held
+// its operator-controlled release state before the catalog did
+const releaseFile = "release.json"
+
+// releaseState says which of a component's versions the manifest offers.
+// Revision increases with every change; admin mutations must name the
+// revision they were based on so concurrent operators can't clobber each
+// other.
+type releaseState struct {
+	Revision int64 `json:"revision"`
+	// Promoted pins the offered version; empty offers the newest one
+	Promoted string   `json:"promoted,omitempty"`
+	Yanked   []string `json:"yanked,omitempty"`
+	// Rollouts are the percentages of clients versions still being rolled
+	// out are offered to; the others are offered what they were before
+	Rollouts map[string]float64 `json:"rollouts,omitempty"`
+	Updated  time.Time          `json:"updated,omitzero"`
+}
+
+// releaseState loads a component's release state from the catalog; a
+// component without one is at revision 0
+func (s *Server) releaseState(comp string) (*releaseState, error) {
+	data, err := s.catalog.State(context.Background(), comp)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return &releaseState{}, nil
+	}
+
+	var state releaseState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("decode release state of %s: %w", comp, err)
+	}
+	return &state, nil
+}
+
+func (s *Server) writeReleaseState(comp string, state *releaseState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("encode release state: %w", err)
+	}
+	return s.catalog.SetState(context.Background(), comp, data)
+}
+
+// offeredVersion picks the version channel's manifest offers from a
+// component's releases published on it: the promoted one, or else the
+// newest not yanked
+func offeredVersion(releases []catalog.Release, state *releaseState, channel string) string {
+	latest := ""
+	for _, r := range releases {
+		if r.Channel != channel || slices.Contains(state.Yanked, r.Version) {
+			continue
+		}
+		if r.Version == state.Promoted {
+			return r.Version
+		}
+		if latest == "" {
+			latest = r.Version
+		}
+	}
+	return latest
+}
+
+// ETag of a release state revision
+func releaseETag(revision int64) string {
+	return strconv.Quote(strconv.FormatInt(revision, 10))
+}
+
+// Release state actions, named as they are in the audit log
+const (
+	releasePromote = update.AuditPromote
+	releaseYank    = update.AuditYank
+	releaseUnyank  = update.AuditUnyank
+	releaseRollout = update.AuditRollout
+	releaseChannel = update.AuditChannel
+)
+
+var (
+	errRevisionRequired = errors.New("If-Match with the current revision is required")
+	errRevisionConflict = errors.New("release state was changed by someone else")
+)
+
+// handleRelease serves the release state admin API:
+//
+//	GET  /v1/admin/components/{component}
+//	POST /v1/admin/components/{component}/{promote,yank,unyank,rollout,channel}
+//
+// Mutations take {"version": "..."}, rollout also {"percent": n}, and
+// channel {"channel": "..."}, the channel to move the version to. They need
+// If-Match set to the ETag of the state they were based on. Reading needs
+// the reader role and mutating the promoter role.
+func (s *Server) handleRelease(w http.ResponseWriter, r *http.Request) {
+	comp, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/admin/components/"), "/")
+	if !s.isValidComponent(comp) {
+		http.Error(w, "Invalid component", http.StatusBadRequest)
+		return
+	}
+	if action == "" {
+		if !s.requireRole(w, r, roleReader) {
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		state, err := s.releaseState(comp)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "failed to read release state", "component", comp, "error", err)
+			http.Error(w, "Failed to read release state", http.StatusInternalServerError)
+			return
+		}
+		writeReleaseResponse(w, state)
+		return
+	}
+
+	if action != releasePromote && action != releaseYank && action != releaseUnyank && action != releaseRollout && action != releaseChannel {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.requireRole(w, r, rolePromoter) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.rejectReadOnly(w) {
+		return
+	}
+
+	var req struct {
+		Version string   `json:"version"`
+		Percent *float64 `json:"percent"`
+		Channel string   `json:"channel"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, err := update.ParseVersion(req.Version); err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	if action == releaseRollout && (req.Percent == nil || *req.Percent < 0 || *req.Percent > 100) {
+		http.Error(w, "Rollout percent must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	if action == releaseChannel {
+		req.Channel = update.NormalizeChannel(req.Channel)
+		if _, ok := s.manifestKeys(req.Channel); update.ValidateChannel(req.Channel) != nil || !ok {
+			http.Error(w, "Unknown channel", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if action != releaseRollout {
+		req.Percent = nil
+	}
+	if action != releaseChannel {
+		req.Channel = ""
+	}
+
+	state, err := s.mutateRelease(comp, r.Header.Get("If-Match"), func(state *releaseState) error {
+		if action == releaseRollout {
+			setRollout(state, req.Version, *req.Percent)
+			return nil
+		}
+		if action == releaseChannel {
+			// A release moves to another channel by its catalog entry
+			return s.catalog.SetChannel(r.Context(), comp, req.Version, req.Channel)
+		}
+		return s.applyReleaseAction(comp, state, action, req.Version)
+	})
+	switch {
+	case errors.Is(err, errRevisionRequired):
+		http.Error(w, err.Error(), http.StatusPreconditionRequired)
+		return
+	case errors.Is(err, errRevisionConflict):
+		w.Header().Set("ETag", releaseETag(state.Revision))
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	case errors.Is(err, catalog.ErrNotFound):
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	case err != nil:
+		s.logger.ErrorContext(r.Context(), "failed to update release state", "component", comp, "error", err)
+		http.Error(w, "Failed to update release state", http.StatusInternalServerError)
+		return
+	}
+
+	actor := requestIdentity(r).Subject
+	logger := s.logger
+	if req.Percent != nil {
+		logger = logger.With("percent", *req.Percent)
+	}
+	if req.Channel != "" {
+		logger = logger.With("channel", req.Channel)
+	}
+	logger.InfoContext(r.Context(), "release state changed",
+		"component", comp,
+		"action", action,
+		"version", req.Version,
+		"revision", state.Revision,
+		"actor", actor,
+		"remote", r.RemoteAddr,
+	)
+	if err := update.AppendAuditLog(s.assetsDir, update.AuditEntry{
+		Action:    action,
+		Actor:     actor,
+		Component: comp,
+		Version:   req.Version,
+		Percent:   req.Percent,
+		Channel:   req.Channel,
+	}); err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to write audit log", "error", err)
+	}
+
+	writeReleaseResponse(w, state)
+}
+
+// mutateRelease applies change to a component's release state if ifMatch
+// names its current revision, and stores the result as the next revision.
+// On a conflict the current state is returned with the error.
+func (s *Server) mutateRelease(comp, ifMatch string, change func(*releaseState) error) (*releaseState, error) {
+	if ifMatch == "" {
+		return nil, errRevisionRequired
+	}
+
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+
+	state, err := s.releaseState(comp)
+	if err != nil {
+		return nil, err
+	}
+	if ifMatch != releaseETag(state.Revision) {
+		return state, errRevisionConflict
+	}
+
+	if err := change(state); err != nil {
+		return nil, err
+	}
+	state.Revision++
+	state.Updated = time.Now().UTC()
+
+	if err := s.writeReleaseState(comp, state); err != nil {
+		return nil, err
+	}
+	s.assetsChanged()
+	return state, nil
+}
+
+func (s *Server) applyReleaseAction(comp string, state *releaseState, action, version string) error {
+	switch action {
+	case releasePromote:
+		if _, err := s.catalog.Release(context.Background(), comp, version); err != nil {
+			return err
+		}
+		state.Yanked = slices.DeleteFunc(state.Yanked, func(v string) bool { return v == version })
+		state.Promoted = version
+	case releaseYank:
+		if !slices.Contains(state.Yanked, version) {
+			state.Yanked = append(state.Yanked, version)
+		}
+		// Fall back to the newest remaining version
+		if state.Promoted == version {
+			state.Promoted = ""
+		}
+	case releaseUnyank:
+		state.Yanked = slices.DeleteFunc(state.Yanked, func(v string) bool { return v == version })
+	}
+	return nil
+}
+
+// setRollout offers version to percent of clients. A rollout may be set up
+// before the version is published, so it starts out staged; at 100 percent
+// the version is offered like any other.
+func setRollout(state *releaseState, version string, percent float64) {
+	if percent >= 100 {
+		delete(state.Rollouts, version)
+		return
+	}
+	if state.Rollouts == nil {
+		state.Rollouts = make(map[string]float64)
+	}
+	state.Rollouts[version] = percent
+}
+
+func writeReleaseResponse(w http.ResponseWriter, state *releaseState) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", releaseETag(state.Revision))
+	json.NewEncoder(w).Encode(state)
+}
+
+// componentReleases is a component's entry in the release listing
+type componentReleases struct {
+	Component string           `json:"component"`
+	Revision  int64            `json:"revision"`
+	Promoted  string           `json:"promoted,omitempty"`
+	Versions  []releaseListing `json:"versions"`
+}
+
+// releaseListing is one published version of a component
+type releaseListing struct {
+	Version   string    `json:"version"`
+	Channel   string    `json:"channel"`
+	Published time.Time `json:"published"`
+	// Assets are the version's assets, by platform
+	Assets map[string]releaseAsset `json:"assets"`
+	// Offered is set for the version the channel's manifest offers, when
+	// no targeting rule or rollout decides otherwise
+	Offered bool     `json:"offered"`
+	Yanked  bool     `json:"yanked,omitempty"`
+	Rollout *float64 `json:"rollout,omitempty"`
+}
+
+type releaseAsset struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Downloads are the complete downloads counted in -stats-file, or else
+	// those served since the server started, resumed ones included, with
+	// -metrics
+	Downloads uint64 `json:"downloads"`
+}
+
+// handleReleases lists every component's versions with their channel,
+// assets, and release state, newest first, for the reader role:
+//
+//	GET /v1/admin/releases[?component={component}]
+func (s *Server) handleReleases(w http.ResponseWriter, r *http.Request) {
+	if !s.requireRole(w, r, roleReader) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	components := s.components
+	if comp := r.URL.Query().Get("component"); comp != "" {
+		if !s.isValidComponent(comp) {
+			http.Error(w, "Invalid component", http.StatusBadRequest)
+			return
+		}
+		components = []string{comp}
+	}
+
+	listing := []componentReleases{}
+	for _, comp := range components {
+		releases, err := s.listReleases(comp)
+		if err != nil {
+			s.logger.ErrorContext(r.Context(), "failed to list releases", "component", comp, "error", err)
+			http.Error(w, "Failed to list releases", http.StatusInternalServerError)
+			return
+		}
+		listing = append(listing, *releases)
+	}
+	writeJSON(w, listing)
+}
+
+func (s *Server) listReleases(comp string) (*componentReleases, error) {
+	state, err := s.releaseState(comp)
+	if err != nil {
+		return nil, err
+	}
+	releases := &componentReleases{Component: comp, Revision: state.Revision, Promoted: state.Promoted, Versions: []releaseListing{}}
+
+	published, err := s.releases(comp)
+	if err != nil {
+		return nil, err
+	}
+	offered := make(map[string]string)
+	for _, r := range published {
+		version, channel := r.Version, r.Channel
+		if _, ok := offered[channel]; !ok {
+			offered[channel] = offeredVersion(published, state, channel)
+		}
+
+		release := releaseListing{
+			Version:   version,
+			Channel:   channel,
+			Published: r.Published,
+			Assets:    make(map[string]releaseAsset),
+			Offered:   offered[channel] == version,
+			Yanked:    slices.Contains(state.Yanked, version),
+		}
+		if percent, ok := state.Rollouts[version]; ok {
+			release.Rollout = &percent
+		}
+		downloads := s.metrics.downloadCounts(s.product, comp, version)
+		if s.stats != nil {
+			downloads = s.stats.downloadCounts(s.product, comp, version)
+		}
+		assets, err := s.catalog.Assets(context.Background(), comp, version)
+		if err != nil {
+			return nil, err
+		}
+		for plat, asset := range assets {
+			release.Assets[plat] = releaseAsset{Size: asset.Size, SHA256: asset.SHA256, Downloads: downloads[plat]}
+		}
+		releases.Versions = append(releases.Versions, release)
+	}
+	return releases, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReleaseRevision(t *testing.T) {
+	_, h := newTestServer(t)
+	for _, version := range []string{"1.0.0", "1.1.0"} {
+		if rec := upload(t, h, version, []byte("nametag "+version), ""); rec.Code != http.StatusCreated {
+			t.Fatalf("upload %s = %d: %s", version, rec.Code, rec.Body)
+		}
+	}
+
+	promote := func(version, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/admin/components/nametag/promote", strings.NewReader(`{"version": "`+version+`"}`))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		return serve(h, req, true)
+	}
+
+	rec := serve(h, httptest.NewRequest(http.MethodGet, "/v1/admin/components/nametag", nil), true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("read state = %d: %s", rec.Code, rec.Body)
+	}
+	initial := rec.Header().Get("ETag")
+	if initial != releaseETag(0) {
+		t.Fatalf("ETag of the initial state = %s, want %s", initial, releaseETag(0))
+	}
+
+	tests := []struct {
+		name    string
+		version string
+		ifMatch string
+		want    int
+		// wantETag is the revision the response names
+		wantETag string
+	}{
+		{"no If-Match", "1.0.0", "", http.StatusPreconditionRequired, ""},
+		{"unknown revision", "1.0.0", releaseETag(7), http.StatusPreconditionFailed, releaseETag(0)},
+		{"current revision", "1.0.0", initial, http.StatusOK, releaseETag(1)},
+		{"stale revision", "1.1.0", initial, http.StatusPreconditionFailed, releaseETag(1)},
+		{"revision after the change", "1.1.0", releaseETag(1), http.StatusOK, releaseETag(2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := promote(tt.version, tt.ifMatch)
+			if rec.Code != tt.want {
+				t.Fatalf("promote = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if got := rec.Header().Get("ETag"); got != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", got, tt.wantETag)
+			}
+		})
+	}
+
+	// The refused change left the promotion of the accepted ones
+	rec = serve(h, httptest.NewRequest(http.MethodGet, "/v1/admin/components/nametag", nil), true)
+	if !strings.Contains(rec.Body.String(), `"promoted":"1.1.0"`) {
+		t.Errorf("state after the changes = %s, want 1.1.0 promoted", rec.Body)
+	}
+}
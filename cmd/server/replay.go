@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// nonceCache remembers the nonces of signed requests until their timestamps
+// fall out of the accepted window, after which the timestamp check alone
+// refuses a replay. It is per process: replicas behind a load balancer each
+// keep their own, so a replay can succeed once per replica.
+type nonceCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: make(map[string]time.Time)}
+}
+
+// use records nonce as spent until expires, reporting false if it already was
+func (c *nonceCache) use(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.pruned) > time.Minute {
+		for n, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, n)
+			}
+		}
+		c.pruned = now
+	}
+
+	if exp, ok := c.seen[nonce]; ok && now.Before(exp) {
+		return false
+	}
+	c.seen[nonce] = expires
+	return true
+}
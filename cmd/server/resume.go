@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// resumeTokens issues and checks download resumption tokens. A download
+// that needed credentials gets one bound to the asset's path, and every
+// resumed request gets a fresh one, so a download spanning hours keeps going
+// after the bearer token it started with has expired.
+type resumeTokens struct {
+	key []byte
+	ttl time.Duration
+}
+
+// resumeKeySize is the length of a generated key and the minimum for a
+// key file
+const resumeKeySize = 32
+
+func newResumeTokens(keyFile string, ttl time.Duration) (*resumeTokens, error) {
+	if keyFile == "" {
+		key := make([]byte, resumeKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("generate key: %w", err)
+		}
+		return &resumeTokens{key: key, ttl: ttl}, nil
+	}
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < resumeKeySize {
+		return nil, fmt.Errorf("key must be at least %d bytes", resumeKeySize)
+	}
+	return &resumeTokens{key: key, ttl: ttl}, nil
+}
+
+type resumeClaims struct {
+	Path    string `json:"path"`
+	Subject string `json:"sub"`
+	Expires int64  `json:"exp"`
+}
+
+// issue returns a token for resuming the download at path
+func (t *resumeTokens) issue(path, subject string, now time.Time) string {
+	payload, _ := json.Marshal(resumeClaims{Path: path, Subject: subject, Expires: now.Add(t.ttl).Unix()})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(t.sign(encoded))
+}
+
+func (t *resumeTokens) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// verify returns the token's claims when it is authentic, unexpired, and
+// issued for path
+func (t *resumeTokens) verify(token, path string, now time.Time) (*resumeClaims, bool) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, t.sign(encoded)) {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+	var claims resumeClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, false
+	}
+	if claims.Path != path || now.Unix() >= claims.Expires {
+		return nil, false
+	}
+	return &claims, true
+}
+
+// resumeAuth accepts downloads carrying a valid resumption token for the
+// requested asset
+type resumeAuth struct {
+	tokens *resumeTokens
+}
+
+func (a *resumeAuth) Scopes() []authScope {
+	return []authScope{scopeDownload}
+}
+
+func (a *resumeAuth) Authenticate(r *http.Request, scope authScope) (*identity, error) {
+	token := r.Header.Get(update.ResumeTokenHeader)
+	if token == "" {
+		return nil, errUnauthenticated
+	}
+	claims, ok := a.tokens.verify(token, r.URL.Path, time.Now())
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	return &identity{Subject: claims.Subject}, nil
+}
+
+// issueResumeToken hands the client of an authenticated download a token to
+// resume it with
+func (s *Server) issueResumeToken(w http.ResponseWriter, r *http.Request) {
+	id := requestIdentity(r)
+	if s.resume == nil || id == nil {
+		return
+	}
+	w.Header().Set(update.ResumeTokenHeader, s.resume.issue(r.URL.Path, id.Subject, time.Now()))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// rollout is a component's release offered to some clients only, while the
+// manifest offers the others the release before it
+type rollout struct {
+	// percent is the share of clients offered the release
+	percent   float64
+	component update.Component
+}
+
+// stageRollouts offers r's client the releases being rolled out whose
+// percentage covers its machine ID's bucket, and names the others in
+// RolloutHeader so the client can tell why it isn't offered them. Clients
+// that send no machine ID get the manifest everyone else does. Components in
+// skip were decided otherwise and are left alone.
+func stageRollouts(w http.ResponseWriter, r *http.Request, manifest *update.Manifest, rollouts map[string]rollout, skip map[string]bool) {
+	machineID := r.Header.Get(update.MachineIDHeader)
+	if len(machineID) > update.MaxMachineIDLength {
+		machineID = ""
+	}
+	identity := requestIdentity(r)
+	for comp, staged := range rollouts {
+		if skip[comp] || (identity != nil && !identity.allows(comp)) {
+			continue
+		}
+		if machineID != "" && update.RolloutBucket(machineID, comp, staged.component.Version) < staged.percent {
+			manifest.Components[comp] = staged.component
+			continue
+		}
+		held := update.HeldRollout{Component: comp, Version: staged.component.Version, Percent: staged.percent}
+		w.Header().Add(update.RolloutHeader, held.String())
+	}
+}
+
+// withRollouts returns manifest offering every release being rolled out, as
+// it will once the rollouts complete
+func withRollouts(manifest *update.Manifest, rollouts map[string]rollout) *update.Manifest {
+	full := *manifest
+	full.Components = maps.Clone(manifest.Components)
+	for comp, staged := range rollouts {
+		full.Components[comp] = staged.component
+	}
+	return &full
+}
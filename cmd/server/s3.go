@@ -0,0 +1,334 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Storage keeps releases in a bucket of an S3-compatible object store:
+// Amazon S3, MinIO, or Google Cloud Storage through its XML API. Requests
+// are signed with AWS Signature Version 4, or sent anonymously for a public
+// bucket when no credentials are set.
+type s3Storage struct {
+	client   *http.Client
+	endpoint *url.URL
+	bucket   string
+	// prefix is the key prefix of the releases, empty or ending in a slash
+	prefix string
+	region string
+	// pathStyle addresses the bucket in the path rather than the host name
+	pathStyle bool
+
+	accessKey, secretKey, sessionToken string
+}
+
+// newS3Storage returns the storage a URL names:
+//
+//	s3://bucket/prefix[?region=&endpoint=&path-style=]
+//	gs://bucket/prefix
+//
+// Credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+// AWS_SESSION_TOKEN; for Google Cloud Storage they are an HMAC key.
+func newS3Storage(raw string) (*s3Storage, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse storage url: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("storage url %s names no bucket", raw)
+	}
+
+	s := &s3Storage{
+		client:       &http.Client{Timeout: 30 * time.Minute},
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+
+	q := u.Query()
+	endpoint := q.Get("endpoint")
+	s.region = q.Get("region")
+	switch u.Scheme {
+	case "s3":
+		if s.region == "" {
+			s.region = cmp.Or(os.Getenv("AWS_REGION"), "us-east-1")
+		}
+		if endpoint == "" {
+			endpoint = "https://s3." + s.region + ".amazonaws.com"
+		} else {
+			// MinIO and most other stores only route path-style requests
+			s.pathStyle = true
+		}
+	case "gs":
+		if s.region == "" {
+			s.region = "auto"
+		}
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+		s.pathStyle = true
+	default:
+		return nil, fmt.Errorf("unsupported storage url scheme %q (want s3 or gs)", u.Scheme)
+	}
+	if v := q.Get("path-style"); v != "" {
+		if s.pathStyle, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid path-style %q", v)
+		}
+	}
+
+	if s.endpoint, err = url.Parse(endpoint); err != nil || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid storage endpoint %q", endpoint)
+	}
+	if (s.accessKey == "") != (s.secretKey == "") {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set together")
+	}
+	return s, nil
+}
+
+func (s *s3Storage) String() string {
+	return s.endpoint.Host + "/" + s.bucket + "/" + s.prefix
+}
+
+// List returns the objects under prefix, following continuation tokens
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]storageObject, error) {
+	var (
+		objects []storageObject
+		token   string
+	)
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, -1)
+		if err != nil {
+			return nil, fmt.Errorf("list objects: %w", err)
+		}
+
+		var page struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+				ETag         string    `xml:"ETag"`
+				Size         int64     `xml:"Size"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decode object list: %w", err)
+		}
+
+		for _, c := range page.Contents {
+			name := strings.TrimPrefix(c.Key, s.prefix)
+			if name == "" || strings.HasSuffix(name, "/") {
+				// Folder placeholders some consoles create
+				continue
+			}
+			objects = append(objects, storageObject{Name: name, Size: c.Size, ModTime: c.LastModified, ETag: c.ETag})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Stat returns an object's metadata
+func (s *s3Storage) Stat(ctx context.Context, name string) (storageObject, error) {
+	resp, err := s.do(ctx, http.MethodHead, name, nil, nil, -1)
+	if err != nil {
+		return storageObject{}, fmt.Errorf("stat %s: %w", name, err)
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return storageObject{Name: name, Size: resp.ContentLength, ModTime: modTime, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// Open returns an object's content
+func (s *s3Storage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, nil, -1)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", name, err)
+	}
+	return resp.Body, nil
+}
+
+// Put stores size bytes of body as an object
+func (s *s3Storage) Put(ctx context.Context, name string, body io.Reader, size int64) error {
+	resp, err := s.do(ctx, http.MethodPut, name, nil, body, size)
+	if err != nil {
+		return fmt.Errorf("put %s: %w", name, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Delete removes an object; a missing one is not an error
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, name, nil, nil, -1)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("delete %s: %w", name, err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// do sends a signed request for the object name, or for the bucket when name
+// is empty, and returns the response unless its status is an error
+func (s *s3Storage) do(ctx context.Context, method, name string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.endpoint
+	path := "/"
+	if name != "" {
+		path += s.prefix + name
+	}
+	if s.pathStyle {
+		path = "/" + s.bucket + path
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + path
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&s3Err)
+	if resp.StatusCode == http.StatusNotFound && s3Err.Code != "NoSuchBucket" {
+		return nil, fs.ErrNotExist
+	}
+	if s3Err.Code != "" {
+		return nil, fmt.Errorf("%s: %s: %s", resp.Status, s3Err.Code, s3Err.Message)
+	}
+	return nil, fmt.Errorf("%s", resp.Status)
+}
+
+// sign adds an AWS Signature Version 4 to req. The payload isn't hashed,
+// which S3 allows over TLS, so uploads stream straight from disk.
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	if s.accessKey == "" {
+		return
+	}
+	const payload = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := slices.Sorted(maps.Keys(headers))
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes s as Signature Version 4 requires: everything
+// but unreserved characters, and slashes unless escapeSlash
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query sorted by key, which is also its canonical form
+func s3Query(query url.Values) string {
+	var parts []string
+	for _, key := range slices.Sorted(maps.Keys(query)) {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
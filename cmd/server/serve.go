@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// listenAndServe serves until the server fails or is asked to stop with
+// SIGINT or SIGTERM. Stopping closes the listeners at once and waits up to
+// drain for in-flight requests, downloads above all, to finish before
+// cutting them off; a second signal doesn't wait.
+func listenAndServe(httpServer *http.Server, useTLS bool, drain time.Duration, logger *slog.Logger) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	served := make(chan error, 1)
+	go func() {
+		if useTLS {
+			served <- httpServer.ListenAndServeTLS("", "")
+		} else {
+			served <- httpServer.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	// Restore the default handling, so another signal kills the server
+	stop()
+
+	logger.Info("shutting down, draining in-flight requests", "timeout", drain)
+	drainCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := httpServer.Shutdown(drainCtx); err != nil {
+		logger.Warn("cutting off requests still in flight", "error", err)
+		httpServer.Close()
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// testAdminToken is the -admin-token of servers from newTestServer
+const testAdminToken = "test-admin-token"
+
+// newTestServer returns a server of an empty assets directory, as main sets
+// one up with -admin-token, after applying setup, and its release routes
+func newTestServer(t *testing.T, setup ...func(*Server)) (*Server, http.Handler) {
+	t.Helper()
+	namer, err := update.NewAssetNamer(update.DefaultAssetTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		assetsDir:      t.TempDir(),
+		namer:          namer,
+		digests:        []string{update.HashSHA256},
+		manifestTTL:    24 * time.Hour,
+		components:     []string{"nametag"},
+		uploadMaxSize:  1 << 20,
+		mode:           new(atomic.Pointer[modeState]),
+		authenticators: []Authenticator{&tokenAuth{token: testAdminToken, scopes: []authScope{scopeAdmin}}},
+		logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	s.setMode(modeNormal, time.Minute)
+	for _, f := range setup {
+		f(s)
+	}
+	if err := s.openCatalog(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.catalog.Close() })
+
+	mux := http.NewServeMux()
+	s.registerReleaseRoutes(mux)
+	return s, s.withMode(mux)
+}
+
+// serve sends req to h, with the admin token when admin is set
+func serve(h http.Handler, req *http.Request, admin bool) *httptest.ResponseRecorder {
+	if admin {
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// upload publishes data as nametag's linux-amd64 asset of version, with
+// query appended to the upload URL
+func upload(t *testing.T, h http.Handler, version string, data []byte, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/upload/nametag/linux-amd64/"+version+query, bytes.NewReader(data))
+	req.Header.Set(UploadSHA256Header, sha256Hex(data))
+	return serve(h, req, true)
+}
+
+// sha256Hex returns the hex SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestLintRequiresAdmin(t *testing.T) {
+	_, h := newTestServer(t)
+
+	rec := serve(h, httptest.NewRequest(http.MethodGet, "/v1/manifest/lint", nil), false)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("lint without credentials = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if bytes.Contains(rec.Body.Bytes(), []byte("issues")) {
+		t.Errorf("lint without credentials returned a report: %s", rec.Body)
+	}
+
+	rec = serve(h, httptest.NewRequest(http.MethodGet, "/v1/manifest/lint", nil), true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("lint = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var report struct {
+		Valid  bool     `json:"valid"`
+		Issues []string `json:"issues"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+}
+
+func TestLintCachedUntilAssetsChange(t *testing.T) {
+	s, h := newTestServer(t)
+
+	lint := func() *lintReport {
+		t.Helper()
+		if rec := serve(h, httptest.NewRequest(http.MethodGet, "/v1/manifest/lint", nil), true); rec.Code != http.StatusOK {
+			t.Fatalf("lint = %d: %s", rec.Code, rec.Body)
+		}
+		return s.lint
+	}
+
+	first := lint()
+	if first == nil {
+		t.Fatal("lint report not cached")
+	}
+	if again := lint(); again != first {
+		t.Error("lint recomputed without an assets change")
+	}
+
+	if rec := upload(t, h, "1.0.0", []byte("nametag 1.0.0"), ""); rec.Code != http.StatusCreated {
+		t.Fatalf("upload = %d: %s", rec.Code, rec.Body)
+	}
+	if changed := lint(); changed == first {
+		t.Error("lint served the report of the assets before the upload")
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// updaterAgent is the User-Agent product token of the nametag clients;
+// downloads are counted by the minor version after it
+const updaterAgent = "nametag-updater/"
+
+// otherClients counts downloads by anything else, such as browsers and
+// scripts
+const otherClients = "other"
+
+type statsKey struct {
+	product, component, platform, version string
+}
+
+// statsRecord is what the stats file keeps of an asset's downloads
+type statsRecord struct {
+	Product   string `json:"product,omitempty"`
+	Component string `json:"component"`
+	Platform  string `json:"platform"`
+	Version   string `json:"version"`
+	// Downloads are the complete downloads served or redirected to a CDN,
+	// and Resumed the partial ones continuing a download
+	Downloads uint64    `json:"downloads"`
+	Resumed   uint64    `json:"resumed"`
+	Bytes     uint64    `json:"bytes"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+	// Clients are the downloads by client version, coarsened to major.minor
+	Clients map[string]uint64 `json:"clients,omitempty"`
+}
+
+// downloadStats counts downloads across restarts, kept in a JSON file so
+// release managers can see which versions are still fetched before deleting
+// them. It's shared by the servers of all products, and written every
+// -stats-interval: a crash loses at most that much.
+type downloadStats struct {
+	path   string
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	records map[statsKey]*statsRecord
+	dirty   bool
+}
+
+// openDownloadStats reads the stats file at path; a missing one starts the
+// counts from zero
+func openDownloadStats(path string, logger *slog.Logger) (*downloadStats, error) {
+	s := &downloadStats{path: path, logger: logger, records: make(map[statsKey]*statsRecord)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read download stats: %w", err)
+	}
+
+	var records []*statsRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("decode download stats %s: %w", path, err)
+	}
+	for _, r := range records {
+		s.records[statsKey{r.Product, r.Component, r.Platform, r.Version}] = r
+	}
+	return s, nil
+}
+
+// downloadServed counts a download response; statuses other than complete,
+// partial, and redirected downloads aren't downloads
+func (s *downloadStats) downloadServed(product, comp, plat, version string, status int, bytes int64, userAgent string) {
+	if s == nil {
+		return
+	}
+	if status != http.StatusOK && status != http.StatusPartialContent && status != http.StatusFound {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	key := statsKey{product, comp, plat, version}
+	r, ok := s.records[key]
+	if !ok {
+		r = &statsRecord{Product: product, Component: comp, Platform: plat, Version: version, First: now}
+		s.records[key] = r
+	}
+	r.Last = now
+	r.Bytes += uint64(bytes)
+	if status == http.StatusPartialContent {
+		r.Resumed++
+	} else {
+		r.Downloads++
+		if r.Clients == nil {
+			r.Clients = make(map[string]uint64)
+		}
+		r.Clients[clientVersion(userAgent)]++
+	}
+	s.dirty = true
+}
+
+// clientVersion returns the major.minor version of the nametag client that
+// sent userAgent, or otherClients
+func clientVersion(userAgent string) string {
+	token, _, _ := strings.Cut(userAgent, " ")
+	version, ok := strings.CutPrefix(token, updaterAgent)
+	if !ok {
+		return otherClients
+	}
+	v, err := update.ParseVersion(version)
+	if err != nil {
+		if v, err = update.ParseVersion(version + ".0"); err != nil {
+			return otherClients
+		}
+	}
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// downloadCounts returns the complete downloads of a version since stats
+// were first kept, by platform
+func (s *downloadStats) downloadCounts(product, comp, version string) map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]uint64)
+	for k, r := range s.records {
+		if k.product == product && k.component == comp && k.version == version {
+			counts[k.platform] += r.Downloads
+		}
+	}
+	return counts
+}
+
+// save writes the stats file when the counts changed since it was last
+// written
+func (s *downloadStats) save() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	records := make([]statsRecord, 0, len(s.records))
+	for _, r := range s.records {
+		record := *r
+		record.Clients = maps.Clone(r.Clients)
+		records = append(records, record)
+	}
+	s.dirty = false
+	s.mu.Unlock()
+
+	slices.SortFunc(records, func(a, b statsRecord) int {
+		return cmp.Or(
+			strings.Compare(a.Product, b.Product),
+			strings.Compare(a.Component, b.Component),
+			strings.Compare(a.Version, b.Version),
+			strings.Compare(a.Platform, b.Platform),
+		)
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode download stats: %w", err)
+	}
+	if err := writeStatsFile(s.path, data); err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func writeStatsFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".stats-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write download stats: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close download stats: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename download stats: %w", err)
+	}
+	return nil
+}
+
+// runStatsLoop writes the stats file every interval
+func (s *downloadStats) runStatsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.save(); err != nil {
+			s.logger.Error("failed to save download stats", "error", err)
+		}
+	}
+}
+
+// versionStats are a version's downloads since stats were first kept
+type versionStats struct {
+	Version   string                   `json:"version"`
+	Downloads uint64                   `json:"downloads"`
+	Resumed   uint64                   `json:"resumed"`
+	Bytes     uint64                   `json:"bytes"`
+	First     time.Time                `json:"first_download"`
+	Last      time.Time                `json:"last_download"`
+	Platforms map[string]platformStats `json:"platforms"`
+	Clients   map[string]uint64        `json:"clients"`
+}
+
+type platformStats struct {
+	Downloads uint64    `json:"downloads"`
+	Resumed   uint64    `json:"resumed"`
+	Bytes     uint64    `json:"bytes"`
+	Last      time.Time `json:"last_download"`
+}
+
+type componentStats struct {
+	Component string         `json:"component"`
+	Versions  []versionStats `json:"versions"`
+}
+
+// handleStats reports every component's downloads by version, newest
+// first, including versions deleted since, for the reader role:
+//
+//	GET /v1/admin/stats[?component={component}][&version={version}]
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !s.requireRole(w, r, roleReader) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	components := s.components
+	query := r.URL.Query()
+	if comp := query.Get("component"); comp != "" {
+		if !s.isValidComponent(comp) {
+			http.Error(w, "Invalid component", http.StatusBadRequest)
+			return
+		}
+		components = []string{comp}
+	}
+	version := query.Get("version")
+	if version != "" {
+		if _, err := update.ParseVersion(version); err != nil {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report := []componentStats{}
+	for _, comp := range components {
+		report = append(report, s.stats.componentStats(s.product, comp, version))
+	}
+	writeJSON(w, report)
+}
+
+// componentStats sums the records of a component by version, of only
+// version when set
+func (s *downloadStats) componentStats(product, comp, version string) componentStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := make(map[string]*versionStats)
+	for k, r := range s.records {
+		if k.product != product || k.component != comp || (version != "" && k.version != version) {
+			continue
+		}
+		v, ok := versions[k.version]
+		if !ok {
+			v = &versionStats{
+				Version:   k.version,
+				First:     r.First,
+				Platforms: make(map[string]platformStats),
+				Clients:   make(map[string]uint64),
+			}
+			versions[k.version] = v
+		}
+		v.Downloads += r.Downloads
+		v.Resumed += r.Resumed
+		v.Bytes += r.Bytes
+		if r.First.Before(v.First) {
+			v.First = r.First
+		}
+		if r.Last.After(v.Last) {
+			v.Last = r.Last
+		}
+		v.Platforms[k.platform] = platformStats{Downloads: r.Downloads, Resumed: r.Resumed, Bytes: r.Bytes, Last: r.Last}
+		for client, n := range r.Clients {
+			v.Clients[client] += n
+		}
+	}
+
+	stats := componentStats{Component: comp, Versions: []versionStats{}}
+	for _, v := range versions {
+		stats.Versions = append(stats.Versions, *v)
+	}
+	slices.SortFunc(stats.Versions, func(a, b versionStats) int {
+		va, _ := update.ParseVersion(a.Version)
+		vb, _ := update.ParseVersion(b.Version)
+		return vb.Compare(va)
+	})
+	return stats
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage is where releases live when they aren't kept in a local directory:
+// files named by slash-separated paths, as in the assets directory
+type Storage interface {
+	// List returns the files whose names start with prefix
+	List(ctx context.Context, prefix string) ([]storageObject, error)
+	// Stat returns a file's metadata, or an error wrapping fs.ErrNotExist
+	Stat(ctx context.Context, name string) (storageObject, error)
+	// Open returns a file's content, or an error wrapping fs.ErrNotExist
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// Put stores size bytes of body as a file, replacing any it had
+	Put(ctx context.Context, name string, body io.Reader, size int64) error
+	// Delete removes a file; a missing one is not an error
+	Delete(ctx context.Context, name string) error
+}
+
+// storageObject is a stored file's metadata
+type storageObject struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	// ETag changes whenever the content does
+	ETag string
+}
+
+// openStorage returns the storage a URL names; see newS3Storage
+func openStorage(raw string) (Storage, error) {
+	return newS3Storage(raw)
+}
+
+// openStorageMirror opens the storage a URL names, with dir as its copy
+func openStorageMirror(raw, dir string, logger *slog.Logger) (*storageMirror, error) {
+	storage, err := openStorage(raw)
+	if err != nil {
+		return nil, err
+	}
+	return newStorageMirror(storage, dir, logger.With("storage", raw))
+}
+
+// storageIndexFile records, at the root of the assets directory, which
+// version of each stored file the local copy holds
+const storageIndexFile = ".storage.json"
+
+// storageTimeout bounds a sync, which may move multi-hundred-MB assets
+const storageTimeout = time.Hour
+
+// mirrorEntry is a file the local copy shares with the storage: the
+// object's ETag when fetched or stored, and the local file's size and
+// modification time then, which tell whether it changed since
+type mirrorEntry struct {
+	ETag    string    `json:"etag"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Held is set for a file quarantined by the integrity audit, so the
+	// same corrupt object isn't fetched again
+	Held bool `json:"held,omitempty"`
+}
+
+// storageMirror keeps the assets directory a copy of a Storage, so the rest
+// of the server, which reads and writes files, works unchanged. Pulls fetch
+// files changed in the storage and remove those deleted from it; pushes store
+// files the server changed. Files and directories whose names start with a
+// dot, such as the hash cache and the quarantine, are never synced.
+type storageMirror struct {
+	storage Storage
+	dir     string
+	logger  *slog.Logger
+	// kick asks the sync loop to push without waiting for its next tick
+	kick chan struct{}
+
+	mu    sync.Mutex
+	index map[string]mirrorEntry
+}
+
+func newStorageMirror(storage Storage, dir string, logger *slog.Logger) (*storageMirror, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create assets directory: %w", err)
+	}
+
+	m := &storageMirror{
+		storage: storage,
+		dir:     dir,
+		logger:  logger,
+		kick:    make(chan struct{}, 1),
+		index:   make(map[string]mirrorEntry),
+	}
+	data, err := os.ReadFile(filepath.Join(dir, storageIndexFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("read storage index: %w", err)
+	default:
+		if err := json.Unmarshal(data, &m.index); err != nil {
+			// Files are fetched again rather than trusted
+			logger.Warn("ignoring corrupt storage index", "error", err)
+			m.index = make(map[string]mirrorEntry)
+		}
+	}
+	return m, nil
+}
+
+// synced reports whether a name is mirrored rather than local to this copy
+func synced(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// unchanged reports whether the local file is still as the entry recorded
+func (e mirrorEntry) unchanged(info fs.FileInfo) bool {
+	return info != nil && info.Size() == e.Size && info.ModTime().Equal(e.ModTime)
+}
+
+// pull brings the local copy up to date with the storage, returning how
+// many files it fetched or removed. A file changed on both sides is taken
+// from the storage; one changed only locally is left for push.
+func (m *storageMirror) pull(ctx context.Context) (int, error) {
+	objects, err := m.storage.List(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.save()
+
+	changed := 0
+	remote := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		if !synced(obj.Name) {
+			continue
+		}
+		remote[obj.Name] = true
+
+		local, _ := os.Stat(m.localPath(obj.Name))
+		entry, ok := m.index[obj.Name]
+		if ok && entry.ETag == obj.ETag {
+			if entry.Held || local != nil {
+				continue
+			}
+			// Removed locally behind our back; fetch it again
+		} else if ok && local != nil && !entry.unchanged(local) {
+			m.logger.Warn("file changed both locally and in storage, taking the stored one", "file", obj.Name)
+		}
+
+		if err := m.fetch(ctx, obj); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+
+	for name, entry := range m.index {
+		if remote[name] {
+			continue
+		}
+		path := m.localPath(name)
+		if local, err := os.Stat(path); err == nil && !entry.unchanged(local) {
+			// Changed since; push stores it again
+			delete(m.index, name)
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return changed, fmt.Errorf("remove %s: %w", name, err)
+		}
+		delete(m.index, name)
+		m.pruneDirs(filepath.Dir(path))
+		m.logger.Info("removed file deleted from storage", "file", name)
+		changed++
+	}
+	return changed, nil
+}
+
+// fetch downloads an object over the local file. m.mu must be held.
+func (m *storageMirror) fetch(ctx context.Context, obj storageObject) error {
+	body, err := m.storage.Open(ctx, obj.Name)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dest := m.localPath(obj.Name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".sync-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("fetch %s: %w", obj.Name, err)
+	}
+	if size != obj.Size {
+		return fmt.Errorf("fetch %s: got %d bytes, storage lists %d", obj.Name, size, obj.Size)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("store %s: %w", obj.Name, err)
+	}
+
+	info, err := os.Stat(dest)
+	if err != nil {
+		return err
+	}
+	m.index[obj.Name] = mirrorEntry{ETag: obj.ETag, Size: info.Size(), ModTime: info.ModTime()}
+	m.logger.Info("fetched file from storage", "file", obj.Name, "bytes", size)
+	return nil
+}
+
+// push stores the local files that are new or changed since they were last
+// synced, returning how many. Files removed locally stay in the storage
+// unless removed through remove.
+func (m *storageMirror) push(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.save()
+
+	pushed := 0
+	err := filepath.WalkDir(m.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == m.dir {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(m.dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if entry, ok := m.index[name]; ok && entry.unchanged(info) {
+			return nil
+		}
+
+		if err := m.store(ctx, name, path, info); err != nil {
+			return err
+		}
+		pushed++
+		return nil
+	})
+	return pushed, err
+}
+
+// store uploads a local file. m.mu must be held.
+func (m *storageMirror) store(ctx context.Context, name, path string, info fs.FileInfo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := m.storage.Put(ctx, name, f, info.Size()); err != nil {
+		return err
+	}
+	obj, err := m.storage.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	m.index[name] = mirrorEntry{ETag: obj.ETag, Size: info.Size(), ModTime: info.ModTime()}
+	m.logger.Info("stored file in storage", "file", name, "bytes", info.Size())
+	return nil
+}
+
+// remove deletes a file from the storage and the local copy
+func (m *storageMirror) remove(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.storage.Delete(ctx, name); err != nil {
+		return err
+	}
+	delete(m.index, name)
+	m.save()
+	if err := os.Remove(m.localPath(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// hold keeps a file the local copy no longer has from being fetched again
+// until it changes in the storage
+func (m *storageMirror) hold(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry, ok := m.index[name]; ok {
+		entry.Held = true
+		m.index[name] = entry
+		m.save()
+	}
+}
+
+// pruneDirs removes dir and its parents below the local copy's root while
+// they're empty, so a deleted version leaves no directory to be mistaken for
+// a release
+func (m *storageMirror) pruneDirs(dir string) {
+	for dir != m.dir && strings.HasPrefix(dir, m.dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (m *storageMirror) localPath(name string) string {
+	return filepath.Join(m.dir, filepath.FromSlash(name))
+}
+
+// save writes the index. Losing it only costs fetching files again, so
+// failing to is logged. Called with mu held.
+func (m *storageMirror) save() {
+	data, err := json.Marshal(m.index)
+	if err == nil {
+		path := filepath.Join(m.dir, storageIndexFile)
+		if err = os.WriteFile(path+".tmp", data, 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		m.logger.Warn("failed to write storage index", "error", err)
+	}
+}
+
+// syncStorage pulls changes from the storage and then, unless the server is
+// refusing changes, pushes its own. Pulling first means a copy that lost its
+// index takes the stored files rather than overwriting them.
+func (s *Server) syncStorage(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	snapshot, _ := os.Stat(filepath.Join(s.assetsDir, catalogSnapshot))
+	n, err := s.storage.pull(ctx)
+	if n > 0 {
+		s.manifests.invalidate()
+		s.logger.Info("pulled changes from storage", "files", n)
+	}
+	if err != nil {
+		return fmt.Errorf("pull from storage: %w", err)
+	}
+	if n > 0 && s.catalog != nil {
+		// The catalog of the server storing is taken over whole, and releases
+		// published into the storage by other means imported
+		if restored, err := s.restoreCatalog(ctx, snapshot); err != nil {
+			return fmt.Errorf("restore catalog from storage: %w", err)
+		} else if restored {
+			s.logger.Info("restored release catalog from storage")
+		}
+		if imported, err := s.importReleases(ctx); err != nil {
+			return fmt.Errorf("catalog releases pulled from storage: %w", err)
+		} else if imported > 0 {
+			s.logger.Info("imported releases pulled from storage", "releases", imported)
+		}
+	}
+
+	if s.currentMode().Mode != modeNormal {
+		return nil
+	}
+	if s.catalog != nil {
+		if err := s.exportCatalog(ctx); err != nil {
+			return fmt.Errorf("export catalog: %w", err)
+		}
+	}
+	if n, err := s.storage.push(ctx); err != nil {
+		return fmt.Errorf("push to storage: %w", err)
+	} else if n > 0 {
+		s.logger.Info("pushed changes to storage", "files", n)
+	}
+	return nil
+}
+
+// runStorageLoop syncs with the storage every interval, and as soon as the
+// server changed the assets, until the process exits
+func (s *Server) runStorageLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.storage.kick:
+		}
+		if err := s.syncStorage(context.Background()); err != nil {
+			s.logger.Error("storage sync failed", "error", err)
+		}
+	}
+}
+
+// assetsChanged is called after the server changed the assets directory
+func (s *Server) assetsChanged() {
+	s.manifests.invalidate()
+	if s.storage != nil {
+		select {
+		case s.storage.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// removeAsset deletes a file of the assets directory, and from the storage
+// the directory mirrors, where it would otherwise come back from
+func (s *Server) removeAsset(ctx context.Context, path string) error {
+	if s.storage == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	rel, err := filepath.Rel(s.assetsDir, path)
+	if err != nil {
+		return err
+	}
+	return s.storage.remove(ctx, filepath.ToSlash(rel))
+}
+
+// holdAsset keeps a quarantined file from being fetched from the storage
+// again
+func (s *Server) holdAsset(path string) {
+	if s.storage == nil {
+		return
+	}
+	if rel, err := filepath.Rel(s.assetsDir, path); err == nil {
+		s.storage.hold(filepath.ToSlash(rel))
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/catalog"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// targetingFile is the name of the optional file in a component's directory
+// holding the rules that vary its offered release by client
+const targetingFile = "targeting.json"
+
+// targetingRule offers clients it matches another release of a component
+// than everyone else gets. A rule matches when all of its conditions set do;
+// the first matching rule of a component decides, ahead of any rollout.
+type targetingRule struct {
+	Name string `json:"name"`
+
+	// Platforms, Groups, and Clients match clients sending one of them as
+	// their platform, group label, or machine ID
+	Platforms []string `json:"platforms,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	Clients   []string `json:"clients,omitempty"`
+	// CurrentBelow and CurrentAtLeast bound the component version the
+	// client runs; clients that don't send it match neither
+	CurrentBelow   string `json:"current_below,omitempty"`
+	CurrentAtLeast string `json:"current_at_least,omitempty"`
+
+	// Offer is the version offered, when it is published on the channel;
+	// HoldFrom instead offers what would be offered were it and every
+	// later version yanked. Exactly one is set.
+	Offer    string `json:"offer,omitempty"`
+	HoldFrom string `json:"hold_from,omitempty"`
+}
+
+type targetingRules struct {
+	Rules []targetingRule `json:"rules"`
+}
+
+// readTargeting loads a component's targeting rules; a component without
+// them has none
+func readTargeting(compDir string) ([]targetingRule, error) {
+	path := filepath.Join(compDir, targetingFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read targeting rules: %w", err)
+	}
+
+	var rules targetingRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("decode targeting rules %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i, rule := range rules.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("targeting rule %d in %s: %w", i+1, path, err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("targeting rule %d in %s: duplicate name %q", i+1, path, rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return rules.Rules, nil
+}
+
+func (r targetingRule) validate() error {
+	if r.Name == "" || strings.ContainsAny(r.Name, " \t\r\n") {
+		return errors.New("name must be set and have no spaces")
+	}
+	if (r.Offer == "") == (r.HoldFrom == "") {
+		return errors.New("exactly one of offer and hold_from must be set")
+	}
+	for _, v := range []string{r.Offer, r.HoldFrom, r.CurrentBelow, r.CurrentAtLeast} {
+		if v == "" {
+			continue
+		}
+		if _, err := update.ParseVersion(v); err != nil {
+			return err
+		}
+	}
+	for _, p := range r.Platforms {
+		if !isValidPlatform(p) {
+			return fmt.Errorf("unknown platform %q", p)
+		}
+	}
+	for _, g := range r.Groups {
+		if err := update.ValidateGroup(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// target is a targeting rule with the release it offers; component is nil
+// when it offers none. held is set when the release is older than the one
+// everyone else gets, or missing.
+type target struct {
+	rule      targetingRule
+	component *update.Component
+	held      bool
+}
+
+// generateTargets builds the releases a component's targeting rules offer
+// on channel, skipping rules offering a version not published on it
+func (s *Server) generateTargets(comp, compDir string, releases []catalog.Release, state *releaseState, channel string, offered *update.Component, restart *update.Restart, keys []ed25519.PrivateKey) ([]target, error) {
+	rules, err := readTargeting(compDir)
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+
+	var targets []target
+	for _, rule := range rules {
+		version := rule.Offer
+		if rule.Offer != "" {
+			published, ok := findRelease(releases, rule.Offer)
+			if !ok || published.Channel != channel || slices.Contains(state.Yanked, rule.Offer) {
+				continue
+			}
+		} else {
+			held, err := holdFrom(releases, state, rule.HoldFrom)
+			if err != nil {
+				return nil, err
+			}
+			version = offeredVersion(releases, held, channel)
+		}
+
+		t := target{rule: rule}
+		if version != "" {
+			component, err := s.generateComponent(comp, compDir, version, releases, restart, keys)
+			if err != nil {
+				return nil, err
+			}
+			if len(component.Assets) > 0 {
+				t.component = &component
+			}
+		}
+		t.held = t.component == nil || (offered != nil && olderVersion(t.component.Version, offered.Version))
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// holdFrom returns state with from and every later version yanked, and the
+// versions being rolled out too, as the rule decides ahead of rollouts
+func holdFrom(releases []catalog.Release, state *releaseState, from string) (*releaseState, error) {
+	floor, err := update.ParseVersion(from)
+	if err != nil {
+		return nil, err
+	}
+
+	held := *state
+	held.Yanked = slices.Concat(state.Yanked, slices.Collect(maps.Keys(state.Rollouts)))
+	for _, r := range releases {
+		v, err := update.ParseVersion(r.Version)
+		if err == nil && !v.LessThan(floor) {
+			held.Yanked = append(held.Yanked, r.Version)
+		}
+	}
+	return &held, nil
+}
+
+func olderVersion(a, b string) bool {
+	va, errA := update.ParseVersion(a)
+	vb, errB := update.ParseVersion(b)
+	return errA == nil && errB == nil && va.LessThan(vb)
+}
+
+// targetedClient is what a manifest request says about its client
+type targetedClient struct {
+	platform  string
+	group     string
+	machineID string
+	// current are the versions the client runs, by component
+	current map[string]update.Version
+}
+
+// requestClient reads what r says about its client. Versions sent for a
+// renamed component's former name count as the component's.
+func requestClient(r *http.Request, aliases map[string]string) targetedClient {
+	c := targetedClient{
+		platform:  r.Header.Get(update.PlatformHeader),
+		group:     r.Header.Get(update.GroupHeader),
+		machineID: r.Header.Get(update.MachineIDHeader),
+		current:   make(map[string]update.Version),
+	}
+	if len(c.machineID) > update.MaxMachineIDLength {
+		c.machineID = ""
+	}
+	for _, value := range r.Header.Values(update.CurrentVersionHeader) {
+		comp, version, _ := strings.Cut(value, " ")
+		if renamed, ok := aliases[comp]; ok {
+			comp = renamed
+		}
+		if v, err := update.ParseVersion(version); err == nil {
+			c.current[comp] = v
+		}
+	}
+	return c
+}
+
+func (r targetingRule) matches(comp string, c targetedClient) bool {
+	if len(r.Platforms) > 0 && !slices.Contains(r.Platforms, c.platform) {
+		return false
+	}
+	if len(r.Groups) > 0 && !slices.Contains(r.Groups, c.group) {
+		return false
+	}
+	if len(r.Clients) > 0 && (c.machineID == "" || !slices.Contains(r.Clients, c.machineID)) {
+		return false
+	}
+	if r.CurrentBelow != "" || r.CurrentAtLeast != "" {
+		current, ok := c.current[comp]
+		if !ok {
+			return false
+		}
+		if below, err := update.ParseVersion(r.CurrentBelow); err == nil && !current.LessThan(below) {
+			return false
+		}
+		if atLeast, err := update.ParseVersion(r.CurrentAtLeast); err == nil && current.LessThan(atLeast) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyTargeting offers r's client what the first targeting rule matching
+// it offers of each component, and names the rules holding releases back in
+// TargetHeader. It returns the components the rules decided.
+func applyTargeting(w http.ResponseWriter, r *http.Request, manifest *update.Manifest, targets map[string][]target, aliases map[string]string) map[string]bool {
+	client := requestClient(r, aliases)
+	identity := requestIdentity(r)
+	decided := make(map[string]bool)
+	for comp, rules := range targets {
+		if identity != nil && !identity.allows(comp) {
+			continue
+		}
+		for _, t := range rules {
+			if !t.rule.matches(comp, client) {
+				continue
+			}
+			decided[comp] = true
+			if t.component == nil {
+				delete(manifest.Components, comp)
+			} else {
+				manifest.Components[comp] = *t.component
+			}
+			if t.held {
+				w.Header().Add(update.TargetHeader, comp+" "+t.rule.Name)
+			}
+			break
+		}
+	}
+	return decided
+}
+
+// withTarget returns manifest offering what t offers of comp
+func withTarget(manifest *update.Manifest, comp string, t target) *update.Manifest {
+	targeted := *manifest
+	targeted.Components = maps.Clone(manifest.Components)
+	targeted.Components[comp] = *t.component
+	return &targeted
+}
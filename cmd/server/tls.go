@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often the certificate files are checked for a
+// renewed certificate
+const certReloadInterval = time.Minute
+
+// serverTLSConfig serves the certificate in certFile and keyFile, reloaded
+// when the files change, so a certificate renewed by certbot or a secrets
+// manager is picked up without a restart
+func serverTLSConfig(certFile, keyFile string, logger *slog.Logger) (*tls.Config, error) {
+	certs := &certFiles{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}, nil
+}
+
+// requireClientCerts makes config require every client to present a
+// certificate issued by one of the CAs in the PEM bundle clientCA, so only
+// enrolled machines can talk to the server
+func requireClientCerts(config *tls.Config, clientCA string) error {
+	pem, err := os.ReadFile(clientCA)
+	if err != nil {
+		return fmt.Errorf("read client ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("client ca: no certificates found")
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+// certFiles is a certificate and key loaded from files, read again when
+// either file's modification time changes
+type certFiles struct {
+	certFile, keyFile string
+	logger            *slog.Logger
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified [2]time.Time
+	checked  time.Time
+}
+
+func (c *certFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= certReloadInterval {
+		c.checked = time.Now()
+		if modified, err := c.modTimes(); err == nil && modified != c.modified {
+			// A half-written renewal keeps the old certificate until the
+			// next check
+			if cert, err := c.read(); err != nil {
+				c.logger.Warn("failed to reload tls certificate", "error", err)
+			} else {
+				c.cert, c.modified = cert, modified
+				c.logger.Info("tls certificate reloaded", "expires", cert.Leaf.NotAfter)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+func (c *certFiles) load() error {
+	modified, err := c.modTimes()
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+	cert, err := c.read()
+	if err != nil {
+		return err
+	}
+	c.cert, c.modified, c.checked = cert, modified, time.Now()
+	return nil
+}
+
+func (c *certFiles) read() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+func (c *certFiles) modTimes() ([2]time.Time, error) {
+	var modified [2]time.Time
+	for i, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modified, err
+		}
+		modified[i] = info.ModTime()
+	}
+	return modified, nil
+}
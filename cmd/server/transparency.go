@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// transparencyLog is the append-only log of every asset the server has
+// published. Leaves are stored one JSON line each; the Merkle tree over them
+// is rebuilt in memory on start.
+type transparencyLog struct {
+	path string
+
+	mu     sync.Mutex
+	leaves [][]byte
+	index  map[string]int
+}
+
+// openTransparencyLog loads the log at path, creating it when missing
+func openTransparencyLog(path string) (*transparencyLog, error) {
+	l := &transparencyLog{path: path, index: make(map[string]int)}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open transparency log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var leaf update.LogLeaf
+		if err := json.Unmarshal(scanner.Bytes(), &leaf); err != nil {
+			return nil, fmt.Errorf("transparency log line %d: %w", line, err)
+		}
+		l.add(leaf.Hash())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read transparency log: %w", err)
+	}
+	return l, nil
+}
+
+func (l *transparencyLog) add(hash []byte) {
+	if _, ok := l.index[string(hash)]; !ok {
+		l.index[string(hash)] = len(l.leaves)
+	}
+	l.leaves = append(l.leaves, hash)
+}
+
+// record appends the assets of manifest that aren't logged yet. A manifest
+// is only served once this succeeds, so nothing reaches clients unlogged.
+func (l *transparencyLog) record(manifest *update.Manifest) error {
+	var leaves []update.LogLeaf
+	for name, comp := range manifest.Components {
+		for plat, asset := range comp.Assets {
+			leaves = append(leaves, update.LogLeaf{Component: name, Version: comp.Version, Platform: plat, SHA256: asset.SHA256})
+		}
+	}
+	// Map order is random; the log's shouldn't depend on it
+	slices.SortFunc(leaves, func(a, b update.LogLeaf) int {
+		return cmp.Or(
+			strings.Compare(a.Component, b.Component),
+			strings.Compare(a.Version, b.Version),
+			strings.Compare(a.Platform, b.Platform),
+		)
+	})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var lines []byte
+	var hashes [][]byte
+	for _, leaf := range leaves {
+		hash := leaf.Hash()
+		if _, ok := l.index[string(hash)]; ok {
+			continue
+		}
+		line, err := json.Marshal(leaf)
+		if err != nil {
+			return fmt.Errorf("marshal log leaf: %w", err)
+		}
+		lines = append(append(lines, line...), '\n')
+		hashes = append(hashes, hash)
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open transparency log: %w", err)
+	}
+	if _, err := f.Write(lines); err != nil {
+		f.Close()
+		return fmt.Errorf("write transparency log: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync transparency log: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close transparency log: %w", err)
+	}
+
+	for _, hash := range hashes {
+		l.add(hash)
+	}
+	return nil
+}
+
+// snapshot returns the leaf hashes logged so far
+func (l *transparencyLog) snapshot() [][]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leaves[:len(l.leaves):len(l.leaves)]
+}
+
+// logSize parses a tree size parameter, defaulting to the whole tree
+func logSize(value string, size int) (int, bool) {
+	if value == "" {
+		return size, true
+	}
+	n, err := strconv.Atoi(value)
+	return n, err == nil && n >= 0 && n <= size
+}
+
+// logManifest records manifest's assets in the transparency log, if any
+func (s *Server) logManifest(manifest *update.Manifest) error {
+	if s.transparency == nil {
+		return nil
+	}
+	return s.transparency.record(manifest)
+}
+
+// handleCheckpoint serves the log's current size and root, signed with the
+// stable manifest keys
+func (s *Server) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	leaves := s.transparency.snapshot()
+	checkpoint := update.Checkpoint{
+		Type:      update.CheckpointType,
+		Size:      int64(len(leaves)),
+		Root:      hex.EncodeToString(update.MerkleRoot(leaves)),
+		Timestamp: time.Now().UTC(),
+	}
+
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		http.Error(w, "Failed to encode checkpoint", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, key := range s.signingKeys {
+		w.Header().Add(update.SignatureHeader, update.Sign(key, data))
+	}
+	w.Write(data)
+}
+
+// handleInclusionProof serves the audit path of an asset's leaf in the tree
+// of ?size= leaves
+func (s *Server) handleInclusionProof(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	leaf := update.LogLeaf{
+		Component: q.Get("component"),
+		Version:   q.Get("version"),
+		Platform:  q.Get("platform"),
+		SHA256:    q.Get("sha256"),
+	}
+
+	s.transparency.mu.Lock()
+	index, ok := s.transparency.index[string(leaf.Hash())]
+	s.transparency.mu.Unlock()
+	leaves := s.transparency.snapshot()
+
+	size, valid := logSize(q.Get("size"), len(leaves))
+	if !valid {
+		http.Error(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
+	if !ok || index >= size {
+		http.Error(w, "Not logged", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, update.InclusionProof{
+		Index:  int64(index),
+		Size:   int64(size),
+		Hashes: update.EncodeHashes(update.MerkleInclusion(index, leaves[:size])),
+	})
+}
+
+// handleConsistencyProof serves the proof that the tree of ?from= leaves is
+// a prefix of the tree of ?to= leaves
+func (s *Server) handleConsistencyProof(w http.ResponseWriter, r *http.Request) {
+	leaves := s.transparency.snapshot()
+	q := r.URL.Query()
+	to, okTo := logSize(q.Get("to"), len(leaves))
+	from, okFrom := logSize(q.Get("from"), to)
+	if !okTo || !okFrom || q.Get("from") == "" {
+		http.Error(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, update.ConsistencyProof{
+		From:   int64(from),
+		To:     int64(to),
+		Hashes: update.EncodeHashes(update.MerkleConsistency(from, leaves[:to])),
+	})
+}
+
+// writeJSON writes a proof response
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(v)
+}
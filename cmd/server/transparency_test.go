@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+func TestTransparencyInclusion(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "transparency.log")
+	_, h := newTestServer(t, func(s *Server) {
+		log, err := openTransparencyLog(logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.transparency = log
+	})
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	leaves := map[string]update.LogLeaf{}
+	for _, version := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+		data := []byte("nametag " + version)
+		if rec := upload(t, h, version, data, ""); rec.Code != http.StatusCreated {
+			t.Fatalf("upload %s = %d: %s", version, rec.Code, rec.Body)
+		}
+		// Serving the manifest is what logs its assets
+		if rec := serve(h, httptest.NewRequest(http.MethodGet, "/v1/manifest.json", nil), false); rec.Code != http.StatusOK {
+			t.Fatalf("manifest = %d: %s", rec.Code, rec.Body)
+		}
+		leaves[version] = update.LogLeaf{Component: "nametag", Version: version, Platform: "linux-amd64", SHA256: sha256Hex(data)}
+	}
+
+	rec := serve(h, httptest.NewRequest(http.MethodGet, update.TransparencyCheckpointPath, nil), false)
+	var checkpoint update.Checkpoint
+	if err := json.Unmarshal(rec.Body.Bytes(), &checkpoint); err != nil {
+		t.Fatalf("decode checkpoint: %v: %s", err, rec.Body)
+	}
+	if checkpoint.Size != int64(len(leaves)) {
+		t.Fatalf("checkpoint of %d leaves, want %d", checkpoint.Size, len(leaves))
+	}
+	root, err := hex.DecodeString(checkpoint.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for version, leaf := range leaves {
+		t.Run(version, func(t *testing.T) {
+			rec := serve(h, httptest.NewRequest(http.MethodGet, update.TransparencyProofPath+"?"+leaf.Query().Encode(), nil), false)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("proof = %d: %s", rec.Code, rec.Body)
+			}
+			var proof update.InclusionProof
+			if err := json.Unmarshal(rec.Body.Bytes(), &proof); err != nil {
+				t.Fatalf("decode proof: %v", err)
+			}
+			hashes, err := update.DecodeHashes(proof.Hashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := update.VerifyInclusion(leaf.Hash(), proof.Index, proof.Size, hashes, root); err != nil {
+				t.Errorf("proof doesn't lead to the checkpoint's root: %v", err)
+			}
+
+			client := update.NewTransparencyClient(filepath.Join(t.TempDir(), update.TransparencyFile))
+			if err := client.Verify(context.Background(), ts.Client(), ts.URL, "", nil, leaf); err != nil {
+				t.Errorf("Verify() = %v", err)
+			}
+		})
+	}
+
+	// An asset that was never published has no proof
+	unlogged := leaves["1.0.0"]
+	unlogged.SHA256 = sha256Hex([]byte("nametag 1.0.0, rebuilt"))
+	client := update.NewTransparencyClient(filepath.Join(t.TempDir(), update.TransparencyFile))
+	if err := client.Verify(context.Background(), ts.Client(), ts.URL, "", nil, unlogged); !errors.Is(err, update.ErrNotLogged) {
+		t.Errorf("Verify() of an unlogged asset = %v, want %v", err, update.ErrNotLogged)
+	}
+
+	// Reopened, the log rebuilds the same tree
+	reopened, err := openTransparencyLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(update.MerkleRoot(reopened.snapshot())); got != checkpoint.Root {
+		t.Errorf("reopened log root %s, want %s", got, checkpoint.Root)
+	}
+}
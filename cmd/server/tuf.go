@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// Lifetimes of the online TUF metadata. Everything is re-signed once the
+// timestamp passes half its lifetime or the targets change.
+const (
+	tufTimestampLifetime = 24 * time.Hour
+	tufSnapshotLifetime  = 7 * 24 * time.Hour
+	tufTargetsLifetime   = 7 * 24 * time.Hour
+)
+
+var versionedRootPattern = regexp.MustCompile(`^[0-9]+\.root\.json$`)
+
+// tufRepo serves TUF metadata. Root metadata is signed offline and read from
+// disk; targets, snapshot, and timestamp are generated from the assets and
+// signed with online keys.
+type tufRepo struct {
+	dir          string
+	targetsKey   ed25519.PrivateKey
+	snapshotKey  ed25519.PrivateKey
+	timestampKey ed25519.PrivateKey
+
+	mu        sync.Mutex
+	digest    string
+	version   int64
+	refreshAt time.Time
+	metadata  map[string][]byte
+}
+
+// loadTUFRepo loads root.json and the online role keys from dir and checks
+// that the keys are the ones the root trusts
+func loadTUFRepo(dir string) (*tufRepo, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "root.json"))
+	if err != nil {
+		return nil, fmt.Errorf("read root: %w", err)
+	}
+
+	root, err := update.ParseTUFRoot(data)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &tufRepo{dir: dir}
+	keys := map[string]*ed25519.PrivateKey{
+		update.TUFRoleTargets:   &repo.targetsKey,
+		update.TUFRoleSnapshot:  &repo.snapshotKey,
+		update.TUFRoleTimestamp: &repo.timestampKey,
+	}
+
+	for role, dest := range keys {
+		key, err := update.LoadPrivateKey(filepath.Join(dir, role+".pem"))
+		if err != nil {
+			return nil, err
+		}
+
+		keyID, err := update.TUFKeyID(update.NewTUFKey(key.Public().(ed25519.PublicKey)))
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(root.Roles[role].KeyIDs, keyID) {
+			return nil, fmt.Errorf("%s key %s is not trusted by root", role, keyID)
+		}
+		if root.Roles[role].Threshold > 1 {
+			return nil, fmt.Errorf("%s role requires %d signatures, only one online key is supported", role, root.Roles[role].Threshold)
+		}
+
+		*dest = key
+	}
+
+	return repo, nil
+}
+
+// handleTUF serves /v1/tuf/{name}
+func (s *Server) handleTUF(w http.ResponseWriter, r *http.Request) {
+	t := s.tuf
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/tuf/")
+
+	// Root metadata is static; versioned copies let clients walk rotations
+	if name == "root.json" || versionedRootPattern.MatchString(name) {
+		path := filepath.Join(t.dir, name)
+		if _, err := os.Stat(path); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		http.ServeFile(w, r, path)
+		return
+	}
+
+	role := strings.TrimSuffix(name, ".json")
+	if role != update.TUFRoleTimestamp && role != update.TUFRoleSnapshot && role != update.TUFRoleTargets {
+		http.NotFound(w, r)
+		return
+	}
+
+	// TUF targets cover the stable channel only
+	data, err := t.get(role, func() (*update.Manifest, error) {
+		generated, err := s.manifest(update.ChannelStable)
+		if err != nil {
+			return nil, err
+		}
+		return generated.manifest, s.logManifest(generated.manifest)
+	})
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to generate tuf metadata", "role", role, "error", err)
+		http.Error(w, "Failed to generate metadata", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(data)
+}
+
+// get returns signed metadata for an online role. Clients start with the
+// timestamp, so only a timestamp request may regenerate the metadata set;
+// the snapshot and targets that follow then match what it references.
+func (t *tufRepo) get(role string, manifest func() (*update.Manifest, error)) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.metadata == nil || role == update.TUFRoleTimestamp {
+		m, err := manifest()
+		if err != nil {
+			return nil, err
+		}
+		if err := t.refresh(m); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.metadata[role], nil
+}
+
+// refresh re-signs the metadata set if the targets changed or the timestamp
+// is past half its lifetime
+func (t *tufRepo) refresh(manifest *update.Manifest) error {
+	targets := tufTargetsFromManifest(manifest)
+
+	data, err := json.Marshal(targets)
+	if err != nil {
+		return fmt.Errorf("marshal targets: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	now := time.Now()
+	if t.metadata != nil && digest == t.digest && now.Before(t.refreshAt) {
+		return nil
+	}
+
+	// Unix time keeps versions increasing across server restarts
+	version := max(t.version+1, now.Unix())
+
+	targetsData, err := update.SignTUF(update.TUFTargets{
+		TUFHeader: update.NewTUFHeader(update.TUFRoleTargets, version, now.Add(tufTargetsLifetime)),
+		Targets:   targets,
+	}, t.targetsKey)
+	if err != nil {
+		return err
+	}
+
+	snapshotData, err := update.SignTUF(update.TUFSnapshot{
+		TUFHeader: update.NewTUFHeader(update.TUFRoleSnapshot, version, now.Add(tufSnapshotLifetime)),
+		Meta:      map[string]update.TUFMetaFile{"targets.json": metaFile(version, targetsData)},
+	}, t.snapshotKey)
+	if err != nil {
+		return err
+	}
+
+	timestampData, err := update.SignTUF(update.TUFTimestamp{
+		TUFHeader: update.NewTUFHeader(update.TUFRoleTimestamp, version, now.Add(tufTimestampLifetime)),
+		Meta:      map[string]update.TUFMetaFile{"snapshot.json": metaFile(version, snapshotData)},
+	}, t.timestampKey)
+	if err != nil {
+		return err
+	}
+
+	t.metadata = map[string][]byte{
+		update.TUFRoleTargets:   targetsData,
+		update.TUFRoleSnapshot:  snapshotData,
+		update.TUFRoleTimestamp: timestampData,
+	}
+	t.digest = digest
+	t.version = version
+	t.refreshAt = now.Add(tufTimestampLifetime / 2)
+
+	return nil
+}
+
+// tufTargetsFromManifest lists every asset of the manifest as a target
+func tufTargetsFromManifest(manifest *update.Manifest) map[string]update.TUFTarget {
+	targets := make(map[string]update.TUFTarget)
+
+	for name, comp := range manifest.Components {
+		for platform, asset := range comp.Assets {
+			path := fmt.Sprintf("%s/%s/%s", name, platform, comp.Version)
+			targets[path] = update.TUFTarget{
+				Length: asset.Size,
+				Hashes: asset.Digests(),
+				Custom: &update.TUFTargetCustom{
+					Component: name,
+					Version:   comp.Version,
+					Platform:  platform,
+					URL:       asset.URL,
+					Format:    asset.Format,
+					KeyID:     asset.KeyID,
+
+					SignatureURL:    asset.SignatureURL,
+					GPGSignatureURL: asset.GPGSignatureURL,
+					ProvenanceURL:   asset.ProvenanceURL,
+					SBOMURL:         asset.SBOMURL,
+					SBOMFormat:      asset.SBOMFormat,
+
+					Hooks: asset.Hooks,
+				},
+			}
+		}
+	}
+
+	return targets
+}
+
+func metaFile(version int64, data []byte) update.TUFMetaFile {
+	sum := sha256.Sum256(data)
+	return update.TUFMetaFile{
+		Version: version,
+		Length:  int64(len(data)),
+		Hashes:  map[string]string{"sha256": hex.EncodeToString(sum[:])},
+	}
+}
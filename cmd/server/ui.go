@@ -0,0 +1,46 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"slices"
+)
+
+// uiPath is where the web dashboard is served
+const uiPath = "/ui/"
+
+//go:embed ui
+var uiFiles embed.FS
+
+// uiHandler serves the web dashboard. It is only static pages: the data and
+// actions come from the admin API, called with a bearer token the operator
+// enters, so the dashboard is gated by the same roles as the API.
+func uiHandler() http.Handler {
+	root, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	files := http.StripPrefix(uiPath, http.FileServerFS(root))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// The pages hold a token able to yank releases; nothing but them
+		// may run scripts in them or frame them
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("Cache-Control", "no-cache")
+		files.ServeHTTP(w, r)
+	})
+}
+
+// protects reports whether some authenticator protects scope
+func (s *Server) protects(scope authScope) bool {
+	return slices.ContainsFunc(s.authenticators, func(a Authenticator) bool {
+		return slices.Contains(a.Scopes(), scope)
+	})
+}
@@ -0,0 +1,187 @@
+// Web dashboard of the update server: renders /v1/admin/releases and sends
+// release state changes to the admin API with the operator's bearer token.
+// Open /ui/?product={name} for a product listed in -products.
+"use strict";
+
+const tokenKey = "nametag-token";
+const product = new URLSearchParams(location.search).get("product");
+const api = product ? "/v1/" + encodeURIComponent(product) : "/v1";
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [key, value] of Object.entries(attrs || {})) {
+    if (key === "onclick") {
+      node.addEventListener("click", value);
+    } else {
+      node.setAttribute(key, value);
+    }
+  }
+  for (const child of children) {
+    if (child !== null && child !== undefined) {
+      node.append(child);
+    }
+  }
+  return node;
+}
+
+function setStatus(message, error) {
+  const status = document.getElementById("status");
+  status.textContent = message;
+  status.className = error ? "error" : "";
+}
+
+function formatSize(bytes) {
+  const units = ["B", "KiB", "MiB", "GiB"];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return (i === 0 ? bytes : bytes.toFixed(1)) + " " + units[i];
+}
+
+async function request(method, path, body, revision) {
+  const headers = { Authorization: "Bearer " + sessionStorage.getItem(tokenKey) };
+  if (body !== undefined) {
+    headers["Content-Type"] = "application/json";
+    headers["If-Match"] = '"' + revision + '"';
+  }
+  const resp = await fetch(api + path, {
+    method,
+    headers,
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  if (!resp.ok) {
+    const text = (await resp.text()).trim();
+    throw new Error(resp.status + " " + (text || resp.statusText));
+  }
+  return resp.json();
+}
+
+async function act(component, revision, action, body, done) {
+  try {
+    await request("POST", "/admin/components/" + encodeURIComponent(component) + "/" + action, body, revision);
+    setStatus(done);
+  } catch (err) {
+    setStatus(action + " " + component + " " + body.version + ": " + err.message, true);
+  }
+  await load(true);
+}
+
+function actions(comp, release) {
+  const run = (action, body, done) => () => act(comp.component, comp.revision, action, body, done);
+  const version = release.version;
+  const buttons = [];
+
+  if (comp.promoted !== version) {
+    buttons.push(el("button", { onclick: run("promote", { version }, "Promoted " + version) }, "Promote"));
+  }
+  if (release.yanked) {
+    buttons.push(el("button", { onclick: run("unyank", { version }, "Unyanked " + version) }, "Unyank"));
+  } else {
+    buttons.push(el("button", {
+      onclick: () => {
+        if (confirm("Yank " + comp.component + " " + version + "? Clients stop being offered it.")) {
+          run("yank", { version }, "Yanked " + version)();
+        }
+      },
+    }, "Yank"));
+  }
+  buttons.push(el("button", {
+    onclick: () => {
+      const answer = prompt("Percent of clients to offer " + version + " to (100 ends the rollout)",
+        release.rollout === undefined ? "10" : String(release.rollout));
+      if (answer !== null) {
+        const percent = Number(answer);
+        run("rollout", { version, percent }, "Rolling " + version + " out to " + percent + "%")();
+      }
+    },
+  }, "Rollout"));
+  buttons.push(el("button", {
+    onclick: () => {
+      const channel = prompt("Channel to move " + version + " to", release.channel);
+      if (channel) {
+        run("channel", { version, channel }, "Moved " + version + " to " + channel)();
+      }
+    },
+  }, "Channel"));
+  return buttons;
+}
+
+function renderComponent(comp) {
+  const rows = comp.versions.map((release) => {
+    const badges = [];
+    if (release.offered) badges.push(el("span", { class: "badge offered" }, "offered"));
+    if (comp.promoted === release.version) badges.push(el("span", { class: "badge promoted" }, "promoted"));
+    if (release.yanked) badges.push(el("span", { class: "badge yanked" }, "yanked"));
+    if (release.rollout !== undefined) badges.push(el("span", { class: "badge rollout" }, "rollout " + release.rollout + "%"));
+
+    const platforms = Object.keys(release.assets).sort();
+    const assets = platforms.length === 0 ? "none" : el("table", {},
+      ...platforms.map((platform) => {
+        const asset = release.assets[platform];
+        return el("tr", {},
+          el("td", {}, platform),
+          el("td", {}, formatSize(asset.size)),
+          el("td", { title: asset.sha256 }, el("code", {}, asset.sha256.slice(0, 12))),
+          el("td", {}, asset.downloads + " downloads"));
+      }));
+
+    return el("tr", {},
+      el("td", {}, el("strong", {}, release.version)),
+      el("td", {}, release.channel),
+      el("td", {}, ...badges),
+      el("td", {}, assets),
+      el("td", { class: "actions" }, ...actions(comp, release)));
+  });
+
+  return el("section", {},
+    el("h2", {}, comp.component, el("small", {}, "revision " + comp.revision)),
+    comp.versions.length === 0 ? el("p", {}, "No versions published.") : el("table", {},
+      el("thead", {}, el("tr", {},
+        el("th", {}, "Version"), el("th", {}, "Channel"), el("th", {}, "State"),
+        el("th", {}, "Assets"), el("th", {}, "Actions"))),
+      el("tbody", {}, ...rows)));
+}
+
+async function load(keepStatus) {
+  const main = document.getElementById("components");
+  if (!sessionStorage.getItem(tokenKey)) {
+    main.replaceChildren();
+    setStatus("Sign in with a token holding at least the reader role.");
+    return;
+  }
+  try {
+    const components = await request("GET", "/admin/releases");
+    main.replaceChildren(...components.map(renderComponent));
+    if (!keepStatus) setStatus("");
+  } catch (err) {
+    main.replaceChildren();
+    setStatus("Failed to list releases: " + err.message, true);
+  }
+}
+
+async function loadMode() {
+  try {
+    const resp = await fetch("/health");
+    const health = await resp.json();
+    document.getElementById("mode").replaceChildren(el("span", { class: "mode" }, health.mode));
+  } catch (err) {
+    document.getElementById("mode").textContent = "unreachable";
+  }
+}
+
+document.getElementById("login").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const input = document.getElementById("token");
+  sessionStorage.setItem(tokenKey, input.value.trim());
+  input.value = "";
+  load();
+});
+document.getElementById("logout").addEventListener("click", () => {
+  sessionStorage.removeItem(tokenKey);
+  load();
+});
+
+loadMode();
+load();
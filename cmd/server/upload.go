@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/catalog"
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// UploadSHA256Header carries the expected SHA-256 of an uploaded asset; a
+// multipart upload may send it as the "sha256" field instead
+const UploadSHA256Header = "X-Nametag-SHA256"
+
+// errChecksumMismatch is returned for an upload that doesn't hash to what
+// its uploader said it would
+var errChecksumMismatch = errors.New("uploaded asset doesn't match its checksum")
+
+// uploadResult describes a published asset
+type uploadResult struct {
+	Component string `json:"component"`
+	Platform  string `json:"platform"`
+	Version   string `json:"version"`
+	File      string `json:"file"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	// Unchanged is set when the same content was already published
+	Unchanged bool `json:"unchanged,omitempty"`
+	// Signed is set when a detached signature was stored with the asset
+	Signed bool `json:"signed,omitempty"`
+}
+
+// handleUpload publishes a release asset:
+//
+//	POST /v1/upload/{component}/{platform}/{version}[?force=true]
+//
+// The body is the asset itself, or a multipart form with a "file" part and
+// optionally a "signature" part, the asset's minisign signature made offline,
+// which is served in place of one from the server's keys. The expected
+// SHA-256 is required, in UploadSHA256Header, the sha256 query parameter, or
+// a "sha256" form field. Published assets and their signatures are
+// immutable: re-uploading the same content is a no-op and different content,
+// or a different signature, is refused with 409 unless force is set. Uploading needs the publisher role.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireRole(w, r, rolePublisher) {
+		return
+	}
+	if s.rejectReadOnly(w) {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/upload/"), "/")
+	if len(parts) != 3 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	comp, plat, version := parts[0], parts[1], parts[2]
+	if !s.isValidComponent(comp) || !isValidPlatform(plat) {
+		http.Error(w, "Invalid component or platform", http.StatusBadRequest)
+		return
+	}
+	if _, err := update.ParseVersion(version); err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	filename, err := s.namer.Name(comp, version, plat)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to render asset name", "error", err)
+		http.Error(w, "Invalid asset name", http.StatusInternalServerError)
+		return
+	}
+
+	// Uploads are received next to the version directory, which is only
+	// created once one is verified: an empty one would be the newest version
+	compDir := filepath.Join(s.assetsDir, comp)
+	dir := filepath.Join(compDir, version)
+	if err := os.MkdirAll(compDir, 0755); err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to create component directory", "dir", compDir, "error", err)
+		http.Error(w, "Failed to store asset", http.StatusInternalServerError)
+		return
+	}
+
+	expected := r.Header.Get(UploadSHA256Header)
+	if expected == "" {
+		expected = r.URL.Query().Get("sha256")
+	}
+	body := http.MaxBytesReader(w, r.Body, s.uploadMaxSize)
+	upload, err := receiveUpload(r, body, compDir, expected)
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytes):
+		http.Error(w, "Asset too large", http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errChecksumMismatch):
+		s.logger.WarnContext(r.Context(), "upload checksum mismatch", "component", comp, "platform", plat, "version", version, "error", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		s.logger.WarnContext(r.Context(), "upload failed", "component", comp, "platform", plat, "version", version, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer os.Remove(upload.path)
+	hash, size := upload.sha256, upload.size
+
+	result := uploadResult{Component: comp, Platform: plat, Version: version, File: filename, Size: size, SHA256: hash}
+	actor := requestIdentity(r).Subject
+
+	// Serialized with release state changes, so two uploads of one asset
+	// can't both find it unpublished
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+
+	previous, err := s.publishedHash(dir, filename)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to check published asset", "dir", dir, "file", filename, "error", err)
+		http.Error(w, "Failed to store asset", http.StatusInternalServerError)
+		return
+	}
+	force := r.URL.Query().Get("force") == "true"
+	switch {
+	case previous == hash:
+		// An asset put in place by other means is published by uploading it
+		release := catalog.Release{Version: version, Channel: update.ChannelStable, Published: time.Now().UTC()}
+		asset := catalog.Asset{Platform: plat, File: filename, Size: size, SHA256: hash}
+		if added, err := s.catalog.Import(r.Context(), comp, release, []catalog.Asset{asset}); err != nil {
+			s.logger.ErrorContext(r.Context(), "failed to catalog asset", "dir", dir, "file", filename, "error", err)
+			http.Error(w, "Failed to store asset", http.StatusInternalServerError)
+			return
+		} else if added {
+			s.assetsChanged()
+		}
+
+		// A signature may still be added to an asset published unsigned,
+		// but one already published is as immutable as the asset
+		if upload.signature != nil {
+			current, err := os.ReadFile(filepath.Join(dir, filename) + update.MinisignExtension)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				s.logger.ErrorContext(r.Context(), "failed to read published signature", "dir", dir, "file", filename, "error", err)
+				http.Error(w, "Failed to store signature", http.StatusInternalServerError)
+				return
+			}
+			replaced := current != nil && !bytes.Equal(current, upload.signature)
+			if replaced && !force {
+				http.Error(w, "Asset already published with a different signature; pass force=true to replace it", http.StatusConflict)
+				return
+			}
+			if current == nil || replaced {
+				if err := writeUploadSignature(filepath.Join(dir, filename), upload.signature); err != nil {
+					s.logger.ErrorContext(r.Context(), "failed to store signature", "dir", dir, "file", filename, "error", err)
+					http.Error(w, "Failed to store signature", http.StatusInternalServerError)
+					return
+				}
+				s.assetsChanged()
+			}
+			if replaced {
+				entry := update.AuditEntry{
+					Action:    update.AuditResign,
+					Actor:     actor,
+					Component: comp,
+					Version:   version,
+					File:      filename,
+					SHA256:    hash,
+				}
+				if err := update.AppendAuditLog(s.assetsDir, entry); err != nil {
+					s.logger.ErrorContext(r.Context(), "failed to write audit log", "error", err)
+				}
+				s.logger.InfoContext(r.Context(), "asset signature replaced",
+					"component", comp,
+					"platform", plat,
+					"version", version,
+					"actor", actor,
+					"remote", r.RemoteAddr,
+				)
+			}
+			result.Signed = true
+		}
+		result.Unchanged = true
+		writeJSON(w, result)
+		return
+	case previous != "" && !force:
+		http.Error(w, "Asset already published with different content; bump the version or pass force=true", http.StatusConflict)
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to create release directory", "dir", dir, "error", err)
+		http.Error(w, "Failed to store asset", http.StatusInternalServerError)
+		return
+	}
+	// A republished asset's old signature must not outlive it
+	sigPath := filepath.Join(dir, filename) + update.MinisignExtension
+	if err := s.removeAsset(r.Context(), sigPath); err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to remove stale signature", "path", sigPath, "error", err)
+		http.Error(w, "Failed to store asset", http.StatusInternalServerError)
+		return
+	}
+	if err := s.placeUpload(r.Context(), upload.path, size, filepath.Join(dir, filename)); err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to store asset", "dir", dir, "file", filename, "error", err)
+		http.Error(w, "Failed to store asset", http.StatusInternalServerError)
+		return
+	}
+	if upload.signature != nil {
+		if err := writeUploadSignature(filepath.Join(dir, filename), upload.signature); err != nil {
+			s.logger.ErrorContext(r.Context(), "failed to store signature", "dir", dir, "file", filename, "error", err)
+			http.Error(w, "Failed to store signature", http.StatusInternalServerError)
+			return
+		}
+		result.Signed = true
+	}
+	// Recorded for the integrity audit
+	if err := update.RecordChecksum(dir, filename, hash); err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to record checksum", "dir", dir, "error", err)
+		http.Error(w, "Failed to store asset", http.StatusInternalServerError)
+		return
+	}
+	// Published once in the catalog, which manifests are generated from
+	if err := s.publishAsset(r.Context(), comp, plat, version, update.ChannelStable, time.Time{}, size, hash); err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to catalog asset", "dir", dir, "file", filename, "error", err)
+		http.Error(w, "Failed to store asset", http.StatusInternalServerError)
+		return
+	}
+	s.assetsChanged()
+
+	entry := update.AuditEntry{
+		Action:         update.AuditPublish,
+		Actor:          actor,
+		Component:      comp,
+		Version:        version,
+		File:           filename,
+		SHA256:         hash,
+		PreviousSHA256: previous,
+	}
+	if previous != "" {
+		entry.Action = update.AuditRepublish
+	}
+	if err := update.AppendAuditLog(s.assetsDir, entry); err != nil {
+		s.logger.ErrorContext(r.Context(), "failed to write audit log", "error", err)
+	}
+	s.logger.InfoContext(r.Context(), "asset uploaded",
+		"component", comp,
+		"platform", plat,
+		"version", version,
+		"sha256", hash,
+		"size", size,
+		"republished", previous != "",
+		"signed", result.Signed,
+		"actor", actor,
+		"remote", r.RemoteAddr,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+// receivedUpload is an uploaded asset stored in a temp file
+type receivedUpload struct {
+	path   string
+	size   int64
+	sha256 string
+	// signature is the asset's detached minisign signature, if uploaded
+	signature []byte
+}
+
+// receiveUpload streams the uploaded asset into a temp file in dir while
+// hashing it, and checks the hash against expected, which a multipart form
+// may carry instead. The caller removes the temp file; on error it's
+// already gone.
+func receiveUpload(r *http.Request, body io.Reader, dir, expected string) (*receivedUpload, error) {
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	upload := &receivedUpload{path: tmp.Name()}
+	if err := upload.receive(tmp, r, body, &expected); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("close temp file: %w", err)
+	}
+
+	if expected == "" {
+		os.Remove(tmp.Name())
+		return nil, errors.New("sha256 of the asset is required")
+	}
+	if !strings.EqualFold(upload.sha256, expected) {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("%w: got %s, expected %s", errChecksumMismatch, upload.sha256, expected)
+	}
+	return upload, nil
+}
+
+func (u *receivedUpload) receive(dst io.Writer, r *http.Request, body io.Reader, expected *string) error {
+	h := sha256.New()
+	dst = io.MultiWriter(dst, h)
+	defer func() { u.sha256 = hex.EncodeToString(h.Sum(nil)) }()
+
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		var err error
+		if u.size, err = io.Copy(dst, body); err != nil {
+			return fmt.Errorf("read asset: %w", err)
+		}
+		return nil
+	}
+
+	received := false
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read form: %w", err)
+		}
+		switch part.FormName() {
+		case "file":
+			if received {
+				return errors.New("more than one file in form")
+			}
+			if u.size, err = io.Copy(dst, part); err != nil {
+				return fmt.Errorf("read asset: %w", err)
+			}
+			received = true
+		case "sha256":
+			value, err := io.ReadAll(io.LimitReader(part, 128))
+			if err != nil {
+				return fmt.Errorf("read form: %w", err)
+			}
+			if *expected == "" {
+				*expected = strings.TrimSpace(string(value))
+			}
+		case "signature":
+			// A minisign signature is four short lines
+			value, err := io.ReadAll(io.LimitReader(part, 4096))
+			if err != nil {
+				return fmt.Errorf("read form: %w", err)
+			}
+			if !strings.HasPrefix(string(value), "untrusted comment:") {
+				return errors.New("signature is not a minisign signature")
+			}
+			u.signature = value
+		}
+	}
+	if !received {
+		return errors.New("form has no file part")
+	}
+	return nil
+}
+
+// publishedHash returns the SHA-256 of the asset already published as
+// filename in dir, or "" if there is none
+func (s *Server) publishedHash(dir, filename string) (string, error) {
+	sums, err := update.ReadChecksums(filepath.Join(dir, update.ChecksumsFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if hash, ok := sums[filename]; ok {
+		return hash, nil
+	}
+
+	_, digests, err := s.cachedDigests(filepath.Join(dir, filename), update.HashSHA256)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return digests[update.HashSHA256], nil
+}
+
+// writeUploadSignature stores signature next to the asset at path, where
+// the server serves it from
+func writeUploadSignature(path string, signature []byte) error {
+	tmp := path + update.MinisignExtension + ".tmp"
+	if err := os.WriteFile(tmp, signature, 0644); err != nil {
+		return fmt.Errorf("write signature: %w", err)
+	}
+	if err := os.Rename(tmp, path+update.MinisignExtension); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write signature: %w", err)
+	}
+	return nil
+}
+
+// placeUpload moves a verified upload to dest, encrypting it at rest when
+// the server is set up to
+func (s *Server) placeUpload(ctx context.Context, tmp string, size int64, dest string) error {
+	if s.encryption != nil {
+		in, err := os.Open(tmp)
+		if err != nil {
+			return fmt.Errorf("open upload: %w", err)
+		}
+		defer in.Close()
+
+		enc, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+		if err != nil {
+			return fmt.Errorf("create temp file: %w", err)
+		}
+		defer os.Remove(enc.Name())
+		if err := update.EncryptAsset(ctx, enc, in, size, s.encryption); err != nil {
+			enc.Close()
+			return fmt.Errorf("encrypt asset: %w", err)
+		}
+		if err := enc.Close(); err != nil {
+			return fmt.Errorf("close temp file: %w", err)
+		}
+		tmp = enc.Name()
+	}
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return fmt.Errorf("chmod: %w", err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+func TestUploadImmutable(t *testing.T) {
+	s, h := newTestServer(t)
+	original, replacement := []byte("nametag 1.0.0"), []byte("nametag 1.0.0, rebuilt")
+	path := filepath.Join(s.assetsDir, "nametag", "1.0.0", "nametag-linux-amd64")
+
+	if rec := upload(t, h, "1.0.0", original, ""); rec.Code != http.StatusCreated {
+		t.Fatalf("first upload = %d: %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		query string
+		want  int
+		// stored is what the asset holds afterwards
+		stored []byte
+	}{
+		{"same content", original, "", http.StatusOK, original},
+		{"different content", replacement, "", http.StatusConflict, original},
+		{"force=false", replacement, "?force=false", http.StatusConflict, original},
+		{"forced", replacement, "?force=true", http.StatusCreated, replacement},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := upload(t, h, "1.0.0", tt.data, tt.query); rec.Code != tt.want {
+				t.Fatalf("upload = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			stored, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(stored) != string(tt.stored) {
+				t.Errorf("asset holds %q, want %q", stored, tt.stored)
+			}
+		})
+	}
+}
+
+// uploadSigned publishes data as nametag 1.0.0 for linux-amd64 in a
+// multipart form with signature, with query appended to the upload URL
+func uploadSigned(t *testing.T, h http.Handler, data []byte, signature, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile("file", "nametag-linux-amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(data)
+	form.WriteField("sha256", sha256Hex(data))
+	form.WriteField("signature", signature)
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/v1/upload/nametag/linux-amd64/1.0.0"+query, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return serve(h, req, true)
+}
+
+func TestUploadSignatureImmutable(t *testing.T) {
+	s, h := newTestServer(t)
+	data := []byte("nametag 1.0.0")
+	sigPath := filepath.Join(s.assetsDir, "nametag", "1.0.0", "nametag-linux-amd64") + update.MinisignExtension
+	first := "untrusted comment: signed by the release key\nRWQ...\n"
+	second := "untrusted comment: signed by another key\nRWQ...\n"
+
+	if rec := upload(t, h, "1.0.0", data, ""); rec.Code != http.StatusCreated {
+		t.Fatalf("first upload = %d: %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		name      string
+		signature string
+		query     string
+		want      int
+		// stored is the signature published afterwards
+		stored string
+		// resigned is whether the audit log records a replacement
+		resigned bool
+	}{
+		{"signing an unsigned asset", first, "", http.StatusOK, first, false},
+		{"same signature", first, "", http.StatusOK, first, false},
+		{"different signature", second, "", http.StatusConflict, first, false},
+		{"force=false", second, "?force=false", http.StatusConflict, first, false},
+		{"forced", second, "?force=true", http.StatusOK, second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := uploadSigned(t, h, data, tt.signature, tt.query); rec.Code != tt.want {
+				t.Fatalf("upload = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			stored, err := os.ReadFile(sigPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(stored) != tt.stored {
+				t.Errorf("signature %q, want %q", stored, tt.stored)
+			}
+			audit, err := os.ReadFile(filepath.Join(s.assetsDir, update.AuditLogFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resigned := strings.Contains(string(audit), `"action":"`+update.AuditResign+`"`); resigned != tt.resigned {
+				t.Errorf("audit log records a replaced signature: %t, want %t:\n%s", resigned, tt.resigned, audit)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package compat
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// Run checks the fixture both ways: the server binary at serverBinary,
+// started with args on the fixture's files, against the recorded client,
+// and this release's client against the recorded server
+func Run(ctx context.Context, f *Fixture, serverBinary string, args ...string) error {
+	dir, err := os.MkdirTemp("", "nametag-compat-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	assetsDir := filepath.Join(dir, "assets")
+	if err := f.WriteFiles(assetsDir); err != nil {
+		return err
+	}
+	// A signing server publishes fields an unsigned one leaves out; any key
+	// does, as the recorded client's keys are checked with CheckClient
+	if len(f.PublicKeys) > 0 {
+		keyPath := filepath.Join(dir, "signing-key.pem")
+		if err := writeSigningKey(keyPath); err != nil {
+			return err
+		}
+		args = append([]string{"-signing-key", keyPath}, args...)
+	}
+
+	server, err := StartServer(ctx, serverBinary, assetsDir, args...)
+	if err != nil {
+		return err
+	}
+	serverErr := CheckServer(ctx, server.URL, f)
+	server.Stop()
+	if serverErr != nil {
+		serverErr = fmt.Errorf("%s client, current server: %w", f.Version, serverErr)
+	}
+	clientErr := CheckClient(ctx, f)
+	if clientErr != nil {
+		clientErr = fmt.Errorf("current client, %s server: %w", f.Version, clientErr)
+	}
+	return errors.Join(serverErr, clientErr)
+}
+
+// CheckServer replays the fixture's requests against the server at
+// serverURL, which must serve the fixture's files, and returns what in its
+// responses the recorded client would not accept
+func CheckServer(ctx context.Context, serverURL string, f *Fixture) error {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var problems []error
+	for _, recorded := range f.Exchanges {
+		where := recorded.Method + " " + recorded.URI
+		req, err := http.NewRequestWithContext(ctx, recorded.Method, strings.TrimSuffix(serverURL, "/")+recorded.URI, nil)
+		if err != nil {
+			return err
+		}
+		req.Header = recorded.Header.Clone()
+
+		resp, err := client.Do(req)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", where, err))
+			continue
+		}
+		body, err := readBody(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", where, err))
+			continue
+		}
+
+		if resp.StatusCode != recorded.Status {
+			problems = append(problems, fmt.Errorf("%s: status %d, recorded %d", where, resp.StatusCode, recorded.Status))
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			continue
+		}
+		if got, want := mediaType(resp.Header), mediaType(recorded.ResponseHeader); got != want {
+			problems = append(problems, fmt.Errorf("%s: content type %q, recorded %q", where, got, want))
+		}
+
+		path, _, _ := strings.Cut(recorded.URI, "?")
+		switch {
+		case strings.HasSuffix(path, "/manifest.json"):
+			for _, problem := range compareManifest(f, recorded.Body, body) {
+				problems = append(problems, fmt.Errorf("%s: %w", where, problem))
+			}
+		case strings.Contains(path, "/download/") && recorded.Method == http.MethodGet:
+			if !bytes.Equal(body, recorded.Body) {
+				problems = append(problems, fmt.Errorf("%s: asset differs from the recorded one", where))
+			}
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// compareManifest returns why a client that decodes f.ManifestFields of
+// schema f.SchemaVersion would refuse or misread current, a manifest served
+// in place of recorded
+func compareManifest(f *Fixture, recorded, current []byte) []error {
+	known := make(map[string]bool, len(f.ManifestFields))
+	for _, field := range f.ManifestFields {
+		known[field] = true
+	}
+
+	var old, cur any
+	if err := json.Unmarshal(recorded, &old); err != nil {
+		return []error{fmt.Errorf("recorded manifest: %w", err)}
+	}
+	if err := json.Unmarshal(current, &cur); err != nil {
+		return []error{fmt.Errorf("manifest: %w", err)}
+	}
+	oldShape, curShape := make(map[string]string), make(map[string]string)
+	shape(old, "", known, oldShape)
+	shape(cur, "", known, curShape)
+
+	var problems []error
+	for _, field := range sortedKeys(oldShape) {
+		kind, ok := curShape[field]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Errorf("manifest field %s is gone", field))
+		case kind != oldShape[field]:
+			problems = append(problems, fmt.Errorf("manifest field %s is a %s, recorded as a %s", field, kind, oldShape[field]))
+		}
+	}
+
+	// Clients decode manifests of their own schema strictly, and only
+	// tolerate unknown fields in a newer one
+	var header struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	json.Unmarshal(current, &header)
+	if header.SchemaVersion <= f.SchemaVersion {
+		// Sorted, an unknown field's own fields follow it and go unreported
+		reported := ""
+		for _, field := range sortedKeys(curShape) {
+			if known[field] || (reported != "" && strings.HasPrefix(field, reported+".")) {
+				continue
+			}
+			reported = field
+			problems = append(problems, fmt.Errorf("manifest field %s is unknown to schema %d clients, which refuse it unless schema_version is raised", field, f.SchemaVersion))
+		}
+	}
+	return problems
+}
+
+// shape records the JSON kind of every field below path in v, with the keys
+// of maps the known fields name collapsed to *. Nulls are left out, since a
+// client decodes them like absent fields.
+func shape(v any, path string, known map[string]bool, out map[string]string) {
+	switch v := v.(type) {
+	case map[string]any:
+		if path != "" {
+			out[path] = "object"
+		}
+		for key, value := range v {
+			field := joinPath(path, key)
+			if wildcard := joinPath(path, "*"); !known[field] && known[wildcard] {
+				field = wildcard
+			}
+			shape(value, field, known, out)
+		}
+	case []any:
+		out[path] = "array"
+		for _, elem := range v {
+			// Elements are described by the array's own field
+			if object, ok := elem.(map[string]any); ok {
+				for key, value := range object {
+					shape(value, joinPath(path, key), known, out)
+				}
+			}
+		}
+	case string:
+		out[path] = "string"
+	case float64:
+		out[path] = "number"
+	case bool:
+		out[path] = "boolean"
+	}
+}
+
+// CheckClient serves the fixture's recorded responses to this release's
+// client, which must accept the manifest and download the recorded asset
+func CheckClient(ctx context.Context, f *Fixture) error {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, recorded := range f.Exchanges {
+			if recorded.Method == r.Method && recorded.URI == r.URL.RequestURI() {
+				recorded.write(w)
+				return
+			}
+		}
+		http.Error(w, "Not recorded", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	var keys []ed25519.PublicKey
+	for _, encoded := range f.PublicKeys {
+		key, err := update.ParsePublicKey(encoded)
+		if err != nil {
+			return fmt.Errorf("fixture public key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	opts, err := clientOptions(keys)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := update.NewChecker(server.URL, slog.New(slog.DiscardHandler), opts...).GetManifest(ctx)
+	if err != nil {
+		return fmt.Errorf("check: %w", err)
+	}
+	asset, err := manifestAsset(manifest, f.Component, f.Platform)
+	if err != nil {
+		return err
+	}
+	return download(ctx, server.URL, asset, opts)
+}
+
+// Server is a server binary started by StartServer
+type Server struct {
+	URL    string
+	cmd    *exec.Cmd
+	output bytes.Buffer
+	exited chan struct{}
+}
+
+// StartServer starts the server binary at path serving assetsDir, with
+// further args, and waits until it answers
+func StartServer(ctx context.Context, path, assetsDir string, args ...string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	s := &Server{URL: "http://" + addr, exited: make(chan struct{})}
+	s.cmd = exec.Command(path, append([]string{"-addr", addr, "-assets", assetsDir}, args...)...)
+	s.cmd.Stdout = &s.output
+	s.cmd.Stderr = &s.output
+	if err := s.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start server: %w", err)
+	}
+	go func() {
+		s.cmd.Wait()
+		close(s.exited)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	for {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/v1/manifest.json", nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			return s, nil
+		}
+		select {
+		case <-s.exited:
+			return nil, fmt.Errorf("server exited: %s", s.output.String())
+		case <-ctx.Done():
+			s.Stop()
+			return nil, fmt.Errorf("server didn't start: %w", ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Stop stops the server
+func (s *Server) Stop() {
+	s.cmd.Process.Kill()
+	<-s.exited
+}
+
+// writeSigningKey writes a new signing key to path
+func writeSigningKey(path string) error {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	data, err := update.EncodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func mediaType(h http.Header) string {
+	t, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return t
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
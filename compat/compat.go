@@ -0,0 +1,191 @@
+// Package compat checks that clients and servers of different releases
+// still understand each other. A release is captured in a fixture, recorded
+// once while it is current: the releases its server served, the requests its
+// client sent, the responses it got back, and the manifest fields that client
+// decodes. Checking a fixture against today's code covers both directions of
+// version skew:
+//
+//   - old client, new server: the recorded requests are replayed against the
+//     current server, whose responses must still be what the old client
+//     accepts (CheckServer)
+//   - new client, old server: the recorded responses are served to the
+//     current client, which must still accept them (CheckClient)
+//
+// A protocol or schema change, e.g. a new manifest field, proves itself
+// backward compatible by passing against the fixtures of every release still
+// deployed. Fixtures are kept in fixtures/ and checked with
+// nametag-release compat.
+package compat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// Fixture is what one release's client and server exchanged
+type Fixture struct {
+	// Version is the nametag release that recorded the fixture
+	Version string `json:"version"`
+	// SchemaVersion is the manifest schema the release speaks
+	SchemaVersion int `json:"schema_version"`
+	// ManifestFields are the manifest fields the release's client decodes,
+	// as dotted paths with * for map keys, e.g. components.*.assets.*.url
+	ManifestFields []string `json:"manifest_fields"`
+	// Component and Platform are the asset the client checked for and
+	// downloaded
+	Component string `json:"component"`
+	Platform  string `json:"platform"`
+	// PublicKeys verify the recorded manifest's signatures; empty when the
+	// server didn't sign it
+	PublicKeys []string `json:"public_keys,omitempty"`
+	// Files are the assets directory the recording server served, so a
+	// current server can serve the same releases
+	Files []File `json:"files"`
+	// Exchanges are the client's requests and the server's responses, in
+	// order
+	Exchanges []Exchange `json:"exchanges"`
+}
+
+// File is a file of an assets directory
+type File struct {
+	// Path is slash-separated, relative to the assets directory
+	Path    string `json:"path"`
+	Content []byte `json:"content"`
+}
+
+// Exchange is a request and the response it got
+type Exchange struct {
+	Method string `json:"method"`
+	// URI is the request's path and query
+	URI            string      `json:"uri"`
+	Header         http.Header `json:"header,omitempty"`
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	Body           []byte      `json:"body,omitempty"`
+}
+
+// Load reads the fixture at path
+func Load(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read fixture: %w", err)
+	}
+	var f Fixture
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("decode fixture %s: %w", path, err)
+	}
+	if f.Component == "" || f.Platform == "" || len(f.Exchanges) == 0 {
+		return nil, fmt.Errorf("fixture %s records no check", path)
+	}
+	return &f, nil
+}
+
+// LoadDir reads the fixtures (*.json) in dir, oldest release first
+func LoadDir(dir string) ([]*Fixture, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []*Fixture
+	for _, path := range paths {
+		f, err := Load(path)
+		if err != nil {
+			return nil, err
+		}
+		fixtures = append(fixtures, f)
+	}
+	sort.Slice(fixtures, func(i, j int) bool {
+		a, errA := update.ParseVersion(fixtures[i].Version)
+		b, errB := update.ParseVersion(fixtures[j].Version)
+		if errA != nil || errB != nil {
+			return fixtures[i].Version < fixtures[j].Version
+		}
+		return a.LessThan(b)
+	})
+	return fixtures, nil
+}
+
+// Save writes the fixture to path
+func (f *Fixture) Save(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// WriteFiles recreates the recorded assets directory in dir
+func (f *Fixture) WriteFiles(dir string) error {
+	for _, file := range f.Files {
+		if !filepath.IsLocal(filepath.FromSlash(file.Path)) {
+			return fmt.Errorf("fixture file %q is outside the assets directory", file.Path)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, file.Content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ManifestFields returns the manifest fields this release's client decodes
+func ManifestFields() []string {
+	var fields []string
+	collectFields(reflect.TypeFor[update.Manifest](), "", &fields)
+	slices.Sort(fields)
+	return fields
+}
+
+var (
+	timeType      = reflect.TypeFor[time.Time]()
+	marshalerType = reflect.TypeFor[json.Marshaler]()
+)
+
+// collectFields appends the JSON paths of t's fields below prefix
+func collectFields(t reflect.Type, prefix string, fields *[]string) {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType || t.Implements(marshalerType):
+		return
+	case t.Kind() == reflect.Map:
+		path := joinPath(prefix, "*")
+		*fields = append(*fields, path)
+		collectFields(t.Elem(), path, fields)
+	case t.Kind() == reflect.Struct:
+		for i := range t.NumField() {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			path := joinPath(prefix, name)
+			*fields = append(*fields, path)
+			collectFields(field.Type, path, fields)
+		}
+	}
+}
+
+func joinPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
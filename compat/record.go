@@ -0,0 +1,260 @@
+package compat
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+)
+
+// maxBodySize caps the bodies recorded and compared; fixtures stand in for
+// releases with small assets
+const maxBodySize = 64 << 20
+
+// RecordManifestTTL is the least -manifest-ttl of a server recorded with
+// Record: fixtures are replayed for as long as their release is deployed
+const RecordManifestTTL = 876000 * time.Hour // 100 years
+
+// Recorder is a proxy in front of a server that records the exchanges
+// passing through it
+type Recorder struct {
+	target string
+	client *http.Client
+
+	mu        sync.Mutex
+	exchanges []Exchange
+}
+
+// NewRecorder returns a recorder proxying to the server at serverURL
+func NewRecorder(serverURL string) *Recorder {
+	return &Recorder{
+		target: strings.TrimSuffix(serverURL, "/"),
+		// Redirects are the client's to follow, and to record
+		client: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}},
+	}
+}
+
+func (rec *Recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, rec.target+r.URL.RequestURI(), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	req.Header = requestHeader(r.Header)
+
+	resp, err := rec.client.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := readBody(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	exchange := Exchange{
+		Method:         r.Method,
+		URI:            r.URL.RequestURI(),
+		Header:         req.Header,
+		Status:         resp.StatusCode,
+		ResponseHeader: responseHeader(resp.Header),
+		Body:           body,
+	}
+	rec.mu.Lock()
+	rec.exchanges = append(rec.exchanges, exchange)
+	rec.mu.Unlock()
+
+	exchange.write(w)
+}
+
+// Exchanges returns the exchanges recorded so far
+func (rec *Recorder) Exchanges() []Exchange {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]Exchange(nil), rec.exchanges...)
+}
+
+// Record checks for component's asset for platform on the server at
+// serverURL with this release's client and downloads it, and returns the
+// fixture of it, recorded as release version. assetsDir is the server's
+// assets directory; keys verify its manifest signatures when it signs them.
+// Clients refuse signed manifests that never expire, so the server must run
+// with a -manifest-ttl of at least RecordManifestTTL instead, which keeps the
+// recorded manifest valid when replayed.
+func Record(ctx context.Context, version, serverURL, assetsDir, component, platform string, keys []ed25519.PublicKey) (*Fixture, error) {
+	rec := NewRecorder(serverURL)
+	proxy := httptest.NewServer(rec)
+	defer proxy.Close()
+
+	opts, err := clientOptions(keys)
+	if err != nil {
+		return nil, err
+	}
+	logger := slog.New(slog.DiscardHandler)
+	manifest, err := update.NewChecker(proxy.URL, logger, opts...).GetManifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("check: %w", err)
+	}
+	if !manifest.Expires.IsZero() && manifest.Expires.Before(time.Now().Add(RecordManifestTTL-time.Hour)) {
+		return nil, fmt.Errorf("the manifest expires at %s; record against a server started with -manifest-ttl %s", manifest.Expires.Format(time.RFC3339), RecordManifestTTL)
+	}
+	asset, err := manifestAsset(manifest, component, platform)
+	if err != nil {
+		return nil, err
+	}
+	if err := download(ctx, proxy.URL, asset, opts); err != nil {
+		return nil, err
+	}
+
+	files, err := readFiles(assetsDir)
+	if err != nil {
+		return nil, err
+	}
+	f := &Fixture{
+		Version:        version,
+		SchemaVersion:  update.SchemaVersion,
+		ManifestFields: ManifestFields(),
+		Component:      component,
+		Platform:       platform,
+		Files:          files,
+		Exchanges:      rec.Exchanges(),
+	}
+	for _, key := range keys {
+		f.PublicKeys = append(f.PublicKeys, update.EncodePublicKey(key))
+	}
+	return f, nil
+}
+
+// clientOptions returns the options of a client trusting keys
+func clientOptions(keys []ed25519.PublicKey) ([]update.Option, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	trusted, err := update.NewLocalKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return []update.Option{update.WithTrustedKeys(trusted)}, nil
+}
+
+// manifestAsset returns component's asset for platform
+func manifestAsset(manifest *update.Manifest, component, platform string) (update.Asset, error) {
+	comp, ok := manifest.Components[component]
+	if !ok {
+		return update.Asset{}, fmt.Errorf("component %q not found in manifest", component)
+	}
+	if _, err := update.ParseVersion(comp.Version); err != nil {
+		return update.Asset{}, fmt.Errorf("component %q: %w", component, err)
+	}
+	asset, ok := comp.Assets[platform]
+	if !ok {
+		return update.Asset{}, fmt.Errorf("component %q has no asset for %s", component, platform)
+	}
+	return asset, nil
+}
+
+// download downloads asset from the server at serverURL and verifies it
+// against the manifest's digests
+func download(ctx context.Context, serverURL string, asset update.Asset, opts []update.Option) error {
+	dir, err := os.MkdirTemp("", "nametag-compat-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "asset")
+	logger := slog.New(slog.DiscardHandler)
+	if _, err := update.NewDownloader(logger, opts...).Download(ctx, serverURL+asset.URL, path, nil); err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+	return update.VerifyChecksum(path, asset.Digests())
+}
+
+// readFiles reads an assets directory, without the dot files the server
+// keeps for itself
+func readFiles(dir string) ([]File, error) {
+	var files []File
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{Path: filepath.ToSlash(rel), Content: content})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read assets: %w", err)
+	}
+	return files, nil
+}
+
+// requestHeader returns the headers of a request worth replaying: what the
+// client chose to send, not what its transport adds
+func requestHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range []string{"Connection", "Accept-Encoding", "Content-Length"} {
+		h.Del(name)
+	}
+	return h
+}
+
+// responseHeader returns the headers of a response worth replaying
+func responseHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range []string{"Connection", "Date", "Content-Length"} {
+		h.Del(name)
+	}
+	return h
+}
+
+func readBody(r io.Reader) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBodySize {
+		return nil, fmt.Errorf("body larger than %d bytes", maxBodySize)
+	}
+	return body, nil
+}
+
+// write sends the exchange's response
+func (e Exchange) write(w http.ResponseWriter) {
+	for name, values := range e.ResponseHeader {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(e.Status)
+	io.Copy(w, bytes.NewReader(e.Body))
+}
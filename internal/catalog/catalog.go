@@ -0,0 +1,437 @@
+// Package catalog keeps the release metadata of an update server in SQLite:
+// each component's published versions, the channel each is on, the assets
+// published for them, and the release state operators control. The assets
+// directory only holds the files; what a manifest offers is decided here, so
+// whatever publishes into the directory records what it published as well.
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/update"
+
+	// Registers the "sqlite" driver, which needs no cgo
+	_ "modernc.org/sqlite"
+)
+
+// File is the catalog's name at the root of an assets directory. Like the
+// server's other dot files it is never synced with a storage; servers share
+// their catalog through copies made with Export.
+const File = ".catalog.db"
+
+// schemaVersion is the layout of the tables below, kept in user_version
+const schemaVersion = 1
+
+const schema = `
+CREATE TABLE releases (
+	component TEXT NOT NULL,
+	version   TEXT NOT NULL,
+	channel   TEXT NOT NULL,
+	published INTEGER NOT NULL,
+	PRIMARY KEY (component, version)
+);
+CREATE TABLE assets (
+	component TEXT NOT NULL,
+	version   TEXT NOT NULL,
+	platform  TEXT NOT NULL,
+	file      TEXT NOT NULL,
+	size      INTEGER NOT NULL,
+	sha256    TEXT NOT NULL,
+	published INTEGER NOT NULL,
+	PRIMARY KEY (component, version, platform),
+	FOREIGN KEY (component, version) REFERENCES releases ON DELETE CASCADE
+);
+CREATE TABLE states (
+	component TEXT PRIMARY KEY,
+	state     TEXT NOT NULL
+);
+CREATE TABLE meta (
+	id       INTEGER PRIMARY KEY CHECK (id = 1),
+	serial   INTEGER NOT NULL,
+	changed  INTEGER NOT NULL,
+	imported INTEGER NOT NULL
+);
+INSERT INTO meta (id, serial, changed, imported) VALUES (1, 0, 0, 0);
+`
+
+// ErrNotFound is returned for a release the catalog doesn't have
+var ErrNotFound = errors.New("release not in catalog")
+
+// Release is a published version of a component
+type Release struct {
+	Version string
+	Channel string
+	// Published is when the version was first published
+	Published time.Time
+}
+
+// Asset is the file published for a platform of a release
+type Asset struct {
+	Platform string
+	// File is the asset's name in the release's directory
+	File   string
+	Size   int64
+	SHA256 string
+}
+
+// Catalog is an open catalog database. Several processes may have the same
+// one open, such as the server and nametag-release publishing next to it.
+type Catalog struct {
+	db *sql.DB
+}
+
+// Open opens the catalog at path, creating it if needed
+func Open(path string) (*Catalog, error) {
+	// Writers take the lock up front, so one waiting on another's isn't
+	// refused for upgrading a read lock
+	query := url.Values{
+		"_pragma": {"busy_timeout(10000)", "journal_mode(WAL)", "foreign_keys(1)"},
+		"_txlock": {"immediate"},
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?"+query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("open catalog: %w", err)
+	}
+	c := &Catalog{db: db}
+	if err := c.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open catalog %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// migrate creates the tables of a new catalog, and refuses one written by a
+// newer version
+func (c *Catalog) migrate() error {
+	return c.write(context.Background(), false, func(tx *sql.Tx) error {
+		var version int
+		if err := tx.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+			return err
+		}
+		switch {
+		case version == schemaVersion:
+			return nil
+		case version > schemaVersion:
+			return fmt.Errorf("catalog schema %d is newer than this version supports (%d)", version, schemaVersion)
+		}
+		if _, err := tx.Exec(schema); err != nil {
+			return fmt.Errorf("create tables: %w", err)
+		}
+		_, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, schemaVersion))
+		return err
+	})
+}
+
+// Close closes the database
+func (c *Catalog) Close() error {
+	return c.db.Close()
+}
+
+// Imported reports whether the releases of the assets directory from before
+// the catalog was created were imported into it. Whoever creates it, the
+// server imports them once.
+func (c *Catalog) Imported(ctx context.Context) (bool, error) {
+	var imported bool
+	if err := c.db.QueryRowContext(ctx, `SELECT imported FROM meta WHERE id = 1`).Scan(&imported); err != nil {
+		return false, fmt.Errorf("read catalog: %w", err)
+	}
+	return imported, nil
+}
+
+// SetImported records that the releases of the assets directory were
+// imported
+func (c *Catalog) SetImported(ctx context.Context) error {
+	return c.write(ctx, false, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE meta SET imported = 1 WHERE id = 1`)
+		return err
+	})
+}
+
+// Releases returns a component's releases, newest first by version
+// precedence, so 1.10.0 sorts above 1.9.0
+func (c *Catalog) Releases(ctx context.Context, comp string) ([]Release, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT version, channel, published FROM releases WHERE component = ?`, comp)
+	if err != nil {
+		return nil, fmt.Errorf("list releases: %w", err)
+	}
+	defer rows.Close()
+
+	var releases []Release
+	for rows.Next() {
+		var r Release
+		var published int64
+		if err := rows.Scan(&r.Version, &r.Channel, &published); err != nil {
+			return nil, fmt.Errorf("list releases: %w", err)
+		}
+		r.Published = time.Unix(0, published).UTC()
+		releases = append(releases, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list releases: %w", err)
+	}
+	slices.SortFunc(releases, func(a, b Release) int {
+		va, _ := update.ParseVersion(a.Version)
+		vb, _ := update.ParseVersion(b.Version)
+		return vb.Compare(va)
+	})
+	return releases, nil
+}
+
+// Release returns a component's release of version, or ErrNotFound
+func (c *Catalog) Release(ctx context.Context, comp, version string) (Release, error) {
+	r := Release{Version: version}
+	var published int64
+	err := c.db.QueryRowContext(ctx, `SELECT channel, published FROM releases WHERE component = ? AND version = ?`, comp, version).
+		Scan(&r.Channel, &published)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Release{}, fmt.Errorf("%s %s: %w", comp, version, ErrNotFound)
+	}
+	if err != nil {
+		return Release{}, fmt.Errorf("read release: %w", err)
+	}
+	r.Published = time.Unix(0, published).UTC()
+	return r, nil
+}
+
+// Assets returns the assets of a release by platform
+func (c *Catalog) Assets(ctx context.Context, comp, version string) (map[string]Asset, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT platform, file, size, sha256 FROM assets WHERE component = ? AND version = ?`, comp, version)
+	if err != nil {
+		return nil, fmt.Errorf("list assets: %w", err)
+	}
+	defer rows.Close()
+
+	assets := make(map[string]Asset)
+	for rows.Next() {
+		var a Asset
+		if err := rows.Scan(&a.Platform, &a.File, &a.Size, &a.SHA256); err != nil {
+			return nil, fmt.Errorf("list assets: %w", err)
+		}
+		assets[a.Platform] = a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list assets: %w", err)
+	}
+	return assets, nil
+}
+
+// Publish records asset as published for a component's release, replacing
+// the one of its platform. A version's first asset publishes the version on
+// release's channel, as of its Published time or else now; a version
+// already published stays as it is.
+func (c *Catalog) Publish(ctx context.Context, comp string, release Release, asset Asset) error {
+	now := time.Now().UnixNano()
+	published := now
+	if !release.Published.IsZero() {
+		published = release.Published.UnixNano()
+	}
+	return c.write(ctx, true, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO releases (component, version, channel, published) VALUES (?, ?, ?, ?)`,
+			comp, release.Version, release.Channel, published); err != nil {
+			return fmt.Errorf("publish release: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO assets (component, version, platform, file, size, sha256, published) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			comp, release.Version, asset.Platform, asset.File, asset.Size, asset.SHA256, now); err != nil {
+			return fmt.Errorf("publish asset: %w", err)
+		}
+		return nil
+	})
+}
+
+// Import records a release found in an assets directory and its assets,
+// keeping what the catalog already has of them. It reports whether it
+// recorded anything.
+func (c *Catalog) Import(ctx context.Context, comp string, release Release, assets []Asset) (bool, error) {
+	imported := false
+	err := c.write(ctx, true, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO releases (component, version, channel, published) VALUES (?, ?, ?, ?)`,
+			comp, release.Version, release.Channel, release.Published.UnixNano())
+		if err != nil {
+			return fmt.Errorf("import release: %w", err)
+		}
+		imported = rowsAffected(res) > 0
+		for _, a := range assets {
+			res, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO assets (component, version, platform, file, size, sha256, published) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				comp, release.Version, a.Platform, a.File, a.Size, a.SHA256, release.Published.UnixNano())
+			if err != nil {
+				return fmt.Errorf("import asset: %w", err)
+			}
+			imported = imported || rowsAffected(res) > 0
+		}
+		if !imported {
+			return errUnchanged
+		}
+		return nil
+	})
+	if errors.Is(err, errUnchanged) {
+		return false, nil
+	}
+	return imported, err
+}
+
+// SetChannel moves a component's release of version to channel
+func (c *Catalog) SetChannel(ctx context.Context, comp, version, channel string) error {
+	return c.write(ctx, true, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE releases SET channel = ? WHERE component = ? AND version = ?`, channel, comp, version)
+		if err != nil {
+			return fmt.Errorf("set channel: %w", err)
+		}
+		if rowsAffected(res) == 0 {
+			return fmt.Errorf("%s %s: %w", comp, version, ErrNotFound)
+		}
+		return nil
+	})
+}
+
+// RemoveAsset drops the asset of a platform from a release, which stays
+// published with the others
+func (c *Catalog) RemoveAsset(ctx context.Context, comp, version, platform string) error {
+	return c.write(ctx, true, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM assets WHERE component = ? AND version = ? AND platform = ?`, comp, version, platform); err != nil {
+			return fmt.Errorf("remove asset: %w", err)
+		}
+		return nil
+	})
+}
+
+// State returns a component's release state as last stored, or nil for a
+// component without one. Its encoding is the caller's.
+func (c *Catalog) State(ctx context.Context, comp string) ([]byte, error) {
+	var state []byte
+	err := c.db.QueryRowContext(ctx, `SELECT state FROM states WHERE component = ?`, comp).Scan(&state)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read release state: %w", err)
+	}
+	return state, nil
+}
+
+// SetState stores a component's release state
+func (c *Catalog) SetState(ctx context.Context, comp string, state []byte) error {
+	return c.write(ctx, true, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO states (component, state) VALUES (?, ?)`, comp, string(state)); err != nil {
+			return fmt.Errorf("write release state: %w", err)
+		}
+		return nil
+	})
+}
+
+// Changed returns a serial number that grows with every change to the
+// catalog, by any process, and when the last one was made
+func (c *Catalog) Changed(ctx context.Context) (int64, time.Time, error) {
+	var serial, changed int64
+	if err := c.db.QueryRowContext(ctx, `SELECT serial, changed FROM meta WHERE id = 1`).Scan(&serial, &changed); err != nil {
+		return 0, time.Time{}, fmt.Errorf("read catalog changes: %w", err)
+	}
+	if changed == 0 {
+		return serial, time.Time{}, nil
+	}
+	return serial, time.Unix(0, changed).UTC(), nil
+}
+
+// Export writes a consistent copy of the catalog to path, replacing the file
+// there, for other servers to Restore
+func (c *Catalog) Export(ctx context.Context, path string) error {
+	// VACUUM INTO refuses to overwrite, so the copy is written next to path
+	// and moved over it
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("export catalog: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, `VACUUM INTO ?`, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("export catalog: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("export catalog: %w", err)
+	}
+	return nil
+}
+
+// Restore replaces the releases, assets, and release states of the catalog
+// with those of a copy written by Export. The catalog's last change becomes
+// the copy's.
+func (c *Catalog) Restore(ctx context.Context, path string) error {
+	// A database can't be attached inside a transaction, so the copy is
+	// attached to a connection of its own for the length of the restore
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("restore catalog: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS snapshot`, "file:"+path+"?mode=ro"); err != nil {
+		return fmt.Errorf("restore catalog: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `DETACH DATABASE snapshot`)
+
+	var version int
+	if err := conn.QueryRowContext(ctx, `PRAGMA snapshot.user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("restore catalog: %w", err)
+	}
+	if version != schemaVersion {
+		return fmt.Errorf("restore catalog: copy has schema %d, this version supports %d", version, schemaVersion)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("restore catalog: %w", err)
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`DELETE FROM assets`,
+		`DELETE FROM releases`,
+		`DELETE FROM states`,
+		`INSERT INTO releases SELECT * FROM snapshot.releases`,
+		`INSERT INTO assets SELECT * FROM snapshot.assets`,
+		`INSERT INTO states SELECT * FROM snapshot.states`,
+		`UPDATE meta SET serial = serial + 1, changed = (SELECT changed FROM snapshot.meta WHERE id = 1), imported = 1 WHERE id = 1`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("restore catalog: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// errUnchanged rolls back a write that turned out to change nothing
+var errUnchanged = errors.New("unchanged")
+
+// write runs f in a transaction, counting it as a change of the catalog
+// when changes is set
+func (c *Catalog) write(ctx context.Context, changes bool, f func(*sql.Tx) error) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+	if changes {
+		if _, err := tx.ExecContext(ctx, `UPDATE meta SET serial = serial + 1, changed = ? WHERE id = 1`, time.Now().UnixNano()); err != nil {
+			return fmt.Errorf("record change: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func rowsAffected(res sql.Result) int64 {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,284 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func openTest(t *testing.T, path string) *Catalog {
+	t.Helper()
+	c, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func asset(plat string) Asset {
+	return Asset{Platform: plat, File: "nametag-" + plat, Size: 10, SHA256: "ab"}
+}
+
+func versions(releases []Release) []string {
+	var vs []string
+	for _, r := range releases {
+		vs = append(vs, r.Version)
+	}
+	return vs
+}
+
+func TestReleasesOrder(t *testing.T) {
+	ctx := context.Background()
+	c := openTest(t, filepath.Join(t.TempDir(), File))
+	for _, v := range []string{"1.9.0", "1.10.0", "1.2.3", "2.0.0", "1.10.1"} {
+		if err := c.Publish(ctx, "nametag", Release{Version: v, Channel: "stable"}, asset("linux-amd64")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := c.Releases(ctx, "nametag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2.0.0", "1.10.1", "1.10.0", "1.9.0", "1.2.3"}
+	if !slices.Equal(versions(got), want) {
+		t.Errorf("Releases() = %v, want %v", versions(got), want)
+	}
+	if other, err := c.Releases(ctx, "nametag-up"); err != nil || len(other) != 0 {
+		t.Errorf("Releases() of another component = %v, %v", other, err)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	ctx := context.Background()
+	c := openTest(t, filepath.Join(t.TempDir(), File))
+	published := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	if err := c.Publish(ctx, "nametag", Release{Version: "1.0.0", Channel: "beta", Published: published}, asset("linux-amd64")); err != nil {
+		t.Fatal(err)
+	}
+	// The version's later assets leave it where it was published
+	later := asset("darwin-arm64")
+	if err := c.Publish(ctx, "nametag", Release{Version: "1.0.0", Channel: "stable"}, later); err != nil {
+		t.Fatal(err)
+	}
+	// A republished asset replaces its platform's
+	replaced := asset("linux-amd64")
+	replaced.SHA256 = "cd"
+	if err := c.Publish(ctx, "nametag", Release{Version: "1.0.0", Channel: "stable"}, replaced); err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := c.Release(ctx, "nametag", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if release.Channel != "beta" || !release.Published.Equal(published) {
+		t.Errorf("Release() = %+v, want on beta as of %s", release, published)
+	}
+	assets, err := c.Assets(ctx, "nametag", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 2 || assets["linux-amd64"] != replaced || assets["darwin-arm64"] != later {
+		t.Errorf("Assets() = %v", assets)
+	}
+
+	if err := c.RemoveAsset(ctx, "nametag", "1.0.0", "linux-amd64"); err != nil {
+		t.Fatal(err)
+	}
+	if assets, _ := c.Assets(ctx, "nametag", "1.0.0"); len(assets) != 1 {
+		t.Errorf("Assets() after RemoveAsset() = %v", assets)
+	}
+	if _, err := c.Release(ctx, "nametag", "1.0.0"); err != nil {
+		t.Errorf("Release() after RemoveAsset() = %v, want it still published", err)
+	}
+}
+
+func TestSetChannel(t *testing.T) {
+	ctx := context.Background()
+	c := openTest(t, filepath.Join(t.TempDir(), File))
+	if err := c.Publish(ctx, "nametag", Release{Version: "1.0.0", Channel: "beta"}, asset("linux-amd64")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		comp    string
+		version string
+		wantErr error
+	}{
+		{"published", "nametag", "1.0.0", nil},
+		{"unpublished version", "nametag", "1.1.0", ErrNotFound},
+		{"other component", "nametag-up", "1.0.0", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.SetChannel(ctx, tt.comp, tt.version, "stable")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SetChannel() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if release, _ := c.Release(ctx, "nametag", "1.0.0"); release.Channel != "stable" {
+		t.Errorf("channel after SetChannel() = %q", release.Channel)
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	c := openTest(t, filepath.Join(t.TempDir(), File))
+	if err := c.Publish(ctx, "nametag", Release{Version: "1.0.0", Channel: "beta"}, asset("linux-amd64")); err != nil {
+		t.Fatal(err)
+	}
+	found := Release{Version: "1.0.0", Channel: "stable", Published: time.Unix(0, 0).UTC()}
+	stale := asset("linux-amd64")
+	stale.SHA256 = "00"
+
+	tests := []struct {
+		name    string
+		release Release
+		assets  []Asset
+		want    bool
+	}{
+		{"known release and asset", found, []Asset{stale}, false},
+		{"new asset of a known release", found, []Asset{stale, asset("darwin-arm64")}, true},
+		{"same again", found, []Asset{asset("darwin-arm64")}, false},
+		{"new release", Release{Version: "0.9.0", Channel: "stable", Published: time.Unix(0, 0).UTC()}, []Asset{asset("linux-amd64")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _, _ := c.Changed(ctx)
+			added, err := c.Import(ctx, "nametag", tt.release, tt.assets)
+			if err != nil {
+				t.Fatalf("Import() = %v", err)
+			}
+			if added != tt.want {
+				t.Errorf("Import() = %t, want %t", added, tt.want)
+			}
+			// Only an import that added something counts as a change
+			if after, _, _ := c.Changed(ctx); (after != before) != tt.want {
+				t.Errorf("change serial went from %d to %d", before, after)
+			}
+		})
+	}
+
+	// What the catalog had is kept
+	release, _ := c.Release(ctx, "nametag", "1.0.0")
+	assets, _ := c.Assets(ctx, "nametag", "1.0.0")
+	if release.Channel != "beta" || assets["linux-amd64"].SHA256 != "ab" {
+		t.Errorf("import replaced %+v, %+v", release, assets["linux-amd64"])
+	}
+}
+
+func TestState(t *testing.T) {
+	ctx := context.Background()
+	c := openTest(t, filepath.Join(t.TempDir(), File))
+	if state, err := c.State(ctx, "nametag"); err != nil || state != nil {
+		t.Fatalf("State() of a new component = %q, %v", state, err)
+	}
+	for _, want := range []string{`{"revision":1}`, `{"revision":2}`} {
+		if err := c.SetState(ctx, "nametag", []byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := c.State(ctx, "nametag"); err != nil || string(got) != want {
+			t.Errorf("State() = %q, %v, want %s", got, err, want)
+		}
+	}
+}
+
+func TestSharedCatalog(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), File)
+	server, publisher := openTest(t, path), openTest(t, path)
+
+	imported, err := server.Imported(ctx)
+	if err != nil || imported {
+		t.Fatalf("Imported() of a new catalog = %t, %v", imported, err)
+	}
+	if err := server.SetImported(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if imported, _ := publisher.Imported(ctx); !imported {
+		t.Error("Imported() = false after SetImported() through another handle")
+	}
+
+	serial, changed, err := server.Changed(ctx)
+	if err != nil || serial != 0 || !changed.IsZero() {
+		t.Fatalf("Changed() of an unchanged catalog = %d, %s, %v", serial, changed, err)
+	}
+	if err := publisher.Publish(ctx, "nametag", Release{Version: "1.0.0", Channel: "stable"}, asset("linux-amd64")); err != nil {
+		t.Fatal(err)
+	}
+	after, changed, err := server.Changed(ctx)
+	if err != nil || after <= serial || changed.IsZero() {
+		t.Errorf("Changed() after another handle published = %d, %s, %v", after, changed, err)
+	}
+	if releases, _ := server.Releases(ctx, "nametag"); len(releases) != 1 {
+		t.Errorf("Releases() = %v, want the one published through another handle", releases)
+	}
+}
+
+func TestOpenNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), File)
+	c := openTest(t, path)
+	if _, err := c.db.Exec(`PRAGMA user_version = 2`); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if _, err := Open(path); err == nil {
+		t.Fatal("Open() of a catalog with a newer schema succeeded")
+	}
+}
+
+func TestExportRestore(t *testing.T) {
+	ctx := context.Background()
+	writer := openTest(t, filepath.Join(t.TempDir(), File))
+	if err := writer.Publish(ctx, "nametag", Release{Version: "1.0.0", Channel: "beta"}, asset("linux-amd64")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.SetState(ctx, "nametag", []byte(`{"revision":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	_, changed, _ := writer.Changed(ctx)
+
+	replica := openTest(t, filepath.Join(t.TempDir(), File))
+	// What the replica had of its own is replaced
+	if err := replica.Publish(ctx, "nametag", Release{Version: "0.9.0", Channel: "stable"}, asset("linux-amd64")); err != nil {
+		t.Fatal(err)
+	}
+	before, _, _ := replica.Changed(ctx)
+
+	snapshot := filepath.Join(t.TempDir(), "catalog.db")
+	// Exporting twice replaces the first copy
+	for range 2 {
+		if err := writer.Export(ctx, snapshot); err != nil {
+			t.Fatalf("Export() = %v", err)
+		}
+	}
+	if err := replica.Restore(ctx, snapshot); err != nil {
+		t.Fatalf("Restore() = %v", err)
+	}
+
+	releases, _ := replica.Releases(ctx, "nametag")
+	if len(releases) != 1 || releases[0].Version != "1.0.0" || releases[0].Channel != "beta" {
+		t.Errorf("Releases() after Restore() = %+v", releases)
+	}
+	if assets, _ := replica.Assets(ctx, "nametag", "1.0.0"); assets["linux-amd64"] != asset("linux-amd64") {
+		t.Errorf("Assets() after Restore() = %v", assets)
+	}
+	if state, _ := replica.State(ctx, "nametag"); string(state) != `{"revision":1}` {
+		t.Errorf("State() after Restore() = %s", state)
+	}
+	after, restored, _ := replica.Changed(ctx)
+	if after <= before || !restored.Equal(changed) {
+		t.Errorf("Changed() after Restore() = %d, %s, want past %d as of %s", after, restored, before, changed)
+	}
+	if imported, _ := replica.Imported(ctx); !imported {
+		t.Error("Imported() = false after Restore()")
+	}
+}
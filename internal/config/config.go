@@ -0,0 +1,233 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Prefixes of the environment variables that override flags. Server settings
+// get their own prefix so NAMETAG_SERVER stays the client's server URL.
+const (
+	ClientEnvPrefix = "NAMETAG_"
+	ServerEnvPrefix = "NAMETAG_SERVER_"
+)
+
+// FlagName is the flag that names the config file; it is also read from
+// <prefix>CONFIG
+const FlagName = "config"
+
+// DefaultClientPath returns the config file nametag and nametag-up read when
+// none is given: config.json in the user config directory under nametag
+func DefaultClientPath() string {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(base, "nametag", "config.json")
+}
+
+// EnvName returns the environment variable for a flag, e.g. "tuf-root" with
+// prefix NAMETAG_ becomes NAMETAG_TUF_ROOT
+func EnvName(prefix, flagName string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Load fills in the flags of an already parsed fs that were not given on the
+// command line. Precedence, highest first:
+//
+//  1. command-line flags
+//  2. environment variables (<prefix>FLAG_NAME)
+//  3. the config file, keyed by flag name
+//  4. flag defaults
+//
+// The config file is taken from the -config flag, then <prefix>CONFIG, then
+// defaultPath. Only the default path may be missing. Files ending in .toml
+// are TOML, anything else JSON. Tables group flags by their prefix, so
+// [tls] cert = "..." sets -tls-cert, and arrays become comma-separated
+// lists. A table that is named after a flag sets that flag to its
+// comma-separated KEY=VALUE pairs instead. Keys that don't match a flag are
+// ignored so nametag and nametag-up can share one file.
+func Load(fs *flag.FlagSet, prefix, defaultPath string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	path, required := "", true
+	if f := fs.Lookup(FlagName); f != nil && explicit[FlagName] {
+		path = f.Value.String()
+	} else if env, ok := os.LookupEnv(EnvName(prefix, FlagName)); ok {
+		path = env
+	} else {
+		path, required = defaultPath, false
+	}
+
+	file, err := readFile(fs, path, required)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || f.Name == FlagName {
+			return
+		}
+
+		env := EnvName(prefix, f.Name)
+		if value, ok := os.LookupEnv(env); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", env, err))
+			}
+			return
+		}
+
+		if value, ok := file[f.Name]; ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("config %s: %s: %w", path, f.Name, err))
+			}
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// readFile reads a config file into flag values
+func readFile(fs *flag.FlagSet, path string, required bool) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	var raw map[string]any
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		raw, err = parseTOML(data)
+	} else {
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	if err := flattenTable(fs, raw, "", values); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// flattenTable adds the values of a decoded config table to values, naming
+// them after the table's keys with prefix in front. A flag set twice, like
+// tls-cert and cert under tls, is an error rather than one of them winning
+// at random.
+func flattenTable(fs *flag.FlagSet, table map[string]any, prefix string, values map[string]string) error {
+	for key, value := range table {
+		name := prefix + key
+		if sub, ok := value.(map[string]any); ok && fs.Lookup(name) == nil {
+			if err := flattenTable(fs, sub, name+"-", values); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, ok := values[name]; ok {
+			return fmt.Errorf("%s is set more than once", name)
+		}
+		switch v := value.(type) {
+		case map[string]any:
+			pairs, err := pairList(v, name)
+			if err != nil {
+				return err
+			}
+			values[name] = pairs
+		case []any:
+			list, err := scalarList(v, name)
+			if err != nil {
+				return err
+			}
+			values[name] = strings.Join(list, ",")
+		default:
+			s, ok := scalarValue(v)
+			if !ok {
+				return fmt.Errorf("%s must be a string, number, boolean, array, or table", name)
+			}
+			values[name] = s
+		}
+	}
+	return nil
+}
+
+// pairList turns a table into comma-separated KEY=VALUE pairs, sorted by
+// key; a key whose value is an array is listed once per element
+func pairList(table map[string]any, name string) (string, error) {
+	var pairs []string
+	for _, key := range slices.Sorted(maps.Keys(table)) {
+		values := []any{table[key]}
+		if list, ok := table[key].([]any); ok {
+			values = list
+		}
+		list, err := scalarList(values, name+"."+key)
+		if err != nil {
+			return "", err
+		}
+		for _, value := range list {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+	return strings.Join(pairs, ","), nil
+}
+
+func scalarList(values []any, name string) ([]string, error) {
+	list := make([]string, len(values))
+	for i, value := range values {
+		s, ok := scalarValue(value)
+		if !ok {
+			return nil, fmt.Errorf("%s must hold strings, numbers, or booleans", name)
+		}
+		list[i] = s
+	}
+	return list, nil
+}
+
+// scalarValue formats a decoded string, number, or boolean as a flag value.
+// Scalars are accepted as-is so booleans and numbers needn't be quoted.
+func scalarValue(value any) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// flagValues converts the scalars of a decoded JSON object to flag values
+func flagValues(raw map[string]any, source string) (map[string]string, error) {
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		s, ok := scalarValue(value)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s must be a string, number, or boolean", source, key)
+		}
+		values[key] = s
+	}
+	return values, nil
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serverFlags returns a flag set like the server's, parsed from args
+func serverFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("addr", ":8080", "")
+	fs.String("tls-cert", "", "")
+	fs.String("tls-key", "", "")
+	fs.String("components", "", "")
+	fs.Int64("upload-max-size", 512, "")
+	fs.Bool("metrics", true, "")
+	fs.String("channel-signing-key", "", "")
+	fs.String("oidc-role-map", "", "")
+	fs.String(FlagName, "", "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    map[string]string
+	}{
+		{"json", "config.json", `{"addr": ":9090", "upload-max-size": 64, "metrics": false}`,
+			map[string]string{"addr": ":9090", "upload-max-size": "64", "metrics": "false"}},
+		{"nested json", "config.json", `{"tls": {"cert": "c.pem", "key": "k.pem"}, "components": ["a", "b"]}`,
+			map[string]string{"tls-cert": "c.pem", "tls-key": "k.pem", "components": "a,b"}},
+		{"toml", "config.toml", `
+addr = ":9090"   # comment
+upload-max-size = 64
+metrics = false
+components = [
+  "a",
+  "b", # trailing comma
+]
+
+[tls]
+cert = "c.pem"
+key = 'k.pem'
+`, map[string]string{"addr": ":9090", "upload-max-size": "64", "metrics": "false", "components": "a,b",
+			"tls-cert": "c.pem", "tls-key": "k.pem"}},
+		{"toml pairs", "config.toml", `
+oidc.role-map = { "release-team" = "publisher", sre = "promoter" }
+
+[channel-signing-key]
+nightly = ["n1.pem", "n2.pem"]
+beta = "b.pem"
+`, map[string]string{"oidc-role-map": "release-team=publisher,sre=promoter",
+			"channel-signing-key": "beta=b.pem,nightly=n1.pem,nightly=n2.pem"}},
+		{"unknown keys", "config.toml", "unknown = 1\n[other]\nkey = \"x\"\n", map[string]string{"addr": ":8080"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := serverFlags(t, "-config", writeConfig(t, tt.file, tt.content))
+			if err := Load(fs, "NAMETAG_TEST_", ""); err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			for name, want := range tt.want {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "config.toml", "addr = \":1\"\ntls-cert = \"file.pem\"\ntls-key = \"file.key\"\n")
+	t.Setenv("NAMETAG_TEST_TLS_CERT", "env.pem")
+	t.Setenv("NAMETAG_TEST_ADDR", ":2")
+
+	fs := serverFlags(t, "-config", path, "-addr", ":3")
+	if err := Load(fs, "NAMETAG_TEST_", ""); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for name, want := range map[string]string{"addr": ":3", "tls-cert": "env.pem", "tls-key": "file.key"} {
+		if got := fs.Lookup(name).Value.String(); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    string
+	}{
+		{"same flag twice in toml", "config.toml", "tls-cert = \"a\"\n[tls]\ncert = \"b\"\n", "set more than once"},
+		{"same flag twice in json", "config.json", `{"tls-cert": "a", "tls": {"cert": "b"}}`, "set more than once"},
+		{"invalid value", "config.json", `{"upload-max-size": "lots"}`, "upload-max-size"},
+		{"nested array", "config.toml", "components = [[\"a\"]]\n", "components"},
+		{"toml syntax", "config.toml", "addr = :80\n", "line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := serverFlags(t, "-config", writeConfig(t, tt.file, tt.content))
+			err := Load(fs, "NAMETAG_TEST_", "")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Load() error = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDuplicateIsDeterministic(t *testing.T) {
+	// Map iteration order once decided which of the two values won
+	path := writeConfig(t, "config.toml", "tls-cert = \"a\"\n[tls]\ncert = \"b\"\n")
+	for range 50 {
+		if err := Load(serverFlags(t, "-config", path), "NAMETAG_TEST_", ""); err == nil {
+			t.Fatal("Load accepted a flag set twice")
+		}
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	if err := Load(serverFlags(t), "NAMETAG_TEST_", missing); err != nil {
+		t.Errorf("missing default config: %v", err)
+	}
+	if err := Load(serverFlags(t, "-config", missing), "NAMETAG_TEST_", ""); err == nil {
+		t.Error("missing explicit config was accepted")
+	}
+}
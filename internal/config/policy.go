@@ -0,0 +1,34 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// ApplyPolicy sets the flags of an already loaded fs that an administrator
+// enforces through the platform's policy store, such as the server, the
+// channel, or whether updates are installed: the Policies registry keys on
+// Windows, managed preferences on macOS, and /etc/nametag/policy.json
+// elsewhere. Enforced values override the command line, the environment,
+// and the config file. Settings that don't match a flag are ignored, as in
+// the config file. It returns the names of the flags it set.
+func ApplyPolicy(fs *flag.FlagSet) ([]string, error) {
+	policy, err := readPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []string
+	for _, name := range slices.Sorted(maps.Keys(policy)) {
+		if name == FlagName || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, policy[name]); err != nil {
+			return nil, fmt.Errorf("policy %s: %w", name, err)
+		}
+		applied = append(applied, name)
+	}
+	return applied, nil
+}
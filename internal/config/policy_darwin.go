@@ -0,0 +1,82 @@
+//go:build darwin
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// policyDomain is the preference domain configuration profiles manage
+// nametag's settings under
+const policyDomain = "com.nametag.client"
+
+// managedPreferencesDir is where macOS installs the settings of the
+// configuration profiles an MDM server pushes
+const managedPreferencesDir = "/Library/Managed Preferences"
+
+// plutilTimeout bounds converting a managed preferences file
+const plutilTimeout = 10 * time.Second
+
+// readPolicy reads the enforced settings of policyDomain from the managed
+// preferences of the device and of the current user, the device's taking
+// precedence
+func readPolicy() (map[string]string, error) {
+	paths := []string{}
+	if u, err := user.Current(); err == nil {
+		paths = append(paths, filepath.Join(managedPreferencesDir, u.Username, policyDomain+".plist"))
+	}
+	paths = append(paths, filepath.Join(managedPreferencesDir, policyDomain+".plist"))
+
+	policy := make(map[string]string)
+	for _, path := range paths {
+		values, err := readManagedPreferences(path)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(policy, values)
+	}
+	return policy, nil
+}
+
+// readManagedPreferences reads a managed preferences file, usually a binary
+// property list, by having plutil convert it to JSON
+func readManagedPreferences(path string) (map[string]string, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), plutilTimeout)
+	defer cancel()
+
+	// Use the system tool rather than whatever is first on PATH
+	out, err := exec.CommandContext(ctx, "/usr/bin/plutil", "-convert", "json", "-o", "-", path).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("read policy %s: %s", path, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("read policy %s: %w", path, err)
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(out, &raw); err != nil {
+		return nil, fmt.Errorf("parse policy %s: %w", path, err)
+	}
+	// Profiles carry their own bookkeeping keys, none of them flags
+	for key := range raw {
+		if strings.HasPrefix(key, "Payload") || strings.HasPrefix(key, "PolicyLevel") {
+			delete(raw, key)
+		}
+	}
+	return flagValues(raw, "policy "+path)
+}
@@ -0,0 +1,32 @@
+//go:build !windows && !darwin
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// policyPath is where configuration management tools drop the settings
+// they enforce
+const policyPath = "/etc/nametag/policy.json"
+
+// readPolicy reads the enforced settings from policyPath, a JSON object
+// keyed by flag name like the config file; a missing one enforces nothing
+func readPolicy() (map[string]string, error) {
+	data, err := os.ReadFile(policyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read policy: %w", err)
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse policy %s: %w", policyPath, err)
+	}
+	return flagValues(raw, "policy "+policyPath)
+}
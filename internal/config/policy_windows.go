@@ -0,0 +1,70 @@
+//go:build windows
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// policyKey is the registry key, under HKLM and HKCU, that Group Policy
+// writes nametag's enforced settings to
+const policyKey = `SOFTWARE\Policies\Nametag`
+
+// readPolicy reads the enforced settings from the policy key of the user
+// and of the machine, the machine's taking precedence. Values are named
+// after flags: strings as REG_SZ, numbers and booleans (0 or 1) as
+// REG_DWORD.
+func readPolicy() (map[string]string, error) {
+	policy := make(map[string]string)
+	for _, root := range []registry.Key{registry.CURRENT_USER, registry.LOCAL_MACHINE} {
+		values, err := readPolicyKey(root)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(policy, values)
+	}
+	return policy, nil
+}
+
+func readPolicyKey(root registry.Key) (map[string]string, error) {
+	k, err := registry.OpenKey(root, policyKey, registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open policy key: %w", err)
+	}
+	defer k.Close()
+
+	names, err := k.ReadValueNames(0)
+	if err != nil {
+		return nil, fmt.Errorf("read policy key: %w", err)
+	}
+	values := make(map[string]string, len(names))
+	for _, name := range names {
+		_, valType, err := k.GetValue(name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %w", name, err)
+		}
+		switch valType {
+		case registry.SZ, registry.EXPAND_SZ:
+			if values[name], _, err = k.GetStringValue(name); err != nil {
+				return nil, fmt.Errorf("policy %s: %w", name, err)
+			}
+		case registry.DWORD, registry.QWORD:
+			n, _, err := k.GetIntegerValue(name)
+			if err != nil {
+				return nil, fmt.Errorf("policy %s: %w", name, err)
+			}
+			values[name] = strconv.FormatUint(n, 10)
+		default:
+			return nil, fmt.Errorf("policy %s must be a string or a DWORD", name)
+		}
+	}
+	return values, nil
+}
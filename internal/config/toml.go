@@ -0,0 +1,485 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML decodes the subset of TOML config files need: tables, dotted
+// keys, basic and literal strings, integers, floats, booleans, arrays, and
+// inline tables. Multi-line strings, dates, and arrays of tables are
+// rejected. Tables decode to map[string]any, arrays to []any, and integers
+// to int64.
+func parseTOML(data []byte) (map[string]any, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("toml: invalid UTF-8")
+	}
+	p := &tomlParser{src: string(data), line: 1}
+	root := newTOMLTable(headerTable)
+	if err := p.parse(root); err != nil {
+		return nil, fmt.Errorf("toml: line %d: %w", p.line, err)
+	}
+	return root.decode(), nil
+}
+
+// tableKind is how a table was defined, which decides how it may be
+// extended later on
+type tableKind int
+
+const (
+	// implicitTable was created by a header naming one of its subtables,
+	// and may still get a header of its own
+	implicitTable tableKind = iota
+	// headerTable was defined by a [table] header
+	headerTable
+	// dottedTable was defined by dotted keys, which may add to it
+	dottedTable
+	// inlineTable is complete once written
+	inlineTable
+)
+
+type tomlTable struct {
+	kind   tableKind
+	values map[string]any
+}
+
+func newTOMLTable(kind tableKind) *tomlTable {
+	return &tomlTable{kind: kind, values: make(map[string]any)}
+}
+
+// decode converts the table and the tables in it to plain maps
+func (t *tomlTable) decode() map[string]any {
+	table := make(map[string]any, len(t.values))
+	for key, value := range t.values {
+		table[key] = decodeTOMLValue(value)
+	}
+	return table
+}
+
+func decodeTOMLValue(value any) any {
+	switch v := value.(type) {
+	case *tomlTable:
+		return v.decode()
+	case []any:
+		list := make([]any, len(v))
+		for i, elem := range v {
+			list[i] = decodeTOMLValue(elem)
+		}
+		return list
+	}
+	return value
+}
+
+type tomlParser struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) parse(root *tomlTable) error {
+	current := root
+	for {
+		p.skipBlank(true)
+		if p.eof() {
+			return nil
+		}
+
+		if p.peek() == '[' {
+			p.pos++
+			if p.peek() == '[' {
+				return fmt.Errorf("arrays of tables are not supported")
+			}
+			p.skipBlank(false)
+			path, err := p.key()
+			if err != nil {
+				return err
+			}
+			p.skipBlank(false)
+			if p.peek() != ']' {
+				return fmt.Errorf("expected ] after table name")
+			}
+			p.pos++
+			if current, err = headerTableAt(root, path); err != nil {
+				return err
+			}
+		} else {
+			if err := p.keyValue(current); err != nil {
+				return err
+			}
+		}
+
+		p.skipBlank(false)
+		if !p.eof() && p.peek() != '\n' && p.peek() != '\r' {
+			return fmt.Errorf("unexpected %q at end of line", p.peek())
+		}
+	}
+}
+
+// headerTableAt returns the table a [table] header at path defines,
+// creating the tables on the way. Each table may only be defined once, and
+// inline tables can't be added to.
+func headerTableAt(root *tomlTable, path []string) (*tomlTable, error) {
+	table := root
+	for i := range path {
+		next, created, err := table.subtable(path[:i+1], implicitTable)
+		if err != nil {
+			return nil, err
+		}
+		table = next
+		if i == len(path)-1 && !created && table.kind != implicitTable {
+			return nil, fmt.Errorf("table %s is defined twice", strings.Join(path, "."))
+		}
+	}
+	table.kind = headerTable
+	return table, nil
+}
+
+// subtable returns the table t holds under the last element of path,
+// creating one of kind when there is none
+func (t *tomlTable) subtable(path []string, kind tableKind) (*tomlTable, bool, error) {
+	name := path[len(path)-1]
+	switch next := t.values[name].(type) {
+	case nil:
+		table := newTOMLTable(kind)
+		t.values[name] = table
+		return table, true, nil
+	case *tomlTable:
+		if next.kind == inlineTable {
+			return nil, false, fmt.Errorf("inline table %s can't be extended", strings.Join(path, "."))
+		}
+		return next, false, nil
+	default:
+		return nil, false, fmt.Errorf("key %s is not a table", strings.Join(path, "."))
+	}
+}
+
+// keyValue parses a key = value pair into table. Dotted keys may add to
+// tables other dotted keys of the same table defined, not to ones defined
+// by headers.
+func (p *tomlParser) keyValue(table *tomlTable) error {
+	path, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipBlank(false)
+	if p.peek() != '=' {
+		return fmt.Errorf("expected = after key %s", strings.Join(path, "."))
+	}
+	p.pos++
+	p.skipBlank(false)
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+
+	parent := table
+	for i := range path[:len(path)-1] {
+		next, created, err := parent.subtable(path[:i+1], dottedTable)
+		if err != nil {
+			return err
+		}
+		if !created && next.kind != dottedTable {
+			return fmt.Errorf("table %s is defined twice", strings.Join(path[:i+1], "."))
+		}
+		parent = next
+	}
+	last := path[len(path)-1]
+	if _, ok := parent.values[last]; ok {
+		return fmt.Errorf("key %s is defined twice", strings.Join(path, "."))
+	}
+	parent.values[last] = value
+	return nil
+}
+
+// key parses a bare, quoted, or dotted key
+func (p *tomlParser) key() ([]string, error) {
+	var path []string
+	for {
+		var part string
+		switch c := p.peek(); {
+		case c == '"':
+			s, err := p.basicString()
+			if err != nil {
+				return nil, err
+			}
+			part = s
+		case c == '\'':
+			s, err := p.literalString()
+			if err != nil {
+				return nil, err
+			}
+			part = s
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			if p.pos == start {
+				if p.eof() {
+					return nil, fmt.Errorf("expected a key")
+				}
+				return nil, fmt.Errorf("unexpected %q, expected a key", p.peek())
+			}
+			part = p.src[start:p.pos]
+		}
+		path = append(path, part)
+
+		p.skipBlank(false)
+		if p.peek() != '.' {
+			return path, nil
+		}
+		p.pos++
+		p.skipBlank(false)
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+func (p *tomlParser) value() (any, error) {
+	switch p.peek() {
+	case '"':
+		return p.basicString()
+	case '\'':
+		return p.literalString()
+	case '[':
+		return p.array()
+	case '{':
+		return p.inlineTable()
+	}
+
+	start := p.pos
+	for !p.eof() && (isBareKeyChar(p.peek()) || strings.IndexByte("+.:", p.peek()) >= 0) {
+		p.pos++
+	}
+	token := p.src[start:p.pos]
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "":
+		if p.eof() {
+			return nil, fmt.Errorf("expected a value")
+		}
+		return nil, fmt.Errorf("unexpected %q, expected a value", p.peek())
+	}
+
+	number := strings.ReplaceAll(token, "_", "")
+	switch {
+	case tomlInteger.MatchString(token):
+		n, err := strconv.ParseInt(number, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("integer %s is out of range", token)
+		}
+		return n, nil
+	case tomlFloat.MatchString(token):
+		f, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return nil, fmt.Errorf("float %s is out of range", token)
+		}
+		return f, nil
+	case tomlSpecialFloat.MatchString(token):
+		f, _ := strconv.ParseFloat(number, 64)
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid value %q (strings must be quoted)", token)
+}
+
+// TOML numbers: decimal integers without leading zeros, hexadecimal,
+// octal, and binary ones, and floats with a fraction, an exponent, or both.
+// Underscores may only separate digits.
+var (
+	tomlInteger = regexp.MustCompile(`^(?:[+-]?(?:0|[1-9](?:_?[0-9])*)` +
+		`|0x[0-9A-Fa-f](?:_?[0-9A-Fa-f])*|0o[0-7](?:_?[0-7])*|0b[01](?:_?[01])*)$`)
+	tomlFloat = regexp.MustCompile(`^[+-]?(?:0|[1-9](?:_?[0-9])*)` +
+		`(?:\.[0-9](?:_?[0-9])*(?:[eE][+-]?[0-9](?:_?[0-9])*)?|[eE][+-]?[0-9](?:_?[0-9])*)$`)
+	tomlSpecialFloat = regexp.MustCompile(`^[+-]?(?:inf|nan)$`)
+)
+
+func (p *tomlParser) basicString() (string, error) {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		return "", fmt.Errorf("multi-line strings are not supported")
+	}
+	p.pos++
+
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", fmt.Errorf("unterminated string")
+		}
+		c := p.src[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.eof() {
+				return "", fmt.Errorf("unterminated string")
+			}
+			e := p.src[p.pos]
+			p.pos++
+			switch e {
+			case 'b':
+				b.WriteByte('\b')
+			case 't':
+				b.WriteByte('\t')
+			case 'n':
+				b.WriteByte('\n')
+			case 'f':
+				b.WriteByte('\f')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(e)
+			case 'u', 'U':
+				size := 4
+				if e == 'U' {
+					size = 8
+				}
+				if p.pos+size > len(p.src) {
+					return "", fmt.Errorf("invalid escape \\%c", e)
+				}
+				code, err := strconv.ParseUint(p.src[p.pos:p.pos+size], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(code)) {
+					return "", fmt.Errorf("invalid escape \\%c%s", e, p.src[p.pos:p.pos+size])
+				}
+				p.pos += size
+				b.WriteRune(rune(code))
+			default:
+				return "", fmt.Errorf("invalid escape \\%c", e)
+			}
+		default:
+			if isControlChar(c) {
+				return "", fmt.Errorf("control character %q in string must be escaped", c)
+			}
+			b.WriteByte(c)
+		}
+	}
+}
+
+// isControlChar reports whether strings must not hold c as is: the control
+// characters other than tab, which TOML allows
+func isControlChar(c byte) bool {
+	return c < 0x20 && c != '\t' || c == 0x7f
+}
+
+func (p *tomlParser) literalString() (string, error) {
+	if strings.HasPrefix(p.src[p.pos:], "'''") {
+		return "", fmt.Errorf("multi-line strings are not supported")
+	}
+	p.pos++
+
+	end := strings.IndexAny(p.src[p.pos:], "'\n")
+	if end < 0 || p.src[p.pos+end] != '\'' {
+		return "", fmt.Errorf("unterminated string")
+	}
+	s := p.src[p.pos : p.pos+end]
+	for i := range len(s) {
+		if isControlChar(s[i]) {
+			return "", fmt.Errorf("control character %q in string", s[i])
+		}
+	}
+	p.pos += end + 1
+	return s, nil
+}
+
+// array parses an array, which may span lines and end with a comma
+func (p *tomlParser) array() ([]any, error) {
+	p.pos++
+	values := []any{}
+	for {
+		p.skipBlank(true)
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		p.skipBlank(true)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+			p.pos++
+			return values, nil
+		default:
+			return nil, fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+// inlineTable parses a table written on one line, like {a = 1, b = "x"};
+// it is complete once its closing brace is read
+func (p *tomlParser) inlineTable() (*tomlTable, error) {
+	p.pos++
+	table := newTOMLTable(inlineTable)
+	p.skipBlank(false)
+	if p.peek() == '}' {
+		p.pos++
+		return table, nil
+	}
+	for {
+		if err := p.keyValue(table); err != nil {
+			return nil, err
+		}
+		p.skipBlank(false)
+		switch p.peek() {
+		case ',':
+			p.pos++
+			p.skipBlank(false)
+		case '}':
+			p.pos++
+			return table, nil
+		default:
+			return nil, fmt.Errorf("expected , or } in inline table")
+		}
+	}
+}
+
+// skipBlank skips spaces, tabs, and comments, and newlines too when
+// newlines is set
+func (p *tomlParser) skipBlank(newlines bool) {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t':
+			p.pos++
+		case '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		case '\r':
+			if !newlines {
+				return
+			}
+			p.pos++
+		case '\n':
+			if !newlines {
+				return
+			}
+			p.pos++
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.src)
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want map[string]any
+	}{
+		{"empty", "", map[string]any{}},
+		{"comments and blank lines", "# comment\n\n  # indented\r\na = 1 # trailing\n", map[string]any{"a": int64(1)}},
+		{"strings", `basic = "a\tb\"c\\d\u00e9\U0001F600"` + "\n" + `literal = 'C:\path\n'` + "\n",
+			map[string]any{"basic": "a\tb\"c\\d\u00e9\U0001F600", "literal": `C:\path\n`}},
+		// TOML 1.0 allows tabs in strings as is
+		{"raw tab", "s = \"a\tb\"\nl = 'a\tb'\n", map[string]any{"s": "a\tb", "l": "a\tb"}},
+		{"integers", "a = 0\nb = -17\nc = +99\nd = 1_000\ne = 0xdead_BEEF\nf = 0o755\ng = 0b1101\nh = -0\n",
+			map[string]any{"a": int64(0), "b": int64(-17), "c": int64(99), "d": int64(1000),
+				"e": int64(0xdeadbeef), "f": int64(0o755), "g": int64(13), "h": int64(0)}},
+		{"floats", "a = 3.14\nb = -0.5\nc = 1e06\nd = 6.02E+23\ne = 1_0.0_1\nf = 0.0\n",
+			map[string]any{"a": 3.14, "b": -0.5, "c": 1e6, "d": 6.02e23, "e": 10.01, "f": 0.0}},
+		{"special floats", "a = inf\nb = -inf\n", map[string]any{"a": math.Inf(1), "b": math.Inf(-1)}},
+		{"booleans", "a = true\nb = false\n", map[string]any{"a": true, "b": false}},
+		{"arrays", "a = []\nb = [1, \"two\", [3]]\nc = [\n  1, # one\n  2,\n]\n",
+			map[string]any{"a": []any{}, "b": []any{int64(1), "two", []any{int64(3)}}, "c": []any{int64(1), int64(2)}}},
+		{"inline tables", "a = {}\nb = { x = 1, y.z = \"w\" }\nc = [{ x = 1 }]\n",
+			map[string]any{"a": map[string]any{}, "b": map[string]any{"x": int64(1), "y": map[string]any{"z": "w"}},
+				"c": []any{map[string]any{"x": int64(1)}}}},
+		{"quoted and dotted keys", "\"a.b\" = 1\n'c' = 2\nd . e = 3\nd.f = 4\n\"\" = 5\n",
+			map[string]any{"a.b": int64(1), "c": int64(2), "d": map[string]any{"e": int64(3), "f": int64(4)}, "": int64(5)}},
+		{"tables", "top = 1\n[a]\nx = 1\n[a.b]\ny = 2\n[ c . \"d\" ]\nz = 3\n",
+			map[string]any{"top": int64(1), "a": map[string]any{"x": int64(1), "b": map[string]any{"y": int64(2)}},
+				"c": map[string]any{"d": map[string]any{"z": int64(3)}}}},
+		{"implicit table defined later", "[a.b]\nx = 1\n[a]\ny = 2\n",
+			map[string]any{"a": map[string]any{"b": map[string]any{"x": int64(1)}, "y": int64(2)}}},
+		{"subtable of a dotted table", "[a]\nb.c = 1\n[a.b.d]\ne = 2\n",
+			map[string]any{"a": map[string]any{"b": map[string]any{"c": int64(1), "d": map[string]any{"e": int64(2)}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tt.in))
+			if err != nil {
+				t.Fatalf("parseTOML: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseTOML =\n%#v\nwant\n%#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLNaN(t *testing.T) {
+	got, err := parseTOML([]byte("a = nan\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := got["a"].(float64); !ok || !math.IsNaN(f) {
+		t.Fatalf("a = %#v, want NaN", got["a"])
+	}
+}
+
+func TestParseTOMLRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"unquoted string", "a = hello\n", "strings must be quoted"},
+		{"leading zero", "a = 01\n", "invalid value"},
+		{"signed leading zero", "a = -01\n", "invalid value"},
+		{"double underscore", "a = 1__2\n", "invalid value"},
+		{"leading underscore", "a = _1\n", "invalid value"},
+		{"trailing underscore", "a = 1_\n", "invalid value"},
+		{"underscore next to a point", "a = 1_.5\n", "invalid value"},
+		{"float without integer part", "a = .5\n", "invalid value"},
+		{"float without fraction digits", "a = 1.\n", "invalid value"},
+		{"float with leading zero", "a = 03.14\n", "invalid value"},
+		{"signed hex", "a = -0x1\n", "invalid value"},
+		{"capitalized inf", "a = Inf\n", "invalid value"},
+		{"hex float", "a = 0x1p-2\n", "invalid value"},
+		{"integer out of range", "a = 9223372036854775808\n", "out of range"},
+		{"date", "a = 1979-05-27\n", "invalid value"},
+		{"control character", "a = \"a\x01b\"\n", "control character"},
+		{"delete character", "a = \"a\x7fb\"\n", "control character"},
+		{"control character in literal", "a = 'a\x1bb'\n", "control character"},
+		{"raw newline", "a = \"a\nb\"\n", "unterminated string"},
+		{"unterminated literal", "a = 'abc\n", "unterminated string"},
+		{"invalid escape", `a = "\x41"` + "\n", "invalid escape"},
+		{"surrogate escape", `a = "\uD800"` + "\n", "invalid escape"},
+		{"multi-line basic string", "a = \"\"\"x\"\"\"\n", "multi-line strings are not supported"},
+		{"multi-line literal string", "a = '''x'''\n", "multi-line strings are not supported"},
+		{"array of tables", "[[a]]\n", "arrays of tables are not supported"},
+		{"duplicate key", "a = 1\na = 2\n", "defined twice"},
+		{"duplicate dotted key", "a.b = 1\na.b = 2\n", "defined twice"},
+		{"key over a value", "a = 1\na.b = 2\n", "not a table"},
+		{"duplicate table", "[a]\n[a]\n", "defined twice"},
+		{"table over a value", "a = 1\n[a]\n", "not a table"},
+		{"table defined by dotted keys", "a.b = 1\n[a]\n", "defined twice"},
+		{"header over a dotted table", "[a]\nb.c = 1\n[a.b]\n", "defined twice"},
+		{"dotted keys into a header table", "[a.b]\nc = 1\n[a]\nb.d = 2\n", "defined twice"},
+		{"inline table extended by a header", "a = { b = 1 }\n[a]\nc = 2\n", "can't be extended"},
+		{"inline table extended by a subtable header", "a = { b = {} }\n[a.b]\n", "can't be extended"},
+		{"inline table extended by dotted keys", "a = { b = 1 }\na.c = 2\n", "can't be extended"},
+		{"inline table extended inside its braces", "a = { b = { c = 1 }, b.d = 2 }\n", "can't be extended"},
+		{"inline table with trailing comma", "a = { b = 1, }\n", "expected a key"},
+		{"inline table across lines", "a = { b = 1,\nc = 2 }\n", "expected a key"},
+		{"unclosed array", "a = [1, 2\n", "expected , or ]"},
+		{"array without commas", "a = [1 2]\n", "expected , or ]"},
+		{"two values on a line", "a = 1 b = 2\n", "at end of line"},
+		{"missing equals", "a 1\n", "expected ="},
+		{"missing value", "a =\n", "expected a value"},
+		{"empty bare key", "= 1\n", "expected a key"},
+		{"unclosed header", "[a\n", "expected ]"},
+		{"invalid UTF-8", "a = \"\xff\"\n", "invalid UTF-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tt.in))
+			if err == nil {
+				t.Fatalf("parseTOML(%q) = %#v, want an error", tt.in, got)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("parseTOML(%q) error = %v, want one mentioning %q", tt.in, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrorLine(t *testing.T) {
+	_, err := parseTOML([]byte("a = 1\nb = [\n  1,\n  x,\n]\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Fatalf("error = %v, want one on line 4", err)
+	}
+}
+
+func FuzzParseTOML(f *testing.F) {
+	for _, seed := range []string{
+		"a = 1\n", "[a.b]\nc = 'd'\n", "a = { b = [1, 2.5, true] }\n", "\"k\" = \"\\u00e9\"\n", "a.b.c = 0x1f\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Anything may be rejected, but nothing may panic, and what is
+		// accepted must be made of the types Load understands
+		table, err := parseTOML(data)
+		if err != nil {
+			return
+		}
+		var check func(any)
+		check = func(value any) {
+			switch v := value.(type) {
+			case map[string]any:
+				for _, elem := range v {
+					check(elem)
+				}
+			case []any:
+				for _, elem := range v {
+					check(elem)
+				}
+			case string, int64, float64, bool:
+			default:
+				t.Fatalf("decoded %T", value)
+			}
+		}
+		check(table)
+	})
+}
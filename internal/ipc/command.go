@@ -1,9 +1,19 @@
 package ipc
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/platform"
+	"github.com/1995parham-learning/auto-update-binary/internal/strictjson"
 )
 
 // Action represents the type of update action
@@ -14,21 +24,139 @@ const (
 	ActionRollback Action = "rollback"
 )
 
+// RestartMode selects how the updater restarts the updated component
+type RestartMode string
+
+const (
+	// RestartExec runs RestartBinary with RestartArgs (the default)
+	RestartExec RestartMode = "exec"
+	// RestartSystemd restarts RestartUnit through systemctl
+	RestartSystemd RestartMode = "systemd"
+	// RestartNone skips the restart entirely
+	RestartNone RestartMode = "none"
+	// RestartAdmin tells the service on AdminSocket to restart itself
+	RestartAdmin RestartMode = "admin"
+)
+
+// HookPolicy controls whether the updater may run hook scripts shipped in
+// an update archive
+type HookPolicy string
+
+const (
+	// HookDeny refuses archives that carry hooks (the default)
+	HookDeny HookPolicy = "deny"
+	// HookAllow runs preinstall and postinstall hooks
+	HookAllow HookPolicy = "allow"
+)
+
 // UpdateCommand is passed from main app to updater
 type UpdateCommand struct {
-	Action         Action   `json:"action"`
-	TargetBinary   string   `json:"target_binary"`
-	NewBinaryPath  string   `json:"new_binary_path"`
-	BackupPath     string   `json:"backup_path"`
-	ExpectedSHA256 string   `json:"expected_sha256"`
-	RestartBinary  string   `json:"restart_binary"`
-	RestartArgs    []string `json:"restart_args"`
-	ParentPID      int      `json:"parent_pid"`
-}
-
-// WriteToFile writes the command to a JSON file
-func (c *UpdateCommand) WriteToFile(path string) error {
-	data, err := json.MarshalIndent(c, "", "  ")
+	Action         Action      `json:"action"`
+	TargetBinary   string      `json:"target_binary"`
+	NewBinaryPath  string      `json:"new_binary_path"`
+	BackupPath     string      `json:"backup_path"`
+	ExpectedSHA256 string      `json:"expected_sha256"`
+	RestartBinary  string      `json:"restart_binary"`
+	RestartArgs    []string    `json:"restart_args"`
+	RestartMode    RestartMode `json:"restart_mode,omitempty"`
+	RestartUnit    string      `json:"restart_unit,omitempty"`
+	// VersionURL, when set, is polled after the restart until it reports
+	// NewVersion, for up to VersionTimeout
+	VersionURL     string        `json:"version_url,omitempty"`
+	VersionTimeout time.Duration `json:"version_timeout,omitempty"`
+	// AdminSocket, when set, is asked to quiesce the running service before
+	// the swap, for up to QuiesceTimeout, and to resume if the update fails
+	AdminSocket    string        `json:"admin_socket,omitempty"`
+	QuiesceTimeout time.Duration `json:"quiesce_timeout,omitempty"`
+	// RunAsUser and RunAsGroup, when set, are who RestartBinary is started
+	// as; the updater itself keeps its rights so it can still roll back
+	RunAsUser  string `json:"run_as_user,omitempty"`
+	RunAsGroup string `json:"run_as_group,omitempty"`
+	// ExpectedHashes holds further digests of NewBinaryPath by algorithm;
+	// the strongest one supported is verified
+	ExpectedHashes map[string]string `json:"expected_hashes,omitempty"`
+	// ArchiveFormat is set when NewBinaryPath is an archive containing
+	// ArchiveBinary and optional hook scripts
+	ArchiveFormat string     `json:"archive_format,omitempty"`
+	ArchiveBinary string     `json:"archive_binary,omitempty"`
+	HookPolicy    HookPolicy `json:"hook_policy,omitempty"`
+	// Publisher, when set, is the code signing identity the new binary must
+	// carry (Authenticode signer on Windows, Team ID on macOS)
+	Publisher string `json:"publisher,omitempty"`
+	// ScanCommand, when set, is run against NewBinaryPath before it
+	// replaces anything; a non-zero exit aborts the update
+	ScanCommand string `json:"scan_command,omitempty"`
+	// InstallPath, when set, is where the new binary is installed instead
+	// of over TargetBinary, which is forwarded to it by a symlink or shim
+	InstallPath string `json:"install_path,omitempty"`
+	// UninstallKey, when set, names the Windows Uninstall registry entry
+	// the new version and location are recorded in after the update
+	UninstallKey string `json:"uninstall_key,omitempty"`
+	// Component and NewVersion are checked against and recorded in the
+	// installed state, unless AllowDowngrade is set
+	Component      string `json:"component,omitempty"`
+	NewVersion     string `json:"new_version,omitempty"`
+	AllowDowngrade bool   `json:"allow_downgrade,omitempty"`
+	ParentPID      int    `json:"parent_pid"`
+	// ParentStartTime identifies the parent alongside its PID so a recycled
+	// PID is not mistaken for it. Zero means unknown.
+	ParentStartTime uint64 `json:"parent_start_time,omitempty"`
+	// TargetSHA256, when set, is the digest TargetBinary had when the update
+	// was prepared; a binary changed since, e.g. by another update of a
+	// shared install, isn't replaced
+	TargetSHA256 string `json:"target_sha256,omitempty"`
+}
+
+// KeyEnv carries the hex-encoded key that authenticates the command file
+// from the main app to the updater it spawns
+const KeyEnv = "NAMETAG_IPC_KEY"
+
+// ErrBadMAC is returned for a command file not signed with the expected key,
+// e.g. one planted by another local process
+var ErrBadMAC = errors.New("command file is not signed with the updater's key")
+
+// MaxCommandSize caps how much of a command file is read
+const MaxCommandSize = 1 << 20
+
+// signedCommand is the command file: the command and its HMAC-SHA256
+type signedCommand struct {
+	Command json.RawMessage `json:"command"`
+	MAC     string          `json:"mac"`
+}
+
+// NewKey returns a fresh key for signing one command file
+func NewKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+	return key, nil
+}
+
+// KeyFromEnv reads the command file key from KeyEnv and removes it from the
+// environment, so processes the updater starts don't inherit it
+func KeyFromEnv() ([]byte, error) {
+	value := os.Getenv(KeyEnv)
+	os.Unsetenv(KeyEnv)
+	if value == "" {
+		return nil, fmt.Errorf("%s is not set", KeyEnv)
+	}
+
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", KeyEnv, err)
+	}
+	return key, nil
+}
+
+// WriteToFile writes the command to a JSON file, signed with key
+func (c *UpdateCommand) WriteToFile(path string, key []byte) error {
+	command, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("marshal command: %w", err)
+	}
+
+	data, err := json.MarshalIndent(signedCommand{Command: command, MAC: commandMAC(key, command)}, "", "  ")
 	if err != nil {
 		return fmt.Errorf("marshal command: %w", err)
 	}
@@ -40,22 +168,77 @@ func (c *UpdateCommand) WriteToFile(path string) error {
 	return nil
 }
 
-// ReadFromFile reads the command from a JSON file
-func ReadFromFile(path string) (*UpdateCommand, error) {
-	data, err := os.ReadFile(path)
+// ReadFromFile reads the command from a JSON file, refusing it unless it is
+// signed with key. Both the file and the command are decoded strictly (see
+// strictjson.Decode), so the main app and the updater must agree on the
+// command's fields: they ship together.
+func ReadFromFile(path string, key []byte) (*UpdateCommand, error) {
+	command, mac, err := readCommandFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(mac), []byte(commandMAC(key, command))) {
+		return nil, ErrBadMAC
+	}
+	return decodeCommand(command)
+}
+
+// ReadUnverifiedFromFile reads the command from a JSON file without checking
+// its MAC, to inspect a command file whose key is gone. Nothing it names may
+// be run.
+func ReadUnverifiedFromFile(path string) (*UpdateCommand, error) {
+	command, _, err := readCommandFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCommand(command)
+}
+
+// readCommandFile returns the compact command in the file at path and the
+// MAC it carries
+func readCommandFile(path string) ([]byte, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("read file: %w", err)
+	}
+	data, err := strictjson.ReadAll(file, MaxCommandSize)
+	file.Close()
 	if err != nil {
-		return nil, fmt.Errorf("read file: %w", err)
+		return nil, "", fmt.Errorf("read file: %w", err)
+	}
+
+	var signed signedCommand
+	if err := strictjson.Decode(data, MaxCommandSize, &signed); err != nil {
+		return nil, "", fmt.Errorf("unmarshal command: %w", err)
+	}
+	if len(signed.Command) == 0 {
+		return nil, "", ErrBadMAC
 	}
 
+	// The MAC covers the compact encoding; indentation is for readers
+	var command bytes.Buffer
+	if err := json.Compact(&command, signed.Command); err != nil {
+		return nil, "", fmt.Errorf("unmarshal command: %w", err)
+	}
+	return command.Bytes(), signed.MAC, nil
+}
+
+func decodeCommand(command []byte) (*UpdateCommand, error) {
 	var cmd UpdateCommand
-	if err := json.Unmarshal(data, &cmd); err != nil {
+	if err := strictjson.Decode(command, MaxCommandSize, &cmd); err != nil {
 		return nil, fmt.Errorf("unmarshal command: %w", err)
 	}
-
 	return &cmd, nil
 }
 
-// Cleanup removes the command file
+// commandMAC is the hex-encoded HMAC-SHA256 of the compact command
+func commandMAC(key, command []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(command)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Cleanup shreds and removes the command file
 func Cleanup(path string) {
-	_ = os.Remove(path)
+	platform.Shred(path)
 }
@@ -0,0 +1,352 @@
+package ipc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/strictjson"
+)
+
+func newTestKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testCommand() *UpdateCommand {
+	return &UpdateCommand{
+		Action:         ActionUpdate,
+		TargetBinary:   "/opt/nametag/nametag",
+		NewBinaryPath:  "/var/cache/nametag/nametag.new",
+		ExpectedSHA256: strings.Repeat("ab", 32),
+		RestartBinary:  "/opt/nametag/nametag",
+		RestartArgs:    []string{"serve", "--port", "8080"},
+		HookPolicy:     HookDeny,
+		ParentPID:      4242,
+	}
+}
+
+// writeCommand writes testCommand signed with key and returns the file
+func writeCommand(t *testing.T, key []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "command.json")
+	if err := testCommand().WriteToFile(path, key); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCommandFileRoundTrip(t *testing.T) {
+	key := newTestKey(t)
+	path := writeCommand(t, key)
+
+	cmd, err := ReadFromFile(path, key)
+	if err != nil {
+		t.Fatalf("ReadFromFile() = %v", err)
+	}
+	want, _ := json.Marshal(testCommand())
+	if got, _ := json.Marshal(cmd); string(got) != string(want) {
+		t.Errorf("ReadFromFile() = %s, want %s", got, want)
+	}
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("command file mode %v, want 0600", info.Mode().Perm())
+		}
+	}
+}
+
+func TestReadFromFileRejects(t *testing.T) {
+	key := newTestKey(t)
+
+	for _, tt := range []struct {
+		name string
+		// edit changes the signed file's contents
+		edit    func(data string) string
+		key     []byte
+		wantErr error
+	}{
+		{"other key", nil, newTestKey(t), ErrBadMAC},
+		{"no key", nil, []byte{}, ErrBadMAC},
+		{"tampered target", func(data string) string {
+			return strings.Replace(data, `"/opt/nametag/nametag"`, `"/usr/bin/sudo"`, 1)
+		}, key, ErrBadMAC},
+		{"tampered restart args", func(data string) string {
+			return strings.Replace(data, `"8080"`, `"8081"`, 1)
+		}, key, ErrBadMAC},
+		{"unknown envelope field", func(data string) string {
+			return strings.Replace(data, `"mac"`, `"unused"`, 1)
+		}, key, nil},
+		{"MAC stripped", func(data string) string {
+			var signed signedCommand
+			json.Unmarshal([]byte(data), &signed)
+			signed.MAC = ""
+			out, _ := json.Marshal(signed)
+			return string(out)
+		}, key, ErrBadMAC},
+		{"no command", func(string) string { return `{"mac": "00"}` }, key, ErrBadMAC},
+		{"not json", func(string) string { return "update /opt/nametag/nametag" }, key, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeCommand(t, key)
+			if tt.edit != nil {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(tt.edit(string(data))), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cmd, err := ReadFromFile(path, tt.key)
+			if err == nil {
+				t.Fatalf("ReadFromFile() accepted %+v", cmd)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadFromFile() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadFromFileIgnoresLayout(t *testing.T) {
+	key := newTestKey(t)
+	path := writeCommand(t, key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The MAC covers the command, not how the file is indented
+	var signed signedCommand
+	if err := json.Unmarshal(data, &signed); err != nil {
+		t.Fatal(err)
+	}
+	compact, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, compact, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFromFile(path, key); err != nil {
+		t.Fatalf("ReadFromFile() of the compacted file = %v", err)
+	}
+}
+
+func TestReadFromFileStrict(t *testing.T) {
+	key := newTestKey(t)
+	path := filepath.Join(t.TempDir(), "command.json")
+
+	// A correctly signed command with a field this updater doesn't know
+	command := []byte(`{"action":"update","target_binary":"/opt/nametag/nametag","parent_pid":1,"run_as_root":true}`)
+	data, err := json.Marshal(signedCommand{Command: command, MAC: commandMAC(key, command)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFromFile(path, key); err == nil {
+		t.Fatal("ReadFromFile() accepted an unknown field")
+	}
+}
+
+func TestReadUnverifiedFromFile(t *testing.T) {
+	path := writeCommand(t, newTestKey(t))
+	cmd, err := ReadUnverifiedFromFile(path)
+	if err != nil {
+		t.Fatalf("ReadUnverifiedFromFile() = %v", err)
+	}
+	if cmd.TargetBinary != testCommand().TargetBinary {
+		t.Errorf("target %s, want %s", cmd.TargetBinary, testCommand().TargetBinary)
+	}
+}
+
+func TestKeyFromEnv(t *testing.T) {
+	key := newTestKey(t)
+	t.Setenv(KeyEnv, hex.EncodeToString(key))
+
+	got, err := KeyFromEnv()
+	if err != nil || hex.EncodeToString(got) != hex.EncodeToString(key) {
+		t.Fatalf("KeyFromEnv() = %x, %v, want %x", got, err, key)
+	}
+	// Processes the updater starts must not inherit the key
+	if _, ok := os.LookupEnv(KeyEnv); ok {
+		t.Errorf("%s still set after KeyFromEnv()", KeyEnv)
+	}
+	if _, err := KeyFromEnv(); err == nil {
+		t.Error("KeyFromEnv() succeeded without a key")
+	}
+
+	t.Setenv(KeyEnv, "not hex")
+	if _, err := KeyFromEnv(); err == nil {
+		t.Error("KeyFromEnv() accepted a key that isn't hex")
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	a, b := newTestKey(t), newTestKey(t)
+	if len(a) != 32 || hex.EncodeToString(a) == hex.EncodeToString(b) {
+		t.Errorf("NewKey() = %x and %x, want two distinct 32-byte keys", a, b)
+	}
+}
+
+// errAny stands for any error in tables
+var errAny = errors.New("any error")
+
+func checkErr(t *testing.T, err, want error) {
+	t.Helper()
+	switch {
+	case want == nil && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case want != nil && err == nil:
+		t.Fatalf("succeeded, want %v", want)
+	case want != nil && want != errAny && !errors.Is(err, want):
+		t.Fatalf("error = %v, want %v", err, want)
+	}
+}
+
+// signFile returns a command file carrying command signed with key
+func signFile(t *testing.T, key []byte, command string) []byte {
+	t.Helper()
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(command)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(signedCommand{Command: compact.Bytes(), MAC: commandMAC(key, compact.Bytes())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	const valid = `{"action":"update","target_binary":"/opt/nametag/nametag","parent_pid":1}`
+	// padded is valid with its restart args grown to size bytes of command
+	padded := func(size int) string {
+		arg := strings.Repeat("a", size-len(valid)-len(`,"restart_args":[""]`))
+		return strings.TrimSuffix(valid, "}") + `,"restart_args":["` + arg + `"]}`
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		wantErr error
+	}{
+		{"valid", valid, nil},
+		{"over the size limit", padded(MaxCommandSize + 1), strictjson.ErrTooLarge},
+		{"nested too deeply", strings.TrimSuffix(valid, "}") + `,"restart_args":` + strings.Repeat("[", strictjson.MaxDepth) + strings.Repeat("]", strictjson.MaxDepth) + `}`, strictjson.ErrTooDeep},
+		{"duplicate key", strings.TrimSuffix(valid, "}") + `,"target_binary":"/usr/bin/sudo"}`, strictjson.ErrDuplicateKey},
+		{"duplicate key in another case", strings.TrimSuffix(valid, "}") + `,"Target_Binary":"/usr/bin/sudo"}`, strictjson.ErrDuplicateKey},
+		{"unknown field", strings.TrimSuffix(valid, "}") + `,"run_as_root":true}`, errAny},
+		{"wrong type", `{"action":"update","target_binary":"/opt/nametag/nametag","parent_pid":"1"}`, errAny},
+		{"trailing data", valid + ` {}`, errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Run("queue entry", func(t *testing.T) {
+				dir := t.TempDir()
+				if err := os.WriteFile(filepath.Join(dir, queueCommandFile), []byte(tt.command), 0600); err != nil {
+					t.Fatal(err)
+				}
+				_, err := readEntry(dir)
+				checkErr(t, err, tt.wantErr)
+			})
+			t.Run("command file", func(t *testing.T) {
+				if !json.Valid([]byte(tt.command)) {
+					t.Skip("only valid JSON can be signed")
+				}
+				key := newTestKey(t)
+				path := filepath.Join(t.TempDir(), "command.json")
+				if err := os.WriteFile(path, signFile(t, key, tt.command), 0600); err != nil {
+					t.Fatal(err)
+				}
+				_, err := ReadFromFile(path, key)
+				checkErr(t, err, tt.wantErr)
+			})
+		})
+	}
+
+	// The signed file around a command is held to the same limits
+	key := newTestKey(t)
+	path := filepath.Join(t.TempDir(), "command.json")
+	data := signFile(t, key, valid)
+	for _, tt := range []struct {
+		name    string
+		data    string
+		wantErr error
+	}{
+		{"file over the size limit", string(data) + strings.Repeat(" ", MaxCommandSize), strictjson.ErrTooLarge},
+		{"duplicate MAC", strings.TrimSuffix(string(data), "}") + `,"mac":"00"}`, strictjson.ErrDuplicateKey},
+		{"duplicate command", `{"command":{},` + strings.TrimPrefix(string(data), "{"), strictjson.ErrDuplicateKey},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := ReadFromFile(path, key)
+			checkErr(t, err, tt.wantErr)
+		})
+	}
+}
+
+func FuzzReadCommand(f *testing.F) {
+	key := bytes.Repeat([]byte{1}, 32)
+	seed, err := json.Marshal(testCommand())
+	if err != nil {
+		f.Fatal(err)
+	}
+	mac := commandMAC(key, seed)
+	for _, s := range []string{
+		string(seed),
+		`{"command":` + string(seed) + `,"mac":"` + mac + `"}`,
+		`{"command":` + string(seed) + `,"mac":"` + mac + `","mac":"00"}`,
+		`{"action":"update","target_binary":"/opt/nametag/nametag","parent_pid":1,"restart_args":[[]]}`,
+		`{"command":null,"mac":""}`,
+	} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, queueCommandFile)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// Anything may be refused, but nothing may panic, and an accepted
+		// command must survive being written and read back
+		for _, read := range []func() (*UpdateCommand, error){
+			func() (*UpdateCommand, error) { return readEntry(dir) },
+			func() (*UpdateCommand, error) { return ReadFromFile(path, key) },
+			func() (*UpdateCommand, error) { return ReadUnverifiedFromFile(path) },
+		} {
+			cmd, err := read()
+			if err != nil {
+				continue
+			}
+			again := filepath.Join(t.TempDir(), "command.json")
+			if err := cmd.WriteToFile(again, key); err != nil {
+				t.Fatalf("WriteToFile() = %v", err)
+			}
+			roundTrip, err := ReadFromFile(again, key)
+			if err != nil {
+				t.Fatalf("ReadFromFile() refused a written command: %v", err)
+			}
+			want, _ := json.Marshal(cmd)
+			if got, _ := json.Marshal(roundTrip); !bytes.Equal(got, want) {
+				t.Fatalf("round trip changed the command:\n%s\n%s", want, got)
+			}
+		}
+	})
+}
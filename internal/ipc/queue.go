@@ -0,0 +1,218 @@
+package ipc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/strictjson"
+)
+
+// A Queue is a directory of update commands waiting to be applied, such as
+// updates staged to be applied on the next start. Each entry is a
+// subdirectory holding the files the command installs and the command. An
+// entry only counts once its command is written, so entries can be filled
+// while the queue is read.
+//
+// Queued commands are not signed. Whoever adds entries also reads them back,
+// so a key would have to be kept where anyone able to write the queue could
+// read it, and a MAC would protect nothing. The directory's permissions are
+// the only protection: it is created 0700 and must sit in a directory only
+// its owner can write, the user's state directory or, for shared installs,
+// the root-owned system directory. Commands taken from the queue are handed
+// to the updater signed with a fresh key like any other.
+type Queue struct {
+	dir string
+}
+
+const (
+	queueCommandFile = "command.json"
+	// queueClaimed marks an entry taken out of the queue to be applied
+	queueClaimed = ".applying"
+	// staleEntryAge is how long an entry may stay incomplete, or claimed,
+	// before it is taken for abandoned
+	staleEntryAge = 24 * time.Hour
+)
+
+// QueuedCommand is a complete entry of a queue
+type QueuedCommand struct {
+	// Dir is the entry's directory
+	Dir     string
+	Command *UpdateCommand
+	// Queued is when the command was added
+	Queued time.Time
+}
+
+// NewQueue returns the queue in dir, creating the directory if needed
+func NewQueue(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create queue: %w", err)
+	}
+	return &Queue{dir: dir}, nil
+}
+
+// NewEntry creates an empty entry for the files of a command to be added
+// with Add
+func (q *Queue) NewEntry() (string, error) {
+	dir, err := os.MkdirTemp(q.dir, "entry-")
+	if err != nil {
+		return "", fmt.Errorf("create queue entry: %w", err)
+	}
+	return dir, nil
+}
+
+// Add completes the entry in dir with cmd
+func (q *Queue) Add(dir string, cmd *UpdateCommand) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("marshal command: %w", err)
+	}
+
+	// Readers see the command whole or not at all
+	tmp := filepath.Join(dir, queueCommandFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write command: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, queueCommandFile)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("add command: %w", err)
+	}
+	return nil
+}
+
+// Pending returns the queue's complete entries, oldest first. Entries whose
+// command can't be read or verified are removed, as are incomplete entries
+// abandoned long ago.
+func (q *Queue) Pending() ([]QueuedCommand, error) {
+	entries, err := os.ReadDir(q.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read queue: %w", err)
+	}
+
+	var pending []QueuedCommand
+	var errs []error
+	for _, e := range entries {
+		dir := filepath.Join(q.dir, e.Name())
+		if !e.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), queueClaimed) {
+			removeStale(dir)
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(dir, queueCommandFile))
+		if errors.Is(err, os.ErrNotExist) {
+			removeStale(dir)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		cmd, err := readEntry(dir)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.Name(), err))
+			os.RemoveAll(dir)
+			continue
+		}
+		pending = append(pending, QueuedCommand{Dir: dir, Command: cmd, Queued: info.ModTime()})
+	}
+
+	slices.SortFunc(pending, func(a, b QueuedCommand) int { return a.Queued.Compare(b.Queued) })
+	return pending, errors.Join(errs...)
+}
+
+// readEntry reads an entry's command, as strictly as a command file
+func readEntry(dir string) (*UpdateCommand, error) {
+	file, err := os.Open(filepath.Join(dir, queueCommandFile))
+	if err != nil {
+		return nil, fmt.Errorf("read command: %w", err)
+	}
+	data, err := strictjson.ReadAll(file, MaxCommandSize)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read command: %w", err)
+	}
+	return decodeCommand(data)
+}
+
+// removeStale removes an entry untouched for staleEntryAge; an empty one,
+// whose files were all consumed, goes right away
+func removeStale(dir string) {
+	if os.Remove(dir) == nil {
+		return
+	}
+	if info, err := os.Stat(dir); err == nil && time.Since(info.ModTime()) > staleEntryAge {
+		os.RemoveAll(dir)
+	}
+}
+
+// Claim takes an entry out of the queue so no other process applies it too,
+// and returns the command with its paths moved along. It fails when another
+// process claimed the entry first.
+func (q *Queue) Claim(entry QueuedCommand) (*UpdateCommand, string, error) {
+	claimed := entry.Dir + queueClaimed
+	if err := os.Rename(entry.Dir, claimed); err != nil {
+		return nil, "", fmt.Errorf("claim queue entry: %w", err)
+	}
+	os.Chtimes(claimed, time.Now(), time.Now())
+
+	// The command is used up; what remains are the files it installs
+	os.Remove(filepath.Join(claimed, queueCommandFile))
+
+	cmd := *entry.Command
+	if rel, err := filepath.Rel(entry.Dir, cmd.NewBinaryPath); err == nil && !strings.HasPrefix(rel, "..") {
+		cmd.NewBinaryPath = filepath.Join(claimed, rel)
+	}
+	return &cmd, claimed, nil
+}
+
+// Remove drops an entry and its files from the queue
+func (q *Queue) Remove(entry QueuedCommand) error {
+	return os.RemoveAll(entry.Dir)
+}
+
+// Prune drops the entries for target that don't go past version, ordered
+// by less, once it is installed by other means
+func (q *Queue) Prune(target, version string, less func(a, b string) bool) error {
+	pending, err := q.Pending()
+	for _, entry := range pending {
+		if entry.Command.TargetBinary == target && !less(version, entry.Command.NewVersion) {
+			q.Remove(entry)
+		}
+	}
+	return err
+}
+
+// Collapse reduces queued commands, oldest first, to the one to apply for
+// each target binary: the newest version, as ordered by less, and the latest
+// queued among equals. The rest are superseded and returned separately so
+// their files can go.
+func Collapse(pending []QueuedCommand, less func(a, b string) bool) (apply, superseded []QueuedCommand) {
+	best := make(map[string]int)
+	for i, entry := range pending {
+		j, ok := best[entry.Command.TargetBinary]
+		if !ok || !less(entry.Command.NewVersion, pending[j].Command.NewVersion) {
+			best[entry.Command.TargetBinary] = i
+		}
+	}
+
+	for i, entry := range pending {
+		if best[entry.Command.TargetBinary] == i {
+			apply = append(apply, entry)
+		} else {
+			superseded = append(superseded, entry)
+		}
+	}
+	return apply, superseded
+}
@@ -0,0 +1,105 @@
+package ipc
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// addEntry queues cmd with its binary in a new entry of q
+func addEntry(t *testing.T, q *Queue, cmd *UpdateCommand) string {
+	t.Helper()
+	dir, err := q.NewEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.NewBinaryPath = filepath.Join(dir, "nametag.new")
+	if err := os.WriteFile(cmd.NewBinaryPath, []byte("binary"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Add(dir, cmd); err != nil {
+		t.Fatalf("Add() = %v", err)
+	}
+	return dir
+}
+
+func TestQueueRoundTrip(t *testing.T) {
+	q, err := NewQueue(filepath.Join(t.TempDir(), "staged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := addEntry(t, q, testCommand())
+
+	// Only the command and the files it installs; no key to go with it
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 2 || names[0] != queueCommandFile || names[1] != "nametag.new" {
+		t.Errorf("entry holds %v, want [%s nametag.new]", names, queueCommandFile)
+	}
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(q.dir); err != nil || info.Mode().Perm() != 0700 {
+			t.Errorf("queue directory mode %v, want 0700", info.Mode().Perm())
+		}
+	}
+
+	pending, err := q.Pending()
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("Pending() = %d entries, %v, want 1", len(pending), err)
+	}
+	want := testCommand()
+	want.NewBinaryPath = filepath.Join(dir, "nametag.new")
+	got, _ := json.Marshal(pending[0].Command)
+	if wantJSON, _ := json.Marshal(want); string(got) != string(wantJSON) {
+		t.Errorf("queued command %s, want %s", got, wantJSON)
+	}
+
+	cmd, claimed, err := q.Claim(pending[0])
+	if err != nil {
+		t.Fatalf("Claim() = %v", err)
+	}
+	if cmd.NewBinaryPath != filepath.Join(claimed, "nametag.new") {
+		t.Errorf("claimed binary %s, want it under %s", cmd.NewBinaryPath, claimed)
+	}
+	if _, err := os.Stat(filepath.Join(claimed, queueCommandFile)); !os.IsNotExist(err) {
+		t.Errorf("claimed entry still holds its command: %v", err)
+	}
+}
+
+func TestQueueDropsUnreadableEntries(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		command string
+	}{
+		{"not json", "update /opt/nametag/nametag"},
+		{"unknown field", `{"action":"update","target_binary":"/opt/nametag/nametag","parent_pid":1,"run_as_root":true}`},
+		{"duplicate key", `{"action":"update","target_binary":"/opt/nametag/nametag","target_binary":"/usr/bin/sudo","parent_pid":1}`},
+		{"signed command file", `{"command":{"action":"update"},"mac":"00"}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewQueue(filepath.Join(t.TempDir(), "staged"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := addEntry(t, q, testCommand())
+			if err := os.WriteFile(filepath.Join(dir, queueCommandFile), []byte(tt.command), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			pending, err := q.Pending()
+			if err == nil || len(pending) != 0 {
+				t.Fatalf("Pending() = %d entries, %v, want the entry refused", len(pending), err)
+			}
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				t.Errorf("refused entry left in the queue: %v", err)
+			}
+		})
+	}
+}
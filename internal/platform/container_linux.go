@@ -0,0 +1,46 @@
+//go:build linux
+
+package platform
+
+import (
+	"os"
+	"strings"
+)
+
+// cgroupMarkers are path fragments container runtimes leave in the cgroup
+// of the processes they start
+var cgroupMarkers = []string{"docker", "kubepods", "containerd", "libpod", "lxc", "crio"}
+
+// InContainer reports whether the process runs inside a container, and the
+// heuristic that says so
+func InContainer() (string, bool) {
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return "/.dockerenv exists", true
+	}
+	if _, err := os.Stat("/run/.containerenv"); err == nil {
+		return "/run/.containerenv exists", true
+	}
+	// systemd-nspawn, podman, and LXC set this for the container's init
+	if value := os.Getenv("container"); value != "" {
+		return "container=" + value + " in the environment", true
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return "running in a Kubernetes pod", true
+	}
+
+	// cgroup v1 names the runtime in the paths; cgroup v2 namespaces
+	// usually hide them, leaving the checks above
+	data, err := os.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return "", false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		_, path, _ := strings.Cut(line, ":")
+		for _, marker := range cgroupMarkers {
+			if strings.Contains(path, marker) {
+				return "cgroup of pid 1 mentions " + marker, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package platform
+
+// InContainer reports whether the process runs inside a container, and the
+// heuristic that says so. Containers are Linux-only as far as nametag is
+// concerned.
+func InContainer() (string, bool) {
+	return "", false
+}
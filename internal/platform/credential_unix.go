@@ -0,0 +1,81 @@
+//go:build !windows
+
+package platform
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// lookupCredential resolves username and group (the user's primary group
+// when empty) to the credential to start a process with, including the
+// user's supplementary groups
+func lookupCredential(username, group string) (*user.User, *syscall.Credential, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, nil, fmt.Errorf("look up user: %w", err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("user %s has non-numeric uid %q", username, u.Uid)
+	}
+
+	gidName := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, nil, fmt.Errorf("look up group: %w", err)
+		}
+		gidName = g.Gid
+	}
+	gid, err := strconv.ParseUint(gidName, 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("non-numeric gid %q", gidName)
+	}
+
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if n, err := strconv.ParseUint(id, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(n))
+			}
+		}
+	}
+
+	// Only root can switch to someone else
+	if euid := os.Geteuid(); euid != 0 && uint32(euid) != cred.Uid {
+		return nil, nil, fmt.Errorf("running as uid %d can't switch to user %s", euid, username)
+	}
+	return u, cred, nil
+}
+
+// CheckRunAs reports whether processes can be started as username and group
+func CheckRunAs(username, group string) error {
+	_, _, err := lookupCredential(username, group)
+	return err
+}
+
+// RunAs makes proc start as username and group with that user's
+// environment basics, instead of inheriting the caller's rights. Call it
+// after ConfigureDetached.
+func RunAs(proc *exec.Cmd, username, group string) error {
+	u, cred, err := lookupCredential(username, group)
+	if err != nil {
+		return err
+	}
+
+	if proc.SysProcAttr == nil {
+		proc.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	proc.SysProcAttr.Credential = cred
+
+	if proc.Env == nil {
+		proc.Env = os.Environ()
+	}
+	proc.Env = append(proc.Env, "HOME="+u.HomeDir, "USER="+u.Username, "LOGNAME="+u.Username)
+	return nil
+}
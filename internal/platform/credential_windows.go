@@ -0,0 +1,23 @@
+//go:build windows
+
+package platform
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// errRunAsUnsupported is returned on Windows, where starting a process as
+// another user needs that user's password or token
+var errRunAsUnsupported = errors.New("running the restarted process as another user is not supported on Windows")
+
+// CheckRunAs reports whether processes can be started as username and group
+func CheckRunAs(username, group string) error {
+	return errRunAsUnsupported
+}
+
+// RunAs makes proc start as username and group instead of inheriting the
+// caller's rights
+func RunAs(proc *exec.Cmd, username, group string) error {
+	return errRunAsUnsupported
+}
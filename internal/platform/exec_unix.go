@@ -17,8 +17,15 @@ func ConfigureDetached(cmd *exec.Cmd) {
 	}
 }
 
-// WaitForProcessExit waits for a process to exit with timeout
-func WaitForProcessExit(pid int, timeout time.Duration) error {
+// WaitForProcessExit waits for a process to exit with timeout. A non-zero
+// startTime guards against PID reuse: a process at pid with a different
+// start time is treated as an unrelated process and the wait ends.
+func WaitForProcessExit(pid int, startTime uint64, timeout time.Duration) error {
+	return waitForExit(pid, startTime, timeout)
+}
+
+// pollForExit waits for a process to exit by probing it with signal 0
+func pollForExit(pid int, startTime uint64, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
 		process, err := os.FindProcess(pid)
@@ -32,11 +39,28 @@ func WaitForProcessExit(pid int, timeout time.Duration) error {
 			return nil // Process gone
 		}
 
+		if pidRecycled(pid, startTime) {
+			return nil
+		}
+
 		time.Sleep(100 * time.Millisecond)
 	}
 	return fmt.Errorf("timeout waiting for process %d", pid)
 }
 
+// pidRecycled reports whether pid now refers to a process other than the
+// one that started at startTime. Only a start time that was read and
+// differs counts: when it can't be read, say because the process is
+// exiting or the platform doesn't report one, the wait goes on. A zero
+// startTime disables the check.
+func pidRecycled(pid int, startTime uint64) bool {
+	if startTime == 0 {
+		return false
+	}
+	current, err := ProcessStartTime(pid)
+	return err == nil && current != startTime
+}
+
 // AtomicReplace performs Unix atomic binary replacement
 func AtomicReplace(target, newFile, backup string) error {
 	// Remove any existing backup
@@ -61,6 +85,15 @@ func AtomicReplace(target, newFile, backup string) error {
 	return nil
 }
 
+// Reexec replaces the current process image with path, keeping the PID,
+// stdio, and environment. It only returns on failure.
+func Reexec(path string, args []string) error {
+	if err := syscall.Exec(path, append([]string{path}, args...), os.Environ()); err != nil {
+		return fmt.Errorf("exec %s: %w", path, err)
+	}
+	return nil
+}
+
 // ScheduleCleanup removes old binary immediately on Unix
 func ScheduleCleanup(path string) {
 	_ = os.Remove(path)
@@ -79,3 +112,8 @@ func RemoveQuarantine(path string) error {
 func BinaryExtension() string {
 	return ""
 }
+
+// HookExtension returns the file extension of update hook scripts
+func HookExtension() string {
+	return ""
+}
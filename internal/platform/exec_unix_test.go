@@ -0,0 +1,95 @@
+//go:build !windows
+
+package platform
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startSleep starts a process that sleeps for d and reaps it once it exits,
+// so waits see it go away rather than linger as a zombie
+func startSleep(t *testing.T, d time.Duration) int {
+	t.Helper()
+	cmd := exec.Command("sleep", strconv.FormatFloat(d.Seconds(), 'f', -1, 64))
+	if err := cmd.Start(); err != nil {
+		t.Skipf("start sleep: %v", err)
+	}
+	go cmd.Wait()
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+	return cmd.Process.Pid
+}
+
+func TestWaitForProcessExit(t *testing.T) {
+	for name, wait := range map[string]func(int, uint64, time.Duration) error{
+		"wait": waitForExit,
+		"poll": pollForExit,
+	} {
+		t.Run(name, func(t *testing.T) {
+			pid := startSleep(t, 300*time.Millisecond)
+			startTime, _ := ProcessStartTime(pid)
+
+			start := time.Now()
+			if err := wait(pid, startTime, 10*time.Second); err != nil {
+				t.Fatalf("wait: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("wait returned after %v, want soon after the process exited", elapsed)
+			}
+		})
+	}
+}
+
+func TestWaitForProcessExitTimeout(t *testing.T) {
+	pid := startSleep(t, 30*time.Second)
+	startTime, _ := ProcessStartTime(pid)
+
+	if err := WaitForProcessExit(pid, startTime, 300*time.Millisecond); err == nil {
+		t.Fatal("wait for a running process returned without timing out")
+	}
+}
+
+func TestWaitForProcessExitRecycledPID(t *testing.T) {
+	pid := os.Getpid()
+	startTime, err := ProcessStartTime(pid)
+	if err != nil {
+		t.Skipf("no process start times here: %v", err)
+	}
+
+	// A running process with another start time is someone else's
+	if err := WaitForProcessExit(pid, startTime+1, 5*time.Second); err != nil {
+		t.Fatalf("wait for a recycled pid: %v", err)
+	}
+}
+
+func TestPIDRecycled(t *testing.T) {
+	pid := os.Getpid()
+	startTime, err := ProcessStartTime(pid)
+	if err != nil {
+		t.Skipf("no process start times here: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		pid       int
+		startTime uint64
+		want      bool
+	}{
+		{"same process", pid, startTime, false},
+		{"other start time", pid, startTime + 1, true},
+		{"check disabled", pid, 0, false},
+		// An unreadable start time never counts as reuse, or an exiting
+		// parent could be mistaken for an unrelated process
+		{"unreadable start time", 1 << 30, startTime, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pidRecycled(tt.pid, tt.startTime); got != tt.want {
+				t.Errorf("pidRecycled(%d, %d) = %v, want %v", tt.pid, tt.startTime, got, tt.want)
+			}
+		})
+	}
+}
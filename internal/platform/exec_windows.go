@@ -19,15 +19,25 @@ func ConfigureDetached(cmd *exec.Cmd) {
 	}
 }
 
-// WaitForProcessExit waits for a process to exit with timeout
-func WaitForProcessExit(pid int, timeout time.Duration) error {
-	handle, err := windows.OpenProcess(windows.SYNCHRONIZE, false, uint32(pid))
+// WaitForProcessExit waits for a process to exit with timeout. A non-zero
+// startTime guards against PID reuse: a process at pid with a different
+// creation time is treated as an unrelated process and the wait ends.
+func WaitForProcessExit(pid int, startTime uint64, timeout time.Duration) error {
+	handle, err := windows.OpenProcess(windows.SYNCHRONIZE|windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
 	if err != nil {
 		// Process might already be gone
 		return nil
 	}
 	defer windows.CloseHandle(handle)
 
+	// The open handle pins the process, so checking identity once is race-free
+	if startTime != 0 {
+		current, err := processCreationTime(handle)
+		if err != nil || current != startTime {
+			return nil // PID was recycled
+		}
+	}
+
 	event, err := windows.WaitForSingleObject(handle, uint32(timeout.Milliseconds()))
 	if err != nil {
 		return fmt.Errorf("wait for process: %w", err)
@@ -38,6 +48,26 @@ func WaitForProcessExit(pid int, timeout time.Duration) error {
 	return nil
 }
 
+// ProcessStartTime returns the creation time of a process in 100ns
+// intervals since January 1, 1601 (UTC)
+func ProcessStartTime(pid int) (uint64, error) {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return 0, fmt.Errorf("open process: %w", err)
+	}
+	defer windows.CloseHandle(handle)
+
+	return processCreationTime(handle)
+}
+
+func processCreationTime(handle windows.Handle) (uint64, error) {
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(handle, &creation, &exit, &kernel, &user); err != nil {
+		return 0, fmt.Errorf("get process times: %w", err)
+	}
+	return uint64(creation.HighDateTime)<<32 | uint64(creation.LowDateTime), nil
+}
+
 // AtomicReplace performs Windows-safe binary replacement
 // On Windows, we rename the old file rather than delete it
 func AtomicReplace(target, newFile, backup string) error {
@@ -71,6 +101,28 @@ func hideFile(path string) {
 	_ = syscall.SetFileAttributes(ptr, syscall.FILE_ATTRIBUTE_HIDDEN)
 }
 
+// Reexec runs path in place of the current process. Windows can't replace a
+// process image, so path runs on the same console and the current process
+// exits with its status once it is done. It only returns on failure.
+func Reexec(path string, args []string) error {
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %s: %w", path, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		os.Exit(1)
+	}
+	os.Exit(0)
+	return nil
+}
+
 // ScheduleCleanup marks file for deletion on next startup
 // We can't delete the old exe while it might still be referenced
 func ScheduleCleanup(path string) {
@@ -87,3 +139,8 @@ func RemoveQuarantine(path string) error {
 func BinaryExtension() string {
 	return ".exe"
 }
+
+// HookExtension returns the file extension of update hook scripts
+func HookExtension() string {
+	return ".cmd"
+}
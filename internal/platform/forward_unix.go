@@ -0,0 +1,18 @@
+//go:build !windows
+
+package platform
+
+import "os"
+
+// Forward leaves a symlink at oldPath to newPath, so what named oldPath
+// runs newPath, and returns the forwarder's path
+func Forward(oldPath, newPath string) (string, error) {
+	if err := os.Symlink(newPath, oldPath); err != nil {
+		return "", err
+	}
+	return oldPath, nil
+}
+
+// RemoveForwarder removes what Forward left for oldPath besides oldPath
+// itself; on Unix that is nothing
+func RemoveForwarder(oldPath string) {}
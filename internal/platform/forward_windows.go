@@ -0,0 +1,35 @@
+//go:build windows
+
+package platform
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Forward leaves a symlink at oldPath to newPath, so what named oldPath
+// runs newPath, and returns the forwarder's path. Symlinks need developer
+// mode or elevated rights; without them a .cmd shim next to oldPath
+// forwards its arguments instead, which command lines naming the program
+// without its extension find.
+func Forward(oldPath, newPath string) (string, error) {
+	if err := os.Symlink(newPath, oldPath); err == nil {
+		return oldPath, nil
+	}
+	shim := shimPath(oldPath)
+	script := fmt.Sprintf("@echo off\r\n\"%s\" %%*\r\n", newPath)
+	if err := os.WriteFile(shim, []byte(script), 0755); err != nil {
+		return "", err
+	}
+	return shim, nil
+}
+
+// RemoveForwarder removes the .cmd shim Forward may have left for oldPath
+func RemoveForwarder(oldPath string) {
+	_ = os.Remove(shimPath(oldPath))
+}
+
+func shimPath(oldPath string) string {
+	return strings.TrimSuffix(oldPath, ".exe") + ".cmd"
+}
@@ -0,0 +1,38 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLaunchdUnsupported is returned for launchd agents on platforms other
+// than macOS
+var ErrLaunchdUnsupported = errors.New("launchd agents are only supported on macOS")
+
+// LaunchAgent is a per-user launchd job that starts at login and is kept
+// running, restarted by launchd whenever it exits
+type LaunchAgent struct {
+	// Label names the job, in reverse-DNS style
+	Label string
+	// Args are the program, by absolute path, and its arguments
+	Args []string
+	// Throttle is the least time between two starts, so a job exiting at
+	// once isn't restarted in a tight loop
+	Throttle time.Duration
+	// LogPath receives the job's output
+	LogPath string
+}
+
+// validLaunchdLabel checks that label can name a job and its plist file
+func validLaunchdLabel(label string) error {
+	if label == "" || label[0] == '.' {
+		return fmt.Errorf("invalid launchd label %q", label)
+	}
+	for _, r := range label {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '.' && r != '-' && r != '_' {
+			return fmt.Errorf("invalid launchd label %q", label)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+//go:build darwin
+
+package platform
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// launchctlTimeout bounds each launchctl run
+const launchctlTimeout = 30 * time.Second
+
+// InstallLaunchAgent writes agent's plist to ~/Library/LaunchAgents and
+// loads it into the user's login session, replacing a job of the same label
+// already loaded. It returns the plist's path.
+func InstallLaunchAgent(agent LaunchAgent) (string, error) {
+	if err := validLaunchdLabel(agent.Label); err != nil {
+		return "", err
+	}
+	if len(agent.Args) == 0 || !filepath.IsAbs(agent.Args[0]) {
+		return "", errors.New("launch agent program must be an absolute path")
+	}
+	path, err := launchAgentPath(agent.Label)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if agent.LogPath != "" {
+		if err := os.MkdirAll(filepath.Dir(agent.LogPath), 0755); err != nil {
+			return "", err
+		}
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, launchAgentPlist(agent), 0644); err != nil {
+		return "", fmt.Errorf("write launch agent: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("write launch agent: %w", err)
+	}
+
+	// A loaded job keeps its old definition until it is booted out
+	bootout(agent.Label)
+	if err := launchctl("bootstrap", guiDomain(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// UninstallLaunchAgent stops and unloads the job of label and removes its
+// plist, returning the path it was at. A job that isn't installed is not an
+// error.
+func UninstallLaunchAgent(label string) (string, error) {
+	if err := validLaunchdLabel(label); err != nil {
+		return "", err
+	}
+	path, err := launchAgentPath(label)
+	if err != nil {
+		return "", err
+	}
+	bootout(label)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	return path, nil
+}
+
+func launchAgentPath(label string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", label+".plist"), nil
+}
+
+// launchAgentPlist renders agent as a property list
+func launchAgentPlist(agent LaunchAgent) []byte {
+	var b bytes.Buffer
+	str := func(s string) string {
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(s))
+		return "<string>" + escaped.String() + "</string>"
+	}
+
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	fmt.Fprintf(&b, "\t<key>Label</key>\n\t%s\n", str(agent.Label))
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range agent.Args {
+		fmt.Fprintf(&b, "\t\t%s\n", str(arg))
+	}
+	b.WriteString("\t</array>\n")
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	b.WriteString("\t<key>KeepAlive</key>\n\t<true/>\n")
+	fmt.Fprintf(&b, "\t<key>ThrottleInterval</key>\n\t<integer>%d</integer>\n", int(agent.Throttle.Seconds()))
+	b.WriteString("\t<key>ProcessType</key>\n\t<string>Background</string>\n")
+	if agent.LogPath != "" {
+		fmt.Fprintf(&b, "\t<key>StandardOutPath</key>\n\t%s\n", str(agent.LogPath))
+		fmt.Fprintf(&b, "\t<key>StandardErrorPath</key>\n\t%s\n", str(agent.LogPath))
+	}
+	b.WriteString("</dict>\n</plist>\n")
+	return b.Bytes()
+}
+
+// guiDomain is the launchd domain of the user's login session
+func guiDomain() string {
+	return fmt.Sprintf("gui/%d", os.Getuid())
+}
+
+// bootout unloads the job of label, which fails when it isn't loaded
+func bootout(label string) {
+	_ = launchctl("bootout", guiDomain()+"/"+label)
+}
+
+func launchctl(args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), launchctlTimeout)
+	defer cancel()
+
+	// Use the system tool rather than whatever is first on PATH
+	out, err := exec.CommandContext(ctx, "/bin/launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s failed: %s", args[0], strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !darwin
+
+package platform
+
+// InstallLaunchAgent is unsupported on platforms without launchd
+func InstallLaunchAgent(agent LaunchAgent) (string, error) {
+	if err := validLaunchdLabel(agent.Label); err != nil {
+		return "", err
+	}
+	return "", ErrLaunchdUnsupported
+}
+
+// UninstallLaunchAgent is unsupported on platforms without launchd
+func UninstallLaunchAgent(label string) (string, error) {
+	if err := validLaunchdLabel(label); err != nil {
+		return "", err
+	}
+	return "", ErrLaunchdUnsupported
+}
@@ -0,0 +1,34 @@
+package platform
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNetworkWatchUnsupported is returned by WatchNetwork on platforms it
+// can't watch
+var ErrNetworkWatchUnsupported = errors.New("watching network changes is not supported on this platform")
+
+// WatchNetwork notifies on the returned channel when the machine's network
+// configuration changes: an interface going up or down, an address added or
+// removed, a route changing. A burst of changes, as when Wi-Fi reconnects,
+// coalesces into one or a few notifications; none say whether the network
+// is usable yet. It stops, closing the channel, when ctx is done, or early
+// if the kernel's notifications can no longer be read.
+//
+// It listens to the kernel's own notifications rather than a network
+// manager's: a netlink socket on Linux, a routing socket on macOS and the
+// BSDs, and the IP Helper change notifications on Windows, so it works
+// whatever manages the network, NetworkManager, systemd-networkd, or none.
+func WatchNetwork(ctx context.Context) (<-chan struct{}, error) {
+	return watchNetwork(ctx)
+}
+
+// notifyNetwork sends on changes without blocking; a notification already
+// pending covers this change as well
+func notifyNetwork(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
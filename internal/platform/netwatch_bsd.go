@@ -0,0 +1,42 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package platform
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// watchNetwork reads the routing socket, which reports interface, address,
+// and route changes, as SCNetworkReachability does underneath
+func watchNetwork(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("open routing socket: %w", err)
+	}
+	syscall.CloseOnExec(fd)
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("open routing socket: %w", err)
+	}
+
+	// A non-blocking descriptor goes through the runtime poller, so closing
+	// the file ends a read in progress
+	return readNetworkChanges(ctx, os.NewFile(uintptr(fd), "route"), routeChange), nil
+}
+
+// routeChange reports whether a routing message is a change rather than,
+// say, the answer to another process's route lookup
+func routeChange(msg []byte) bool {
+	// rtm_type follows the message length and version
+	if len(msg) < 4 {
+		return false
+	}
+	switch msg[3] {
+	case syscall.RTM_ADD, syscall.RTM_DELETE, syscall.RTM_CHANGE, syscall.RTM_NEWADDR, syscall.RTM_DELADDR, syscall.RTM_IFINFO:
+		return true
+	}
+	return false
+}
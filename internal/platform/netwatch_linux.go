@@ -0,0 +1,35 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// rtnetlink multicast groups of link, address, and route changes
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// watchNetwork subscribes a netlink socket to the kernel's link, address,
+// and route changes
+func watchNetwork(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("open netlink socket: %w", err)
+	}
+	groups := uint32(rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Ifaddr | rtmgrpIPv6Route)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("subscribe to network changes: %w", err)
+	}
+
+	// A non-blocking descriptor goes through the runtime poller, so closing
+	// the file ends a read in progress
+	return readNetworkChanges(ctx, os.NewFile(uintptr(fd), "netlink"), nil), nil
+}
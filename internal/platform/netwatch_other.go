@@ -0,0 +1,9 @@
+//go:build !linux && !windows && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package platform
+
+import "context"
+
+func watchNetwork(context.Context) (<-chan struct{}, error) {
+	return nil, ErrNetworkWatchUnsupported
+}
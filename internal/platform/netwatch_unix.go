@@ -0,0 +1,44 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package platform
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+)
+
+// readNetworkChanges notifies changes of every message read from socket,
+// until ctx is done or reading fails; relevant filters out messages that
+// aren't changes, and may be nil.
+//
+// ENOBUFS means the kernel dropped messages because the socket's buffer was
+// full, as happens when a burst of changes outruns the reader; the socket is
+// still usable, and the dropped messages were changes, so it notifies and
+// keeps reading.
+func readNetworkChanges(ctx context.Context, socket io.ReadCloser, relevant func([]byte) bool) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		socket.Close()
+	}()
+	go func() {
+		defer close(changes)
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := socket.Read(buf)
+			if errors.Is(err, syscall.ENOBUFS) {
+				notifyNetwork(changes)
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if relevant == nil || relevant(buf[:n]) {
+				notifyNetwork(changes)
+			}
+		}
+	}()
+	return changes
+}
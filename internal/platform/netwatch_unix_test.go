@@ -0,0 +1,93 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package platform
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// scriptedSocket returns each of reads in turn, then io.EOF
+type scriptedSocket struct {
+	reads []any
+}
+
+func (s *scriptedSocket) Read(p []byte) (int, error) {
+	if len(s.reads) == 0 {
+		return 0, io.EOF
+	}
+	r := s.reads[0]
+	s.reads = s.reads[1:]
+	if err, ok := r.(error); ok {
+		return 0, err
+	}
+	return copy(p, r.(string)), nil
+}
+
+func (s *scriptedSocket) Close() error { return nil }
+
+// collectChanges counts the notifications on changes until it's closed
+func collectChanges(t *testing.T, changes <-chan struct{}) int {
+	t.Helper()
+	n := 0
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return n
+			}
+			n++
+		case <-time.After(5 * time.Second):
+			t.Fatal("changes was not closed")
+		}
+	}
+}
+
+func TestReadNetworkChanges(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		reads    []any
+		relevant func([]byte) bool
+		want     bool
+		// left is how many reads should go unread
+		left int
+	}{
+		{name: "message", reads: []any{"link"}, want: true},
+		{name: "irrelevant", reads: []any{"noise"}, relevant: func(b []byte) bool { return string(b) == "link" }},
+		{name: "overflow", reads: []any{&os.PathError{Op: "read", Path: "netlink", Err: syscall.ENOBUFS}}, want: true},
+		{name: "read after overflow", reads: []any{syscall.ENOBUFS, syscall.ENOBUFS, "link"}, want: true},
+		{name: "failure", reads: []any{syscall.EBADF, "link"}, left: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			socket := &scriptedSocket{reads: tt.reads}
+			changes := readNetworkChanges(context.Background(), socket, tt.relevant)
+			// Notifications coalesce, so only whether one came is certain
+			if got := collectChanges(t, changes) > 0; got != tt.want {
+				t.Errorf("notified = %v, want %v", got, tt.want)
+			}
+			if len(socket.reads) != tt.left {
+				t.Errorf("%d reads left, want %d", len(socket.reads), tt.left)
+			}
+		})
+	}
+}
+
+func TestReadNetworkChangesClosesOnCancel(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := readNetworkChanges(ctx, r, nil)
+	cancel()
+	collectChanges(t, changes)
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("read after cancel: %v, want %v", err, os.ErrClosed)
+	}
+}
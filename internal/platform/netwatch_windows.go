@@ -0,0 +1,57 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	networkMu       sync.Mutex
+	networkWatchers = make(map[chan struct{}]struct{})
+	// networkCallback is made once: Windows callbacks are never freed
+	networkCallback = sync.OnceValue(func() uintptr { return windows.NewCallback(onNetworkChange) })
+)
+
+// onNetworkChange is called by the IP Helper on an interface or address
+// change, on a thread of its own
+func onNetworkChange(callerContext, row, notificationType uintptr) uintptr {
+	networkMu.Lock()
+	defer networkMu.Unlock()
+	for changes := range networkWatchers {
+		notifyNetwork(changes)
+	}
+	return 0
+}
+
+// watchNetwork registers for the IP Helper's interface and unicast address
+// change notifications, which the Network List Manager's connectivity
+// events are built on
+func watchNetwork(ctx context.Context) (<-chan struct{}, error) {
+	var interfaces, addresses windows.Handle
+	if err := windows.NotifyIpInterfaceChange(windows.AF_UNSPEC, networkCallback(), nil, false, &interfaces); err != nil {
+		return nil, fmt.Errorf("subscribe to interface changes: %w", err)
+	}
+	if err := windows.NotifyUnicastIpAddressChange(windows.AF_UNSPEC, networkCallback(), nil, false, &addresses); err != nil {
+		windows.CancelMibChangeNotify2(interfaces)
+		return nil, fmt.Errorf("subscribe to address changes: %w", err)
+	}
+
+	changes := make(chan struct{}, 1)
+	networkMu.Lock()
+	networkWatchers[changes] = struct{}{}
+	networkMu.Unlock()
+	go func() {
+		<-ctx.Done()
+		// Cancelling waits for callbacks in progress
+		windows.CancelMibChangeNotify2(interfaces)
+		windows.CancelMibChangeNotify2(addresses)
+		networkMu.Lock()
+		delete(networkWatchers, changes)
+		close(changes)
+		networkMu.Unlock()
+	}()
+	return changes, nil
+}
@@ -4,11 +4,21 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-// GetExecutablePath returns the path to the current executable
+// GetExecutablePath returns the path to the current executable. In the slot
+// layout that is the symlink rather than the slot it runs from, so updates
+// and restarts go through the symlink.
 func GetExecutablePath() (string, error) {
-	return os.Executable()
+	path, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if link, ok := SlotLink(path); ok {
+		return link, nil
+	}
+	return path, nil
 }
 
 // GetUpdaterPath returns the path to the updater binary
@@ -24,6 +34,47 @@ func GetUpdaterPath() (string, error) {
 	return filepath.Join(dir, updaterName), nil
 }
 
+// GetLauncherPath returns the path to the launcher binary shipped next to
+// the executable, which execs the active slot in the launcher slot layout
+func GetLauncherPath() (string, error) {
+	execPath, err := GetExecutablePath()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(filepath.Dir(execPath), "nametag-launcher"+BinaryExtension()), nil
+}
+
+// StateDir returns the per-user directory where nametag keeps persistent
+// client state, creating it if needed
+func StateDir() (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(base, "nametag")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// StagedDir returns the directory of the queue of updates staged to be
+// applied on the next start, in SystemDir for a shared install
+func StagedDir() (string, error) {
+	if runningShared() {
+		return systemSubdir("staged")
+	}
+
+	stateDir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, "staged"), nil
+}
+
 // GetBackupPath returns the backup path for a binary
 func GetBackupPath(binaryPath string) string {
 	return binaryPath + ".old"
@@ -53,21 +104,25 @@ func CleanupOldBinaries() error {
 	}
 
 	// Also clean up temp files from interrupted updates
-	tmpPattern := filepath.Join(os.TempDir(), "nametag-update-*")
-	matches, _ := filepath.Glob(tmpPattern)
-	for _, match := range matches {
-		_ = os.Remove(match)
+	if tmpDir, err := TempDir(); err == nil {
+		shredStaleUpdates(tmpDir)
 	}
 
 	return nil
 }
 
-// TempDownloadPath returns a temporary path for downloading an update
-func TempDownloadPath(version string) string {
-	return filepath.Join(os.TempDir(), "nametag-update-"+version+BinaryExtension())
-}
+// staleUpdateAge is how long an update's temp file may go untouched before
+// it is taken for left behind by an interrupted update
+const staleUpdateAge = 24 * time.Hour
 
-// TempCommandPath returns a temporary path for the update command file
-func TempCommandPath() string {
-	return filepath.Join(os.TempDir(), "nametag-update-cmd.json")
+// shredStaleUpdates shreds the downloads and command files in dir older than
+// staleUpdateAge. Younger ones may belong to an update in flight, such as a
+// command file a helper is about to read, and are left alone.
+func shredStaleUpdates(dir string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, "nametag-update-*"))
+	for _, match := range matches {
+		if info, err := os.Lstat(match); err == nil && time.Since(info.ModTime()) > staleUpdateAge {
+			Shred(match)
+		}
+	}
 }
@@ -0,0 +1,42 @@
+package platform
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShredStaleUpdates(t *testing.T) {
+	dir := t.TempDir()
+	files := []struct {
+		name string
+		age  time.Duration
+		kept bool
+	}{
+		{name: "nametag-update-1.2.0-1", age: staleUpdateAge + time.Hour},
+		{name: "nametag-update-cmd-2.json", age: staleUpdateAge + time.Hour},
+		{name: "nametag-update-1.3.0-3", age: time.Minute, kept: true},
+		{name: "nametag-update-cmd-4.json", kept: true},
+		{name: "unrelated-5", age: staleUpdateAge + time.Hour, kept: true},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		modified := time.Now().Add(-f.age)
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shredStaleUpdates(dir)
+
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dir, f.name))
+		if kept := err == nil; kept != f.kept {
+			t.Errorf("%s, %v old: kept = %v, want %v", f.name, f.age, kept, f.kept)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+//go:build darwin
+
+package platform
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// codesignTimeout bounds each codesign and spctl run; spctl may consult
+// Apple's notarization service
+const codesignTimeout = time.Minute
+
+// VerifyPublisher checks that the binary at path is signed with a Developer
+// ID certificate of the Apple Team ID publisher and that Gatekeeper accepts
+// it, i.e. it is notarized. The updater strips the quarantine attribute after
+// replacing the binary, so this is the check Gatekeeper would otherwise make
+// when the binary is next launched.
+func VerifyPublisher(path, publisher string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), codesignTimeout)
+	defer cancel()
+
+	// Team IDs are ten alphanumerics; anything else can't be embedded in the
+	// requirement safely
+	if !validTeamID(publisher) {
+		return fmt.Errorf("invalid team id %q", publisher)
+	}
+	requirement := fmt.Sprintf(`=anchor apple generic and certificate leaf[subject.OU] = "%s"`, publisher)
+
+	// Use the system tools rather than whatever is first on PATH
+	out, err := exec.CommandContext(ctx, "/usr/bin/codesign", "--verify", "--strict", "-R", requirement, path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("codesign verification failed: %s", strings.TrimSpace(string(out)))
+	}
+
+	// Bare executables aren't apps, so assess them as opened documents, which
+	// still checks the notarization ticket
+	out, err = exec.CommandContext(ctx, "/usr/sbin/spctl", "--assess", "--type", "open", "--context", "context:primary-signature", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("gatekeeper assessment failed: %s", strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+func validTeamID(id string) bool {
+	if len(id) != 10 {
+		return false
+	}
+	for _, r := range id {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,8 @@
+//go:build !windows && !darwin
+
+package platform
+
+// VerifyPublisher is a no-op on platforms without an OS code signature check
+func VerifyPublisher(path, publisher string) error {
+	return nil
+}
@@ -0,0 +1,85 @@
+//go:build windows
+
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// authenticodeTimeout bounds the PowerShell signature check
+const authenticodeTimeout = time.Minute
+
+// authenticodeScript prints the signature status and the signer's subject.
+// The path is passed through the environment so it is never parsed as script.
+const authenticodeScript = `$s = Get-AuthenticodeSignature -LiteralPath $env:NAMETAG_VERIFY_PATH
+$s.Status.ToString()
+if ($s.SignerCertificate) { $s.SignerCertificate.Subject }`
+
+// VerifyPublisher checks that the binary at path has a valid Authenticode
+// signature whose signer is publisher, either the certificate's full subject
+// or its common name
+func VerifyPublisher(path, publisher string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), authenticodeTimeout)
+	defer cancel()
+
+	// Use the system PowerShell rather than whatever is first on PATH
+	powershell := filepath.Join(os.Getenv("SystemRoot"), "System32", "WindowsPowerShell", "v1.0", "powershell.exe")
+
+	cmd := exec.CommandContext(ctx, powershell, "-NoProfile", "-NonInteractive", "-Command", authenticodeScript)
+	cmd.Env = append(os.Environ(), "NAMETAG_VERIFY_PATH="+path)
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("check authenticode signature: %w", err)
+	}
+
+	status, subject, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	status = strings.TrimSpace(status)
+	subject = strings.TrimSpace(subject)
+
+	if status != "Valid" {
+		return fmt.Errorf("authenticode signature is not valid: %s", status)
+	}
+	if subject == "" {
+		return errors.New("authenticode signature has no signer certificate")
+	}
+	if subject != publisher && commonName(subject) != publisher {
+		return fmt.Errorf("binary is signed by %q, expected %q", subject, publisher)
+	}
+
+	return nil
+}
+
+// commonName returns the CN of an X.500 subject as formatted by .NET, e.g.
+// `CN="Example, Inc.", O="Example, Inc.", C=US`
+func commonName(subject string) string {
+	for len(subject) > 0 {
+		var attr string
+		attr, subject = nextAttribute(subject)
+		if value, ok := strings.CutPrefix(attr, "CN="); ok {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// nextAttribute splits the first comma-separated attribute off subject,
+// keeping commas inside quoted values
+func nextAttribute(subject string) (string, string) {
+	quoted := false
+	for i, r := range subject {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			return strings.TrimSpace(subject[:i]), strings.TrimSpace(subject[i+1:])
+		}
+	}
+	return strings.TrimSpace(subject), ""
+}
@@ -0,0 +1,40 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrReadOnly is returned when the binary to update sits on a read-only
+// filesystem, e.g. a container image layer, the Nix store, or a live CD
+var ErrReadOnly = errors.New("binary is on a read-only filesystem")
+
+// CheckWritable checks that the binary at path can be replaced, by creating
+// and removing a file next to it, so an update that can't be installed
+// fails before it is downloaded rather than at the rename. Binaries in a
+// package store are refused without probing.
+func CheckWritable(path string) error {
+	if reason, ok := ImmutableStore(path); ok {
+		return fmt.Errorf("%w: %s", ErrImmutableStore, reason)
+	}
+
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, ".nametag-preflight-*")
+	if err == nil {
+		name := f.Name()
+		f.Close()
+		return os.Remove(name)
+	}
+
+	switch {
+	case isReadOnly(err):
+		return fmt.Errorf("%w: %s; update it with the package manager or image that installed it, "+
+			"or copy nametag to a writable directory such as ~/.local/bin and update that copy", ErrReadOnly, dir)
+	case errors.Is(err, os.ErrPermission):
+		return fmt.Errorf("no permission to replace binaries in %s; run the update as the user that owns it: %w", dir, err)
+	default:
+		return fmt.Errorf("check %s is writable: %w", dir, err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package platform
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isReadOnly reports whether err comes from writing to a read-only mount
+func isReadOnly(err error) bool {
+	return errors.Is(err, syscall.EROFS)
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package platform
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// isReadOnly reports whether err comes from writing to write-protected media
+func isReadOnly(err error) bool {
+	return errors.Is(err, windows.ERROR_WRITE_PROTECT)
+}
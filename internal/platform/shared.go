@@ -0,0 +1,139 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrInsecureDir is returned for a directory of a shared install that users
+// other than the administrators could plant or swap files in
+var ErrInsecureDir = errors.New("directory is not protected from other users")
+
+// ErrUpdateInProgress is returned by LockSharedInstall when another update
+// of a shared install holds the lock
+var ErrUpdateInProgress = errors.New("another update of this install is in progress")
+
+// SharedInstall reports whether the binary at path is a system-wide install
+// shared by the users of the machine: one in a directory owned by root, or
+// by Administrators or SYSTEM on Windows. Updates of a shared install take
+// turns through LockSharedInstall and keep their downloads, command files,
+// and staged updates in SystemDir instead of the user's directories, which
+// under sudo may well belong to someone else.
+func SharedInstall(path string) bool {
+	owned, err := systemOwned(filepath.Dir(path))
+	return err == nil && owned
+}
+
+// runningShared reports whether the running binary is a shared install
+func runningShared() bool {
+	execPath, err := GetExecutablePath()
+	return err == nil && SharedInstall(execPath)
+}
+
+// SystemDir returns the directory updates of shared installs keep their
+// files in, creating it: /var/lib/nametag, /Library/Application
+// Support/nametag on macOS, or nametag under ProgramData on Windows. Only
+// the administrators can write to it.
+func SystemDir() (string, error) {
+	dir, err := systemDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := protectDir(dir); err != nil {
+		return "", err
+	}
+	if err := CheckSystemDir(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// systemSubdir returns the directory name in SystemDir, created with 0700
+// permissions
+func systemSubdir(name string) (string, error) {
+	base, err := SystemDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(base, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := CheckSystemDir(dir); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// CheckSystemDir checks that dir is a directory, not a symlink, owned by
+// root (Administrators or SYSTEM on Windows) and writable by its owner only,
+// so files an update verified in it can't be replaced before they are
+// installed. On Windows only the owner is checked.
+func CheckSystemDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%w: %s is not a directory", ErrInsecureDir, dir)
+	}
+	owned, err := systemOwned(dir)
+	if err != nil {
+		return fmt.Errorf("check owner of %s: %w", dir, err)
+	}
+	if !owned {
+		return fmt.Errorf("%w: %s is not owned by %s", ErrInsecureDir, dir, systemOwner)
+	}
+	if writableByOthers(info) {
+		return fmt.Errorf("%w: %s is writable by users other than %s", ErrInsecureDir, dir, systemOwner)
+	}
+	return nil
+}
+
+// LockSharedInstall takes the machine-wide lock updates of shared installs
+// take turns with, waiting up to timeout for another update to finish; 0
+// doesn't wait. The returned function releases it, as does the process
+// exiting, so a crashed update never leaves it behind; callers keep it until
+// they are done, since the lock file it holds is closed once unreachable.
+// Once the wait is over it returns ErrUpdateInProgress.
+func LockSharedInstall(timeout time.Duration) (func(), error) {
+	dir, err := SystemDir()
+	if err != nil {
+		return nil, fmt.Errorf("get system directory: %w", err)
+	}
+
+	lockPath := filepath.Join(dir, "update.lock")
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open update lock: %w", err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("lock %s: %w", lockPath, err)
+		}
+		if locked {
+			return func() {
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, ErrUpdateInProgress
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
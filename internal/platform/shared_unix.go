@@ -0,0 +1,50 @@
+//go:build !windows
+
+package platform
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// systemOwner names who a shared install's directories must belong to
+const systemOwner = "root"
+
+func systemDir() (string, error) {
+	if runtime.GOOS == "darwin" {
+		return "/Library/Application Support/nametag", nil
+	}
+	return "/var/lib/nametag", nil
+}
+
+// systemOwned reports whether root owns dir
+func systemOwned(dir string) (bool, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return false, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, fmt.Errorf("no owner for %s", dir)
+	}
+	return stat.Uid == 0, nil
+}
+
+// writableByOthers reports whether the group or everyone may write to a
+// directory
+func writableByOthers(info fs.FileInfo) bool {
+	return info.Mode().Perm()&0022 != 0
+}
+
+// protectDir takes group and other write permission away from dir; the
+// permissions MkdirAll gave it are already right unless someone changed them
+func protectDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil || !info.IsDir() || !writableByOthers(info) {
+		return err
+	}
+	return os.Chmod(dir, info.Mode().Perm()&^0022)
+}
@@ -0,0 +1,75 @@
+//go:build windows
+
+package platform
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// systemOwner names who a shared install's directories must belong to
+const systemOwner = "Administrators or SYSTEM"
+
+// systemDirACL gives SYSTEM and Administrators full control, and no one else
+// any access, without inheriting the user-writable defaults of ProgramData
+const systemDirACL = "D:P(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)"
+
+func systemDir() (string, error) {
+	programData, err := windows.KnownFolderPath(windows.FOLDERID_ProgramData, 0)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(programData, "nametag"), nil
+}
+
+// systemOwned reports whether Administrators or SYSTEM own dir
+func systemOwned(dir string) (bool, error) {
+	sd, err := windows.GetNamedSecurityInfo(dir, windows.SE_FILE_OBJECT, windows.OWNER_SECURITY_INFORMATION)
+	if err != nil {
+		return false, err
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return false, err
+	}
+	return owner.IsWellKnown(windows.WinBuiltinAdministratorsSid) || owner.IsWellKnown(windows.WinLocalSystemSid), nil
+}
+
+// writableByOthers can't tell from the mode who may write on Windows; the
+// ACL protectDir sets decides that
+func writableByOthers(info fs.FileInfo) bool {
+	return false
+}
+
+// protectDir replaces the ACL dir inherited, which lets users create files
+// under ProgramData, with one for SYSTEM and Administrators only
+func protectDir(dir string) error {
+	sd, err := windows.SecurityDescriptorFromString(systemDirACL)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(dir, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, dacl, nil)
+}
+
+// tryLockFile takes an exclusive lock on f, reporting false when another
+// process holds it
+func tryLockFile(f *os.File) (bool, error) {
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, new(windows.Overlapped))
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) {
+	_ = windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, new(windows.Overlapped))
+}
@@ -0,0 +1,26 @@
+//go:build aix || solaris
+
+package platform
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes an exclusive fcntl lock on f, where flock is missing,
+// reporting false when another process holds it
+func tryLockFile(f *os.File) (bool, error) {
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) {
+	lock := syscall.Flock_t{Type: syscall.F_UNLCK, Whence: io.SeekStart}
+	_ = syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+}
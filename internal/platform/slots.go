@@ -0,0 +1,244 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Slot names of the blue/green layout: the binary's path leads to one of two
+// slots next to it, e.g. nametag -> nametag.a, so switching versions is a
+// flip and the other slot holds the previous version. The path is either a
+// symlink to the active slot or a launcher that execs the slot named in a
+// pointer file, e.g. nametag.slot holding "a".
+const (
+	SlotA = "a"
+	SlotB = "b"
+)
+
+// SlotPointerExt is the extension of the pointer file naming the active slot
+// in the launcher layout
+const SlotPointerExt = ".slot"
+
+// ErrNotSlotted is returned for a binary that isn't in the slot layout
+var ErrNotSlotted = errors.New("binary is not in the slot layout")
+
+// SlotPath returns the path of slot ("a" or "b") of the binary at link, with
+// the slot before the executable extension: nametag.a, nametag.a.exe
+func SlotPath(link, slot string) string {
+	ext := BinaryExtension()
+	return strings.TrimSuffix(link, ext) + "." + slot + ext
+}
+
+// SlotPointerPath returns the pointer file of the launcher at link
+func SlotPointerPath(link string) string {
+	return strings.TrimSuffix(link, BinaryExtension()) + SlotPointerExt
+}
+
+// usesLauncher reports whether link is in the launcher layout rather than a
+// symlink
+func usesLauncher(link string) bool {
+	info, err := os.Lstat(link)
+	if err != nil || info.Mode()&os.ModeSymlink != 0 {
+		return false
+	}
+	_, err = os.Stat(SlotPointerPath(link))
+	return err == nil
+}
+
+// ActiveSlot returns the path of the slot link currently leads to
+func ActiveSlot(link string) (string, error) {
+	var name string
+	if usesLauncher(link) {
+		data, err := os.ReadFile(SlotPointerPath(link))
+		if err != nil {
+			return "", ErrNotSlotted
+		}
+		name = strings.TrimSpace(string(data))
+	} else {
+		dest, err := os.Readlink(link)
+		if err != nil || filepath.Dir(dest) != "." {
+			return "", ErrNotSlotted
+		}
+		for _, slot := range []string{SlotA, SlotB} {
+			if dest == filepath.Base(SlotPath(link, slot)) {
+				name = slot
+			}
+		}
+	}
+
+	if name != SlotA && name != SlotB {
+		return "", ErrNotSlotted
+	}
+	return SlotPath(link, name), nil
+}
+
+// OtherSlot returns the path of the slot next to the one at slot
+func OtherSlot(slot string) string {
+	ext := BinaryExtension()
+	base := strings.TrimSuffix(slot, ext)
+	if strings.HasSuffix(base, "."+SlotA) {
+		return strings.TrimSuffix(base, SlotA) + SlotB + ext
+	}
+	return strings.TrimSuffix(base, SlotB) + SlotA + ext
+}
+
+// SlotLink returns the binary path of the slot layout path belongs to: path
+// itself, or the symlink or launcher leading to it when path is the active
+// slot, as os.Executable reports
+func SlotLink(path string) (string, bool) {
+	if _, err := ActiveSlot(path); err == nil {
+		return path, true
+	}
+	ext := BinaryExtension()
+	for _, slot := range []string{SlotA, SlotB} {
+		if base, ok := strings.CutSuffix(strings.TrimSuffix(path, ext), "."+slot); ok {
+			link := base + ext
+			if active, err := ActiveSlot(link); err == nil && active == path {
+				return link, true
+			}
+		}
+	}
+	return "", false
+}
+
+// PointSlot atomically switches link to slot, which must be in the same
+// directory: by renaming a new symlink over it, or a new pointer file over
+// the launcher's
+func PointSlot(link, slot string) error {
+	if usesLauncher(link) {
+		return writeSlotPointer(SlotPointerPath(link), slot)
+	}
+
+	tmp := link + ".slot-tmp"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(filepath.Base(slot), tmp); err != nil {
+		return fmt.Errorf("create slot link: %w", err)
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("switch slot: %w", err)
+	}
+	return nil
+}
+
+// writeSlotPointer atomically writes the name of slot to the pointer file
+func writeSlotPointer(pointer, slot string) error {
+	name := SlotA
+	if strings.HasSuffix(strings.TrimSuffix(slot, BinaryExtension()), "."+SlotB) {
+		name = SlotB
+	}
+	tmp := pointer + ".tmp"
+	if err := os.WriteFile(tmp, []byte(name+"\n"), 0644); err != nil {
+		return fmt.Errorf("write slot pointer: %w", err)
+	}
+	if err := os.Rename(tmp, pointer); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("switch slot: %w", err)
+	}
+	return nil
+}
+
+// SaveSlot records at backup which slot link leads to, for RestoreSlot
+func SaveSlot(link, backup string) error {
+	active, err := ActiveSlot(link)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(backup)
+	if usesLauncher(link) {
+		return writeSlotPointer(backup, active)
+	}
+	if err := os.Symlink(filepath.Base(active), backup); err != nil {
+		return fmt.Errorf("link previous slot: %w", err)
+	}
+	return nil
+}
+
+// RestoreSlot switches link back to the slot SaveSlot recorded at backup
+func RestoreSlot(link, backup string) error {
+	if usesLauncher(link) {
+		if err := os.Rename(backup, SlotPointerPath(link)); err != nil {
+			return fmt.Errorf("switch back slot: %w", err)
+		}
+		return nil
+	}
+	if info, err := os.Lstat(backup); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return errors.New("backup is not a slot link")
+	}
+	if err := os.Rename(backup, link); err != nil {
+		return fmt.Errorf("switch back slot: %w", err)
+	}
+	return nil
+}
+
+// EnableSlots moves the binary at path into slot A and leads path to it,
+// with a symlink or, when launcher names a launcher binary, by installing a
+// copy of the launcher at path and a pointer file next to it. Symlinks
+// aren't supported on Windows, since they need privileges there.
+func EnableSlots(path, launcher string) error {
+	if _, ok := SlotLink(path); ok {
+		return nil
+	}
+	if launcher == "" && runtime.GOOS == "windows" {
+		return errors.New("symlinked slots are not supported on Windows; use the launcher")
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	slot := SlotPath(path, SlotA)
+	if launcher != "" {
+		return enableLauncher(path, slot, launcher)
+	}
+
+	// The slot is a hard link, so the binary's path never goes missing
+	// while the symlink is renamed over it
+	_ = os.Remove(slot)
+	if err := os.Link(path, slot); err != nil {
+		return fmt.Errorf("move binary into slot: %w", err)
+	}
+	if err := PointSlot(path, slot); err != nil {
+		_ = os.Remove(slot)
+		return err
+	}
+	return nil
+}
+
+// enableLauncher moves the binary at path into slot and puts a copy of the
+// launcher in its place. Renaming works on a running executable even on
+// Windows, so this may run from the binary being moved.
+func enableLauncher(path, slot, launcher string) error {
+	data, err := os.ReadFile(launcher)
+	if err != nil {
+		return fmt.Errorf("read launcher: %w", err)
+	}
+	tmp := path + ".launcher-tmp"
+	if err := os.WriteFile(tmp, data, 0755); err != nil {
+		return fmt.Errorf("write launcher: %w", err)
+	}
+
+	if err := writeSlotPointer(SlotPointerPath(path), slot); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(path, slot); err != nil {
+		_ = os.Remove(tmp)
+		_ = os.Remove(SlotPointerPath(path))
+		return fmt.Errorf("move binary into slot: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Rename(slot, path)
+		_ = os.Remove(SlotPointerPath(path))
+		return fmt.Errorf("install launcher: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrImmutableStore is returned when the binary to update is part of a
+// content-addressed package store, which only its package manager changes
+var ErrImmutableStore = errors.New("binary is in an immutable package store")
+
+// packageStore is a content-addressed store and how packages in it are
+// upgraded
+type packageStore struct {
+	root    string
+	name    string
+	upgrade string
+}
+
+// packageStores returns the stores binaries are recognized in. Nix honors
+// NIX_STORE_DIR for stores outside /nix/store.
+func packageStores() []packageStore {
+	nixUpgrade := "upgrade it through Nix (nix profile upgrade, home-manager, or the NixOS configuration that installed it)"
+	stores := []packageStore{
+		{root: "/nix/store", name: "the Nix store", upgrade: nixUpgrade},
+		{root: "/gnu/store", name: "the Guix store", upgrade: "upgrade it through Guix (guix pull, then guix upgrade)"},
+	}
+	if dir := os.Getenv("NIX_STORE_DIR"); dir != "" && filepath.Clean(dir) != "/nix/store" {
+		stores = append(stores, packageStore{root: filepath.Clean(dir), name: "the Nix store", upgrade: nixUpgrade})
+	}
+	return stores
+}
+
+// ImmutableStore reports whether the binary at path, after following
+// symlinks such as a Nix profile's, is in a content-addressed package store,
+// with guidance on upgrading it instead. Replacing such a binary is bound to
+// fail: the store is read-only, and a rebuild would undo it anyway.
+func ImmutableStore(path string) (string, bool) {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	for _, store := range packageStores() {
+		if strings.HasPrefix(path, store.root+"/") {
+			return fmt.Sprintf("%s is in %s, which only its package manager changes; %s", path, store.name, store.upgrade), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,94 @@
+package platform
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// TempDir returns the per-user private directory for downloads and command
+// files, creating it with 0700 permissions. Unlike the shared temp
+// directory, no other user can plant or pre-create files in it. A shared
+// install uses tmp in SystemDir instead.
+func TempDir() (string, error) {
+	if runningShared() {
+		return systemSubdir("tmp")
+	}
+
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(base, "nametag", "tmp")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	// A directory someone else made, or a symlink out of the cache, isn't
+	// private
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// CreateTemp creates a new file with an unpredictable name matching pattern
+// in TempDir, exclusively and with 0600 permissions, and returns its path
+func CreateTemp(pattern string) (string, error) {
+	dir, err := TempDir()
+	if err != nil {
+		return "", fmt.Errorf("get temp directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	path := f.Name()
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// TempDownloadPath creates an empty file for downloading an update to
+func TempDownloadPath(version string) (string, error) {
+	return CreateTemp("nametag-update-" + version + "-*" + BinaryExtension())
+}
+
+// TempCommandPath creates an empty file for the update command
+func TempCommandPath() (string, error) {
+	return CreateTemp("nametag-update-cmd-*.json")
+}
+
+// Shred overwrites a file with zeros before removing it, so a command file
+// or download doesn't linger on disk. On copy-on-write and flash storage the
+// old blocks may survive; it is best effort. Symlinks are removed, not
+// followed.
+func Shred(path string) {
+	if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+		if f, err := os.OpenFile(path, os.O_WRONLY, 0); err == nil {
+			_, _ = io.CopyN(f, zeroReader{}, info.Size())
+			_ = f.Sync()
+			_ = f.Close()
+		}
+	}
+	_ = os.Remove(path)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,14 @@
+package platform
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validUninstallKey checks that key names a single Uninstall registry entry
+func validUninstallKey(key string) error {
+	if key == "" || strings.ContainsAny(key, `\/`) {
+		return fmt.Errorf("invalid uninstall entry name %q", key)
+	}
+	return nil
+}
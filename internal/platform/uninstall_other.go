@@ -0,0 +1,8 @@
+//go:build !windows
+
+package platform
+
+// RegisterUninstall is a no-op on platforms without an Uninstall registry
+func RegisterUninstall(key, name, version, binaryPath string) error {
+	return validUninstallKey(key)
+}
@@ -0,0 +1,67 @@
+//go:build windows
+
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// uninstallPath is the registry path, under HKLM or HKCU, of the entries
+// Add/Remove Programs and inventory tools list installed software from
+const uninstallPath = `Software\Microsoft\Windows\CurrentVersion\Uninstall\`
+
+// RegisterUninstall records version and location of the binary at
+// binaryPath in the Uninstall registry entry named key, so Add/Remove
+// Programs and inventory tools report what is installed now. A machine-wide
+// entry, as an installer run as administrator creates, is updated where one
+// exists; otherwise the user's, created if needed with name as its display
+// name. The uninstall command an installer set is left alone.
+func RegisterUninstall(key, name, version, binaryPath string) error {
+	if err := validUninstallKey(key); err != nil {
+		return err
+	}
+	path := uninstallPath + key
+
+	root := registry.CURRENT_USER
+	if k, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE); err == nil {
+		k.Close()
+		root = registry.LOCAL_MACHINE
+	}
+	k, _, err := registry.CreateKey(root, path, registry.QUERY_VALUE|registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("open uninstall entry %s: %w", key, err)
+	}
+	defer k.Close()
+
+	if _, _, err := k.GetStringValue("DisplayName"); errors.Is(err, registry.ErrNotExist) {
+		if err := k.SetStringValue("DisplayName", name); err != nil {
+			return fmt.Errorf("write uninstall entry %s: %w", key, err)
+		}
+		// Without an uninstaller, there's nothing to modify or repair with
+		_ = k.SetDWordValue("NoModify", 1)
+		_ = k.SetDWordValue("NoRepair", 1)
+	}
+
+	values := map[string]string{
+		"DisplayVersion":  version,
+		"InstallLocation": filepath.Dir(binaryPath),
+		"DisplayIcon":     binaryPath,
+	}
+	for value, data := range values {
+		if err := k.SetStringValue(value, data); err != nil {
+			return fmt.Errorf("write uninstall entry %s: %w", key, err)
+		}
+	}
+	if info, err := os.Stat(binaryPath); err == nil {
+		// In KiB, as Add/Remove Programs shows it
+		if err := k.SetDWordValue("EstimatedSize", uint32((info.Size()+1023)/1024)); err != nil {
+			return fmt.Errorf("write uninstall entry %s: %w", key, err)
+		}
+	}
+	return nil
+}
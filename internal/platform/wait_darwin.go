@@ -0,0 +1,30 @@
+//go:build darwin
+
+package platform
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitForExit polls for the process to exit; macOS has no pidfd
+func waitForExit(pid int, startTime uint64, timeout time.Duration) error {
+	return pollForExit(pid, startTime, timeout)
+}
+
+// ProcessStartTime returns the start time of a process in microseconds
+// since the Unix epoch, as reported by the kern.proc.pid sysctl
+func ProcessStartTime(pid int) (uint64, error) {
+	info, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	if err != nil {
+		return 0, fmt.Errorf("sysctl kern.proc.pid: %w", err)
+	}
+	// A process that is gone comes back zeroed rather than as an error
+	if int(info.Proc.P_pid) != pid {
+		return 0, fmt.Errorf("no process %d", pid)
+	}
+	started := info.Proc.P_starttime
+	return uint64(started.Sec)*1e6 + uint64(started.Usec), nil
+}
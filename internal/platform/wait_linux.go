@@ -0,0 +1,82 @@
+//go:build linux
+
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitForExit waits on a pidfd so the kernel notifies us as soon as the
+// process exits. Kernels older than 5.3 fall back to signal polling.
+func waitForExit(pid int, startTime uint64, timeout time.Duration) error {
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		if errors.Is(err, unix.ESRCH) {
+			return nil // Process gone
+		}
+		return pollForExit(pid, startTime, timeout)
+	}
+	defer unix.Close(pidfd)
+
+	// The pidfd pins the process, so checking identity once is race-free
+	if pidRecycled(pid, startTime) {
+		return nil
+	}
+
+	return waitPidfd(pidfd, pid, timeout)
+}
+
+// waitPidfd blocks until the pidfd becomes readable, which happens when the
+// process it refers to exits
+func waitPidfd(pidfd, pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	fds := []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("timeout waiting for process %d", pid)
+		}
+
+		n, err := unix.Poll(fds, int(remaining.Milliseconds())+1)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("poll pidfd: %w", err)
+		}
+		if n > 0 {
+			return nil
+		}
+	}
+}
+
+// ProcessStartTime returns the start time of a process in clock ticks since
+// boot, as reported by /proc/<pid>/stat
+func ProcessStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, fmt.Errorf("read stat: %w", err)
+	}
+
+	// The command name may contain spaces, so skip past its closing paren
+	stat := string(data)
+	end := strings.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("malformed stat for process %d", pid)
+	}
+
+	// Fields after the name start at field 3 (state); starttime is field 22
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed stat for process %d", pid)
+	}
+
+	return strconv.ParseUint(fields[19], 10, 64)
+}
@@ -0,0 +1,19 @@
+//go:build !windows && !linux && !darwin
+
+package platform
+
+import (
+	"errors"
+	"time"
+)
+
+// waitForExit falls back to signal polling where pidfd is unavailable
+func waitForExit(pid int, startTime uint64, timeout time.Duration) error {
+	return pollForExit(pid, startTime, timeout)
+}
+
+// ProcessStartTime is unsupported on the BSDs and other Unix systems, whose
+// process tables differ in layout; waits there rely on signal polling alone
+func ProcessStartTime(pid int) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
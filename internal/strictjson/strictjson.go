@@ -0,0 +1,133 @@
+// Package strictjson decodes JSON from sources that may be compromised or
+// buggy, refusing documents a well-behaved producer never writes rather than
+// making the best of them
+package strictjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MaxDepth is how deeply objects and arrays may nest. Manifests and commands
+// nest a few levels; the standard decoder allows thousands.
+const MaxDepth = 32
+
+var (
+	// ErrTooLarge is returned for a document over its size limit
+	ErrTooLarge = errors.New("json document too large")
+	// ErrTooDeep is returned for a document nested deeper than MaxDepth
+	ErrTooDeep = errors.New("json document nested too deeply")
+	// ErrDuplicateKey is returned for an object naming a key twice, which
+	// other parsers may resolve differently than encoding/json's last-wins
+	ErrDuplicateKey = errors.New("duplicate key in json object")
+)
+
+// Decode decodes data into v, refusing documents over maxSize bytes, nested
+// deeper than MaxDepth, repeating a key in an object, with fields v has no
+// place for, or with anything after the value. Keys differing only in case
+// count as repeated, since encoding/json matches them to the same field.
+func Decode(data []byte, maxSize int, v any) error {
+	if err := Check(data, maxSize); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// Check applies Decode's checks that don't depend on the type decoded into
+func Check(data []byte, maxSize int) error {
+	if len(data) > maxSize {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrTooLarge, len(data), maxSize)
+	}
+	return checkStructure(data)
+}
+
+// ReadAll reads r to the end, failing with ErrTooLarge once it has more than
+// maxSize bytes
+func ReadAll(r io.Reader, maxSize int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, maxSize)
+	}
+	return data, nil
+}
+
+// frame is an object or array being walked
+type frame struct {
+	// keys are the object's keys so far, lower-cased; nil for an array
+	keys map[string]bool
+	// wantKey is set while the object's next token is a key
+	wantKey bool
+}
+
+// checkStructure walks data's tokens, checking nesting depth and keys before
+// anything is decoded, and that a single value makes up the document
+func checkStructure(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var stack []*frame
+	done := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			if !done {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if done {
+			return errors.New("trailing data after json value")
+		}
+
+		var top *frame
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+		if top != nil && top.wantKey {
+			if key, ok := tok.(string); ok {
+				folded := strings.ToLower(key)
+				if top.keys[folded] {
+					return fmt.Errorf("%w: %q", ErrDuplicateKey, key)
+				}
+				top.keys[folded] = true
+				top.wantKey = false
+				continue
+			}
+		}
+
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			if len(stack) == MaxDepth {
+				return fmt.Errorf("%w: more than %d levels", ErrTooDeep, MaxDepth)
+			}
+			f := &frame{}
+			if tok == json.Delim('{') {
+				f.keys, f.wantKey = make(map[string]bool), true
+			}
+			stack = append(stack, f)
+			continue
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+		}
+
+		// A value ended: the enclosing object wants its next key
+		if len(stack) == 0 {
+			done = true
+		} else if parent := stack[len(stack)-1]; parent.keys != nil {
+			parent.wantKey = true
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package strictjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// errAny stands for any error in tables
+var errAny = errors.New("any error")
+
+// nested returns a document of arrays depth levels deep
+func nested(depth int) string {
+	return strings.Repeat("[", depth) + strings.Repeat("]", depth)
+}
+
+func TestDecode(t *testing.T) {
+	type doc struct {
+		Name  string `json:"name"`
+		Inner *doc   `json:"inner,omitempty"`
+		List  []any  `json:"list,omitempty"`
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		maxSize int
+		wantErr error
+	}{
+		{"valid", `{"name":"a","inner":{"name":"b"}}`, 100, nil},
+		{"at the size limit", `{"name":"abc"}`, 14, nil},
+		{"over the size limit", `{"name":"abcd"}`, 14, ErrTooLarge},
+		{"at the depth limit", `{"list":` + nested(MaxDepth-1) + `}`, 1000, nil},
+		{"over the depth limit", `{"list":` + nested(MaxDepth) + `}`, 1000, ErrTooDeep},
+		{"duplicate key", `{"name":"a","name":"b"}`, 100, ErrDuplicateKey},
+		{"duplicate key in another case", `{"name":"a","NAME":"b"}`, 100, ErrDuplicateKey},
+		{"duplicate key in a nested object", `{"inner":{"name":"a","name":"b"}}`, 100, ErrDuplicateKey},
+		{"same key in sibling objects", `{"list":[{"name":"a"},{"name":"b"}]}`, 100, nil},
+		{"same key at two levels", `{"name":"a","inner":{"name":"b"}}`, 100, nil},
+		{"key-like string value", `{"name":"name","inner":{"name":"name"}}`, 100, nil},
+		{"unknown field", `{"name":"a","extra":1}`, 100, errAny},
+		{"unknown field in a nested object", `{"inner":{"extra":1}}`, 100, errAny},
+		{"trailing data", `{"name":"a"} {}`, 100, errAny},
+		{"truncated", `{"name":"a"`, 100, errAny},
+		{"empty", ``, 100, errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v doc
+			err := Decode([]byte(tt.data), tt.maxSize, &v)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Errorf("Decode() = %v, want success", err)
+			case tt.wantErr == errAny && err == nil:
+				t.Error("Decode() succeeded, want an error")
+			case tt.wantErr != nil && tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+				t.Errorf("Decode() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		maxSize int
+		wantErr error
+	}{
+		{"under the limit", 10, 11, nil},
+		{"at the limit", 11, 11, nil},
+		{"over the limit", 12, 11, ErrTooLarge},
+		{"far over the limit", 1 << 20, 11, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ReadAll(bytes.NewReader(make([]byte, tt.size)), tt.maxSize)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadAll() = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && len(data) != tt.size {
+				t.Errorf("ReadAll() read %d bytes, want %d", len(data), tt.size)
+			}
+		})
+	}
+}
+
+func FuzzCheck(f *testing.F) {
+	for _, seed := range []string{
+		`{"a":1}`, `{"a":{"b":[1,2,{"c":null}]}}`, `{"a":1,"A":2}`, `[[[]]]`, `"s"`, `{"a":1} 2`, `{"a":`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// What Check accepts is one valid JSON value, within the limits
+		if err := Check(data, 1<<16); err != nil {
+			return
+		}
+		if !json.Valid(data) {
+			t.Fatalf("Check() accepted invalid JSON %q", data)
+		}
+		depth, maxDepth := 0, 0
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				break
+			}
+			switch tok {
+			case json.Delim('{'), json.Delim('['):
+				depth++
+				maxDepth = max(maxDepth, depth)
+			case json.Delim('}'), json.Delim(']'):
+				depth--
+			}
+		}
+		if maxDepth > MaxDepth {
+			t.Fatalf("Check() accepted %d levels of nesting", maxDepth)
+		}
+	})
+}
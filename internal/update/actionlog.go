@@ -0,0 +1,218 @@
+package update
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ActionLogFile is the client's tamper-evident log of update actions, kept
+// in the state directory
+const ActionLogFile = "actions.log"
+
+// Client actions recorded in the action log
+const (
+	ActionCheck    = "check"
+	ActionDownload = "download"
+	ActionReplace  = "replace"
+	ActionRollback = "rollback"
+	ActionSwitch   = "switch"
+	ActionMigrate  = "migrate"
+	ActionFailure  = "failure"
+)
+
+// actionLockTimeout is how long appending waits for another process's lock
+// before taking it over as stale
+const actionLockTimeout = 10 * time.Second
+
+// ActionEntry is one line of the action log. Each entry carries the hash of
+// the one before it, so editing, reordering, or removing a line breaks the
+// chain from there on.
+type ActionEntry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Component string    `json:"component,omitempty"`
+	From      string    `json:"from,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash"`
+}
+
+// hash is the SHA-256 over the entry with Hash left empty
+func (e ActionEntry) hash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("marshal action entry: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ActionLog is an append-only, hash-chained log file
+type ActionLog struct {
+	path string
+}
+
+// NewActionLog returns the action log at path
+func NewActionLog(path string) *ActionLog {
+	return &ActionLog{path: path}
+}
+
+// Append chains entry to the last one and appends it. Seq, Prev, and Hash
+// are filled in, and Time when it is zero.
+func (l *ActionLog) Append(entry ActionEntry) error {
+	unlock, err := l.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	last, err := l.last()
+	if err != nil {
+		return err
+	}
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	entry.Seq, entry.Prev = 1, ""
+	if last != nil {
+		entry.Seq, entry.Prev = last.Seq+1, last.Hash
+	}
+	if entry.Hash, err = entry.hash(); err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("marshal action entry: %w", err)
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("open action log: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("write action log: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync action log: %w", err)
+	}
+	return f.Close()
+}
+
+// last returns the last entry, or nil for an empty log
+func (l *ActionLog) last() (*ActionEntry, error) {
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open action log: %w", err)
+	}
+	defer f.Close()
+
+	// Entries are small; the tail holds the last one
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat action log: %w", err)
+	}
+	offset := max(info.Size()-64<<10, 0)
+	tail := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read action log: %w", err)
+	}
+
+	tail = bytes.TrimRight(tail, "\n")
+	if len(tail) == 0 {
+		return nil, nil
+	}
+	if i := bytes.LastIndexByte(tail, '\n'); i >= 0 {
+		tail = tail[i+1:]
+	}
+	var entry ActionEntry
+	if err := json.Unmarshal(tail, &entry); err != nil {
+		return nil, fmt.Errorf("action log's last entry is corrupt: %w", err)
+	}
+	return &entry, nil
+}
+
+// lock serializes appends between nametag and nametag-up with a lock file
+func (l *ActionLog) lock() (func(), error) {
+	lockPath := l.path + ".lock"
+	deadline := time.Now().Add(actionLockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("lock action log: %w", err)
+		}
+		// A holder that crashed leaves the lock behind
+		if time.Now().After(deadline) {
+			os.Remove(lockPath)
+			deadline = time.Now().Add(actionLockTimeout)
+			continue
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// ErrActionLogTampered is returned by Verify for a log whose chain is broken
+var ErrActionLogTampered = errors.New("action log chain is broken")
+
+// Entries reads and verifies the log, calling fn for each entry in order. It
+// stops at the first entry that doesn't chain to the one before it,
+// returning an error wrapping ErrActionLogTampered.
+func (l *ActionLog) Entries(fn func(ActionEntry)) error {
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open action log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	var prev ActionEntry
+	for line := 1; scanner.Scan(); line++ {
+		var entry ActionEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("%w: line %d is not an entry", ErrActionLogTampered, line)
+		}
+
+		sum, err := entry.hash()
+		if err != nil {
+			return err
+		}
+		switch {
+		case sum != entry.Hash:
+			return fmt.Errorf("%w: line %d was modified", ErrActionLogTampered, line)
+		case entry.Prev != prev.Hash || entry.Seq != prev.Seq+1:
+			return fmt.Errorf("%w: line %d doesn't follow line %d", ErrActionLogTampered, line, line-1)
+		}
+
+		fn(entry)
+		prev = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read action log: %w", err)
+	}
+	return nil
+}
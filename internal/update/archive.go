@@ -0,0 +1,257 @@
+package update
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Archive formats an asset may be published in. An empty format is a raw
+// binary.
+const (
+	FormatTarGz = "tar.gz"
+	FormatZip   = "zip"
+)
+
+// Hook scripts an archive may carry alongside the binary
+const (
+	HookPreinstall  = "preinstall"
+	HookPostinstall = "postinstall"
+)
+
+// ArchiveFormat returns the archive format implied by a filename, or "" for
+// a raw binary
+func ArchiveFormat(filename string) string {
+	switch {
+	case strings.HasSuffix(filename, ".tar.gz"), strings.HasSuffix(filename, ".tgz"):
+		return FormatTarGz
+	case strings.HasSuffix(filename, ".zip"):
+		return FormatZip
+	default:
+		return ""
+	}
+}
+
+// ExtractedArchive lists the files taken from an update archive
+type ExtractedArchive struct {
+	Binary     string
+	Hooks      map[string]string
+	Companions []ExtractedCompanion
+}
+
+// ExtractArchive extracts the binary named binaryName, any hook scripts
+// (named hook+hookSuffix, e.g. "preinstall.cmd"), and the companion files
+// listed in a companions index from an archive into destDir. Files may sit
+// at any depth; everything else is ignored.
+func ExtractArchive(archivePath, format, destDir, binaryName, hookSuffix string) (*ExtractedArchive, error) {
+	wanted := map[string]string{
+		binaryName:                   "",
+		HookPreinstall + hookSuffix:  HookPreinstall,
+		HookPostinstall + hookSuffix: HookPostinstall,
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("open archive: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat archive: %w", err)
+	}
+	companions, companionPaths, err := readCompanionIndex(f, info.Size(), format)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ExtractedArchive{Hooks: make(map[string]string), Companions: make([]ExtractedCompanion, len(companions))}
+	extract := func(name string, r io.Reader) error {
+		if i, ok := companionPaths[path.Clean(name)]; ok {
+			delete(companionPaths, path.Clean(name))
+			// Numbered, as companions of different kinds may share a name
+			dest := filepath.Join(destDir, fmt.Sprintf("companion-%d-%s", i, companions[i].Name()))
+			if err := writeCompanion(dest, r, companions[i]); err != nil {
+				return err
+			}
+			result.Companions[i] = ExtractedCompanion{CompanionFile: companions[i], Extracted: dest}
+			return nil
+		}
+
+		base := path.Base(name)
+		hook, ok := wanted[base]
+		if !ok {
+			return nil
+		}
+		delete(wanted, base) // first match wins
+
+		// Only the base name is used, so entries can't escape destDir
+		dest := filepath.Join(destDir, base)
+		if err := writeExecutable(dest, r); err != nil {
+			return err
+		}
+
+		if hook == "" {
+			result.Binary = dest
+		} else {
+			result.Hooks[hook] = dest
+		}
+		return nil
+	}
+
+	if err := walkArchive(f, info.Size(), format, extract); err != nil {
+		return nil, err
+	}
+
+	if result.Binary == "" {
+		return nil, fmt.Errorf("archive does not contain %s", binaryName)
+	}
+	for name := range companionPaths {
+		return nil, fmt.Errorf("archive does not contain companion %s", name)
+	}
+
+	return result, nil
+}
+
+// ArchiveFileSHA256 returns the SHA-256 of the file named name in an
+// archive, matched at any depth like ExtractArchive's binary
+func ArchiveFileSHA256(archivePath, format, name string) (string, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("open archive: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("stat archive: %w", err)
+	}
+
+	var hash string
+	err = walkArchive(f, info.Size(), format, func(entry string, r io.Reader) error {
+		if hash != "" || path.Base(entry) != name {
+			return nil
+		}
+		digests, err := ReaderDigests(r, HashSHA256)
+		if err != nil {
+			return err
+		}
+		hash = digests[HashSHA256]
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if hash == "" {
+		return "", fmt.Errorf("archive does not contain %s", name)
+	}
+	return hash, nil
+}
+
+// ArchiveHooks returns the hook scripts (named hook+hookSuffix) an archive
+// of size bytes read from r carries, in the order they run
+func ArchiveHooks(r io.ReaderAt, size int64, format, hookSuffix string) ([]string, error) {
+	found := make(map[string]bool)
+	err := walkArchive(r, size, format, func(name string, _ io.Reader) error {
+		switch path.Base(name) {
+		case HookPreinstall + hookSuffix:
+			found[HookPreinstall] = true
+		case HookPostinstall + hookSuffix:
+			found[HookPostinstall] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []string
+	for _, hook := range []string{HookPreinstall, HookPostinstall} {
+		if found[hook] {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks, nil
+}
+
+// walkArchive calls fn with every regular file in the archive
+func walkArchive(r io.ReaderAt, size int64, format string, fn func(name string, r io.Reader) error) error {
+	switch format {
+	case FormatTarGz:
+		return walkTarGz(io.NewSectionReader(r, 0, size), fn)
+	case FormatZip:
+		return walkZip(r, size, fn)
+	default:
+		return fmt.Errorf("unsupported archive format %q", format)
+	}
+}
+
+func walkTarGz(r io.Reader, fn func(name string, r io.Reader) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("open gzip: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read tar: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func walkZip(r io.ReaderAt, size int64, fn func(name string, r io.Reader) error) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("open zip: %w", err)
+	}
+
+	for _, file := range zr.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("open %s: %w", file.Name, err)
+		}
+		err = fn(file.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeExecutable(dest string, r io.Reader) error {
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", filepath.Base(dest), err)
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("extract %s: %w", filepath.Base(dest), err)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,217 @@
+package update
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveEntry is a file packed by writeArchive; a symlink entry links to
+// body
+type archiveEntry struct {
+	name    string
+	body    string
+	symlink bool
+}
+
+// writeArchive packs entries into an archive of format in a fresh directory
+func writeArchive(t *testing.T, format string, entries ...archiveEntry) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "nametag."+format)
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	switch format {
+	case FormatTarGz:
+		gz := gzip.NewWriter(f)
+		tw := tar.NewWriter(gz)
+		for _, e := range entries {
+			hdr := &tar.Header{Name: e.name, Mode: 0755, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+			if e.symlink {
+				hdr = &tar.Header{Name: e.name, Mode: 0777, Linkname: e.body, Typeflag: tar.TypeSymlink}
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if !e.symlink {
+				io.WriteString(tw, e.body)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case FormatZip:
+		zw := zip.NewWriter(f)
+		for _, e := range entries {
+			hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+			hdr.SetMode(0755)
+			if e.symlink {
+				hdr.SetMode(os.ModeSymlink | 0777)
+			}
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, e.body)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return name
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestExtractArchive(t *testing.T) {
+	for _, format := range []string{FormatTarGz, FormatZip} {
+		t.Run(format, func(t *testing.T) {
+			archive := writeArchive(t, format,
+				archiveEntry{name: "nametag_1.2.0/README.md", body: "readme"},
+				archiveEntry{name: "nametag_1.2.0/bin/nametag", body: "binary"},
+				archiveEntry{name: "nametag_1.2.0/postinstall.sh", body: "post"},
+				// The first entry of a name wins
+				archiveEntry{name: "other/nametag", body: "second binary"},
+			)
+			dest := t.TempDir()
+
+			got, err := ExtractArchive(archive, format, dest, "nametag", ".sh")
+			if err != nil {
+				t.Fatalf("ExtractArchive() = %v", err)
+			}
+			if got.Binary != filepath.Join(dest, "nametag") || readFile(t, got.Binary) != "binary" {
+				t.Errorf("binary %s holds %q, want the first nametag", got.Binary, readFile(t, got.Binary))
+			}
+			if info, err := os.Stat(got.Binary); err != nil || info.Mode().Perm()&0100 == 0 {
+				t.Errorf("binary not executable: %v, %v", info.Mode(), err)
+			}
+			if len(got.Hooks) != 1 || readFile(t, got.Hooks[HookPostinstall]) != "post" {
+				t.Errorf("hooks = %v, want the postinstall hook only", got.Hooks)
+			}
+			if entries, _ := os.ReadDir(dest); len(entries) != 2 {
+				t.Errorf("extracted %d files, want the binary and the hook", len(entries))
+			}
+		})
+	}
+}
+
+func TestExtractArchiveConfined(t *testing.T) {
+	for _, format := range []string{FormatTarGz, FormatZip} {
+		t.Run(format, func(t *testing.T) {
+			root := t.TempDir()
+			dest := filepath.Join(root, "dest")
+			if err := os.Mkdir(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			archive := writeArchive(t, format,
+				archiveEntry{name: "../../preinstall.sh", body: "escaped"},
+				archiveEntry{name: "/abs/nametag", body: "binary"},
+			)
+
+			got, err := ExtractArchive(archive, format, dest, "nametag", ".sh")
+			if err != nil {
+				t.Fatalf("ExtractArchive() = %v", err)
+			}
+			if got.Binary != filepath.Join(dest, "nametag") || got.Hooks[HookPreinstall] != filepath.Join(dest, "preinstall.sh") {
+				t.Errorf("extracted to %s and %v, want both in %s", got.Binary, got.Hooks, dest)
+			}
+			if entries, _ := os.ReadDir(root); len(entries) != 1 {
+				t.Errorf("%d entries beside the destination, want none", len(entries)-1)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveErrors(t *testing.T) {
+	for _, format := range []string{FormatTarGz, FormatZip} {
+		for _, tt := range []struct {
+			name    string
+			entries []archiveEntry
+			wantErr string
+		}{
+			{"no binary", []archiveEntry{{name: "README.md", body: "readme"}}, "does not contain nametag"},
+			{"binary only in another directory's name", []archiveEntry{{name: "nametag/README.md", body: "readme"}}, "does not contain nametag"},
+			// A link could point the binary anywhere, so it's skipped
+			{"symlinked binary", []archiveEntry{{name: "nametag", body: "/bin/sh", symlink: true}}, "does not contain nametag"},
+		} {
+			t.Run(format+"/"+tt.name, func(t *testing.T) {
+				archive := writeArchive(t, format, tt.entries...)
+				_, err := ExtractArchive(archive, format, t.TempDir(), "nametag", ".sh")
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ExtractArchive() = %v, want %q", err, tt.wantErr)
+				}
+			})
+		}
+	}
+
+	archive := writeArchive(t, FormatZip, archiveEntry{name: "nametag", body: "binary"})
+	if _, err := ExtractArchive(archive, FormatTarGz, t.TempDir(), "nametag", ".sh"); err == nil {
+		t.Error("ExtractArchive() read a zip as a tarball")
+	}
+	if _, err := ExtractArchive(archive, "rar", t.TempDir(), "nametag", ".sh"); err == nil {
+		t.Error("ExtractArchive() accepted an unknown format")
+	}
+}
+
+func TestArchiveHooks(t *testing.T) {
+	for _, format := range []string{FormatTarGz, FormatZip} {
+		t.Run(format, func(t *testing.T) {
+			archive := writeArchive(t, format,
+				archiveEntry{name: "scripts/postinstall.cmd", body: "post"},
+				archiveEntry{name: "nametag.exe", body: "binary"},
+				archiveEntry{name: "preinstall.sh", body: "wrong suffix"},
+				archiveEntry{name: "scripts/preinstall.cmd", body: "pre"},
+			)
+			f, err := os.Open(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hooks, err := ArchiveHooks(f, info.Size(), format, ".cmd")
+			if err != nil {
+				t.Fatalf("ArchiveHooks() = %v", err)
+			}
+			if strings.Join(hooks, ",") != HookPreinstall+","+HookPostinstall {
+				t.Errorf("ArchiveHooks() = %v, want them in the order they run", hooks)
+			}
+		})
+	}
+}
+
+func TestArchiveFormat(t *testing.T) {
+	for name, want := range map[string]string{
+		"nametag_linux_amd64.tar.gz":  FormatTarGz,
+		"nametag_linux_amd64.tgz":     FormatTarGz,
+		"nametag_windows_amd64.zip":   FormatZip,
+		"nametag_linux_amd64":         "",
+		"nametag_windows_amd64.exe":   "",
+		"nametag_linux_amd64.tar.bz2": "",
+	} {
+		if got := ArchiveFormat(name); got != want {
+			t.Errorf("ArchiveFormat(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
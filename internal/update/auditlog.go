@@ -0,0 +1,66 @@
+package update
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// AuditLogFile is the append-only log of changes to published assets, kept at
+// the root of the assets directory
+const AuditLogFile = "audit.log"
+
+// Audit log actions
+const (
+	AuditPublish    = "publish"
+	AuditRepublish  = "republish"
+	AuditResign     = "resign"
+	AuditPromote    = "promote"
+	AuditYank       = "yank"
+	AuditUnyank     = "unyank"
+	AuditRollout    = "rollout"
+	AuditChannel    = "channel"
+	AuditQuarantine = "quarantine"
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time           time.Time `json:"time"`
+	Action         string    `json:"action"`
+	Actor          string    `json:"actor,omitempty"`
+	Component      string    `json:"component"`
+	Version        string    `json:"version"`
+	File           string    `json:"file,omitempty"`
+	SHA256         string    `json:"sha256,omitempty"`
+	PreviousSHA256 string    `json:"previous_sha256,omitempty"`
+	// Percent is the rollout percentage a rollout entry set
+	Percent *float64 `json:"percent,omitempty"`
+	// Channel is the channel a channel entry moved the version to
+	Channel string `json:"channel,omitempty"`
+}
+
+// AppendAuditLog appends entry as a JSON line to the audit log in assetsDir
+func AppendAuditLog(assetsDir string, entry AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("marshal audit entry: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(assetsDir, AuditLogFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("write audit log: %w", err)
+	}
+
+	return f.Close()
+}
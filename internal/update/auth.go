@@ -0,0 +1,57 @@
+package update
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// APIKeyHeader carries the API key of a client of an update server that
+// restricts manifests and downloads to key holders. Servers also accept the
+// key in the APIKeyParam query parameter, for clients that can't set
+// headers.
+const (
+	APIKeyHeader = "X-Nametag-API-Key"
+	APIKeyParam  = "api_key"
+)
+
+// authTransport adds the client's credentials, an API key or a bearer token,
+// to requests for the update server. Redirects to other hosts, such as a
+// CDN, go without them. With sign set the API key itself never leaves the
+// client; each request is signed with it instead.
+type authTransport struct {
+	base   http.RoundTripper
+	token  string
+	sign   bool
+	tokens TokenSource
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	first := req
+	for first.Response != nil && first.Response.Request != nil {
+		first = first.Response.Request
+	}
+	if first.URL.Host != req.URL.Host {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	switch {
+	case t.token != "" && t.sign:
+		if err := SignRequest(req, RequestSigningKey(t.token), time.Now()); err != nil {
+			return nil, err
+		}
+	case t.token != "":
+		req.Header.Set(APIKeyHeader, t.token)
+	}
+	// Requests with credentials of their own, like license token
+	// exchanges, keep them
+	if t.tokens != nil && req.Header.Get("Authorization") == "" {
+		token, err := t.tokens.Token(req.Context())
+		if err != nil {
+			return nil, fmt.Errorf("get bearer token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return t.base.RoundTrip(req)
+}
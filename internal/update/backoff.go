@@ -0,0 +1,113 @@
+package update
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// BackoffFile is the name of the client state file recording when the server
+// next wants to hear from the client
+const BackoffFile = "backoff.json"
+
+const (
+	// defaultBackoff is used when the server refuses without Retry-After
+	defaultBackoff = 5 * time.Minute
+	// maxBackoff caps how long a server can silence a client, so a bad
+	// header can't stop updates for good
+	maxBackoff = 24 * time.Hour
+)
+
+// BackoffError is returned instead of contacting the server while a backoff
+// it asked for is in effect
+type BackoffError struct {
+	Until  time.Time
+	Reason string
+}
+
+func (e *BackoffError) Error() string {
+	return fmt.Sprintf("server asked not to be contacted until %s (%s)", e.Until.Format(time.RFC3339), e.Reason)
+}
+
+// Backoff persists the server's backpressure signals across runs, so a
+// client started again by cron or a service manager keeps away too
+type Backoff struct {
+	path string
+}
+
+type backoffState struct {
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+// NewBackoff stores backoff state in the file at path
+func NewBackoff(path string) *Backoff {
+	return &Backoff{path: path}
+}
+
+// Check returns a BackoffError while a recorded backoff is in effect
+func (b *Backoff) Check(now time.Time) error {
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read backoff: %w", err)
+	}
+
+	var state backoffState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("decode backoff: %w", err)
+	}
+
+	// The cap also bounds a state file written by an older client
+	if now.Before(state.Until) && state.Until.Sub(now) <= maxBackoff {
+		return &BackoffError{Until: state.Until, Reason: state.Reason}
+	}
+	return nil
+}
+
+// Wait records that the server should not be contacted for d
+func (b *Backoff) Wait(now time.Time, d time.Duration, reason string) error {
+	d = min(d, maxBackoff)
+
+	data, err := json.MarshalIndent(backoffState{Until: now.Add(d).UTC(), Reason: reason}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode backoff: %w", err)
+	}
+
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write backoff: %w", err)
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write backoff: %w", err)
+	}
+	return nil
+}
+
+// Clear forgets any recorded backoff
+func (b *Backoff) Clear() error {
+	if err := os.Remove(b.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("clear backoff: %w", err)
+	}
+	return nil
+}
+
+// Record persists the backoff an UnavailableError asks for; other errors are
+// ignored
+func (b *Backoff) Record(err error) error {
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) {
+		return nil
+	}
+
+	d := unavailable.RetryAfter
+	if d <= 0 {
+		d = defaultBackoff
+	}
+	return b.Wait(time.Now(), d, unavailable.Error())
+}
@@ -0,0 +1,223 @@
+package update
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// BLAKE3 hashing, following the reference implementation. Only the default
+// hash mode with 32-byte output is supported, which is all digests need.
+
+const (
+	blake3BlockLen = 64
+	blake3ChunkLen = 1024
+
+	blake3ChunkStart = 1 << 0
+	blake3ChunkEnd   = 1 << 1
+	blake3Parent     = 1 << 2
+	blake3Root       = 1 << 3
+)
+
+var blake3IV = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func blake3G(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] += s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+func blake3Compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+
+	for round := range 7 {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+
+		if round < 6 {
+			var permuted [16]uint32
+			for i, j := range blake3Permutation {
+				permuted[i] = m[j]
+			}
+			m = permuted
+		}
+	}
+
+	for i := range 8 {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+func blake3Words(block *[blake3BlockLen]byte) [16]uint32 {
+	var words [16]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(block[4*i:])
+	}
+	return words
+}
+
+// blake3Output is a node whose chaining value or root output hasn't been
+// computed yet
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *blake3Output) chainingValue() [8]uint32 {
+	s := blake3Compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags)
+	return [8]uint32(s[:8])
+}
+
+func (o *blake3Output) rootBytes() []byte {
+	s := blake3Compress(&o.cv, &o.block, 0, o.blockLen, o.flags|blake3Root)
+	out := make([]byte, 32)
+	for i := range 8 {
+		binary.LittleEndian.PutUint32(out[4*i:], s[i])
+	}
+	return out
+}
+
+func blake3ParentOutput(left, right [8]uint32) blake3Output {
+	o := blake3Output{cv: blake3IV, blockLen: blake3BlockLen, flags: blake3Parent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+type blake3Chunk struct {
+	cv               [8]uint32
+	counter          uint64
+	block            [blake3BlockLen]byte
+	blockLen         int
+	blocksCompressed int
+}
+
+func newBlake3Chunk(counter uint64) blake3Chunk {
+	return blake3Chunk{cv: blake3IV, counter: counter}
+}
+
+func (c *blake3Chunk) len() int {
+	return blake3BlockLen*c.blocksCompressed + c.blockLen
+}
+
+func (c *blake3Chunk) startFlag() uint32 {
+	if c.blocksCompressed == 0 {
+		return blake3ChunkStart
+	}
+	return 0
+}
+
+func (c *blake3Chunk) write(p []byte) {
+	for len(p) > 0 {
+		// The last block of a chunk is compressed by output, with
+		// blake3ChunkEnd set, so a full block waits for more input
+		if c.blockLen == blake3BlockLen {
+			words := blake3Words(&c.block)
+			s := blake3Compress(&c.cv, &words, c.counter, blake3BlockLen, c.startFlag())
+			c.cv = [8]uint32(s[:8])
+			c.blocksCompressed++
+			c.block = [blake3BlockLen]byte{}
+			c.blockLen = 0
+		}
+
+		n := copy(c.block[c.blockLen:], p)
+		c.blockLen += n
+		p = p[n:]
+	}
+}
+
+func (c *blake3Chunk) output() blake3Output {
+	return blake3Output{
+		cv:       c.cv,
+		block:    blake3Words(&c.block),
+		counter:  c.counter,
+		blockLen: uint32(c.blockLen),
+		flags:    c.startFlag() | blake3ChunkEnd,
+	}
+}
+
+// blake3Hasher implements hash.Hash for BLAKE3-256
+type blake3Hasher struct {
+	chunk blake3Chunk
+	// stack holds the chaining values of completed subtrees, one per set
+	// bit of the number of completed chunks
+	stack [][8]uint32
+}
+
+func newBLAKE3() hash.Hash {
+	return &blake3Hasher{chunk: newBlake3Chunk(0)}
+}
+
+func (h *blake3Hasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if h.chunk.len() == blake3ChunkLen {
+			cv := h.chunk.output()
+			h.pushChunk(cv.chainingValue(), h.chunk.counter+1)
+			h.chunk = newBlake3Chunk(h.chunk.counter + 1)
+		}
+
+		take := min(blake3ChunkLen-h.chunk.len(), len(p))
+		h.chunk.write(p[:take])
+		p = p[take:]
+	}
+	return n, nil
+}
+
+// pushChunk adds a chunk's chaining value, merging every subtree it
+// completes; total is the number of chunks so far
+func (h *blake3Hasher) pushChunk(cv [8]uint32, total uint64) {
+	for total&1 == 0 {
+		parent := blake3ParentOutput(h.stack[len(h.stack)-1], cv)
+		cv = parent.chainingValue()
+		h.stack = h.stack[:len(h.stack)-1]
+		total >>= 1
+	}
+	h.stack = append(h.stack, cv)
+}
+
+func (h *blake3Hasher) Sum(b []byte) []byte {
+	out := h.chunk.output()
+	for i := len(h.stack) - 1; i >= 0; i-- {
+		out = blake3ParentOutput(h.stack[i], out.chainingValue())
+	}
+	return append(b, out.rootBytes()...)
+}
+
+func (h *blake3Hasher) Reset() {
+	*h = blake3Hasher{chunk: newBlake3Chunk(0)}
+}
+
+func (h *blake3Hasher) Size() int {
+	return 32
+}
+
+func (h *blake3Hasher) BlockSize() int {
+	return blake3BlockLen
+}
@@ -0,0 +1,96 @@
+package update
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ChannelStable is the channel of releases not published on any other, and
+// the one clients follow by default
+const ChannelStable = "stable"
+
+// ChannelFile is the name of the file in a component version's directory
+// that names the channel the release is published on, e.g. "beta" or
+// "nightly". Versions without one are stable.
+const ChannelFile = "CHANNEL"
+
+// ErrWrongChannel is returned for a manifest signed for a channel other than
+// the one the client follows
+var ErrWrongChannel = errors.New("manifest is for another channel")
+
+// NormalizeChannel returns the channel name clients and servers compare:
+// lowercase, with the empty name meaning stable
+func NormalizeChannel(channel string) string {
+	channel = strings.ToLower(strings.TrimSpace(channel))
+	if channel == "" {
+		return ChannelStable
+	}
+	return channel
+}
+
+// ValidateChannel checks that channel is a usable channel name: lowercase
+// letters, digits, and dashes
+func ValidateChannel(channel string) error {
+	if channel == "" {
+		return errors.New("channel name is empty")
+	}
+	for _, r := range channel {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return fmt.Errorf("invalid channel name %q", channel)
+		}
+	}
+	return nil
+}
+
+// ChannelManifestURL returns the server path of channel's manifest; the
+// stable one keeps the path clients without channels fetch
+func ChannelManifestURL(channel string) string {
+	channel = NormalizeChannel(channel)
+	if channel == ChannelStable {
+		return "/v1/manifest.json"
+	}
+	return "/v1/manifest.json?channel=" + url.QueryEscape(channel)
+}
+
+// ReadChannel returns the channel the release in versionDir is published on
+func ReadChannel(versionDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(versionDir, ChannelFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return ChannelStable, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read channel: %w", err)
+	}
+
+	channel := NormalizeChannel(string(data))
+	if err := ValidateChannel(channel); err != nil {
+		return "", fmt.Errorf("%s: %w", versionDir, err)
+	}
+	return channel, nil
+}
+
+// WriteChannel publishes the release in versionDir on channel; a stable
+// release has no channel file
+func WriteChannel(versionDir, channel string) error {
+	path := filepath.Join(versionDir, ChannelFile)
+	if channel == ChannelStable {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("write channel: %w", err)
+		}
+		return nil
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(channel+"\n"), 0644); err != nil {
+		return fmt.Errorf("write channel: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write channel: %w", err)
+	}
+	return nil
+}
@@ -2,18 +2,52 @@ package update
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/strictjson"
 )
 
 // Checker handles version checking against the update server
 type Checker struct {
 	serverURL  string
 	httpClient *http.Client
+	keys       *TrustedKeys
+	tuf        *TUFClient
+	channel    string
+	product    string
 	logger     *slog.Logger
+
+	installedPath  string
+	allowDowngrade bool
+	maxAge         time.Duration
+	limits         ManifestLimits
+
+	backoff       *Backoff
+	ignoreBackoff bool
+
+	// verified remembers manifests whose signatures verified
+	verified *VerifyCache
+	// transparency, when set, checks offered assets against the server's
+	// transparency log
+	transparency *TransparencyClient
+	// dictionary, when set, holds the dictionary manifests are fetched
+	// compressed against
+	dictionary *dictionaryStore
+	// machineIDPath, when set, is the file of the machine ID sent with
+	// manifest requests
+	machineIDPath string
+	// group is the label targeting rules may match the client by
+	group string
 }
 
 // CheckResult contains the result of a version check
@@ -23,46 +57,424 @@ type CheckResult struct {
 	LatestVersion   Version
 	UpdateAvailable bool
 	Asset           *Asset
+	Restart         *Restart
+	// Deferred is how long the server asked to wait before taking an
+	// available update; UpdateAvailable is false meanwhile
+	Deferred time.Duration
+	// Signers are the trusted keys whose signatures over the manifest
+	// verified; empty when no keys are configured or TUF is in use
+	Signers []ed25519.PublicKey
+	// Preview describes what applying the update involves; set when an
+	// update is available
+	Preview *UpdatePreview
+	// Reason says why no update is offered, and Explanation says it to the
+	// user; both are empty when an update is available
+	Reason      NoUpdateReason
+	Explanation string
+	// InstallDir is the directory the latest release is installed in on
+	// this OS, when it declares one
+	InstallDir string
+	// RenamedTo is the name the component's releases are published under
+	// when Component is one of its former names; the manifest lists them
+	// under both
+	RenamedTo string
+}
+
+// NoUpdateReason says why a check offers no update
+type NoUpdateReason string
+
+const (
+	// NoUpdateUpToDate: the current version is the one offered
+	NoUpdateUpToDate NoUpdateReason = "up-to-date"
+	// NoUpdateDeferred: the server asked to take the update later
+	NoUpdateDeferred NoUpdateReason = "deferred"
+	// NoUpdateBlocked: the offered version is lower than the current one,
+	// or than one installed before, and downgrades aren't allowed
+	NoUpdateBlocked NoUpdateReason = "version-blocked"
+	// NoUpdateRollout: a newer version is being rolled out to other
+	// clients first
+	NoUpdateRollout NoUpdateReason = "rollout-not-selected"
+	// NoUpdateNoAsset: the newer version wasn't published for this platform
+	NoUpdateNoAsset NoUpdateReason = "platform-asset-missing"
+	// NoUpdateExcluded: the manifest offers no release of the component to
+	// this client, e.g. on its channel or with its credentials, or a
+	// targeting rule holds newer ones back from it
+	NoUpdateExcluded NoUpdateReason = "excluded"
+)
+
+// UpdatePreview describes what applying an update involves, so operators can
+// plan for it before running it
+type UpdatePreview struct {
+	// DownloadSize is the size of the asset; updates always download the
+	// full binary or archive, never a delta
+	DownloadSize int64
+	// RestartRequired is whether the component is restarted once replaced,
+	// as RestartMode describes
+	RestartRequired bool
+	RestartMode     string
+	// Hooks are the hook scripts the update archive carries
+	Hooks []string
+	// Downtime is the publisher's estimate of how long the component is
+	// unavailable while it restarts; zero when not published
+	Downtime time.Duration
+}
+
+func previewUpdate(asset *Asset, restart *Restart) *UpdatePreview {
+	preview := &UpdatePreview{
+		DownloadSize:    asset.Size,
+		RestartRequired: true,
+		RestartMode:     RestartExec,
+		Hooks:           asset.Hooks,
+	}
+	if restart != nil {
+		if restart.Mode != "" {
+			preview.RestartMode = restart.Mode
+		}
+		preview.RestartRequired = restart.Mode != RestartNone
+		preview.Downtime = time.Duration(restart.DowntimeSeconds) * time.Second
+	}
+	return preview
 }
 
 // NewChecker creates a new version checker
-func NewChecker(serverURL string, logger *slog.Logger) *Checker {
+func NewChecker(serverURL string, logger *slog.Logger, opts ...Option) *Checker {
+	o := applyOptions(opts)
+
 	return &Checker{
 		serverURL: serverURL,
 		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   30 * time.Second,
+			Transport: o.transport(),
 		},
-		logger: logger,
+		keys:    o.keys,
+		tuf:     o.tuf,
+		channel: NormalizeChannel(o.channel),
+		product: o.product,
+		logger:  logger,
+
+		installedPath:  o.installedPath,
+		allowDowngrade: o.allowDowngrade,
+		maxAge:         o.maxAge,
+		limits:         o.manifestLimits,
+
+		backoff:       o.backoff(),
+		ignoreBackoff: o.ignoreBackoff,
+
+		verified:     o.verifyCache(),
+		transparency: o.transparency(),
+		dictionary:   o.dictionary(),
+
+		machineIDPath: o.machineIDPath,
+		group:         o.group,
 	}
 }
 
 // GetManifest fetches the current version manifest from the server
 func (c *Checker) GetManifest(ctx context.Context) (*Manifest, error) {
-	url := c.serverURL + "/v1/manifest.json"
+	manifest, _, err := c.getManifest(ctx, nil)
+	return manifest, err
+}
+
+// getManifest fetches and verifies the manifest, returning the keys that
+// signed it. Only the components the client runs the current version of
+// are decoded, or all of them when none are given.
+func (c *Checker) getManifest(ctx context.Context, current map[string]Version) (*Manifest, []ed25519.PublicKey, error) {
+	if c.backoff != nil && !c.ignoreBackoff {
+		if err := c.backoff.Check(time.Now()); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	manifest, signers, err := c.fetchManifest(ctx, current)
+	if err != nil {
+		c.recordBackoff(err)
+		return nil, nil, err
+	}
+
+	// Only a verified manifest's dates can be trusted, but checking them
+	// regardless costs nothing
+	if err := manifest.CheckFresh(time.Now(), c.maxAge); err != nil {
+		return nil, nil, err
+	}
+	if len(signers) > 0 && manifest.Expires.IsZero() {
+		return nil, nil, ErrManifestNoExpiry
+	}
+
+	c.recordNextCheck(manifest)
+
+	return manifest, signers, nil
+}
+
+// recordBackoff persists the backoff a refusal from the server asks for
+func (c *Checker) recordBackoff(err error) {
+	if c.backoff == nil {
+		return
+	}
+	if err := c.backoff.Record(err); err != nil {
+		c.logger.Warn("failed to record backoff", "error", err)
+	}
+}
+
+// deferUpdate records a deferral as backoff, so the client doesn't return
+// before it has passed, unless next_check_after already holds it off longer
+func (c *Checker) deferUpdate(manifest *Manifest, deferred time.Duration) {
+	if c.backoff == nil || manifest.NextCheckAfter >= int64(deferred.Seconds()) {
+		return
+	}
+	if err := c.backoff.Wait(time.Now(), deferred, "update deferred"); err != nil {
+		c.logger.Warn("failed to record backoff", "error", err)
+	}
+}
+
+// recordNextCheck replaces any recorded backoff with the manifest's
+// next_check_after hint, so a server that recovered stops holding clients off
+func (c *Checker) recordNextCheck(manifest *Manifest) {
+	if c.backoff == nil {
+		return
+	}
+
+	var err error
+	if manifest.NextCheckAfter > 0 {
+		err = c.backoff.Wait(time.Now(), time.Duration(manifest.NextCheckAfter)*time.Second, "next_check_after")
+	} else {
+		err = c.backoff.Clear()
+	}
+	if err != nil {
+		c.logger.Warn("failed to record backoff", "error", err)
+	}
+}
+
+func (c *Checker) fetchManifest(ctx context.Context, current map[string]Version) (*Manifest, []ed25519.PublicKey, error) {
+	if c.tuf != nil {
+		if c.channel != ChannelStable {
+			return nil, nil, fmt.Errorf("channel %s is not published through TUF", c.channel)
+		}
+		if c.product != "" {
+			return nil, nil, fmt.Errorf("product %s is not published through TUF", c.product)
+		}
+		manifest, err := c.tuf.Manifest(ctx)
+		return manifest, nil, err
+	}
+
+	url := c.serverURL + ProductPath(c.product, ChannelManifestURL(c.channel))
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
+		return nil, nil, fmt.Errorf("create request: %w", err)
 	}
 
 	req.Header.Set("User-Agent", "nametag-updater/1.0")
+	c.identifyMachine(req)
+	c.describeClient(req, current)
+	dict := c.offerDictionary(req)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("fetch manifest: %w", err)
+		return nil, nil, fmt.Errorf("fetch manifest: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned status %d", resp.StatusCode)
+	if err := checkStatus(resp); err != nil {
+		return nil, nil, err
+	}
+
+	body, err := strictjson.ReadAll(resp.Body, c.limits.maxSize())
+	if err != nil {
+		return nil, nil, fmt.Errorf("read manifest: %w", err)
+	}
+	body, err = decodeContent(resp, body, dict, c.limits.maxSize())
+	if err != nil {
+		return nil, nil, fmt.Errorf("decompress manifest: %w", err)
+	}
+
+	// Verify before decoding so an untrusted manifest is never acted on
+	var signers []ed25519.PublicKey
+	if c.keys != nil {
+		if err := c.keys.Refresh(ctx, c.httpClient, c.serverURL, c.product, c.logger); err != nil {
+			return nil, nil, fmt.Errorf("refresh signing keys: %w", err)
+		}
+		signers, err = c.verifyManifest(body, resp.Header.Values(SignatureHeader))
+		if err != nil {
+			return nil, nil, fmt.Errorf("verify manifest: %w", err)
+		}
+	}
+
+	manifest, err := DecodeManifest(body, c.limits, slices.Collect(maps.Keys(current))...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode manifest: %w", err)
 	}
 
-	var manifest Manifest
-	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
-		return nil, fmt.Errorf("decode manifest: %w", err)
+	// Channels are signed with their own keys, but a client that trusts
+	// several channels' keys must still get the channel it asked for
+	if channel := NormalizeChannel(manifest.Channel); channel != c.channel {
+		return nil, nil, fmt.Errorf("%w: got %s, want %s", ErrWrongChannel, channel, c.channel)
 	}
 
-	return &manifest, nil
+	manifest.heldRollouts = parseHeldRollouts(resp.Header.Values(RolloutHeader))
+	manifest.targets = parseTargets(resp.Header.Values(TargetHeader))
+	c.refreshDictionary(ctx, resp.Header.Get(ManifestDictionaryHeader), dict)
+
+	return manifest, signers, nil
+}
+
+// identifyMachine sends the client's machine ID with req. Staged rollouts
+// only hold back updates, so failing to is logged rather than returned.
+func (c *Checker) identifyMachine(req *http.Request) {
+	if c.machineIDPath == "" {
+		return
+	}
+	id, err := LoadMachineID(c.machineIDPath)
+	if err != nil {
+		c.logger.Warn("failed to load machine ID", "error", err)
+		return
+	}
+	req.Header.Set(MachineIDHeader, id)
+}
+
+// describeClient tells the server what its targeting rules match clients
+// by: the platform, the group, and the current versions
+func (c *Checker) describeClient(req *http.Request, current map[string]Version) {
+	req.Header.Set(PlatformHeader, CurrentPlatform())
+	if c.group != "" {
+		req.Header.Set(GroupHeader, c.group)
+	}
+	for _, component := range slices.Sorted(maps.Keys(current)) {
+		req.Header.Add(CurrentVersionHeader, component+" "+current[component].String())
+	}
+}
+
+// offerDictionary asks for req's response compressed against the stored
+// manifest dictionary, returning the dictionary, or nil when there is none
+func (c *Checker) offerDictionary(req *http.Request) []byte {
+	dict := c.dictionary.load(c.limits.maxSize())
+	if dict != nil {
+		// Setting Accept-Encoding also stops the transport's transparent gzip
+		req.Header.Set("Accept-Encoding", EncodingDCZ)
+		req.Header.Set(AvailableDictionaryHeader, DictionaryHash(dict))
+	}
+	return dict
+}
+
+// refreshDictionary fetches the manifest dictionary the server offers when
+// it isn't the one stored. Compression only saves bandwidth, so failing to is
+// logged rather than returned.
+func (c *Checker) refreshDictionary(ctx context.Context, offered string, current []byte) {
+	if c.dictionary == nil || offered == "" || (current != nil && DictionaryID(current) == offered) {
+		return
+	}
+	dict, err := c.fetchDictionary(ctx, offered, current)
+	if err == nil {
+		err = c.dictionary.save(dict)
+	}
+	if err != nil {
+		c.logger.Warn("failed to update manifest dictionary", "error", err)
+	}
+}
+
+// fetchDictionary fetches the manifest dictionary with id, itself compressed
+// against the current one when there is one
+func (c *Checker) fetchDictionary(ctx context.Context, id string, current []byte) ([]byte, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 2*sha256.Size {
+		return nil, fmt.Errorf("invalid manifest dictionary id %q", id)
+	}
+
+	url := c.serverURL + ProductPath(c.product, ManifestDictionaryURL(id))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("User-Agent", "nametag-updater/1.0")
+	if current != nil {
+		req.Header.Set("Accept-Encoding", EncodingDCZ)
+		req.Header.Set(AvailableDictionaryHeader, DictionaryHash(current))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch manifest dictionary: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
+	body, err := strictjson.ReadAll(resp.Body, c.limits.maxSize())
+	if err != nil {
+		return nil, fmt.Errorf("read manifest dictionary: %w", err)
+	}
+	dict, err := decodeContent(resp, body, current, c.limits.maxSize())
+	if err != nil {
+		return nil, fmt.Errorf("decompress manifest dictionary: %w", err)
+	}
+	// Dictionaries are named by their hash, so this is all it takes to
+	// know it's the one offered
+	if DictionaryID(dict) != id {
+		return nil, fmt.Errorf("manifest dictionary doesn't match id %s", id)
+	}
+	return dict, nil
+}
+
+// verifyManifest checks the manifest's signatures against the trusted keys,
+// unless the same manifest was verified with the same keys before
+func (c *Checker) verifyManifest(body []byte, signatures []string) ([]ed25519.PublicKey, error) {
+	set := c.keys.Current()
+	id := verifyCacheID("manifest", set.fingerprint(), body, []byte(strings.Join(signatures, "\n")))
+	if cached, ok := c.verified.lookup(id, time.Now()); ok {
+		var signers []ed25519.PublicKey
+		for _, encoded := range cached {
+			key, err := ParsePublicKey(encoded)
+			if err != nil {
+				break
+			}
+			signers = append(signers, key)
+		}
+		if len(signers) == len(cached) {
+			return signers, nil
+		}
+	}
+
+	signers, err := set.VerifySigners(body, signatures)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]string, len(signers))
+	for i, key := range signers {
+		encoded[i] = EncodePublicKey(key)
+	}
+	c.verified.record(id, encoded, time.Now())
+	return signers, nil
+}
+
+// explainRollout blames a release being rolled out to other clients first
+// for no update being offered, when it is newer than the current version
+func (c *Checker) explainRollout(result *CheckResult, manifest *Manifest) {
+	for _, held := range manifest.heldRollouts {
+		v, err := ParseVersion(held.Version)
+		if held.Component != result.Component || err != nil || !result.CurrentVersion.LessThan(v) {
+			continue
+		}
+
+		result.Reason = NoUpdateRollout
+		var id string
+		if c.machineIDPath != "" {
+			id, _ = LoadMachineID(c.machineIDPath)
+		}
+		if id == "" {
+			result.Explanation = fmt.Sprintf("%s is rolling out to %g%% of clients, which this client can't be picked for without a machine ID", held.Version, held.Percent)
+		} else {
+			result.Explanation = fmt.Sprintf("%s is rolling out to %g%% of clients, and this machine (bucket %.1f) hasn't been picked yet", held.Version, held.Percent, RolloutBucket(id, held.Component, held.Version))
+		}
+		return
+	}
+}
+
+func (c *Checker) logNoUpdate(result *CheckResult) {
+	c.logger.Info("no update available",
+		"component", result.Component,
+		"current", result.CurrentVersion.String(),
+		"reason", result.Reason,
+		"explanation", result.Explanation,
+	)
 }
 
 // Check checks if an update is available for a component
@@ -72,35 +484,105 @@ func (c *Checker) Check(ctx context.Context, component string, currentVersion Ve
 		"current_version", currentVersion.String(),
 	)
 
-	manifest, err := c.GetManifest(ctx)
+	manifest, signers, err := c.getManifest(ctx, map[string]Version{component: currentVersion})
 	if err != nil {
 		return nil, fmt.Errorf("get manifest: %w", err)
 	}
 
+	result := &CheckResult{
+		Component:      component,
+		CurrentVersion: currentVersion,
+		Signers:        signers,
+	}
 	comp, ok := manifest.Components[component]
 	if !ok {
-		return nil, fmt.Errorf("component %q not found in manifest", component)
+		result.Reason = NoUpdateExcluded
+		result.Explanation = fmt.Sprintf("the server offers no release of %s to this client", component)
+		if rule := manifest.targets[component]; rule != "" {
+			result.Explanation = fmt.Sprintf("the server's targeting rule %q offers no release of %s to this client", rule, component)
+		}
+		c.explainRollout(result, manifest)
+		c.logNoUpdate(result)
+		return result, nil
+	}
+
+	if comp.Name != component {
+		result.RenamedTo = comp.Name
+		c.logger.Info("component was renamed", "component", component, "renamed_to", comp.Name)
+	}
+
+	if comp.Restart != nil {
+		if err := lintRestart(comp.Restart); err != nil {
+			return nil, fmt.Errorf("component %q restart policy: %w", component, err)
+		}
 	}
 
 	latestVersion, err := ParseVersion(comp.Version)
 	if err != nil {
 		return nil, fmt.Errorf("parse latest version: %w", err)
 	}
+	result.LatestVersion = latestVersion
+	result.Restart = comp.Restart
+	result.InstallDir = comp.InstallDir()
 
-	result := &CheckResult{
-		Component:       component,
-		CurrentVersion:  currentVersion,
-		LatestVersion:   latestVersion,
-		UpdateAvailable: currentVersion.LessThan(latestVersion),
+	updateAvailable := currentVersion.LessThan(latestVersion)
+	switch {
+	case c.allowDowngrade:
+		// Follow the server wherever it points, e.g. back from a yanked release
+		updateAvailable = latestVersion != currentVersion
+	case latestVersion.LessThan(currentVersion):
+		result.Reason = NoUpdateBlocked
+		result.Explanation = fmt.Sprintf("the server offers %s, older than this version; it may have been yanked (allow downgrades to follow it)", latestVersion)
+	case updateAvailable && c.installedPath != "":
+		// The running binary may itself be an older reinstall; a stale or
+		// malicious server must not walk it back further
+		err := CheckDowngrade(c.installedPath, component, latestVersion)
+		if errors.Is(err, ErrDowngrade) {
+			updateAvailable = false
+			result.Reason, result.Explanation = NoUpdateBlocked, err.Error()
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if !updateAvailable && result.Reason == "" {
+		result.Reason = NoUpdateUpToDate
+		result.Explanation = fmt.Sprintf("%s is the latest version", currentVersion)
+		if rule := manifest.targets[component]; rule != "" {
+			result.Reason = NoUpdateExcluded
+			result.Explanation = fmt.Sprintf("the server's targeting rule %q holds newer releases back from this client", rule)
+		}
+	}
+	if !updateAvailable {
+		c.explainRollout(result, manifest)
+	}
+
+	if updateAvailable && comp.DeferSeconds > 0 && !comp.Critical && !c.ignoreBackoff {
+		result.Deferred = time.Duration(comp.DeferSeconds) * time.Second
+		result.Reason = NoUpdateDeferred
+		result.Explanation = fmt.Sprintf("the server deferred the update to %s for %s to spread out downloads", latestVersion, result.Deferred)
+		updateAvailable = false
+		c.deferUpdate(manifest, result.Deferred)
 	}
 
-	if result.UpdateAvailable {
+	if updateAvailable {
 		platform := CurrentPlatform()
 		asset, ok := comp.Assets[platform]
 		if !ok {
-			return nil, fmt.Errorf("no asset found for platform %q", platform)
+			result.Reason = NoUpdateNoAsset
+			result.Explanation = fmt.Sprintf("%s was not published for %s", latestVersion, platform)
+			c.logNoUpdate(result)
+			return result, nil
 		}
+		if c.transparency != nil {
+			leaf := LogLeaf{Component: component, Version: comp.Version, Platform: platform, SHA256: asset.SHA256}
+			if err := c.transparency.Verify(ctx, c.httpClient, c.serverURL, c.product, c.keys, leaf); err != nil {
+				return nil, fmt.Errorf("transparency log: %w", err)
+			}
+			c.logger.Info("asset is in the transparency log", "component", component, "version", comp.Version)
+		}
+		result.UpdateAvailable = true
 		result.Asset = &asset
+		result.Preview = previewUpdate(&asset, comp.Restart)
 
 		c.logger.Info("update available",
 			"component", component,
@@ -108,10 +590,7 @@ func (c *Checker) Check(ctx context.Context, component string, currentVersion Ve
 			"latest", latestVersion.String(),
 		)
 	} else {
-		c.logger.Info("no update available",
-			"component", component,
-			"current", currentVersion.String(),
-		)
+		c.logNoUpdate(result)
 	}
 
 	return result, nil
@@ -0,0 +1,86 @@
+package update
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ChecksumsFile is the name of the sha256sum-style file in a component
+// version's directory that records the hashes its assets were published with
+const ChecksumsFile = "SHA256SUMS"
+
+// ReadChecksums parses a sha256sum-style file into a filename to hash map
+func ReadChecksums(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open checksums: %w", err)
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		sums[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read checksums: %w", err)
+	}
+
+	return sums, nil
+}
+
+// WriteChecksums writes sums to path in sha256sum format, sorted by filename,
+// replacing the file atomically
+func WriteChecksums(path string, sums map[string]string) error {
+	var b strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(sums)) {
+		fmt.Fprintf(&b, "%s  %s\n", sums[name], name)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".checksums-*")
+	if err != nil {
+		return fmt.Errorf("create checksums: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write checksums: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write checksums: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("write checksums: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replace checksums: %w", err)
+	}
+	return nil
+}
+
+// RecordChecksum adds or updates one entry of the checksums file in dir
+func RecordChecksum(dir, filename, hash string) error {
+	path := filepath.Join(dir, ChecksumsFile)
+
+	sums, err := ReadChecksums(path)
+	if errors.Is(err, os.ErrNotExist) {
+		sums = make(map[string]string)
+	} else if err != nil {
+		return err
+	}
+
+	sums[filename] = hash
+	return WriteChecksums(path, sums)
+}
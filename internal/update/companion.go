@@ -0,0 +1,379 @@
+package update
+
+import (
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// CompanionsFile is the name of the index an update archive may carry, at
+// any depth, listing the companion files installed along with the binary:
+// shell completions, man pages, and default configs
+const CompanionsFile = "companions.json"
+
+// CompanionStateFile is the name of the client state file recording the
+// companion files each component's last update installed, with their hashes
+const CompanionStateFile = "companion-files.json"
+
+// Kinds of companion files, which decide where they are installed
+const (
+	CompanionBash       = "bash-completion"
+	CompanionZsh        = "zsh-completion"
+	CompanionFish       = "fish-completion"
+	CompanionPowerShell = "powershell-completion"
+	CompanionMan        = "man"
+	CompanionConfig     = "config"
+)
+
+// ErrCompanionUnsupported is returned for a companion file kind that has no
+// place on this platform, such as a man page on Windows
+var ErrCompanionUnsupported = errors.New("companion file kind not supported on this platform")
+
+// CompanionFile is an entry of an archive's companions index
+type CompanionFile struct {
+	// Path is the file's path in the archive, relative to the index
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	SHA256 string `json:"sha256"`
+}
+
+type companionIndex struct {
+	Files []CompanionFile `json:"files"`
+}
+
+// ExtractedCompanion is a companion file taken from an update archive, its
+// hash checked against the index
+type ExtractedCompanion struct {
+	CompanionFile
+	Extracted string
+}
+
+// Name returns the file name the companion is installed under
+func (c CompanionFile) Name() string {
+	return path.Base(c.Path)
+}
+
+func (c CompanionFile) validate() error {
+	switch c.Kind {
+	case CompanionBash, CompanionZsh, CompanionFish, CompanionPowerShell, CompanionMan, CompanionConfig:
+	default:
+		return fmt.Errorf("companion %s: unknown kind %q", c.Path, c.Kind)
+	}
+	clean := path.Clean(c.Path)
+	if c.Path == "" || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("companion %q: path must be relative to %s", c.Path, CompanionsFile)
+	}
+	if c.Kind == CompanionMan && len(path.Ext(clean)) < 2 {
+		return fmt.Errorf("companion %s: man page has no section extension", c.Path)
+	}
+	if sum, err := hex.DecodeString(c.SHA256); err != nil || len(sum) != 32 {
+		return fmt.Errorf("companion %s: sha256 must be 64 hex digits", c.Path)
+	}
+	return nil
+}
+
+// readCompanionIndex returns the companion files the archive's index lists,
+// keyed by their cleaned path in the archive; an archive without an index
+// has none
+func readCompanionIndex(r io.ReaderAt, size int64, format string) ([]CompanionFile, map[string]int, error) {
+	var (
+		files []CompanionFile
+		dir   string
+		found bool
+	)
+	err := walkArchive(r, size, format, func(name string, r io.Reader) error {
+		if found || path.Base(name) != CompanionsFile {
+			return nil
+		}
+		found = true
+		var index companionIndex
+		if err := json.NewDecoder(io.LimitReader(r, 1<<20)).Decode(&index); err != nil {
+			return fmt.Errorf("decode %s: %w", CompanionsFile, err)
+		}
+		files, dir = index.Files, path.Dir(name)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	paths := make(map[string]int)
+	for i, f := range files {
+		if err := f.validate(); err != nil {
+			return nil, nil, err
+		}
+		key := path.Clean(path.Join(dir, f.Path))
+		if _, ok := paths[key]; ok {
+			return nil, nil, fmt.Errorf("companion %s listed twice", f.Path)
+		}
+		paths[key] = i
+	}
+	return files, paths, nil
+}
+
+// WriteCompanionIndex writes the companions index listing files to path,
+// for packing into an update archive along with them
+func WriteCompanionIndex(path string, files []CompanionFile) error {
+	for _, f := range files {
+		if err := f.validate(); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(companionIndex{Files: files}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", CompanionsFile, err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", CompanionsFile, err)
+	}
+	return nil
+}
+
+// writeCompanion extracts companion c to dest, checking it against the hash
+// the index lists
+func writeCompanion(dest string, r io.Reader, c CompanionFile) error {
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("create companion %s: %w", c.Path, err)
+	}
+	digests, err := ReaderDigests(io.TeeReader(r, f), HashSHA256)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("extract companion %s: %w", c.Path, err)
+	}
+	if err := MatchDigests(map[string]string{HashSHA256: c.SHA256}, digests); err != nil {
+		return fmt.Errorf("companion %s: checksum mismatch: %w", c.Path, err)
+	}
+	return nil
+}
+
+// CompanionPath returns where a companion file of kind named name is
+// installed for the current user on this platform
+func CompanionPath(kind, name string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dataHome := cmp.Or(os.Getenv("XDG_DATA_HOME"), filepath.Join(home, ".local", "share"))
+	configHome := cmp.Or(os.Getenv("XDG_CONFIG_HOME"), filepath.Join(home, ".config"))
+
+	if kind == CompanionConfig {
+		// Where the config the clients load by default lives
+		return filepath.Join(configDir, "nametag", name), nil
+	}
+	if runtime.GOOS == "windows" {
+		if kind == CompanionPowerShell {
+			return filepath.Join(configDir, "nametag", "completions", name), nil
+		}
+		return "", ErrCompanionUnsupported
+	}
+	switch kind {
+	case CompanionBash:
+		return filepath.Join(dataHome, "bash-completion", "completions", name), nil
+	case CompanionZsh:
+		return filepath.Join(dataHome, "zsh", "site-functions", name), nil
+	case CompanionFish:
+		return filepath.Join(configHome, "fish", "completions", name), nil
+	case CompanionMan:
+		return filepath.Join(dataHome, "man", "man"+strings.TrimPrefix(filepath.Ext(name), "."), name), nil
+	}
+	return "", ErrCompanionUnsupported
+}
+
+// CompanionInstall is the companion files an update installed, which
+// Rollback removes again, restoring the files they replaced, until Commit
+type CompanionInstall struct {
+	// Installed are the hashes of the files in place, by path
+	Installed map[string]string
+	// Kept are configs left alone because they were changed locally, and
+	// Unsupported the files with no place on this platform
+	Kept        []string
+	Unsupported []string
+
+	// backups are the files replaced, by the path they were at; "" when
+	// there was none
+	backups map[string]string
+	// stale are files the previous update installed that this one no
+	// longer ships, with the hashes they were installed with
+	stale map[string]string
+}
+
+// InstallCompanions puts extracted companion files in place. previous are
+// the files the component's last update installed, with their hashes: a
+// config is only replaced while it is unchanged since, and the files no
+// longer shipped are removed on Commit unless they were changed. On error
+// nothing is left changed.
+func InstallCompanions(companions []ExtractedCompanion, previous map[string]string) (*CompanionInstall, error) {
+	install := &CompanionInstall{
+		Installed: make(map[string]string),
+		backups:   make(map[string]string),
+		stale:     maps.Clone(previous),
+	}
+	for _, c := range companions {
+		dest, err := CompanionPath(c.Kind, c.Name())
+		if errors.Is(err, ErrCompanionUnsupported) {
+			install.Unsupported = append(install.Unsupported, c.Path)
+			continue
+		}
+		if err != nil {
+			install.Rollback()
+			return nil, fmt.Errorf("locate companion %s: %w", c.Path, err)
+		}
+		delete(install.stale, dest)
+
+		current, err := FileSHA256(dest)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			install.Rollback()
+			return nil, fmt.Errorf("read %s: %w", dest, err)
+		}
+		if strings.EqualFold(current, c.SHA256) {
+			install.Installed[dest] = c.SHA256
+			continue
+		}
+		if c.Kind == CompanionConfig && current != "" && current != previous[dest] {
+			install.Kept = append(install.Kept, dest)
+			continue
+		}
+
+		if err := install.put(dest, c.Extracted, current != ""); err != nil {
+			install.Rollback()
+			return nil, fmt.Errorf("install companion %s: %w", c.Path, err)
+		}
+		install.Installed[dest] = strings.ToLower(c.SHA256)
+	}
+	return install, nil
+}
+
+// put copies src to dest, moving a file already there aside
+func (i *CompanionInstall) put(dest, src string, exists bool) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	os.Remove(tmp) // left by an interrupted update
+	if err := copyFile(src, tmp, 0644); err != nil {
+		return err
+	}
+
+	backup := ""
+	if exists {
+		backup = dest + ".old"
+		if err := os.Rename(dest, backup); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		if backup != "" {
+			os.Rename(backup, dest)
+		}
+		return err
+	}
+	i.backups[dest] = backup
+	return nil
+}
+
+// Rollback removes the files installed and restores the ones they replaced
+func (i *CompanionInstall) Rollback() error {
+	var errs []error
+	for dest, backup := range i.backups {
+		if backup == "" {
+			if err := os.Remove(dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err := os.Rename(backup, dest); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	clear(i.backups)
+	return errors.Join(errs...)
+}
+
+// Commit drops the replaced files and removes the stale ones still as they
+// were installed
+func (i *CompanionInstall) Commit() error {
+	var errs []error
+	for _, backup := range i.backups {
+		if backup != "" {
+			if err := os.Remove(backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	clear(i.backups)
+	for dest, sum := range i.stale {
+		if current, err := FileSHA256(dest); err == nil && strings.EqualFold(current, sum) {
+			if err := os.Remove(dest); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReadCompanionState returns the companion files component's last update
+// installed, with their hashes, from the state file at path
+func ReadCompanionState(path, component string) (map[string]string, error) {
+	state, err := readCompanionState(path)
+	if err != nil {
+		return nil, err
+	}
+	return state[component], nil
+}
+
+// RecordCompanionState records the companion files component's update
+// installed in the state file at path
+func RecordCompanionState(path, component string, installed map[string]string) error {
+	state, err := readCompanionState(path)
+	if err != nil {
+		return err
+	}
+	state[component] = installed
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode companion state: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write companion state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write companion state: %w", err)
+	}
+	return nil
+}
+
+func readCompanionState(path string) (map[string]map[string]string, error) {
+	state := make(map[string]map[string]string)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read companion state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("decode companion state: %w", err)
+	}
+	return state, nil
+}
@@ -0,0 +1,309 @@
+package update
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// companionIndexEntry returns an archive entry holding a companions index
+// listing files
+func companionIndexEntry(t *testing.T, name string, files ...CompanionFile) archiveEntry {
+	t.Helper()
+	data, err := json.Marshal(companionIndex{Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archiveEntry{name: name, body: string(data)}
+}
+
+func TestExtractArchiveCompanions(t *testing.T) {
+	for _, format := range []string{FormatTarGz, FormatZip} {
+		t.Run(format, func(t *testing.T) {
+			archive := writeArchive(t, format,
+				archiveEntry{name: "dist/nametag", body: "binary"},
+				companionIndexEntry(t, "dist/"+CompanionsFile,
+					CompanionFile{Path: "completions/nametag", Kind: CompanionBash, SHA256: sha256Hex("bash")},
+					// Same name, another kind
+					CompanionFile{Path: "./completions/zsh/nametag", Kind: CompanionZsh, SHA256: strings.ToUpper(sha256Hex("zsh"))},
+					CompanionFile{Path: "man/nametag.1", Kind: CompanionMan, SHA256: sha256Hex("man")},
+				),
+				archiveEntry{name: "dist/completions/nametag", body: "bash"},
+				archiveEntry{name: "dist/completions/zsh/nametag", body: "zsh"},
+				archiveEntry{name: "dist/man/nametag.1", body: "man"},
+				// Not listed, so not extracted
+				archiveEntry{name: "dist/completions/nametag.fish", body: "fish"},
+			)
+			dest := t.TempDir()
+
+			got, err := ExtractArchive(archive, format, dest, "nametag", ".sh")
+			if err != nil {
+				t.Fatalf("ExtractArchive() = %v", err)
+			}
+			if readFile(t, got.Binary) != "binary" {
+				t.Errorf("binary holds %q", readFile(t, got.Binary))
+			}
+			if len(got.Companions) != 3 {
+				t.Fatalf("%d companions, want 3", len(got.Companions))
+			}
+			for _, c := range got.Companions {
+				if filepath.Dir(c.Extracted) != dest {
+					t.Errorf("companion %s extracted to %s, outside %s", c.Path, c.Extracted, dest)
+				}
+				if want := map[string]string{CompanionBash: "bash", CompanionZsh: "zsh", CompanionMan: "man"}[c.Kind]; readFile(t, c.Extracted) != want {
+					t.Errorf("companion %s holds %q, want %q", c.Path, readFile(t, c.Extracted), want)
+				}
+			}
+			if entries, _ := os.ReadDir(dest); len(entries) != 4 {
+				t.Errorf("extracted %d files, want the binary and 3 companions", len(entries))
+			}
+		})
+	}
+}
+
+func TestExtractArchiveCompanionErrors(t *testing.T) {
+	bash := CompanionFile{Path: "nametag.bash", Kind: CompanionBash, SHA256: sha256Hex("bash")}
+	withPath := func(path string) CompanionFile {
+		c := bash
+		c.Path = path
+		return c
+	}
+	withKind := func(kind string) CompanionFile {
+		c := bash
+		c.Kind = kind
+		return c
+	}
+
+	for _, tt := range []struct {
+		name    string
+		files   []CompanionFile
+		body    string
+		wantErr string
+	}{
+		{"checksum mismatch", []CompanionFile{bash}, "tampered", "checksum mismatch"},
+		{"missing", []CompanionFile{withPath("other.bash")}, "bash", "does not contain companion other.bash"},
+		{"escaping path", []CompanionFile{withPath("../nametag.bash")}, "bash", "must be relative"},
+		{"absolute path", []CompanionFile{withPath("/etc/nametag.bash")}, "bash", "must be relative"},
+		{"unknown kind", []CompanionFile{withKind("plugin")}, "bash", "unknown kind"},
+		{"man page without section", []CompanionFile{{Path: "man/nametag", Kind: CompanionMan, SHA256: sha256Hex("bash")}}, "bash", "no section"},
+		{"bad hash", []CompanionFile{{Path: "nametag.bash", Kind: CompanionBash, SHA256: "abc"}}, "bash", "64 hex digits"},
+		{"listed twice", []CompanionFile{bash, withPath("./nametag.bash")}, "bash", "listed twice"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := writeArchive(t, FormatTarGz,
+				archiveEntry{name: "nametag", body: "binary"},
+				companionIndexEntry(t, CompanionsFile, tt.files...),
+				archiveEntry{name: "nametag.bash", body: tt.body},
+			)
+			_, err := ExtractArchive(archive, FormatTarGz, t.TempDir(), "nametag", ".sh")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ExtractArchive() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteCompanionIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), CompanionsFile)
+	files := []CompanionFile{{Path: "nametag.1", Kind: CompanionMan, SHA256: sha256Hex("man")}}
+	if err := WriteCompanionIndex(path, files); err != nil {
+		t.Fatalf("WriteCompanionIndex() = %v", err)
+	}
+	archive := writeArchive(t, FormatZip,
+		archiveEntry{name: "nametag", body: "binary"},
+		archiveEntry{name: CompanionsFile, body: readFile(t, path)},
+		archiveEntry{name: "nametag.1", body: "man"},
+	)
+	if got, err := ExtractArchive(archive, FormatZip, t.TempDir(), "nametag", ".sh"); err != nil || len(got.Companions) != 1 {
+		t.Fatalf("ExtractArchive() of a written index = %v", err)
+	}
+
+	files[0].Path = "../nametag.1"
+	if err := WriteCompanionIndex(path, files); err == nil {
+		t.Error("WriteCompanionIndex() wrote an escaping path")
+	}
+}
+
+// companionHome points the companion locations at a fresh home directory
+func companionHome(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("completions and man pages have no place on Windows")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_DATA_HOME", filepath.Join(home, "data"))
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+}
+
+// extracted returns a companion of kind named name holding content, as
+// ExtractArchive leaves it
+func extracted(t *testing.T, kind, name, content string) ExtractedCompanion {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(src, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ExtractedCompanion{CompanionFile: CompanionFile{Path: name, Kind: kind, SHA256: sha256Hex(content)}, Extracted: src}
+}
+
+func companionPath(t *testing.T, kind, name string) string {
+	t.Helper()
+	dest, err := CompanionPath(kind, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dest
+}
+
+func TestInstallCompanions(t *testing.T) {
+	companionHome(t)
+	bash := companionPath(t, CompanionBash, "nametag")
+	fish := companionPath(t, CompanionFish, "nametag.fish")
+	config := companionPath(t, CompanionConfig, "nametag.toml")
+
+	first, err := InstallCompanions([]ExtractedCompanion{
+		extracted(t, CompanionBash, "nametag", "bash v1"),
+		extracted(t, CompanionFish, "nametag.fish", "fish v1"),
+		extracted(t, CompanionConfig, "nametag.toml", "config v1"),
+	}, nil)
+	if err != nil {
+		t.Fatalf("InstallCompanions() = %v", err)
+	}
+	if err := first.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if readFile(t, bash) != "bash v1" || readFile(t, fish) != "fish v1" || readFile(t, config) != "config v1" {
+		t.Fatal("first update didn't install its companions")
+	}
+
+	// The user edits the config; the next update drops the fish completion
+	if err := os.WriteFile(config, []byte("config edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	second, err := InstallCompanions([]ExtractedCompanion{
+		extracted(t, CompanionBash, "nametag", "bash v2"),
+		extracted(t, CompanionConfig, "nametag.toml", "config v2"),
+	}, first.Installed)
+	if err != nil {
+		t.Fatalf("InstallCompanions() = %v", err)
+	}
+	if !slices.Equal(second.Kept, []string{config}) {
+		t.Errorf("kept %v, want the edited config", second.Kept)
+	}
+	if _, err := os.Stat(fish); err != nil {
+		t.Errorf("stale completion removed before Commit: %v", err)
+	}
+	if err := second.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if readFile(t, bash) != "bash v2" || readFile(t, config) != "config edited" {
+		t.Errorf("after update: bash %q, config %q", readFile(t, bash), readFile(t, config))
+	}
+	if _, err := os.Stat(fish); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stale completion left after Commit: %v", err)
+	}
+	if _, err := os.Stat(bash + ".old"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("backup left after Commit: %v", err)
+	}
+	if _, ok := second.Installed[config]; ok {
+		t.Error("the kept config is recorded as installed")
+	}
+}
+
+func TestInstallCompanionsUnchangedConfig(t *testing.T) {
+	companionHome(t)
+	config := companionPath(t, CompanionConfig, "nametag.toml")
+	first, err := InstallCompanions([]ExtractedCompanion{extracted(t, CompanionConfig, "nametag.toml", "config v1")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Commit()
+
+	second, err := InstallCompanions([]ExtractedCompanion{extracted(t, CompanionConfig, "nametag.toml", "config v2")}, first.Installed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Commit()
+	if readFile(t, config) != "config v2" || len(second.Kept) != 0 {
+		t.Errorf("config %q, kept %v: an untouched config should be replaced", readFile(t, config), second.Kept)
+	}
+
+	// A config the updates never installed is the user's own
+	if err := os.WriteFile(config, []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	third, err := InstallCompanions([]ExtractedCompanion{extracted(t, CompanionConfig, "nametag.toml", "config v3")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.Commit()
+	if readFile(t, config) != "mine" {
+		t.Errorf("config %q, want the user's own kept", readFile(t, config))
+	}
+}
+
+func TestInstallCompanionsRollback(t *testing.T) {
+	companionHome(t)
+	bash := companionPath(t, CompanionBash, "nametag")
+	zsh := companionPath(t, CompanionZsh, "_nametag")
+	if err := os.MkdirAll(filepath.Dir(bash), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bash, []byte("bash v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	install, err := InstallCompanions([]ExtractedCompanion{
+		extracted(t, CompanionBash, "nametag", "bash v2"),
+		extracted(t, CompanionZsh, "_nametag", "zsh v2"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readFile(t, bash) != "bash v2" {
+		t.Fatalf("bash %q before rollback, want v2", readFile(t, bash))
+	}
+	if err := install.Rollback(); err != nil {
+		t.Fatalf("Rollback() = %v", err)
+	}
+
+	if readFile(t, bash) != "bash v1" {
+		t.Errorf("bash %q after rollback, want v1 restored", readFile(t, bash))
+	}
+	if _, err := os.Stat(zsh); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("new completion left after rollback: %v", err)
+	}
+}
+
+func TestCompanionState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), CompanionStateFile)
+	if got, err := ReadCompanionState(path, "nametag"); err != nil || got != nil {
+		t.Fatalf("ReadCompanionState() without a state file = %v, %v", got, err)
+	}
+
+	installed := map[string]string{"/home/u/.config/nametag/nametag.toml": sha256Hex("config")}
+	if err := RecordCompanionState(path, "nametag", installed); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordCompanionState(path, "nametag-launcher", map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadCompanionState(path, "nametag")
+	if err != nil || len(got) != 1 || got["/home/u/.config/nametag/nametag.toml"] != sha256Hex("config") {
+		t.Fatalf("ReadCompanionState() = %v, %v, want what was recorded", got, err)
+	}
+}
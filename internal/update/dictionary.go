@@ -0,0 +1,204 @@
+package update
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Manifests are served compressed against a dictionary the client already
+// holds, following HTTP compression dictionary transport (RFC 9842). The
+// dictionary is the manifest itself, minus the timestamps every response
+// changes, so a manifest that didn't change otherwise compresses to a few
+// dozen bytes.
+
+// ManifestDictionaryFile is the name of the file in the state directory
+// holding the manifest dictionary
+const ManifestDictionaryFile = "manifest-dictionary.json"
+
+const (
+	// EncodingDCZ is the content encoding of dictionary-compressed
+	// Zstandard
+	EncodingDCZ = "dcz"
+	// AvailableDictionaryHeader names the hash of the dictionary a client
+	// holds
+	AvailableDictionaryHeader = "Available-Dictionary"
+	// ManifestDictionaryHeader carries the ID of the dictionary the server
+	// offers for the manifest served
+	ManifestDictionaryHeader = "X-Nametag-Manifest-Dictionary"
+)
+
+// dczMaxWindow is the largest window a dcz frame may use (RFC 9842)
+const dczMaxWindow = 8 << 20
+
+// dczMagic starts a dcz body: a skippable frame header for the 32-byte
+// dictionary hash that follows
+var dczMagic = []byte{0x5e, 0x2a, 0x4d, 0x18, 0x20, 0x00, 0x00, 0x00}
+
+// ManifestDictionaryURL returns the server path of the manifest dictionary
+// with id
+func ManifestDictionaryURL(id string) string {
+	return "/v1/manifest-dictionary/" + id
+}
+
+// ManifestDictionary returns the dictionary for manifest: its JSON encoding
+// without the generated and expires times
+func ManifestDictionary(manifest *Manifest) ([]byte, error) {
+	content := *manifest
+	content.Generated, content.Expires = time.Time{}, time.Time{}
+	return json.Marshal(&content)
+}
+
+// DictionaryID returns the ID of dict the server names it by: its hex
+// SHA-256
+func DictionaryID(dict []byte) string {
+	sum := sha256.Sum256(dict)
+	return hex.EncodeToString(sum[:])
+}
+
+// DictionaryHash returns dict's SHA-256 as the Available-Dictionary header
+// carries it
+func DictionaryHash(dict []byte) string {
+	sum := sha256.Sum256(dict)
+	return ":" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+// ParseDictionaryHash returns the SHA-256 in an Available-Dictionary header
+func ParseDictionaryHash(value string) ([sha256.Size]byte, bool) {
+	encoded, ok := strings.CutPrefix(value, ":")
+	if encoded, ok = strings.CutSuffix(encoded, ":"); !ok {
+		return [sha256.Size]byte{}, false
+	}
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sum) != sha256.Size {
+		return [sha256.Size]byte{}, false
+	}
+	return [sha256.Size]byte(sum), true
+}
+
+// CompressDCZ encodes data as dcz against dict
+func CompressDCZ(data, dict []byte) ([]byte, error) {
+	// A raw content dictionary, named by the dcz header rather than an ID
+	// in the frame. The window only needs to span the dictionary and the
+	// manifest, and sizes what the encoder allocates.
+	window := zstd.MinWindowSize
+	for window < len(dict)+len(data) && window < dczMaxWindow {
+		window <<= 1
+	}
+	enc, err := zstd.NewWriter(nil,
+		zstd.WithEncoderDictRaw(0, dict),
+		zstd.WithWindowSize(window),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithLowerEncoderMem(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create zstd encoder: %w", err)
+	}
+	defer enc.Close()
+
+	sum := sha256.Sum256(dict)
+	out := append(bytes.Clone(dczMagic), sum[:]...)
+	return enc.EncodeAll(data, out), nil
+}
+
+// DecompressDCZ decodes a dcz body compressed against dict, refusing content
+// over maxSize bytes
+func DecompressDCZ(data, dict []byte, maxSize int) ([]byte, error) {
+	if len(data) < len(dczMagic)+sha256.Size || !bytes.Equal(data[:len(dczMagic)], dczMagic) {
+		return nil, errors.New("not a dcz body")
+	}
+	sum := sha256.Sum256(dict)
+	if !bytes.Equal(data[len(dczMagic):len(dczMagic)+sha256.Size], sum[:]) {
+		return nil, errors.New("dcz body compressed against another dictionary")
+	}
+
+	dec, err := zstd.NewReader(nil,
+		zstd.WithDecoderDictRaw(0, dict),
+		zstd.WithDecoderMaxWindow(dczMaxWindow),
+		zstd.WithDecoderMaxMemory(uint64(max(maxSize, 1))),
+		zstd.WithDecoderConcurrency(1),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create zstd decoder: %w", err)
+	}
+	defer dec.Close()
+
+	content, err := dec.DecodeAll(data[len(dczMagic)+sha256.Size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decode dcz body: %w", err)
+	}
+	if len(content) > maxSize {
+		return nil, fmt.Errorf("decode dcz body: %w", zstd.ErrDecoderSizeExceeded)
+	}
+	return content, nil
+}
+
+// decodeContent undoes the content encoding of a response body, which is
+// dcz against dict when the client offered it
+func decodeContent(resp *http.Response, body, dict []byte, maxSize int) ([]byte, error) {
+	switch encoding := resp.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+		return body, nil
+	case EncodingDCZ:
+		if dict == nil {
+			return nil, errors.New("dcz body without a dictionary offered")
+		}
+		return DecompressDCZ(body, dict, maxSize)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// dictionaryStore keeps the client's manifest dictionary in a file. A nil
+// store keeps none.
+type dictionaryStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// load returns the stored dictionary, or nil when there is none or it is
+// larger than maxSize
+func (s *dictionaryStore) load(maxSize int) []byte {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil || len(data) > maxSize {
+		return nil
+	}
+	return data
+}
+
+// save replaces the stored dictionary
+func (s *dictionaryStore) save(dict []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, dict, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("save manifest dictionary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package update
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// dictionaryManifest returns a manifest of n components at patch level
+// patch, encoded as servers serve it
+func dictionaryManifest(t testing.TB, n, patch int) []byte {
+	manifest := &Manifest{SchemaVersion: SchemaVersion, Generated: time.Unix(0, 0).UTC(), Components: map[string]Component{}}
+	for i := range n {
+		name := fmt.Sprintf("component-%d", i)
+		version := fmt.Sprintf("1.%d.%d", i, patch)
+		comp := Component{Name: name, Version: version, Assets: map[string]Asset{}}
+		for _, plat := range []string{"linux-amd64", "linux-arm64", "darwin-arm64", "windows-amd64"} {
+			sum := sha256.Sum256([]byte(name + plat + version))
+			comp.Assets[plat] = Asset{URL: "/v1/download/" + name + "/" + plat + "/" + version, Size: int64(1<<20 + i), SHA256: fmt.Sprintf("%x", sum)}
+		}
+		manifest.Components[name] = comp
+	}
+	dict, err := ManifestDictionary(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dict
+}
+
+func TestDCZRoundTrip(t *testing.T) {
+	dict := dictionaryManifest(t, 20, 0)
+	// One component moved on since the client's dictionary
+	changed := dictionaryManifest(t, 20, 0)
+	changed = bytes.Replace(changed, []byte(`"version":"1.3.0"`), []byte(`"version":"1.3.1"`), 1)
+
+	tests := []struct {
+		name string
+		data []byte
+		dict []byte
+		// maxRatio bounds the compressed size relative to data's
+		maxRatio float64
+	}{
+		{"unchanged", dict, dict, 0.02},
+		{"one change", changed, dict, 0.1},
+		{"empty", []byte{}, dict, 0},
+		{"unrelated dictionary", changed, []byte("nothing like it"), 1},
+		{"empty dictionary", changed, []byte{}, 1},
+		{"larger than a block", bytes.Repeat(changed, 64), dict, 0.05},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed, err := CompressDCZ(tt.data, tt.dict)
+			if err != nil {
+				t.Fatalf("CompressDCZ() = %v", err)
+			}
+			if tt.maxRatio > 0 {
+				if ratio := float64(len(compressed)) / float64(len(tt.data)); ratio > tt.maxRatio {
+					t.Errorf("compressed %d bytes to %d, ratio %.3f over %.3f", len(tt.data), len(compressed), ratio, tt.maxRatio)
+				}
+			}
+			got, err := DecompressDCZ(compressed, tt.dict, len(tt.data))
+			if err != nil {
+				t.Fatalf("DecompressDCZ() = %v", err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Fatalf("round trip changed %d bytes into %d", len(tt.data), len(got))
+			}
+		})
+	}
+}
+
+func TestDecompressDCZRejects(t *testing.T) {
+	dict := dictionaryManifest(t, 20, 0)
+	data := dictionaryManifest(t, 20, 1)
+	compressed, err := CompressDCZ(data, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The frame itself, as a body compressed against another dictionary
+	// would carry it
+	other := append(bytes.Clone(compressed[:len(dczMagic)]), make([]byte, sha256.Size)...)
+	other = append(other, compressed[len(dczMagic)+sha256.Size:]...)
+
+	tests := []struct {
+		name    string
+		body    []byte
+		dict    []byte
+		maxSize int
+		wantErr error
+	}{
+		{"over the size limit", compressed, dict, len(data) - 1, zstd.ErrDecoderSizeExceeded},
+		{"other dictionary", compressed, dictionaryManifest(t, 20, 2), len(data), errAny},
+		{"hash of another dictionary", other, dict, len(data), errAny},
+		{"no dcz header", compressed[len(dczMagic)+sha256.Size:], dict, len(data), errAny},
+		{"truncated", compressed[:len(compressed)-4], dict, len(data), errAny},
+		{"corrupt frame", append(bytes.Clone(compressed[:len(compressed)-8]), bytes.Repeat([]byte{0xff}, 8)...), dict, len(data), errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecompressDCZ(tt.body, tt.dict, tt.maxSize)
+			checkErr(t, err, tt.wantErr)
+		})
+	}
+}
+
+// TestDCZInterop checks that dcz bodies are frames the reference zstd CLI
+// decodes with the raw dictionary, and that it can decode the CLI's
+func TestDCZInterop(t *testing.T) {
+	cli, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd CLI not installed")
+	}
+	dir := t.TempDir()
+	dict := dictionaryManifest(t, 20, 0)
+	data := dictionaryManifest(t, 20, 1)
+	dictPath := filepath.Join(dir, "dict")
+	if err := os.WriteFile(dictPath, dict, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	compressed, err := CompressDCZ(data, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 9842 names the dictionary by its hash, not by an ID in the frame
+	frame := compressed[len(dczMagic)+sha256.Size:]
+	if descriptor := frame[4]; descriptor&0x3 != 0 {
+		t.Errorf("frame header descriptor %#x carries a dictionary ID", descriptor)
+	}
+	out, err := exec.Command(cli, "-d", "-q", "-c", "-D", dictPath, "--", writeTemp(t, dir, "ours.zst", frame)).Output()
+	if err != nil {
+		t.Fatalf("zstd -d = %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("zstd decoded %d bytes, not the %d compressed", len(out), len(data))
+	}
+
+	for _, level := range []string{"-1", "-19"} {
+		t.Run("zstd "+level, func(t *testing.T) {
+			theirs, err := exec.Command(cli, level, "-q", "-c", "--no-dictID", "-D", dictPath, "--", writeTemp(t, dir, "data", data)).Output()
+			if err != nil {
+				t.Fatalf("zstd %s = %v", level, err)
+			}
+			sum := sha256.Sum256(dict)
+			body := append(append(bytes.Clone(dczMagic), sum[:]...), theirs...)
+			got, err := DecompressDCZ(body, dict, len(data))
+			if err != nil {
+				t.Fatalf("DecompressDCZ() = %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decoded %d bytes, not the %d zstd compressed", len(got), len(data))
+			}
+		})
+	}
+}
+
+func writeTemp(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func FuzzDecompressDCZ(f *testing.F) {
+	dict := dictionaryManifest(f, 5, 0)
+	for _, patch := range []int{0, 1} {
+		body, err := CompressDCZ(dictionaryManifest(f, 5, patch), dict)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(body)
+	}
+	f.Add(append(bytes.Clone(dczMagic), make([]byte, sha256.Size)...))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		// A forged hash reaches the frame decoder
+		if len(body) >= len(dczMagic)+sha256.Size && bytes.HasPrefix(body, dczMagic) {
+			sum := sha256.Sum256(dict)
+			body = append(append(bytes.Clone(dczMagic), sum[:]...), body[len(dczMagic)+sha256.Size:]...)
+		}
+		const maxSize = 64 << 10
+		out, err := DecompressDCZ(body, dict, maxSize)
+		if err == nil && len(out) > maxSize {
+			t.Fatalf("decompressed %d bytes, limit %d", len(out), maxSize)
+		}
+	})
+}
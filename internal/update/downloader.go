@@ -4,11 +4,14 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,7 +21,20 @@ type ProgressFunc func(downloaded, total int64)
 // Downloader handles downloading update files
 type Downloader struct {
 	httpClient *http.Client
+	keys       *TrustedKeys
+	gpgKeyring string
 	logger     *slog.Logger
+
+	// licenseToken is exchanged for the content keys of private assets
+	licenseToken string
+	// provenance is what assets' SLSA provenance must attest to
+	provenance *ProvenancePolicy
+
+	// backoff records refusals; only the Checker enforces them, since every
+	// download follows a check
+	backoff *Backoff
+	// verified remembers assets whose signatures verified
+	verified *VerifyCache
 }
 
 // DownloadResult contains the downloaded file information
@@ -26,112 +42,431 @@ type DownloadResult struct {
 	Path   string
 	Size   int64
 	SHA256 string
+	// Hashes holds every supported digest by algorithm, SHA256 included
+	Hashes map[string]string
 }
 
 // NewDownloader creates a new downloader
-func NewDownloader(logger *slog.Logger) *Downloader {
+func NewDownloader(logger *slog.Logger, opts ...Option) *Downloader {
+	o := applyOptions(opts)
+
 	return &Downloader{
 		httpClient: &http.Client{
-			Timeout: 10 * time.Minute,
+			Timeout:   10 * time.Minute,
+			Transport: o.transport(),
 		},
-		logger: logger,
+		keys:       o.keys,
+		gpgKeyring: o.gpgKeyring,
+		logger:     logger,
+
+		backoff:      o.backoff(),
+		licenseToken: o.licenseToken,
+		provenance:   o.provenance,
+		verified:     o.verifyCache(),
 	}
 }
 
-// Download downloads a file from the given URL to the destination path
+// ResumeTokenHeader carries the token a server hands out with an
+// authenticated download, which authorizes resuming it once the original
+// credentials have expired
+const ResumeTokenHeader = "X-Nametag-Resume-Token"
+
+// AssetSHA256Header carries the hex SHA-256 of a downloaded asset, which is
+// also the download's strong ETag
+const AssetSHA256Header = "X-Nametag-SHA256"
+
+// maxResumes bounds how often an interrupted download is resumed
+const maxResumes = 5
+
+// download is the state of a transfer that may be resumed
+type download struct {
+	url         string
+	file        *os.File
+	digests     *digestWriter
+	written     int64
+	total       int64
+	resumeToken string
+	// etag is the first response's strong ETag, which a resumed request
+	// sends as If-Range so a replaced asset is fetched anew, not spliced
+	etag     string
+	progress ProgressFunc
+}
+
+// errInterrupted marks a transfer that broke off after it started, which is
+// worth resuming
+var errInterrupted = errors.New("download interrupted")
+
+// Download downloads a file from the given URL to the destination path. A
+// transfer that breaks off midway is resumed with a Range request.
 func (d *Downloader) Download(ctx context.Context, url string, dest string, progress ProgressFunc) (*DownloadResult, error) {
 	d.logger.Info("downloading update",
 		"url", url,
 		"dest", dest,
 	)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	// Create destination file; only its owner may read a download
+	file, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
+		return nil, fmt.Errorf("create file: %w", err)
 	}
+	defer file.Close()
 
-	req.Header.Set("User-Agent", "nametag-updater/1.0")
+	// Compute every supported digest, since the asset's are only compared
+	// afterwards
+	digests, err := newDigestWriter(HashAlgorithms()...)
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := d.httpClient.Do(req)
+	dl := &download{url: url, file: file, digests: digests, total: -1, progress: progress}
+	for attempt := 1; ; attempt++ {
+		err := d.fetch(ctx, dl)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errInterrupted) || attempt > maxResumes || ctx.Err() != nil {
+			os.Remove(dest)
+			return nil, err
+		}
+
+		d.logger.Warn("download interrupted, resuming",
+			"offset", dl.written,
+			"attempt", attempt,
+			"error", err,
+		)
+		select {
+		case <-ctx.Done():
+			os.Remove(dest)
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+
+	sums := digests.Sums()
+
+	d.logger.Info("download complete",
+		"size", dl.written,
+		"sha256", sums[HashSHA256],
+	)
+
+	return &DownloadResult{
+		Path:   dest,
+		Size:   dl.written,
+		SHA256: sums[HashSHA256],
+		Hashes: sums,
+	}, nil
+}
+
+// fetch requests the rest of the download and appends it to the file. It
+// returns an error wrapping errInterrupted when the transfer can be resumed.
+func (d *Downloader) fetch(ctx context.Context, dl *download) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dl.url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("download: %w", err)
+		return fmt.Errorf("create request: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned status %d", resp.StatusCode)
+	req.Header.Set("User-Agent", "nametag-updater/1.0")
+	if dl.written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", dl.written))
+		if dl.resumeToken != "" {
+			req.Header.Set(ResumeTokenHeader, dl.resumeToken)
+		}
+		if dl.etag != "" {
+			req.Header.Set("If-Range", dl.etag)
+		}
 	}
 
-	// Create destination file
-	file, err := os.Create(dest)
+	resp, err := d.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("create file: %w", err)
+		if dl.written > 0 {
+			return fmt.Errorf("%w: %w", errInterrupted, err)
+		}
+		return fmt.Errorf("download: %w", err)
 	}
-	defer file.Close()
+	defer resp.Body.Close()
 
-	// Create hash writer
-	hash := sha256.New()
+	if token := resp.Header.Get(ResumeTokenHeader); token != "" {
+		dl.resumeToken = token
+	}
 
-	// Create multi-writer to write to both file and hash
-	writer := io.MultiWriter(file, hash)
+	switch {
+	case dl.written > 0 && resp.StatusCode == http.StatusPartialContent:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if start != dl.written {
+			return fmt.Errorf("server resumed at %d instead of %d", start, dl.written)
+		}
+		dl.total = total
+	case dl.written > 0 && resp.StatusCode == http.StatusOK:
+		// The server ignored the Range header, or the asset changed; start
+		// over
+		if err := dl.restart(); err != nil {
+			return err
+		}
+		dl.total = resp.ContentLength
+		dl.etag = strongETag(resp)
+	default:
+		if err := checkStatus(resp); err != nil {
+			d.recordBackoff(err)
+			return err
+		}
+		dl.total = resp.ContentLength
+		dl.etag = strongETag(resp)
+	}
 
-	// Track progress
-	var downloaded int64
-	total := resp.ContentLength
+	// Create multi-writer to write to both file and hashes
+	writer := io.MultiWriter(dl.file, dl.digests)
 
-	var reader io.Reader = resp.Body
-	if progress != nil {
+	// Read errors are the network's and worth resuming; write errors are
+	// the disk's and are not
+	body := &readErrorTracker{reader: resp.Body}
+	var reader io.Reader = body
+	if dl.progress != nil {
+		base := dl.written
+		var downloaded int64
 		reader = &progressReader{
-			reader: resp.Body,
+			reader: body,
 			onProgress: func(n int64) {
 				downloaded += n
-				progress(downloaded, total)
+				dl.progress(base+downloaded, dl.total)
 			},
 		}
 	}
 
 	// Copy data
-	size, err := io.Copy(writer, reader)
+	n, err := io.Copy(writer, reader)
+	dl.written += n
 	if err != nil {
-		os.Remove(dest)
-		return nil, fmt.Errorf("copy: %w", err)
+		if body.err != nil {
+			return fmt.Errorf("%w: %w", errInterrupted, err)
+		}
+		return fmt.Errorf("copy: %w", err)
 	}
 
-	hashSum := hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
 
-	d.logger.Info("download complete",
-		"size", size,
-		"sha256", hashSum,
-	)
+// strongETag returns the response's ETag unless it's weak, which If-Range
+// can't use
+func strongETag(resp *http.Response) string {
+	etag := resp.Header.Get("ETag")
+	if strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+	return etag
+}
 
-	return &DownloadResult{
-		Path:   dest,
-		Size:   size,
-		SHA256: hashSum,
-	}, nil
+// restart discards what was downloaded so far
+func (dl *download) restart() error {
+	if err := dl.file.Truncate(0); err != nil {
+		return fmt.Errorf("truncate file: %w", err)
+	}
+	if _, err := dl.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek file: %w", err)
+	}
+	dl.digests.Reset()
+	dl.written = 0
+	return nil
 }
 
-// VerifyChecksum verifies that a file matches the expected SHA256 hash
-func VerifyChecksum(filePath string, expectedSHA256 string) error {
-	file, err := os.Open(filePath)
+// parseContentRange returns the first byte and total length of a
+// "bytes first-last/total" Content-Range; an unknown total is -1
+func parseContentRange(value string) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	byteRange, totalStr, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	firstStr, _, ok := strings.Cut(byteRange, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+
+	first, err := strconv.ParseInt(firstStr, 10, 64)
 	if err != nil {
-		return fmt.Errorf("open file: %w", err)
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
 	}
-	defer file.Close()
+	total := int64(-1)
+	if totalStr != "*" {
+		total, err = strconv.ParseInt(totalStr, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+		}
+	}
+	return first, total, nil
+}
 
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+// VerifySignature fetches the minisign signature at url and verifies the file
+// at path against it. It is a no-op when no public key is configured, and an
+// error when a key is configured but the asset has no signature.
+func (d *Downloader) VerifySignature(ctx context.Context, url string, path string) error {
+	if d.keys == nil {
+		return nil
+	}
+	if url == "" {
+		return errors.New("asset is not signed")
+	}
+
+	d.logger.Info("verifying signature", "url", url)
+
+	// Signatures are a few hundred bytes; cap the read to avoid abuse
+	signature, err := d.fetchSignature(ctx, url, 4096)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
 		return fmt.Errorf("read file: %w", err)
 	}
 
-	actual := hex.EncodeToString(hash.Sum(nil))
-	if actual != expectedSHA256 {
-		return fmt.Errorf("checksum mismatch: expected %s, got %s", expectedSHA256, actual)
+	set := d.keys.Current()
+	sum := sha256.Sum256(data)
+	id := verifyCacheID("minisign", set.fingerprint(), sum[:], signature)
+	if _, ok := d.verified.lookup(id, time.Now()); ok {
+		return nil
+	}
+
+	// Assets carry a single signature; any trusted key may have made it
+	var verifyErr error
+	for _, key := range set.Keys {
+		if verifyErr = MinisignVerify(key, data, string(signature)); verifyErr == nil {
+			d.verified.record(id, []string{EncodePublicKey(key)}, time.Now())
+			return nil
+		}
+	}
+
+	return fmt.Errorf("verify signature: %w", verifyErr)
+}
+
+// VerifyGPGSignature fetches the armored GPG signature at url and verifies
+// the file at path against the configured keyring. It is a no-op when no
+// keyring is configured, and an error when the asset has no GPG signature.
+func (d *Downloader) VerifyGPGSignature(ctx context.Context, url string, path string) error {
+	if d.gpgKeyring == "" {
+		return nil
+	}
+	if url == "" {
+		return errors.New("asset has no gpg signature")
+	}
+
+	d.logger.Info("verifying gpg signature", "url", url, "keyring", d.gpgKeyring)
+
+	// Armored RSA-4096 signatures stay under 1KiB; leave room for several
+	signature, err := d.fetchSignature(ctx, url, 64<<10)
+	if err != nil {
+		return err
 	}
 
+	// gpgv is slow to start; the keyring's contents stand in for the keys
+	// when remembering its verdict
+	var id string
+	if keyring, err := os.ReadFile(d.gpgKeyring); err == nil {
+		if digests, err := FileDigests(path, "sha256"); err == nil {
+			keyringSum := sha256.Sum256(keyring)
+			id = verifyCacheID("gpg", keyringSum[:], []byte(digests["sha256"]), signature)
+		}
+	}
+	if id != "" {
+		if _, ok := d.verified.lookup(id, time.Now()); ok {
+			return nil
+		}
+	}
+
+	sigPath := path + GPGExtension
+	if err := os.WriteFile(sigPath, signature, 0600); err != nil {
+		return fmt.Errorf("write gpg signature: %w", err)
+	}
+	defer os.Remove(sigPath)
+
+	if err := GPGVerify(ctx, d.gpgKeyring, sigPath, path); err != nil {
+		return fmt.Errorf("verify gpg signature: %w", err)
+	}
+
+	if id != "" {
+		d.verified.record(id, nil, time.Now())
+	}
 	return nil
 }
 
+func (d *Downloader) fetchSignature(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("User-Agent", "nametag-updater/1.0")
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch signature: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		d.recordBackoff(err)
+		return nil, err
+	}
+
+	signature, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return nil, fmt.Errorf("read signature: %w", err)
+	}
+
+	return signature, nil
+}
+
+// recordBackoff persists the backoff a refusal from the server asks for
+func (d *Downloader) recordBackoff(err error) {
+	if d.backoff == nil {
+		return
+	}
+	if err := d.backoff.Record(err); err != nil {
+		d.logger.Warn("failed to record backoff", "error", err)
+	}
+}
+
+// VerifyChecksum verifies that a file matches the strongest of the expected
+// digests, keyed by algorithm, that this client supports
+func VerifyChecksum(filePath string, expected map[string]string) error {
+	algorithm, _, err := StrongestDigest(expected)
+	if err != nil {
+		return err
+	}
+
+	actual, err := FileDigests(filePath, algorithm)
+	if err != nil {
+		return err
+	}
+
+	if err := MatchDigests(expected, actual); err != nil {
+		return fmt.Errorf("checksum mismatch: %w", err)
+	}
+
+	return nil
+}
+
+// FileSHA256 returns the hex-encoded SHA256 hash of a file
+func FileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("open file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("read file: %w", err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 // progressReader wraps an io.Reader and calls onProgress for each read
 type progressReader struct {
 	reader     io.Reader
@@ -145,3 +480,17 @@ func (p *progressReader) Read(buf []byte) (int, error) {
 	}
 	return n, err
 }
+
+// readErrorTracker remembers the error a read failed with, other than EOF
+type readErrorTracker struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *readErrorTracker) Read(buf []byte) (int, error) {
+	n, err := r.reader.Read(buf)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,300 @@
+package update
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Assets may be stored encrypted at rest with envelope encryption: every file
+// gets its own random data key, which a KeyWrapper wraps with a key
+// encryption key and which is stored, wrapped, in the file's header. The
+// content is sealed with AES-256-GCM in fixed-size segments, so a reader can
+// seek and encrypted assets still serve Range requests. The header is the
+// additional data of every segment, binding the wrapped key and the size.
+//
+// Layout: magic | uint16 wrapped key length | wrapped key | uint64 size |
+// segments, each encryptedSegmentSize bytes of plaintext (the last shorter)
+// plus the GCM tag, with the segment index as nonce.
+const (
+	encryptedMagic       = "NTAGENC1"
+	encryptedSegmentSize = 64 << 10
+	dataKeySize          = 32
+)
+
+// ErrAssetEncrypted is returned when opening an encrypted asset without a key
+var ErrAssetEncrypted = errors.New("asset is encrypted at rest and no encryption key is configured")
+
+// ErrUnwrapKey is returned when an encrypted asset's data key can't be
+// unwrapped, e.g. because it was wrapped with another key or the KMS is down
+var ErrUnwrapKey = errors.New("unwrap data key")
+
+// ErrDecrypt is returned when an encrypted asset fails authentication, i.e.
+// it was corrupted or tampered with
+var ErrDecrypt = errors.New("asset failed to decrypt")
+
+// KeyWrapper wraps and unwraps the per-asset data keys with a key encryption
+// key, typically held by a KMS
+type KeyWrapper interface {
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// EncryptAsset writes the encryption of src, which must hold exactly size
+// bytes, to dst under a fresh data key wrapped by wrapper
+func EncryptAsset(ctx context.Context, dst io.Writer, src io.Reader, size int64, wrapper KeyWrapper) error {
+	return encryptAsset(ctx, encryptedMagic, dst, src, size, wrapper)
+}
+
+func encryptAsset(ctx context.Context, magic string, dst io.Writer, src io.Reader, size int64, wrapper KeyWrapper) error {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("generate data key: %w", err)
+	}
+
+	wrapped, err := wrapper.WrapKey(ctx, key)
+	if err != nil {
+		return fmt.Errorf("wrap data key: %w", err)
+	}
+	if len(wrapped) > 0xffff {
+		return fmt.Errorf("wrapped data key is %d bytes", len(wrapped))
+	}
+
+	header := make([]byte, 0, len(magic)+2+len(wrapped)+8)
+	header = append(header, magic...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+	header = binary.BigEndian.AppendUint64(header, uint64(size))
+
+	aead, err := newSegmentAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	if _, err := dst.Write(header); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+
+	plain := make([]byte, encryptedSegmentSize)
+	sealed := make([]byte, 0, encryptedSegmentSize+aead.Overhead())
+	for index, remaining := int64(0), size; remaining > 0; index++ {
+		n := min(remaining, encryptedSegmentSize)
+		if _, err := io.ReadFull(src, plain[:n]); err != nil {
+			return fmt.Errorf("read plaintext: %w", err)
+		}
+		sealed = aead.Seal(sealed[:0], segmentNonce(index), plain[:n], header)
+		if _, err := dst.Write(sealed); err != nil {
+			return fmt.Errorf("write ciphertext: %w", err)
+		}
+		remaining -= n
+	}
+
+	return nil
+}
+
+func newSegmentAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("create gcm: %w", err)
+	}
+	return aead, nil
+}
+
+// segmentNonce is the segment index; data keys are never reused across
+// files, so it is unique per key
+func segmentNonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+// AssetFile is a stored asset opened for reading. Encrypted assets are
+// decrypted transparently; others are read as they are.
+type AssetFile struct {
+	file *os.File
+	info os.FileInfo
+	size int64
+
+	// Set for encrypted assets only
+	aead     cipher.AEAD
+	header   []byte
+	offset   int64
+	segment  []byte
+	segIndex int64
+}
+
+// OpenAsset opens a stored asset, unwrapping its data key with wrapper if it
+// is encrypted. Opening an encrypted asset without a wrapper fails with
+// ErrAssetEncrypted.
+func OpenAsset(ctx context.Context, path string, wrapper KeyWrapper) (*AssetFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open asset: %w", err)
+	}
+
+	f, err := openAsset(ctx, file, encryptedMagic, wrapper)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openAsset reads the header of a file encrypted in the format identified by
+// magic; files without it are returned to be read as they are
+func openAsset(ctx context.Context, file *os.File, magic string, wrapper KeyWrapper) (*AssetFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat asset: %w", err)
+	}
+
+	f := &AssetFile{file: file, info: info, size: info.Size()}
+
+	prefix := make([]byte, len(magic)+2)
+	if _, err := file.ReadAt(prefix, 0); err != nil || string(prefix[:len(magic)]) != magic {
+		return f, nil
+	}
+	if wrapper == nil {
+		return nil, ErrAssetEncrypted
+	}
+
+	headerLen := int64(len(prefix)) + int64(binary.BigEndian.Uint16(prefix[len(magic):])) + 8
+	header := make([]byte, headerLen)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("%w: read header: %w", ErrDecrypt, err)
+	}
+	wrapped := header[len(prefix) : headerLen-8]
+	size := int64(binary.BigEndian.Uint64(header[headerLen-8:]))
+
+	key, err := wrapper.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnwrapKey, err)
+	}
+	aead, err := newSegmentAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := (size + encryptedSegmentSize - 1) / encryptedSegmentSize
+	if size < 0 || headerLen+size+segments*int64(aead.Overhead()) != info.Size() {
+		return nil, fmt.Errorf("%w: file is %d bytes, header says %d of content", ErrDecrypt, info.Size(), size)
+	}
+
+	f.size = size
+	f.aead = aead
+	f.header = header
+	f.segIndex = -1
+	return f, nil
+}
+
+// Size returns the size of the asset's content
+func (f *AssetFile) Size() int64 {
+	return f.size
+}
+
+// ModTime returns the stored file's modification time
+func (f *AssetFile) ModTime() time.Time {
+	return f.info.ModTime()
+}
+
+// Encrypted reports whether the stored file is encrypted at rest, so its
+// bytes differ from the content read
+func (f *AssetFile) Encrypted() bool {
+	return f.aead != nil
+}
+
+func (f *AssetFile) Read(p []byte) (int, error) {
+	if f.aead == nil {
+		return f.file.Read(p)
+	}
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+
+	index := f.offset / encryptedSegmentSize
+	if index != f.segIndex {
+		if err := f.loadSegment(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, f.segment[f.offset-index*encryptedSegmentSize:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *AssetFile) loadSegment(index int64) error {
+	overhead := int64(f.aead.Overhead())
+	length := min(f.size-index*encryptedSegmentSize, encryptedSegmentSize) + overhead
+
+	sealed := make([]byte, length)
+	if _, err := f.file.ReadAt(sealed, int64(len(f.header))+index*(encryptedSegmentSize+overhead)); err != nil {
+		return fmt.Errorf("read ciphertext: %w", err)
+	}
+
+	plain, err := f.aead.Open(f.segment[:0], segmentNonce(index), sealed, f.header)
+	if err != nil {
+		f.segIndex = -1
+		return fmt.Errorf("%w: segment %d", ErrDecrypt, index)
+	}
+	f.segment = plain
+	f.segIndex = index
+	return nil
+}
+
+// ReadAt reads the content at off without moving the offset Read and Seek
+// use
+func (f *AssetFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.aead == nil {
+		return f.file.ReadAt(p, off)
+	}
+	if off < 0 {
+		return 0, errors.New("read at: negative offset")
+	}
+
+	saved := f.offset
+	defer func() { f.offset = saved }()
+
+	f.offset = off
+	n, err := io.ReadFull(f, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *AssetFile) Seek(offset int64, whence int) (int64, error) {
+	if f.aead == nil {
+		return f.file.Seek(offset, whence)
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *AssetFile) Close() error {
+	return f.file.Close()
+}
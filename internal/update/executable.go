@@ -0,0 +1,109 @@
+package update
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+)
+
+// ErrWrongExecutable is returned when a new binary isn't an executable for
+// the platform it is about to be installed on, such as a linux/amd64 binary
+// handed to a darwin/arm64 client by a misconfigured server
+var ErrWrongExecutable = errors.New("binary is not an executable for this platform")
+
+var (
+	elfArchs = map[elf.Machine]string{
+		elf.EM_X86_64:    "amd64",
+		elf.EM_386:       "386",
+		elf.EM_AARCH64:   "arm64",
+		elf.EM_ARM:       "arm",
+		elf.EM_RISCV:     "riscv64",
+		elf.EM_S390:      "s390x",
+		elf.EM_LOONGARCH: "loong64",
+	}
+	peArchs = map[uint16]string{
+		pe.IMAGE_FILE_MACHINE_AMD64: "amd64",
+		pe.IMAGE_FILE_MACHINE_I386:  "386",
+		pe.IMAGE_FILE_MACHINE_ARM64: "arm64",
+		pe.IMAGE_FILE_MACHINE_ARMNT: "arm",
+	}
+	machoArchs = map[macho.Cpu]string{
+		macho.CpuAmd64: "amd64",
+		macho.Cpu386:   "386",
+		macho.CpuArm64: "arm64",
+		macho.CpuArm:   "arm",
+	}
+)
+
+// CheckExecutable parses the header of the binary at path and checks that
+// it is an executable for the running OS and architecture: ELF outside
+// Windows and macOS, PE on Windows, and Mach-O, possibly universal, on macOS
+func CheckExecutable(path string) error {
+	return checkExecutable(path, runtime.GOOS, runtime.GOARCH)
+}
+
+func checkExecutable(path, goos, goarch string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open binary: %w", err)
+	}
+	defer f.Close()
+
+	format, archs, err := executableArchs(f)
+	if err != nil {
+		return fmt.Errorf("%w: %s is not a recognized executable", ErrWrongExecutable, path)
+	}
+
+	want := "ELF"
+	switch goos {
+	case "windows":
+		want = "PE"
+	case "darwin", "ios":
+		want = "Mach-O"
+	}
+	if format != want {
+		return fmt.Errorf("%w: %s is %s, %s needs %s", ErrWrongExecutable, path, format, goos, want)
+	}
+
+	// An architecture missing from the tables can't be told apart, so only
+	// the format is checked for it
+	if slices.Contains(archs, goarch) || slices.Contains(archs, "unknown") {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is built for %v, this is %s/%s", ErrWrongExecutable, path, archs, goos, goarch)
+}
+
+// executableArchs returns the format of an executable and the architectures
+// it runs on; "unknown" stands for an architecture missing from the tables
+func executableArchs(r io.ReaderAt) (string, []string, error) {
+	if f, err := elf.NewFile(r); err == nil {
+		return "ELF", []string{archName(elfArchs, f.Machine)}, nil
+	}
+	if f, err := pe.NewFile(r); err == nil {
+		return "PE", []string{archName(peArchs, f.Machine)}, nil
+	}
+	if f, err := macho.NewFile(r); err == nil {
+		return "Mach-O", []string{archName(machoArchs, f.Cpu)}, nil
+	}
+	if f, err := macho.NewFatFile(r); err == nil {
+		var archs []string
+		for _, arch := range f.Arches {
+			archs = append(archs, archName(machoArchs, arch.Cpu))
+		}
+		return "Mach-O", archs, nil
+	}
+	return "", nil, errors.New("unknown executable format")
+}
+
+func archName[K comparable](table map[K]string, machine K) string {
+	if name, ok := table[machine]; ok {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,32 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// GPGExtension is the suffix of an armored detached GPG signature stored next
+// to an asset
+const GPGExtension = ".asc"
+
+// GPGVerify checks the detached signature at sigPath over the file at
+// dataPath using gpgv, trusting only the keys in keyring (a keyring exported
+// with `gpg --export`). gpgv is used rather than gpg so the user's own
+// keyring and trust database play no part.
+func GPGVerify(ctx context.Context, keyring, sigPath, dataPath string) error {
+	// gpgv looks up keyring names without a slash in its home directory
+	keyring, err := filepath.Abs(keyring)
+	if err != nil {
+		return fmt.Errorf("resolve keyring: %w", err)
+	}
+
+	out, err := exec.CommandContext(ctx, "gpgv", "--keyring", keyring, sigPath, dataPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("gpgv: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
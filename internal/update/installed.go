@@ -0,0 +1,97 @@
+package update
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// InstalledFile is the name of the client state file recording the highest
+// version of each component ever installed
+const InstalledFile = "installed.json"
+
+// ErrDowngrade is returned for a version lower than one installed before
+var ErrDowngrade = errors.New("refusing to downgrade")
+
+// HighestInstalled returns the highest version of component recorded in the
+// installed state file at path, and whether there is one
+func HighestInstalled(path, component string) (Version, bool, error) {
+	installed, err := readInstalled(path)
+	if err != nil {
+		return Version{}, false, err
+	}
+
+	s, ok := installed[component]
+	if !ok {
+		return Version{}, false, nil
+	}
+	v, err := ParseVersion(s)
+	if err != nil {
+		return Version{}, false, fmt.Errorf("installed state %s: %w", component, err)
+	}
+	return v, true, nil
+}
+
+// CheckDowngrade returns ErrDowngrade when v is lower than the highest
+// version of component ever installed
+func CheckDowngrade(path, component string, v Version) error {
+	highest, ok, err := HighestInstalled(path, component)
+	if err != nil {
+		return err
+	}
+	if ok && v.LessThan(highest) {
+		return fmt.Errorf("%w: %s %s is lower than %s, which was installed before", ErrDowngrade, component, v, highest)
+	}
+	return nil
+}
+
+// RecordInstalled raises the highest installed version of component to v.
+// The record never goes down, so installing an older version doesn't lower
+// the floor.
+func RecordInstalled(path, component string, v Version) error {
+	installed, err := readInstalled(path)
+	if err != nil {
+		return err
+	}
+
+	if s, ok := installed[component]; ok {
+		if highest, err := ParseVersion(s); err == nil && !highest.LessThan(v) {
+			return nil
+		}
+	}
+	installed[component] = v.String()
+
+	data, err := json.MarshalIndent(installed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode installed state: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write installed state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write installed state: %w", err)
+	}
+	return nil
+}
+
+// readInstalled loads the component to version map; a missing file is empty
+func readInstalled(path string) (map[string]string, error) {
+	installed := make(map[string]string)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return installed, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read installed state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &installed); err != nil {
+		return nil, fmt.Errorf("decode installed state: %w", err)
+	}
+	return installed, nil
+}
@@ -0,0 +1,127 @@
+package update
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeInstalled writes an installed state file recording installed
+func writeInstalled(t *testing.T, installed map[string]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), InstalledFile)
+	if installed == nil {
+		return path
+	}
+	data, err := json.Marshal(installed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustParseVersion(t *testing.T, s string) Version {
+	t.Helper()
+	v, err := ParseVersion(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestCheckDowngrade(t *testing.T) {
+	tests := []struct {
+		name      string
+		installed map[string]string
+		version   string
+		wantErr   error
+	}{
+		{"no state file", nil, "1.0.0", nil},
+		{"component never installed", map[string]string{"nametag-up": "2.0.0"}, "1.0.0", nil},
+		{"upgrade", map[string]string{"nametag": "1.2.0"}, "1.3.0", nil},
+		{"reinstall of the highest", map[string]string{"nametag": "1.2.0"}, "1.2.0", nil},
+		{"precedence, not text", map[string]string{"nametag": "1.9.0"}, "1.10.0", nil},
+		{"downgrade", map[string]string{"nametag": "1.2.0"}, "1.1.9", ErrDowngrade},
+		{"lower patch", map[string]string{"nametag": "1.2.1"}, "1.2.0", ErrDowngrade},
+		{"corrupt state", map[string]string{"nametag": "latest"}, "1.0.0", errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := mustParseVersion(t, tt.version)
+			checkErr(t, CheckDowngrade(writeInstalled(t, tt.installed), "nametag", v), tt.wantErr)
+		})
+	}
+}
+
+func TestRecordInstalledNeverLowers(t *testing.T) {
+	path := writeInstalled(t, nil)
+	for _, installed := range []string{"1.0.0", "1.2.0", "1.1.0", "1.0.9"} {
+		if err := RecordInstalled(path, "nametag", mustParseVersion(t, installed)); err != nil {
+			t.Fatalf("RecordInstalled(%s) = %v", installed, err)
+		}
+	}
+	highest, ok, err := HighestInstalled(path, "nametag")
+	if err != nil || !ok || highest.String() != "1.2.0" {
+		t.Fatalf("HighestInstalled() = %s, %t, %v, want 1.2.0", highest, ok, err)
+	}
+}
+
+func TestCheckerDowngradeFloor(t *testing.T) {
+	tests := []struct {
+		name           string
+		installed      map[string]string
+		offered        string
+		allowDowngrade bool
+		wantUpdate     bool
+		wantReason     NoUpdateReason
+	}{
+		{"above the floor", map[string]string{"nametag": "1.2.0"}, "1.3.0", false, true, ""},
+		{"at the floor", map[string]string{"nametag": "1.2.0"}, "1.2.0", false, true, ""},
+		{"below the floor", map[string]string{"nametag": "1.2.0"}, "1.1.5", false, false, NoUpdateBlocked},
+		{"below the floor, allowed", map[string]string{"nametag": "1.2.0"}, "1.1.5", true, true, ""},
+		{"no floor", nil, "1.1.5", false, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(&Manifest{
+				SchemaVersion: SchemaVersion,
+				Generated:     time.Now().UTC(),
+				Components: map[string]Component{"nametag": {
+					Name:    "nametag",
+					Version: tt.offered,
+					Assets: map[string]Asset{CurrentPlatform(): {
+						URL:    "/v1/download/nametag/" + CurrentPlatform() + "/" + tt.offered,
+						Size:   1,
+						SHA256: strings.Repeat("ab", 32),
+					}},
+				}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := []Option{WithInstalledState(writeInstalled(t, tt.installed)), WithIgnoreBackoff()}
+			if tt.allowDowngrade {
+				opts = append(opts, WithAllowDowngrade())
+			}
+			checker := NewChecker(serveManifest(t, body), slog.New(slog.NewTextHandler(io.Discard, nil)), opts...)
+
+			// The running binary is an older reinstall, below the floor
+			result, err := checker.Check(context.Background(), "nametag", mustParseVersion(t, "1.1.0"))
+			if err != nil {
+				t.Fatalf("Check() = %v", err)
+			}
+			if result.UpdateAvailable != tt.wantUpdate || result.Reason != tt.wantReason {
+				t.Errorf("Check() = update %t, reason %q, want %t, %q", result.UpdateAvailable, result.Reason, tt.wantUpdate, tt.wantReason)
+			}
+		})
+	}
+}
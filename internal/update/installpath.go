@@ -0,0 +1,77 @@
+package update
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// InstallPathFile is the name of the client state file recording the
+// components an update moved to a new install path
+const InstallPathFile = "install-path.json"
+
+// InstallMigration is a component's move to a new install path
+type InstallMigration struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Forwarder is what was left at From to reach To: From itself as a
+	// symlink, or a shim next to it
+	Forwarder string    `json:"forwarder"`
+	Version   string    `json:"version,omitempty"`
+	Migrated  time.Time `json:"migrated"`
+}
+
+// InstallDir returns the directory the release is installed in on this
+// OS, or "" when it doesn't say
+func (c Component) InstallDir() string {
+	dir := c.InstallDirs[runtime.GOOS]
+	if dir == "" || !filepath.IsAbs(dir) {
+		return ""
+	}
+	return filepath.Clean(dir)
+}
+
+// RecordInstallMigration records component's latest move in the install
+// path state file at path
+func RecordInstallMigration(path, component string, m InstallMigration) error {
+	migrations, err := ReadInstallMigrations(path)
+	if err != nil {
+		return err
+	}
+	migrations[component] = m
+
+	data, err := json.MarshalIndent(migrations, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode install path state: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write install path state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write install path state: %w", err)
+	}
+	return nil
+}
+
+// ReadInstallMigrations loads each component's latest move from the install
+// path state file at path; a missing file has none
+func ReadInstallMigrations(path string) (map[string]InstallMigration, error) {
+	migrations := make(map[string]InstallMigration)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return migrations, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read install path state: %w", err)
+	}
+	if err := json.Unmarshal(data, &migrations); err != nil {
+		return nil, fmt.Errorf("decode install path state: %w", err)
+	}
+	return migrations, nil
+}
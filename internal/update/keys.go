@@ -0,0 +1,370 @@
+package update
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KeyRotationPath is the server path under which key rotation documents are
+// published as {version}.json
+const KeyRotationPath = "/v1/keys/"
+
+// maxKeyRotationSize caps how much of a key rotation document is read
+const maxKeyRotationSize = 64 << 10
+
+// KeySet is a set of trusted signing keys of which Threshold must sign.
+// Version 0 is the set built into the client; rotations count up from there.
+type KeySet struct {
+	Version   int64
+	Keys      []ed25519.PublicKey
+	Threshold int
+}
+
+// ParseKeySet decodes a comma-separated list of base64 public keys
+func ParseKeySet(keys string, threshold int) (*KeySet, error) {
+	set := &KeySet{Threshold: threshold}
+	for _, s := range strings.Split(keys, ",") {
+		key, err := ParsePublicKey(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		// A repeated key would count twice towards the threshold
+		if slices.ContainsFunc(set.Keys, func(k ed25519.PublicKey) bool { return k.Equal(key) }) {
+			return nil, fmt.Errorf("duplicate key %s", EncodePublicKey(key))
+		}
+		set.Keys = append(set.Keys, key)
+	}
+
+	if err := set.validate(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+func (k *KeySet) validate() error {
+	if len(k.Keys) == 0 {
+		return errors.New("key set is empty")
+	}
+	if k.Threshold < 1 || k.Threshold > len(k.Keys) {
+		return fmt.Errorf("threshold %d is not between 1 and %d", k.Threshold, len(k.Keys))
+	}
+	return nil
+}
+
+// Verify checks that at least Threshold distinct keys of the set produced one
+// of the base64 signatures over data
+func (k *KeySet) Verify(data []byte, signatures []string) error {
+	_, err := k.VerifySigners(data, signatures)
+	return err
+}
+
+// VerifySigners is Verify that also returns the keys whose signatures are
+// valid
+func (k *KeySet) VerifySigners(data []byte, signatures []string) ([]ed25519.PublicKey, error) {
+	if len(signatures) == 0 {
+		return nil, ErrUnsigned
+	}
+
+	var signers []ed25519.PublicKey
+	for _, key := range k.Keys {
+		for _, sig := range signatures {
+			if Verify(key, data, sig) == nil {
+				signers = append(signers, key)
+				break
+			}
+		}
+	}
+
+	if len(signers) < k.Threshold {
+		return nil, fmt.Errorf("%d valid signature(s), threshold is %d", len(signers), k.Threshold)
+	}
+	return signers, nil
+}
+
+// fingerprint identifies the set's keys and threshold, for remembering what
+// it verified
+func (k *KeySet) fingerprint() []byte {
+	keys := make([]string, len(k.Keys))
+	for i, key := range k.Keys {
+		keys[i] = EncodePublicKey(key)
+	}
+	slices.Sort(keys)
+	sum := sha256.Sum256([]byte(strconv.Itoa(k.Threshold) + ":" + strings.Join(keys, ",")))
+	return sum[:]
+}
+
+// KeyRotation is the signed body of a key rotation document. Version N must
+// be signed by a threshold of key set N-1 and of its own keys.
+type KeyRotation struct {
+	Version   int64    `json:"version"`
+	Keys      []string `json:"keys"`
+	Threshold int      `json:"threshold"`
+}
+
+// keyRotationEnvelope is the on-the-wire form of a key rotation document. The
+// signatures cover the compact JSON encoding of Signed.
+type keyRotationEnvelope struct {
+	Signed     json.RawMessage `json:"signed"`
+	Signatures []string        `json:"signatures"`
+}
+
+// SignKeyRotation produces a key rotation document signed by keys, which
+// should include a threshold of both the previous and the new key set
+func SignKeyRotation(rotation KeyRotation, keys ...crypto.Signer) ([]byte, error) {
+	signed, err := json.Marshal(rotation)
+	if err != nil {
+		return nil, fmt.Errorf("marshal key rotation: %w", err)
+	}
+
+	envelope := keyRotationEnvelope{Signed: signed}
+	for _, key := range keys {
+		signature, err := SignWith(key, signed)
+		if err != nil {
+			return nil, err
+		}
+		envelope.Signatures = append(envelope.Signatures, signature)
+	}
+
+	out, err := json.MarshalIndent(envelope, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal key rotation: %w", err)
+	}
+	return out, nil
+}
+
+// Rotate verifies a key rotation document against k and returns the key set
+// it introduces
+func (k *KeySet) Rotate(data []byte) (*KeySet, error) {
+	envelope, next, err := decodeKeyRotation(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := k.Verify(envelope.Signed, envelope.Signatures); err != nil {
+		return nil, fmt.Errorf("not signed by key set %d: %w", k.Version, err)
+	}
+	if next.Version != k.Version+1 {
+		return nil, fmt.Errorf("key rotation version is %d, expected %d", next.Version, k.Version+1)
+	}
+
+	// The new keys must be usable, which also proves possession
+	if err := next.Verify(envelope.Signed, envelope.Signatures); err != nil {
+		return nil, fmt.Errorf("not signed by key set %d: %w", next.Version, err)
+	}
+
+	return next, nil
+}
+
+// ParseKeyRotation returns the key set a key rotation document introduces,
+// without verifying its signatures
+func ParseKeyRotation(data []byte) (*KeySet, error) {
+	_, set, err := decodeKeyRotation(data)
+	return set, err
+}
+
+// decodeKeyRotation decodes a key rotation document without verifying it
+func decodeKeyRotation(data []byte) (*keyRotationEnvelope, *KeySet, error) {
+	var envelope keyRotationEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, nil, fmt.Errorf("decode key rotation: %w", err)
+	}
+
+	// Signatures cover the compact encoding; the document itself is indented
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, envelope.Signed); err != nil {
+		return nil, nil, fmt.Errorf("decode key rotation: %w", err)
+	}
+	envelope.Signed = compact.Bytes()
+
+	var rotation KeyRotation
+	if err := json.Unmarshal(envelope.Signed, &rotation); err != nil {
+		return nil, nil, fmt.Errorf("decode key rotation: %w", err)
+	}
+
+	set, err := ParseKeySet(strings.Join(rotation.Keys, ","), rotation.Threshold)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key set %d: %w", rotation.Version, err)
+	}
+	set.Version = rotation.Version
+
+	return &envelope, set, nil
+}
+
+// TrustedKeys holds the key set a client currently trusts. It follows key
+// rotation documents from the server and persists the latest accepted one,
+// so a client keeps trusting rotated keys across runs without a reinstall.
+type TrustedKeys struct {
+	mu        sync.Mutex
+	current   *KeySet
+	storePath string
+	// rotationPath is where the server publishes the key set's rotations;
+	// empty when the keys don't rotate
+	rotationPath string
+	// local are keys trusted locally on top of the current set
+	local []ed25519.PublicKey
+}
+
+// NewTrustedKeys starts from the built-in key set, or from the last rotation
+// stored at storePath when there is one. An empty storePath disables
+// persistence.
+func NewTrustedKeys(builtin *KeySet, storePath string) (*TrustedKeys, error) {
+	t := &TrustedKeys{current: builtin, storePath: storePath, rotationPath: KeyRotationPath}
+	if storePath == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(storePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read trusted keys: %w", err)
+	}
+
+	// The stored document was verified when it was accepted; it is trusted
+	// like the rest of the client's state
+	_, stored, err := decodeKeyRotation(data)
+	if err != nil {
+		return nil, fmt.Errorf("trusted keys: %w", err)
+	}
+
+	if stored.Version > builtin.Version {
+		t.current = stored
+	}
+	return t, nil
+}
+
+// NewChannelKeys is NewTrustedKeys for the keys of a release channel, which
+// rotate independently of the stable channel's under KeyRotationPath
+// {channel}/
+func NewChannelKeys(channel string, builtin *KeySet, storePath string) (*TrustedKeys, error) {
+	t, err := NewTrustedKeys(builtin, storePath)
+	if err != nil {
+		return nil, err
+	}
+	if channel = NormalizeChannel(channel); channel != ChannelStable {
+		t.rotationPath = KeyRotationPath + channel + "/"
+	}
+	return t, nil
+}
+
+// NewLocalKeys trusts only keys from a local trust store, any one of which
+// may sign. Such keys are managed locally, so they don't follow the server's
+// key rotations.
+func NewLocalKeys(keys []ed25519.PublicKey) (*TrustedKeys, error) {
+	set := &KeySet{Keys: keys, Threshold: 1}
+	if err := set.validate(); err != nil {
+		return nil, err
+	}
+	return &TrustedKeys{current: set}, nil
+}
+
+// AddLocal trusts keys from a local trust store on top of the current set.
+// Each counts towards the threshold like a key of the set, but not towards
+// verifying key rotations.
+func (t *TrustedKeys) AddLocal(keys ...ed25519.PublicKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.local = append(t.local, keys...)
+}
+
+// Current returns the key set currently trusted, locally trusted keys
+// included
+func (t *TrustedKeys) Current() *KeySet {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	set := *t.current
+	set.Keys = slices.Clone(set.Keys)
+	for _, key := range t.local {
+		if !slices.ContainsFunc(set.Keys, func(k ed25519.PublicKey) bool { return k.Equal(key) }) {
+			set.Keys = append(set.Keys, key)
+		}
+	}
+	return &set
+}
+
+// Refresh walks the server's key rotation documents of product from the
+// current version onwards, each verified by the set before it
+func (t *TrustedKeys) Refresh(ctx context.Context, httpClient *http.Client, serverURL, product string, logger *slog.Logger) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.rotationPath == "" {
+		return nil
+	}
+	for {
+		next := t.current.Version + 1
+		data, err := fetchKeyRotation(ctx, httpClient, serverURL+ProductPath(product, t.rotationPath)+strconv.FormatInt(next, 10)+".json")
+		if errors.Is(err, errNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rotated, err := t.current.Rotate(data)
+		if err != nil {
+			return fmt.Errorf("key rotation %d: %w", next, err)
+		}
+
+		if t.storePath != "" {
+			tmp := t.storePath + ".tmp"
+			if err := os.WriteFile(tmp, data, 0600); err != nil {
+				return fmt.Errorf("store trusted keys: %w", err)
+			}
+			if err := os.Rename(tmp, t.storePath); err != nil {
+				return fmt.Errorf("store trusted keys: %w", err)
+			}
+		}
+
+		logger.Info("rotated signing keys",
+			"version", rotated.Version,
+			"keys", len(rotated.Keys),
+			"threshold", rotated.Threshold,
+		)
+		t.current = rotated
+	}
+}
+
+func fetchKeyRotation(ctx context.Context, httpClient *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("User-Agent", "nametag-updater/1.0")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch key rotation: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if err := checkStatus(resp); err != nil {
+		return nil, fmt.Errorf("fetch key rotation: %w", err)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxKeyRotationSize))
+	if err != nil {
+		return nil, fmt.Errorf("read key rotation: %w", err)
+	}
+	return data, nil
+}
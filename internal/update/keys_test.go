@@ -0,0 +1,248 @@
+package update
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestKeys returns n fresh key pairs
+func newTestKeys(t *testing.T, n int) ([]ed25519.PublicKey, []ed25519.PrivateKey) {
+	t.Helper()
+	pubs := make([]ed25519.PublicKey, n)
+	privs := make([]ed25519.PrivateKey, n)
+	for i := range n {
+		pubs[i], privs[i] = newTestKey(t)
+	}
+	return pubs, privs
+}
+
+func encodeKeys(keys []ed25519.PublicKey) string {
+	encoded := make([]string, len(keys))
+	for i, key := range keys {
+		encoded[i] = EncodePublicKey(key)
+	}
+	return strings.Join(encoded, ",")
+}
+
+func TestParseKeySet(t *testing.T) {
+	pubs, _ := newTestKeys(t, 3)
+	for _, tt := range []struct {
+		name      string
+		keys      string
+		threshold int
+		wantErr   bool
+	}{
+		{"2 of 3", encodeKeys(pubs), 2, false},
+		{"3 of 3", encodeKeys(pubs), 3, false},
+		{"zero threshold", encodeKeys(pubs), 0, true},
+		{"threshold above the keys", encodeKeys(pubs), 4, true},
+		// A repeated key would let one signer count twice
+		{"duplicate key", encodeKeys([]ed25519.PublicKey{pubs[0], pubs[1], pubs[0]}), 2, true},
+		{"bad key", encodeKeys(pubs) + ",bad", 1, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKeySet(tt.keys, tt.threshold)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseKeySet() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeySetThreshold(t *testing.T) {
+	pubs, privs := newTestKeys(t, 3)
+	_, outsiders := newTestKeys(t, 2)
+	set := &KeySet{Keys: pubs, Threshold: 2}
+	data := []byte("manifest")
+
+	for _, tt := range []struct {
+		name    string
+		signers []ed25519.PrivateKey
+		extra   []string
+		want    int
+	}{
+		{name: "two of three", signers: privs[:2], want: 2},
+		{name: "all three", signers: privs, want: 3},
+		{name: "one", signers: privs[:1]},
+		// The same key signing twice is still one signer
+		{name: "one key twice", signers: []ed25519.PrivateKey{privs[0], privs[0]}},
+		{name: "outsiders", signers: append([]ed25519.PrivateKey{privs[0]}, outsiders...)},
+		{name: "garbage", signers: privs[:1], extra: []string{"", "!!!", Sign(privs[1], []byte("other data"))}},
+		{name: "unsigned"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			signatures := tt.extra
+			for _, key := range tt.signers {
+				signatures = append(signatures, Sign(key, data))
+			}
+			signers, err := set.VerifySigners(data, signatures)
+			if tt.want == 0 {
+				if err == nil {
+					t.Fatalf("VerifySigners() accepted %d signature(s)", len(signatures))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifySigners() = %v", err)
+			}
+			if len(signers) != tt.want {
+				t.Errorf("%d signers, want %d", len(signers), tt.want)
+			}
+		})
+	}
+}
+
+// signRotation signs a rotation to version with keys as its new set and
+// threshold, by signers
+func signRotation(t *testing.T, version int64, keys []ed25519.PublicKey, threshold int, signers ...ed25519.PrivateKey) []byte {
+	t.Helper()
+	rotation := KeyRotation{Version: version, Threshold: threshold}
+	for _, key := range keys {
+		rotation.Keys = append(rotation.Keys, EncodePublicKey(key))
+	}
+	cryptoSigners := make([]crypto.Signer, len(signers))
+	for i, key := range signers {
+		cryptoSigners[i] = key
+	}
+	data, err := SignKeyRotation(rotation, cryptoSigners...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestKeySetRotate(t *testing.T) {
+	oldPubs, oldPrivs := newTestKeys(t, 3)
+	newPubs, newPrivs := newTestKeys(t, 2)
+	current := &KeySet{Version: 4, Keys: oldPubs, Threshold: 2}
+	both := append(append([]ed25519.PrivateKey{}, oldPrivs[:2]...), newPrivs...)
+
+	for _, tt := range []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"signed by both sets", signRotation(t, 5, newPubs, 2, both...), ""},
+		{"old keys short of the threshold", signRotation(t, 5, newPubs, 2, oldPrivs[0], newPrivs[0], newPrivs[1]), "not signed by key set 4"},
+		// The new keys must prove they can sign
+		{"new keys short of the threshold", signRotation(t, 5, newPubs, 2, oldPrivs[0], oldPrivs[1], newPrivs[0]), "not signed by key set 5"},
+		{"skipped version", signRotation(t, 6, newPubs, 2, both...), "expected 5"},
+		{"replayed version", signRotation(t, 4, newPubs, 2, both...), "expected 5"},
+		{"bad threshold", signRotation(t, 5, newPubs, 3, both...), "threshold"},
+		{"not json", []byte("rotation"), "decode"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			next, err := current.Rotate(tt.data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Rotate() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Rotate() = %v", err)
+			}
+			if next.Version != 5 || next.Threshold != 2 || len(next.Keys) != 2 {
+				t.Errorf("Rotate() = version %d, %d of %d keys", next.Version, next.Threshold, len(next.Keys))
+			}
+		})
+	}
+}
+
+func TestKeySetRotateTamperedKeys(t *testing.T) {
+	oldPubs, oldPrivs := newTestKeys(t, 1)
+	newPubs, newPrivs := newTestKeys(t, 1)
+	attacker, _ := newTestKey(t)
+	data := signRotation(t, 1, newPubs, 1, oldPrivs[0], newPrivs[0])
+
+	// Swapping in another key breaks the signatures over the signed body
+	tampered := strings.Replace(string(data), EncodePublicKey(newPubs[0]), EncodePublicKey(attacker), 1)
+	if _, err := (&KeySet{Keys: oldPubs, Threshold: 1}).Rotate([]byte(tampered)); err == nil {
+		t.Fatal("Rotate() accepted a rotation with a swapped key")
+	}
+}
+
+func TestTrustedKeysRefresh(t *testing.T) {
+	pubs0, privs0 := newTestKeys(t, 2)
+	pubs1, privs1 := newTestKeys(t, 2)
+	pubs2, privs2 := newTestKeys(t, 1)
+	rotations := map[string][]byte{
+		"1.json": signRotation(t, 1, pubs1, 2, privs0[0], privs0[1], privs1[0], privs1[1]),
+		"2.json": signRotation(t, 2, pubs2, 1, privs1[0], privs1[1], privs2[0]),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := rotations[strings.TrimPrefix(r.URL.Path, KeyRotationPath)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	store := filepath.Join(t.TempDir(), "keys.json")
+	builtin := &KeySet{Keys: pubs0, Threshold: 2}
+	keys, err := NewTrustedKeys(builtin, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := keys.Refresh(context.Background(), srv.Client(), srv.URL, "", logger); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+	if got := keys.Current(); got.Version != 2 || !got.Keys[0].Equal(pubs2[0]) {
+		t.Fatalf("trusting key set %d after refresh, want 2", got.Version)
+	}
+
+	// The rotation is remembered across runs
+	reloaded, err := NewTrustedKeys(builtin, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Current().Version; got != 2 {
+		t.Errorf("reloaded key set %d, want 2", got)
+	}
+
+	// A rotation the current set didn't sign stops the walk
+	_, rogue := newTestKeys(t, 1)
+	rotations["3.json"] = signRotation(t, 3, pubs1, 1, rogue[0], privs1[0])
+	if err := keys.Refresh(context.Background(), srv.Client(), srv.URL, "", logger); err == nil {
+		t.Fatal("Refresh() accepted a rotation not signed by the current keys")
+	}
+	if got := keys.Current().Version; got != 2 {
+		t.Errorf("trusting key set %d after a rejected rotation, want 2", got)
+	}
+}
+
+func TestTrustedKeysLocal(t *testing.T) {
+	pubs, privs := newTestKeys(t, 2)
+	local, localPriv := newTestKey(t)
+	keys, err := NewTrustedKeys(&KeySet{Keys: pubs, Threshold: 2}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.AddLocal(local, pubs[0])
+
+	data := []byte("manifest")
+	set := keys.Current()
+	if len(set.Keys) != 3 {
+		t.Fatalf("%d keys, want 3: a locally trusted key already in the set counts once", len(set.Keys))
+	}
+	if err := set.Verify(data, []string{Sign(privs[0], data), Sign(localPriv, data)}); err != nil {
+		t.Errorf("Verify() with a local key = %v", err)
+	}
+	if err := set.Verify(data, []string{Sign(privs[0], data), Sign(privs[0], data)}); err == nil {
+		t.Error("Verify() counted one key twice")
+	}
+	if got := keys.Current().Threshold; got != 2 {
+		t.Errorf("threshold %d, want 2", got)
+	}
+}
@@ -0,0 +1,222 @@
+package update
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoadKeyWrapper parses a key encryption key spec: "file:PATH" for a local
+// 256-bit key, raw or base64, or "vault-transit:[MOUNT/]NAME" for a HashiCorp
+// Vault transit key reached through VAULT_ADDR and VAULT_TOKEN
+func LoadKeyWrapper(spec string) (KeyWrapper, error) {
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok || arg == "" {
+		return nil, fmt.Errorf("invalid encryption key %q: want file:PATH or vault-transit:NAME", spec)
+	}
+
+	switch kind {
+	case "file":
+		return loadLocalKeyWrapper(arg)
+	case "vault-transit":
+		return newVaultTransit(arg)
+	default:
+		return nil, fmt.Errorf("unknown encryption key type %q", kind)
+	}
+}
+
+// localKeyWrapper wraps data keys with AES-256-GCM under a key read from
+// disk. Wrapped keys start with an ID of the key so unwrapping with another
+// key fails clearly.
+type localKeyWrapper struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+func loadLocalKeyWrapper(path string) (*localKeyWrapper, error) {
+	key, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalKeyWrapper(key)
+}
+
+func newLocalKeyWrapper(key []byte) (*localKeyWrapper, error) {
+	aead, err := newSegmentAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	id := sha256.Sum256(key)
+	return &localKeyWrapper{id: id[:keyIDSize], aead: aead}, nil
+}
+
+// keyIDSize is how many bytes of a key's SHA-256 identify it
+const keyIDSize = 8
+
+// readKeyFile reads a 256-bit key stored raw or base64-encoded
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+
+	if len(data) == dataKeySize {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != dataKeySize {
+		return nil, fmt.Errorf("key %s must be %d bytes, raw or base64", path, dataKeySize)
+	}
+	return key, nil
+}
+
+func (w *localKeyWrapper) WrapKey(_ context.Context, key []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+
+	wrapped := append(append([]byte{}, w.id...), nonce...)
+	return w.aead.Seal(wrapped, nonce, key, w.id), nil
+}
+
+func (w *localKeyWrapper) UnwrapKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	nonceEnd := len(w.id) + w.aead.NonceSize()
+	if len(wrapped) < nonceEnd || !bytes.Equal(wrapped[:len(w.id)], w.id) {
+		return nil, errors.New("data key was wrapped with a different key encryption key")
+	}
+
+	key, err := w.aead.Open(nil, wrapped[len(w.id):nonceEnd], wrapped[nonceEnd:], w.id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrapped data key", ErrDecrypt)
+	}
+	return key, nil
+}
+
+// vaultTransit wraps data keys with a Vault transit key. Unwrapped keys are
+// cached in memory, since serving an asset would otherwise cost a Vault
+// round trip every time.
+type vaultTransit struct {
+	addr       string
+	token      string
+	namespace  string
+	mount      string
+	name       string
+	httpClient *http.Client
+
+	mu     sync.Mutex
+	cached map[string][]byte
+}
+
+func newVaultTransit(key string) (*vaultTransit, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	token := os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return nil, errors.New("VAULT_ADDR and VAULT_TOKEN must be set for vault-transit keys")
+	}
+
+	mount, name := "transit", key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		mount, name = key[:i], key[i+1:]
+	}
+
+	return &vaultTransit{
+		addr:       strings.TrimSuffix(addr, "/"),
+		token:      token,
+		namespace:  os.Getenv("VAULT_NAMESPACE"),
+		mount:      mount,
+		name:       name,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		cached:     make(map[string][]byte),
+	}, nil
+}
+
+func (v *vaultTransit) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	var resp struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := v.call(ctx, "encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}, &resp); err != nil {
+		return nil, err
+	}
+	return []byte(resp.Ciphertext), nil
+}
+
+func (v *vaultTransit) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	v.mu.Lock()
+	key, ok := v.cached[string(wrapped)]
+	v.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	var resp struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := v.call(ctx, "decrypt", map[string]string{"ciphertext": string(wrapped)}, &resp); err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("decode vault plaintext: %w", err)
+	}
+
+	v.mu.Lock()
+	v.cached[string(wrapped)] = key
+	v.mu.Unlock()
+	return key, nil
+}
+
+// call POSTs to the transit key's operation endpoint and decodes the
+// response's data into out
+func (v *vaultTransit) call(ctx context.Context, op string, body any, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("encode vault request: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", v.addr, v.mount, op, v.name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	req.Header.Set("Content-Type", "application/json")
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s: %w", op, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("vault %s: status %d: %s", op, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&envelope); err != nil {
+		return fmt.Errorf("decode vault response: %w", err)
+	}
+	if err := json.Unmarshal(envelope.Data, out); err != nil {
+		return fmt.Errorf("decode vault response: %w", err)
+	}
+	return nil
+}
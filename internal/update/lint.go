@@ -0,0 +1,229 @@
+package update
+
+import (
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the manifest schema version understood by this client.
+// Schema 2 added install_dirs.
+const SchemaVersion = 2
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// LintManifest checks a manifest for problems that would make clients fail
+// or misbehave, returning one error per problem found
+func LintManifest(m *Manifest) []error {
+	var issues []error
+	report := func(format string, args ...any) {
+		issues = append(issues, fmt.Errorf(format, args...))
+	}
+
+	if m.SchemaVersion < 1 || m.SchemaVersion > SchemaVersion {
+		report("unsupported schema version %d", m.SchemaVersion)
+	}
+	if m.Channel != "" {
+		if err := ValidateChannel(m.Channel); err != nil {
+			report("%v", err)
+		}
+	}
+	if !m.Expires.IsZero() && !m.Expires.After(m.Generated) {
+		report("expires %s is not after generated %s", m.Expires.Format(time.RFC3339), m.Generated.Format(time.RFC3339))
+	}
+
+	names := make([]string, 0, len(m.Components))
+	for name := range m.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		comp := m.Components[name]
+
+		// An alias lists a renamed component's release under a former name,
+		// and must be the release listed under the new one
+		if target, ok := m.Components[comp.Name]; comp.Name != name && (!ok || target.Name != comp.Name || target.Version != comp.Version) {
+			report("component %q: name field is %q, which isn't listed with the same version", name, comp.Name)
+		}
+		if _, err := ParseVersion(comp.Version); err != nil {
+			report("component %q: %v", name, err)
+		}
+		if len(comp.Assets) == 0 {
+			report("component %q: no assets", name)
+		}
+		if comp.DeferSeconds < 0 {
+			report("component %q: negative defer_seconds %d", name, comp.DeferSeconds)
+		} else if comp.DeferSeconds > 0 && comp.Critical {
+			report("component %q: critical release is deferred", name)
+		}
+		if comp.Restart != nil {
+			if err := lintRestart(comp.Restart); err != nil {
+				report("component %q: restart %v", name, err)
+			}
+		}
+		for _, goos := range slices.Sorted(maps.Keys(comp.InstallDirs)) {
+			if err := lintInstallDir(comp.InstallDirs[goos]); err != nil {
+				report("component %q: install dir for %s %v", name, goos, err)
+			}
+		}
+
+		platforms := make([]string, 0, len(comp.Assets))
+		for platform := range comp.Assets {
+			platforms = append(platforms, platform)
+		}
+		sort.Strings(platforms)
+
+		for _, platform := range platforms {
+			asset := comp.Assets[platform]
+			where := fmt.Sprintf("component %q platform %q", name, platform)
+
+			if goos, goarch, ok := strings.Cut(platform, "-"); !ok || goos == "" || goarch == "" {
+				report("%s: platform is not in os-arch form", where)
+			}
+			if !sha256Pattern.MatchString(asset.SHA256) {
+				report("%s: malformed sha256 %q", where, asset.SHA256)
+			}
+			algorithms := make([]string, 0, len(asset.Hashes))
+			for algorithm := range asset.Hashes {
+				algorithms = append(algorithms, algorithm)
+			}
+			sort.Strings(algorithms)
+			for _, algorithm := range algorithms {
+				if err := lintDigest(algorithm, asset.Hashes[algorithm], asset.SHA256); err != nil {
+					report("%s: %v", where, err)
+				}
+			}
+			if asset.Size <= 0 {
+				report("%s: invalid size %d", where, asset.Size)
+			}
+			if err := lintAssetURL(asset.URL); err != nil {
+				report("%s: %v", where, err)
+			}
+			if asset.Format != "" && asset.Format != FormatTarGz && asset.Format != FormatZip {
+				report("%s: unknown format %q", where, asset.Format)
+			}
+			if asset.SignatureURL != "" {
+				if err := lintAssetURL(asset.SignatureURL); err != nil {
+					report("%s: signature %v", where, err)
+				}
+			}
+			if asset.GPGSignatureURL != "" {
+				if err := lintAssetURL(asset.GPGSignatureURL); err != nil {
+					report("%s: gpg signature %v", where, err)
+				}
+			}
+			if asset.ProvenanceURL != "" {
+				if err := lintAssetURL(asset.ProvenanceURL); err != nil {
+					report("%s: provenance %v", where, err)
+				}
+			}
+			if asset.SBOMURL != "" {
+				if err := lintAssetURL(asset.SBOMURL); err != nil {
+					report("%s: sbom %v", where, err)
+				}
+			}
+		}
+	}
+
+	return issues
+}
+
+// windowsAbsPattern matches absolute Windows paths, which filepath can't
+// tell apart on other platforms
+var windowsAbsPattern = regexp.MustCompile(`^[A-Za-z]:\\`)
+
+// lintInstallDir checks an install directory is absolute on some platform
+func lintInstallDir(dir string) error {
+	if !strings.HasPrefix(dir, "/") && !windowsAbsPattern.MatchString(dir) {
+		return fmt.Errorf("%q is not absolute", dir)
+	}
+	return nil
+}
+
+func lintRestart(r *Restart) error {
+	if r.VersionURL != "" {
+		if r.Mode == RestartNone {
+			return fmt.Errorf("mode %q restarts nothing to check the version_url of", r.Mode)
+		}
+		if u, err := url.Parse(r.VersionURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("version_url %q is not an http(s) URL", r.VersionURL)
+		}
+	}
+	if r.VersionTimeoutSeconds < 0 {
+		return fmt.Errorf("negative version_timeout_seconds %d", r.VersionTimeoutSeconds)
+	}
+	if r.QuiesceTimeoutSeconds < 0 {
+		return fmt.Errorf("negative quiesce_timeout_seconds %d", r.QuiesceTimeoutSeconds)
+	}
+	if r.Group != "" && r.User == "" {
+		return fmt.Errorf("group %q requires a user", r.Group)
+	}
+	if r.User != "" && r.Mode != RestartExec && r.Mode != RestartCommand {
+		return fmt.Errorf("mode %q starts no process to run as user %q", r.Mode, r.User)
+	}
+
+	switch r.Mode {
+	case RestartExec, RestartNone:
+		return nil
+	case RestartCommand:
+		if len(r.Command) == 0 {
+			return fmt.Errorf("mode %q requires a command", r.Mode)
+		}
+		return nil
+	case RestartSystemd:
+		if r.Unit == "" {
+			return fmt.Errorf("mode %q requires a unit", r.Mode)
+		}
+		return nil
+	case RestartAdmin:
+		if r.AdminSocket == "" {
+			return fmt.Errorf("mode %q requires an admin_socket", r.Mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q", r.Mode)
+	}
+}
+
+func lintAssetURL(raw string) error {
+	if raw == "" {
+		return fmt.Errorf("missing url")
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+
+	// Relative paths are resolved against the update server
+	if u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/") {
+		return nil
+	}
+	if (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return nil
+	}
+
+	return fmt.Errorf("url %q is neither a server path nor an http(s) URL", raw)
+}
+
+// lintDigest checks one of an asset's extra digests
+func lintDigest(algorithm, digest, sha256 string) error {
+	h, ok := newHash(algorithm)
+	if !ok {
+		return fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+	if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != h.Size() || strings.ToLower(digest) != digest {
+		return fmt.Errorf("malformed %s %q", algorithm, digest)
+	}
+	if algorithm == HashSHA256 && digest != sha256 {
+		return fmt.Errorf("hashes.sha256 %q differs from sha256 %q", digest, sha256)
+	}
+	return nil
+}
@@ -1,18 +1,99 @@
 package update
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"runtime"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/strictjson"
 )
 
 // Manifest represents the server-side version manifest
 type Manifest struct {
-	SchemaVersion int                  `json:"schema_version"`
-	Generated     time.Time            `json:"generated"`
-	Components    map[string]Component `json:"components"`
+	SchemaVersion int       `json:"schema_version"`
+	Generated     time.Time `json:"generated"`
+	// Expires is when clients stop accepting the manifest, so a stale copy
+	// can't be replayed to freeze them on old versions. Zero never expires,
+	// which clients only accept of manifests they don't verify.
+	Expires time.Time `json:"expires,omitzero"`
+	// Channel is the release channel the manifest is for; empty is stable.
+	// It is covered by the signature, so clients can't be handed another
+	// channel's manifest.
+	Channel string `json:"channel,omitempty"`
+	// NextCheckAfter asks clients to wait this many seconds before checking
+	// again, so the server can shed load without client configuration
+	NextCheckAfter int64                `json:"next_check_after,omitempty"`
+	Components     map[string]Component `json:"components"`
+
+	// heldRollouts are the releases the server is rolling out but held back
+	// from this client, as its response said; they aren't signed, and only
+	// explain why no update is offered
+	heldRollouts []HeldRollout
+	// targets are the targeting rules that decided components' releases
+	// for this client, by component, as its response said
+	targets map[string]string
+}
+
+// MaxManifestSize caps how much of a manifest is read; manifests list a
+// handful of components with a few assets each, far less than this
+const MaxManifestSize = 4 << 20
+
+// ParseManifest decodes a manifest, refusing documents that are too large or
+// deeply nested, repeat keys, or carry fields this client doesn't know, so a
+// compromised or buggy server can neither exhaust its memory nor slip in
+// fields it would silently drop. A manifest of a newer schema may add fields:
+// it still gets the structural checks, but unknown fields are ignored.
+func ParseManifest(data []byte) (*Manifest, error) {
+	if err := strictjson.Check(data, MaxManifestSize); err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if header.SchemaVersion > SchemaVersion {
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, err
+		}
+		return &manifest, nil
+	}
+	if err := strictjson.Decode(data, MaxManifestSize, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// ErrManifestStale is returned for a manifest that has expired or is older
+// than the client accepts
+var ErrManifestStale = errors.New("manifest is stale")
+
+// ErrManifestNoExpiry is returned for a verified manifest without an expiry,
+// which could be replayed forever
+var ErrManifestNoExpiry = errors.New("signed manifest has no expiry")
+
+// manifestClockSkew is how far the server's clock may be ahead of or behind
+// the client's when judging manifest freshness
+const manifestClockSkew = time.Minute
+
+// CheckFresh returns ErrManifestStale when the manifest has expired at now or,
+// with a non-zero maxAge, was generated more than maxAge ago
+func (m *Manifest) CheckFresh(now time.Time, maxAge time.Duration) error {
+	if !m.Expires.IsZero() && now.After(m.Expires.Add(manifestClockSkew)) {
+		return fmt.Errorf("%w: expired at %s", ErrManifestStale, m.Expires.Format(time.RFC3339))
+	}
+	if maxAge > 0 && now.Sub(m.Generated) > maxAge+manifestClockSkew {
+		return fmt.Errorf("%w: generated at %s, more than %s ago", ErrManifestStale, m.Generated.Format(time.RFC3339), maxAge)
+	}
+	return nil
 }
 
 // Component represents a single updatable binary
@@ -21,14 +102,115 @@ type Component struct {
 	Version     string           `json:"version"`
 	ReleaseDate time.Time        `json:"release_date"`
 	Changelog   string           `json:"changelog,omitempty"`
+	Restart     *Restart         `json:"restart,omitempty"`
 	Assets      map[string]Asset `json:"assets"`
+	// Critical releases, e.g. security fixes, are never deferred
+	Critical bool `json:"critical,omitempty"`
+	// DeferSeconds asks clients not yet on Version to wait this long before
+	// updating, so a busy server can spread out the downloads
+	DeferSeconds int64 `json:"defer_seconds,omitempty"`
+	// InstallDirs are the directories the release is installed in, by OS
+	// (GOOS); clients installed elsewhere move there as they update
+	InstallDirs map[string]string `json:"install_dirs,omitempty"`
+}
+
+// Restart modes for a component after it has been updated
+const (
+	RestartExec    = "exec"    // run the updated binary with Args
+	RestartCommand = "command" // run an arbitrary Command
+	RestartSystemd = "systemd" // restart a systemd Unit
+	RestartNone    = "none"    // leave restarting to the operator
+	RestartAdmin   = "admin"   // tell the service on AdminSocket to restart
+)
+
+// Restart describes how a component is restarted after an update. A nil
+// Restart means the updated binary is run with the "version" argument.
+type Restart struct {
+	Mode    string   `json:"mode"`
+	Args    []string `json:"args,omitempty"`
+	Command []string `json:"command,omitempty"`
+	Unit    string   `json:"unit,omitempty"`
+	// DowntimeSeconds is the publisher's estimate of how long the component
+	// is unavailable while it restarts after an update
+	DowntimeSeconds int64 `json:"downtime_seconds,omitempty"`
+	// VersionURL is the component's version endpoint (see package
+	// buildinfo). After restarting, the updater waits for it to report the
+	// new version and rolls back when it doesn't within
+	// VersionTimeoutSeconds.
+	VersionURL            string `json:"version_url,omitempty"`
+	VersionTimeoutSeconds int64  `json:"version_timeout_seconds,omitempty"`
+	// AdminSocket is the running service's admin socket (see package
+	// quiesce). The updater asks it to quiesce before swapping the binary,
+	// waiting up to QuiesceTimeoutSeconds, and to resume if the update fails.
+	AdminSocket           string `json:"admin_socket,omitempty"`
+	QuiesceTimeoutSeconds int64  `json:"quiesce_timeout_seconds,omitempty"`
+	// User and Group, when set, are who the restarted process runs as, so
+	// an updater running as root doesn't hand its rights to the component.
+	// Group defaults to the user's primary group.
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
 }
 
 // Asset represents a downloadable binary for a specific platform
 type Asset struct {
-	URL    string `json:"url"`
-	Size   int64  `json:"size"`
-	SHA256 string `json:"sha256"`
+	URL             string `json:"url"`
+	Size            int64  `json:"size"`
+	SHA256          string `json:"sha256"`
+	SignatureURL    string `json:"signature_url,omitempty"`
+	GPGSignatureURL string `json:"gpg_signature_url,omitempty"`
+	ProvenanceURL   string `json:"provenance_url,omitempty"`
+	SBOMURL         string `json:"sbom_url,omitempty"`
+	SBOMFormat      string `json:"sbom_format,omitempty"`
+	Format          string `json:"format,omitempty"`
+	// Hashes holds further digests by algorithm (sha512, blake3). Clients
+	// verify the strongest they support; SHA256 stays for older clients.
+	Hashes map[string]string `json:"hashes,omitempty"`
+	// KeyID, when set, names the content key the asset is encrypted end to
+	// end with; Size, SHA256, and Hashes describe the ciphertext
+	KeyID string `json:"key_id,omitempty"`
+	// Hooks are the hook scripts an archive asset carries, in run order
+	Hooks []string `json:"hooks,omitempty"`
+}
+
+// RestartFile is the name of the optional file in a component's directory
+// that holds its Restart policy
+const RestartFile = "restart.json"
+
+// ChangelogFile is the name of the release notes file stored alongside a
+// component version's assets
+const ChangelogFile = "CHANGELOG.md"
+
+// CriticalFile is the name of the marker file in a component version's
+// directory that makes the release critical
+const CriticalFile = "CRITICAL"
+
+// InstallFile is the name of the optional file in a component version's
+// directory that holds the release's InstallDirs
+const InstallFile = "install.json"
+
+// AssetURL returns the server path from which an asset is downloaded
+func AssetURL(component, platform, version string) string {
+	return fmt.Sprintf("/v1/download/%s/%s/%s", component, platform, version)
+}
+
+// SignatureURL returns the server path of an asset's minisign signature
+func SignatureURL(component, platform, version string) string {
+	return fmt.Sprintf("/v1/signature/%s/%s/%s", component, platform, version)
+}
+
+// GPGSignatureURL returns the server path of an asset's armored GPG signature
+func GPGSignatureURL(component, platform, version string) string {
+	return fmt.Sprintf("/v1/gpg-signature/%s/%s/%s", component, platform, version)
+}
+
+// ProvenanceURL returns the server path of an asset's SLSA provenance
+func ProvenanceURL(component, platform, version string) string {
+	return fmt.Sprintf("/v1/provenance/%s/%s/%s", component, platform, version)
+}
+
+// SBOMURL returns the server path of an asset's software bill of materials
+func SBOMURL(component, platform, version string) string {
+	return fmt.Sprintf("/v1/sbom/%s/%s/%s", component, platform, version)
 }
 
 // CurrentPlatform returns the platform key for the current OS/arch
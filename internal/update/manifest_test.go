@@ -0,0 +1,198 @@
+package update
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/strictjson"
+)
+
+// manifestJSON returns a manifest document of schema with the components,
+// each a JSON object, and extra top-level fields appended
+func manifestJSON(schema int, components map[string]string, extra string) string {
+	var entries []string
+	for _, name := range slices.Sorted(maps.Keys(components)) {
+		entries = append(entries, fmt.Sprintf("%q:%s", name, components[name]))
+	}
+	return fmt.Sprintf(`{"schema_version":%d,"generated":"2026-01-01T00:00:00Z","expires":"2026-01-02T00:00:00Z"%s,"components":{%s}}`,
+		schema, extra, strings.Join(entries, ","))
+}
+
+// componentJSON returns a component of version with an asset for each
+// platform, and extra fields appended to the first asset
+func componentJSON(name, version string, extra string, platforms ...string) string {
+	var assets []string
+	for i, plat := range platforms {
+		asset := fmt.Sprintf(`{"url":"/v1/download/%s/%s/%s","size":1,"sha256":"%s"`, name, plat, version, strings.Repeat("ab", 32))
+		if i == 0 {
+			asset += extra
+		}
+		assets = append(assets, fmt.Sprintf("%q:%s}", plat, asset))
+	}
+	return fmt.Sprintf(`{"name":%q,"version":%q,"release_date":"2026-01-01T00:00:00Z","assets":{%s}}`, name, version, strings.Join(assets, ","))
+}
+
+// nestedJSON returns arrays nested depth levels deep
+func nestedJSON(depth int) string {
+	return strings.Repeat("[", depth) + strings.Repeat("]", depth)
+}
+
+func TestManifestDecodingLimits(t *testing.T) {
+	valid := manifestJSON(SchemaVersion, map[string]string{"nametag": componentJSON("nametag", "1.0.0", "", "linux-amd64")}, "")
+
+	tests := []struct {
+		name    string
+		data    string
+		wantErr error
+	}{
+		{"valid", valid, nil},
+		{"at the size limit", valid + strings.Repeat(" ", MaxManifestSize-len(valid)), nil},
+		{"over the size limit", valid + strings.Repeat(" ", MaxManifestSize-len(valid)+1), strictjson.ErrTooLarge},
+		{"nested too deeply", manifestJSON(SchemaVersion+1, nil, `,"future":`+nestedJSON(strictjson.MaxDepth)), strictjson.ErrTooDeep},
+		{"nested within the limit", manifestJSON(SchemaVersion+1, nil, `,"future":`+nestedJSON(strictjson.MaxDepth-1)), nil},
+		{"duplicate key", manifestJSON(SchemaVersion, nil, `,"generated":"2030-01-01T00:00:00Z"`), strictjson.ErrDuplicateKey},
+		{"duplicate key in another case", manifestJSON(SchemaVersion, nil, `,"Components":{}`), strictjson.ErrDuplicateKey},
+		{"duplicate component", `{"schema_version":2,"components":{"nametag":{},"nametag":{}}}`, strictjson.ErrDuplicateKey},
+		{"duplicate key in an asset", manifestJSON(SchemaVersion, map[string]string{"nametag": componentJSON("nametag", "1.0.0", `,"sha256":"00"`, "linux-amd64")}, ""), strictjson.ErrDuplicateKey},
+		{"duplicate key of a newer schema", manifestJSON(SchemaVersion+1, nil, `,"future":1,"future":2`), strictjson.ErrDuplicateKey},
+		{"unknown field", manifestJSON(SchemaVersion, nil, `,"future":1`), errAny},
+		{"unknown field in an asset", manifestJSON(SchemaVersion, map[string]string{"nametag": componentJSON("nametag", "1.0.0", `,"future":1`, "linux-amd64")}, ""), errAny},
+		{"unknown field of a newer schema", manifestJSON(SchemaVersion+1, nil, `,"future":1`), nil},
+		{"unknown asset field of a newer schema", manifestJSON(SchemaVersion+1, map[string]string{"nametag": componentJSON("nametag", "1.0.0", `,"future":1`, "linux-amd64")}, ""), nil},
+		{"trailing data", valid + ` {}`, errAny},
+		{"not an object", `[]`, errAny},
+		{"wrong type", `{"schema_version":"2","components":{}}`, errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Run("ParseManifest", func(t *testing.T) {
+				_, err := ParseManifest([]byte(tt.data))
+				checkErr(t, err, tt.wantErr)
+			})
+			t.Run("DecodeManifest", func(t *testing.T) {
+				_, err := DecodeManifest([]byte(tt.data), ManifestLimits{})
+				checkErr(t, err, tt.wantErr)
+			})
+		})
+	}
+}
+
+func TestDecodeManifestLimits(t *testing.T) {
+	data := manifestJSON(SchemaVersion, map[string]string{
+		"nametag":    componentJSON("nametag", "1.0.0", "", "linux-amd64"),
+		"nametag-up": componentJSON("nametag-up", "1.0.0", "", "linux-amd64", "linux-arm64", "darwin-arm64"),
+	}, "")
+
+	tests := []struct {
+		name       string
+		limits     ManifestLimits
+		components []string
+		wantErr    error
+		// want is the components decoded
+		want []string
+	}{
+		{"no limits", ManifestLimits{}, nil, nil, []string{"nametag", "nametag-up"}},
+		{"named components", ManifestLimits{}, []string{"nametag"}, nil, []string{"nametag"}},
+		{"size", ManifestLimits{MaxSize: len(data) - 1}, nil, strictjson.ErrTooLarge, nil},
+		{"size, exactly", ManifestLimits{MaxSize: len(data)}, nil, nil, []string{"nametag", "nametag-up"}},
+		{"components", ManifestLimits{MaxComponents: 1}, nil, ErrManifestLimit, nil},
+		{"components, counting skipped ones", ManifestLimits{MaxComponents: 1}, []string{"nametag"}, ErrManifestLimit, nil},
+		{"components, exactly", ManifestLimits{MaxComponents: 2}, nil, nil, []string{"nametag", "nametag-up"}},
+		{"assets", ManifestLimits{MaxAssets: 2}, nil, ErrManifestLimit, nil},
+		{"assets of a skipped component", ManifestLimits{MaxAssets: 2}, []string{"nametag"}, nil, []string{"nametag"}},
+		{"assets, exactly", ManifestLimits{MaxAssets: 3}, nil, nil, []string{"nametag", "nametag-up"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, err := DecodeManifest([]byte(data), tt.limits, tt.components...)
+			checkErr(t, err, tt.wantErr)
+			if err != nil {
+				return
+			}
+			if got := slices.Sorted(maps.Keys(manifest.Components)); !slices.Equal(got, tt.want) {
+				t.Errorf("decoded components %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// manifestSeeds are the corpus of the manifest fuzz tests
+func manifestSeeds() []string {
+	return []string{
+		manifestJSON(SchemaVersion, map[string]string{"nametag": componentJSON("nametag", "1.0.0", "", "linux-amd64", "windows-amd64")}, ""),
+		manifestJSON(SchemaVersion+1, map[string]string{"nametag": componentJSON("nametag", "1.0.0", `,"future":[1,{"a":null}]`, "linux-amd64")}, `,"future":true`),
+		manifestJSON(SchemaVersion, nil, `,"generated":"2026-01-01T00:00:00Z"`),
+		`{"schema_version":2,"components":null}`,
+		`{"schema_version":2,"components":{"a":{"assets":{"linux-amd64":{}}}}}`,
+		`{}`,
+	}
+}
+
+func FuzzParseManifest(f *testing.F) {
+	for _, seed := range manifestSeeds() {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Anything may be rejected, but nothing may panic, and what is
+		// accepted must survive a round trip
+		manifest, err := ParseManifest(data)
+		if err != nil {
+			return
+		}
+		encoded, err := json.Marshal(manifest)
+		if err != nil {
+			// Times beyond year 9999 decode but don't encode
+			return
+		}
+		again, err := ParseManifest(encoded)
+		if err != nil {
+			t.Fatalf("ParseManifest() refused its own output %s: %v", encoded, err)
+		}
+		if reencoded, _ := json.Marshal(again); string(reencoded) != string(encoded) {
+			t.Fatalf("round trip changed the manifest:\n%s\n%s", encoded, reencoded)
+		}
+	})
+}
+
+func FuzzDecodeManifest(f *testing.F) {
+	for _, seed := range manifestSeeds() {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Decoding component by component must agree with decoding the
+		// whole document
+		decoded, err := DecodeManifest(data, ManifestLimits{})
+		parsed, parseErr := ParseManifest(data)
+		if (err == nil) != (parseErr == nil) {
+			t.Fatalf("DecodeManifest() = %v, ParseManifest() = %v", err, parseErr)
+		}
+		if err != nil {
+			return
+		}
+		if parsed.Components == nil {
+			parsed.Components = map[string]Component{}
+		}
+		want, err := json.Marshal(parsed)
+		if err != nil {
+			return
+		}
+		if got, _ := json.Marshal(decoded); string(got) != string(want) {
+			t.Fatalf("DecodeManifest() = %s, ParseManifest() = %s", got, want)
+		}
+
+		// Only the named components are decoded
+		for name := range decoded.Components {
+			one, err := DecodeManifest(data, ManifestLimits{}, name)
+			if err != nil {
+				t.Fatalf("DecodeManifest(%q) = %v", name, err)
+			}
+			if len(one.Components) != 1 {
+				t.Fatalf("DecodeManifest(%q) decoded %d components", name, len(one.Components))
+			}
+		}
+	})
+}
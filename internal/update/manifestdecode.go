@@ -0,0 +1,178 @@
+package update
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/strictjson"
+)
+
+// ManifestLimits bound what decoding a manifest may cost, for clients on
+// small devices. Zero fields take the defaults: MaxManifestSize, and no limit
+// on components or assets.
+type ManifestLimits struct {
+	// MaxSize is the largest manifest accepted, in bytes. The whole
+	// document is held in memory, since its signatures cover all of it.
+	MaxSize int
+	// MaxComponents is how many components the manifest may list, decoded
+	// or not
+	MaxComponents int
+	// MaxAssets is how many platforms a decoded component may have assets
+	// for
+	MaxAssets int
+}
+
+// ErrManifestLimit is returned for a manifest over a ManifestLimits bound
+var ErrManifestLimit = errors.New("manifest exceeds limit")
+
+func (l ManifestLimits) maxSize() int {
+	return cmp.Or(l.MaxSize, MaxManifestSize)
+}
+
+// DecodeManifest decodes a manifest like ParseManifest, but only the named
+// components, or all of them when none are named. The others are skipped
+// token by token, so a manifest listing hundreds of components costs little
+// more than its bytes.
+func DecodeManifest(data []byte, limits ManifestLimits, components ...string) (*Manifest, error) {
+	if err := strictjson.Check(data, limits.maxSize()); err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	// A manifest of a newer schema may add fields, which are ignored
+	strict := header.SchemaVersion <= SchemaVersion
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	// Everything but the components is small, and decoded as a whole once
+	// they're taken out
+	rest := make(map[string]json.RawMessage)
+	decoded := make(map[string]Component)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := tok.(string)
+		if !strings.EqualFold(key, "components") {
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return nil, err
+			}
+			rest[key] = value
+			continue
+		}
+		if err := decodeComponents(dec, limits, components, decoded); err != nil {
+			return nil, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+
+	head, err := json.Marshal(rest)
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if strict {
+		err = strictjson.Decode(head, len(head), &manifest)
+	} else {
+		err = json.Unmarshal(head, &manifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest.Components = decoded
+	return &manifest, nil
+}
+
+// decodeComponents decodes the wanted entries of the components object into
+// decoded, skipping the rest
+func decodeComponents(dec *json.Decoder, limits ManifestLimits, wanted []string, decoded map[string]Component) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("components: expected an object, got %v", tok)
+	}
+
+	count := 0
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name := tok.(string)
+		if count++; limits.MaxComponents > 0 && count > limits.MaxComponents {
+			return fmt.Errorf("%w: more than %d components", ErrManifestLimit, limits.MaxComponents)
+		}
+
+		if len(wanted) > 0 && !slices.Contains(wanted, name) {
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+			continue
+		}
+		var comp Component
+		if err := dec.Decode(&comp); err != nil {
+			return fmt.Errorf("component %s: %w", name, err)
+		}
+		if limits.MaxAssets > 0 && len(comp.Assets) > limits.MaxAssets {
+			return fmt.Errorf("%w: component %s has %d assets, at most %d", ErrManifestLimit, name, len(comp.Assets), limits.MaxAssets)
+		}
+		decoded[name] = comp
+	}
+	return expectDelim(dec, '}')
+}
+
+// skipValue reads past the next value without decoding it
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %v, got %v", delim, tok)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package update
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MinisignExtension is the conventional suffix of detached signature files
+const MinisignExtension = ".minisig"
+
+// minisignAlgorithm identifies an Ed25519 signature over the raw file, the
+// variant minisign calls "legacy" and still verifies by default
+var minisignAlgorithm = [2]byte{'E', 'd'}
+
+// MinisignKeyID derives the 8-byte minisign key ID for an Ed25519 public key
+func MinisignKeyID(key ed25519.PublicKey) [8]byte {
+	var id [8]byte
+	sum := sha256.Sum256(key)
+	copy(id[:], sum[:8])
+	return id
+}
+
+// MinisignPublicKey encodes key in minisign's public key format, suitable for
+// `minisign -V -P <key>`
+func MinisignPublicKey(key ed25519.PublicKey) string {
+	id := MinisignKeyID(key)
+
+	var raw bytes.Buffer
+	raw.Write(minisignAlgorithm[:])
+	raw.Write(id[:])
+	raw.Write(key)
+
+	return base64.StdEncoding.EncodeToString(raw.Bytes())
+}
+
+// MinisignSign produces a minisign-compatible detached signature of data
+func MinisignSign(key ed25519.PrivateKey, data []byte, trustedComment string) string {
+	// A private key in memory can't fail to sign
+	signature, _ := MinisignSignWith(key, data, trustedComment)
+	return signature
+}
+
+// MinisignSignWith is MinisignSign for any Ed25519 signer, such as a key held
+// on a hardware token, which may fail
+func MinisignSignWith(signer crypto.Signer, data []byte, trustedComment string) (string, error) {
+	public, err := SignerPublicKey(signer)
+	if err != nil {
+		return "", err
+	}
+	id := MinisignKeyID(public)
+	signature, err := signer.Sign(nil, data, crypto.Hash(0))
+	if err != nil {
+		return "", fmt.Errorf("sign: %w", err)
+	}
+
+	var sig bytes.Buffer
+	sig.Write(minisignAlgorithm[:])
+	sig.Write(id[:])
+	sig.Write(signature)
+
+	// The global signature binds the trusted comment to the file signature
+	global, err := signer.Sign(nil, globalMessage(signature, trustedComment), crypto.Hash(0))
+	if err != nil {
+		return "", fmt.Errorf("sign trusted comment: %w", err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "untrusted comment: signature from nametag key %X\n", id)
+	fmt.Fprintf(&b, "%s\n", base64.StdEncoding.EncodeToString(sig.Bytes()))
+	fmt.Fprintf(&b, "trusted comment: %s\n", trustedComment)
+	fmt.Fprintf(&b, "%s\n", base64.StdEncoding.EncodeToString(global))
+
+	return b.String(), nil
+}
+
+// MinisignVerify verifies a minisign detached signature of data, including
+// the global signature covering the trusted comment
+func MinisignVerify(key ed25519.PublicKey, data []byte, signature string) error {
+	lines := strings.Split(strings.TrimRight(signature, "\n"), "\n")
+	if len(lines) != 4 {
+		return errors.New("malformed minisign signature")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	if len(raw) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("invalid signature size: %d", len(raw))
+	}
+
+	if [2]byte(raw[:2]) != minisignAlgorithm {
+		return fmt.Errorf("unsupported signature algorithm %q", raw[:2])
+	}
+	if [8]byte(raw[2:10]) != MinisignKeyID(key) {
+		return fmt.Errorf("signature key ID %X does not match trusted key", raw[2:10])
+	}
+
+	sig := raw[10:]
+	if !ed25519.Verify(key, data, sig) {
+		return errors.New("invalid signature")
+	}
+
+	trustedComment, ok := strings.CutPrefix(lines[2], "trusted comment: ")
+	if !ok {
+		return errors.New("missing trusted comment")
+	}
+
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return fmt.Errorf("decode global signature: %w", err)
+	}
+	if !ed25519.Verify(key, globalMessage(sig, trustedComment), global) {
+		return errors.New("invalid global signature")
+	}
+
+	return nil
+}
+
+func globalMessage(signature []byte, trustedComment string) []byte {
+	msg := make([]byte, 0, len(signature)+len(trustedComment))
+	msg = append(msg, signature...)
+	return append(msg, trustedComment...)
+}
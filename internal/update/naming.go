@@ -0,0 +1,59 @@
+package update
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// DefaultAssetTemplate is the original component-platform[.exe] naming convention
+const DefaultAssetTemplate = "{{.Component}}-{{.Platform}}{{.Ext}}"
+
+// AssetNameData is the data available to asset name templates
+type AssetNameData struct {
+	Component string
+	Version   string
+	Platform  string
+	OS        string
+	Arch      string
+	Ext       string
+}
+
+// AssetNamer renders asset filenames from a template, so artifacts produced by
+// other tooling (e.g. GoReleaser) can be served without renaming
+type AssetNamer struct {
+	tmpl *template.Template
+}
+
+// NewAssetNamer parses an asset name template
+func NewAssetNamer(text string) (*AssetNamer, error) {
+	tmpl, err := template.New("asset").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse asset template: %w", err)
+	}
+
+	return &AssetNamer{tmpl: tmpl}, nil
+}
+
+// Name returns the filename of the asset for a component version and platform
+func (n *AssetNamer) Name(component, version, platform string) (string, error) {
+	goos, goarch, _ := strings.Cut(platform, "-")
+
+	data := AssetNameData{
+		Component: component,
+		Version:   version,
+		Platform:  platform,
+		OS:        goos,
+		Arch:      goarch,
+	}
+	if goos == "windows" {
+		data.Ext = ".exe"
+	}
+
+	var b strings.Builder
+	if err := n.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("render asset name: %w", err)
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,289 @@
+package update
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+)
+
+// Option configures a Checker or Downloader
+type Option func(*options)
+
+type options struct {
+	keys       *TrustedKeys
+	tuf        *TUFClient
+	gpgKeyring string
+	channel    string
+
+	installedPath  string
+	allowDowngrade bool
+	maxAge         time.Duration
+	manifestLimits ManifestLimits
+
+	backoffPath   string
+	ignoreBackoff bool
+
+	pins       *PinSet
+	clientCert *tls.Certificate
+	rootCAs    *x509.CertPool
+
+	licenseToken string
+	provenance   *ProvenancePolicy
+
+	authToken    string
+	signRequests bool
+	tokenSource  TokenSource
+
+	verifyCachePath string
+	dictionaryPath  string
+
+	transparencyPath string
+
+	machineIDPath string
+	group         string
+
+	product string
+}
+
+func applyOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithTrustedKeys makes the Checker refuse manifests not signed by a
+// threshold of the trusted keys, and the Downloader refuse assets not signed
+// by one of them. The Checker follows key rotations published by the server.
+func WithTrustedKeys(keys *TrustedKeys) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// WithChannel makes the Checker follow a release channel other than stable:
+// it fetches the channel's manifest and refuses manifests signed for another
+// channel. The keys given with WithTrustedKeys should be the channel's own.
+func WithChannel(channel string) Option {
+	return func(o *options) {
+		o.channel = channel
+	}
+}
+
+// WithProduct makes the Checker fetch the manifest of product from a server
+// distributing several, under /v1/{product}/
+func WithProduct(product string) Option {
+	return func(o *options) {
+		o.product = product
+	}
+}
+
+// WithTUF makes the Checker build its manifest from TUF metadata verified by
+// client instead of fetching /v1/manifest.json
+func WithTUF(client *TUFClient) Option {
+	return func(o *options) {
+		o.tuf = client
+	}
+}
+
+// WithGPGKeyring makes the Downloader refuse assets without a valid detached
+// GPG signature from a key in the keyring at path
+func WithGPGKeyring(path string) Option {
+	return func(o *options) {
+		o.gpgKeyring = path
+	}
+}
+
+// WithInstalledState makes the Checker refuse to offer a version lower than
+// the highest one recorded in the installed state file at path
+func WithInstalledState(path string) Option {
+	return func(o *options) {
+		o.installedPath = path
+	}
+}
+
+// WithAllowDowngrade makes the Checker offer whatever version the server
+// lists, even one lower than the current or a previously installed version
+func WithAllowDowngrade() Option {
+	return func(o *options) {
+		o.allowDowngrade = true
+	}
+}
+
+// WithMaxManifestAge makes the Checker refuse manifests generated more than
+// maxAge ago, on top of the manifest's own expiry
+func WithMaxManifestAge(maxAge time.Duration) Option {
+	return func(o *options) {
+		o.maxAge = maxAge
+	}
+}
+
+// WithManifestLimits makes the Checker refuse manifests over limits, for
+// clients on small devices that can't afford what a large one costs to decode
+func WithManifestLimits(limits ManifestLimits) Option {
+	return func(o *options) {
+		o.manifestLimits = limits
+	}
+}
+
+// WithBackoff makes the Checker and Downloader persist the server's
+// backpressure signals, 429 and 503 Retry-After and the manifest's
+// next_check_after, in the file at path, and the Checker refuse to contact
+// the server until they have passed
+func WithBackoff(path string) Option {
+	return func(o *options) {
+		o.backoffPath = path
+	}
+}
+
+// WithIgnoreBackoff makes the Checker contact the server even while a
+// recorded backoff is in effect, and take updates the server deferred; new
+// signals are still recorded
+func WithIgnoreBackoff() Option {
+	return func(o *options) {
+		o.ignoreBackoff = true
+	}
+}
+
+// WithTLSPins makes every connection to the update server require a pinned
+// certificate or public key in its verified chain, on top of the usual CA
+// verification, so a compromised CA can't intercept updates
+func WithTLSPins(pins *PinSet) Option {
+	return func(o *options) {
+		o.pins = pins
+	}
+}
+
+// WithClientCertificate makes connections to the update server present cert,
+// for servers that only talk to enrolled machines over mutual TLS
+func WithClientCertificate(cert tls.Certificate) Option {
+	return func(o *options) {
+		o.clientCert = &cert
+	}
+}
+
+// WithRootCAs makes connections to the update server verify its certificate
+// against pool, e.g. one from LoadCABundle, instead of the system roots
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(o *options) {
+		o.rootCAs = pool
+	}
+}
+
+// backoff returns the configured backoff store, or nil
+func (o options) backoff() *Backoff {
+	if o.backoffPath == "" {
+		return nil
+	}
+	return NewBackoff(o.backoffPath)
+}
+
+// WithLicenseToken sets the token the Downloader exchanges for the content
+// keys of private assets
+func WithLicenseToken(token string) Option {
+	return func(o *options) {
+		o.licenseToken = token
+	}
+}
+
+// WithProvenancePolicy makes the Downloader refuse assets without SLSA
+// provenance that satisfies policy
+func WithProvenancePolicy(policy *ProvenancePolicy) Option {
+	return func(o *options) {
+		o.provenance = policy
+	}
+}
+
+// WithAuthToken makes the Checker and Downloader present token as their API
+// key to update servers that require one for manifests and downloads
+func WithAuthToken(token string) Option {
+	return func(o *options) {
+		o.authToken = token
+	}
+}
+
+// WithSignedRequests makes the Checker and Downloader sign their requests
+// with the API key given with WithAuthToken instead of sending it, so
+// captured requests can't be replayed
+func WithSignedRequests() Option {
+	return func(o *options) {
+		o.signRequests = true
+	}
+}
+
+// WithTokenSource makes the Checker and Downloader send a bearer token from
+// source with their requests, for update servers behind an identity provider
+func WithTokenSource(source TokenSource) Option {
+	return func(o *options) {
+		o.tokenSource = source
+	}
+}
+
+// WithVerifyCache makes the Checker and Downloader remember successful
+// signature verifications in the file at path and skip repeating them
+func WithVerifyCache(path string) Option {
+	return func(o *options) {
+		o.verifyCachePath = path
+	}
+}
+
+// WithManifestDictionary makes the Checker keep the dictionary the server
+// offers for its manifest in the file at path, and fetch manifests
+// compressed against it
+func WithManifestDictionary(path string) Option {
+	return func(o *options) {
+		o.dictionaryPath = path
+	}
+}
+
+// WithMachineID makes the Checker identify the client to the server by the
+// machine ID kept in the file at path, created on first use, so the server
+// can place it in staged rollouts. Without one, a client is offered staged
+// releases only once they reach everyone.
+func WithMachineID(path string) Option {
+	return func(o *options) {
+		o.machineIDPath = path
+	}
+}
+
+// WithGroup makes the Checker tell the server the client belongs to group,
+// e.g. pilot, which targeting rules may offer releases by
+func WithGroup(group string) Option {
+	return func(o *options) {
+		o.group = group
+	}
+}
+
+// WithTransparencyLog makes the Checker refuse an update unless the server's
+// transparency log proves to contain its asset, in a checkpoint consistent
+// with the last one verified, which is kept in the file at path
+func WithTransparencyLog(path string) Option {
+	return func(o *options) {
+		o.transparencyPath = path
+	}
+}
+
+// transparency returns the configured transparency log client, or nil
+func (o options) transparency() *TransparencyClient {
+	if o.transparencyPath == "" {
+		return nil
+	}
+	return NewTransparencyClient(o.transparencyPath)
+}
+
+// dictionary returns the configured manifest dictionary store, or nil
+func (o options) dictionary() *dictionaryStore {
+	if o.dictionaryPath == "" {
+		return nil
+	}
+	return &dictionaryStore{path: o.dictionaryPath}
+}
+
+// verifyCache returns the configured verification cache, or nil
+func (o options) verifyCache() *VerifyCache {
+	if o.verifyCachePath == "" {
+		return nil
+	}
+	return NewVerifyCache(o.verifyCachePath)
+}
@@ -0,0 +1,145 @@
+package update
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PIVToolEnv names the yubico-piv-tool binary to use instead of the one on
+// the PATH, and PIVPINEnv the PIN to unlock the token with instead of
+// prompting for it
+const (
+	PIVToolEnv = "NAMETAG_PIV_TOOL"
+	PIVPINEnv  = "NAMETAG_PIV_PIN"
+)
+
+// touchPromptDelay is how long signing may take before the token is assumed
+// to be waiting for its PIN or a touch
+const touchPromptDelay = time.Second
+
+// pivSlotPattern matches PIV key slots: 9a, 9c, 9d, 9e, and the retired key
+// slots 82 to 95
+var pivSlotPattern = regexp.MustCompile(`^(9[acde]|8[2-9a-f]|9[0-5])$`)
+
+// PIVSigner signs with an Ed25519 key in a PIV slot of a hardware token,
+// such as a YubiKey with firmware 5.7 or later, through yubico-piv-tool. The
+// private key never leaves the token. The slot's certificate supplies the
+// public key.
+type PIVSigner struct {
+	slot   string
+	tool   string
+	public ed25519.PublicKey
+	// Prompt is called when the token seems to be waiting for the operator,
+	// to enter the PIN or touch it; by default a note goes to stderr
+	Prompt func(slot string)
+	// Out receives the tool's prompts and messages; stderr by default
+	Out io.Writer
+}
+
+// NewPIVSigner reads the certificate in slot and returns a signer for its key
+func NewPIVSigner(slot string) (*PIVSigner, error) {
+	slot = strings.ToLower(slot)
+	if !pivSlotPattern.MatchString(slot) {
+		return nil, fmt.Errorf("invalid PIV slot %q", slot)
+	}
+
+	s := &PIVSigner{slot: slot, tool: "yubico-piv-tool", Out: os.Stderr}
+	if tool := os.Getenv(PIVToolEnv); tool != "" {
+		s.tool = tool
+	}
+	s.Prompt = func(slot string) {
+		fmt.Fprintf(s.Out, "Waiting for the token: enter its PIN, or touch it if it blinks (PIV slot %s)\n", slot)
+	}
+
+	out, err := exec.Command(s.tool, "-a", "read-certificate", "-s", slot).Output()
+	if err != nil {
+		return nil, fmt.Errorf("read PIV slot %s certificate: %w", slot, toolError(err))
+	}
+	block, _ := pem.Decode(out)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("PIV slot %s holds no certificate", slot)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse PIV slot %s certificate: %w", slot, err)
+	}
+	public, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("PIV slot %s key is %T, not Ed25519", slot, cert.PublicKey)
+	}
+	s.public = public
+	return s, nil
+}
+
+// Public returns the key's Ed25519 public key
+func (s *PIVSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs message on the token. Like ed25519.PrivateKey, it signs the
+// message itself, so opts must be crypto.Hash(0).
+func (s *PIVSigner) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, errors.New("ed25519: cannot sign hashed message")
+	}
+
+	dir, err := os.MkdirTemp("", "nametag-piv-")
+	if err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "message")
+	out := filepath.Join(dir, "signature")
+	if err := os.WriteFile(in, message, 0600); err != nil {
+		return nil, fmt.Errorf("write message: %w", err)
+	}
+
+	args := []string{"-s", s.slot, "-A", "ED25519", "-a", "verify-pin", "-a", "sign", "-i", in, "-o", out}
+	if pin := os.Getenv(PIVPINEnv); pin != "" {
+		args = append(args, "-P", pin)
+	}
+	cmd := exec.Command(s.tool, args...)
+	// The tool prompts for the PIN on the terminal; the signature goes to a
+	// file, so its output is only ever messages
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = s.Out
+	cmd.Stderr = s.Out
+
+	prompt := time.AfterFunc(touchPromptDelay, func() { s.Prompt(s.slot) })
+	err = cmd.Run()
+	prompt.Stop()
+	if err != nil {
+		return nil, fmt.Errorf("sign with PIV slot %s (was the token touched in time?): %w", s.slot, err)
+	}
+
+	signature, err := os.ReadFile(out)
+	if err != nil {
+		return nil, fmt.Errorf("read signature: %w", err)
+	}
+	// A wrong slot or algorithm shows up here rather than on every client
+	if !ed25519.Verify(s.public, message, signature) {
+		return nil, fmt.Errorf("PIV slot %s produced a signature its certificate's key doesn't verify", s.slot)
+	}
+	return signature, nil
+}
+
+// toolError adds what an external tool printed to its failure
+func toolError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
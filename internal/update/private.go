@@ -0,0 +1,187 @@
+package update
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Private assets are encrypted end to end at publish time with a content key
+// that only entitled clients receive, in exchange for a license token.
+// Servers, mirrors, and caches only ever hold the ciphertext, which the
+// manifest's digests and signatures cover: clients verify it as usual, then
+// decrypt. The format is that of assets encrypted at rest under its own
+// magic, with the data key wrapped by the content key.
+const privateMagic = "NTAGE2E1"
+
+// LicenseKeysPath is where clients exchange a license token for the content
+// keys it entitles them to
+const LicenseKeysPath = "/v1/license/keys"
+
+// LicenseKeys is the response of LicenseKeysPath: base64 content keys by ID
+type LicenseKeys struct {
+	Keys map[string]string `json:"keys"`
+}
+
+// ErrNotEntitled is returned when a private asset's content key is not
+// available to the client
+var ErrNotEntitled = errors.New("not entitled to the asset's content key")
+
+// LoadContentKey reads a 256-bit content key, raw or base64, and returns its
+// ID along with it
+func LoadContentKey(path string) (string, []byte, error) {
+	key, err := readKeyFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	return ContentKeyID(key), key, nil
+}
+
+// ContentKeyID identifies a content key by a prefix of its SHA-256
+func ContentKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:keyIDSize])
+}
+
+// EncryptPrivateAsset writes the end-to-end encryption of src, which must
+// hold exactly size bytes, to dst under the content key
+func EncryptPrivateAsset(dst io.Writer, src io.Reader, size int64, key []byte) error {
+	wrapper, err := newLocalKeyWrapper(key)
+	if err != nil {
+		return err
+	}
+	return encryptAsset(context.Background(), privateMagic, dst, src, size, wrapper)
+}
+
+// PrivateKeyID returns the ID of the content key the private asset read
+// from r is encrypted with, or false if it is not a private asset
+func PrivateKeyID(r io.Reader) (string, bool, error) {
+	prefix := make([]byte, len(privateMagic)+2+keyIDSize)
+	if _, err := io.ReadFull(r, prefix); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("read header: %w", err)
+	}
+
+	if string(prefix[:len(privateMagic)]) != privateMagic {
+		return "", false, nil
+	}
+	return hex.EncodeToString(prefix[len(privateMagic)+2:]), true, nil
+}
+
+// OpenPrivateAsset opens a private asset for reading its plaintext with the
+// matching one of keys, keyed by ID
+func OpenPrivateAsset(path string, keys map[string][]byte) (*AssetFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open asset: %w", err)
+	}
+
+	asset, err := openPrivateAsset(file, keys)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return asset, nil
+}
+
+func openPrivateAsset(file *os.File, keys map[string][]byte) (*AssetFile, error) {
+	id, ok, err := PrivateKeyID(file)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("not a private asset")
+	}
+
+	key, ok := keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w (key %s)", ErrNotEntitled, id)
+	}
+	wrapper, err := newLocalKeyWrapper(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return openAsset(context.Background(), file, privateMagic, wrapper)
+}
+
+// DecryptPrivateAsset replaces the private asset at path with its plaintext
+func DecryptPrivateAsset(path string, keys map[string][]byte) error {
+	asset, err := OpenPrivateAsset(path, keys)
+	if err != nil {
+		return err
+	}
+	defer asset.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".decrypt-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, asset); err != nil {
+		tmp.Close()
+		return fmt.Errorf("decrypt: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
+
+// FetchContentKeys exchanges the configured license token for the content
+// keys it entitles the client to, keyed by ID
+func (d *Downloader) FetchContentKeys(ctx context.Context, url string) (map[string][]byte, error) {
+	if d.licenseToken == "" {
+		return nil, fmt.Errorf("%w: no license token configured", ErrNotEntitled)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("User-Agent", "nametag-updater/1.0")
+	req.Header.Set("Authorization", "Bearer "+d.licenseToken)
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("exchange license token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w: license rejected with status %d", ErrNotEntitled, resp.StatusCode)
+	}
+	if err := checkStatus(resp); err != nil {
+		d.recordBackoff(err)
+		return nil, err
+	}
+
+	var body LicenseKeys
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode license keys: %w", err)
+	}
+
+	keys := make(map[string][]byte, len(body.Keys))
+	for id, encoded := range body.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != dataKeySize || ContentKeyID(key) != id {
+			return nil, fmt.Errorf("invalid content key %s", id)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
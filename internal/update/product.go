@@ -0,0 +1,39 @@
+package update
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// reservedProducts are the first segments of the default product's paths
+// under /v1/, which a product name would shadow
+var reservedProducts = []string{
+	"admin", "download", "gpg-signature", "keys", "license", "log",
+	"manifest", "manifest.json", "provenance", "sbom", "signature", "tuf", "upload",
+}
+
+// ValidateProduct checks that product can name a namespace on a server
+// distributing several products
+func ValidateProduct(product string) error {
+	if product == "" || slices.Contains(reservedProducts, product) {
+		return fmt.Errorf("invalid product name %q", product)
+	}
+	for _, r := range product {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return fmt.Errorf("invalid product name %q", product)
+		}
+	}
+	return nil
+}
+
+// ProductPath moves path, a server path under /v1/, into product's
+// namespace: /v1/manifest.json becomes /v1/{product}/manifest.json. The
+// default product, "", keeps the paths as they are.
+func ProductPath(product, path string) string {
+	rest, ok := strings.CutPrefix(path, "/v1/")
+	if product == "" || !ok {
+		return path
+	}
+	return "/v1/" + product + "/" + rest
+}
@@ -0,0 +1,331 @@
+package update
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ProvenanceExtension is the suffix of the SLSA provenance attestation stored
+// next to an asset: in-toto statements in DSSE envelopes, one per line, as
+// SLSA builders such as slsa-github-generator produce them
+const ProvenanceExtension = ".intoto.jsonl"
+
+// Payload and predicate types of the attestations the client understands
+const (
+	inTotoPayloadType   = "application/vnd.in-toto+json"
+	slsaProvenanceV1    = "https://slsa.dev/provenance/v1"
+	slsaProvenanceV02   = "https://slsa.dev/provenance/v0.2"
+	maxProvenanceLength = 4 << 20
+)
+
+// ErrProvenance is returned when an asset's provenance doesn't satisfy the
+// client's policy
+var ErrProvenance = errors.New("provenance verification failed")
+
+// ProvenancePolicy is what an asset's SLSA provenance must attest to before
+// the update is applied
+type ProvenancePolicy struct {
+	// Builder is the trusted builder ID. An ID pinned to a ref, as in
+	// ".../builder.yml@refs/tags/v2.0.0", also matches Builder without it.
+	Builder string
+	// Source is the repository the asset must be built from, e.g.
+	// "https://github.com/owner/repo"; refs and "git+" prefixes are ignored
+	Source string
+	// Keys verify the attestation's DSSE signatures
+	Keys []crypto.PublicKey
+}
+
+// Provenance is what a verified attestation says about an asset
+type Provenance struct {
+	Builder string
+	Source  string
+}
+
+// LoadProvenanceKeys reads the PEM public keys (ECDSA or Ed25519) that
+// attestations must be signed with
+func LoadProvenanceKeys(path string) ([]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read provenance keys: %w", err)
+	}
+
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse provenance key: %w", err)
+		}
+		switch key.(type) {
+		case *ecdsa.PublicKey, ed25519.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported provenance key type %T", key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys in %s", path)
+	}
+	return keys, nil
+}
+
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+	Signatures  []struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	} `json:"signatures"`
+}
+
+type inTotoStatement struct {
+	Type    string `json:"_type"`
+	Subject []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// slsaPredicate covers the fields of SLSA provenance v1 and v0.2 that name
+// the builder and the source
+type slsaPredicate struct {
+	// v1
+	BuildDefinition struct {
+		ExternalParameters struct {
+			Workflow struct {
+				Repository string `json:"repository"`
+			} `json:"workflow"`
+		} `json:"externalParameters"`
+		ResolvedDependencies []struct {
+			URI string `json:"uri"`
+		} `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+	} `json:"runDetails"`
+
+	// v0.2
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	Invocation struct {
+		ConfigSource struct {
+			URI string `json:"uri"`
+		} `json:"configSource"`
+	} `json:"invocation"`
+	Materials []struct {
+		URI string `json:"uri"`
+	} `json:"materials"`
+}
+
+// VerifyProvenance checks that one of the attestations in data is signed by
+// one of the policy's keys, has a subject with one of digests, keyed by
+// algorithm, and was built by the policy's builder from its source
+func VerifyProvenance(data []byte, digests map[string]string, policy *ProvenancePolicy) (*Provenance, error) {
+	verifyErr := errors.New("no attestations")
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, maxProvenanceLength)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		statement, err := verifyEnvelope(line, policy.Keys)
+		if err != nil {
+			verifyErr = err
+			continue
+		}
+		if !subjectMatches(statement, digests) {
+			verifyErr = errors.New("no attestation subject matches the asset")
+			continue
+		}
+
+		provenance, err := parseProvenance(statement)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrProvenance, err)
+		}
+		if err := policy.check(provenance); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrProvenance, err)
+		}
+		return provenance, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: read attestations: %w", ErrProvenance, err)
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrProvenance, verifyErr)
+}
+
+// verifyEnvelope checks a DSSE envelope's signatures and returns the
+// in-toto statement it carries
+func verifyEnvelope(line []byte, keys []crypto.PublicKey) (*inTotoStatement, error) {
+	var envelope dsseEnvelope
+	if err := json.Unmarshal(line, &envelope); err != nil {
+		return nil, fmt.Errorf("decode envelope: %w", err)
+	}
+	if envelope.PayloadType != inTotoPayloadType {
+		return nil, fmt.Errorf("unexpected payload type %q", envelope.PayloadType)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("decode payload: %w", err)
+	}
+
+	message := dssePAE(envelope.PayloadType, payload)
+	verified := false
+	for _, sig := range envelope.Signatures {
+		raw, err := base64.StdEncoding.DecodeString(sig.Sig)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			if verifyDSSESignature(key, message, raw) {
+				verified = true
+				break
+			}
+		}
+		if verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("attestation is not signed by a trusted key")
+	}
+
+	var statement inTotoStatement
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return nil, fmt.Errorf("decode statement: %w", err)
+	}
+	return &statement, nil
+}
+
+// dssePAE is the DSSE pre-authentication encoding that signatures cover
+func dssePAE(payloadType string, payload []byte) []byte {
+	return fmt.Appendf(nil, "DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+}
+
+func verifyDSSESignature(key crypto.PublicKey, message, sig []byte) bool {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(message)
+		return ecdsa.VerifyASN1(key, sum[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, sig)
+	}
+	return false
+}
+
+func subjectMatches(statement *inTotoStatement, digests map[string]string) bool {
+	for _, subject := range statement.Subject {
+		for alg, want := range subject.Digest {
+			if got, ok := digests[alg]; ok && strings.EqualFold(got, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseProvenance(statement *inTotoStatement) (*Provenance, error) {
+	var predicate slsaPredicate
+	if err := json.Unmarshal(statement.Predicate, &predicate); err != nil {
+		return nil, fmt.Errorf("decode predicate: %w", err)
+	}
+
+	var provenance Provenance
+	switch statement.PredicateType {
+	case slsaProvenanceV1:
+		provenance.Builder = predicate.RunDetails.Builder.ID
+		provenance.Source = predicate.BuildDefinition.ExternalParameters.Workflow.Repository
+		if provenance.Source == "" && len(predicate.BuildDefinition.ResolvedDependencies) > 0 {
+			provenance.Source = predicate.BuildDefinition.ResolvedDependencies[0].URI
+		}
+	case slsaProvenanceV02:
+		provenance.Builder = predicate.Builder.ID
+		provenance.Source = predicate.Invocation.ConfigSource.URI
+		if provenance.Source == "" && len(predicate.Materials) > 0 {
+			provenance.Source = predicate.Materials[0].URI
+		}
+	default:
+		return nil, fmt.Errorf("unsupported predicate type %q", statement.PredicateType)
+	}
+	return &provenance, nil
+}
+
+func (p *ProvenancePolicy) check(provenance *Provenance) error {
+	if p.Builder != "" && provenance.Builder != p.Builder && !strings.HasPrefix(provenance.Builder, p.Builder+"@") {
+		return fmt.Errorf("built by %q, want %q", provenance.Builder, p.Builder)
+	}
+	if p.Source != "" && normalizeSource(provenance.Source) != normalizeSource(p.Source) {
+		return fmt.Errorf("built from %q, want %q", provenance.Source, p.Source)
+	}
+	return nil
+}
+
+// normalizeSource reduces a source URI such as
+// "git+https://github.com/owner/repo@refs/tags/v1.0.0" to "github.com/owner/repo"
+func normalizeSource(uri string) string {
+	uri = strings.TrimPrefix(uri, "git+")
+	if _, rest, ok := strings.Cut(uri, "://"); ok {
+		uri = rest
+	}
+	uri, _, _ = strings.Cut(uri, "@")
+	uri = strings.TrimSuffix(strings.TrimSuffix(uri, "/"), ".git")
+	return strings.ToLower(uri)
+}
+
+// VerifyProvenance fetches the SLSA provenance at url and checks it attests
+// to the asset with digests, keyed by algorithm, under the configured
+// policy. It is a no-op when no policy is configured, and an error when the
+// asset has no provenance.
+func (d *Downloader) VerifyProvenance(ctx context.Context, url string, digests map[string]string) error {
+	if d.provenance == nil {
+		return nil
+	}
+	if url == "" {
+		return fmt.Errorf("%w: asset has no provenance", ErrProvenance)
+	}
+
+	d.logger.Info("verifying provenance", "url", url, "builder", d.provenance.Builder, "source", d.provenance.Source)
+
+	data, err := d.fetchSignature(ctx, url, maxProvenanceLength)
+	if err != nil {
+		return err
+	}
+
+	provenance, err := VerifyProvenance(data, digests, d.provenance)
+	if err != nil {
+		return err
+	}
+
+	d.logger.Info("provenance verified", "builder", provenance.Builder, "source", provenance.Source)
+	return nil
+}
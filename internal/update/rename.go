@@ -0,0 +1,55 @@
+package update
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/1995parham-learning/auto-update-binary/internal/platform"
+)
+
+// AliasesFile is the name of the optional file in a component's directory
+// listing, one per line, the former names its releases are also offered
+// under, so clients installed before a rename still find them
+const AliasesFile = "ALIASES"
+
+// MigrateRename moves the executable at execPath to name in the same
+// directory when it is installed under one of formerNames. Clients released
+// before a rename find the new release under their old name and update the
+// file they were installed as; the new release moves itself on its first
+// start. A symlink is left at the former path where the platform allows, so
+// scripts and service definitions naming it keep working. It returns the
+// path the executable is now at, which is execPath when nothing was moved.
+func MigrateRename(execPath, name string, formerNames []string) (string, error) {
+	// The former path may already be the symlink left by a migration
+	resolved, err := filepath.EvalSymlinks(execPath)
+	if err != nil {
+		return execPath, err
+	}
+	ext := platform.BinaryExtension()
+	base := strings.TrimSuffix(filepath.Base(resolved), ext)
+	if base == name || !slices.Contains(formerNames, base) {
+		return resolved, nil
+	}
+	if _, ok := platform.SlotLink(resolved); ok {
+		// Slots are named by the layout, not the component
+		return resolved, nil
+	}
+	if err := platform.CheckWritable(resolved); err != nil {
+		return resolved, err
+	}
+
+	target := filepath.Join(filepath.Dir(resolved), name+ext)
+	if _, err := os.Lstat(target); err == nil {
+		return resolved, fmt.Errorf("migrate %s to %s: %s already exists", base, name, target)
+	}
+	if err := os.Rename(resolved, target); err != nil {
+		return resolved, fmt.Errorf("migrate %s to %s: %w", base, name, err)
+	}
+	// Best effort: Windows only allows symlinks with developer mode or
+	// elevated rights
+	_ = os.Symlink(filepath.Base(target), resolved)
+	return target, nil
+}
@@ -1,9 +1,13 @@
 package update
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/1995parham-learning/auto-update-binary/internal/platform"
 )
@@ -20,6 +24,26 @@ func NewReplacer(logger *slog.Logger) *Replacer {
 	}
 }
 
+// ErrTargetChanged is returned by CheckTarget for a binary replaced since
+// the update was prepared, e.g. by another update of a shared install
+var ErrTargetChanged = errors.New("binary changed since the update was prepared")
+
+// CheckTarget checks that the binary at path still has the SHA-256 digest
+// sha256 it had when the update was prepared; an empty digest isn't checked
+func CheckTarget(path, sha256 string) error {
+	if sha256 == "" {
+		return nil
+	}
+	current, err := FileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(current, sha256) {
+		return fmt.Errorf("%w: %s", ErrTargetChanged, path)
+	}
+	return nil
+}
+
 // Replace performs atomic binary replacement
 func (r *Replacer) Replace(targetPath, newBinaryPath, backupPath string) error {
 	r.logger.Info("replacing binary",
@@ -33,6 +57,16 @@ func (r *Replacer) Replace(targetPath, newBinaryPath, backupPath string) error {
 		return fmt.Errorf("new binary not found: %w", err)
 	}
 
+	// A binary for another platform would leave nothing that runs, and no
+	// updater left to fix it
+	if err := CheckExecutable(newBinaryPath); err != nil {
+		return err
+	}
+
+	if link, ok := platform.SlotLink(targetPath); ok {
+		return r.replaceSlot(link, newBinaryPath, backupPath)
+	}
+
 	// Perform platform-specific atomic replacement
 	if err := platform.AtomicReplace(targetPath, newBinaryPath, backupPath); err != nil {
 		return fmt.Errorf("atomic replace: %w", err)
@@ -47,6 +81,129 @@ func (r *Replacer) Replace(targetPath, newBinaryPath, backupPath string) error {
 	return nil
 }
 
+// Migrate installs the new binary at installPath instead of over
+// targetPath, which is kept as backupPath and forwarded to installPath, so
+// anything naming the old path still runs the new binary. It returns what
+// was left at the old path; RollbackMigration undoes it.
+func (r *Replacer) Migrate(targetPath, newBinaryPath, backupPath, installPath string) (string, error) {
+	r.logger.Info("migrating binary",
+		"target", targetPath,
+		"install_path", installPath,
+		"new", newBinaryPath,
+		"backup", backupPath,
+	)
+
+	if err := CheckExecutable(newBinaryPath); err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(installPath); err == nil {
+		return "", fmt.Errorf("install path %s already exists", installPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(installPath), 0755); err != nil {
+		return "", fmt.Errorf("create install directory: %w", err)
+	}
+	if err := platform.CheckWritable(installPath); err != nil {
+		return "", err
+	}
+
+	// The download may be on another filesystem than the new directory
+	if err := os.Rename(newBinaryPath, installPath); err != nil {
+		if err := copyFile(newBinaryPath, installPath, 0755); err != nil {
+			return "", fmt.Errorf("install new: %w", err)
+		}
+		os.Remove(newBinaryPath)
+	}
+	if err := os.Chmod(installPath, 0755); err != nil {
+		os.Remove(installPath)
+		return "", fmt.Errorf("chmod: %w", err)
+	}
+
+	_ = os.Remove(backupPath)
+	if err := os.Rename(targetPath, backupPath); err != nil {
+		os.Remove(installPath)
+		return "", fmt.Errorf("backup old: %w", err)
+	}
+	forwarder, err := platform.Forward(targetPath, installPath)
+	if err != nil {
+		_ = os.Rename(backupPath, targetPath)
+		os.Remove(installPath)
+		return "", fmt.Errorf("forward %s: %w", targetPath, err)
+	}
+
+	if err := platform.RemoveQuarantine(installPath); err != nil {
+		r.logger.Warn("failed to remove quarantine", "error", err)
+	}
+
+	r.logger.Info("binary migrated successfully", "forwarder", forwarder)
+	return forwarder, nil
+}
+
+// RollbackMigration restores the binary Migrate moved aside and removes
+// what it installed
+func (r *Replacer) RollbackMigration(targetPath, backupPath, installPath string) error {
+	if err := r.Rollback(targetPath, backupPath); err != nil {
+		return err
+	}
+	platform.RemoveForwarder(targetPath)
+	_ = os.Remove(installPath)
+	return nil
+}
+
+// copyFile copies src to a new file dst with permissions perm
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// replaceSlot installs the new binary into the inactive slot and flips the
+// symlink or launcher to it. The running binary is never touched. The backup
+// records the previous slot, so rolling back is another flip.
+func (r *Replacer) replaceSlot(link, newBinaryPath, backupPath string) error {
+	active, err := platform.ActiveSlot(link)
+	if err != nil {
+		return err
+	}
+	inactive := platform.OtherSlot(active)
+
+	if err := os.Rename(newBinaryPath, inactive); err != nil {
+		return fmt.Errorf("install into slot: %w", err)
+	}
+	if err := os.Chmod(inactive, 0755); err != nil {
+		return fmt.Errorf("chmod: %w", err)
+	}
+
+	if err := platform.SaveSlot(link, backupPath); err != nil {
+		return err
+	}
+	if err := platform.PointSlot(link, inactive); err != nil {
+		return err
+	}
+
+	if err := platform.RemoveQuarantine(inactive); err != nil {
+		r.logger.Warn("failed to remove quarantine", "error", err)
+	}
+
+	r.logger.Info("binary replaced successfully", "slot", filepath.Base(inactive), "previous", filepath.Base(active))
+	return nil
+}
+
 // Rollback restores the backup binary
 func (r *Replacer) Rollback(targetPath, backupPath string) error {
 	r.logger.Warn("rolling back update",
@@ -54,6 +211,18 @@ func (r *Replacer) Rollback(targetPath, backupPath string) error {
 		"backup", backupPath,
 	)
 
+	// In the slot layout the backup records the previous slot
+	if link, ok := platform.SlotLink(targetPath); ok {
+		if _, err := os.Lstat(backupPath); err != nil {
+			return fmt.Errorf("backup not found: %w", err)
+		}
+		if err := platform.RestoreSlot(link, backupPath); err != nil {
+			return err
+		}
+		r.logger.Info("rollback complete")
+		return nil
+	}
+
 	// Check if backup exists
 	if _, err := os.Stat(backupPath); err != nil {
 		return fmt.Errorf("backup not found: %w", err)
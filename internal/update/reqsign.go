@@ -0,0 +1,129 @@
+package update
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RequestSignatureHeader carries a signed request's credentials in place of
+// its API key: the key's ID, a timestamp, a nonce and an HMAC over them and
+// the request. A captured request is then useless once its nonce is spent or
+// its timestamp is stale, and never reveals the key.
+//
+//	X-Nametag-Request-Signature: keyid=<id>, ts=<unix seconds>, nonce=<hex>, sig=<base64>
+const RequestSignatureHeader = "X-Nametag-Request-Signature"
+
+// RequestSignatureSkew is how far a signed request's timestamp may be from
+// the server's clock
+const RequestSignatureSkew = 5 * time.Minute
+
+// RequestSignature is the parsed RequestSignatureHeader
+type RequestSignature struct {
+	KeyID     string
+	Timestamp time.Time
+	Nonce     string
+	Signature []byte
+}
+
+// requestSigningLabel separates the signing key derived from an API key from
+// anything else derived from it, such as the SHA-256 servers look keys up by
+const requestSigningLabel = "nametag-request-signing"
+
+// RequestSigningKey derives the HMAC key of an API key,
+// HMAC-SHA256(apiKey, "nametag-request-signing"). Servers store it next to
+// the key's SHA-256 so they can check signatures without holding the key;
+// it can't be computed from the SHA-256, but anyone holding it can sign
+// requests, so it is as secret as the key.
+func RequestSigningKey(apiKey string) []byte {
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	mac.Write([]byte(requestSigningLabel))
+	return mac.Sum(nil)
+}
+
+// RequestKeyID identifies a signing key without revealing it
+func RequestKeyID(signingKey []byte) string {
+	sum := sha256.Sum256(append([]byte("nametag-key-id:"), signingKey...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// requestSigningString is what a request signature covers
+func requestSigningString(method, requestURI string, ts int64, nonce string) []byte {
+	return []byte(strings.Join([]string{method, requestURI, strconv.FormatInt(ts, 10), nonce}, "\n"))
+}
+
+// SignRequest sets req's RequestSignatureHeader for the API key's signing key
+func SignRequest(req *http.Request, signingKey []byte, now time.Time) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generate nonce: %w", err)
+	}
+
+	sig := RequestSignature{KeyID: RequestKeyID(signingKey), Timestamp: now, Nonce: hex.EncodeToString(nonce)}
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write(requestSigningString(req.Method, req.URL.RequestURI(), now.Unix(), sig.Nonce))
+	sig.Signature = mac.Sum(nil)
+
+	req.Header.Set(RequestSignatureHeader, sig.String())
+	return nil
+}
+
+// String formats the signature as a header value
+func (s RequestSignature) String() string {
+	return fmt.Sprintf("keyid=%s, ts=%d, nonce=%s, sig=%s",
+		s.KeyID, s.Timestamp.Unix(), s.Nonce, base64.StdEncoding.EncodeToString(s.Signature))
+}
+
+// ParseRequestSignature parses a RequestSignatureHeader value
+func ParseRequestSignature(value string) (*RequestSignature, error) {
+	var sig RequestSignature
+	for part := range strings.SplitSeq(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid request signature field %q", part)
+		}
+		switch k {
+		case "keyid":
+			sig.KeyID = v
+		case "ts":
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid request signature timestamp %q", v)
+			}
+			sig.Timestamp = time.Unix(ts, 0)
+		case "nonce":
+			sig.Nonce = v
+		case "sig":
+			mac, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid request signature: %w", err)
+			}
+			sig.Signature = mac
+		}
+	}
+	if sig.KeyID == "" || sig.Timestamp.IsZero() || len(sig.Nonce) < 16 || len(sig.Signature) == 0 {
+		return nil, errors.New("incomplete request signature")
+	}
+	return &sig, nil
+}
+
+// Verify checks that the signature was made over req with signingKey. A
+// server request is checked against the URI it was sent to, which routing
+// may since have rewritten in req.URL.
+func (s *RequestSignature) Verify(req *http.Request, signingKey []byte) bool {
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write(requestSigningString(req.Method, uri, s.Timestamp.Unix(), s.Nonce))
+	return hmac.Equal(mac.Sum(nil), s.Signature)
+}
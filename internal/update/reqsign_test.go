@@ -0,0 +1,107 @@
+package update
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestSigningKey(t *testing.T) {
+	key := RequestSigningKey("secret")
+	if len(key) != sha256.Size {
+		t.Fatalf("signing key is %d bytes, want %d", len(key), sha256.Size)
+	}
+	// The key's SHA-256 is what servers look keys up by; signing with it
+	// would let anyone holding the key file forge requests
+	if sum := sha256.Sum256([]byte("secret")); bytes.Equal(key, sum[:]) {
+		t.Fatal("signing key is the key's SHA-256")
+	}
+	if !bytes.Equal(key, RequestSigningKey("secret")) {
+		t.Fatal("signing key is not deterministic")
+	}
+	if bytes.Equal(key, RequestSigningKey("secret2")) {
+		t.Fatal("different keys derive the same signing key")
+	}
+}
+
+func TestSignRequestRoundTrip(t *testing.T) {
+	signingKey := RequestSigningKey("secret")
+	now := time.Unix(1700000000, 0)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/manifest.json?channel=beta", nil)
+	if err := SignRequest(req, signingKey, now); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	sig, err := ParseRequestSignature(req.Header.Get(RequestSignatureHeader))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if sig.KeyID != RequestKeyID(signingKey) || !sig.Timestamp.Equal(now) {
+		t.Fatalf("parsed signature %+v doesn't match what was signed", sig)
+	}
+	if !sig.Verify(req, signingKey) {
+		t.Fatal("signature doesn't verify")
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*http.Request, *RequestSignature) []byte
+	}{
+		{"other key", func(*http.Request, *RequestSignature) []byte { return RequestSigningKey("other") }},
+		{"other path", func(r *http.Request, _ *RequestSignature) []byte {
+			r.RequestURI = "/v1/download/nametag/linux-amd64/1.0.0"
+			return signingKey
+		}},
+		{"other query", func(r *http.Request, _ *RequestSignature) []byte {
+			r.RequestURI = "/v1/manifest.json?channel=stable"
+			return signingKey
+		}},
+		{"other method", func(r *http.Request, _ *RequestSignature) []byte {
+			r.Method = http.MethodPost
+			return signingKey
+		}},
+		{"other timestamp", func(_ *http.Request, s *RequestSignature) []byte {
+			s.Timestamp = s.Timestamp.Add(time.Second)
+			return signingKey
+		}},
+		{"other nonce", func(_ *http.Request, s *RequestSignature) []byte {
+			s.Nonce = strings.Repeat("0", len(s.Nonce))
+			return signingKey
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := req.Clone(req.Context())
+			s := *sig
+			key := tt.modify(r, &s)
+			if s.Verify(r, key) {
+				t.Fatal("altered request verifies")
+			}
+		})
+	}
+}
+
+func TestParseRequestSignature(t *testing.T) {
+	valid := "keyid=abcd, ts=1700000000, nonce=00112233445566778899aabbccddeeff, sig=c2lnbmF0dXJl"
+	if _, err := ParseRequestSignature(valid); err != nil {
+		t.Fatalf("parse valid signature: %v", err)
+	}
+
+	for _, value := range []string{
+		"",
+		"keyid=abcd",
+		"keyid=abcd, ts=now, nonce=00112233445566778899aabbccddeeff, sig=c2lnbmF0dXJl",
+		"keyid=abcd, ts=1700000000, nonce=short, sig=c2lnbmF0dXJl",
+		"keyid=abcd, ts=1700000000, nonce=00112233445566778899aabbccddeeff, sig=!!!",
+		"keyid=abcd, ts=1700000000, nonce=00112233445566778899aabbccddeeff",
+		"keyid, ts=1700000000, nonce=00112233445566778899aabbccddeeff, sig=c2lnbmF0dXJl",
+	} {
+		if _, err := ParseRequestSignature(value); err == nil {
+			t.Errorf("ParseRequestSignature(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package update
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MachineIDFile is the name of the client state file holding the machine ID
+// staged rollouts place the client by
+const MachineIDFile = "machine-id"
+
+// MachineIDHeader carries the client's machine ID on manifest requests
+const MachineIDHeader = "X-Nametag-Machine-ID"
+
+// RolloutHeader names, on a manifest response, a release being rolled out
+// that the manifest holds back from the client, as "{component} {version}
+// {percent}", once per release
+const RolloutHeader = "X-Nametag-Rollout"
+
+// MaxMachineIDLength bounds the machine IDs a server buckets; longer ones
+// are treated as absent
+const MaxMachineIDLength = 128
+
+// LoadMachineID returns the machine ID kept in the file at path, creating a
+// random one the first time. The ID stays the same across runs, so a client
+// doesn't move in and out of a staged rollout; it says nothing about the
+// machine beyond that.
+func LoadMachineID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(data))
+		if id == "" || len(id) > MaxMachineIDLength {
+			return "", fmt.Errorf("invalid machine ID in %s", path)
+		}
+		return id, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("read machine ID: %w", err)
+	}
+
+	var buf [16]byte
+	rand.Read(buf[:])
+	id := hex.EncodeToString(buf[:])
+	if err := os.WriteFile(path, []byte(id+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("write machine ID: %w", err)
+	}
+	return id, nil
+}
+
+// RolloutBucket places a machine among all clients of a component's
+// release, in [0, 100): the release is offered to it once the release's
+// rollout percentage exceeds its bucket, so a machine offered a release
+// keeps being offered it as the percentage ramps up. Each release reshuffles
+// the machines, so the same ones aren't always the first to update.
+func RolloutBucket(machineID, component, version string) float64 {
+	sum := sha256.Sum256([]byte(component + "/" + version + "/" + machineID))
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53) * 100
+}
+
+// HeldRollout is a release being rolled out that a manifest held back from
+// the client
+type HeldRollout struct {
+	Component string
+	Version   string
+	Percent   float64
+}
+
+// String formats the rollout as a RolloutHeader value
+func (h HeldRollout) String() string {
+	return h.Component + " " + h.Version + " " + strconv.FormatFloat(h.Percent, 'g', -1, 64)
+}
+
+// parseHeldRollouts reads RolloutHeader values, skipping malformed ones
+func parseHeldRollouts(values []string) []HeldRollout {
+	var held []HeldRollout
+	for _, value := range values {
+		fields := strings.Fields(value)
+		if len(fields) != 3 {
+			continue
+		}
+		percent, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			continue
+		}
+		held = append(held, HeldRollout{Component: fields[0], Version: fields[1], Percent: percent})
+	}
+	return held
+}
@@ -0,0 +1,86 @@
+package update
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// SBOM formats an asset's software bill of materials can be published in
+const (
+	SBOMFormatSPDX      = "spdx"
+	SBOMFormatCycloneDX = "cyclonedx"
+)
+
+// sbomFormats maps each format to the suffix of the SBOM stored next to an
+// asset and the media type it is served with
+var sbomFormats = []struct {
+	format      string
+	ext         string
+	contentType string
+}{
+	{SBOMFormatSPDX, ".spdx.json", "application/spdx+json"},
+	{SBOMFormatCycloneDX, ".cdx.json", "application/vnd.cyclonedx+json"},
+}
+
+// ErrNoSBOM is returned when the server has no SBOM for an asset
+var ErrNoSBOM = errors.New("no sbom published")
+
+// maxSBOMSize bounds SBOM downloads; large dependency trees stay well under
+const maxSBOMSize = 64 << 20
+
+// FindSBOM returns the path and format of the SBOM stored next to the asset
+// at assetPath, if there is one
+func FindSBOM(assetPath string) (string, string, bool) {
+	for _, f := range sbomFormats {
+		if _, err := os.Stat(assetPath + f.ext); err == nil {
+			return assetPath + f.ext, f.format, true
+		}
+	}
+	return "", "", false
+}
+
+// SBOMContentType returns the media type of an SBOM format
+func SBOMContentType(format string) string {
+	for _, f := range sbomFormats {
+		if f.format == format {
+			return f.contentType
+		}
+	}
+	return "application/json"
+}
+
+// FetchSBOM downloads the SBOM at url into w
+func (d *Downloader) FetchSBOM(ctx context.Context, url string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("User-Agent", "nametag-updater/1.0")
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch sbom: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNoSBOM
+	}
+	if err := checkStatus(resp); err != nil {
+		d.recordBackoff(err)
+		return err
+	}
+
+	n, err := io.Copy(w, io.LimitReader(resp.Body, maxSBOMSize+1))
+	if err != nil {
+		return fmt.Errorf("read sbom: %w", err)
+	}
+	if n > maxSBOMSize {
+		return fmt.Errorf("sbom exceeds %d bytes", maxSBOMSize)
+	}
+	return nil
+}
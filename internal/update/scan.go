@@ -0,0 +1,67 @@
+package update
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ScanTimeout bounds how long a scan command may run; a scan that doesn't
+// finish counts as a rejection
+const ScanTimeout = 10 * time.Minute
+
+// ScanPlaceholder in a scan command is replaced by the path of the file to
+// scan; without it the path is appended as the last argument
+const ScanPlaceholder = "{}"
+
+// maxScanOutput caps how much of a scanner's output ends up in the error
+const maxScanOutput = 4 << 10
+
+// ErrScanRejected is returned when the scan command exits non-zero, or can't
+// be run at all, so the update is aborted
+var ErrScanRejected = errors.New("scan rejected the update")
+
+// Scan runs command, e.g. "clamscan --no-summary" or an EDR's on-demand
+// scanner, against the file at path. Like exec token sources, the command
+// is split on spaces and run without a shell.
+func Scan(ctx context.Context, command, path string) error {
+	argv := strings.Fields(command)
+	if len(argv) == 0 {
+		return fmt.Errorf("%w: empty scan command", ErrScanRejected)
+	}
+
+	replaced := false
+	for i, arg := range argv {
+		if strings.Contains(arg, ScanPlaceholder) {
+			argv[i] = strings.ReplaceAll(arg, ScanPlaceholder, path)
+			replaced = true
+		}
+	}
+	if !replaced {
+		argv = append(argv, path)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ScanTimeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(output.String())
+		if len(out) > maxScanOutput {
+			out = "..." + out[len(out)-maxScanOutput:]
+		}
+		if out == "" {
+			return fmt.Errorf("%w: %s: %w", ErrScanRejected, argv[0], err)
+		}
+		return fmt.Errorf("%w: %s: %w: %s", ErrScanRejected, argv[0], err, out)
+	}
+	return nil
+}
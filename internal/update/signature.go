@@ -0,0 +1,148 @@
+package update
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SignatureHeader carries the base64 Ed25519 signature of the manifest body
+const SignatureHeader = "X-Nametag-Signature"
+
+// ManifestSignatureExtension is the suffix of the file next to a manifest
+// signed offline that holds its signatures, one base64 signature per line,
+// which the server sends as SignatureHeader values
+const ManifestSignatureExtension = ".sig"
+
+// ErrUnsigned is returned when a manifest carries no signature
+var ErrUnsigned = errors.New("manifest is not signed")
+
+// ParsePublicKey decodes a base64-encoded raw Ed25519 public key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("decode public key: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key size: %d", len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// EncodePublicKey encodes an Ed25519 public key as base64
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// LoadPrivateKey reads a PEM-encoded PKCS#8 Ed25519 private key, as produced by
+// `openssl genpkey -algorithm ed25519` or `nametag-release keygen`
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read private key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no PRIVATE KEY block in %s", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, not Ed25519", key)
+	}
+
+	return edKey, nil
+}
+
+// EncodePrivateKey encodes an Ed25519 private key as PEM PKCS#8
+func EncodePrivateKey(key ed25519.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Sign signs data and returns the base64-encoded signature
+func Sign(key ed25519.PrivateKey, data []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+}
+
+// SignWith is Sign for any Ed25519 signer, such as a key held on a hardware
+// token, which may fail
+func SignWith(signer crypto.Signer, data []byte) (string, error) {
+	signature, err := signer.Sign(nil, data, crypto.Hash(0))
+	if err != nil {
+		return "", fmt.Errorf("sign: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// LoadSigner returns the Ed25519 signer spec names: piv:SLOT for a key in a
+// PIV slot of a hardware token (see PIVSigner), or else the path of a PEM
+// private key
+func LoadSigner(spec string) (crypto.Signer, error) {
+	if slot, ok := strings.CutPrefix(spec, "piv:"); ok {
+		return NewPIVSigner(slot)
+	}
+	return LoadPrivateKey(spec)
+}
+
+// SignerPublicKey returns the Ed25519 public key of signer
+func SignerPublicKey(signer crypto.Signer) (ed25519.PublicKey, error) {
+	key, ok := signer.Public().(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key is %T, not Ed25519", signer.Public())
+	}
+	return key, nil
+}
+
+// Verify checks a base64-encoded signature of data against key
+func Verify(key ed25519.PublicKey, data []byte, signature string) error {
+	if signature == "" {
+		return ErrUnsigned
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+
+	if !ed25519.Verify(key, data, sig) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+// ReadManifestSignatures reads the offline signatures of the manifest at
+// manifestPath
+func ReadManifestSignatures(manifestPath string) ([]string, error) {
+	data, err := os.ReadFile(manifestPath + ManifestSignatureExtension)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest signatures: %w", err)
+	}
+
+	var signatures []string
+	for line := range strings.Lines(string(data)) {
+		if line = strings.TrimSpace(line); line != "" {
+			signatures = append(signatures, line)
+		}
+	}
+	if len(signatures) == 0 {
+		return nil, fmt.Errorf("%w: %s%s is empty", ErrUnsigned, manifestPath, ManifestSignatureExtension)
+	}
+	return signatures, nil
+}
@@ -0,0 +1,248 @@
+package update
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestKey returns a fresh Ed25519 key pair
+func newTestKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func TestVerify(t *testing.T) {
+	pub, priv := newTestKey(t)
+	other, _ := newTestKey(t)
+	data := []byte(`{"schema_version":1}`)
+	signature := Sign(priv, data)
+
+	tests := []struct {
+		name      string
+		key       ed25519.PublicKey
+		data      []byte
+		signature string
+		wantErr   error
+	}{
+		{"valid", pub, data, signature, nil},
+		{"unsigned", pub, data, "", ErrUnsigned},
+		{"tampered", pub, []byte(`{"schema_version":2}`), signature, errAny},
+		{"other key", other, data, signature, errAny},
+		{"not base64", pub, data, "!!!", errAny},
+		{"truncated", pub, data, signature[:20], errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.key, tt.data, tt.signature)
+			checkErr(t, err, tt.wantErr)
+		})
+	}
+}
+
+// errAny stands for any error in test tables
+var errAny = errors.New("any error")
+
+// checkErr fails unless err is want: nil, errAny for any error, or else an
+// error matching it
+func checkErr(t *testing.T, err, want error) {
+	t.Helper()
+	switch {
+	case want == nil && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case want != nil && err == nil:
+		t.Fatalf("succeeded, want %v", want)
+	case want != nil && want != errAny && !errors.Is(err, want):
+		t.Fatalf("error = %v, want %v", err, want)
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	pub, _ := newTestKey(t)
+	got, err := ParsePublicKey(EncodePublicKey(pub))
+	if err != nil || !got.Equal(pub) {
+		t.Fatalf("ParsePublicKey() = %v, %v", got, err)
+	}
+	for _, bad := range []string{"", "not base64!", EncodePublicKey(pub[:31])} {
+		if _, err := ParsePublicKey(bad); err == nil {
+			t.Errorf("ParsePublicKey(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestLoadPrivateKey(t *testing.T) {
+	dir := t.TempDir()
+	_, priv := newTestKey(t)
+	encoded, err := EncodePrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "signing.key")
+	if err := os.WriteFile(path, encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPrivateKey(path)
+	if err != nil || !loaded.Equal(priv) {
+		t.Fatalf("LoadPrivateKey() = %v", err)
+	}
+
+	// Another kind of key must not be taken for an Ed25519 one
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPath := filepath.Join(dir, "ec.key")
+	if err := os.WriteFile(ecPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPrivateKey(ecPath); err == nil {
+		t.Error("LoadPrivateKey() accepted an ECDSA key")
+	}
+}
+
+func TestReadManifestSignatures(t *testing.T) {
+	manifest := filepath.Join(t.TempDir(), "manifest.json")
+	if err := os.WriteFile(manifest+ManifestSignatureExtension, []byte("sig-a\n\n  sig-b  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadManifestSignatures(manifest)
+	if err != nil || strings.Join(got, ",") != "sig-a,sig-b" {
+		t.Fatalf("ReadManifestSignatures() = %q, %v", got, err)
+	}
+
+	if err := os.WriteFile(manifest+ManifestSignatureExtension, []byte("\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadManifestSignatures(manifest); !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("ReadManifestSignatures() of an empty file = %v, want %v", err, ErrUnsigned)
+	}
+}
+
+// serveManifest serves body as the stable manifest with signatures in
+// SignatureHeader, and no key rotations
+func serveManifest(t *testing.T, body []byte, signatures ...string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != ChannelManifestURL(ChannelStable) {
+			http.NotFound(w, r)
+			return
+		}
+		for _, sig := range signatures {
+			w.Header().Add(SignatureHeader, sig)
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func testManifest(t *testing.T) []byte {
+	t.Helper()
+	now := time.Now().UTC()
+	return encodeManifest(t, &Manifest{SchemaVersion: SchemaVersion, Generated: now, Expires: now.Add(time.Hour), Components: map[string]Component{}})
+}
+
+func encodeManifest(t *testing.T, manifest *Manifest) []byte {
+	t.Helper()
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestCheckerVerifiesManifestSignature(t *testing.T) {
+	pub, priv := newTestKey(t)
+	_, untrusted := newTestKey(t)
+	body := testManifest(t)
+	tampered := []byte(strings.Replace(string(body), `"components"`, `"components" `, 1))
+
+	tests := []struct {
+		name       string
+		body       []byte
+		signatures []string
+		wantErr    error
+	}{
+		{"signed", body, []string{Sign(priv, body)}, nil},
+		{"also signed by another key", body, []string{Sign(untrusted, body), Sign(priv, body)}, nil},
+		{"unsigned", body, nil, ErrUnsigned},
+		{"tampered", tampered, []string{Sign(priv, body)}, errAny},
+		{"untrusted key", body, []string{Sign(untrusted, body)}, errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := NewTrustedKeys(&KeySet{Keys: []ed25519.PublicKey{pub}, Threshold: 1}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checker := NewChecker(serveManifest(t, tt.body, tt.signatures...), slog.New(slog.NewTextHandler(io.Discard, nil)),
+				WithTrustedKeys(keys), WithIgnoreBackoff())
+			_, err = checker.GetManifest(context.Background())
+			checkErr(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestCheckerManifestExpiry(t *testing.T) {
+	pub, priv := newTestKey(t)
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name     string
+		manifest *Manifest
+		signed   bool
+		maxAge   time.Duration
+		wantErr  error
+	}{
+		{"signed, expires", &Manifest{Generated: now, Expires: now.Add(time.Hour)}, true, 0, nil},
+		{"signed, no expiry", &Manifest{Generated: now}, true, 0, ErrManifestNoExpiry},
+		{"signed, expired", &Manifest{Generated: now.Add(-2 * time.Hour), Expires: now.Add(-time.Hour)}, true, 0, ErrManifestStale},
+		{"signed, older than max age", &Manifest{Generated: now.Add(-2 * time.Hour), Expires: now.Add(time.Hour)}, true, time.Hour, ErrManifestStale},
+		{"unsigned, no expiry", &Manifest{Generated: now}, false, 0, nil},
+		{"unsigned, expired", &Manifest{Generated: now.Add(-2 * time.Hour), Expires: now.Add(-time.Hour)}, false, 0, ErrManifestStale},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.manifest.SchemaVersion = SchemaVersion
+			tt.manifest.Components = map[string]Component{}
+			body := encodeManifest(t, tt.manifest)
+
+			opts := []Option{WithIgnoreBackoff(), WithMaxManifestAge(tt.maxAge)}
+			var signatures []string
+			if tt.signed {
+				keys, err := NewTrustedKeys(&KeySet{Keys: []ed25519.PublicKey{pub}, Threshold: 1}, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts = append(opts, WithTrustedKeys(keys))
+				signatures = append(signatures, Sign(priv, body))
+			}
+			checker := NewChecker(serveManifest(t, body, signatures...), slog.New(slog.NewTextHandler(io.Discard, nil)), opts...)
+			_, err := checker.GetManifest(context.Background())
+			checkErr(t, err, tt.wantErr)
+		})
+	}
+}
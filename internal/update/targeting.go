@@ -0,0 +1,47 @@
+package update
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Manifest request headers describing the client, which the server's
+// targeting rules may vary the offered releases by
+const (
+	// PlatformHeader carries the client's platform, e.g. linux-amd64
+	PlatformHeader = "X-Nametag-Platform"
+	// CurrentVersionHeader carries the version of a component the client
+	// runs, as "{component} {version}", once per component checked
+	CurrentVersionHeader = "X-Nametag-Current-Version"
+	// GroupHeader carries the group label the client was configured with
+	GroupHeader = "X-Nametag-Group"
+)
+
+// TargetHeader names, on a manifest response, a targeting rule that held a
+// component's newer releases back from the client, as "{component} {rule}"
+const TargetHeader = "X-Nametag-Target"
+
+var groupPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// ValidateGroup checks a group label: lowercase letters, digits, dots,
+// dashes, and underscores, starting with a letter or digit
+func ValidateGroup(group string) error {
+	if !groupPattern.MatchString(group) {
+		return fmt.Errorf("invalid group %q", group)
+	}
+	return nil
+}
+
+// parseTargets reads TargetHeader values into the rule deciding each
+// component, skipping malformed ones
+func parseTargets(values []string) map[string]string {
+	targets := make(map[string]string)
+	for _, value := range values {
+		component, rule, ok := strings.Cut(value, " ")
+		if ok && component != "" && rule != "" {
+			targets[component] = rule
+		}
+	}
+	return targets
+}
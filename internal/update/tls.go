@@ -0,0 +1,140 @@
+package update
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ErrPinMismatch is returned when the server's verified certificate chain
+// contains neither a pinned public key nor a pinned certificate
+var ErrPinMismatch = errors.New("server certificate does not match any pin")
+
+// spkiPinPrefix marks a public key pin, the format curl's --pinnedpubkey uses
+const spkiPinPrefix = "sha256//"
+
+// PinSet holds TLS pins for the update server. A connection is accepted when
+// any certificate of a verified chain matches any pin, so pinning an
+// intermediate or a backup key keeps working across leaf renewals.
+type PinSet struct {
+	spki  [][sha256.Size]byte
+	certs [][sha256.Size]byte
+}
+
+// ParsePins parses a comma-separated list of pins. Each is either
+// "sha256//" followed by the base64 SHA-256 of a SubjectPublicKeyInfo, or the
+// hex SHA-256 fingerprint of a whole certificate, colons allowed.
+func ParsePins(list string) (*PinSet, error) {
+	pins := &PinSet{}
+	for pin := range strings.SplitSeq(list, ",") {
+		pin = strings.TrimSpace(pin)
+		if pin == "" {
+			continue
+		}
+
+		var digest [sha256.Size]byte
+		if encoded, ok := strings.CutPrefix(pin, spkiPinPrefix); ok {
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("invalid public key pin %q", pin)
+			}
+			copy(digest[:], decoded)
+			pins.spki = append(pins.spki, digest)
+			continue
+		}
+
+		decoded, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate pin %q", pin)
+		}
+		copy(digest[:], decoded)
+		pins.certs = append(pins.certs, digest)
+	}
+
+	if len(pins.spki) == 0 && len(pins.certs) == 0 {
+		return nil, errors.New("no pins given")
+	}
+	return pins, nil
+}
+
+// verifyConnection runs after the usual chain verification and additionally
+// requires a pinned certificate or key in a verified chain. Certificates the
+// server merely sent along don't count, since pinned certificates are public.
+func (p *PinSet) verifyConnection(cs tls.ConnectionState) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range p.spki {
+				if spki == pin {
+					return nil
+				}
+			}
+
+			fingerprint := sha256.Sum256(cert.Raw)
+			for _, pin := range p.certs {
+				if fingerprint == pin {
+					return nil
+				}
+			}
+		}
+	}
+	return ErrPinMismatch
+}
+
+// LoadCABundle returns the system roots plus the certificates of the PEM
+// bundle at path, e.g. an internal CA or a TLS-inspecting proxy's
+func LoadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read ca bundle: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("ca bundle %s: no certificates found", path)
+	}
+	return pool, nil
+}
+
+// transport returns the HTTP transport for connections to the update server;
+// nil is the default transport
+func (o options) transport() http.RoundTripper {
+	t := o.tlsTransport()
+	if o.authToken == "" && o.tokenSource == nil {
+		return t
+	}
+	if t == nil {
+		t = http.DefaultTransport
+	}
+	return &authTransport{base: t, token: o.authToken, sign: o.signRequests, tokens: o.tokenSource}
+}
+
+// tlsTransport returns the transport the TLS options ask for, or nil
+func (o options) tlsTransport() http.RoundTripper {
+	if o.pins == nil && o.clientCert == nil && o.rootCAs == nil {
+		return nil
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.pins != nil {
+		t.TLSClientConfig.VerifyConnection = o.pins.verifyConnection
+	}
+	if o.clientCert != nil {
+		t.TLSClientConfig.Certificates = []tls.Certificate{*o.clientCert}
+	}
+	if o.rootCAs != nil {
+		t.TLSClientConfig.RootCAs = o.rootCAs
+	}
+	return t
+}
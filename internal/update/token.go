@@ -0,0 +1,218 @@
+package update
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource supplies the bearer tokens sent to an update server behind an
+// identity provider. Sources that mint tokens cache them and get new ones
+// shortly before they expire.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+const (
+	// tokenRefreshMargin is how long before expiry a token is replaced, so
+	// it doesn't run out mid-request
+	tokenRefreshMargin = 30 * time.Second
+	// tokenDefaultLifetime is how long a token of unknown expiry is reused
+	tokenDefaultLifetime = 5 * time.Minute
+	// maxTokenSize caps tokens and token responses
+	maxTokenSize = 64 << 10
+)
+
+// ParseTokenSource returns the token source spec names:
+//
+//   - file:PATH reads the token from a file on every request, for tokens
+//     kept fresh by an agent
+//   - exec:COMMAND runs COMMAND, split on spaces and without a shell, and
+//     uses what it prints, e.g. exec:gcloud auth print-identity-token
+//   - oauth2:URL gets tokens from the token endpoint at URL with the OAuth 2.0
+//     client credentials grant, authenticating as clientID and clientSecret
+//     and asking for scope when it isn't empty
+func ParseTokenSource(spec, clientID, clientSecret, scope string) (TokenSource, error) {
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok || arg == "" {
+		return nil, fmt.Errorf("invalid token source %q: want file:PATH, exec:COMMAND, or oauth2:URL", spec)
+	}
+
+	switch kind {
+	case "file":
+		return fileTokenSource(arg), nil
+	case "exec":
+		argv := strings.Fields(arg)
+		if len(argv) == 0 {
+			return nil, errors.New("exec token source needs a command")
+		}
+		return &cachedTokenSource{fetch: commandToken(argv)}, nil
+	case "oauth2":
+		if clientID == "" || clientSecret == "" {
+			return nil, errors.New("oauth2 token source needs a client ID and secret")
+		}
+		c := &clientCredentials{
+			tokenURL:     arg,
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			scope:        scope,
+			httpClient:   &http.Client{Timeout: 30 * time.Second},
+		}
+		return &cachedTokenSource{fetch: c.fetch}, nil
+	default:
+		return nil, fmt.Errorf("unknown token source %q", kind)
+	}
+}
+
+// fileTokenSource reads the token from a file
+type fileTokenSource string
+
+func (f fileTokenSource) Token(ctx context.Context) (string, error) {
+	data, err := os.ReadFile(string(f))
+	if err != nil {
+		return "", fmt.Errorf("read token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", string(f))
+	}
+	return token, nil
+}
+
+// cachedTokenSource reuses a fetched token until shortly before it expires
+type cachedTokenSource struct {
+	// fetch returns a new token and its expiry; zero when unknown
+	fetch func(ctx context.Context) (string, time.Time, error)
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (c *cachedTokenSource) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.token != "" && now.Before(c.expires.Add(-tokenRefreshMargin)) {
+		return c.token, nil
+	}
+
+	token, expires, err := c.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	if expires.IsZero() {
+		expires = jwtExpiry(token)
+	}
+	if expires.IsZero() {
+		expires = now.Add(tokenDefaultLifetime)
+	}
+	c.token, c.expires = token, expires
+	return token, nil
+}
+
+// commandToken returns a fetch that runs argv for a token
+func commandToken(argv []string) func(ctx context.Context) (string, time.Time, error) {
+	return func(ctx context.Context) (string, time.Time, error) {
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", time.Time{}, fmt.Errorf("run token command: %w", err)
+		}
+		token := strings.TrimSpace(stdout.String())
+		if token == "" || len(token) > maxTokenSize {
+			return "", time.Time{}, errors.New("token command printed no usable token")
+		}
+		return token, time.Time{}, nil
+	}
+}
+
+// clientCredentials is the OAuth 2.0 client credentials grant (RFC 6749
+// section 4.4), the usual way for a service to get tokens of its own
+type clientCredentials struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scope        string
+	httpClient   *http.Client
+}
+
+func (c *clientCredentials) fetch(ctx context.Context) (string, time.Time, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if c.scope != "" {
+		form.Set("scope", c.scope)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("request token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenSize))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", time.Time{}, fmt.Errorf("decode token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, errors.New("token response has no access_token")
+	}
+
+	var expires time.Time
+	if token.ExpiresIn > 0 {
+		expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return token.AccessToken, expires, nil
+}
+
+// jwtExpiry reads the exp claim of a JWT without verifying it, which is
+// the server's job; zero when token isn't a JWT with one
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(claims.Exp), 0)
+}
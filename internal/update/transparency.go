@@ -0,0 +1,260 @@
+package update
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/url"
+	"time"
+)
+
+// Transparency log endpoints. The server logs every asset it publishes in
+// an append-only Merkle tree (RFC 9162 hashing), so a server that shows one
+// client a release it hides from everyone else has to fork the log, which
+// clients holding an earlier checkpoint notice.
+const (
+	TransparencyCheckpointPath  = "/v1/log/checkpoint"
+	TransparencyProofPath       = "/v1/log/proof"
+	TransparencyConsistencyPath = "/v1/log/consistency"
+)
+
+// TransparencyFile is the name of the last verified checkpoint in the state
+// directory
+const TransparencyFile = "transparency.json"
+
+// CheckpointType tells a checkpoint apart from other documents signed with
+// the same keys
+const CheckpointType = "nametag-transparency-checkpoint"
+
+// ErrNotLogged is returned for an asset the transparency log doesn't prove
+// to contain
+var ErrNotLogged = errors.New("asset is not in the transparency log")
+
+// ErrLogForked is returned when a checkpoint doesn't extend the one seen
+// before, i.e. the server rewrote its log or shows clients different ones
+var ErrLogForked = errors.New("transparency log is inconsistent with the last checkpoint")
+
+// LogLeaf is one published asset, as logged
+type LogLeaf struct {
+	Component string `json:"component"`
+	Version   string `json:"version"`
+	Platform  string `json:"platform"`
+	SHA256    string `json:"sha256"`
+}
+
+// Hash returns the leaf's Merkle tree hash
+func (l LogLeaf) Hash() []byte {
+	data, _ := json.Marshal(l)
+	return leafHash(data)
+}
+
+// Query returns the proof request parameters identifying the leaf
+func (l LogLeaf) Query() url.Values {
+	return url.Values{
+		"component": {l.Component},
+		"version":   {l.Version},
+		"platform":  {l.Platform},
+		"sha256":    {l.SHA256},
+	}
+}
+
+// Checkpoint is a signed commitment to the log's first Size leaves
+type Checkpoint struct {
+	Type      string    `json:"type"`
+	Size      int64     `json:"size"`
+	Root      string    `json:"root"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// InclusionProof proves that the leaf at Index is in the tree of Size leaves
+type InclusionProof struct {
+	Index  int64    `json:"index"`
+	Size   int64    `json:"size"`
+	Hashes []string `json:"hashes"`
+}
+
+// ConsistencyProof proves that the tree of From leaves is a prefix of the
+// tree of To leaves
+type ConsistencyProof struct {
+	From   int64    `json:"from"`
+	To     int64    `json:"to"`
+	Hashes []string `json:"hashes"`
+}
+
+func leafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// splitPoint is the largest power of two smaller than n
+func splitPoint(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
+
+// MerkleRoot returns the root hash of the tree over the leaf hashes
+func MerkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return nodeHash(MerkleRoot(leaves[:k]), MerkleRoot(leaves[k:]))
+}
+
+// MerkleInclusion returns the audit path of leaf index in the tree over the
+// leaf hashes
+func MerkleInclusion(index int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := splitPoint(len(leaves))
+	if index < k {
+		return append(MerkleInclusion(index, leaves[:k]), MerkleRoot(leaves[k:]))
+	}
+	return append(MerkleInclusion(index-k, leaves[k:]), MerkleRoot(leaves[:k]))
+}
+
+// MerkleConsistency returns the proof that the tree over the first from
+// leaf hashes is a prefix of the tree over all of them
+func MerkleConsistency(from int, leaves [][]byte) [][]byte {
+	if from <= 0 || from >= len(leaves) {
+		return nil
+	}
+	return subproof(from, leaves, true)
+}
+
+func subproof(m int, leaves [][]byte, complete bool) [][]byte {
+	if m == len(leaves) {
+		if complete {
+			return nil
+		}
+		return [][]byte{MerkleRoot(leaves)}
+	}
+	k := splitPoint(len(leaves))
+	if m <= k {
+		return append(subproof(m, leaves[:k], complete), MerkleRoot(leaves[k:]))
+	}
+	return append(subproof(m-k, leaves[k:], false), MerkleRoot(leaves[:k]))
+}
+
+// VerifyInclusion checks that proof places leaf at index in the tree of size
+// leaves with root
+func VerifyInclusion(leaf []byte, index, size int64, proof [][]byte, root []byte) error {
+	if index < 0 || index >= size {
+		return fmt.Errorf("%w: index %d outside tree of %d", ErrNotLogged, index, size)
+	}
+
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range proof {
+		if sn == 0 {
+			return fmt.Errorf("%w: proof too long", ErrNotLogged)
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return fmt.Errorf("%w: proof doesn't lead to the checkpoint's root", ErrNotLogged)
+	}
+	return nil
+}
+
+// VerifyConsistency checks that proof shows the tree of from leaves with
+// fromRoot to be a prefix of the tree of to leaves with toRoot
+func VerifyConsistency(from, to int64, fromRoot, toRoot []byte, proof [][]byte) error {
+	switch {
+	case from > to:
+		return fmt.Errorf("%w: log shrank from %d to %d leaves", ErrLogForked, from, to)
+	case from == to:
+		if len(proof) > 0 || !bytes.Equal(fromRoot, toRoot) {
+			return fmt.Errorf("%w: different roots for %d leaves", ErrLogForked, to)
+		}
+		return nil
+	case from == 0:
+		return nil
+	}
+
+	// A complete subtree is its own first node
+	if from&(from-1) == 0 {
+		proof = append([][]byte{fromRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return fmt.Errorf("%w: empty proof", ErrLogForked)
+	}
+
+	fn, sn := from-1, to-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return fmt.Errorf("%w: proof too long", ErrLogForked)
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(fr, fromRoot) || !bytes.Equal(sr, toRoot) {
+		return fmt.Errorf("%w: %d leaves don't extend the %d seen before", ErrLogForked, to, from)
+	}
+	return nil
+}
+
+// EncodeHashes hex-encodes proof hashes for the wire
+func EncodeHashes(hashes [][]byte) []string {
+	encoded := make([]string, len(hashes))
+	for i, h := range hashes {
+		encoded[i] = hex.EncodeToString(h)
+	}
+	return encoded
+}
+
+// DecodeHashes decodes hex proof hashes
+func DecodeHashes(encoded []string) ([][]byte, error) {
+	hashes := make([][]byte, len(encoded))
+	for i, s := range encoded {
+		h, err := hex.DecodeString(s)
+		if err != nil || len(h) != sha256.Size {
+			return nil, fmt.Errorf("invalid proof hash %q", s)
+		}
+		hashes[i] = h
+	}
+	return hashes, nil
+}
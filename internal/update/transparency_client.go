@@ -0,0 +1,186 @@
+package update
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// maxTransparencyResponse bounds checkpoints and proofs read from the server
+const maxTransparencyResponse = 1 << 20
+
+// TransparencyClient verifies that assets are in the server's transparency
+// log before they are installed. It keeps the last checkpoint it verified
+// and only accepts later ones the server proves to extend it.
+type TransparencyClient struct {
+	statePath string
+}
+
+// NewTransparencyClient returns a client keeping its last verified
+// checkpoint at statePath
+func NewTransparencyClient(statePath string) *TransparencyClient {
+	return &TransparencyClient{statePath: statePath}
+}
+
+// Verify fetches the current checkpoint of product's log, checks its
+// signatures against keys (when set) and its consistency with the last one
+// seen, and checks that leaf is included in it
+func (t *TransparencyClient) Verify(ctx context.Context, httpClient *http.Client, serverURL, product string, keys *TrustedKeys, leaf LogLeaf) error {
+	checkpoint, root, err := t.fetchCheckpoint(ctx, httpClient, serverURL+ProductPath(product, TransparencyCheckpointPath), keys)
+	if err != nil {
+		return err
+	}
+
+	last, err := t.load()
+	if err != nil {
+		return err
+	}
+	if last != nil {
+		lastRoot, err := hex.DecodeString(last.Root)
+		if err != nil {
+			return fmt.Errorf("decode last checkpoint: %w", err)
+		}
+		var hashes [][]byte
+		if last.Size > 0 && last.Size < checkpoint.Size {
+			var proof ConsistencyProof
+			query := url.Values{"from": {strconv.FormatInt(last.Size, 10)}, "to": {strconv.FormatInt(checkpoint.Size, 10)}}
+			if err := fetchTransparency(ctx, httpClient, serverURL+ProductPath(product, TransparencyConsistencyPath)+"?"+query.Encode(), &proof); err != nil {
+				return fmt.Errorf("fetch consistency proof: %w", err)
+			}
+			if hashes, err = DecodeHashes(proof.Hashes); err != nil {
+				return fmt.Errorf("decode consistency proof: %w", err)
+			}
+		}
+		if err := VerifyConsistency(last.Size, checkpoint.Size, lastRoot, root, hashes); err != nil {
+			return err
+		}
+	}
+
+	query := leaf.Query()
+	query.Set("size", strconv.FormatInt(checkpoint.Size, 10))
+	var proof InclusionProof
+	if err := fetchTransparency(ctx, httpClient, serverURL+ProductPath(product, TransparencyProofPath)+"?"+query.Encode(), &proof); err != nil {
+		return fmt.Errorf("fetch inclusion proof: %w", err)
+	}
+	if proof.Size != checkpoint.Size {
+		return fmt.Errorf("%w: proof is for %d leaves, checkpoint has %d", ErrNotLogged, proof.Size, checkpoint.Size)
+	}
+	hashes, err := DecodeHashes(proof.Hashes)
+	if err != nil {
+		return fmt.Errorf("decode inclusion proof: %w", err)
+	}
+	if err := VerifyInclusion(leaf.Hash(), proof.Index, proof.Size, hashes, root); err != nil {
+		return err
+	}
+
+	return t.save(checkpoint)
+}
+
+// fetchCheckpoint fetches and verifies the checkpoint at url, returning it
+// with its decoded root
+func (t *TransparencyClient) fetchCheckpoint(ctx context.Context, httpClient *http.Client, url string, keys *TrustedKeys) (*Checkpoint, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("User-Agent", "nametag-updater/1.0")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetch checkpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return nil, nil, fmt.Errorf("fetch checkpoint: %w", err)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTransparencyResponse))
+	if err != nil {
+		return nil, nil, fmt.Errorf("read checkpoint: %w", err)
+	}
+
+	// A signed checkpoint is what makes a forked log evidence against the
+	// server rather than a network glitch
+	if keys != nil {
+		if err := keys.Current().Verify(body, resp.Header.Values(SignatureHeader)); err != nil {
+			return nil, nil, fmt.Errorf("verify checkpoint: %w", err)
+		}
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(body, &checkpoint); err != nil {
+		return nil, nil, fmt.Errorf("decode checkpoint: %w", err)
+	}
+	if checkpoint.Type != CheckpointType {
+		return nil, nil, fmt.Errorf("not a checkpoint: type %q", checkpoint.Type)
+	}
+	root, err := hex.DecodeString(checkpoint.Root)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode checkpoint root: %w", err)
+	}
+	return &checkpoint, root, nil
+}
+
+// fetchTransparency fetches a proof into v
+func fetchTransparency(ctx context.Context, httpClient *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("User-Agent", "nametag-updater/1.0")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotLogged
+	}
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxTransparencyResponse)).Decode(v)
+}
+
+// load reads the last verified checkpoint, or nil before the first one
+func (t *TransparencyClient) load() (*Checkpoint, error) {
+	data, err := os.ReadFile(t.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read last checkpoint: %w", err)
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("decode last checkpoint: %w", err)
+	}
+	return &checkpoint, nil
+}
+
+// save records checkpoint as the last one verified
+func (t *TransparencyClient) save(checkpoint *Checkpoint) error {
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal checkpoint: %w", err)
+	}
+
+	tmp := t.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, t.statePath); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	return nil
+}
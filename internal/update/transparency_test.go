@@ -0,0 +1,93 @@
+package update
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// testLeaves returns the hashes of n distinct leaves
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = LogLeaf{Component: "nametag", Version: fmt.Sprintf("1.0.%d", i), Platform: "linux-amd64"}.Hash()
+	}
+	return leaves
+}
+
+func TestVerifyInclusion(t *testing.T) {
+	for size := 1; size <= 17; size++ {
+		leaves := testLeaves(size)
+		root := MerkleRoot(leaves)
+		for index := range size {
+			proof := MerkleInclusion(index, leaves)
+			if err := VerifyInclusion(leaves[index], int64(index), int64(size), proof, root); err != nil {
+				t.Errorf("leaf %d of %d: VerifyInclusion() = %v", index, size, err)
+			}
+		}
+	}
+}
+
+func TestVerifyInclusionRejects(t *testing.T) {
+	const size, index = 7, 4
+	leaves := testLeaves(size)
+	root := MerkleRoot(leaves)
+	proof := MerkleInclusion(index, leaves)
+
+	tampered := make([][]byte, len(proof))
+	for i, p := range proof {
+		tampered[i] = bytes.Clone(p)
+	}
+	tampered[1][0] ^= 1
+
+	tests := []struct {
+		name  string
+		leaf  []byte
+		index int64
+		size  int64
+		proof [][]byte
+		root  []byte
+	}{
+		{"other leaf", leaves[index-1], index, size, proof, root},
+		{"other index", leaves[index], index - 1, size, proof, root},
+		{"index past the tree", leaves[index], size, size, proof, root},
+		{"negative index", leaves[index], -1, size, proof, root},
+		{"smaller tree", leaves[index], index, size - 1, proof, root},
+		{"tampered proof", leaves[index], index, size, tampered, root},
+		{"truncated proof", leaves[index], index, size, proof[:len(proof)-1], root},
+		{"padded proof", leaves[index], index, size, append(proof[:len(proof):len(proof)], root), root},
+		{"root of a prefix", leaves[index], index, size, proof, MerkleRoot(leaves[:size-1])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifyInclusion(tt.leaf, tt.index, tt.size, tt.proof, tt.root); !errors.Is(err, ErrNotLogged) {
+				t.Errorf("VerifyInclusion() = %v, want %v", err, ErrNotLogged)
+			}
+		})
+	}
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	const size = 17
+	leaves := testLeaves(size)
+	for to := 1; to <= size; to++ {
+		for from := 0; from <= to; from++ {
+			proof := MerkleConsistency(from, leaves[:to])
+			if err := VerifyConsistency(int64(from), int64(to), MerkleRoot(leaves[:from]), MerkleRoot(leaves[:to]), proof); err != nil {
+				t.Errorf("%d to %d leaves: VerifyConsistency() = %v", from, to, err)
+			}
+		}
+	}
+
+	// A log rewritten under an earlier checkpoint doesn't extend it
+	forked := append(testLeaves(5), testLeaves(size)[5:]...)
+	forked[2] = LogLeaf{Component: "nametag", Version: "6.6.6", Platform: "linux-amd64"}.Hash()
+	proof := MerkleConsistency(5, forked)
+	if err := VerifyConsistency(5, size, MerkleRoot(leaves[:5]), MerkleRoot(forked), proof); !errors.Is(err, ErrLogForked) {
+		t.Errorf("VerifyConsistency() of a forked log = %v, want %v", err, ErrLogForked)
+	}
+	if err := VerifyConsistency(size, 5, MerkleRoot(leaves), MerkleRoot(leaves[:5]), nil); !errors.Is(err, ErrLogForked) {
+		t.Errorf("VerifyConsistency() of a shrunk log = %v, want %v", err, ErrLogForked)
+	}
+}
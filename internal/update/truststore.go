@@ -0,0 +1,144 @@
+package update
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// TrustStoreFile is the name of the local trust store in the state
+// directory; release channels other than stable have their own, named
+// trusted-keys-{channel}.json
+const TrustStoreFile = "trusted-keys.json"
+
+// TrustStorePath returns the path of channel's trust store in stateDir
+func TrustStorePath(stateDir, channel string) string {
+	if channel = NormalizeChannel(channel); channel != ChannelStable {
+		return filepath.Join(stateDir, "trusted-keys-"+channel+".json")
+	}
+	return filepath.Join(stateDir, TrustStoreFile)
+}
+
+// LocalKey is a signing key trusted locally, on top of the keys built into
+// the client, e.g. the key of an internal mirror that re-signs releases
+type LocalKey struct {
+	Key     string    `json:"key"`
+	Comment string    `json:"comment,omitempty"`
+	Added   time.Time `json:"added"`
+	// Expires is when the key stops being trusted; zero never expires
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// Expired reports whether the key is no longer trusted at now
+func (k LocalKey) Expired(now time.Time) bool {
+	return !k.Expires.IsZero() && !now.Before(k.Expires)
+}
+
+// TrustStore is a file of locally trusted signing keys, managed with
+// nametag trust
+type TrustStore struct {
+	path string
+}
+
+type trustStoreFile struct {
+	Keys []LocalKey `json:"keys"`
+}
+
+// NewTrustStore returns the trust store at path; a missing file is an empty
+// store
+func NewTrustStore(path string) *TrustStore {
+	return &TrustStore{path: path}
+}
+
+// List returns every key in the store, expired ones included
+func (s *TrustStore) List() ([]LocalKey, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read trust store: %w", err)
+	}
+
+	var file trustStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("decode trust store %s: %w", s.path, err)
+	}
+	return file.Keys, nil
+}
+
+// Keys returns the keys trusted at now
+func (s *TrustStore) Keys(now time.Time) ([]ed25519.PublicKey, error) {
+	local, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ed25519.PublicKey
+	for _, k := range local {
+		if k.Expired(now) {
+			continue
+		}
+		key, err := ParsePublicKey(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("trust store %s: %w", s.path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Add trusts key, replacing an earlier entry for the same key so its expiry
+// and comment can be changed
+func (s *TrustStore) Add(key LocalKey) error {
+	if _, err := ParsePublicKey(key.Key); err != nil {
+		return err
+	}
+
+	keys, err := s.List()
+	if err != nil {
+		return err
+	}
+	keys = slices.DeleteFunc(keys, func(k LocalKey) bool { return k.Key == key.Key })
+	return s.write(append(keys, key))
+}
+
+// Remove stops trusting key and reports whether it was in the store
+func (s *TrustStore) Remove(key string) (bool, error) {
+	keys, err := s.List()
+	if err != nil {
+		return false, err
+	}
+
+	n := len(keys)
+	keys = slices.DeleteFunc(keys, func(k LocalKey) bool { return k.Key == key })
+	if len(keys) == n {
+		return false, nil
+	}
+	return true, s.write(keys)
+}
+
+func (s *TrustStore) write(keys []LocalKey) error {
+	data, err := json.MarshalIndent(trustStoreFile{Keys: keys}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode trust store: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("create state directory: %w", err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write trust store: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write trust store: %w", err)
+	}
+	return nil
+}
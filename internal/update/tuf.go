@@ -0,0 +1,368 @@
+package update
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TUF role names and the spec version the metadata follows
+const (
+	TUFRoleRoot      = "root"
+	TUFRoleTargets   = "targets"
+	TUFRoleSnapshot  = "snapshot"
+	TUFRoleTimestamp = "timestamp"
+
+	TUFSpecVersion = "1.0.31"
+)
+
+// TUFKey is a public key in TUF metadata
+type TUFKey struct {
+	KeyType string       `json:"keytype"`
+	Scheme  string       `json:"scheme"`
+	KeyVal  TUFKeyValues `json:"keyval"`
+}
+
+// TUFKeyValues holds the hex-encoded public key
+type TUFKeyValues struct {
+	Public string `json:"public"`
+}
+
+// TUFRole lists the keys trusted for a role and how many must sign
+type TUFRole struct {
+	KeyIDs    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+// TUFHeader holds the fields common to all TUF metadata
+type TUFHeader struct {
+	Type        string    `json:"_type"`
+	SpecVersion string    `json:"spec_version"`
+	Version     int64     `json:"version"`
+	Expires     time.Time `json:"expires"`
+}
+
+// TUFRoot is the root role metadata
+type TUFRoot struct {
+	TUFHeader
+	ConsistentSnapshot bool               `json:"consistent_snapshot"`
+	Keys               map[string]TUFKey  `json:"keys"`
+	Roles              map[string]TUFRole `json:"roles"`
+}
+
+// TUFMetaFile describes a metadata file referenced by timestamp or snapshot
+type TUFMetaFile struct {
+	Version int64             `json:"version"`
+	Length  int64             `json:"length,omitempty"`
+	Hashes  map[string]string `json:"hashes,omitempty"`
+}
+
+// TUFTimestamp is the timestamp role metadata
+type TUFTimestamp struct {
+	TUFHeader
+	Meta map[string]TUFMetaFile `json:"meta"`
+}
+
+// TUFSnapshot is the snapshot role metadata
+type TUFSnapshot struct {
+	TUFHeader
+	Meta map[string]TUFMetaFile `json:"meta"`
+}
+
+// TUFTargetCustom carries the fields needed to build a Manifest from targets
+type TUFTargetCustom struct {
+	Component string `json:"component"`
+	Version   string `json:"version"`
+	Platform  string `json:"platform"`
+	URL       string `json:"url"`
+	Format    string `json:"format,omitempty"`
+	KeyID     string `json:"key_id,omitempty"`
+
+	SignatureURL    string `json:"signature_url,omitempty"`
+	GPGSignatureURL string `json:"gpg_signature_url,omitempty"`
+	ProvenanceURL   string `json:"provenance_url,omitempty"`
+	SBOMURL         string `json:"sbom_url,omitempty"`
+	SBOMFormat      string `json:"sbom_format,omitempty"`
+
+	Hooks []string `json:"hooks,omitempty"`
+}
+
+// TUFTarget describes a downloadable target file
+type TUFTarget struct {
+	Length int64             `json:"length"`
+	Hashes map[string]string `json:"hashes"`
+	Custom *TUFTargetCustom  `json:"custom,omitempty"`
+}
+
+// TUFTargets is the targets role metadata
+type TUFTargets struct {
+	TUFHeader
+	Targets map[string]TUFTarget `json:"targets"`
+}
+
+// TUFSignature is a signature over the canonical form of the signed metadata
+type TUFSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// tufEnvelope is the on-the-wire form of signed metadata
+type tufEnvelope struct {
+	Signed     json.RawMessage `json:"signed"`
+	Signatures []TUFSignature  `json:"signatures"`
+}
+
+// NewTUFHeader returns a header for role metadata
+func NewTUFHeader(role string, version int64, expires time.Time) TUFHeader {
+	return TUFHeader{
+		Type:        role,
+		SpecVersion: TUFSpecVersion,
+		Version:     version,
+		// The spec requires expiry timestamps without fractional seconds
+		Expires: expires.UTC().Truncate(time.Second),
+	}
+}
+
+// NewTUFKey wraps an Ed25519 public key for TUF metadata
+func NewTUFKey(key ed25519.PublicKey) TUFKey {
+	return TUFKey{
+		KeyType: "ed25519",
+		Scheme:  "ed25519",
+		KeyVal:  TUFKeyValues{Public: hex.EncodeToString(key)},
+	}
+}
+
+// TUFKeyID returns the key ID of a key: the SHA256 of its canonical JSON
+func TUFKeyID(key TUFKey) (string, error) {
+	data, err := canonicalJSON(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// SignTUF signs role metadata with the given keys and returns the envelope
+func SignTUF(signed any, keys ...ed25519.PrivateKey) ([]byte, error) {
+	data, err := canonicalJSON(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := tufEnvelope{Signed: data}
+	for _, key := range keys {
+		keyID, err := TUFKeyID(NewTUFKey(key.Public().(ed25519.PublicKey)))
+		if err != nil {
+			return nil, err
+		}
+		envelope.Signatures = append(envelope.Signatures, TUFSignature{
+			KeyID: keyID,
+			Sig:   hex.EncodeToString(ed25519.Sign(key, data)),
+		})
+	}
+
+	out, err := json.MarshalIndent(envelope, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal metadata: %w", err)
+	}
+	return out, nil
+}
+
+// VerifyTUF checks that data carries at least role's threshold of valid
+// signatures from keys listed in root, then decodes the signed metadata
+// into out and checks its type
+func VerifyTUF(data []byte, root *TUFRoot, role string, out any) error {
+	var envelope tufEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return fmt.Errorf("decode %s metadata: %w", role, err)
+	}
+
+	roleKeys, ok := root.Roles[role]
+	if !ok {
+		return fmt.Errorf("root does not define role %q", role)
+	}
+	if roleKeys.Threshold < 1 {
+		return fmt.Errorf("role %q has invalid threshold %d", role, roleKeys.Threshold)
+	}
+
+	signed, err := recanonicalize(envelope.Signed)
+	if err != nil {
+		return fmt.Errorf("canonicalize %s metadata: %w", role, err)
+	}
+
+	trusted := make(map[string]bool, len(roleKeys.KeyIDs))
+	for _, id := range roleKeys.KeyIDs {
+		trusted[id] = true
+	}
+
+	valid := make(map[string]bool)
+	for _, sig := range envelope.Signatures {
+		if !trusted[sig.KeyID] || valid[sig.KeyID] {
+			continue
+		}
+		key, ok := root.Keys[sig.KeyID]
+		if !ok || key.KeyType != "ed25519" {
+			continue
+		}
+		pub, err := hex.DecodeString(key.KeyVal.Public)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			continue
+		}
+		raw, err := hex.DecodeString(sig.Sig)
+		if err != nil {
+			continue
+		}
+		if ed25519.Verify(pub, signed, raw) {
+			valid[sig.KeyID] = true
+		}
+	}
+
+	if len(valid) < roleKeys.Threshold {
+		return fmt.Errorf("%s metadata has %d valid signature(s), threshold is %d", role, len(valid), roleKeys.Threshold)
+	}
+
+	if err := json.Unmarshal(envelope.Signed, out); err != nil {
+		return fmt.Errorf("decode signed %s metadata: %w", role, err)
+	}
+
+	var header struct {
+		Type string `json:"_type"`
+	}
+	if err := json.Unmarshal(envelope.Signed, &header); err != nil {
+		return fmt.Errorf("decode %s metadata type: %w", role, err)
+	}
+	if header.Type != role {
+		return fmt.Errorf("expected %s metadata, got %q", role, header.Type)
+	}
+
+	return nil
+}
+
+// ParseTUFRoot decodes root metadata and checks that it is signed by the
+// keys it declares itself
+func ParseTUFRoot(data []byte) (*TUFRoot, error) {
+	var envelope tufEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("decode root metadata: %w", err)
+	}
+
+	var root TUFRoot
+	if err := json.Unmarshal(envelope.Signed, &root); err != nil {
+		return nil, fmt.Errorf("decode signed root metadata: %w", err)
+	}
+	if err := VerifyTUF(data, &root, TUFRoleRoot, &root); err != nil {
+		return nil, fmt.Errorf("verify root metadata: %w", err)
+	}
+
+	return &root, nil
+}
+
+// Manifest converts targets metadata into a manifest offering the highest
+// version of each component
+func (t *TUFTargets) Manifest() (*Manifest, error) {
+	latest := make(map[string]Version)
+	for path, target := range t.Targets {
+		if target.Custom == nil {
+			continue
+		}
+		version, err := ParseVersion(target.Custom.Version)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", path, err)
+		}
+		if current, ok := latest[target.Custom.Component]; !ok || current.LessThan(version) {
+			latest[target.Custom.Component] = version
+		}
+	}
+
+	manifest := &Manifest{
+		SchemaVersion: SchemaVersion,
+		Generated:     time.Now().UTC(),
+		Expires:       t.Expires,
+		Components:    make(map[string]Component),
+	}
+
+	for path, target := range t.Targets {
+		custom := target.Custom
+		if custom == nil {
+			continue
+		}
+
+		version, _ := ParseVersion(custom.Version)
+		if version != latest[custom.Component] {
+			continue
+		}
+
+		sha, ok := target.Hashes["sha256"]
+		if !ok {
+			return nil, fmt.Errorf("target %q has no sha256 hash", path)
+		}
+
+		comp, ok := manifest.Components[custom.Component]
+		if !ok {
+			comp = Component{
+				Name:    custom.Component,
+				Version: custom.Version,
+				Assets:  make(map[string]Asset),
+			}
+		}
+
+		comp.Assets[custom.Platform] = Asset{
+			URL:    custom.URL,
+			Size:   target.Length,
+			SHA256: sha,
+			Hashes: extraDigests(target.Hashes),
+			Format: custom.Format,
+			KeyID:  custom.KeyID,
+
+			SignatureURL:    custom.SignatureURL,
+			GPGSignatureURL: custom.GPGSignatureURL,
+			ProvenanceURL:   custom.ProvenanceURL,
+			SBOMURL:         custom.SBOMURL,
+			SBOMFormat:      custom.SBOMFormat,
+
+			Hooks: custom.Hooks,
+		}
+		manifest.Components[custom.Component] = comp
+	}
+
+	return manifest, nil
+}
+
+// canonicalJSON encodes v as canonical JSON: sorted object keys, no
+// insignificant whitespace, and no HTML escaping
+func canonicalJSON(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+	return recanonicalize(data)
+}
+
+// recanonicalize re-encodes JSON through a generic value so maps and struct
+// fields alike come out with sorted keys
+func recanonicalize(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after JSON value")
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(generic); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,365 @@
+package update
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// maxTUFMetadataSize caps how much metadata the client will download
+const maxTUFMetadataSize = 8 << 20
+
+// errNotFound marks metadata the server does not have
+var errNotFound = errors.New("not found")
+
+// TUFClient fetches and verifies TUF metadata from the update server,
+// keeping the last trusted metadata on disk to detect rollback and freeze
+// attacks between runs
+type TUFClient struct {
+	baseURL    string
+	storeDir   string
+	httpClient *http.Client
+	logger     *slog.Logger
+}
+
+// NewTUFClient creates a TUF client. The trusted root is read from storeDir;
+// bootstrapRoot seeds it on first use and is ignored once a root is stored.
+func NewTUFClient(serverURL, storeDir string, bootstrapRoot []byte, logger *slog.Logger, opts ...Option) (*TUFClient, error) {
+	o := applyOptions(opts)
+
+	c := &TUFClient{
+		baseURL:  serverURL + "/v1/tuf",
+		storeDir: storeDir,
+		httpClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: o.transport(),
+		},
+		logger: logger,
+	}
+
+	if err := os.MkdirAll(storeDir, 0700); err != nil {
+		return nil, fmt.Errorf("create metadata store: %w", err)
+	}
+
+	if _, err := os.Stat(c.storePath(TUFRoleRoot)); os.IsNotExist(err) {
+		if bootstrapRoot == nil {
+			return nil, errors.New("no trusted root: a bootstrap root.json is required on first use")
+		}
+
+		// The bootstrap root is trusted by fiat but must still be self-consistent
+		if _, err := ParseTUFRoot(bootstrapRoot); err != nil {
+			return nil, fmt.Errorf("bootstrap root: %w", err)
+		}
+		if err := c.store(TUFRoleRoot, bootstrapRoot); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// HasTrustedRoot reports whether a trusted root is already stored in storeDir
+func HasTrustedRoot(storeDir string) bool {
+	_, err := os.Stat(filepath.Join(storeDir, TUFRoleRoot+".json"))
+	return err == nil
+}
+
+// Manifest runs the TUF client workflow (root, timestamp, snapshot, targets)
+// and returns a manifest built from the verified targets
+func (c *TUFClient) Manifest(ctx context.Context) (*Manifest, error) {
+	targets, err := c.Update(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return targets.Manifest()
+}
+
+// Update refreshes all metadata and returns the verified targets
+func (c *TUFClient) Update(ctx context.Context) (*TUFTargets, error) {
+	root, err := c.updateRoot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("update root: %w", err)
+	}
+
+	timestamp, err := c.updateTimestamp(ctx, root)
+	if err != nil {
+		return nil, fmt.Errorf("update timestamp: %w", err)
+	}
+
+	snapshot, err := c.updateSnapshot(ctx, root, timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("update snapshot: %w", err)
+	}
+
+	targets, err := c.updateTargets(ctx, root, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("update targets: %w", err)
+	}
+
+	return targets, nil
+}
+
+// updateRoot walks the chain of root versions N+1, N+2, ... each of which
+// must be signed by both the previous root's keys and its own
+func (c *TUFClient) updateRoot(ctx context.Context) (*TUFRoot, error) {
+	data, err := os.ReadFile(c.storePath(TUFRoleRoot))
+	if err != nil {
+		return nil, fmt.Errorf("read trusted root: %w", err)
+	}
+
+	root, err := ParseTUFRoot(data)
+	if err != nil {
+		return nil, fmt.Errorf("trusted root: %w", err)
+	}
+	trusted := *root
+
+	for {
+		next := trusted.Version + 1
+		data, err := c.fetch(ctx, strconv.FormatInt(next, 10)+".root.json")
+		if errors.Is(err, errNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var candidate TUFRoot
+		if err := VerifyTUF(data, &trusted, TUFRoleRoot, &candidate); err != nil {
+			return nil, fmt.Errorf("root v%d not signed by trusted root: %w", next, err)
+		}
+		if err := VerifyTUF(data, &candidate, TUFRoleRoot, &candidate); err != nil {
+			return nil, fmt.Errorf("root v%d not self-signed: %w", next, err)
+		}
+		if candidate.Version != next {
+			return nil, fmt.Errorf("root version is %d, expected %d", candidate.Version, next)
+		}
+
+		if err := c.store(TUFRoleRoot, data); err != nil {
+			return nil, err
+		}
+		c.logger.Info("rotated tuf root", "version", candidate.Version)
+
+		// Key rotation invalidates trust in the online roles' metadata
+		if rolesChanged(&trusted, &candidate) {
+			for _, role := range []string{TUFRoleTimestamp, TUFRoleSnapshot, TUFRoleTargets} {
+				_ = os.Remove(c.storePath(role))
+			}
+		}
+
+		trusted = candidate
+	}
+
+	if time.Now().After(trusted.Expires) {
+		return nil, fmt.Errorf("root metadata expired at %s", trusted.Expires)
+	}
+
+	return &trusted, nil
+}
+
+func (c *TUFClient) updateTimestamp(ctx context.Context, root *TUFRoot) (*TUFTimestamp, error) {
+	data, err := c.fetch(ctx, "timestamp.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var timestamp TUFTimestamp
+	if err := VerifyTUF(data, root, TUFRoleTimestamp, &timestamp); err != nil {
+		return nil, err
+	}
+
+	var previous TUFTimestamp
+	if c.loadTrusted(root, TUFRoleTimestamp, &previous) {
+		if timestamp.Version < previous.Version {
+			return nil, fmt.Errorf("rollback: version %d is older than trusted %d", timestamp.Version, previous.Version)
+		}
+		if timestamp.Meta["snapshot.json"].Version < previous.Meta["snapshot.json"].Version {
+			return nil, errors.New("rollback: snapshot version went backwards")
+		}
+	}
+
+	if _, ok := timestamp.Meta["snapshot.json"]; !ok {
+		return nil, errors.New("timestamp does not reference snapshot.json")
+	}
+	if time.Now().After(timestamp.Expires) {
+		return nil, fmt.Errorf("timestamp metadata expired at %s", timestamp.Expires)
+	}
+
+	if err := c.store(TUFRoleTimestamp, data); err != nil {
+		return nil, err
+	}
+	return &timestamp, nil
+}
+
+func (c *TUFClient) updateSnapshot(ctx context.Context, root *TUFRoot, timestamp *TUFTimestamp) (*TUFSnapshot, error) {
+	data, err := c.fetch(ctx, "snapshot.json")
+	if err != nil {
+		return nil, err
+	}
+
+	expected := timestamp.Meta["snapshot.json"]
+	if err := checkMetaFile(data, expected); err != nil {
+		return nil, err
+	}
+
+	var snapshot TUFSnapshot
+	if err := VerifyTUF(data, root, TUFRoleSnapshot, &snapshot); err != nil {
+		return nil, err
+	}
+
+	if snapshot.Version != expected.Version {
+		return nil, fmt.Errorf("version is %d, timestamp says %d", snapshot.Version, expected.Version)
+	}
+
+	var previous TUFSnapshot
+	if c.loadTrusted(root, TUFRoleSnapshot, &previous) {
+		for name, meta := range previous.Meta {
+			current, ok := snapshot.Meta[name]
+			if !ok {
+				return nil, fmt.Errorf("%s is no longer listed", name)
+			}
+			if current.Version < meta.Version {
+				return nil, fmt.Errorf("rollback: %s version went backwards", name)
+			}
+		}
+	}
+
+	if _, ok := snapshot.Meta["targets.json"]; !ok {
+		return nil, errors.New("snapshot does not reference targets.json")
+	}
+	if time.Now().After(snapshot.Expires) {
+		return nil, fmt.Errorf("snapshot metadata expired at %s", snapshot.Expires)
+	}
+
+	if err := c.store(TUFRoleSnapshot, data); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func (c *TUFClient) updateTargets(ctx context.Context, root *TUFRoot, snapshot *TUFSnapshot) (*TUFTargets, error) {
+	data, err := c.fetch(ctx, "targets.json")
+	if err != nil {
+		return nil, err
+	}
+
+	expected := snapshot.Meta["targets.json"]
+	if err := checkMetaFile(data, expected); err != nil {
+		return nil, err
+	}
+
+	var targets TUFTargets
+	if err := VerifyTUF(data, root, TUFRoleTargets, &targets); err != nil {
+		return nil, err
+	}
+
+	if targets.Version != expected.Version {
+		return nil, fmt.Errorf("version is %d, snapshot says %d", targets.Version, expected.Version)
+	}
+	if time.Now().After(targets.Expires) {
+		return nil, fmt.Errorf("targets metadata expired at %s", targets.Expires)
+	}
+
+	if err := c.store(TUFRoleTargets, data); err != nil {
+		return nil, err
+	}
+	return &targets, nil
+}
+
+// loadTrusted loads previously trusted metadata for rollback checks. Stored
+// metadata that no longer verifies (e.g. after key rotation) is ignored.
+func (c *TUFClient) loadTrusted(root *TUFRoot, role string, out any) bool {
+	data, err := os.ReadFile(c.storePath(role))
+	if err != nil {
+		return false
+	}
+	return VerifyTUF(data, root, role, out) == nil
+}
+
+func (c *TUFClient) fetch(ctx context.Context, name string) ([]byte, error) {
+	url := c.baseURL + "/" + name
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("User-Agent", "nametag-updater/1.0")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("fetch %s: %w", name, errNotFound)
+	}
+	if err := checkStatus(resp); err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", name, err)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxTUFMetadataSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	if len(data) > maxTUFMetadataSize {
+		return nil, fmt.Errorf("%s exceeds %d bytes", name, maxTUFMetadataSize)
+	}
+
+	return data, nil
+}
+
+func (c *TUFClient) storePath(role string) string {
+	return filepath.Join(c.storeDir, role+".json")
+}
+
+func (c *TUFClient) store(role string, data []byte) error {
+	tmp := c.storePath(role) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("store %s metadata: %w", role, err)
+	}
+	if err := os.Rename(tmp, c.storePath(role)); err != nil {
+		return fmt.Errorf("store %s metadata: %w", role, err)
+	}
+	return nil
+}
+
+// checkMetaFile verifies metadata against the length and hashes recorded for
+// it by the role above, when present
+func checkMetaFile(data []byte, meta TUFMetaFile) error {
+	if meta.Length > 0 && int64(len(data)) != meta.Length {
+		return fmt.Errorf("length is %d, expected %d", len(data), meta.Length)
+	}
+	if expected, ok := meta.Hashes["sha256"]; ok {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != expected {
+			return errors.New("sha256 does not match")
+		}
+	}
+	return nil
+}
+
+// rolesChanged reports whether any online role's keys changed between roots
+func rolesChanged(old, new *TUFRoot) bool {
+	for _, role := range []string{TUFRoleTimestamp, TUFRoleSnapshot, TUFRoleTargets} {
+		a, b := old.Roles[role], new.Roles[role]
+		if a.Threshold != b.Threshold || len(a.KeyIDs) != len(b.KeyIDs) {
+			return true
+		}
+		for i := range a.KeyIDs {
+			if a.KeyIDs[i] != b.KeyIDs[i] {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,308 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tufRepo is a TUF repository of one root key and one online key for the
+// timestamp, snapshot, and targets roles, served under /v1/tuf
+type tufRepo struct {
+	t       *testing.T
+	srv     *httptest.Server
+	rootKey ed25519.PrivateKey
+	online  ed25519.PrivateKey
+	root    TUFRoot
+
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newTUFRepo(t *testing.T) *tufRepo {
+	t.Helper()
+	_, rootKey := newTestKey(t)
+	_, online := newTestKey(t)
+	r := &tufRepo{t: t, rootKey: rootKey, online: online, files: make(map[string][]byte)}
+	r.root = r.newRoot(1, rootKey, online)
+	r.files["1.root.json"] = r.sign(r.root, rootKey)
+
+	r.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		data, ok := r.files[strings.TrimPrefix(req.URL.Path, "/v1/tuf/")]
+		r.mu.Unlock()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(r.srv.Close)
+	return r
+}
+
+func (r *tufRepo) keyID(key ed25519.PrivateKey) string {
+	id, err := TUFKeyID(NewTUFKey(key.Public().(ed25519.PublicKey)))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return id
+}
+
+// newRoot returns root metadata trusting rootKey for the root role and
+// online for the others
+func (r *tufRepo) newRoot(version int64, rootKey, online ed25519.PrivateKey) TUFRoot {
+	root := TUFRoot{
+		TUFHeader: NewTUFHeader(TUFRoleRoot, version, time.Now().Add(365*24*time.Hour)),
+		Keys: map[string]TUFKey{
+			r.keyID(rootKey): NewTUFKey(rootKey.Public().(ed25519.PublicKey)),
+			r.keyID(online):  NewTUFKey(online.Public().(ed25519.PublicKey)),
+		},
+		Roles: map[string]TUFRole{TUFRoleRoot: {KeyIDs: []string{r.keyID(rootKey)}, Threshold: 1}},
+	}
+	for _, role := range []string{TUFRoleTimestamp, TUFRoleSnapshot, TUFRoleTargets} {
+		root.Roles[role] = TUFRole{KeyIDs: []string{r.keyID(online)}, Threshold: 1}
+	}
+	return root
+}
+
+func (r *tufRepo) sign(signed any, keys ...ed25519.PrivateKey) []byte {
+	data, err := SignTUF(signed, keys...)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return data
+}
+
+func metaFile(version int64, data []byte) TUFMetaFile {
+	sum := sha256.Sum256(data)
+	return TUFMetaFile{Version: version, Length: int64(len(data)), Hashes: map[string]string{"sha256": hex.EncodeToString(sum[:])}}
+}
+
+// publish signs and serves targets offering nametag at versions, as
+// targets, snapshot, and timestamp metadata all at version
+func (r *tufRepo) publish(version int64, versions ...string) {
+	expires := time.Now().Add(24 * time.Hour)
+	targets := TUFTargets{TUFHeader: NewTUFHeader(TUFRoleTargets, version, expires), Targets: map[string]TUFTarget{}}
+	for _, v := range versions {
+		targets.Targets["nametag/"+v+"/linux-amd64"] = TUFTarget{
+			Length: 1024,
+			Hashes: map[string]string{"sha256": strings.Repeat("ab", 32)},
+			Custom: &TUFTargetCustom{Component: "nametag", Version: v, Platform: "linux-amd64", URL: "/v1/download/nametag/linux-amd64/" + v},
+		}
+	}
+	targetsData := r.sign(targets, r.online)
+	snapshot := TUFSnapshot{TUFHeader: NewTUFHeader(TUFRoleSnapshot, version, expires), Meta: map[string]TUFMetaFile{"targets.json": metaFile(version, targetsData)}}
+	snapshotData := r.sign(snapshot, r.online)
+	timestamp := TUFTimestamp{TUFHeader: NewTUFHeader(TUFRoleTimestamp, version, expires), Meta: map[string]TUFMetaFile{"snapshot.json": metaFile(version, snapshotData)}}
+
+	r.serve(map[string][]byte{
+		"targets.json":   targetsData,
+		"snapshot.json":  snapshotData,
+		"timestamp.json": r.sign(timestamp, r.online),
+	})
+}
+
+func (r *tufRepo) serve(files map[string][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, data := range files {
+		r.files[name] = data
+	}
+}
+
+func (r *tufRepo) file(name string) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.files[name]
+}
+
+// client returns a client bootstrapped with the repository's first root,
+// storing its metadata in dir
+func (r *tufRepo) client(dir string) *TUFClient {
+	r.t.Helper()
+	c, err := NewTUFClient(r.srv.URL, dir, r.file("1.root.json"), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return c
+}
+
+func TestTUFClientManifest(t *testing.T) {
+	repo := newTUFRepo(t)
+	repo.publish(1, "1.0.0", "1.2.0", "1.1.0")
+	dir := t.TempDir()
+
+	manifest, err := repo.client(dir).Manifest(context.Background())
+	if err != nil {
+		t.Fatalf("Manifest() = %v", err)
+	}
+	comp := manifest.Components["nametag"]
+	if comp.Version != "1.2.0" || comp.Assets["linux-amd64"].URL != "/v1/download/nametag/linux-amd64/1.2.0" {
+		t.Errorf("offered %s at %s, want 1.2.0", comp.Version, comp.Assets["linux-amd64"].URL)
+	}
+	for _, role := range []string{TUFRoleRoot, TUFRoleTimestamp, TUFRoleSnapshot, TUFRoleTargets} {
+		if _, err := os.Stat(filepath.Join(dir, role+".json")); err != nil {
+			t.Errorf("%s metadata not stored: %v", role, err)
+		}
+	}
+}
+
+func TestTUFClientRejects(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+	_, attacker := newTestKey(t)
+
+	for _, tt := range []struct {
+		name string
+		// tamper changes the repository after the client trusted version 2
+		tamper  func(r *tufRepo)
+		wantErr string
+	}{
+		{"rollback", func(r *tufRepo) { r.publish(1, "1.0.0") }, "rollback"},
+		{"expired timestamp", func(r *tufRepo) {
+			timestamp := TUFTimestamp{TUFHeader: NewTUFHeader(TUFRoleTimestamp, 3, expired), Meta: map[string]TUFMetaFile{"snapshot.json": {Version: 2}}}
+			r.serve(map[string][]byte{"timestamp.json": r.sign(timestamp, r.online)})
+		}, "expired"},
+		// Targets swapped in without a snapshot listing them
+		{"mix and match", func(r *tufRepo) {
+			current := r.file("timestamp.json")
+			r.publish(3, "9.9.9")
+			r.serve(map[string][]byte{"timestamp.json": current})
+		}, "snapshot"},
+		{"untrusted key", func(r *tufRepo) {
+			r.online = attacker
+			r.publish(3, "9.9.9")
+		}, "valid signature"},
+		{"wrong role", func(r *tufRepo) {
+			snapshot := TUFSnapshot{TUFHeader: NewTUFHeader(TUFRoleSnapshot, 3, time.Now().Add(time.Hour))}
+			r.serve(map[string][]byte{"timestamp.json": r.sign(snapshot, r.online)})
+		}, "expected timestamp metadata"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTUFRepo(t)
+			repo.publish(2, "1.0.0")
+			client := repo.client(t.TempDir())
+			if _, err := client.Update(context.Background()); err != nil {
+				t.Fatalf("Update() = %v", err)
+			}
+
+			tt.tamper(repo)
+			_, err := client.Update(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Update() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTUFClientRootRotation(t *testing.T) {
+	_, newRootKey := newTestKey(t)
+	_, newOnline := newTestKey(t)
+
+	for _, tt := range []struct {
+		name    string
+		signers func(r *tufRepo) []ed25519.PrivateKey
+		wantErr string
+	}{
+		{"signed by both roots", func(r *tufRepo) []ed25519.PrivateKey { return []ed25519.PrivateKey{r.rootKey, newRootKey} }, ""},
+		{"signed by the new root only", func(r *tufRepo) []ed25519.PrivateKey { return []ed25519.PrivateKey{newRootKey} }, "not signed by trusted root"},
+		{"signed by the old root only", func(r *tufRepo) []ed25519.PrivateKey { return []ed25519.PrivateKey{r.rootKey} }, "not self-signed"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTUFRepo(t)
+			repo.publish(1, "1.0.0")
+			dir := t.TempDir()
+			client := repo.client(dir)
+			if _, err := client.Update(context.Background()); err != nil {
+				t.Fatalf("Update() = %v", err)
+			}
+
+			// Version 2 rotates the root key and the online key
+			root := repo.newRoot(2, newRootKey, newOnline)
+			repo.serve(map[string][]byte{"2.root.json": repo.sign(root, tt.signers(repo)...)})
+			repo.online = newOnline
+			repo.publish(1, "1.1.0")
+
+			_, err := client.Update(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Update() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			// The online metadata restarts at version 1 under the new keys,
+			// which is only accepted because the rotation dropped the old
+			if err != nil {
+				t.Fatalf("Update() = %v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, TUFRoleRoot+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := ParseTUFRoot(data)
+			if err != nil || stored.Version != 2 {
+				t.Fatalf("stored root = %v, %v, want version 2", stored, err)
+			}
+		})
+	}
+}
+
+func TestVerifyTUFThreshold(t *testing.T) {
+	repo := newTUFRepo(t)
+	_, second := newTestKey(t)
+	root := repo.newRoot(1, repo.rootKey, repo.online)
+	root.Keys[repo.keyID(second)] = NewTUFKey(second.Public().(ed25519.PublicKey))
+	root.Roles[TUFRoleTargets] = TUFRole{KeyIDs: []string{repo.keyID(repo.online), repo.keyID(second)}, Threshold: 2}
+	targets := TUFTargets{TUFHeader: NewTUFHeader(TUFRoleTargets, 1, time.Now().Add(time.Hour))}
+
+	var out TUFTargets
+	if err := VerifyTUF(repo.sign(targets, repo.online, second), &root, TUFRoleTargets, &out); err != nil {
+		t.Fatalf("VerifyTUF() with both keys = %v", err)
+	}
+	// One key's signature listed twice counts once
+	if err := VerifyTUF(repo.sign(targets, repo.online, repo.online), &root, TUFRoleTargets, &out); err == nil {
+		t.Fatal("VerifyTUF() counted one key twice")
+	}
+	// A key of the root role can't sign for targets
+	if err := VerifyTUF(repo.sign(targets, repo.online, repo.rootKey), &root, TUFRoleTargets, &out); err == nil {
+		t.Fatal("VerifyTUF() accepted a key not listed for the role")
+	}
+}
+
+func TestNewTUFClientBootstrap(t *testing.T) {
+	repo := newTUFRepo(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	if _, err := NewTUFClient(repo.srv.URL, t.TempDir(), nil, logger); err == nil {
+		t.Error("NewTUFClient() without a root succeeded")
+	}
+	// A root signed by a key it doesn't list isn't self-consistent
+	_, other := newTestKey(t)
+	if _, err := NewTUFClient(repo.srv.URL, t.TempDir(), repo.sign(repo.root, other), logger); err == nil {
+		t.Error("NewTUFClient() accepted a root not signed by its own keys")
+	}
+
+	// Once a root is stored the bootstrap is ignored
+	dir := t.TempDir()
+	repo.client(dir)
+	if !HasTrustedRoot(dir) {
+		t.Fatal("no trusted root stored")
+	}
+	if _, err := NewTUFClient(repo.srv.URL, dir, []byte("ignored"), logger); err != nil {
+		t.Errorf("NewTUFClient() with a stored root = %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, TUFRoleRoot+".json")); string(data) == "ignored" {
+		t.Error("the bootstrap root replaced the stored one")
+	}
+}
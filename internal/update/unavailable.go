@@ -0,0 +1,58 @@
+package update
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// UnavailableError is returned when the server answers 429 Too Many Requests
+// or 503 Service Unavailable, e.g. while shedding load or in maintenance
+// mode. Clients should not try again before RetryAfter has passed; zero means
+// the server didn't say.
+type UnavailableError struct {
+	Status     int
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	what := "server is unavailable"
+	if e.Status == http.StatusTooManyRequests {
+		what = "server is rate limiting"
+	}
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s, retry after %s", what, e.RetryAfter)
+	}
+	return what
+}
+
+// checkStatus turns a non-200 response into an error
+func checkStatus(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return &UnavailableError{
+			Status:     resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	default:
+		return fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+}
+
+// parseRetryAfter decodes a Retry-After header, given either as seconds or
+// as an HTTP date; anything else is zero
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now).Round(time.Second)
+	}
+	return 0
+}
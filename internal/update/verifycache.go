@@ -0,0 +1,136 @@
+package update
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// VerifyCacheFile is the name of the verification cache in the state
+// directory
+const VerifyCacheFile = "verified.json"
+
+const (
+	// verifyCacheTTL is how long a verification is remembered
+	verifyCacheTTL = 30 * 24 * time.Hour
+	// maxVerifyCacheEntries bounds the cache; the oldest entries go first
+	maxVerifyCacheEntries = 256
+)
+
+// VerifyCache remembers successful signature verifications, so checking the
+// same manifest or asset again doesn't redo them. An entry is identified by
+// everything the verification depended on: the kind of check, the trusted
+// keys, the signed content, and the signatures. Changing any of them, such as
+// removing a key from the trust store, misses the cache. A nil cache
+// remembers nothing.
+type VerifyCache struct {
+	mu   sync.Mutex
+	path string
+}
+
+type verifyCacheEntry struct {
+	Verified time.Time `json:"verified"`
+	// Signers are the base64 keys whose signatures verified
+	Signers []string `json:"signers,omitempty"`
+}
+
+// NewVerifyCache returns the cache stored at path
+func NewVerifyCache(path string) *VerifyCache {
+	return &VerifyCache{path: path}
+}
+
+// verifyCacheID identifies a verification by its inputs
+func verifyCacheID(kind string, inputs ...[]byte) string {
+	h := sha256.New()
+	h.Write([]byte(kind))
+	for _, input := range inputs {
+		// Length prefixes keep different splits of the same bytes apart
+		binary.Write(h, binary.BigEndian, uint64(len(input)))
+		h.Write(input)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *VerifyCache) read() map[string]verifyCacheEntry {
+	entries := make(map[string]verifyCacheEntry)
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return entries
+	}
+	// A corrupt cache is as good as an empty one
+	json.Unmarshal(data, &entries)
+	return entries
+}
+
+// lookup returns the signers of a remembered verification
+func (c *VerifyCache) lookup(id string, now time.Time) ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.read()[id]
+	if !ok || now.Sub(entry.Verified) > verifyCacheTTL || entry.Verified.After(now) {
+		return nil, false
+	}
+	return entry.Signers, true
+}
+
+// record remembers a successful verification. The cache is an optimization,
+// so failing to write it is not an error.
+func (c *VerifyCache) record(id string, signers []string, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := c.read()
+	entries[id] = verifyCacheEntry{Verified: now, Signers: signers}
+	for id, entry := range entries {
+		if now.Sub(entry.Verified) > verifyCacheTTL {
+			delete(entries, id)
+		}
+	}
+	for len(entries) > maxVerifyCacheEntries {
+		var oldest string
+		for id, entry := range entries {
+			if oldest == "" || entry.Verified.Before(entries[oldest].Verified) {
+				oldest = id
+			}
+		}
+		delete(entries, oldest)
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+	}
+}
+
+// Clear forgets every remembered verification
+func (c *VerifyCache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
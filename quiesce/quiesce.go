@@ -0,0 +1,148 @@
+// Package quiesce is the two-phase commit between nametag-up and a service
+// that can't be restarted blindly. Before swapping the binary, the updater
+// asks the service over its admin socket to quiesce and waits for the
+// acknowledgment; after the swap it tells the service to restart into the
+// new binary, or to resume when the update was aborted.
+//
+// The protocol is one JSON request and one JSON response per connection
+// over a Unix domain socket:
+//
+//	{"op":"quiesce","version":"1.2.0"}
+//	{"ok":true}
+package quiesce
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// Operations the updater sends
+const (
+	// OpQuiesce asks the service to stop taking new work and finish what is
+	// in flight; the acknowledgment means it is safe to swap the binary
+	OpQuiesce = "quiesce"
+	// OpResume tells a quiesced service the update was aborted and it keeps
+	// running as it is
+	OpResume = "resume"
+	// OpRestart tells a quiesced service the binary was swapped and it
+	// should restart into it, e.g. by re-executing itself
+	OpRestart = "restart"
+)
+
+// maxMessageSize caps requests and responses
+const maxMessageSize = 64 << 10
+
+// Request is what the updater sends
+type Request struct {
+	Op string `json:"op"`
+	// Version is the version being installed, for the service's logs
+	Version string `json:"version,omitempty"`
+}
+
+// Response acknowledges a request, or says why it failed
+type Response struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Handler is implemented by services taking part in the protocol. Each
+// method returns once the operation is done; Quiesce may take as long as
+// draining takes, up to the updater's timeout.
+type Handler interface {
+	Quiesce(ctx context.Context, version string) error
+	Resume(ctx context.Context) error
+	Restart(ctx context.Context) error
+}
+
+// Serve listens on the admin socket at path, replacing a stale one, and
+// handles the updater's requests until ctx is done. The socket is only
+// accessible to the service's user.
+func Serve(ctx context.Context, path string, h Handler) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("listen on admin socket: %w", err)
+	}
+	defer l.Close()
+	if err := os.Chmod(path, 0600); err != nil {
+		return fmt.Errorf("restrict admin socket: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("accept: %w", err)
+		}
+		go serveConn(ctx, conn, h)
+	}
+}
+
+func serveConn(ctx context.Context, conn net.Conn, h Handler) {
+	defer conn.Close()
+
+	var req Request
+	if err := json.NewDecoder(io.LimitReader(conn, maxMessageSize)).Decode(&req); err != nil {
+		return
+	}
+
+	var err error
+	switch req.Op {
+	case OpQuiesce:
+		err = h.Quiesce(ctx, req.Version)
+	case OpResume:
+		err = h.Resume(ctx)
+	case OpRestart:
+		err = h.Restart(ctx)
+	default:
+		err = fmt.Errorf("unknown op %q", req.Op)
+	}
+
+	resp := Response{OK: err == nil}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+// Send sends req to the service listening at path and waits for its
+// acknowledgment until ctx is done
+func Send(ctx context.Context, path string, req Request) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return fmt.Errorf("connect to admin socket: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("send %s: %w", req.Op, err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(io.LimitReader(conn, maxMessageSize)).Decode(&resp); err != nil {
+		return fmt.Errorf("read %s acknowledgment: %w", req.Op, err)
+	}
+	if !resp.OK {
+		return fmt.Errorf("service refused %s: %s", req.Op, resp.Error)
+	}
+	return nil
+}